@@ -0,0 +1,47 @@
+package apns
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNewApnsId(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id := NewApnsId()
+		if !isValidApnsId(id) || id[14] != '4' || (id[19] != '8' && id[19] != '9' && id[19] != 'a' && id[19] != 'b') {
+			t.Error(fmt.Sprintf("Expected a version 4 uuid but got %v", id))
+		}
+		if seen[id] {
+			t.Error(fmt.Sprintf("Duplicate id %v", id))
+		}
+		seen[id] = true
+	}
+}
+
+func TestIsValidApnsId(t *testing.T) {
+	valid := []string{"123e4567-e89b-12d3-a456-426614174000", "EC1BF194-B3B2-424A-89A9-5A918A6E6B5C"}
+	invalid := []string{
+		"",
+		"123e4567e89b12d3a456426614174000",
+		"{123e4567-e89b-12d3-a456-426614174000}",
+		"123e4567-e89b-12d3-a456-42661417400",
+		"123e4567-e89b-12d3-a456_426614174000",
+		"123e4567-e89b-12d3-a456-42661417400g",
+	}
+	for _, id := range valid {
+		if !isValidApnsId(id) {
+			t.Error(fmt.Sprintf("Expected %v to be valid", id))
+		}
+	}
+	for _, id := range invalid {
+		if isValidApnsId(id) {
+			t.Error(fmt.Sprintf("Expected %v to be invalid", id))
+		}
+	}
+
+	p := &Payload{Token: validateTestToken, AlertText: "Testing", ApnsId: "nope"}
+	if err := p.Validate(); err == nil {
+		t.Error("Expected Validate to reject an invalid apns id")
+	}
+}
@@ -0,0 +1,103 @@
+package apnstest
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Binary protocol frame item ids
+const (
+	itemToken      = 1
+	itemPayload    = 2
+	itemIdentifier = 3
+	itemExpiration = 4
+	itemPriority   = 5
+)
+
+func normalizeToken(token string) string {
+	return strings.ToLower(token)
+}
+
+func (s *Server) acceptBinary() {
+	for {
+		conn, err := s.binaryListener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveBinary(conn, s.accepted(conn))
+	}
+}
+
+// Read notifications until the connection closes, is dropped or a
+// notification is rejected
+func (s *Server) serveBinary(conn net.Conn, number int) {
+	defer s.forget(conn)
+	defer conn.Close()
+	dropAfter := s.nextDropAfter()
+	for read := 0; read != dropAfter; read++ {
+		notification, err := readBinaryNotification(conn)
+		if err != nil {
+			return
+		}
+		notification.Connection = number
+		notification.Status = http.StatusOK
+
+		reason, delay := s.scripted(notification.Token)
+		if reason == "" {
+			s.keep(notification)
+			continue
+		}
+		status, _, binaryStatus := rejection(reason)
+		notification.Status = status
+		notification.Reason = reason
+		s.keep(notification)
+		time.Sleep(delay)
+		response := []byte{8, binaryStatus, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(response[2:], notification.Identifier)
+		conn.Write(response)
+		return
+	}
+}
+
+// Read a command 2 frame into a notification
+func readBinaryNotification(conn net.Conn) (Notification, error) {
+	notification := Notification{Protocol: ProtocolBinary}
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return notification, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		return notification, err
+	}
+	notification.ReceivedAt = time.Now()
+	for len(frame) >= 3 {
+		id := frame[0]
+		length := int(binary.BigEndian.Uint16(frame[1:3]))
+		if len(frame) < 3+length {
+			//go-libapns has always sent a 1 byte priority with a length of
+			//4, so take what's left of the frame
+			length = len(frame) - 3
+		}
+		item := frame[3 : 3+length]
+		frame = frame[3+length:]
+		switch {
+		case id == itemToken:
+			notification.Token = hex.EncodeToString(item)
+		case id == itemPayload:
+			notification.Payload = append([]byte(nil), item...)
+		case id == itemIdentifier && length == 4:
+			notification.Identifier = binary.BigEndian.Uint32(item)
+		case id == itemExpiration && length == 4:
+			notification.Expiration = int64(binary.BigEndian.Uint32(item))
+		case id == itemPriority && length >= 1:
+			notification.Priority = int(item[length-1])
+		}
+	}
+	return notification, nil
+}
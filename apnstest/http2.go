@@ -0,0 +1,113 @@
+package apnstest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const devicePath = "/3/device/"
+
+// Answer a notification request as apple does: 200 with its apns-id, or
+// an error status with a json reason
+func (s *Server) serveHTTP2(w http.ResponseWriter, r *http.Request) {
+	notification := Notification{
+		Protocol:   ProtocolHTTP2,
+		ApnsID:     r.Header.Get("apns-id"),
+		Topic:      r.Header.Get("apns-topic"),
+		CollapseID: r.Header.Get("apns-collapse-id"),
+		PushType:   r.Header.Get("apns-push-type"),
+		Header:     r.Header.Clone(),
+		ReceivedAt: time.Now(),
+	}
+	notification.Connection, _ = r.Context().Value(connNumberKey{}).(int)
+	notification.Priority, _ = strconv.Atoi(r.Header.Get("apns-priority"))
+	notification.Expiration, _ = strconv.ParseInt(r.Header.Get("apns-expiration"), 10, 64)
+	notification.Payload, _ = io.ReadAll(r.Body)
+	if notification.ApnsID == "" {
+		notification.ApnsID = newApnsID()
+	}
+	w.Header().Set("apns-id", notification.ApnsID)
+
+	if r.Method != http.MethodPost {
+		//not a notification, e.g. a health check, so it isn't kept
+		writeResponse(w, http.StatusMethodNotAllowed, "MethodNotAllowed", 0)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, devicePath) || len(r.URL.Path) == len(devicePath) {
+		s.respond(w, notification, http.StatusNotFound, "BadPath", 0)
+		return
+	}
+	notification.Token = normalizeToken(strings.TrimPrefix(r.URL.Path, devicePath))
+
+	reason, delay := s.scripted(notification.Token)
+	time.Sleep(delay)
+	if status, retryAfter, ok := s.throttled(); ok {
+		reason := "TooManyRequests"
+		if status == http.StatusServiceUnavailable {
+			reason = "ServiceUnavailable"
+		}
+		s.respond(w, notification, status, reason, retryAfter)
+		return
+	}
+	if reason != "" {
+		status, http2Reason, _ := rejection(reason)
+		s.respond(w, notification, status, http2Reason, 0)
+		return
+	}
+	s.respond(w, notification, http.StatusOK, "", 0)
+}
+
+// Take one of the requests left to throttle, if any
+func (s *Server) throttled() (int, time.Duration, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.throttleCount <= 0 {
+		return 0, 0, false
+	}
+	s.throttleCount--
+	return s.throttleStatus, s.retryAfter, true
+}
+
+// Write the response and keep the notification with it
+func (s *Server) respond(w http.ResponseWriter, notification Notification, status int, reason string, retryAfter time.Duration) {
+	notification.Status = status
+	notification.Reason = reason
+	s.keep(notification)
+	writeResponse(w, status, reason, retryAfter)
+}
+
+// Write a response with apple's json reason for an error status
+func writeResponse(w http.ResponseWriter, status int, reason string, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		seconds := (retryAfter + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", fmt.Sprint(int64(seconds)))
+	}
+	if status == http.StatusOK {
+		return
+	}
+	body := map[string]interface{}{"reason": reason}
+	if status == http.StatusGone {
+		body["timestamp"] = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// A random (version 4) UUID, as apple generates for a request without an
+// apns-id
+func newApnsID() string {
+	var uuid [16]byte
+	rand.Read(uuid[:])
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	id := hex.EncodeToString(uuid[:])
+	return id[0:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:]
+}
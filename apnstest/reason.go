@@ -0,0 +1,101 @@
+package apnstest
+
+import "net/http"
+
+// HTTP/2 status for each reason apple gives, see its "Handling
+// notification responses from APNs"
+var reasonStatus = map[string]int{
+	"BadCollapseId":               http.StatusBadRequest,
+	"BadDeviceToken":              http.StatusBadRequest,
+	"BadExpirationDate":           http.StatusBadRequest,
+	"BadMessageId":                http.StatusBadRequest,
+	"BadPriority":                 http.StatusBadRequest,
+	"BadTopic":                    http.StatusBadRequest,
+	"DeviceTokenNotForTopic":      http.StatusBadRequest,
+	"DuplicateHeaders":            http.StatusBadRequest,
+	"IdleTimeout":                 http.StatusBadRequest,
+	"InvalidPushType":             http.StatusBadRequest,
+	"MissingDeviceToken":          http.StatusBadRequest,
+	"MissingTopic":                http.StatusBadRequest,
+	"PayloadEmpty":                http.StatusBadRequest,
+	"TopicDisallowed":             http.StatusBadRequest,
+	"BadCertificate":              http.StatusForbidden,
+	"BadCertificateEnvironment":   http.StatusForbidden,
+	"ExpiredProviderToken":        http.StatusForbidden,
+	"Forbidden":                   http.StatusForbidden,
+	"InvalidProviderToken":        http.StatusForbidden,
+	"MissingProviderToken":        http.StatusForbidden,
+	"UnrelatedKeyIdInToken":       http.StatusForbidden,
+	"BadPath":                     http.StatusNotFound,
+	"MethodNotAllowed":            http.StatusMethodNotAllowed,
+	"ExpiredToken":                http.StatusGone,
+	"Unregistered":                http.StatusGone,
+	"PayloadTooLarge":             http.StatusRequestEntityTooLarge,
+	"TooManyProviderTokenUpdates": http.StatusTooManyRequests,
+	"TooManyRequests":             http.StatusTooManyRequests,
+	"InternalServerError":         http.StatusInternalServerError,
+	"ServiceUnavailable":          http.StatusServiceUnavailable,
+	"Shutdown":                    http.StatusServiceUnavailable,
+}
+
+// Binary protocol status for each reason, either the binary status name
+// or the HTTP/2 reason closest to one
+var reasonBinaryStatus = map[string]uint8{
+	"PROCESSING_ERROR":       1,
+	"MISSING_DEVICE_TOKEN":   2,
+	"MISSING_TOPIC":          3,
+	"MISSING_PAYLOAD":        4,
+	"INVALID_TOKEN_SIZE":     5,
+	"INVALID_TOPIC_SIZE":     6,
+	"INVALID_PAYLOAD_SIZE":   7,
+	"INVALID_TOKEN":          8,
+	"SHUTDOWN":               10,
+	"UNKNOWN":                255,
+	"MissingDeviceToken":     2,
+	"MissingTopic":           3,
+	"PayloadEmpty":           4,
+	"PayloadTooLarge":        7,
+	"BadDeviceToken":         8,
+	"DeviceTokenNotForTopic": 8,
+	"ExpiredToken":           8,
+	"Unregistered":           8,
+	"BadTopic":               6,
+	"TopicDisallowed":        6,
+	"Shutdown":               10,
+	"ServiceUnavailable":     10,
+}
+
+// Binary status names, for HTTP/2 responses to a binary reason
+var binaryStatusReason = map[uint8]string{
+	1:   "InternalServerError",
+	2:   "MissingDeviceToken",
+	3:   "MissingTopic",
+	4:   "PayloadEmpty",
+	5:   "BadDeviceToken",
+	6:   "BadTopic",
+	7:   "PayloadTooLarge",
+	8:   "BadDeviceToken",
+	10:  "Shutdown",
+	255: "InternalServerError",
+}
+
+// The HTTP/2 status and reason, and binary status, to reject with reason
+// A binary status name is answered over HTTP/2 with the closest reason,
+// and an unknown reason with a 400 and PROCESSING_ERROR
+func rejection(reason string) (int, string, uint8) {
+	binaryStatus, ok := reasonBinaryStatus[reason]
+	if !ok {
+		binaryStatus = 1
+	}
+	http2Reason := reason
+	if _, ok := reasonStatus[reason]; !ok {
+		if name, ok := binaryStatusReason[reasonBinaryStatus[reason]]; ok {
+			http2Reason = name
+		}
+	}
+	status, ok := reasonStatus[http2Reason]
+	if !ok {
+		status = http.StatusBadRequest
+	}
+	return status, http2Reason, binaryStatus
+}
@@ -0,0 +1,323 @@
+// Package apnstest provides a mock APNs gateway for testing code that
+// sends push notifications, speaking both the binary protocol and HTTP/2
+// It records every notification it receives for assertions, and can be
+// scripted to reject tokens, delay responses, drop connections or
+// throttle requests
+//
+//	server, err := apnstest.NewServer()
+//	...
+//	defer server.Close()
+//	host, port, _ := net.SplitHostPort(server.BinaryAddr())
+//	conn, err := apns.NewAPNSConnection(&apns.APNSConfig{
+//		CertificateBytes: server.ClientCertPEM,
+//		KeyBytes:         server.ClientKeyPEM,
+//		RootCAs:          server.RootCAs,
+//		GatewayHost:      host,
+//		GatewayPort:      port,
+//	})
+package apnstest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Which protocol a notification was received over
+type Protocol string
+
+const (
+	ProtocolBinary Protocol = "binary"
+	ProtocolHTTP2  Protocol = "http2"
+)
+
+// A notification the server received
+type Notification struct {
+	Protocol Protocol
+	// Hex encoded device token
+	Token string
+	// The json payload
+	Payload []byte
+	// Binary protocol identifier, the id an error response refers to
+	Identifier uint32
+	// The priority, 0 if not given
+	Priority int
+	// UNIX time in seconds the notification expires at, 0 if not given
+	Expiration int64
+	// HTTP/2 headers: apns-id, apns-topic, apns-collapse-id and apns-push-type
+	ApnsID     string
+	Topic      string
+	CollapseID string
+	PushType   string
+	// Every HTTP/2 request header, nil for the binary protocol
+	Header http.Header
+	// Number of the connection it arrived on, counting from 1 in the order
+	// connections were accepted
+	Connection int
+	// How the server answered: the HTTP/2 status, or for the binary
+	// protocol 200 unless it was rejected with an error response
+	Status int
+	// The reason it was rejected with, empty if it wasn't
+	Reason     string
+	ReceivedAt time.Time
+}
+
+// Mock APNs gateway listening on local ports, with TLS certificates from
+// a throwaway CA
+// Binary protocol connections must present a client certificate, any is
+// accepted (e.g. ClientCertPEM, or a real push certificate). HTTP/2
+// requests may use either a client certificate or a provider token,
+// which isn't checked
+// Safe for concurrent use
+type Server struct {
+	// Authorities to verify the server with, set as APNSConfig.RootCAs or
+	// HTTP2Config.RootCAs
+	RootCAs *x509.CertPool
+	// Client push certificate and key signed by the CA, for ClientTopic
+	ClientCertPEM []byte
+	ClientKeyPEM  []byte
+
+	binaryListener net.Listener
+	http2Listener  net.Listener
+	http2Server    *http.Server
+
+	lock        *sync.Mutex
+	changed     *sync.Cond
+	received    []Notification
+	connections int
+	conns       map[net.Conn]bool
+	closed      bool
+
+	rejected        map[string]string
+	delay           time.Duration
+	dropAfter       int
+	dropConnections int
+	throttleCount   int
+	throttleStatus  int
+	retryAfter      time.Duration
+}
+
+// Start a server listening on loopback ports chosen by the system
+func NewServer() (*Server, error) {
+	certs, err := newCertificates()
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		RootCAs:       certs.roots,
+		ClientCertPEM: certs.clientCertPEM,
+		ClientKeyPEM:  certs.clientKeyPEM,
+		lock:          new(sync.Mutex),
+		conns:         make(map[net.Conn]bool),
+		rejected:      make(map[string]string),
+	}
+	s.changed = sync.NewCond(s.lock)
+
+	s.binaryListener, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certs.server},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.http2Listener, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certs.server},
+		ClientAuth:   tls.RequestClientCert,
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		s.binaryListener.Close()
+		return nil, err
+	}
+	s.http2Server = &http.Server{
+		Handler:     http.HandlerFunc(s.serveHTTP2),
+		ConnState:   s.trackHTTP2Conn,
+		ConnContext: s.http2ConnContext,
+	}
+	go s.acceptBinary()
+	go s.http2Server.Serve(s.http2Listener)
+	return s, nil
+}
+
+// Host and port of the binary protocol gateway, for APNSConfig's
+// GatewayHost and GatewayPort
+func (s *Server) BinaryAddr() string {
+	return s.binaryListener.Addr().String()
+}
+
+// Host and port of the HTTP/2 gateway, for HTTP2Config's Host and Port
+func (s *Server) HTTP2Addr() string {
+	return s.http2Listener.Addr().String()
+}
+
+// Stop listening and drop every open connection
+func (s *Server) Close() {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+	s.binaryListener.Close()
+	s.http2Server.Close()
+	s.CloseConnections()
+	s.lock.Lock()
+	s.changed.Broadcast()
+	s.lock.Unlock()
+}
+
+// Drop every open connection without a response, as if the gateway died,
+// while still accepting new ones
+func (s *Server) CloseConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Reject notifications to token (hex, in any case) with reason, one of
+// apple's HTTP/2 reasons (e.g. BadDeviceToken, Unregistered) or binary
+// statuses (e.g. INVALID_TOKEN). Each protocol answers with its closest
+// equivalent, and the binary protocol then closes the connection as
+// apple does
+func (s *Server) RejectToken(token string, reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rejected[normalizeToken(token)] = reason
+}
+
+// Wait d before each HTTP/2 response and binary error response
+func (s *Server) SetDelay(d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.delay = d
+}
+
+// Drop each of the next connections binary protocol connections once it
+// has sent notifications notifications, without a response, -1 for every
+// connection from now on and 0 to stop
+func (s *Server) DropAfter(notifications int, connections int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dropAfter = notifications
+	s.dropConnections = connections
+}
+
+// Answer the next count HTTP/2 requests with status (e.g. 429 or 503) and
+// a Retry-After of retryAfter, rounded up to whole seconds, or none if 0
+func (s *Server) Throttle(count int, status int, retryAfter time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.throttleCount = count
+	s.throttleStatus = status
+	s.retryAfter = retryAfter
+}
+
+// Forget the notifications received and every scripted behavior
+func (s *Server) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.received = nil
+	s.rejected = make(map[string]string)
+	s.delay = 0
+	s.dropAfter, s.dropConnections = 0, 0
+	s.throttleCount = 0
+}
+
+// Every notification received, in the order received
+func (s *Server) Received() []Notification {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Notification(nil), s.received...)
+}
+
+// Wait until count notifications have been received, returning them all
+// Returns an error with those received if the timeout passes first
+func (s *Server) WaitForNotifications(count int, timeout time.Duration) ([]Notification, error) {
+	timer := time.AfterFunc(timeout, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.changed.Broadcast()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.received) < count && !s.closed && time.Now().Before(deadline) {
+		s.changed.Wait()
+	}
+	received := append([]Notification(nil), s.received...)
+	if len(received) < count {
+		return received, errors.New(fmt.Sprintf("Expected %v notifications but got %v", count, len(received)))
+	}
+	return received, nil
+}
+
+// Number of connections accepted over both protocols
+func (s *Server) Connections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.connections
+}
+
+// Count and keep hold of a new connection, returning its number
+func (s *Server) accepted(conn net.Conn) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.connections++
+	s.conns[conn] = true
+	return s.connections
+}
+
+func (s *Server) forget(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, conn)
+}
+
+// The reason to reject notifications to token with, if any, and the
+// delay before answering
+func (s *Server) scripted(token string) (string, time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rejected[token], s.delay
+}
+
+// Keep a notification once it's been answered
+func (s *Server) keep(notification Notification) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.received = append(s.received, notification)
+	s.changed.Broadcast()
+}
+
+// Number of notifications a new binary connection is dropped after, -1
+// if it isn't
+func (s *Server) nextDropAfter() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.dropConnections == 0 {
+		return -1
+	}
+	if s.dropConnections > 0 {
+		s.dropConnections--
+	}
+	return s.dropAfter
+}
+
+type connNumberKey struct{}
+
+func (s *Server) http2ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connNumberKey{}, s.accepted(conn))
+}
+
+func (s *Server) trackHTTP2Conn(conn net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		s.forget(conn)
+	}
+}
@@ -0,0 +1,190 @@
+package apnstest_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+	"github.com/joekarl/go-libapns/apnstest"
+)
+
+func newTestServer(t *testing.T) *apnstest.Server {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+func binaryConfig(server *apnstest.Server) *apns.APNSConfig {
+	host, port, _ := net.SplitHostPort(server.BinaryAddr())
+	return &apns.APNSConfig{
+		CertificateBytes:       server.ClientCertPEM,
+		KeyBytes:               server.ClientKeyPEM,
+		RootCAs:                server.RootCAs,
+		GatewayHost:            host,
+		GatewayPort:            port,
+		IgnoreProxyEnvironment: true,
+		FramingTimeout:         1,
+	}
+}
+
+func http2Config(t *testing.T, server *apnstest.Server) *apns.HTTP2Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(server.HTTP2Addr())
+	return &apns.HTTP2Config{
+		AuthKeyBytes:           pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+		KeyID:                  "ABC123DEFG",
+		TeamID:                 "DEF123GHIJ",
+		Topic:                  apnstest.ClientTopic,
+		Host:                   host,
+		Port:                   port,
+		RootCAs:                server.RootCAs,
+		IgnoreProxyEnvironment: true,
+		MaxThrottleRetries:     -1,
+	}
+}
+
+func testPayload(i int) *apns.Payload {
+	return &apns.Payload{
+		AlertText: fmt.Sprintf("Testing%v", i),
+		Token:     fmt.Sprintf("4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c%02x", i),
+	}
+}
+
+func TestServerShouldRecordAndRejectBinaryNotifications(t *testing.T) {
+	server := newTestServer(t)
+	conn, err := apns.NewAPNSConnection(binaryConfig(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := testPayload(0)
+	first.Priority = apns.PriorityThrottled
+	first.ExpirationTime = 4000000000
+	rejected := testPayload(1)
+	server.RejectToken(rejected.Token, "BadDeviceToken")
+	conn.SendChannel <- first
+	conn.SendChannel <- rejected
+	connectionClose := <-conn.CloseChannel
+
+	if connectionClose.Error.ErrorCode != 8 || connectionClose.ErrorPayload != rejected {
+		t.Error(fmt.Sprintf("Expected the token to be rejected but got %v", connectionClose))
+	}
+	received := server.Received()
+	if len(received) != 2 {
+		t.Fatal(fmt.Sprintf("Expected both notifications to be recorded but got %+v", received))
+	}
+	if n := received[0]; n.Protocol != apnstest.ProtocolBinary || n.Token != first.Token || n.Priority != 5 ||
+		n.Expiration != 4000000000 || string(n.Payload) != `{"aps":{"alert":"Testing0"}}` || n.Status != http.StatusOK {
+		t.Error(fmt.Sprintf("Expected the first notification's fields but got %+v", n))
+	}
+	if n := received[1]; n.Identifier != 1 || n.Reason != "BadDeviceToken" || n.Connection != 1 {
+		t.Error(fmt.Sprintf("Expected the rejection to be recorded but got %+v", n))
+	}
+}
+
+func TestServerShouldDropBinaryConnections(t *testing.T) {
+	server := newTestServer(t)
+	server.DropAfter(1, 1)
+	conn, err := apns.NewAPNSConnection(binaryConfig(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SendChannel <- testPayload(0)
+	conn.SendChannel <- testPayload(1)
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.Error.ErrorCode != 10 {
+		t.Error(fmt.Sprintf("Expected the connection to be dropped but got %v", connectionClose))
+	}
+
+	//only the first connection is dropped
+	conn, err = apns.NewAPNSConnection(binaryConfig(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+	for i := 2; i < 5; i++ {
+		conn.SendChannel <- testPayload(i)
+	}
+	received, err := server.WaitForNotifications(4, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received[1].Connection != 2 || server.Connections() != 2 {
+		t.Error(fmt.Sprintf("Expected the rest on a second connection but got %+v", received))
+	}
+}
+
+func TestServerShouldAnswerHTTP2Requests(t *testing.T) {
+	server := newTestServer(t)
+	conn, err := apns.NewHTTP2Connection(http2Config(t, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	accepted := testPayload(0)
+	accepted.CollapseId = "score"
+	result, err := conn.Send(context.Background(), accepted)
+	if err != nil || !result.Accepted() {
+		t.Fatal(fmt.Sprintf("Expected the notification to be accepted but got %+v, %v", result, err))
+	}
+	unregistered := testPayload(1)
+	server.RejectToken(unregistered.Token, "Unregistered")
+	result, err = conn.Send(context.Background(), unregistered)
+	if err != nil || result.StatusCode != http.StatusGone || result.Reason != apns.ReasonUnregistered || result.Timestamp.IsZero() {
+		t.Error(fmt.Sprintf("Expected the token to be unregistered but got %+v, %v", result, err))
+	}
+	server.Throttle(1, http.StatusTooManyRequests, time.Second)
+	result, err = conn.Send(context.Background(), testPayload(2))
+	if err == nil || result.StatusCode != http.StatusTooManyRequests || result.Throttled[0].RetryAfter != time.Second {
+		t.Error(fmt.Sprintf("Expected the request to be throttled but got %+v, %v", result, err))
+	}
+
+	received := server.Received()
+	if len(received) != 3 {
+		t.Fatal(fmt.Sprintf("Expected every request to be recorded but got %+v", received))
+	}
+	if n := received[0]; n.Protocol != apnstest.ProtocolHTTP2 || n.Token != accepted.Token || n.Topic != apnstest.ClientTopic ||
+		n.CollapseID != "score" || n.ApnsID == "" || n.Header.Get("authorization") == "" {
+		t.Error(fmt.Sprintf("Expected the request's headers but got %+v", n))
+	}
+	if received[2].Status != http.StatusTooManyRequests || received[2].Header.Get("apns-id") == "" {
+		t.Error(fmt.Sprintf("Expected the throttled request to be recorded but got %+v", received[2]))
+	}
+}
+
+func TestServerShouldDelayResponses(t *testing.T) {
+	server := newTestServer(t)
+	server.SetDelay(100 * time.Millisecond)
+	conn, err := apns.NewHTTP2Connection(http2Config(t, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if _, err := conn.Send(context.Background(), testPayload(0)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Error(fmt.Sprintf("Expected the response to be delayed but it took %v", elapsed))
+	}
+}
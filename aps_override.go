@@ -0,0 +1,51 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Builds the aps dictionary of a payload in place of the library, set as
+// Payload.ApsOverride, e.g. to use aps keys apple has added since
+type ApsMarshaler interface {
+	// The json object to send as "aps"
+	MarshalAps() ([]byte, error)
+}
+
+// An aps dictionary as fully formed json, e.g.
+// apns.RawAps(`{"alert":"hi","interruption-level":"time-sensitive"}`)
+type RawAps []byte
+
+func (r RawAps) MarshalAps() ([]byte, error) {
+	return r, nil
+}
+
+// Writes an overridden aps dictionary as is. There's no alert text to
+// truncate, so a payload too long with it fails
+type overrideAps struct {
+	json []byte
+}
+
+func (o *overrideAps) writeJson(buffer *bytes.Buffer) truncatableText {
+	buffer.Write(o.json)
+	return noTruncatableText
+}
+
+// Marshal the payload's ApsOverride, checking it's a json object and
+// isn't mixed with the aps fields it replaces
+func (p *Payload) marshalApsOverride() (*overrideAps, error) {
+	if p.AlertText != "" || !p.AlertBody.isEmpty() || p.Badge.IsSet() || p.Sound != "" ||
+		p.Category != "" || p.ContentAvailable != 0 {
+		return nil, errors.New("Cannot set ApsOverride along with alert, badge, sound, category, or content available")
+	}
+	apsJson, err := p.ApsOverride.MarshalAps()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to marshal ApsOverride: %v", err))
+	}
+	if trimmed := bytes.TrimSpace(apsJson); len(trimmed) == 0 || trimmed[0] != '{' || !json.Valid(trimmed) {
+		return nil, errors.New("ApsOverride is not a json object")
+	}
+	return &overrideAps{json: bytes.TrimSpace(apsJson)}, nil
+}
@@ -0,0 +1,100 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type testApsMarshaler struct {
+	level string
+}
+
+func (m testApsMarshaler) MarshalAps() ([]byte, error) {
+	if m.level == "" {
+		return nil, errors.New("no level")
+	}
+	return []byte(`{"alert":"hi","interruption-level":"` + m.level + `"}`), nil
+}
+
+func TestApsOverrideShouldReplaceAps(t *testing.T) {
+	p := &Payload{
+		Token:        builderTestToken,
+		ApsOverride:  testApsMarshaler{"time-sensitive"},
+		CustomFields: map[string]interface{}{"k": "v"},
+	}
+	payloadJson, err := p.Marshal(MaxPayloadSizeAlert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"aps":{"alert":"hi","interruption-level":"time-sensitive"},"k":"v"}`
+	if string(payloadJson) != expected {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expected, string(payloadJson)))
+	}
+	if size, _ := p.Size(); size != len(expected) {
+		t.Error(fmt.Sprintf("Expected a size of %v but got %v", len(expected), size))
+	}
+	if err := p.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	p.ApsOverride = RawAps(" {\"content-available\":1}\n")
+	p.CustomFields = nil
+	if payloadJson, _ := p.Marshal(MaxPayloadSizeAlert); string(payloadJson) != `{"aps":{"content-available":1}}` {
+		t.Error(fmt.Sprintf("Expected the RawAps to be sent but got %v", string(payloadJson)))
+	}
+}
+
+func TestApsOverrideShouldNotTruncate(t *testing.T) {
+	p := &Payload{Token: builderTestToken, ApsOverride: RawAps(`{"alert":"` + strings.Repeat("x", 300) + `"}`)}
+	if _, err := p.Marshal(MaxPayloadSizeLegacy); err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Error(fmt.Sprintf("Expected the payload to be too long but got %v", err))
+	}
+	if _, err := p.Marshal(MaxPayloadSizeAlert); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApsOverrideShouldBeValidated(t *testing.T) {
+	cases := []struct {
+		expected string
+		payload  *Payload
+	}{
+		{"Failed to marshal ApsOverride", &Payload{ApsOverride: testApsMarshaler{}}},
+		{"not a json object", &Payload{ApsOverride: RawAps(`["alert"]`)}},
+		{"not a json object", &Payload{ApsOverride: RawAps(`{"alert":`)}},
+		{"along with alert", &Payload{ApsOverride: RawAps(`{}`), AlertText: "hi"}},
+		{"along with alert, badge", &Payload{ApsOverride: RawAps(`{}`), Badge: NewBadgeNumber(1)}},
+		{"or ApsOverride", &Payload{ApsOverride: RawAps(`{}`), RawPayload: []byte(`{"aps":{}}`)}},
+	}
+	for _, c := range cases {
+		p := c.payload
+		p.Token = builderTestToken
+		if _, err := p.Marshal(MaxPayloadSizeAlert); err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Error(fmt.Sprintf("Expected %q marshaling %+v but got %v", c.expected, p, err))
+		}
+		if err := p.Validate(); err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Error(fmt.Sprintf("Expected %q validating %+v but got %v", c.expected, p, err))
+		}
+	}
+}
+
+func TestApsOverrideShouldRoundTrip(t *testing.T) {
+	p := &Payload{Token: builderTestToken, ApsOverride: testApsMarshaler{"critical"}}
+	data, err := EncodePayload(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodePayload(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := p.Marshal(MaxPayloadSizeAlert)
+	if payloadJson, _ := decoded.Marshal(MaxPayloadSizeAlert); string(payloadJson) != string(expected) {
+		t.Error(fmt.Sprintf("Expected %v but got %v", string(expected), string(payloadJson)))
+	}
+	if clone := decoded.Clone(); &clone.ApsOverride.(RawAps)[0] == &decoded.ApsOverride.(RawAps)[0] {
+		t.Error("Expected Clone to copy a RawAps")
+	}
+}
@@ -0,0 +1,59 @@
+package apns
+
+import (
+	"fmt"
+	"time"
+)
+
+// A failed attempt at sending a payload, kept in an AttemptsExceededError
+type SendAttempt struct {
+	// When the attempt failed
+	Time time.Time
+	// Apple's reason, e.g. TooManyRequests, or SHUTDOWN for a dropped
+	// binary connection
+	Reason ErrorReason
+	// What went wrong
+	Err error
+}
+
+// A payload given up on after being sent MaxAttempts times (for
+// APNSReconnectingConnection, handed back more than MaxReplayAttempts
+// times), with every failed attempt. Passed to the DeadLetterHandler, and
+// returned by HTTP2Connection.Send
+type AttemptsExceededError struct {
+	// The payload that wasn't sent
+	Payload *Payload
+	// The limit it reached
+	MaxAttempts int
+	// Every failed attempt, oldest first
+	Attempts []SendAttempt
+	// The config setting the limit is from, for the message
+	setting string
+}
+
+func (e *AttemptsExceededError) Error() string {
+	last := e.Attempts[len(e.Attempts)-1]
+	return fmt.Sprintf("%v failed %d times, the most %v allows, last with %v",
+		e.Payload, len(e.Attempts), e.setting, last.Err)
+}
+
+// The last attempt's error
+func (e *AttemptsExceededError) Unwrap() error {
+	return e.Attempts[len(e.Attempts)-1].Err
+}
+
+// The Result of a payload apple read over the connection, counting the
+// connections that took it
+func (c *APNSConnection) acceptedResult(payload *Payload) *Result {
+	result := acceptedResult(payload)
+	result.Attempts = c.attempts(payload)
+	return result
+}
+
+// The Result of a payload apple rejected, counting the connections that
+// took it
+func (c *APNSConnection) rejectedResult(payload *Payload, appleError *AppleError) *Result {
+	result := rejectedResult(payload, appleError)
+	result.Attempts = c.attempts(payload)
+	return result
+}
@@ -0,0 +1,104 @@
+package apns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHTTP2SendShouldGiveUpAfterMaxAttempts(t *testing.T) {
+	server, _, app := newManagerTestApps(t)
+	app.HTTP2.MaxThrottleRetries = 100
+	app.HTTP2.ThrottleBackoff = 1
+	app.HTTP2.MaxAttempts = 3
+	conn, err := NewHTTP2Connection(app.HTTP2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, err := conn.Send(context.Background(), groupTestPayload(0))
+	if err != nil || accepted.Attempts != 1 {
+		t.Error(fmt.Sprintf("Expected one attempt but got %+v, %v", accepted, err))
+	}
+
+	payload := groupTestPayload(1)
+	server.RejectToken(payload.Token, "TooManyRequests")
+	result, err := conn.Send(context.Background(), payload)
+	exceeded := &AttemptsExceededError{}
+	if !errors.As(err, &exceeded) {
+		t.Fatal(fmt.Sprintf("Expected the payload to be given up on but got %v", err))
+	}
+	if exceeded.MaxAttempts != 3 || len(exceeded.Attempts) != 3 || exceeded.Payload != payload {
+		t.Error(fmt.Sprintf("Expected 3 attempts but got %+v", exceeded))
+	}
+	for i, attempt := range exceeded.Attempts {
+		if attempt.Reason != ReasonTooManyRequests || attempt.Time.IsZero() || attempt.Err == nil {
+			t.Error(fmt.Sprintf("Expected attempt %v to be throttled but got %+v", i, attempt))
+		}
+	}
+	if result == nil || result.Attempts != 3 || result.StatusCode != http.StatusTooManyRequests {
+		t.Error(fmt.Sprintf("Expected the last result but got %+v", result))
+	}
+	if received := len(server.Received()); received != 4 {
+		t.Error(fmt.Sprintf("Expected 4 posts but got %v", received))
+	}
+}
+
+func TestReconnectShouldDeadLetterAttemptHistory(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	recorder := newDeadLetterRecorder()
+	config := app.Pool.ConnectionConfig
+	config.DeadLetterHandler = recorder.handler
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig:   config,
+		ReconnectBaseDelay: 1,
+		MaxReplayAttempts:  2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//apple shutting down on every attempt hands the payload back each time
+	payload := groupTestPayload(0)
+	server.RejectToken(payload.Token, "SHUTDOWN")
+	conn.SendChannel <- payload
+	select {
+	case connectionClose := <-conn.CloseChannel:
+		if connectionClose.UnsentPayloads.Len() != 1 {
+			t.Error(fmt.Sprintf("Expected the payload to be passed on but got %+v", connectionClose))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the payload to be given up on")
+	}
+
+	letter := recorder.expect(t, 1)[payload]
+	exceeded := &AttemptsExceededError{}
+	if !errors.As(letter.lastReason, &exceeded) || letter.attempts != 3 {
+		t.Fatal(fmt.Sprintf("Expected the attempts to be exceeded but got %+v", letter))
+	}
+	if exceeded.MaxAttempts != 3 || len(exceeded.Attempts) != 3 {
+		t.Error(fmt.Sprintf("Expected 3 attempts but got %+v", exceeded))
+	}
+	for i, attempt := range exceeded.Attempts {
+		if attempt.Reason != BinaryReasonShutdown || attempt.Time.IsZero() {
+			t.Error(fmt.Sprintf("Expected attempt %v to be shut down but got %+v", i, attempt))
+		}
+	}
+
+	conn.Close()
+	for range conn.CloseChannel {
+	}
+
+	//a payload apple accepts first time
+	single, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer single.Disconnect()
+	if result, err := single.Send(context.Background(), groupTestPayload(1)); err != nil || result.Attempts != 1 {
+		t.Error(fmt.Sprintf("Expected one attempt but got %+v, %v", result, err))
+	}
+}
@@ -43,11 +43,20 @@ func (b *BadgeNumber) Set(number int) error {
 	return nil
 }
 
+// An unset badge number is marshaled as null, so it stays unset when
+// unmarshaled again
 func (b BadgeNumber) MarshalJSON() ([]byte, error) {
+	if !b.set {
+		return []byte("null"), nil
+	}
 	return []byte(strconv.Itoa(b.number)), nil
 }
 
 func (b *BadgeNumber) UnmarshalJSON(data []byte) error {
+	//null is a no-op, as for encoding/json's own types
+	if string(data) == "null" {
+		return nil
+	}
 	val, err := strconv.ParseInt(string(data), 10, 32)
 	if err != nil {
 		return errors.New("Error unmarshalling BadgeNumber, cannot convert []byte to int32")
@@ -65,6 +74,22 @@ func (b *BadgeNumber) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// Encodes the number and whether it's set, which encoding/gob can't see
+func (b BadgeNumber) GobEncode() ([]byte, error) {
+	if !b.set {
+		return []byte{}, nil
+	}
+	return []byte(strconv.Itoa(b.number)), nil
+}
+
+func (b *BadgeNumber) GobDecode(data []byte) error {
+	if len(data) == 0 {
+		b.UnSet()
+		return nil
+	}
+	return b.UnmarshalJSON(data)
+}
+
 // Get a new badge number, set to the initial
 // number, and included in the payload
 func NewBadgeNumber(number int) BadgeNumber {
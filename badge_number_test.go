@@ -1,6 +1,8 @@
 package apns
 
 import (
+	"bytes"
+	"encoding/gob"
 	"encoding/json"
 	"testing"
 )
@@ -84,3 +86,28 @@ func TestBadgeNumberUnmarshalJSON(t *testing.T) {
 		t.Error("Expected number to be 11, got %d", ts.Number.Number())
 	}
 }
+
+func TestBadgeNumberShouldRoundTripUnset(t *testing.T) {
+	type TestStruct struct {
+		Number BadgeNumber
+	}
+	for _, b := range []BadgeNumber{{}, NewBadgeNumber(0), NewBadgeNumber(7)} {
+		jsonData, err := json.Marshal(TestStruct{b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ts TestStruct
+		if err := json.Unmarshal(jsonData, &ts); err != nil || ts.Number != b {
+			t.Errorf("Expected %+v to round trip json but got %+v, %v", b, ts.Number, err)
+		}
+
+		buffer := new(bytes.Buffer)
+		if err := gob.NewEncoder(buffer).Encode(TestStruct{b}); err != nil {
+			t.Fatal(err)
+		}
+		ts = TestStruct{}
+		if err := gob.NewDecoder(buffer).Decode(&ts); err != nil || ts.Number != b {
+			t.Errorf("Expected %+v to round trip gob but got %+v, %v", b, ts.Number, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package apns
+
+import (
+	"context"
+	"strings"
+)
+
+// Number of broadcast payloads handed to the connection ahead of the
+// oldest one still waiting for its result
+const broadcastPending = 1000
+
+// A token's payload handed to the connection, or why it couldn't be
+type broadcastSend struct {
+	payload *Payload
+	send    *syncSend
+	err     error
+}
+
+// Send template to every token, waiting for apple's verdict on each as
+// Send does
+// The template is marshaled once and the json reused for every token, so
+// only the token differs between notifications. Repeated tokens (ignoring
+// case) are only sent once. Results are streamed on the returned channel
+// in token order as they resolve, their Payload a copy of template with
+// the token set (sharing its custom fields and ExtraData). Invalid
+// tokens are reported with Result.Err and skipped without stopping the
+// rest, as are those the TokenFilter refused (see Result.Filtered). Once ctx is done no more tokens are sent, and the results
+// channel is closed once everything sent is resolved, so should be read
+// until closed
+// Returns an error if the template can't be marshaled
+func (c *APNSConnection) Broadcast(ctx context.Context, template *Payload, tokens []string) (<-chan Result, error) {
+	return broadcast(ctx, template, tokens, c.config.MaxPayloadSize, BatchOptions{}, c.startSend)
+}
+
+// Send template to every token as Broadcast does, with options, e.g. to
+// report repeated tokens (see BatchOptions)
+func (c *APNSConnection) BroadcastWithOptions(ctx context.Context, template *Payload, tokens []string, options BatchOptions) (<-chan Result, error) {
+	return broadcast(ctx, template, tokens, c.config.MaxPayloadSize, options, c.startSend)
+}
+
+// Send template to every token over the pool's connections (see
+// APNSConnection.Broadcast)
+func (p *APNSConnectionPool) Broadcast(ctx context.Context, template *Payload, tokens []string) (<-chan Result, error) {
+	return broadcast(ctx, template, tokens, p.config.ConnectionConfig.MaxPayloadSize, BatchOptions{}, p.startSend)
+}
+
+// Send template to every token over the pool's connections with options
+// (see APNSConnection.BroadcastWithOptions)
+func (p *APNSConnectionPool) BroadcastWithOptions(ctx context.Context, template *Payload, tokens []string, options BatchOptions) (<-chan Result, error) {
+	return broadcast(ctx, template, tokens, p.config.ConnectionConfig.MaxPayloadSize, options, p.startSend)
+}
+
+func broadcast(ctx context.Context, template *Payload, tokens []string, maxPayloadSize int, options BatchOptions,
+	start func(ctx context.Context, payload *Payload) (*syncSend, error)) (<-chan Result, error) {
+	body, err := template.Marshal(maxPayloadSize)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make(chan *broadcastSend, broadcastPending)
+	go func() {
+		defer close(pending)
+		seen := make(map[string]*Payload, len(tokens))
+		for _, token := range tokens {
+			key := strings.ToLower(token)
+			payload := *template
+			payload.Token = token
+			payload.broadcastBody = body
+			payload.broadcastBodySize = maxPayloadSize
+			if original, ok := seen[key]; ok {
+				if options.Dedupe {
+					pending <- &broadcastSend{payload: &payload, err: &DuplicateError{Payload: &payload, Original: original}}
+				}
+				continue
+			}
+			seen[key] = &payload
+
+			send, err := start(ctx, &payload)
+			pending <- &broadcastSend{payload: &payload, send: send, err: err}
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+
+	//resolved in order, later payloads have settled by the time earlier
+	//ones have
+	results := make(chan Result)
+	go func() {
+		defer close(results)
+		for b := range pending {
+			if b.err != nil {
+				results <- Result{Payload: b.payload, Err: b.err}
+				continue
+			}
+			result, err := b.send.wait(ctx)
+			if err != nil {
+				results <- Result{Payload: b.payload, Err: err}
+				continue
+			}
+			results <- *result
+		}
+	}()
+	return results, nil
+}
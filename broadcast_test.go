@@ -0,0 +1,167 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func broadcastTestTokens(count int) []string {
+	tokens := make([]string, count)
+	for i := range tokens {
+		tokens[i] = groupTestPayload(i).Token
+	}
+	return tokens
+}
+
+func collectBroadcast(results <-chan Result) []Result {
+	collected := []Result{}
+	for result := range results {
+		collected = append(collected, result)
+	}
+	return collected
+}
+
+func TestBroadcastShouldSendToEveryToken(t *testing.T) {
+	conn, socket := sendTestConnection(5000)
+	tokens := broadcastTestTokens(3)
+	//repeated in upper case, with an invalid token in between
+	tokens = []string{tokens[0], tokens[1], strings.ToUpper(tokens[0]), "zzz", tokens[2]}
+	template := &Payload{AlertText: "Testing broadcast", ExtraData: "event 1"}
+
+	results, err := conn.Broadcast(context.Background(), template, tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForSocketSends(t, socket, 3)
+	socket.reject(8, 1)
+
+	collected := collectBroadcast(results)
+	if len(collected) != 4 {
+		t.Fatal(fmt.Sprintf("Expected 4 results but got %v", len(collected)))
+	}
+	for i, token := range []string{tokens[0], tokens[1], "zzz", tokens[4]} {
+		if collected[i].Payload.Token != token || collected[i].Payload.ExtraData != "event 1" {
+			t.Error(fmt.Sprintf("Expected result %v to be for %v but got %v", i, token, collected[i].Payload))
+		}
+	}
+	if collected[0].Err != nil || !collected[0].Accepted() {
+		t.Error(fmt.Sprintf("Expected the first token to be accepted but got %+v", collected[0]))
+	}
+	if collected[1].Err != nil || collected[1].Reason != "INVALID_TOKEN" {
+		t.Error(fmt.Sprintf("Expected the second token to be rejected but got %+v", collected[1]))
+	}
+	if collected[2].Err == nil || collected[3].Err == nil {
+		t.Error(fmt.Sprintf("Expected the invalid and unsent tokens to fail but got %+v and %+v", collected[2], collected[3]))
+	}
+	if template.Token != "" {
+		t.Error("Expected the template to be left alone")
+	}
+	<-conn.CloseChannel
+}
+
+func TestBroadcastShouldMarshalOnce(t *testing.T) {
+	conn, socket := sendTestConnection(0)
+	template := &Payload{AlertText: "Testing broadcast"}
+
+	results, err := conn.Broadcast(context.Background(), template, broadcastTestTokens(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	collected := collectBroadcast(results)
+	if &collected[0].Payload.broadcastBody[0] != &collected[1].Payload.broadcastBody[0] {
+		t.Error("Expected every token to share the marshaled body")
+	}
+	if socket.sent() != 2 {
+		t.Error(fmt.Sprintf("Expected 2 payloads to be written but got %v", socket.sent()))
+	}
+
+	conn.Disconnect()
+	<-conn.CloseChannel
+}
+
+func TestBroadcastShouldFailForInvalidTemplate(t *testing.T) {
+	conn, _ := sendTestConnection(0)
+	template := &Payload{CustomFields: map[string]interface{}{"aps": 1}}
+	if _, err := conn.Broadcast(context.Background(), template, broadcastTestTokens(1)); err == nil {
+		t.Error("Expected an error for a template that can't be marshaled")
+	}
+	conn.Disconnect()
+	<-conn.CloseChannel
+}
+
+func TestPoolBroadcast(t *testing.T) {
+	pool, dialer := newPoolTestPool(t, 2, PoolRoundRobin)
+	results, err := pool.Broadcast(context.Background(), &Payload{AlertText: "Testing"}, broadcastTestTokens(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for result := range results {
+		if result.Err != nil || !result.Accepted() {
+			t.Error(fmt.Sprintf("Expected every token to be accepted but got %+v", result))
+		}
+	}
+	waitForPoolSends(t, dialer, []int{2, 2})
+
+	pool.Close()
+	finalPoolClose(t, pool)
+}
+
+// Mock gateway socket dropping everything written
+type discardTestSocket struct {
+	*poolTestSocket
+}
+
+func (s *discardTestSocket) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func benchmarkConnection() *APNSConnection {
+	config := shutdownTestConfig()
+	config.FramingTimeout = 0
+	return socketAPNSConnection(&discardTestSocket{newPoolTestSocket()}, config)
+}
+
+func benchmarkTemplate() *Payload {
+	return &Payload{
+		AlertText: "Testing this payload with a bunch of text",
+		Badge:     NewBadgeNumber(2),
+		Sound:     "test.aiff",
+		CustomFields: map[string]interface{}{
+			"num": 55,
+			"str": "string",
+			"obj": map[string]string{"obja": "a", "objb": "b"},
+		},
+	}
+}
+
+func BenchmarkBroadcast1000(b *testing.B) {
+	conn := benchmarkConnection()
+	tokens := broadcastTestTokens(1000)
+	template := benchmarkTemplate()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		results, _ := conn.Broadcast(context.Background(), template, tokens)
+		for range results {
+		}
+	}
+}
+
+func BenchmarkPerPayloadSend1000(b *testing.B) {
+	conn := benchmarkConnection()
+	tokens := broadcastTestTokens(1000)
+	template := benchmarkTemplate()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		payloads := make([]*Payload, len(tokens))
+		for j, token := range tokens {
+			payload := *template
+			payload.Token = token
+			payloads[j] = &payload
+		}
+		conn.SendAll(context.Background(), payloads)
+	}
+}
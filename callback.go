@@ -0,0 +1,68 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+)
+
+// Default number of SendWithCallback callbacks a connection runs at once
+const defaultCallbackWorkers = 4
+
+// Send a payload as Send does, calling fn once with its outcome rather
+// than waiting for it, so there's no need to match results up with the
+// payloads that were sent
+// fn is called exactly once: with the Result apple accepted or rejected
+// the payload with, or with Err set if it couldn't be sent, as for the
+// errors Send returns (invalid, or the connection closed or shut down
+// before apple read it). Callbacks run on their own goroutines, at most
+// CallbackWorkers at once, so a slow one holds up other callbacks but
+// never the connection. A callback that panics is logged
+// Blocks until the connection takes the payload, as SendChannel does
+// Safe to call from many goroutines, and alongside SendChannel
+func (c *APNSConnection) SendWithCallback(payload *Payload, fn func(Result)) {
+	send, err := c.startSend(context.Background(), payload)
+	c.callBack(send, err, payload, fn)
+}
+
+// Send a payload over one of the pool's connections, calling fn once with
+// its outcome (see APNSConnection.SendWithCallback)
+func (p *APNSConnectionPool) SendWithCallback(payload *Payload, fn func(Result)) {
+	send, err := p.startSend(context.Background(), payload)
+	if send == nil {
+		//no connection to run it on
+		go runCallback(fn, Result{Payload: payload, Err: err}, configLogger(p.config.ConnectionConfig.Logger))
+		return
+	}
+	send.conn.callBack(send, err, payload, fn)
+}
+
+// Wait for the outcome of send, or report err if it couldn't start, and
+// call fn with it once a callback worker is free
+func (c *APNSConnection) callBack(send *syncSend, err error, payload *Payload, fn func(Result)) {
+	go func() {
+		result := Result{Payload: payload, Err: err}
+		if send != nil {
+			outcome, err := send.wait(context.Background())
+			if err != nil {
+				result.Err = err
+			} else {
+				result = *outcome
+			}
+		}
+		c.callbacks <- true
+		defer func() {
+			<-c.callbacks
+		}()
+		runCallback(fn, result, c.logger)
+	}()
+}
+
+// Call fn with result, logging it if it panics
+func runCallback(fn func(Result), result Result, logger Logger) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("apns: send callback panicked", "payload", result.Payload.String(), "panic", fmt.Sprint(r))
+		}
+	}()
+	fn(result)
+}
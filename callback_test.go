@@ -0,0 +1,136 @@
+package apns
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Collects the Results of SendWithCallback by payload
+type callbackRecorder struct {
+	lock    *sync.Mutex
+	results map[*Payload][]Result
+}
+
+func newCallbackRecorder() *callbackRecorder {
+	return &callbackRecorder{lock: new(sync.Mutex), results: make(map[*Payload][]Result)}
+}
+
+func (r *callbackRecorder) callback(result Result) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.results[result.Payload] = append(r.results[result.Payload], result)
+}
+
+// Wait for payload's result, failing unless there's exactly one
+func (r *callbackRecorder) expect(t *testing.T, payload *Payload) Result {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.lock.Lock()
+		results := r.results[payload]
+		r.lock.Unlock()
+		if len(results) > 0 {
+			time.Sleep(20 * time.Millisecond)
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if len(r.results[payload]) != 1 {
+				t.Error(fmt.Sprintf("Expected one callback for %v but got %v", payload, r.results[payload]))
+			}
+			return results[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("Expected a callback for %v", payload))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSendWithCallbackShouldReportOutcomes(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	logger := newRecordingLogger()
+	config := app.Pool.ConnectionConfig
+	config.SendSettleWindow = 50
+	config.CallbackWorkers = 1
+	config.Logger = logger
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := newCallbackRecorder()
+
+	accepted := groupTestPayload(0)
+	conn.SendWithCallback(accepted, recorder.callback)
+	if result := recorder.expect(t, accepted); !result.Accepted() || result.Err != nil {
+		t.Error(fmt.Sprintf("Expected the payload to be accepted but got %+v", result))
+	}
+
+	//a wedged callback holds up the other callbacks, not the sends
+	wedged := make(chan bool)
+	started := make(chan bool)
+	conn.SendWithCallback(groupTestPayload(1), func(result Result) {
+		close(started)
+		<-wedged
+		panic("callback failed")
+	})
+	<-started
+	held := []*Payload{groupTestPayload(2), groupTestPayload(3), groupTestPayload(4)}
+	for _, payload := range held {
+		conn.SendWithCallback(payload, recorder.callback)
+	}
+	if _, err := server.WaitForNotifications(5, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	recorder.lock.Lock()
+	waiting := len(recorder.results)
+	recorder.lock.Unlock()
+	if waiting != 1 {
+		t.Error(fmt.Sprintf("Expected callbacks to wait for the wedged one but got %v", waiting))
+	}
+	close(wedged)
+	for _, payload := range held {
+		recorder.expect(t, payload)
+	}
+	if event := logger.waitFor(t, "apns: send callback panicked"); event.keyvals["panic"] != "callback failed" {
+		t.Error(fmt.Sprintf("Expected the panic to be logged but got %+v", event))
+	}
+
+	rejected := groupTestPayload(5)
+	server.RejectToken(rejected.Token, "INVALID_TOKEN")
+	conn.SendWithCallback(rejected, recorder.callback)
+	if result := recorder.expect(t, rejected); result.Reason != BinaryReasonInvalidToken {
+		t.Error(fmt.Sprintf("Expected the payload to be rejected but got %+v", result))
+	}
+	for range conn.CloseChannel {
+	}
+
+	unsent := groupTestPayload(6)
+	conn.SendWithCallback(unsent, recorder.callback)
+	if result := recorder.expect(t, unsent); result.Err == nil {
+		t.Error(fmt.Sprintf("Expected the payload not to be sent but got %+v", result))
+	}
+}
+
+func TestPoolSendWithCallback(t *testing.T) {
+	_, app, _ := newManagerTestApps(t)
+	app.Pool.ConnectionConfig.SendSettleWindow = 50
+	pool, err := NewAPNSConnectionPool(app.Pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := newCallbackRecorder()
+	payload := groupTestPayload(0)
+	pool.SendWithCallback(payload, recorder.callback)
+	if result := recorder.expect(t, payload); !result.Accepted() {
+		t.Error(fmt.Sprintf("Expected the payload to be accepted but got %+v", result))
+	}
+
+	pool.Close()
+	finalPoolClose(t, pool)
+	closed := groupTestPayload(1)
+	pool.SendWithCallback(closed, recorder.callback)
+	if result := recorder.expect(t, closed); result.Err == nil {
+		t.Error(fmt.Sprintf("Expected the closed pool to refuse the payload but got %+v", result))
+	}
+}
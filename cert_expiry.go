@@ -0,0 +1,153 @@
+package apns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// OID of the extension listing the topics a push certificate is valid
+// for, the bundle id and its .voip, .complication etc. variants
+var oidAPNSTopics = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 6}
+
+// How often a connection checks whether its certificate is about to expire
+const certExpiryCheckInterval = 24 * time.Hour
+
+// Returned when connecting with a certificate that has already expired,
+// errors.Is ErrCertificateExpired
+type CertificateExpiredError struct {
+	// The certificate's common name
+	Subject string
+	// When the certificate expired
+	ExpiresAt time.Time
+}
+
+func (e *CertificateExpiredError) Error() string {
+	return fmt.Sprintf("Certificate %q expired at %v", e.Subject, e.ExpiresAt)
+}
+
+func (e *CertificateExpiredError) Is(target error) bool {
+	return target == ErrCertificateExpired
+}
+
+// Warns when a connection's certificate is about to expire
+// Checked on connecting and then at most once per certExpiryCheckInterval
+// as payloads are sent, so long lived connections keep warning
+type certExpiryMonitor struct {
+	leaf     *x509.Certificate
+	window   time.Duration
+	callback func(cert *x509.Certificate, expiresAt time.Time)
+	//warned when there's no callback, the standard logger if nil
+	logger Logger
+	clock  clock
+	lock   *sync.Mutex
+	//when the next check is due
+	nextCheck time.Time
+}
+
+// Check the certificate cert's leaf is valid now, warning now if it
+// expires within warningDays
+func newCertExpiryMonitor(cert tls.Certificate, warningDays int,
+	callback func(cert *x509.Certificate, expiresAt time.Time), logger Logger, c clock) (*certExpiryMonitor, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkCertificateDates(leaf, c.Now()); err != nil {
+		return nil, err
+	}
+
+	m := &certExpiryMonitor{
+		leaf:     leaf,
+		window:   time.Duration(warningDays) * 24 * time.Hour,
+		callback: callback,
+		logger:   logger,
+		clock:    c,
+		lock:     new(sync.Mutex),
+	}
+	m.check()
+	return m, nil
+}
+
+// Warn if the certificate expires within the window and a check is due
+// Safe to call on a nil monitor, for connections without a certificate
+func (m *certExpiryMonitor) check() {
+	if m == nil {
+		return
+	}
+	now := m.clock.Now()
+	m.lock.Lock()
+	if now.Before(m.nextCheck) {
+		m.lock.Unlock()
+		return
+	}
+	m.nextCheck = now.Add(certExpiryCheckInterval)
+	m.lock.Unlock()
+
+	if now.Add(m.window).Before(m.leaf.NotAfter) {
+		return
+	}
+	if m.callback != nil {
+		m.callback(m.leaf, m.leaf.NotAfter)
+		return
+	}
+	if m.logger != nil {
+		m.logger.Warn("apns: certificate expiring", "subject", m.leaf.Subject.CommonName, "expires_at", m.leaf.NotAfter)
+		return
+	}
+	log.Printf("apns: certificate %q expires at %v", m.leaf.Subject.CommonName, m.leaf.NotAfter)
+}
+
+// When the certificate expires, zero for a nil monitor
+func (m *certExpiryMonitor) expiresAt() time.Time {
+	if m == nil {
+		return time.Time{}
+	}
+	return m.leaf.NotAfter
+}
+
+// The certificate's topics, nil for a nil monitor
+func (m *certExpiryMonitor) topics() []string {
+	if m == nil {
+		return nil
+	}
+	return certificateTopics(m.leaf)
+}
+
+// The topics a push certificate can send to, from its topics extension
+// or, for older certificates without one, the bundle id in its subject
+func certificateTopics(cert *x509.Certificate) []string {
+	for _, extension := range cert.Extensions {
+		if !extension.Id.Equal(oidAPNSTopics) {
+			continue
+		}
+		//a sequence of each topic followed by a sequence of its push types
+		sequence := asn1.RawValue{}
+		if _, err := asn1.Unmarshal(extension.Value, &sequence); err != nil {
+			break
+		}
+		topics := []string{}
+		for rest := sequence.Bytes; len(rest) > 0; {
+			value := asn1.RawValue{}
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &value); err != nil {
+				break
+			}
+			if value.Class == asn1.ClassUniversal && value.Tag == asn1.TagUTF8String {
+				topics = append(topics, string(value.Bytes))
+			}
+		}
+		return topics
+	}
+	if topic := topicFromCertificate(cert); topic != "" {
+		return []string{topic}
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package apns
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A push certificate expiring at notAfter, with a topics extension if
+// topics are given
+func generateTestCertExpiring(t *testing.T, notAfter time.Time, topics ...string) ([]byte, []byte) {
+	key, keyPEM := generateAuthKey(t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "Apple Push Services: com.example.app"},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if len(topics) > 0 {
+		values := []interface{}{}
+		for _, topic := range topics {
+			values = append(values, asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte(topic)},
+				[]asn1.RawValue{{Tag: asn1.TagUTF8String, Bytes: []byte("app")}})
+		}
+		value, err := asn1.Marshal(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: oidAPNSTopics, Value: value}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM
+}
+
+// Counts calls to a CertExpiryCallback
+type certExpiryTestCallback struct {
+	lock      *sync.Mutex
+	calls     int
+	expiresAt time.Time
+}
+
+func newCertExpiryTestCallback() *certExpiryTestCallback {
+	return &certExpiryTestCallback{lock: new(sync.Mutex)}
+}
+
+func (c *certExpiryTestCallback) callback(cert *x509.Certificate, expiresAt time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.calls++
+	c.expiresAt = expiresAt
+}
+
+func (c *certExpiryTestCallback) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.calls
+}
+
+func certExpiryTestMonitor(t *testing.T, c clock, notAfter time.Time, callback *certExpiryTestCallback) *certExpiryMonitor {
+	certPEM, keyPEM := generateTestCertExpiring(t, notAfter)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newCertExpiryMonitor(cert, 30, callback.callback, nil, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestCertExpiryShouldWarnWithinWindow(t *testing.T) {
+	clock := newFakeClock()
+	clock.now = time.Now()
+	callback := newCertExpiryTestCallback()
+	notAfter := clock.now.Add(10 * 24 * time.Hour).Truncate(time.Second)
+	m := certExpiryTestMonitor(t, clock, notAfter, callback)
+	if callback.count() != 1 || !callback.expiresAt.Equal(notAfter) {
+		t.Error(fmt.Sprintf("Expected a warning on creation for %v but got %v for %v", notAfter, callback.count(), callback.expiresAt))
+	}
+
+	m.check()
+	if callback.count() != 1 {
+		t.Error(fmt.Sprintf("Expected no more warnings until the next check but got %v", callback.count()))
+	}
+	clock.After(certExpiryCheckInterval)
+	m.check()
+	if callback.count() != 2 {
+		t.Error(fmt.Sprintf("Expected a warning on the next check but got %v", callback.count()))
+	}
+}
+
+func TestCertExpiryShouldWarnOnEnteringWindow(t *testing.T) {
+	clock := newFakeClock()
+	clock.now = time.Now()
+	callback := newCertExpiryTestCallback()
+	m := certExpiryTestMonitor(t, clock, clock.now.Add(60*24*time.Hour), callback)
+	if callback.count() != 0 {
+		t.Error(fmt.Sprintf("Expected no warning 60 days out but got %v", callback.count()))
+	}
+
+	//a long lived connection crossing into the window
+	clock.After(31 * 24 * time.Hour)
+	m.check()
+	if callback.count() != 1 {
+		t.Error(fmt.Sprintf("Expected a warning 29 days out but got %v", callback.count()))
+	}
+}
+
+func TestCertExpiryShouldRefuseExpiredCertificate(t *testing.T) {
+	certPEM, keyPEM := generateTestCertExpiring(t, time.Now().Add(-time.Hour))
+
+	_, err := NewAPNSConnection(&APNSConfig{
+		CertificateBytes: certPEM,
+		KeyBytes:         keyPEM,
+		GatewayHost:      "127.0.0.1",
+		GatewayPort:      "1",
+	})
+	expired := &CertificateExpiredError{}
+	if !errors.As(err, &expired) || expired.Subject != "Apple Push Services: com.example.app" {
+		t.Error(fmt.Sprintf("Expected an expired certificate error but got %v", err))
+	}
+
+	_, err = NewHTTP2Connection(&HTTP2Config{CertificateBytes: certPEM, KeyBytes: keyPEM})
+	if !errors.As(err, &expired) {
+		t.Error(fmt.Sprintf("Expected an expired certificate error over HTTP/2 but got %v", err))
+	}
+}
+
+func TestCertExpiryConnectionShouldExposeCertificate(t *testing.T) {
+	gateway, config := newDropTestGateway(t, 0, 0)
+	defer gateway.Close()
+	notAfter := time.Now().Add(10 * 24 * time.Hour).Truncate(time.Second)
+	config.CertificateBytes, config.KeyBytes = generateTestCertExpiring(t, notAfter, "com.example.app", "com.example.app.voip")
+	callback := newCertExpiryTestCallback()
+	config.CertExpiryCallback = callback.callback
+
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callback.count() != 1 {
+		t.Error(fmt.Sprintf("Expected a warning on connecting but got %v", callback.count()))
+	}
+	if !conn.CertExpiresAt().Equal(notAfter) {
+		t.Error(fmt.Sprintf("Expected the certificate to expire at %v but got %v", notAfter, conn.CertExpiresAt()))
+	}
+	if topics := conn.CertTopics(); !reflect.DeepEqual(topics, []string{"com.example.app", "com.example.app.voip"}) {
+		t.Error(fmt.Sprintf("Expected the certificate's topics but got %v", topics))
+	}
+	conn.Disconnect()
+	<-conn.CloseChannel
+}
+
+func TestCertExpiryHTTP2ShouldExposeCertificate(t *testing.T) {
+	notAfter := time.Now().Add(10 * 24 * time.Hour).Truncate(time.Second)
+	certPEM, keyPEM := generateTestCertExpiring(t, notAfter)
+	callback := newCertExpiryTestCallback()
+	conn, err := NewHTTP2Connection(&HTTP2Config{
+		CertificateBytes:      certPEM,
+		KeyBytes:              keyPEM,
+		CertExpiryWarningDays: 5,
+		CertExpiryCallback:    callback.callback,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callback.count() != 0 {
+		t.Error(fmt.Sprintf("Expected no warning outside the window but got %v", callback.count()))
+	}
+	if !conn.CertExpiresAt().Equal(notAfter) {
+		t.Error(fmt.Sprintf("Expected the certificate to expire at %v but got %v", notAfter, conn.CertExpiresAt()))
+	}
+	//no topics extension, so just the bundle id
+	certPEM, keyPEM = generateTestClientCert(t, "com.example.app")
+	conn, err = NewHTTP2Connection(&HTTP2Config{CertificateBytes: certPEM, KeyBytes: keyPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topics := conn.CertTopics(); !reflect.DeepEqual(topics, []string{"com.example.app"}) {
+		t.Error(fmt.Sprintf("Expected the bundle id but got %v", topics))
+	}
+}
+
+func TestCertExpiryConfigValidation(t *testing.T) {
+	certPEM, keyPEM := generateTestClientCert(t, "com.example.app")
+	if _, err := NewAPNSConnection(&APNSConfig{CertificateBytes: certPEM, KeyBytes: keyPEM, CertExpiryWarningDays: -1}); err == nil {
+		t.Error("Expected an error for negative CertExpiryWarningDays")
+	}
+	if _, err := NewHTTP2Connection(&HTTP2Config{CertificateBytes: certPEM, KeyBytes: keyPEM, CertExpiryWarningDays: -1}); err == nil {
+		t.Error("Expected an error for negative CertExpiryWarningDays over HTTP/2")
+	}
+}
+
+func TestReconnectShouldGiveUpOnExpiredCertificate(t *testing.T) {
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	dials := 0
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig:   &APNSConfig{InFlightPayloadBufferSize: 100, FramingTimeout: 1, MaxPayloadSize: 2048},
+		ReconnectBaseDelay: 1,
+		dial: func(config *APNSConfig) (*APNSConnection, error) {
+			dials++
+			if dials > 1 {
+				return nil, &CertificateExpiredError{ExpiresAt: time.Now()}
+			}
+			return dialer.dial(config)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer.socket(0).Close()
+
+	for range conn.CloseChannel {
+	}
+	if dials != 2 {
+		t.Error(fmt.Sprintf("Expected no more dials after the certificate expired but got %v", dials))
+	}
+}
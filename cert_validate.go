@@ -0,0 +1,144 @@
+package apns
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Load a certificate and key for a connection, checking the key really
+// belongs to the certificate by signing a test digest with it
+// Errors are ErrCertificateKeyMismatch or ErrCorruptCertificate, with
+// details (test with errors.Is)
+func loadKeyPair(certPEM, keyPEM []byte) (tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		if strings.Contains(err.Error(), "does not match") {
+			return cert, fmt.Errorf("%w: %v", ErrCertificateKeyMismatch, err)
+		}
+		return cert, corruptCertificate(err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return cert, corruptCertificate(err)
+		}
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return cert, corruptCertificate(errors.New(fmt.Sprintf("unsupported private key type %T", cert.PrivateKey)))
+	}
+	if err := checkKeySigns(signer, cert.Leaf.PublicKey); err != nil {
+		return cert, fmt.Errorf("%w: %v", ErrCertificateKeyMismatch, err)
+	}
+	return cert, nil
+}
+
+// Sign a test digest with key and verify it with the certificate's public key
+func checkKeySigns(key crypto.Signer, publicKey crypto.PublicKey) error {
+	message := []byte("apns certificate check")
+	digest := sha256.Sum256(message)
+	var signature []byte
+	var err error
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		signature, err = key.Sign(rand.Reader, message, crypto.Hash(0))
+	} else {
+		signature, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return err
+	}
+
+	verified := false
+	switch publicKey := publicKey.(type) {
+	case *rsa.PublicKey:
+		verified = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		verified = ecdsa.VerifyASN1(publicKey, digest[:], signature)
+	case ed25519.PublicKey:
+		verified = ed25519.Verify(publicKey, message, signature)
+	default:
+		return errors.New(fmt.Sprintf("unsupported public key type %T", publicKey))
+	}
+	if !verified {
+		return errors.New("test signature did not verify")
+	}
+	return nil
+}
+
+// Check a pem encoded certificate and key before connecting, e.g. at
+// startup or from a health check, rather than finding out from a failed
+// handshake
+// Checks the key belongs to the certificate (ErrCertificateKeyMismatch),
+// that the certificate is valid now (a *CertificateExpiredError, which
+// errors.Is ErrCertificateExpired, or ErrCertificateNotYetValid) and that
+// the chain apple needs is there (ErrMissingIntermediate)
+// Apple's push certificates are issued by an Apple Worldwide Developer
+// Relations intermediate, which should follow the certificate in certPEM,
+// as openssl pkcs12 writes it without -clcerts. Self signed certificates,
+// e.g. for a test gateway, need no intermediate
+func ValidateCertificate(certPEM, keyPEM []byte) error {
+	now := time.Now()
+	cert, err := loadKeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	if err := checkCertificateDates(cert.Leaf, now); err != nil {
+		return err
+	}
+
+	leaf := cert.Leaf
+	if leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature) == nil {
+		return nil
+	}
+	for _, der := range cert.Certificate[1:] {
+		intermediate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return corruptCertificate(err)
+		}
+		if leaf.CheckSignatureFrom(intermediate) == nil {
+			return checkCertificateDates(intermediate, now)
+		}
+	}
+	return fmt.Errorf("%w: no certificate issued by %q follows %q",
+		ErrMissingIntermediate, leaf.Issuer.CommonName, leaf.Subject.CommonName)
+}
+
+// Check certificate is valid at now
+func checkCertificateDates(certificate *x509.Certificate, now time.Time) error {
+	if now.Before(certificate.NotBefore) {
+		return fmt.Errorf("%w: %q is valid from %v", ErrCertificateNotYetValid,
+			certificate.Subject.CommonName, certificate.NotBefore)
+	}
+	if !now.Before(certificate.NotAfter) {
+		return &CertificateExpiredError{Subject: certificate.Subject.CommonName, ExpiresAt: certificate.NotAfter}
+	}
+	return nil
+}
+
+// Check the config's CertificateBytes and KeyBytes, see ValidateCertificate
+func (config *APNSConfig) ValidateCertificate() error {
+	return ValidateCertificate(config.CertificateBytes, config.KeyBytes)
+}
+
+// Check the config's CertificateBytes and KeyBytes, see
+// ValidateCertificate. Nil with token auth
+func (config *HTTP2Config) ValidateCertificate() error {
+	if config.CertificateBytes == nil && config.KeyBytes == nil {
+		return nil
+	}
+	return ValidateCertificate(config.CertificateBytes, config.KeyBytes)
+}
+
+// Check the config's CertificateBytes and KeyBytes, see ValidateCertificate
+func (config *APNSFeedbackServiceConfig) ValidateCertificate() error {
+	return ValidateCertificate(config.CertificateBytes, config.KeyBytes)
+}
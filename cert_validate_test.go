@@ -0,0 +1,122 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// A push certificate issued by a test intermediate, valid from notBefore
+// to notAfter, and the intermediate
+func generateTestIssuedCert(t *testing.T, notBefore time.Time, notAfter time.Time) ([]byte, []byte, []byte) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(4),
+		Subject:               pkix.Name{CommonName: "Test Worldwide Developer Relations"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, keyPEM := generateAuthKey(t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(5),
+		Subject:      pkix.Name{CommonName: "Apple Push Services: com.example.app"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+}
+
+func TestValidateCertificate(t *testing.T) {
+	certPEM, keyPEM := generateTestClientCert(t, "com.example.app")
+	if err := ValidateCertificate(certPEM, keyPEM); err != nil {
+		t.Error(fmt.Sprintf("Expected a self signed certificate to be valid but got %v", err))
+	}
+	if err := (&HTTP2Config{AuthKeyBytes: keyPEM}).ValidateCertificate(); err != nil {
+		t.Error(fmt.Sprintf("Expected nothing to check with token auth but got %v", err))
+	}
+
+	issuedPEM, issuedKeyPEM, caPEM := generateTestIssuedCert(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	err := ValidateCertificate(issuedPEM, issuedKeyPEM)
+	if !errors.Is(err, ErrMissingIntermediate) {
+		t.Error(fmt.Sprintf("Expected a missing intermediate but got %v", err))
+	}
+	bundled := append(append([]byte{}, issuedPEM...), caPEM...)
+	if err := (&APNSConfig{CertificateBytes: bundled, KeyBytes: issuedKeyPEM}).ValidateCertificate(); err != nil {
+		t.Error(fmt.Sprintf("Expected the bundled intermediate to complete the chain but got %v", err))
+	}
+
+	_, otherKeyPEM := generateAuthKey(t)
+	if err := ValidateCertificate(certPEM, otherKeyPEM); !errors.Is(err, ErrCertificateKeyMismatch) {
+		t.Error(fmt.Sprintf("Expected a key mismatch but got %v", err))
+	}
+	if err := ValidateCertificate(certPEM, []byte("not a key")); !errors.Is(err, ErrCorruptCertificate) {
+		t.Error(fmt.Sprintf("Expected a corrupt certificate but got %v", err))
+	}
+
+	expiredPEM, expiredKeyPEM := generateTestCertExpiring(t, time.Now().Add(-time.Hour))
+	err = ValidateCertificate(expiredPEM, expiredKeyPEM)
+	expired := &CertificateExpiredError{}
+	if !errors.Is(err, ErrCertificateExpired) || !errors.As(err, &expired) {
+		t.Error(fmt.Sprintf("Expected an expired certificate but got %v", err))
+	}
+
+	futurePEM, futureKeyPEM, _ := generateTestIssuedCert(t, time.Now().Add(time.Hour), time.Now().Add(2*time.Hour))
+	if err := ValidateCertificate(futurePEM, futureKeyPEM); !errors.Is(err, ErrCertificateNotYetValid) {
+		t.Error(fmt.Sprintf("Expected a certificate not yet valid but got %v", err))
+	}
+}
+
+func TestConnectionsShouldRefuseMismatchedKey(t *testing.T) {
+	certPEM, _ := generateTestClientCert(t, "com.example.app")
+	_, otherKeyPEM := generateAuthKey(t)
+
+	_, err := NewAPNSConnection(&APNSConfig{
+		CertificateBytes: certPEM,
+		KeyBytes:         otherKeyPEM,
+		GatewayHost:      "127.0.0.1",
+		GatewayPort:      "1",
+	})
+	if !errors.Is(err, ErrCertificateKeyMismatch) {
+		t.Error(fmt.Sprintf("Expected a key mismatch but got %v", err))
+	}
+
+	_, err = NewHTTP2Connection(&HTTP2Config{CertificateBytes: certPEM, KeyBytes: otherKeyPEM})
+	if !errors.Is(err, ErrCertificateKeyMismatch) {
+		t.Error(fmt.Sprintf("Expected a key mismatch over HTTP/2 but got %v", err))
+	}
+
+	futurePEM, futureKeyPEM, _ := generateTestIssuedCert(t, time.Now().Add(time.Hour), time.Now().Add(2*time.Hour))
+	_, err = NewHTTP2Connection(&HTTP2Config{CertificateBytes: futurePEM, KeyBytes: futureKeyPEM})
+	if !errors.Is(err, ErrCertificateNotYetValid) {
+		t.Error(fmt.Sprintf("Expected a certificate not yet valid but got %v", err))
+	}
+}
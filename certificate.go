@@ -0,0 +1,208 @@
+package apns
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+var (
+	// The password or passphrase for a .p12 bundle or encrypted key is wrong
+	ErrIncorrectPassword = errors.New("Incorrect password")
+	// The certificate or key data can't be read
+	ErrCorruptCertificate = errors.New("Corrupt certificate")
+	// The private key doesn't belong to the certificate
+	ErrCertificateKeyMismatch = errors.New("Private key does not match the certificate")
+	// The certificate has expired, see CertificateExpiredError
+	ErrCertificateExpired = errors.New("Certificate expired")
+	// The certificate's NotBefore hasn't been reached
+	ErrCertificateNotYetValid = errors.New("Certificate not yet valid")
+	// The certificate's issuer isn't among the certificates after it
+	ErrMissingIntermediate = errors.New("Missing intermediate certificate")
+)
+
+// A certificate and its private key, ready to be used as the
+// CertificateBytes and KeyBytes of APNSConfig, HTTP2Config or
+// APNSFeedbackServiceConfig
+// Errors loading one are ErrIncorrectPassword, ErrCorruptCertificate or
+// ErrCertificateKeyMismatch, with details (test with errors.Is)
+type Certificate struct {
+	// pem encoded certificate, followed by any intermediate certificates
+	CertificateBytes []byte
+	// pem encoded unencrypted private key
+	KeyBytes []byte
+	// the parsed certificate, e.g. to check when it expires
+	Leaf *x509.Certificate
+}
+
+// When the certificate expires
+func (c *Certificate) ExpiresAt() time.Time {
+	return c.Leaf.NotAfter
+}
+
+// Topics the certificate can send to, e.g. com.example.app and
+// com.example.app.voip
+func (c *Certificate) Topics() []string {
+	return certificateTopics(c.Leaf)
+}
+
+// Load a certificate from pem encoded certificate and key bytes, which
+// may be the same bytes holding both
+func NewCertFromPEM(certPEM, keyPEM []byte) (*Certificate, error) {
+	return newCertFromPEM(certPEM, keyPEM, nil)
+}
+
+// Same as NewCertFromPEM, for a key encrypted with passphrase, either as
+// an ENCRYPTED PRIVATE KEY (PKCS#8) or a legacy encrypted pem block
+func NewCertFromEncryptedPEM(certPEM, keyPEM []byte, passphrase string) (*Certificate, error) {
+	return newCertFromPEM(certPEM, keyPEM, &passphrase)
+}
+
+// Load a certificate from a pem file holding both the certificate and
+// its unencrypted key, as made by openssl from a .p12
+func NewCertFromPemFile(path string) (*Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewCertFromPEM(data, data)
+}
+
+// Load a certificate from a .p12 bundle, as exported from keychain
+// The bundle should hold one private key along with its certificate,
+// any other certificates are kept as intermediates
+func NewCertFromP12(data []byte, password string) (*Certificate, error) {
+	contents, err := decodePKCS12(data, password)
+	if err != nil {
+		return nil, err
+	}
+	if len(contents.keys) != 1 {
+		return nil, corruptCertificate(errors.New(fmt.Sprintf("expected 1 private key but found %v", len(contents.keys))))
+	}
+	return newCertificate(contents.certificates, contents.keys[0])
+}
+
+func newCertFromPEM(certPEM, keyPEM []byte, passphrase *string) (*Certificate, error) {
+	certificates := []*x509.Certificate{}
+	for block, rest := pem.Decode(certPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, corruptCertificate(err)
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	var key interface{}
+	for block, rest := pem.Decode(keyPEM); block != nil && key == nil; block, rest = pem.Decode(rest) {
+		var err error
+		if key, err = parsePEMPrivateKey(block, passphrase); err != nil {
+			return nil, err
+		}
+	}
+	if key == nil {
+		return nil, corruptCertificate(errors.New("no private key found"))
+	}
+	return newCertificate(certificates, key)
+}
+
+// Parse a pem block holding a private key, decrypting it with passphrase
+// Returns nil if the block isn't a private key
+func parsePEMPrivateKey(block *pem.Block, passphrase *string) (interface{}, error) {
+	der := block.Bytes
+	//legacy encryption, marked with a Proc-Type header
+	//the deprecated x509 functions are the only way to decrypt these
+	if x509.IsEncryptedPEMBlock(block) {
+		if passphrase == nil {
+			return nil, incorrectPassword("private key is encrypted, use NewCertFromEncryptedPEM")
+		}
+		var err error
+		if der, err = x509.DecryptPEMBlock(block, []byte(*passphrase)); err != nil {
+			if err == x509.IncorrectPasswordError {
+				return nil, ErrIncorrectPassword
+			}
+			return nil, corruptCertificate(err)
+		}
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "ENCRYPTED PRIVATE KEY":
+		if passphrase == nil {
+			return nil, incorrectPassword("private key is encrypted, use NewCertFromEncryptedPEM")
+		}
+		return decryptPKCS8PrivateKey(der, *passphrase, bmpString(*passphrase))
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(der)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		if x509.IsEncryptedPEMBlock(block) {
+			//decrypted with the wrong passphrase but happened to be padded right
+			return nil, ErrIncorrectPassword
+		}
+		return nil, corruptCertificate(err)
+	}
+	return key, nil
+}
+
+// Pick out the certificate for key, pem encoding it first
+func newCertificate(certificates []*x509.Certificate, key interface{}) (*Certificate, error) {
+	if len(certificates) == 0 {
+		return nil, corruptCertificate(errors.New("no certificate found"))
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, corruptCertificate(errors.New(fmt.Sprintf("unsupported private key type %T", key)))
+	}
+
+	leaf := -1
+	for i, certificate := range certificates {
+		if publicKey, ok := certificate.PublicKey.(interface {
+			Equal(crypto.PublicKey) bool
+		}); ok && publicKey.Equal(signer.Public()) {
+			leaf = i
+			break
+		}
+	}
+	if leaf == -1 {
+		return nil, ErrCertificateKeyMismatch
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, corruptCertificate(err)
+	}
+	c := &Certificate{
+		Leaf:     certificates[leaf],
+		KeyBytes: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}
+	c.CertificateBytes = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Leaf.Raw})
+	for i, certificate := range certificates {
+		if i != leaf {
+			c.CertificateBytes = append(c.CertificateBytes,
+				pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})...)
+		}
+	}
+	return c, nil
+}
+
+func corruptCertificate(err error) error {
+	return fmt.Errorf("%w: %v", ErrCorruptCertificate, err)
+}
+
+func incorrectPassword(detail string) error {
+	return fmt.Errorf("%w: %v", ErrIncorrectPassword, detail)
+}
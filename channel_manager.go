@@ -0,0 +1,249 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// Apple's broadcast channel management API
+	ChannelManagementProductionHost = "api-manage-broadcast.push.apple.com"
+	// Apple's broadcast channel management API for development builds
+	ChannelManagementDevelopmentHost = "api-manage-broadcast.sandbox.push.apple.com"
+)
+
+// How apple stores notifications sent to a channel, see CreateChannel
+const (
+	// Notifications are only delivered to devices that are online
+	ChannelNoMessageStored = 0
+	// The most recent notification is stored for offline devices
+	ChannelMostRecentMessageStored = 1
+)
+
+// Reasons apple gives for rejecting a channel management request, see
+// ChannelError
+const (
+	ChannelReasonBadRequest                = "BadRequest"
+	ChannelReasonBadChannelId              = "BadChannelId"
+	ChannelReasonMissingChannelId          = "MissingChannelId"
+	ChannelReasonBadMessageStoragePolicy   = "BadMessageStoragePolicy"
+	ChannelReasonBadPushType               = "BadPushType"
+	ChannelReasonChannelNotRegistered      = "ChannelNotRegistered"
+	ChannelReasonCannotCreateChannelConfig = "CannotCreateChannelConfig"
+	ChannelReasonInvalidProviderToken      = reasonInvalidProviderToken
+	ChannelReasonExpiredProviderToken      = reasonExpiredProviderToken
+	ChannelReasonTooManyRequests           = "TooManyRequests"
+	ChannelReasonInternalServerError       = "InternalServerError"
+)
+
+// The only push type broadcast channels support
+const channelPushType = "LiveActivity"
+
+// A broadcast channel as returned by ReadChannel
+type Channel struct {
+	// Base64 id of the channel, use as Payload.ChannelId
+	ChannelId string
+	// ChannelNoMessageStored or ChannelMostRecentMessageStored
+	MessageStoragePolicy int
+	// Push type the channel is for, LiveActivity
+	PushType string
+	// apns-request-id apple returned, quote it in support requests
+	RequestID string
+}
+
+// A channel management request apple rejected
+type ChannelError struct {
+	// HTTP status returned by apple
+	StatusCode int
+	// Apple's reason for rejecting the request, one of the ChannelReason
+	// constants
+	Reason string
+	// apns-request-id apple returned, quote it in support requests
+	RequestID string
+}
+
+func (e *ChannelError) Error() string {
+	return fmt.Sprintf("Channel request failed with status %v: %v (request id %v)", e.StatusCode, e.Reason, e.RequestID)
+}
+
+// Creates, reads and deletes broadcast channels (see Payload.ChannelId)
+// Uses the same certificate or token auth as HTTP2Connection. Safe for
+// concurrent use
+type ChannelManager struct {
+	conn *HTTP2Connection
+}
+
+// Create a channel manager with the supplied config, the same config an
+// HTTP2Connection would use
+// The host is switched to the matching channel management host, so
+// HTTP2ProductionHost (or no host with EnvironmentProduction) uses
+// ChannelManagementProductionHost and HTTP2DevelopmentHost (or no host
+// with EnvironmentDevelopment) ChannelManagementDevelopmentHost. Any other
+// host and port are used as is. config isn't modified
+func NewChannelManager(config *HTTP2Config) (*ChannelManager, error) {
+	managerConfig := *config
+	host, _ := resolveEndpoint(config.Environment, http2Hosts, config.GatewayAddr, config.Host, config.Port, "443")
+	switch host {
+	case HTTP2ProductionHost:
+		managerConfig.Host, managerConfig.Port = ChannelManagementProductionHost, "2196"
+		managerConfig.GatewayAddr = ""
+	case HTTP2DevelopmentHost:
+		managerConfig.Host, managerConfig.Port = ChannelManagementDevelopmentHost, "2195"
+		managerConfig.GatewayAddr = ""
+	}
+	conn, err := NewHTTP2Connection(&managerConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &ChannelManager{conn: conn}, nil
+}
+
+// Create a channel for the app with the message storage policy
+// (ChannelNoMessageStored or ChannelMostRecentMessageStored), returning
+// its id. Failed requests return a *ChannelError
+func (m *ChannelManager) CreateChannel(bundleId string, messageStoragePolicy int) (string, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"message-storage-policy": messageStoragePolicy,
+		"push-type":              channelPushType,
+	})
+	response, err := m.do(http.MethodPost, bundleId, "/channels", "", body, http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+	channelId := response.header.Get("apns-channel-id")
+	if channelId == "" {
+		return "", errors.New(fmt.Sprintf("Apple didn't return a channel id (request id %v)", response.header.Get("apns-request-id")))
+	}
+	return channelId, nil
+}
+
+// Read the settings of one of the app's channels
+// Failed requests return a *ChannelError, e.g. ChannelNotRegistered
+func (m *ChannelManager) ReadChannel(bundleId string, channelId string) (*Channel, error) {
+	response, err := m.do(http.MethodGet, bundleId, "/channels", channelId, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	body := struct {
+		MessageStoragePolicy int    `json:"message-storage-policy"`
+		PushType             string `json:"push-type"`
+	}{}
+	if err := json.Unmarshal(response.body, &body); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid channel from apple: %v", err))
+	}
+	return &Channel{
+		ChannelId:            channelId,
+		MessageStoragePolicy: body.MessageStoragePolicy,
+		PushType:             body.PushType,
+		RequestID:            response.header.Get("apns-request-id"),
+	}, nil
+}
+
+// Returns the ids of all of the app's channels
+// Failed requests return a *ChannelError
+func (m *ChannelManager) ReadAllChannels(bundleId string) ([]string, error) {
+	response, err := m.do(http.MethodGet, bundleId, "/all-channels", "", nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	body := struct {
+		Channels []string `json:"channels"`
+	}{}
+	if err := json.Unmarshal(response.body, &body); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid channel list from apple: %v", err))
+	}
+	return body.Channels, nil
+}
+
+// Delete one of the app's channels, devices subscribed to it stop
+// getting its notifications
+// Failed requests return a *ChannelError
+func (m *ChannelManager) DeleteChannel(bundleId string, channelId string) error {
+	_, err := m.do(http.MethodDelete, bundleId, "/channels", channelId, nil, http.StatusNoContent)
+	return err
+}
+
+// Close any idle connections to apple
+func (m *ChannelManager) Close() {
+	m.conn.Close()
+}
+
+type channelResponse struct {
+	header http.Header
+	body   []byte
+}
+
+// Make a request for the app, returning a *ChannelError unless apple
+// responds with expectedStatus
+// Like HTTP2Connection.Send a request rejected for its provider token is
+// retried once with a newly signed token
+func (m *ChannelManager) do(method string, bundleId string, path string, channelId string, body []byte, expectedStatus int) (*channelResponse, error) {
+	providerToken := ""
+	if m.conn.tokens != nil {
+		var err error
+		if providerToken, err = m.conn.tokens.current(); err != nil {
+			return nil, err
+		}
+	}
+
+	response, err := m.request(method, bundleId, path, channelId, body, expectedStatus, providerToken)
+	channelErr, rejected := err.(*ChannelError)
+	if !rejected || m.conn.tokens == nil || channelErr.StatusCode != http.StatusForbidden ||
+		(channelErr.Reason != reasonExpiredProviderToken && channelErr.Reason != reasonInvalidProviderToken) {
+		return response, err
+	}
+
+	if providerToken, err = m.conn.tokens.refresh(providerToken); err != nil {
+		return nil, err
+	}
+	return m.request(method, bundleId, path, channelId, body, expectedStatus, providerToken)
+}
+
+func (m *ChannelManager) request(method string, bundleId string, path string, channelId string, body []byte, expectedStatus int, providerToken string) (*channelResponse, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, m.conn.baseURL+"/1/apps/"+bundleId+path, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	request.Header.Set("apns-request-id", NewApnsId())
+	if channelId != "" {
+		request.Header.Set("apns-channel-id", channelId)
+	}
+	if providerToken != "" {
+		request.Header.Set("Authorization", "bearer "+providerToken)
+	}
+
+	response, err := m.conn.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != expectedStatus {
+		reason := struct {
+			Reason string `json:"reason"`
+		}{}
+		json.Unmarshal(responseBody, &reason)
+		return nil, &ChannelError{
+			StatusCode: response.StatusCode,
+			Reason:     reason.Reason,
+			RequestID:  response.Header.Get("apns-request-id"),
+		}
+	}
+	return &channelResponse{header: response.Header, body: responseBody}, nil
+}
@@ -0,0 +1,159 @@
+package apns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A fake of apple's channel management API, keeping channels in memory
+func newChannelTestServer(t *testing.T) (*ChannelManager, func()) {
+	lock := new(sync.Mutex)
+	channels := map[string]int{}
+	next := 0
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.Header().Set("apns-request-id", r.Header.Get("apns-request-id"))
+		fail := func(status int, reason string) {
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"reason":%q}`, reason)
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "bearer ") {
+			fail(http.StatusForbidden, "MissingProviderToken")
+			return
+		}
+
+		channelId := r.Header.Get("apns-channel-id")
+		switch r.Method + " " + r.URL.Path {
+		case "POST /1/apps/com.example.app/channels":
+			body := map[string]interface{}{}
+			b, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(b, &body)
+			policy, _ := body["message-storage-policy"].(float64)
+			if body["push-type"] != "LiveActivity" {
+				fail(http.StatusBadRequest, "BadPushType")
+			} else if policy != 0 && policy != 1 {
+				fail(http.StatusBadRequest, "BadMessageStoragePolicy")
+			} else {
+				next++
+				channelId = fmt.Sprintf("Y2hhbm5lbC0%v", next)
+				channels[channelId] = int(policy)
+				w.Header().Set("apns-channel-id", channelId)
+				w.WriteHeader(http.StatusCreated)
+			}
+		case "GET /1/apps/com.example.app/channels":
+			if policy, ok := channels[channelId]; !ok {
+				fail(http.StatusNotFound, "ChannelNotRegistered")
+			} else {
+				fmt.Fprintf(w, `{"message-storage-policy":%v,"push-type":"LiveActivity"}`, policy)
+			}
+		case "GET /1/apps/com.example.app/all-channels":
+			ids := []string{}
+			for id := range channels {
+				ids = append(ids, id)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"channels": ids})
+		case "DELETE /1/apps/com.example.app/channels":
+			if _, ok := channels[channelId]; !ok {
+				fail(http.StatusNotFound, "ChannelNotRegistered")
+			} else {
+				delete(channels, channelId)
+				w.WriteHeader(http.StatusNoContent)
+			}
+		default:
+			fail(http.StatusNotFound, "BadPath")
+		}
+	})
+
+	manager, err := NewChannelManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager, func() {
+		manager.Close()
+		server.Close()
+	}
+}
+
+func TestChannelManagerLifecycle(t *testing.T) {
+	manager, done := newChannelTestServer(t)
+	defer done()
+
+	channelId, err := manager.CreateChannel("com.example.app", ChannelMostRecentMessageStored)
+	if err != nil || channelId == "" {
+		t.Fatal(fmt.Sprintf("Expected a channel id but got %q, %v", channelId, err))
+	}
+
+	channel, err := manager.ReadChannel("com.example.app", channelId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.ChannelId != channelId || channel.MessageStoragePolicy != ChannelMostRecentMessageStored ||
+		channel.PushType != "LiveActivity" || !isValidApnsId(channel.RequestID) {
+		t.Error(fmt.Sprintf("Unexpected channel %+v", channel))
+	}
+
+	ids, err := manager.ReadAllChannels("com.example.app")
+	if err != nil || len(ids) != 1 || ids[0] != channelId {
+		t.Error(fmt.Sprintf("Expected just %v but got %v, %v", channelId, ids, err))
+	}
+
+	if err := manager.DeleteChannel("com.example.app", channelId); err != nil {
+		t.Fatal(err)
+	}
+	ids, err = manager.ReadAllChannels("com.example.app")
+	if err != nil || len(ids) != 0 {
+		t.Error(fmt.Sprintf("Expected no channels but got %v, %v", ids, err))
+	}
+}
+
+func TestChannelManagerShouldReturnChannelErrors(t *testing.T) {
+	manager, done := newChannelTestServer(t)
+	defer done()
+
+	_, err := manager.ReadChannel("com.example.app", "bm90LWEtY2hhbm5lbA==")
+	channelErr, ok := err.(*ChannelError)
+	if !ok || channelErr.StatusCode != http.StatusNotFound || channelErr.Reason != ChannelReasonChannelNotRegistered || !isValidApnsId(channelErr.RequestID) {
+		t.Error(fmt.Sprintf("Expected ChannelNotRegistered but got %#v", err))
+	}
+	if err != nil && !strings.Contains(err.Error(), channelErr.RequestID) {
+		t.Error(fmt.Sprintf("Expected the request id in %v", err))
+	}
+
+	_, err = manager.CreateChannel("com.example.app", 7)
+	if channelErr, ok := err.(*ChannelError); !ok || channelErr.Reason != ChannelReasonBadMessageStoragePolicy {
+		t.Error(fmt.Sprintf("Expected BadMessageStoragePolicy but got %v", err))
+	}
+
+	if err := manager.DeleteChannel("com.example.app", "bm90LWEtY2hhbm5lbA=="); err == nil {
+		t.Error("Expected deleting an unknown channel to fail")
+	}
+}
+
+func TestChannelManagerHosts(t *testing.T) {
+	_, keyPEM := generateAuthKey(t)
+	hosts := map[string]string{
+		"":                   "https://api-manage-broadcast.push.apple.com:2196",
+		HTTP2ProductionHost:  "https://api-manage-broadcast.push.apple.com:2196",
+		HTTP2DevelopmentHost: "https://api-manage-broadcast.sandbox.push.apple.com:2195",
+		"localhost":          "https://localhost:443",
+	}
+	for host, expected := range hosts {
+		config := &HTTP2Config{AuthKeyBytes: keyPEM, KeyID: "k", TeamID: "t", Host: host}
+		manager, err := NewChannelManager(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manager.conn.baseURL != expected {
+			t.Error(fmt.Sprintf("Expected %v for host %q but got %v", expected, host, manager.conn.baseURL))
+		}
+		if config.Host != host {
+			t.Error("Expected the config to be left alone")
+		}
+	}
+}
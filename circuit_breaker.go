@@ -0,0 +1,258 @@
+package apns
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Config for the circuit breaker of an APNSReconnectingConnection, which
+// stops it reconnecting in a tight loop while every attempt fails, e.g.
+// once the certificate is revoked or during an incident at apple
+type CircuitBreakerConfig struct {
+	// number of connection failures in a row (failed dials and dropped
+	// connections) that opens the breaker, defaults to 5
+	MaxConsecutiveFailures int
+	// fraction of the outcomes in ErrorRateWindow that were failures which
+	// opens the breaker, e.g. 0.5, defaults to 0 (MaxConsecutiveFailures only)
+	// sent payloads and connections made count as successes
+	MaxErrorRate float64
+	// number of milliseconds of outcomes MaxErrorRate is measured over,
+	// defaults to 60000
+	ErrorRateWindow int
+	// fewest outcomes in the window for MaxErrorRate to apply, defaults to 10
+	MinErrorRateSamples int
+	// number of milliseconds the breaker stays open before a single
+	// connection attempt is let through to probe, defaults to 30000
+	Cooldown int
+	// optional callback invoked on every change of state, e.g. to alert
+	// when the breaker opens
+	// called on the connection's send go-routine
+	StateChangeCallback func(from CircuitState, to CircuitState)
+	// source of time, overridden in tests
+	clock clock
+}
+
+// State of a circuit breaker
+type CircuitState int
+
+const (
+	// Connecting and sending as normal
+	CircuitClosed CircuitState = iota
+	// Failing fast with a CircuitOpenError until the cooldown is over
+	CircuitOpen
+	// Cooled down, a single connection attempt is probing whether to close
+	// or open again
+	CircuitHalfOpen
+)
+
+var circuitStateNames = map[CircuitState]string{
+	CircuitClosed:   "CLOSED",
+	CircuitOpen:     "OPEN",
+	CircuitHalfOpen: "HALF_OPEN",
+}
+
+func (s CircuitState) String() string {
+	if name, ok := circuitStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// Returned for payloads failed fast while the circuit breaker is open,
+// see ConnectionClose.CircuitOpen
+type CircuitOpenError struct {
+	// When the breaker opened
+	Since time.Time
+	// When the next connection attempt will probe
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("Circuit breaker open since %v, probing at %v", e.Since, e.Until)
+}
+
+// Validate a circuit breaker config, returning its errors
+func validateCircuitBreakerConfig(config *CircuitBreakerConfig) string {
+	if config == nil {
+		return ""
+	}
+	errorStrs := ""
+	if config.MaxConsecutiveFailures < 0 || config.ErrorRateWindow < 0 ||
+		config.MinErrorRateSamples < 0 || config.Cooldown < 0 {
+		errorStrs += "Invalid CircuitBreaker. MaxConsecutiveFailures, ErrorRateWindow, MinErrorRateSamples and Cooldown should be >= 0.\n"
+	}
+	if config.MaxErrorRate < 0 || config.MaxErrorRate > 1 {
+		errorStrs += "Invalid CircuitBreaker MaxErrorRate. Should be between 0 and 1.\n"
+	}
+	return errorStrs
+}
+
+// Outcomes counted in one second of the error rate window
+type circuitBucket struct {
+	second    int64
+	successes int
+	failures  int
+}
+
+// Circuit breaker, nil when not configured, which allows everything
+type circuitBreaker struct {
+	config *CircuitBreakerConfig
+	lock   *sync.Mutex
+
+	state       CircuitState
+	since       time.Time
+	until       time.Time
+	consecutive int
+	//oldest first
+	buckets []circuitBucket
+	//state changes to report once the lock is released
+	changes [][2]CircuitState
+}
+
+// Create a circuit breaker, nil if config is, applying the defaults to config
+func newCircuitBreaker(config *CircuitBreakerConfig) *circuitBreaker {
+	if config == nil {
+		return nil
+	}
+	if config.MaxConsecutiveFailures == 0 {
+		config.MaxConsecutiveFailures = 5
+	}
+	if config.ErrorRateWindow == 0 {
+		config.ErrorRateWindow = 60000
+	}
+	if config.MinErrorRateSamples == 0 {
+		config.MinErrorRateSamples = 10
+	}
+	if config.Cooldown == 0 {
+		config.Cooldown = 30000
+	}
+	if config.clock == nil {
+		config.clock = realClock{}
+	}
+	return &circuitBreaker{
+		config: config,
+		lock:   new(sync.Mutex),
+	}
+}
+
+// Current state, CircuitClosed for a nil breaker
+func (b *circuitBreaker) currentState() CircuitState {
+	if b == nil {
+		return CircuitClosed
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// Whether a connection attempt may be made, a CircuitOpenError if not
+// The first call once the cooldown is over moves to CircuitHalfOpen and
+// allows the probe
+func (b *circuitBreaker) allow() *CircuitOpenError {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.unlock()
+	if b.state != CircuitOpen {
+		return nil
+	}
+	if b.config.clock.Now().Before(b.until) {
+		return &CircuitOpenError{Since: b.since, Until: b.until}
+	}
+	b.setState(CircuitHalfOpen)
+	return nil
+}
+
+// Count a connection made, or a payload sent, as a success
+// A connection made by the probe closes the breaker
+func (b *circuitBreaker) success(connected bool) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.unlock()
+	b.record(false)
+	if !connected {
+		return
+	}
+	b.consecutive = 0
+	if b.state == CircuitHalfOpen {
+		b.setState(CircuitClosed)
+		b.buckets = nil
+	}
+}
+
+// Count a failed dial or dropped connection, opening the breaker once
+// there are too many
+func (b *circuitBreaker) failure() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.unlock()
+	b.record(true)
+	b.consecutive++
+	if b.state == CircuitHalfOpen || b.consecutive >= b.config.MaxConsecutiveFailures || b.errorRateExceeded() {
+		b.open()
+	}
+}
+
+func (b *circuitBreaker) open() {
+	if b.state == CircuitOpen {
+		return
+	}
+	b.since = b.config.clock.Now()
+	b.until = b.since.Add(time.Duration(b.config.Cooldown) * time.Millisecond)
+	b.setState(CircuitOpen)
+}
+
+// Add an outcome to the window, dropping the seconds that have left it
+func (b *circuitBreaker) record(failed bool) {
+	second := b.config.clock.Now().Unix()
+	oldest := second - int64(b.config.ErrorRateWindow/1000)
+	for len(b.buckets) > 0 && b.buckets[0].second <= oldest {
+		b.buckets = b.buckets[1:]
+	}
+	if len(b.buckets) == 0 || b.buckets[len(b.buckets)-1].second != second {
+		b.buckets = append(b.buckets, circuitBucket{second: second})
+	}
+	bucket := &b.buckets[len(b.buckets)-1]
+	if failed {
+		bucket.failures++
+	} else {
+		bucket.successes++
+	}
+}
+
+func (b *circuitBreaker) errorRateExceeded() bool {
+	if b.config.MaxErrorRate == 0 {
+		return false
+	}
+	successes, failures := 0, 0
+	for _, bucket := range b.buckets {
+		successes += bucket.successes
+		failures += bucket.failures
+	}
+	total := successes + failures
+	return total >= b.config.MinErrorRateSamples && float64(failures)/float64(total) >= b.config.MaxErrorRate
+}
+
+// Change state, called with the lock held
+func (b *circuitBreaker) setState(to CircuitState) {
+	b.changes = append(b.changes, [2]CircuitState{b.state, to})
+	b.state = to
+}
+
+// Release the lock, then report any state changes
+func (b *circuitBreaker) unlock() {
+	changes := b.changes
+	b.changes = nil
+	b.lock.Unlock()
+	if b.config.StateChangeCallback != nil {
+		for _, change := range changes {
+			b.config.StateChangeCallback(change[0], change[1])
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package apns
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func circuitTestBreaker(config *CircuitBreakerConfig) (*circuitBreaker, *fakeClock, func() []string) {
+	clock := newFakeClock()
+	config.clock = clock
+	lock := new(sync.Mutex)
+	changes := []string{}
+	config.StateChangeCallback = func(from CircuitState, to CircuitState) {
+		lock.Lock()
+		defer lock.Unlock()
+		changes = append(changes, fmt.Sprintf("%v->%v", from, to))
+	}
+	return newCircuitBreaker(config), clock, func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, changes...)
+	}
+}
+
+func TestCircuitBreakerShouldOpenAfterConsecutiveFailures(t *testing.T) {
+	breaker, clock, changes := circuitTestBreaker(&CircuitBreakerConfig{MaxConsecutiveFailures: 3, Cooldown: 1000})
+	breaker.failure()
+	breaker.failure()
+	//a connection made starts the count again
+	breaker.success(true)
+	breaker.failure()
+	breaker.failure()
+	if breaker.currentState() != CircuitClosed || breaker.allow() != nil {
+		t.Fatal(fmt.Sprintf("Expected the breaker to stay closed but it is %v", breaker.currentState()))
+	}
+
+	breaker.failure()
+	open := breaker.allow()
+	if open == nil || !open.Until.Equal(clock.Now().Add(time.Second)) {
+		t.Fatal(fmt.Sprintf("Expected the breaker to open for the cooldown but got %v", open))
+	}
+
+	//the probe fails, opening it again
+	<-clock.After(time.Second)
+	if breaker.allow() != nil || breaker.currentState() != CircuitHalfOpen {
+		t.Fatal(fmt.Sprintf("Expected a probe after the cooldown but the breaker is %v", breaker.currentState()))
+	}
+	breaker.failure()
+	if breaker.allow() == nil {
+		t.Error("Expected a failed probe to open the breaker")
+	}
+
+	<-clock.After(time.Second)
+	breaker.allow()
+	breaker.success(true)
+	expected := "[CLOSED->OPEN OPEN->HALF_OPEN HALF_OPEN->OPEN OPEN->HALF_OPEN HALF_OPEN->CLOSED]"
+	if breaker.currentState() != CircuitClosed || fmt.Sprint(changes()) != expected {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expected, changes()))
+	}
+}
+
+func TestCircuitBreakerShouldOpenOnErrorRate(t *testing.T) {
+	breaker, clock, _ := circuitTestBreaker(&CircuitBreakerConfig{
+		MaxConsecutiveFailures: 100,
+		MaxErrorRate:           0.5,
+		ErrorRateWindow:        10000,
+		MinErrorRateSamples:    4,
+	})
+	breaker.failure()
+	breaker.failure()
+	breaker.success(false)
+	if breaker.currentState() != CircuitClosed {
+		t.Error("Expected too few samples not to open the breaker")
+	}
+
+	//the first failures leave the window
+	<-clock.After(10 * time.Second)
+	breaker.success(false)
+	breaker.failure()
+	breaker.success(false)
+	if breaker.currentState() != CircuitClosed {
+		t.Error("Expected a third of the window failing not to open the breaker")
+	}
+	breaker.failure()
+	if breaker.currentState() != CircuitOpen {
+		t.Error(fmt.Sprintf("Expected half the window failing to open the breaker but it is %v", breaker.currentState()))
+	}
+}
+
+func TestCircuitBreakerShouldAllowEverythingWhenNotConfigured(t *testing.T) {
+	var breaker *circuitBreaker
+	for i := 0; i < 10; i++ {
+		breaker.failure()
+	}
+	if breaker.allow() != nil || breaker.currentState() != CircuitClosed {
+		t.Error("Expected a nil breaker to stay closed")
+	}
+}
+
+func TestReconnectShouldFailFastWhileCircuitOpen(t *testing.T) {
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	changes := make(chan string, 10)
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig:   &APNSConfig{InFlightPayloadBufferSize: 100, FramingTimeout: 1, MaxPayloadSize: 2048},
+		ReconnectBaseDelay: 1,
+		CircuitBreaker: &CircuitBreakerConfig{
+			MaxConsecutiveFailures: 3,
+			Cooldown:               200,
+			StateChangeCallback: func(from CircuitState, to CircuitState) {
+				changes <- fmt.Sprintf("%v->%v", from, to)
+			},
+		},
+		dial: dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := groupTestPayload(0)
+	conn.SendChannel <- dropped
+	waitForPoolSends(t, dialer, []int{1})
+	dialer.lock.Lock()
+	dialer.fail = true
+	dialer.lock.Unlock()
+	//the drop and two failed dials
+	dialer.socket(0).Close()
+
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.CircuitOpen == nil || connectionClose.UnsentPayloads.Len() != 1 ||
+		connectionClose.UnsentPayloads.Front().Value != dropped {
+		t.Fatal(fmt.Sprintf("Expected the payload to resend to be failed fast but got %v", connectionClose))
+	}
+	if state := conn.State(); state != StateThrottled {
+		t.Error(fmt.Sprintf("Expected the connection to be throttled but was %v", state))
+	}
+	if change := <-changes; change != "CLOSED->OPEN" || conn.CircuitState() != CircuitOpen {
+		t.Error(fmt.Sprintf("Expected the breaker to open but got %v", change))
+	}
+
+	//new payloads are failed straight away
+	payload := groupTestPayload(1)
+	conn.SendChannel <- payload
+	connectionClose = <-conn.CloseChannel
+	sendErrors := connectionClose.SendErrors()
+	if len(sendErrors) != 1 || sendErrors[0].Payload != payload || sendErrors[0].Err != connectionClose.CircuitOpen {
+		t.Error(fmt.Sprintf("Expected the payload to be failed fast but got %v", sendErrors))
+	}
+
+	dialer.lock.Lock()
+	dialer.fail = false
+	dialer.lock.Unlock()
+	for _, expected := range []string{"OPEN->HALF_OPEN", "HALF_OPEN->CLOSED"} {
+		if change := <-changes; change != expected {
+			t.Error(fmt.Sprintf("Expected %v but got %v", expected, change))
+		}
+	}
+	conn.SendChannel <- groupTestPayload(2)
+	waitForPoolSends(t, dialer, []int{1, 1})
+
+	conn.Close()
+	for connectionClose = range conn.CloseChannel {
+	}
+	if connectionClose.UnsentPayloads.Len() != 0 {
+		t.Error(fmt.Sprintf("Unexpected final close %v", connectionClose))
+	}
+}
@@ -0,0 +1,102 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// What an APNSConnectionPool does with a ConnectionClose when nothing is
+// reading CloseChannel and its buffer (APNSPoolConfig.CloseBufferSize)
+// is full
+// The final ConnectionClose, sent by Close, always waits to be read
+type CloseFullPolicy int
+
+const (
+	// Wait for it to be read, holding up the connection that closed (and
+	// its replacement) meanwhile
+	CloseBlock CloseFullPolicy = iota
+	// Drop it, counted in CloseStats.Dropped, its UnsentPayloads are lost
+	CloseDrop
+	// Drop it, handing its UnsentPayloads to the DeadLetterHandler
+	CloseDeadLetter
+)
+
+var closeFullPolicyNames = map[CloseFullPolicy]string{
+	CloseBlock:      "block",
+	CloseDrop:       "drop",
+	CloseDeadLetter: "dead letter",
+}
+
+func (p CloseFullPolicy) String() string {
+	if name, ok := closeFullPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("CloseFullPolicy(%d)", int(p))
+}
+
+// How the pool's ConnectionCloses have been passed on, see
+// APNSConnectionPool.CloseStats
+type CloseStats struct {
+	// The pool's CloseFullPolicy
+	Policy CloseFullPolicy
+	// The pool's CloseBufferSize
+	BufferSize int
+	// ConnectionCloses of the connections sent on CloseChannel, not
+	// counting the final one
+	Delivered uint64
+	// ConnectionCloses dropped as CloseChannel was full
+	Dropped uint64
+	// Payloads of dropped ConnectionCloses handed to the DeadLetterHandler
+	DeadLettered uint64
+}
+
+// CloseStats counts, updated atomically
+type closeCounts struct {
+	delivered, dropped, deadLettered uint64
+}
+
+// How the pool's ConnectionCloses have been passed on, safe to call from
+// any goroutine
+func (p *APNSConnectionPool) CloseStats() CloseStats {
+	return CloseStats{
+		Policy:       p.config.CloseFullPolicy,
+		BufferSize:   p.config.CloseBufferSize,
+		Delivered:    atomic.LoadUint64(&p.closes.delivered),
+		Dropped:      atomic.LoadUint64(&p.closes.dropped),
+		DeadLettered: atomic.LoadUint64(&p.closes.deadLettered),
+	}
+}
+
+// Pass a connection's close on to CloseChannel, applying the
+// CloseFullPolicy if it is full
+func (p *APNSConnectionPool) passOn(connectionClose *ConnectionClose) {
+	if p.config.CloseFullPolicy == CloseBlock {
+		p.CloseChannel <- connectionClose
+		atomic.AddUint64(&p.closes.delivered, 1)
+		return
+	}
+	select {
+	case p.CloseChannel <- connectionClose:
+		atomic.AddUint64(&p.closes.delivered, 1)
+		return
+	default:
+	}
+
+	atomic.AddUint64(&p.closes.dropped, 1)
+	if p.config.CloseFullPolicy != CloseDeadLetter {
+		return
+	}
+	//a rejected payload was given to the handler by its connection, unless
+	//the socket dropped, which doesn't say whether apple read it
+	reason := errors.New(fmt.Sprintf("ConnectionClose dropped as CloseChannel was full (%v buffered): %v",
+		p.config.CloseBufferSize, connectionClose.Error))
+	if connectionClose.ErrorPayload != nil && connectionClose.Error != nil && connectionClose.Error.ErrorCode == 10 {
+		p.deadLetter(connectionClose.ErrorPayload, 1, reason)
+		atomic.AddUint64(&p.closes.deadLettered, 1)
+	}
+	for e := connectionClose.UnsentPayloads.Front(); e != nil; e = e.Next() {
+		p.deadLetter(e.Value.(*Payload), 1, reason)
+		atomic.AddUint64(&p.closes.deadLettered, 1)
+	}
+}
@@ -0,0 +1,94 @@
+package apns
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Wait for the pool to have passed on count closes, read or not
+func waitForCloses(t *testing.T, pool *APNSConnectionPool, count uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := pool.CloseStats()
+		if stats.Delivered+stats.Dropped >= count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("Expected %v closes but got %+v", count, stats))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolShouldKeepSendingWithStalledCloseChannel(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	recorder := newDeadLetterRecorder()
+	app.Pool.ConnectionConfig.DeadLetterHandler = recorder.handler
+	app.Pool.ReconnectInterval = 1
+	app.Pool.CloseBufferSize = 1
+	app.Pool.CloseFullPolicy = CloseDeadLetter
+	pool, err := NewAPNSConnectionPool(app.Pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//nothing reads CloseChannel, each rejection closes the connection
+	for i := 0; i < 3; i++ {
+		payload := groupTestPayload(i)
+		server.RejectToken(payload.Token, "INVALID_TOKEN")
+		select {
+		case pool.SendChannel <- payload:
+		case <-time.After(5 * time.Second):
+			t.Fatal(fmt.Sprintf("Expected payload %v to be taken", i))
+		}
+		waitForCloses(t, pool, uint64(i+1))
+	}
+	select {
+	case pool.SendChannel <- groupTestPayload(3):
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the pool to keep taking payloads")
+	}
+	if _, err := server.WaitForNotifications(4, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	//a dropped close's unsent payloads are dead lettered
+	unsent := groupTestPayload(4)
+	unsentList := list.New()
+	unsentList.PushBack(unsent)
+	pool.passOn(&ConnectionClose{Error: &AppleError{ErrorCode: 10}, UnsentPayloads: unsentList})
+	letters := recorder.expect(t, 4)
+	if letter, ok := letters[unsent]; !ok || !strings.Contains(letter.lastReason.Error(), "CloseChannel was full") {
+		t.Error(fmt.Sprintf("Expected the unsent payload to be dead lettered but got %+v", letter))
+	}
+	stats := pool.CloseStats()
+	if stats != (CloseStats{Policy: CloseDeadLetter, BufferSize: 1, Delivered: 1, Dropped: 3, DeadLettered: 1}) {
+		t.Error(fmt.Sprintf("Expected 1 close delivered and 3 dropped but got %+v", stats))
+	}
+
+	//the final close isn't dropped
+	pool.Close()
+	closes := 0
+	for range pool.CloseChannel {
+		closes++
+	}
+	if closes != 2 {
+		t.Error(fmt.Sprintf("Expected the buffered and final closes but got %v", closes))
+	}
+}
+
+func TestPoolShouldRejectInvalidCloseConfig(t *testing.T) {
+	_, app, _ := newManagerTestApps(t)
+	app.Pool.CloseBufferSize = -1
+	app.Pool.CloseFullPolicy = CloseFullPolicy(7)
+	_, err := NewAPNSConnectionPool(app.Pool)
+	if err == nil || !strings.Contains(err.Error(), "CloseBufferSize") || !strings.Contains(err.Error(), "CloseFullPolicy") {
+		t.Error(fmt.Sprintf("Expected CloseBufferSize and CloseFullPolicy to be invalid but got %v", err))
+	}
+	if name := CloseDeadLetter.String(); name != "dead letter" {
+		t.Error(fmt.Sprintf("Expected dead letter but got %v", name))
+	}
+}
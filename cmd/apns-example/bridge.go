@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// Body of a POST to the bridge's /push endpoint
+type pushRequest struct {
+	Token  string                 `json:"token"`
+	Alert  string                 `json:"alert"`
+	Badge  *int                   `json:"badge,omitempty"`
+	Sound  string                 `json:"sound,omitempty"`
+	Custom map[string]interface{} `json:"custom,omitempty"`
+}
+
+// HTTP front end that validates pushes and puts them on the bounded queue,
+// refusing them when the queue is full rather than buffering without limit
+type bridge struct {
+	queue          chan *item
+	stats          *stats
+	maxPayloadSize int
+	nextId         uint64
+	closed         bool
+	lock           *sync.RWMutex
+}
+
+func newBridge(queueSize int, maxPayloadSize int, s *stats) *bridge {
+	return &bridge{
+		queue:          make(chan *item, queueSize),
+		stats:          s,
+		maxPayloadSize: maxPayloadSize,
+		lock:           new(sync.RWMutex),
+	}
+}
+
+func (b *bridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST a push to /push", http.StatusMethodNotAllowed)
+		return
+	}
+	request := &pushRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid push: %v", err), http.StatusBadRequest)
+		return
+	}
+	payload, err := b.payload(request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.closed {
+		b.stats.refused.Add(1)
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	queued := &item{
+		id:      atomic.AddUint64(&b.nextId, 1),
+		payload: payload,
+	}
+	select {
+	case b.queue <- queued:
+		b.stats.accepted.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "{\"id\":%v}\n", queued.id)
+	default:
+		b.stats.refused.Add(1)
+		http.Error(w, "Queue is full", http.StatusServiceUnavailable)
+	}
+}
+
+// Build and validate the payload up front, the connection can't report
+// a bad token or payload back to the caller
+func (b *bridge) payload(request *pushRequest) (*apns.Payload, error) {
+	token, err := hex.DecodeString(request.Token)
+	if err != nil || len(token) != 32 {
+		return nil, fmt.Errorf("Invalid token %q, should be 64 hex characters", request.Token)
+	}
+	payload := &apns.Payload{
+		Token:        request.Token,
+		AlertText:    request.Alert,
+		Sound:        request.Sound,
+		CustomFields: request.Custom,
+	}
+	if request.Badge != nil {
+		payload.Badge = apns.NewBadgeNumber(*request.Badge)
+	}
+	if _, err := payload.Marshal(b.maxPayloadSize); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Stop accepting pushes and close the queue so the senders drain it
+func (b *bridge) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+}
+
+// Health, stats and expvar endpoints
+func adminHandler(s *stats) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if s.connected.Value() == 0 {
+			http.Error(w, "No connections to the gateway", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, s.vars.String())
+	})
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
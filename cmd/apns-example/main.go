@@ -0,0 +1,296 @@
+// Reference setup for running go-libapns in production: a pool of
+// reconnecting connections fed from a bounded queue through an HTTP bridge,
+// with rate limiting, dead lettering to disk, expvar metrics, an admin
+// endpoint and graceful shutdown on SIGINT/SIGTERM.
+//
+// Run it against the real gateway:
+//
+//	apns-example -cert cert.pem -key key.pem
+//
+// or against an in process mock gateway:
+//
+//	apns-example -mock
+//
+// then push with:
+//
+//	curl -d '{"token":"<64 hex chars>","alert":"hello"}' localhost:8080/push
+//
+// On shutdown it prints a json report accounting for every accepted push,
+// and exits non zero if any can't be accounted for.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// Settings for the example, set from flags
+type options struct {
+	CertFile     string
+	KeyFile      string
+	Gateway      string
+	Mock         bool
+	Listen       string
+	Admin        string
+	Connections  int
+	QueueSize    int
+	Rate         float64
+	DeadLetters  string
+	MaxAttempts  int
+	Grace        time.Duration
+	DrainTimeout time.Duration
+}
+
+// Printed on exit, every accepted push is either delivered or dead lettered
+type exitReport struct {
+	Accepted             int64  `json:"accepted"`
+	Refused              int64  `json:"refused"`
+	Delivered            int64  `json:"delivered"`
+	DeliveredUnconfirmed int64  `json:"delivered_unconfirmed"`
+	Requeued             int64  `json:"requeued"`
+	DeadLettered         int64  `json:"dead_lettered"`
+	Reconnects           int64  `json:"reconnects"`
+	Unaccounted          int64  `json:"unaccounted"`
+	DeadLetterFile       string `json:"dead_letter_file"`
+}
+
+// A running example
+type example struct {
+	options      options
+	stats        *stats
+	bridge       *bridge
+	bridgeServer *http.Server
+	adminServer  *http.Server
+	bridgeAddr   string
+	adminAddr    string
+	deadLetters  *deadLetterWriter
+	mock         *mockGateway
+	senders      *sync.WaitGroup
+	abort        chan bool
+}
+
+func main() {
+	opts := options{}
+	flag.StringVar(&opts.CertFile, "cert", "", "path to the certificate pem (not needed with -mock)")
+	flag.StringVar(&opts.KeyFile, "key", "", "path to the unencrypted key pem (not needed with -mock)")
+	flag.StringVar(&opts.Gateway, "gateway", "gateway.push.apple.com:2195", "gateway host:port")
+	flag.BoolVar(&opts.Mock, "mock", false, "send to an in process mock gateway instead")
+	flag.StringVar(&opts.Listen, "listen", "localhost:8080", "address for the push bridge")
+	flag.StringVar(&opts.Admin, "admin", "localhost:8081", "address for the admin endpoints")
+	flag.IntVar(&opts.Connections, "connections", 2, "number of gateway connections")
+	flag.IntVar(&opts.QueueSize, "queue", 10000, "max number of pushes waiting to be sent")
+	flag.Float64Var(&opts.Rate, "rate", 0, "max notifications per second per connection, 0 for no limit")
+	flag.StringVar(&opts.DeadLetters, "dead-letters", "apns-dead-letters.json", "file pushes that can't be delivered are appended to")
+	flag.IntVar(&opts.MaxAttempts, "max-attempts", 5, "times to try a push before dead lettering it")
+	flag.DurationVar(&opts.Grace, "grace", 500*time.Millisecond, "time to wait for errors from apple before disconnecting")
+	flag.DurationVar(&opts.DrainTimeout, "drain-timeout", 30*time.Second, "time to spend draining the queue on shutdown")
+	flag.Parse()
+
+	e, err := startExample(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	expvar.Publish("apns", e.stats.vars)
+	log.Printf("pushes on http://%v/push, admin on http://%v", e.bridgeAddr, e.adminAddr)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("received %v, shutting down", <-signals)
+
+	report := e.shutdown()
+	json.NewEncoder(os.Stdout).Encode(report)
+	if report.Unaccounted != 0 {
+		os.Exit(1)
+	}
+}
+
+func (o options) validate() error {
+	errorStrs := ""
+	if !o.Mock && (o.CertFile == "" || o.KeyFile == "") {
+		errorStrs += "A -cert and -key are required unless using -mock\n"
+	}
+	if !o.Mock {
+		if _, _, err := net.SplitHostPort(o.Gateway); err != nil {
+			errorStrs += fmt.Sprintf("Invalid -gateway: %v\n", err)
+		}
+	}
+	if o.Connections < 1 {
+		errorStrs += "Should have at least 1 connection\n"
+	}
+	if o.QueueSize < 1 {
+		errorStrs += "Queue size should be at least 1\n"
+	}
+	if o.Rate < 0 {
+		errorStrs += "Rate should be >= 0\n"
+	}
+	if o.MaxAttempts < 1 {
+		errorStrs += "Max attempts should be at least 1\n"
+	}
+	if o.DeadLetters == "" {
+		errorStrs += "A dead letter file is required\n"
+	}
+	if errorStrs != "" {
+		return errors.New(errorStrs)
+	}
+	return nil
+}
+
+// Validate the options, connect, and start serving pushes
+func startExample(opts options) (*example, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	e := &example{
+		options: opts,
+		stats:   newStats(),
+		senders: new(sync.WaitGroup),
+		abort:   make(chan bool),
+	}
+
+	config := apns.APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		SocketTimeout:             5,
+		TlsTimeout:                5,
+		MaxNotificationsPerSecond: opts.Rate,
+		RateLimitBurst:            100,
+		SlowStartFraction:         0.1,
+		SlowStartRampTime:         5000,
+	}
+	if opts.Rate == 0 {
+		config.SlowStartFraction = 0
+		config.SlowStartRampTime = 0
+	}
+
+	var err error
+	if opts.Mock {
+		e.mock, err = startMockGateway("127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		opts.Gateway = e.mock.Addr()
+		config.CertificateBytes = e.mock.ClientCertPEM
+		config.KeyBytes = e.mock.ClientKeyPEM
+		config.RootCAs = e.mock.RootCAs
+	} else {
+		if config.CertificateBytes, err = ioutil.ReadFile(opts.CertFile); err != nil {
+			return nil, err
+		}
+		if config.KeyBytes, err = ioutil.ReadFile(opts.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	config.GatewayAddr = opts.Gateway
+
+	if e.deadLetters, err = openDeadLetterWriter(opts.DeadLetters); err != nil {
+		e.stopMock()
+		return nil, err
+	}
+
+	e.bridge = newBridge(opts.QueueSize, apns.MaxPayloadSizeBinary, e.stats)
+	for i := 0; i < opts.Connections; i++ {
+		s := &sender{
+			name:        fmt.Sprintf("connection %v", i),
+			config:      config,
+			queue:       e.bridge.queue,
+			deadLetters: e.deadLetters,
+			stats:       e.stats,
+			maxAttempts: opts.MaxAttempts,
+			grace:       opts.Grace,
+			abort:       e.abort,
+		}
+		e.senders.Add(1)
+		go func() {
+			defer e.senders.Done()
+			s.run()
+		}()
+	}
+
+	bridgeMux := http.NewServeMux()
+	bridgeMux.Handle("/push", e.bridge)
+	if e.bridgeServer, e.bridgeAddr, err = serve(opts.Listen, bridgeMux); err != nil {
+		e.shutdown()
+		return nil, err
+	}
+	if e.adminServer, e.adminAddr, err = serve(opts.Admin, adminHandler(e.stats)); err != nil {
+		e.shutdown()
+		return nil, err
+	}
+	return e, nil
+}
+
+// Start an http server, returning it with the address it is listening on
+func serve(addr string, handler http.Handler) (*http.Server, string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, "", err
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	return server, listener.Addr().String(), nil
+}
+
+// Stop accepting pushes, drain the queue (dead lettering what can't be sent
+// before the drain timeout), then stop everything else
+func (e *example) shutdown() *exitReport {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if e.bridgeServer != nil {
+		e.bridgeServer.Shutdown(ctx)
+	}
+	e.bridge.close()
+
+	drained := make(chan bool)
+	go func() {
+		e.senders.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(e.options.DrainTimeout):
+		log.Printf("queue not drained after %v, dead lettering the rest", e.options.DrainTimeout)
+		close(e.abort)
+		<-drained
+	}
+
+	if e.adminServer != nil {
+		e.adminServer.Shutdown(ctx)
+	}
+	e.deadLetters.Close()
+	e.stopMock()
+
+	report := &exitReport{
+		Accepted:             e.stats.accepted.Value(),
+		Refused:              e.stats.refused.Value(),
+		Delivered:            e.stats.delivered.Value(),
+		DeliveredUnconfirmed: e.stats.unconfirmed.Value(),
+		Requeued:             e.stats.requeued.Value(),
+		DeadLettered:         e.stats.deadLettered.Value(),
+		Reconnects:           e.stats.reconnects.Value(),
+		DeadLetterFile:       e.options.DeadLetters,
+	}
+	report.Unaccounted = report.Accepted - report.Delivered - report.DeadLettered
+	return report
+}
+
+func (e *example) stopMock() {
+	if e.mock != nil {
+		e.mock.Stop()
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exampleTestOptions(t *testing.T) options {
+	dir, err := ioutil.TempDir("", "apns-example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return options{
+		Mock:         true,
+		Listen:       "127.0.0.1:0",
+		Admin:        "127.0.0.1:0",
+		Connections:  2,
+		QueueSize:    1000,
+		DeadLetters:  filepath.Join(dir, "dead-letters.json"),
+		MaxAttempts:  5,
+		Grace:        100 * time.Millisecond,
+		DrainTimeout: 10 * time.Second,
+	}
+}
+
+func push(t *testing.T, e *example, token string, alert string) int {
+	body := fmt.Sprintf(`{"token":%q,"alert":%q}`, token, alert)
+	resp, err := http.Post("http://"+e.bridgeAddr+"/push", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func exampleToken(i int) string {
+	return fmt.Sprintf("%064x", i+1)
+}
+
+func waitForHealthy(t *testing.T, e *example) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get("http://" + e.adminAddr + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Example never connected to the mock gateway")
+}
+
+func readDeadLetters(t *testing.T, path string) []*deadLetter {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var letters []*deadLetter
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		letter := &deadLetter{}
+		if err := json.Unmarshal(scanner.Bytes(), letter); err != nil {
+			t.Fatal(err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters
+}
+
+func TestExampleShouldAccountForEveryPushWhenGatewayDies(t *testing.T) {
+	opts := exampleTestOptions(t)
+	defer os.RemoveAll(filepath.Dir(opts.DeadLetters))
+
+	e, err := startExample(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForHealthy(t, e)
+
+	for i := 0; i < 100; i++ {
+		if status := push(t, e, exampleToken(i), fmt.Sprintf("push %v", i)); status != http.StatusAccepted {
+			t.Fatalf("Expected push to be accepted but got %v", status)
+		}
+	}
+	//rejected by the mock, so dead lettered
+	deadToken := "dead" + exampleToken(0)[4:]
+	push(t, e, deadToken, "bad token")
+
+	//kill the gateway mid run, pushes queue up until it comes back
+	time.Sleep(50 * time.Millisecond)
+	e.mock.Stop()
+	for i := 100; i < 150; i++ {
+		push(t, e, exampleToken(i), fmt.Sprintf("push %v", i))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := e.mock.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 150; i < 200; i++ {
+		push(t, e, exampleToken(i), fmt.Sprintf("push %v", i))
+	}
+
+	resp, err := http.Get("http://" + e.adminAddr + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Contains(stats, []byte(`"accepted": 201`)) {
+		t.Errorf("Expected stats to show 201 accepted but got %s", stats)
+	}
+
+	report := e.shutdown()
+
+	if report.Unaccounted != 0 {
+		t.Errorf("Expected every push to be accounted for but got %+v", report)
+	}
+	if report.Accepted != 201 || report.DeadLettered < 1 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	letters := readDeadLetters(t, opts.DeadLetters)
+	if int64(len(letters)) != report.DeadLettered {
+		t.Errorf("Expected %v dead letters but the file has %v", report.DeadLettered, len(letters))
+	}
+	foundDead := false
+	for _, letter := range letters {
+		if letter.Token == deadToken {
+			foundDead = true
+		}
+	}
+	if !foundDead {
+		t.Errorf("Expected rejected token in dead letters %+v", letters)
+	}
+
+	//anything that never reached the gateway must have been dead lettered
+	received := e.mock.Received()
+	missing := 0
+	for i := 0; i < 200; i++ {
+		if received[exampleToken(i)] == 0 {
+			missing++
+		}
+	}
+	if int64(missing) > report.DeadLettered {
+		t.Errorf("%v pushes never reached the gateway but only %v were dead lettered", missing, report.DeadLettered)
+	}
+}
+
+func TestExampleShouldDeadLetterWhenGatewayNeverReturns(t *testing.T) {
+	opts := exampleTestOptions(t)
+	opts.DrainTimeout = 300 * time.Millisecond
+	defer os.RemoveAll(filepath.Dir(opts.DeadLetters))
+
+	e, err := startExample(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForHealthy(t, e)
+	e.mock.Stop()
+	for i := 0; i < 20; i++ {
+		push(t, e, exampleToken(i), "never delivered")
+	}
+
+	report := e.shutdown()
+	if report.Unaccounted != 0 {
+		t.Errorf("Expected every push to be accounted for but got %+v", report)
+	}
+	if report.Accepted != 20 || report.DeadLettered != 20 {
+		t.Errorf("Expected all 20 pushes dead lettered but got %+v", report)
+	}
+}
+
+func TestExampleShouldRefuseInvalidPushes(t *testing.T) {
+	opts := exampleTestOptions(t)
+	defer os.RemoveAll(filepath.Dir(opts.DeadLetters))
+
+	e, err := startExample(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.shutdown()
+
+	if status := push(t, e, "not hex", "hi"); status != http.StatusBadRequest {
+		t.Errorf("Expected bad request for an invalid token but got %v", status)
+	}
+	body := fmt.Sprintf(`{"token":%q,"alert":"hi","custom":{"blob":%q}}`, exampleToken(0), strings.Repeat("x", 3000))
+	resp, err := http.Post("http://"+e.bridgeAddr+"/push", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected bad request for a payload that is too long but got %v", resp.StatusCode)
+	}
+}
+
+func TestExampleOptionsValidation(t *testing.T) {
+	err := options{}.validate()
+	if err == nil {
+		t.Fatal("Expected invalid options")
+	}
+	for _, expected := range []string{"-cert", "connection", "Queue size", "Max attempts", "dead letter"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q in validation error %v", expected, err)
+		}
+	}
+}
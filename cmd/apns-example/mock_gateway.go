@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In process stand in for the binary gateway, used with -mock and in tests.
+// Accepts any client certificate, records every token it receives and
+// rejects tokens starting with RejectTokenPrefix with an invalid token error
+type mockGateway struct {
+	// Tokens starting with this (hex) prefix are rejected
+	RejectTokenPrefix string
+	// Authorities to verify the mock with, set as APNSConfig.RootCAs
+	RootCAs *x509.CertPool
+	// Client certificate and key to connect with
+	ClientCertPEM []byte
+	ClientKeyPEM  []byte
+
+	addr      string
+	tlsConfig *tls.Config
+	listener  net.Listener
+	conns     map[net.Conn]bool
+	received  map[string]int
+	lock      *sync.Mutex
+}
+
+// Start a mock gateway listening on addr (use "127.0.0.1:0" for any port)
+func startMockGateway(addr string) (*mockGateway, error) {
+	ca, caKey, err := newMockCertificate(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	server, serverKey, err := newMockCertificate(ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+	client, clientKey, err := newMockCertificate(ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mockGateway{
+		RejectTokenPrefix: "dead",
+		RootCAs:           x509.NewCertPool(),
+		conns:             make(map[net.Conn]bool),
+		received:          make(map[string]int),
+		lock:              new(sync.Mutex),
+	}
+	m.RootCAs.AddCert(ca)
+	m.ClientCertPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: client.Raw})
+	m.ClientKeyPEM, err = encodeMockKey(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	serverKeyPEM, err := encodeMockKey(serverKey)
+	if err != nil {
+		return nil, err
+	}
+	serverCert, err := tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Raw}), serverKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	m.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+
+	m.addr = addr
+	if err := m.Start(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Host and port the mock is listening on
+func (m *mockGateway) Addr() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.addr
+}
+
+// Start (or restart after Stop) listening on the same address
+func (m *mockGateway) Start() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.listener != nil {
+		return errors.New("Mock gateway is already running")
+	}
+	listener, err := tls.Listen("tcp", m.addr, m.tlsConfig)
+	if err != nil {
+		return err
+	}
+	m.listener = listener
+	m.addr = listener.Addr().String()
+	go m.accept(listener)
+	return nil
+}
+
+// Stop listening and drop every open connection, as if the gateway died
+func (m *mockGateway) Stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.listener == nil {
+		return
+	}
+	m.listener.Close()
+	m.listener = nil
+	for conn := range m.conns {
+		conn.Close()
+	}
+}
+
+// Number of times each token has been received
+func (m *mockGateway) Received() map[string]int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	received := make(map[string]int, len(m.received))
+	for token, count := range m.received {
+		received[token] = count
+	}
+	return received
+}
+
+func (m *mockGateway) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		m.lock.Lock()
+		if m.listener != listener {
+			m.lock.Unlock()
+			conn.Close()
+			return
+		}
+		m.conns[conn] = true
+		m.lock.Unlock()
+		go m.serve(conn)
+	}
+}
+
+// Read command 2 frames until the connection closes or a token is rejected
+func (m *mockGateway) serve(conn net.Conn) {
+	defer func() {
+		m.lock.Lock()
+		delete(m.conns, conn)
+		m.lock.Unlock()
+		conn.Close()
+	}()
+
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		if header[0] != 2 {
+			m.respond(conn, 1, 0)
+			return
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			return
+		}
+
+		token, id := parseMockFrame(frame)
+		if strings.HasPrefix(token, m.RejectTokenPrefix) {
+			//invalid token
+			m.respond(conn, 8, id)
+			return
+		}
+		m.lock.Lock()
+		m.received[token]++
+		m.lock.Unlock()
+	}
+}
+
+func (m *mockGateway) respond(conn net.Conn, status uint8, id uint32) {
+	response := new(bytes.Buffer)
+	response.WriteByte(8)
+	response.WriteByte(status)
+	binary.Write(response, binary.BigEndian, id)
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write(response.Bytes())
+}
+
+// Pull the token and identifier items out of a frame
+// Item lengths are trusted only as far as the frame goes
+func parseMockFrame(frame []byte) (string, uint32) {
+	var token string
+	var id uint32
+	for len(frame) >= 3 {
+		itemId := frame[0]
+		length := int(binary.BigEndian.Uint16(frame[1:3]))
+		frame = frame[3:]
+		if length > len(frame) {
+			length = len(frame)
+		}
+		data := frame[:length]
+		frame = frame[length:]
+
+		switch {
+		case itemId == 1:
+			token = hex.EncodeToString(data)
+		case itemId == 3 && len(data) == 4:
+			id = binary.BigEndian.Uint32(data)
+		}
+	}
+	return token, id
+}
+
+// Create a certificate signed by parent, or a self signed CA if parent is nil
+func newMockCertificate(parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "apns-example mock gateway"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func encodeMockKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	apns "github.com/joekarl/go-libapns"
+)
+
+// A payload accepted by the bridge, tracked until it is delivered or dead lettered
+type item struct {
+	id       uint64
+	payload  *apns.Payload
+	attempts int
+}
+
+// Line written to the dead letter file
+type deadLetter struct {
+	ID       uint64    `json:"id"`
+	Token    string    `json:"token"`
+	Alert    string    `json:"alert,omitempty"`
+	Reason   string    `json:"reason"`
+	Attempts int       `json:"attempts"`
+	At       time.Time `json:"at"`
+}
+
+// Counters shared by the senders, published through expvar
+type stats struct {
+	vars         *expvar.Map
+	accepted     *expvar.Int
+	refused      *expvar.Int
+	delivered    *expvar.Int
+	unconfirmed  *expvar.Int
+	requeued     *expvar.Int
+	deadLettered *expvar.Int
+	reconnects   *expvar.Int
+	connected    *expvar.Int
+}
+
+func newStats() *stats {
+	s := &stats{
+		vars:         new(expvar.Map).Init(),
+		accepted:     new(expvar.Int),
+		refused:      new(expvar.Int),
+		delivered:    new(expvar.Int),
+		unconfirmed:  new(expvar.Int),
+		requeued:     new(expvar.Int),
+		deadLettered: new(expvar.Int),
+		reconnects:   new(expvar.Int),
+		connected:    new(expvar.Int),
+	}
+	s.vars.Set("accepted", s.accepted)
+	s.vars.Set("refused", s.refused)
+	s.vars.Set("delivered", s.delivered)
+	s.vars.Set("delivered_unconfirmed", s.unconfirmed)
+	s.vars.Set("requeued", s.requeued)
+	s.vars.Set("dead_lettered", s.deadLettered)
+	s.vars.Set("reconnects", s.reconnects)
+	s.vars.Set("connected", s.connected)
+	return s
+}
+
+// Appends dead letters to a file as newline delimited json
+type deadLetterWriter struct {
+	file    *os.File
+	encoder *json.Encoder
+	lock    *sync.Mutex
+}
+
+func openDeadLetterWriter(path string) (*deadLetterWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterWriter{
+		file:    file,
+		encoder: json.NewEncoder(file),
+		lock:    new(sync.Mutex),
+	}, nil
+}
+
+func (w *deadLetterWriter) write(letter *deadLetter) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.encoder.Encode(letter)
+}
+
+func (w *deadLetterWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.file.Close()
+}
+
+// One connection of the pool. Takes payloads off the shared queue,
+// reconnecting whenever the connection closes and resending whatever
+// the connection reports as unsent
+type sender struct {
+	name        string
+	config      apns.APNSConfig
+	queue       <-chan *item
+	deadLetters *deadLetterWriter
+	stats       *stats
+	maxAttempts int
+	//time to wait after the queue drains for apple to report errors
+	grace time.Duration
+	//closed when senders must give up on anything still queued
+	abort <-chan bool
+
+	//payloads waiting to be resent, ahead of the queue
+	retry []*item
+	//payloads handed to the current connection, oldest first
+	inFlight *list.List
+	//payloads for the current connection, by payload
+	inFlightElements map[*apns.Payload]*list.Element
+}
+
+// Send until the queue is closed and drained, or abort is closed
+func (s *sender) run() {
+	s.inFlight = list.New()
+	s.inFlightElements = make(map[*apns.Payload]*list.Element)
+	backoff := 50 * time.Millisecond
+
+	for {
+		//copied as NewAPNSConnection fills in defaults
+		config := s.config
+		conn, err := apns.NewAPNSConnection(&config)
+		if err != nil {
+			log.Printf("%v: connect failed: %v", s.name, err)
+			select {
+			case <-s.abort:
+				s.abandon("gateway unreachable at shutdown")
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < 2*time.Second {
+				backoff *= 2
+			}
+			s.stats.reconnects.Add(1)
+			continue
+		}
+		backoff = 50 * time.Millisecond
+		s.stats.connected.Add(1)
+		done := s.serve(conn, config.InFlightPayloadBufferSize)
+		s.stats.connected.Add(-1)
+		if done {
+			return
+		}
+		s.stats.reconnects.Add(1)
+	}
+}
+
+// Send on a single connection, returns true once there's nothing left to send
+func (s *sender) serve(conn *apns.APNSConnection, bufferSize int) bool {
+	queue := s.queue
+	for {
+		var next *item
+		if len(s.retry) > 0 {
+			next = s.retry[0]
+		} else {
+			select {
+			case next = <-queue:
+			case connClose := <-conn.CloseChannel:
+				s.handleClose(connClose, false)
+				return false
+			case <-s.abort:
+				return s.shutdown(conn)
+			}
+			if next == nil {
+				//queue closed and drained
+				return s.shutdown(conn)
+			}
+		}
+
+		select {
+		case conn.SendChannel <- next.payload:
+			if len(s.retry) > 0 && s.retry[0] == next {
+				s.retry = s.retry[1:]
+			}
+			next.attempts++
+			s.inFlightElements[next.payload] = s.inFlight.PushBack(next)
+			if s.inFlight.Len() > bufferSize {
+				//out of the connection's replay window, so it went out fine
+				s.delivered(s.inFlight.Front().Value.(*item), false)
+			}
+		case connClose := <-conn.CloseChannel:
+			if len(s.retry) == 0 || s.retry[0] != next {
+				s.retry = append([]*item{next}, s.retry...)
+			}
+			s.handleClose(connClose, false)
+			return false
+		}
+	}
+}
+
+// Give apple a chance to report errors for the last payloads, then disconnect
+// Returns false if the connection closed with an error and resending is needed
+func (s *sender) shutdown(conn *apns.APNSConnection) bool {
+	select {
+	case connClose := <-conn.CloseChannel:
+		s.handleClose(connClose, false)
+		return s.finished()
+	case <-time.After(s.grace):
+	}
+
+	conn.Disconnect()
+	connClose := <-conn.CloseChannel
+	s.handleClose(connClose, true)
+	return s.finished()
+}
+
+// Whether there's nothing left to resend
+// When aborting, whatever is left is dead lettered instead
+func (s *sender) finished() bool {
+	select {
+	case <-s.abort:
+		s.abandon("undelivered at shutdown")
+		return true
+	default:
+		return len(s.retry) == 0
+	}
+}
+
+// Work out what happened to every in flight payload when the connection closes
+// disconnected is true when the close was caused by our own Disconnect
+func (s *sender) handleClose(connClose *apns.ConnectionClose, disconnected bool) {
+	var errorItem *item
+	if connClose.ErrorPayload != nil {
+		errorItem = s.remove(connClose.ErrorPayload)
+	}
+
+	var unsent []*item
+	for e := connClose.UnsentPayloads.Front(); e != nil; e = e.Next() {
+		if unsentItem := s.remove(e.Value.(*apns.Payload)); unsentItem != nil {
+			unsent = append(unsent, unsentItem)
+		}
+	}
+
+	transient := connClose.Error == nil || connClose.Error.ErrorCode == 10
+	switch {
+	case disconnected && transient:
+		//a socket close reports the connection's first payload as the
+		//error payload and everything after it as unsent, but after a
+		//flushing Disconnect with no error from apple they went out fine
+		if errorItem != nil {
+			unsent = append([]*item{errorItem}, unsent...)
+		}
+		for _, unsentItem := range unsent {
+			s.delivered(unsentItem, false)
+		}
+		unsent = nil
+	case transient:
+		//the socket dropped, so the first payload may not have been delivered
+		if errorItem != nil {
+			unsent = append([]*item{errorItem}, unsent...)
+		}
+	case errorItem != nil:
+		s.deadLetter(errorItem, connClose.Error.ErrorString)
+	}
+
+	//whatever is left was delivered before the close, although if the unsent
+	//buffer overflowed some of it may be lost
+	for s.inFlight.Len() > 0 {
+		s.delivered(s.inFlight.Front().Value.(*item), connClose.UnsentPayloadBufferOverflow)
+	}
+
+	var retry []*item
+	for _, unsentItem := range unsent {
+		if unsentItem.attempts >= s.maxAttempts {
+			s.deadLetter(unsentItem, "too many attempts")
+			continue
+		}
+		s.stats.requeued.Add(1)
+		retry = append(retry, unsentItem)
+	}
+	s.retry = append(retry, s.retry...)
+}
+
+// Stop tracking a payload for the current connection
+func (s *sender) remove(payload *apns.Payload) *item {
+	element, ok := s.inFlightElements[payload]
+	if !ok {
+		return nil
+	}
+	delete(s.inFlightElements, payload)
+	return s.inFlight.Remove(element).(*item)
+}
+
+func (s *sender) delivered(deliveredItem *item, unconfirmed bool) {
+	s.remove(deliveredItem.payload)
+	s.stats.delivered.Add(1)
+	if unconfirmed {
+		s.stats.unconfirmed.Add(1)
+	}
+}
+
+func (s *sender) deadLetter(deadItem *item, reason string) {
+	letter := &deadLetter{
+		ID:       deadItem.id,
+		Token:    deadItem.payload.Token,
+		Alert:    deadItem.payload.AlertText,
+		Reason:   reason,
+		Attempts: deadItem.attempts,
+		At:       time.Now(),
+	}
+	if err := s.deadLetters.write(letter); err != nil {
+		//still counted, the log is the last resort
+		log.Printf("%v: failed to write dead letter %+v: %v", s.name, letter, err)
+	}
+	s.stats.deadLettered.Add(1)
+}
+
+// Dead letter everything waiting to be resent and still on the queue
+func (s *sender) abandon(reason string) {
+	for _, retryItem := range s.retry {
+		s.deadLetter(retryItem, reason)
+	}
+	s.retry = nil
+	for {
+		select {
+		case queued, ok := <-s.queue:
+			if !ok {
+				return
+			}
+			s.deadLetter(queued, reason)
+		default:
+			return
+		}
+	}
+}
+
+func (s *sender) String() string {
+	return fmt.Sprintf("%v (%v in flight, %v to resend)", s.name, s.inFlight.Len(), len(s.retry))
+}
@@ -0,0 +1,15 @@
+package apns
+
+// Create a watchOS complication push carrying the custom fields, like
+// NewSilentPush but for the watch app's complication
+// The watch limits how many of these it accepts a day, so keep them for
+// updates worth spending the budget on. The topic needs the .complication
+// suffix, e.g. com.example.app.watchkitapp.complication
+func NewComplicationPayload(token string, custom map[string]interface{}) *Payload {
+	return &Payload{
+		Token:            token,
+		ContentAvailable: 1,
+		PushType:         PushTypeComplication,
+		CustomFields:     custom,
+	}
+}
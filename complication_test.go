@@ -0,0 +1,57 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestComplicationPayload(t *testing.T) {
+	p := NewComplicationPayload(validateTestToken, map[string]interface{}{"score": 3})
+	p.Priority = PriorityImmediate
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	payloadBytes, err := p.MarshalAuto()
+	if err != nil || string(payloadBytes) != `{"aps":{"content-available":1},"score":3}` {
+		t.Error(fmt.Sprintf("Unexpected complication push %s, %v", payloadBytes, err))
+	}
+
+	p.AlertBody.Body = "Score updated"
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "Complication pushes can't have an alert") {
+		t.Error(fmt.Sprintf("Expected a complication push with an alert to be invalid but got %v", err))
+	}
+}
+
+func TestHTTP2SendShouldPostComplicationPush(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(b)
+	})
+	defer server.Close()
+
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+
+	p := NewComplicationPayload(validateTestToken, map[string]interface{}{"score": 3})
+	p.Topic = "com.example.app.watchkitapp.complication"
+	if _, err := conn.Send(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	received := <-requests
+	if pushType := received.Header.Get("apns-push-type"); pushType != "complication" {
+		t.Error(fmt.Sprintf("Expected push type complication but got %q", pushType))
+	}
+	if topic := received.Header.Get("apns-topic"); topic != p.Topic {
+		t.Error(fmt.Sprintf("Expected topic %v but got %q", p.Topic, topic))
+	}
+	if body := <-bodies; body != `{"aps":{"content-available":1},"score":3}` {
+		t.Error(fmt.Sprintf("Unexpected body %v", body))
+	}
+}
@@ -0,0 +1,195 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joekarl/go-libapns/apnstest"
+)
+
+func newConcurrencyTestConnection(t *testing.T, stats StatsCollector) (*apnstest.Server, *APNSConnection) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	conn, err := NewAPNSConnection(&APNSConfig{
+		CertificateBytes:       server.ClientCertPEM,
+		KeyBytes:               server.ClientKeyPEM,
+		RootCAs:                server.RootCAs,
+		GatewayAddr:            server.BinaryAddr(),
+		IgnoreProxyEnvironment: true,
+		FramingTimeout:         1,
+		SendSettleWindow:       50,
+		StatsCollector:         stats,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, conn
+}
+
+func concurrencyTestPayload(i int) *Payload {
+	return &Payload{
+		AlertText: fmt.Sprintf("Testing%v", i),
+		Token:     fmt.Sprintf("%064x", i+1),
+	}
+}
+
+// Run each of count goroutines, failing the test if they don't all return
+func runConcurrently(t *testing.T, count int, each func(i int)) {
+	done := make(chan bool)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			each(i)
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected every goroutine to return")
+	}
+}
+
+func TestConnectionShouldBeSafeForConcurrentSends(t *testing.T) {
+	stats := NewMemoryStatsCollector()
+	server, conn := newConcurrencyTestConnection(t, stats)
+	defer conn.Disconnect()
+
+	senders := 600
+	resultsLock := new(sync.Mutex)
+	results := make(map[string]int)
+	runConcurrently(t, senders, func(i int) {
+		payload := concurrencyTestPayload(i)
+		switch i % 3 {
+		case 0:
+			result, err := conn.Send(context.Background(), payload)
+			if err != nil || !result.Accepted() || result.Payload != payload {
+				t.Error(fmt.Sprintf("Expected payload %v to be accepted but got %+v, %v", i, result, err))
+				return
+			}
+			resultsLock.Lock()
+			results[payload.Token]++
+			resultsLock.Unlock()
+		case 1:
+			conn.SendChannel <- payload
+		case 2:
+			if err := conn.Enqueue(payload); err != nil {
+				t.Error(err)
+			}
+			//read the connection's state alongside the sends
+			conn.InFlightBufferState()
+			conn.RateLimitState()
+			conn.ConnectTiming()
+		}
+	})
+
+	received, err := server.WaitForNotifications(senders, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identifiers := make(map[uint32]bool)
+	tokens := make(map[string]bool)
+	for _, notification := range received {
+		if identifiers[notification.Identifier] || tokens[notification.Token] {
+			t.Error(fmt.Sprintf("Expected each payload once with its own identifier but got %+v again", notification))
+		}
+		identifiers[notification.Identifier] = true
+		tokens[notification.Token] = true
+	}
+	for token, count := range results {
+		if count != 1 {
+			t.Error(fmt.Sprintf("Expected one result for %v but got %v", token, count))
+		}
+	}
+	if len(results) != senders/3 {
+		t.Error(fmt.Sprintf("Expected %v results but got %v", senders/3, len(results)))
+	}
+	if snapshot := stats.Snapshot(); snapshot.Enqueued != uint64(senders) || snapshot.Written != uint64(senders) ||
+		snapshot.Acknowledged != uint64(senders/3) {
+		t.Error(fmt.Sprintf("Expected every payload to be counted once but got %+v", snapshot))
+	}
+	if state := conn.InFlightBufferState(); state.Len != senders {
+		t.Error(fmt.Sprintf("Expected every payload in flight but got %+v", state))
+	}
+}
+
+func TestConnectionShouldResolveEveryConcurrentSendOnce(t *testing.T) {
+	server, conn := newConcurrencyTestConnection(t, nil)
+	defer conn.Disconnect()
+	rejected := concurrencyTestPayload(150)
+	server.RejectToken(rejected.Token, "InvalidToken")
+
+	senders := 300
+	outcomesLock := new(sync.Mutex)
+	accepted, rejections, failed := 0, 0, 0
+	runConcurrently(t, senders, func(i int) {
+		result, err := conn.Send(context.Background(), concurrencyTestPayload(i))
+		outcomesLock.Lock()
+		defer outcomesLock.Unlock()
+		switch {
+		case err != nil:
+			failed++
+		case result.Accepted():
+			accepted++
+		case result.AppleError != nil && result.Payload.Token == rejected.Token:
+			rejections++
+		default:
+			t.Error(fmt.Sprintf("Unexpected result %+v", result))
+		}
+	})
+
+	if rejections != 1 || accepted+rejections+failed != senders {
+		t.Error(fmt.Sprintf("Expected every send to resolve once with one rejection but got %v accepted, %v rejected and %v failed",
+			accepted, rejections, failed))
+	}
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.ErrorPayload == nil || connectionClose.ErrorPayload.Token != rejected.Token {
+		t.Error(fmt.Sprintf("Expected the rejection to close the connection but got %v", connectionClose))
+	}
+}
+
+func TestConnectionShouldResolveConcurrentSendsAcrossShutdown(t *testing.T) {
+	_, conn := newConcurrencyTestConnection(t, nil)
+
+	senders := 300
+	outcomesLock := new(sync.Mutex)
+	accepted, failed := 0, 0
+	runConcurrently(t, senders+2, func(i int) {
+		if i >= senders {
+			//shut down while the sends are in progress, and disconnect
+			//alongside it
+			time.Sleep(5 * time.Millisecond)
+			if i == senders {
+				conn.Shutdown(context.Background())
+			} else {
+				conn.Disconnect()
+			}
+			return
+		}
+		result, err := conn.Send(context.Background(), concurrencyTestPayload(i))
+		outcomesLock.Lock()
+		defer outcomesLock.Unlock()
+		if err != nil {
+			failed++
+		} else if result.Accepted() {
+			accepted++
+		} else {
+			t.Error(fmt.Sprintf("Unexpected result %+v", result))
+		}
+	})
+	if accepted+failed != senders {
+		t.Error(fmt.Sprintf("Expected every send to resolve once but got %v accepted and %v failed", accepted, failed))
+	}
+	<-conn.CloseChannel
+}
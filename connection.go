@@ -5,13 +5,17 @@ package apns
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"crypto/tls"
-	"encoding/binary"
-	"encoding/hex"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,25 +23,160 @@ import (
 type APNSConfig struct {
 	//number of payloads to keep for error purposes, defaults to 10000
 	InFlightPayloadBufferSize int
-	//number of milliseconds between frame flushes, defaults to 10
+	//optional callback invoked with each payload removed from the in flight buffer once its
+	//ExpirationTime passed, called on the send goroutine so it should return quickly
+	ExpiredPayloadCallback func(payload *Payload)
+	//number of milliseconds a framed payload waits for more to be written along with it,
+	//defaults to 10, -1 writes each payload straight away
 	FramingTimeout int
-	//max number of bytes allowed in payload, defaults to 2048
+	//max number of payloads to write at once, defaults to 0 for as many as fit in
+	//MaxOutboundTCPFrameSize
+	MaxPayloadsPerWrite int
+	//max number of bytes allowed in payload, defaults to MaxPayloadSizeBinary (2048)
 	MaxPayloadSize int
 	//bytes for cert.pem : required
 	CertificateBytes []byte
 	//bytes for key.pem : required
 	KeyBytes []byte
-	//apple gateway, defaults to "gateway.push.apple.com"
+	//apple gateway, defaults to apple's for Environment, "gateway.push.apple.com" (GatewayProductionHost)
 	GatewayHost string
+	//which of apple's environments to send to, selecting the gateway unless GatewayHost or
+	//GatewayAddr is set, defaults to EnvironmentProduction
+	Environment Environment
+	//optional host:port of the gateway, e.g. a test gateway or a relay, in place of GatewayHost
+	//and GatewayPort, which are set from it once connected
+	GatewayAddr string
+	//certificate authorities used to verify the gateway, defaults to the system roots
+	//only needed when connecting to a test gateway
+	RootCAs *x509.CertPool
+	//optional base64 SHA-256 SPKI fingerprints (see SPKIFingerprint), the connection fails
+	//with a PinningError unless the gateway's verified chain includes one of them
+	PinnedPublicKeys []string
+	//optional TLS versions, cipher suites etc. (see TLSOptions), defaults to crypto/tls's
+	TLS *TLSOptions
+	//optional proxy to connect through, http:// or https:// for HTTP CONNECT or socks5://,
+	//with user:password@ for authentication, defaults to HTTPS_PROXY (respecting NO_PROXY)
+	ProxyURL string
+	//connect directly unless ProxyURL is set, ignoring HTTPS_PROXY
+	IgnoreProxyEnvironment bool
+	//optional function to open the tcp connection to the gateway (or proxy) with, e.g. to bind
+	//a source address or to dial a net.Pipe in tests, defaults to a net.Dialer
+	//TLS is layered on top of the connection it returns
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+	//optional function to resolve the gateway's addresses with, defaults to net.DefaultResolver.LookupHost
+	//each address is tried in turn, those that failed in the last minute after the others
+	Resolver func(ctx context.Context, host string) ([]string, error)
+	//number of milliseconds to wait for each of the gateway's addresses to connect, defaults to 3000
+	DialAttemptTimeout int
 	//apple gateway port, defaults to "2195"
 	GatewayPort string
 	//max number of bytes to frame data to, defaults to TCP_FRAME_MAX
 	//generally best to NOT set this and use the default
 	MaxOutboundTCPFrameSize int
-	//number of seconds to wait for connection before bailing, defaults to no timeout
+	//number of seconds to wait for connection before bailing, defaults to 10, -1 for no timeout
 	SocketTimeout int
-	//number of seconds to wait for Tls handshake to complete before bailing, defaults to no timeout
+	//number of seconds to wait for Tls handshake to complete before bailing, defaults to 5, -1 for no timeout
 	TlsTimeout int
+	//number of seconds to wait for each write to make progress before closing the connection
+	//with a StalledWriteError, handing back what was in flight, defaults to 10, -1 for no timeout
+	//frames are written 16KB at a time with the timeout for each, so large batches don't stall
+	WriteTimeout int
+	//number of seconds the connection may go without writing a frame before it's closed as
+	//idle with a TimeoutError, catching a gateway that vanished without a reset, defaults to
+	//3600, -1 for no timeout
+	ReadTimeout int
+	//number of seconds between tcp keepalive probes, defaults to 15, -1 disables keepalive
+	//not applied to connections opened by a custom Dialer
+	KeepAliveInterval int
+	//number of seconds written data may go unacknowledged by the gateway before the connection
+	//is torn down with a TimeoutError, so what was written is resent rather than lost, defaults
+	//to 30, -1 disables the check (only supported on linux, for direct connections)
+	LivenessTimeout int
+	//optional callback invoked with the timing breakdown of each payload once it is written
+	//called on the send goroutine so it should return quickly
+	SendTimingCallback func(payload *Payload, timing SendTiming)
+	//max number of notifications per second to write, defaults to 0 (no limit)
+	MaxNotificationsPerSecond float64
+	//number of notifications that may be written at once when rate limited, defaults to 1
+	RateLimitBurst int
+	//fraction of MaxNotificationsPerSecond a new connection starts at, defaults to 0 (no slow start)
+	SlowStartFraction float64
+	//number of milliseconds for a new connection to ramp up to MaxNotificationsPerSecond
+	SlowStartRampTime int
+	//optional recorder capturing the connection's traffic for ReplayRecording
+	Recorder *Recorder
+	//number of milliseconds Send waits after writing a payload for apple to reject it, defaults to 1000
+	SendSettleWindow int
+	//number of SendWithCallback callbacks a connection runs at once, defaults to 4
+	CallbackWorkers int
+	//number of milliseconds Drain keeps the socket open after flushing for apple to reject
+	//a payload, defaults to 1000, -1 for none
+	DrainLinger int
+	//number of payloads Enqueue holds while the connection is busy writing, defaults to 100
+	SendQueueSize int
+	//what Enqueue does once SendQueueSize payloads are waiting, defaults to QueueBlock
+	QueueFullPolicy QueueFullPolicy
+	//number of milliseconds Enqueue waits for room with QueueBlockWithTimeout, defaults to 1000
+	QueueFullTimeout int
+	//optional callback invoked with each payload that couldn't be framed or was dropped by
+	//QueueFullPolicy, called on the goroutine that hit it so it should return quickly
+	SendErrorCallback func(err *SendError)
+	//optional handler called exactly once for each payload given up on: those that couldn't be
+	//framed, were rejected by apple or dropped by QueueFullPolicy, and for reconnecting
+	//connections and pools those past MaxReplayAttempts or still unsent at Close
+	//attempts is the number of connections that took it, lastReason why it was given up on
+	//called on the connection's goroutines so it must be safe for concurrent use
+	DeadLetterHandler func(payload *Payload, attempts int, lastReason error)
+	//optional check of each payload's token before the connection takes it, e.g. against a
+	//list of devices not to notify, an error refuses the payload as a SendError of
+	//FailureFiltered (see TokenFilteredError), dead lettered and never written
+	//called once per payload, not again when it's resent, on the goroutine giving it to the
+	//connection (the send goroutine for SendChannel) so it should return quickly
+	TokenFilter func(token string) error
+	//number of milliseconds after apple accepts a payload sent with Send, SendAll or Broadcast
+	//that an identical one (the same token, collapse id and Fingerprint) is dropped with a
+	//DuplicateError instead of being sent, shared by every connection made with this config,
+	//defaults to 0 for none. Enqueue and SendChannel aren't deduplicated as apple never says
+	//whether their payloads were accepted
+	DedupeWindow int
+	//number of days before the certificate expires to start warning about it, defaults to 30
+	CertExpiryWarningDays int
+	//optional callback invoked when the certificate is within CertExpiryWarningDays of expiring,
+	//checked on connecting and then daily as payloads are sent, a warning is logged if not set
+	//called on the send goroutine once connected so it should return quickly
+	CertExpiryCallback func(cert *x509.Certificate, expiresAt time.Time)
+	//number of TLS sessions kept for resuming handshakes, shared by every connection made
+	//with this config (e.g. by a pool or reconnects), defaults to 64, -1 disables resumption
+	//not used if TLS.Base has its own ClientSessionCache
+	TLSSessionCacheSize int
+	//optional collector of send and receive events (see StatsCollector), defaults to
+	//NoopStatsCollector
+	StatsCollector StatsCollector
+	//optional tracer starting a span for each notification sent (see Tracer)
+	Tracer Tracer
+	//optional structured logger of connection events (see Logger), defaults to NoopLogger
+	//if unset the certificate expiry and failover warnings go to the standard logger
+	Logger Logger
+	//optional store keeping payloads from when they're enqueued until apple accepts them or
+	//they fail for good, recovered by the next connection made with a store holding them
+	//(see PayloadStore), defaults to none, which is the same as a MemoryPayloadStore
+	PayloadStore PayloadStore
+	//optional codec storing Payload.ExtraData in the PayloadStore, otherwise it isn't stored
+	ExtraDataCodec ExtraDataCodec
+	//source of time, overridden in tests
+	clock clock
+	//sessions shared by connections made with this config
+	tlsSessions *tlsSessions
+	//BeforeSend and AfterSend hooks of connections made with this config
+	hooks *middleware
+	//which payloads are in the PayloadStore, shared by connections made with this config
+	journal *payloadJournal
+	//rate limiter shared by every connection made with this config once a pool has been
+	//made with it, so the pool's aggregate rate is MaxNotificationsPerSecond
+	//each connection still ramps up with its own limiter
+	poolRateLimiter *rateLimiter
+	//payloads accepted within DedupeWindow, shared by connections made with this config
+	dedupe *dedupeWindow
 }
 
 //Object returned on a connection close or connection error
@@ -46,10 +185,24 @@ type ConnectionClose struct {
 	UnsentPayloads *list.List
 	//The error details returned from Apple
 	Error *AppleError
+	//Set when the connection was closed for a write or read timeout (see APNSConfig.WriteTimeout
+	//and ReadTimeout), Error is then code 10 with the pending payloads handed back as for a dropped socket
+	Timeout *TimeoutError
+	//Set when the connection was closed for a write that stalled, with how long it was stuck
+	//and how much of the frame was written, Timeout is then the write timeout
+	StalledWrite *StalledWriteError
+	//Set when the payloads were failed fast by an open circuit breaker (see
+	//APNSReconnectConfig.CircuitBreaker), Error is then nil and nothing was sent
+	CircuitOpen *CircuitOpenError
 	//The payload object that caused the error
 	ErrorPayload *Payload
 	//True if error payload wasn't found indicating some unsent payloads were lost
 	UnsentPayloadBufferOverflow bool
+	//When the connection closed
+	Time time.Time
+	//when each of the unsent payloads (and the error payload) written to the socket was,
+	//so APNSReconnectingConnection can tell which a drop may have lost
+	writtenAt map[*Payload]time.Time
 }
 
 //Details from Apple regarding a connection close
@@ -62,8 +215,63 @@ type AppleError struct {
 	ErrorString string
 }
 
+//Summary of the error for logging, e.g. INVALID_TOKEN (code 8, message id 3)
+func (e *AppleError) String() string {
+	return fmt.Sprintf("%v (code %v, message id %v)", e.ErrorString, e.ErrorCode, e.MessageID)
+}
+
+//The ErrorCode as a reason, see ErrorReasonFromStatus
+func (e *AppleError) Reason() ErrorReason {
+	return ErrorReasonFromStatus(e.ErrorCode)
+}
+
+//Same as String, so the error can be the Err of a SendError
+func (e *AppleError) Error() string {
+	return e.String()
+}
+
+//Summary of the close for logging, payloads are printed with their
+//tokens redacted (see Payload.String)
+func (c *ConnectionClose) String() string {
+	parts := []string{}
+	if c.Error != nil {
+		parts = append(parts, "error: "+c.Error.String())
+	}
+	if c.Timeout != nil {
+		parts = append(parts, "timeout: "+c.Timeout.Error())
+	}
+	if c.StalledWrite != nil {
+		parts = append(parts, "stalled write: "+c.StalledWrite.Error())
+	}
+	if c.CircuitOpen != nil {
+		parts = append(parts, "circuit open: "+c.CircuitOpen.Error())
+	}
+	if c.ErrorPayload != nil {
+		parts = append(parts, "error payload: "+c.ErrorPayload.String())
+	}
+	if c.UnsentPayloads != nil {
+		parts = append(parts, fmt.Sprintf("unsent: %v", c.UnsentPayloads.Len()))
+	}
+	if c.UnsentPayloadBufferOverflow {
+		parts = append(parts, "unsent payload buffer overflow")
+	}
+	return "ConnectionClose{" + strings.Join(parts, ", ") + "}"
+}
+
 //APNS Connection state
+//Safe for concurrent use: SendChannel, Send, SendAll, Enqueue, SendContext, send groups and
+//the state getters can be used from any number of goroutines at once. Payloads are framed
+//by the connection's own send go-routine, which alone assigns their identifiers and owns the
+//in flight buffer, so each payload gets its own identifier and each Send returns once
+//A payload shouldn't be changed, or given to the connection again, while it's being sent
 type APNSConnection struct {
+	//For InFlightBufferState, updated atomically so kept first for
+	//their alignment on 32 bit platforms
+	inFlightLen     int64
+	inFlightEvicted uint64
+	inFlightExpired uint64
+	//For PendingCount, payloads taken but not yet written
+	pending int64
 	//Channel to send payloads on
 	SendChannel chan *Payload
 	//Channel that connection close is received on
@@ -74,14 +282,88 @@ type APNSConnection struct {
 	config *APNSConfig
 	//Buffer to hold payloads for replay
 	inFlightPayloadBuffer *list.List
+	//When the in flight buffer was last checked for expired payloads
+	lastExpiredSweep time.Time
 	//Stateful buffer to hold framed byte data
 	inFlightFrameByteBuffer *bytes.Buffer
-	//Stateful buffer to hold data while generating item bytes
-	inFlightItemByteBuffer *bytes.Buffer
+	//Scratch buffer reused to frame each payload
+	frameByteBuffer []byte
+	//Scratch buffer reused to marshal each payload
+	payloadByteBuffer []byte
 	//Mutex to sync access to Frame byte buffer
 	inFlightBufferLock *sync.Mutex
 	//Stateful counter to identify payloads for replay
 	payloadIdCounter uint32
+	//Payloads in the frame buffer waiting to be flushed
+	framedPayloads []*idPayload
+	//Number of payloads in the frame buffer, for the StatsCollector
+	framedCount int
+	//Whether the send listener's timer is set to flush the frame buffer
+	flushScheduled bool
+	//Set once a write fails and the socket is closing
+	writeFailed bool
+	//This connection's events in the config's Recorder, nil if not recording
+	recorder *connectionRecorder
+	//The config's Logger, or NoopLogger
+	logger Logger
+	//The config's BeforeSend and AfterSend hooks
+	hooks *middleware
+	//Which payloads are in the config's PayloadStore, nil without one
+	journal *payloadJournal
+	//Times a payload was handed back before, set by an APNSReconnectingConnection
+	replays func(payload *Payload) int
+	//Timing breakdown of establishing the connection
+	connectTiming ConnectTiming
+	//Whether payloads are timed, for the SendTimingCallback or a StatsCollector
+	timeSends bool
+	//warns before the certificate expires, nil for connections made from a socket
+	certExpiry *certExpiryMonitor
+	//the tcp socket's ack state for Ping, nil if it can't be seen
+	ackState ackStateFunc
+	//Pause and Resume
+	pauses *pauseSwitch
+	//payloads written within SendSettleWindow, for InFlightCount
+	inFlight *inFlightWindow
+	//the config's payloads accepted within DedupeWindow, nil without one
+	dedupe *dedupeWindow
+	//The payload an APNSReconnectingConnection reopened the connection for
+	//after it was idle, and how long that took, for its SendTiming
+	reopenedFor *Payload
+	reopen      time.Duration
+	//Channel that committed send groups are received on
+	groupChannel chan *SendGroup
+	//Channel that payloads passed to Send are received on
+	syncSendChannel chan *syncSend
+	//Holds a value for each SendWithCallback callback running, up to CallbackWorkers
+	callbacks chan bool
+	//Send groups with members still in the in flight buffer
+	groups map[*SendGroup]bool
+	//Closed when the send listener has stopped accepting payloads
+	sendListenerDone chan bool
+	//Limits the rate payloads are written, nil if unlimited
+	rateLimiter *rateLimiter
+	//Closed when the connection should stop accepting payloads and shut down
+	stopChannel chan bool
+	stopOnce    *sync.Once
+	//Set before stopChannel is closed if the shutdown is a Drain
+	draining bool
+	//The ConnectionClose, set before sendListenerDone is closed
+	finalClose *ConnectionClose
+	//Closed when a shutdown shouldn't wait for apple
+	abandonChannel chan bool
+	abandonOnce    *sync.Once
+	//The timeout that closed the connection, if any, and the write that
+	//stalled for a write timeout
+	timedOut     *TimeoutError
+	stalledWrite *StalledWriteError
+	timeoutLock  *sync.Mutex
+	//Payloads passed to Enqueue, see QueueFullPolicy
+	queue chan *Payload
+	//Closed once the send listener stops taking payloads off the queue
+	queueDone chan bool
+	//Held for reading by Enqueue, guards queueClosed
+	queueLock   *sync.RWMutex
+	queueClosed bool
 }
 
 //Wrapper for associating an ID with a Payload object
@@ -90,11 +372,33 @@ type idPayload struct {
 	Payload *Payload
 	//The numerical id (from payloadIdCounter) for replay identification
 	ID uint32
+	//When the payload was received off the send channel
+	receivedAt time.Time
+	//How long the payload waited for an idle connection to reopen
+	reopen time.Duration
+	//When the payload finished being framed into the frame buffer
+	framedAt time.Time
+	//When the frame holding the payload was written to the socket, zero until it is
+	writtenAt time.Time
+	//The send group this payload is a member of, if any
+	group *SendGroup
+	//Index of this payload within its send group
+	groupIndex int
+	//Set on connection close if the payload was not sent
+	unsent bool
+	//Set if the payload couldn't be framed, so it's never handed back
+	failed bool
+	//Waiting for the outcome if the payload was passed to Send
+	waiter *syncSend
+	//The payload's span, nil without a Tracer
+	trace *sendTrace
 }
 
 const (
 	//Max number of bytes in a TCP frame
 	TCP_FRAME_MAX = 65535
+	//How long the socket is kept open for apple's error response after a write fails
+	writeErrorCloseDelay = 100 * time.Millisecond
 )
 
 // This enumerates the response codes that Apple defines
@@ -118,6 +422,15 @@ var APPLE_PUSH_RESPONSES = map[uint8]string{
 //If invalid config an error will be returned
 //See APNSConfig object for defaults
 func NewAPNSConnection(config *APNSConfig) (*APNSConnection, error) {
+	return NewAPNSConnectionContext(context.Background(), config)
+}
+
+//Create a new apns connection with supplied config, tied to ctx
+//Connecting gives up if ctx is done first, and once connected ctx being
+//done closes the connection as Disconnect does
+//If invalid config an error will be returned
+//See APNSConfig object for defaults
+func NewAPNSConnectionContext(ctx context.Context, config *APNSConfig) (*APNSConnection, error) {
 	errorStrs := ""
 
 	if config.CertificateBytes == nil || config.KeyBytes == nil {
@@ -126,12 +439,59 @@ func NewAPNSConnection(config *APNSConfig) (*APNSConnection, error) {
 	if config.InFlightPayloadBufferSize < 0 {
 		errorStrs += "Invalid InFlightPayloadBufferSize. Should be > 0 (and probably around 10000)\n"
 	}
+	if config.MaxPayloadsPerWrite < 0 {
+		errorStrs += "Invalid MaxPayloadsPerWrite. Should be >= 0.\n"
+	}
 	if config.MaxOutboundTCPFrameSize < 0 || config.MaxOutboundTCPFrameSize > TCP_FRAME_MAX {
 		errorStrs += "Invalid MaxOutboundTCPFrameSize. Should be between 0 and TCP_FRAME_MAX (and probably above 2048)\n"
 	}
 	if config.MaxPayloadSize < 0 {
 		errorStrs += "Invalid MaxPayloadSize. Should be greater than 0.\n"
 	}
+	if config.MaxNotificationsPerSecond < 0 || config.RateLimitBurst < 0 {
+		errorStrs += "Invalid MaxNotificationsPerSecond or RateLimitBurst. Should be >= 0.\n"
+	}
+	if config.SlowStartFraction < 0 || config.SlowStartFraction >= 1 || config.SlowStartRampTime < 0 {
+		errorStrs += "Invalid SlowStartFraction or SlowStartRampTime. Fraction should be between 0 and 1 and ramp time >= 0.\n"
+	}
+	if config.SendSettleWindow < 0 {
+		errorStrs += "Invalid SendSettleWindow. Should be >= 0.\n"
+	}
+	if config.DedupeWindow < 0 {
+		errorStrs += "Invalid DedupeWindow. Should be >= 0.\n"
+	}
+	if config.CallbackWorkers < 0 {
+		errorStrs += "Invalid CallbackWorkers. Should be >= 0.\n"
+	}
+	if config.DrainLinger < -1 {
+		errorStrs += "Invalid DrainLinger. Should be >= 0, or -1 for none.\n"
+	}
+	if config.SendQueueSize < 0 || config.QueueFullTimeout < 0 {
+		errorStrs += "Invalid SendQueueSize or QueueFullTimeout. Should be >= 0.\n"
+	}
+	if _, ok := queueFullPolicyNames[config.QueueFullPolicy]; !ok {
+		errorStrs += "Invalid QueueFullPolicy. Should be QueueBlock, QueueBlockWithTimeout, QueueDropNewest or QueueDropOldest.\n"
+	}
+	if config.CertExpiryWarningDays < 0 {
+		errorStrs += "Invalid CertExpiryWarningDays. Should be >= 0.\n"
+	}
+	if config.DialAttemptTimeout < 0 {
+		errorStrs += "Invalid DialAttemptTimeout. Should be >= 0.\n"
+	}
+	if config.SocketTimeout < -1 || config.TlsTimeout < -1 || config.WriteTimeout < -1 || config.ReadTimeout < -1 {
+		errorStrs += "Invalid SocketTimeout, TlsTimeout, WriteTimeout or ReadTimeout. Should be >= 0, or -1 for no timeout.\n"
+	}
+	if config.KeepAliveInterval < -1 || config.LivenessTimeout < -1 {
+		errorStrs += "Invalid KeepAliveInterval or LivenessTimeout. Should be >= 0, or -1 to disable.\n"
+	}
+	if config.TLSSessionCacheSize < -1 {
+		errorStrs += "Invalid TLSSessionCacheSize. Should be >= 0, or -1 to disable resumption.\n"
+	}
+	errorStrs += validatePinnedPublicKeys(config.PinnedPublicKeys)
+	errorStrs += validateTLSOptions(config.TLS, config.PinnedPublicKeys)
+	errorStrs += validateProxyURL(config.ProxyURL)
+	errorStrs += validateEndpoint(config.Environment, gatewayHosts, "GatewayAddr", config.GatewayAddr,
+		"GatewayHost", config.GatewayHost, "GatewayPort", config.GatewayPort)
 
 	if errorStrs != "" {
 		return nil, errors.New(errorStrs)
@@ -146,51 +506,195 @@ func NewAPNSConnection(config *APNSConfig) (*APNSConnection, error) {
 	if config.FramingTimeout == 0 {
 		config.FramingTimeout = 10
 	}
-	if config.GatewayPort == "" {
-		config.GatewayPort = "2195"
-	}
-	if config.GatewayHost == "" {
-		config.GatewayHost = "gateway.push.apple.com"
-	}
+	config.GatewayHost, config.GatewayPort = resolveEndpoint(config.Environment, gatewayHosts,
+		config.GatewayAddr, config.GatewayHost, config.GatewayPort, "2195")
 	if config.MaxPayloadSize == 0 {
-		config.MaxPayloadSize = 2048
+		config.MaxPayloadSize = MaxPayloadSizeBinary
+	}
+	if config.SocketTimeout == 0 {
+		config.SocketTimeout = 10
 	}
 	if config.TlsTimeout == 0 {
 		config.TlsTimeout = 5
 	}
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = 10
+	}
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = 3600
+	}
+	if config.KeepAliveInterval == 0 {
+		config.KeepAliveInterval = 15
+	}
+	if config.LivenessTimeout == 0 {
+		config.LivenessTimeout = 30
+	}
+	if config.SendSettleWindow == 0 {
+		config.SendSettleWindow = 1000
+	}
+	if config.CallbackWorkers == 0 {
+		config.CallbackWorkers = defaultCallbackWorkers
+	}
+	if config.DrainLinger == 0 {
+		config.DrainLinger = 1000
+	}
+	if config.SendQueueSize == 0 {
+		config.SendQueueSize = 100
+	}
+	if config.QueueFullTimeout == 0 {
+		config.QueueFullTimeout = 1000
+	}
+	if config.CertExpiryWarningDays == 0 {
+		config.CertExpiryWarningDays = 30
+	}
+	if config.DialAttemptTimeout == 0 {
+		config.DialAttemptTimeout = defaultDialAttemptTimeout
+	}
+	if config.TLSSessionCacheSize == 0 {
+		config.TLSSessionCacheSize = defaultTLSSessionCacheSize
+	}
+	if config.clock == nil {
+		config.clock = realClock{}
+	}
 
-	x509Cert, err := tls.X509KeyPair(config.CertificateBytes, config.KeyBytes)
+	x509Cert, err := loadKeyPair(config.CertificateBytes, config.KeyBytes)
 	if err != nil {
 		//failed to validate key pair
 		return nil, err
 	}
+	certExpiry, err := newCertExpiryMonitor(x509Cert, config.CertExpiryWarningDays,
+		config.CertExpiryCallback, config.Logger, config.clock)
+	if err != nil {
+		//expired, apple would refuse the handshake anyway
+		return nil, err
+	}
 
-	tlsConf := &tls.Config{
-		Certificates: []tls.Certificate{x509Cert},
-		ServerName:   config.GatewayHost,
+	tlsConf := newTLSConfig(config.TLS, config.GatewayHost, config.RootCAs,
+		config.PinnedPublicKeys, []tls.Certificate{x509Cert})
+	sessions := config.sessions()
+	if tlsConf.ClientSessionCache == nil {
+		tlsConf.ClientSessionCache = sessions.cache
 	}
 
-	tcpSocket, err := net.DialTimeout("tcp",
-		config.GatewayHost+":"+config.GatewayPort,
-		time.Duration(config.SocketTimeout)*time.Second)
+	timing := ConnectTiming{}
+	connectStart := time.Now()
+
+	proxy, err := proxyForGateway(config.ProxyURL, config.IgnoreProxyEnvironment,
+		config.GatewayHost, config.GatewayPort)
+	if err != nil {
+		return nil, err
+	}
+	tcpSocket, err := dialGateway(ctx, gatewayAddr{
+		host:           config.GatewayHost,
+		port:           config.GatewayPort,
+		proxy:          proxy,
+		dial:           config.Dialer,
+		resolve:        config.Resolver,
+		timeout:        timeoutSeconds(config.SocketTimeout),
+		attemptTimeout: time.Duration(config.DialAttemptTimeout) * time.Millisecond,
+		keepAlive:      time.Duration(config.KeepAliveInterval) * time.Second,
+		logger:         config.Logger,
+	}, &timing)
 	if err != nil {
 		//failed to connect to gateway
 		return nil, err
 	}
 
+	handshakeStart := time.Now()
 	tlsSocket := tls.Client(tcpSocket, tlsConf)
-	tlsSocket.SetDeadline(time.Now().Add(time.Duration(config.TlsTimeout) * time.Second))
-	err = tlsSocket.Handshake()
+	if tlsTimeout := timeoutSeconds(config.TlsTimeout); tlsTimeout > 0 {
+		tlsSocket.SetDeadline(time.Now().Add(tlsTimeout))
+	}
+	err = tlsSocket.HandshakeContext(ctx)
 	if err != nil {
 		//failed to handshake with tls information
 		return nil, err
 	}
+	timing.Handshake = time.Since(handshakeStart)
+	timing.Total = time.Since(connectStart)
+	timing.Resumed = tlsSocket.ConnectionState().DidResume
+	sessions.record(tlsSocket.ConnectionState())
 
 	//hooray! we're connected
 	//reset the deadline so it doesn't fail subsequent writes
 	tlsSocket.SetDeadline(time.Time{})
 
-	return socketAPNSConnection(tlsSocket, config), nil
+	c := socketAPNSConnection(tlsSocket, config)
+	c.connectTiming = timing
+	c.config.StatsCollector.OnConnected(timing)
+	c.certExpiry = certExpiry
+	c.logger.Info("apns: connected", "endpoint", c.Endpoint(), "gateway", timing.Addr, "tls_resumed", timing.Resumed,
+		"connect_time", timing.Total)
+	c.ackState = socketAckState(tcpSocket)
+	if livenessTimeout := timeoutSeconds(config.LivenessTimeout); livenessTimeout > 0 && c.ackState != nil {
+		go c.livenessMonitor(livenessTimeout, c.ackState)
+	}
+	if ctx.Done() != nil {
+		go c.contextListener(ctx)
+	}
+	return c, nil
+}
+
+//How to reach a gateway, see dialGateway
+type gatewayAddr struct {
+	host string
+	port string
+	//proxy to tunnel through, nil to connect directly
+	proxy *url.URL
+	//custom dial and resolve (see APNSConfig.Dialer and Resolver), nil for the defaults
+	dial    dialFunc
+	resolve resolveFunc
+	//overall and per address timeouts, none if 0
+	timeout        time.Duration
+	attemptTimeout time.Duration
+	//tcp keepalive period for the default dial, net.Dialer's default if 0 and disabled if negative
+	keepAlive time.Duration
+	//logs a failover, the standard logger if nil
+	logger Logger
+}
+
+//Resolve and dial the gateway, trying each resolved address in turn
+//until one connects, the timeout passes or ctx is done
+//With a proxy the tunnel through it is dialed instead, leaving the proxy
+//to resolve the gateway, and a custom dial is left to resolve it too
+//unless a custom resolve is given as well
+//Records the dns and dial phases into timing
+func dialGateway(ctx context.Context, gateway gatewayAddr, timing *ConnectTiming) (net.Conn, error) {
+	if gateway.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, gateway.timeout)
+		defer cancel()
+	}
+	dial := gateway.dial
+	if dial == nil {
+		dial = (&net.Dialer{KeepAlive: gateway.keepAlive}).DialContext
+	}
+
+	if gateway.proxy != nil || (gateway.dial != nil && gateway.resolve == nil) {
+		dialStart := time.Now()
+		var socket net.Conn
+		var err error
+		if gateway.proxy != nil {
+			socket, err = dialThroughProxy(ctx, dial, gateway.proxy, gateway.host, gateway.port)
+		} else {
+			socket, err = dial(ctx, "tcp", net.JoinHostPort(gateway.host, gateway.port))
+		}
+		if err != nil {
+			return nil, err
+		}
+		timing.Dial = time.Since(dialStart)
+		timing.Addr = socket.RemoteAddr().String()
+		if gateway.proxy != nil {
+			timing.Proxy = proxyAddr(gateway.proxy)
+		}
+		return socket, nil
+	}
+
+	resolve := gateway.resolve
+	if resolve == nil {
+		resolve = net.DefaultResolver.LookupHost
+	}
+	return dialResolved(ctx, resolve, dial, gateway.host, gateway.port, gateway.attemptTimeout, gateway.logger, timing)
 }
 
 //Internal create APNS connection from raw socket
@@ -203,13 +707,53 @@ func socketAPNSConnection(socket net.Conn, config *APNSConfig) *APNSConnection {
 	c.SendChannel = make(chan *Payload)
 	c.CloseChannel = make(chan *ConnectionClose)
 	c.inFlightFrameByteBuffer = new(bytes.Buffer)
-	c.inFlightItemByteBuffer = new(bytes.Buffer)
 	c.inFlightBufferLock = new(sync.Mutex)
 	c.payloadIdCounter = 0
+	c.groupChannel = make(chan *SendGroup)
+	c.syncSendChannel = make(chan *syncSend)
+	c.groups = make(map[*SendGroup]bool)
+	c.sendListenerDone = make(chan bool)
+	c.stopChannel = make(chan bool)
+	c.stopOnce = new(sync.Once)
+	c.abandonChannel = make(chan bool)
+	c.abandonOnce = new(sync.Once)
+	c.timeoutLock = new(sync.Mutex)
+	c.queue = make(chan *Payload, config.SendQueueSize)
+	c.queueDone = make(chan bool)
+	c.queueLock = new(sync.RWMutex)
+	c.pauses = newPauseSwitch()
+	c.inFlight = newInFlightWindow(time.Duration(config.SendSettleWindow) * time.Millisecond)
+	if config.clock == nil {
+		config.clock = realClock{}
+	}
+	if config.StatsCollector == nil {
+		config.StatsCollector = NoopStatsCollector{}
+	}
+	_, noStats := config.StatsCollector.(NoopStatsCollector)
+	c.timeSends = config.SendTimingCallback != nil || !noStats
+	if config.CallbackWorkers == 0 {
+		config.CallbackWorkers = defaultCallbackWorkers
+	}
+	c.callbacks = make(chan bool, config.CallbackWorkers)
+	c.recorder = config.Recorder.connection()
+	c.logger = configLogger(config.Logger)
+	c.hooks = config.middleware()
+	c.journal = config.payloadJournal()
+	c.dedupe = config.dedupeWindow()
+	if config.MaxNotificationsPerSecond > 0 {
+		c.rateLimiter = newRateLimiter(config.clock, config.MaxNotificationsPerSecond,
+			config.RateLimitBurst, config.SlowStartFraction,
+			time.Duration(config.SlowStartRampTime)*time.Millisecond)
+		c.rateLimiter.shared = config.poolRateLimiter
+	}
 	errCloseChannel := make(chan *AppleError)
 
+	c.extendReadDeadline()
 	go c.closeListener(errCloseChannel)
 	go c.sendListener(errCloseChannel)
+	if c.journal != nil {
+		go c.recoverStored()
+	}
 
 	return c
 }
@@ -217,6 +761,7 @@ func socketAPNSConnection(socket net.Conn, config *APNSConfig) *APNSConnection {
 //Disconnect from the Apns Gateway
 //Flushes any currently unsent messages before disconnecting from the socket
 func (c *APNSConnection) Disconnect() {
+	c.recorder.recordDisconnect(c.config.clock.Now())
 	//flush on disconnect
 	c.inFlightBufferLock.Lock()
 	c.flushBufferToSocket()
@@ -224,6 +769,36 @@ func (c *APNSConnection) Disconnect() {
 	c.noFlushDisconnect()
 }
 
+//Host and port of the gateway the connection was made to, as configured
+//(see APNSConfig.Environment and GatewayAddr) rather than the address it
+//resolved to, which is ConnectTiming().Addr
+//Will be empty if the connection wasn't dialed by NewAPNSConnection
+func (c *APNSConnection) Endpoint() string {
+	if c.connectTiming.Addr == "" {
+		return ""
+	}
+	return net.JoinHostPort(c.config.GatewayHost, c.config.GatewayPort)
+}
+
+//Timing breakdown of establishing the connection to the gateway
+//Will be the zero value if the connection wasn't dialed by NewAPNSConnection
+func (c *APNSConnection) ConnectTiming() ConnectTiming {
+	return c.connectTiming
+}
+
+//When the connection's certificate expires
+//Will be the zero value if the connection wasn't dialed by NewAPNSConnection
+func (c *APNSConnection) CertExpiresAt() time.Time {
+	return c.certExpiry.expiresAt()
+}
+
+//Topics the connection's certificate can send to, e.g. com.example.app
+//and com.example.app.voip, for checking Payload.Topic values
+//Will be nil if the connection wasn't dialed by NewAPNSConnection
+func (c *APNSConnection) CertTopics() []string {
+	return c.certExpiry.topics()
+}
+
 //internal close socket
 func (c *APNSConnection) noFlushDisconnect() {
 	c.socket.Close()
@@ -231,26 +806,38 @@ func (c *APNSConnection) noFlushDisconnect() {
 
 //go-routine to listen for socket closes or apple response information
 func (c *APNSConnection) closeListener(errCloseChannel chan *AppleError) {
-	buffer := make([]byte, 6, 6)
-	_, err := c.socket.Read(buffer)
+	received := bytes.NewBuffer(make([]byte, 0, errorResponseLength))
+	response, err := ParseErrorResponse(io.TeeReader(c.socket, received))
 	if err != nil {
+		if isTimeout(err) {
+			//idle for ReadTimeout, nothing else sets a read deadline
+			c.setTimedOut("read", timeoutSeconds(c.config.ReadTimeout))
+			c.closeTimedOut()
+		}
+		c.recorder.recordReadError(c.config.clock.Now(), err)
 		errCloseChannel <- &AppleError{
 			ErrorCode:   10,
 			ErrorString: err.Error(),
 			MessageID:   0,
 		}
 	} else {
-		messageId := binary.BigEndian.Uint32(buffer[2:])
-		errCloseChannel <- &AppleError{
-			ErrorString: APPLE_PUSH_RESPONSES[uint8(buffer[1])],
-			ErrorCode:   uint8(buffer[1]),
-			MessageID:   messageId,
+		c.recorder.recordResponse(c.config.clock.Now(), received.Bytes())
+		code, _ := response.Status.BinaryStatus()
+		appleError := &AppleError{
+			ErrorString: APPLE_PUSH_RESPONSES[code],
+			ErrorCode:   code,
+			MessageID:   response.Identifier,
 		}
+		c.logger.Warn("apns: error response received", "reason", string(response.Status),
+			"code", appleError.ErrorCode, "identifier", response.Identifier)
+		errCloseChannel <- appleError
 	}
 }
 
 //go-routine to listen for Payloads which should be sent
 func (c *APNSConnection) sendListener(errCloseChannel chan *AppleError) {
+	defer close(c.sendListenerDone)
+
 	var appleError *AppleError
 
 	longTimeoutDuration := 5 * time.Minute
@@ -258,144 +845,457 @@ func (c *APNSConnection) sendListener(errCloseChannel chan *AppleError) {
 	zeroTimeoutDuration := 0 * time.Millisecond
 	timeoutTimer := time.NewTimer(longTimeoutDuration)
 
+	//set to nil once shutting down, to stop taking payloads
+	sendChannel := c.SendChannel
+	queue := c.queue
+	groupChannel := c.groupChannel
+	syncSendChannel := c.syncSendChannel
+	stopChannel := c.stopChannel
+	//fires once a Drain's linger is over
+	var lingerChannel <-chan time.Time
+
 	for {
 		if appleError != nil {
 			break
 		}
+		//while paused take nothing new, Pause or Resume wakes the loop
+		takeSend, takeQueue, takeGroup, takeSync := sendChannel, queue, groupChannel, syncSendChannel
+		paused, pauseChanged := c.pauses.state()
+		if paused {
+			takeSend, takeQueue, takeGroup, takeSync = nil, nil, nil, nil
+		}
 		select {
-		case sendPayload := <-c.SendChannel:
+		case <-pauseChanged:
+			break
+		case sendPayload := <-takeSend:
 			if sendPayload == nil {
 				//channel was closed
+				c.closeQueue()
 				return
 			}
-			idPayloadObj := &idPayload{
-				Payload: sendPayload,
-				ID:      c.payloadIdCounter,
+			appleError = c.acceptPayload(sendPayload, nil, false, errCloseChannel)
+			if appleError != nil {
+				break
 			}
-			c.payloadIdCounter++
-			c.inFlightPayloadBuffer.PushFront(idPayloadObj)
-			//check to see if we've overrun our buffer
-			//if so, remove one from the buffer
-			if c.inFlightPayloadBuffer.Len() > c.config.InFlightPayloadBufferSize {
-				c.inFlightPayloadBuffer.Remove(c.inFlightPayloadBuffer.Back())
+
+			c.scheduleFlush(timeoutTimer, shortTimeoutDuration, zeroTimeoutDuration, longTimeoutDuration)
+			break
+		case queuedPayload := <-takeQueue:
+			c.reportQueueDepth()
+			appleError = c.acceptPayload(queuedPayload, nil, true, errCloseChannel)
+			if appleError != nil {
+				break
 			}
 
-			c.bufferPayload(idPayloadObj)
-
-			if shortTimeoutDuration > zeroTimeoutDuration {
-				//schedule short timeout
-				timeoutTimer.Reset(shortTimeoutDuration)
-			} else {
-				//flush buffer to socket
-				c.inFlightBufferLock.Lock()
-				c.flushBufferToSocket()
-				c.inFlightBufferLock.Unlock()
-				timeoutTimer.Reset(longTimeoutDuration)
+			c.scheduleFlush(timeoutTimer, shortTimeoutDuration, zeroTimeoutDuration, longTimeoutDuration)
+			break
+		case send := <-takeSync:
+			appleError = c.acceptPayload(send.payload, send, true, errCloseChannel)
+			if appleError != nil {
+				break
 			}
+
+			c.scheduleFlush(timeoutTimer, shortTimeoutDuration, zeroTimeoutDuration, longTimeoutDuration)
+			break
+		case group := <-takeGroup:
+			appleError = c.bufferGroup(group, errCloseChannel)
+
+			c.scheduleFlush(timeoutTimer, shortTimeoutDuration, zeroTimeoutDuration, longTimeoutDuration)
 			break
 		case <-timeoutTimer.C:
 			//flush buffer to socket
 			c.inFlightBufferLock.Lock()
 			c.flushBufferToSocket()
 			c.inFlightBufferLock.Unlock()
+			c.flushScheduled = false
 			timeoutTimer.Reset(longTimeoutDuration)
 			break
+		case <-stopChannel:
+			sendChannel, queue, groupChannel, syncSendChannel, stopChannel = nil, nil, nil, nil, nil
+			//paused, so the queue is handed back rather than drained
+			if !c.draining || paused {
+				c.shutdownSocket()
+				break
+			}
+			appleError = c.drainQueue(errCloseChannel)
+			if appleError == nil {
+				lingerChannel = c.lingerSocket()
+			}
+			break
+		case <-lingerChannel:
+			lingerChannel = nil
+			c.shutdownSocket()
+			break
 		case appleError = <-errCloseChannel:
+			if stopChannel == nil && appleError.ErrorCode == 10 && appleError.MessageID == 0 && !c.abandoned() {
+				//apple closed its side after reading everything we sent
+				//before shutting down, without rejecting any of it
+				appleError = &AppleError{
+					ErrorCode:   0,
+					ErrorString: APPLE_PUSH_RESPONSES[0],
+				}
+			}
 			break
 		}
 	}
 
 	//gather unsent payload objs
 	unsentPayloads := list.New()
+	var errorIdPayload *idPayload
 	var errorPayload *Payload
+	foundErrorId := false
+	unsentIdPayloads := list.New()
 	if appleError.ErrorCode != 0 {
 		for e := c.inFlightPayloadBuffer.Front(); e != nil; e = e.Next() {
 			idPayloadObj := e.Value.(*idPayload)
 			if idPayloadObj.ID == appleError.MessageID {
 				//found error payload, keep track of it and remove from send buffer
-				errorPayload = idPayloadObj.Payload
+				//(unless it was never framed, when only a dropped socket's id 0 matches it)
+				if !idPayloadObj.failed {
+					errorIdPayload = idPayloadObj
+					errorPayload = idPayloadObj.Payload
+				}
+				foundErrorId = true
 				break
 			}
-			unsentPayloads.PushFront(idPayloadObj.Payload)
+			if idPayloadObj.failed {
+				continue
+			}
+			idPayloadObj.unsent = true
+			unsentIdPayloads.PushFront(idPayloadObj)
+		}
+	}
+
+	//a permanent rejection of a group member cancels its unsent siblings,
+	//so they are not handed back to be resent
+	var rejectedGroup *SendGroup
+	var cancelled []*idPayload
+	var unsentIds []uint32
+	writtenAt := make(map[*Payload]time.Time)
+	if errorIdPayload != nil && !errorIdPayload.writtenAt.IsZero() {
+		writtenAt[errorPayload] = errorIdPayload.writtenAt
+	}
+	if errorIdPayload != nil && appleError.ErrorCode != 10 {
+		rejectedGroup = errorIdPayload.group
+	}
+	for e := unsentIdPayloads.Front(); e != nil; e = e.Next() {
+		idPayloadObj := e.Value.(*idPayload)
+		if rejectedGroup != nil && idPayloadObj.group == rejectedGroup {
+			cancelled = append(cancelled, idPayloadObj)
+			continue
+		}
+		unsentPayloads.PushBack(idPayloadObj.Payload)
+		unsentIds = append(unsentIds, idPayloadObj.ID)
+		if !idPayloadObj.writtenAt.IsZero() {
+			writtenAt[idPayloadObj.Payload] = idPayloadObj.writtenAt
+		}
+	}
+	for group := range c.groups {
+		group.finalize(group == rejectedGroup, errorIdPayload)
+	}
+	for e := c.inFlightPayloadBuffer.Front(); e != nil; e = e.Next() {
+		idPayloadObj := e.Value.(*idPayload)
+		if idPayloadObj.waiter != nil {
+			idPayloadObj.waiter.resolve(idPayloadObj, errorIdPayload, appleError)
+		}
+	}
+	c.endUnwrittenTraces(appleError)
+	c.afterSendOnClose(errorIdPayload, appleError)
+
+	if c.recorder != nil {
+		disposition := &CloseDisposition{
+			ErrorCode:      appleError.ErrorCode,
+			UnsentIDs:      unsentIds,
+			BufferOverflow: unsentPayloads.Len() > 0 && !foundErrorId,
 		}
+		if errorIdPayload != nil {
+			disposition.ErrorPayloadID = &errorIdPayload.ID
+		}
+		c.recorder.recordClose(c.config.clock.Now(), disposition)
+	}
+
+	//the overflow is only of the in flight buffer, so judge it before
+	//adding payloads that never left the queue
+	bufferOverflow := unsentPayloads.Len() > 0 && !foundErrorId
+	for _, queuedPayload := range c.closeQueue() {
+		unsentPayloads.PushBack(queuedPayload)
 	}
+	//everything is accounted for in the ConnectionClose
+	atomic.StoreInt64(&c.pending, 0)
+	c.inFlight.reset()
+
+	if errorPayload != nil && appleError.ErrorCode != 10 {
+		c.config.StatsCollector.OnFailed(&SendError{
+			Payload: errorPayload,
+			Kind:    FailureRejected,
+			Reason:  appleError.Reason(),
+			Time:    c.config.clock.Now(),
+			Err:     appleError,
+		})
+	}
+	c.deadLetterRejected(errorIdPayload, cancelled, appleError)
+	c.ackOnClose(cancelled, appleError)
 
 	//connection close channel write and close
+	connectionClose := &ConnectionClose{
+		Error:                       appleError,
+		Timeout:                     c.timeoutError(),
+		StalledWrite:                c.stalledWriteError(),
+		UnsentPayloads:              unsentPayloads,
+		ErrorPayload:                errorPayload,
+		UnsentPayloadBufferOverflow: bufferOverflow,
+		Time:                        c.config.clock.Now(),
+		writtenAt:                   writtenAt,
+	}
+	c.finalClose = connectionClose
+	closeEvent := []interface{}{"error", appleError.ErrorString, "unsent", unsentPayloads.Len()}
+	if errorPayload != nil {
+		closeEvent = append(closeEvent, "error_payload", errorPayload.String())
+	}
+	if connectionClose.Timeout != nil {
+		closeEvent = append(closeEvent, "timeout", connectionClose.Timeout.Error())
+	}
+	if connectionClose.StalledWrite != nil {
+		closeEvent = append(closeEvent, "stalled_write", connectionClose.StalledWrite.Error())
+	}
+	if appleError.ErrorCode == 10 {
+		c.logger.Warn("apns: connection lost", closeEvent...)
+	} else {
+		c.logger.Info("apns: connection closed", closeEvent...)
+	}
 	go func() {
-		c.CloseChannel <- &ConnectionClose{
-			Error:                       appleError,
-			UnsentPayloads:              unsentPayloads,
-			ErrorPayload:                errorPayload,
-			UnsentPayloadBufferOverflow: (unsentPayloads.Len() > 0 && errorPayload == nil),
-		}
+		c.CloseChannel <- connectionClose
 
 		close(c.CloseChannel)
 	}()
 }
 
+//Either schedule a flush of the frame buffer after the framing timeout
+//or flush immediately if framing is disabled
+func (c *APNSConnection) scheduleFlush(timeoutTimer *time.Timer, shortTimeoutDuration,
+	zeroTimeoutDuration, longTimeoutDuration time.Duration) {
+	if shortTimeoutDuration > zeroTimeoutDuration {
+		//schedule short timeout for the first payload framed since the last
+		//flush, so later ones don't hold it up
+		if !c.flushScheduled {
+			timeoutTimer.Reset(shortTimeoutDuration)
+			c.flushScheduled = true
+		}
+	} else {
+		//flush buffer to socket
+		c.inFlightBufferLock.Lock()
+		c.flushBufferToSocket()
+		c.inFlightBufferLock.Unlock()
+		timeoutTimer.Reset(longTimeoutDuration)
+	}
+}
+
+//Track a payload off the send channel (or from Send, with its waiter)
+//and write it to the frame buffer once the rate limiter allows
+//filtered is whether the TokenFilter already allowed the payload, as
+//Enqueue and Send do before handing it over
+//Returns an error from apple if one arrives while waiting, leaving the
+//payload unsent
+func (c *APNSConnection) acceptPayload(payload *Payload, waiter *syncSend, filtered bool, errCloseChannel chan *AppleError) *AppleError {
+	idPayloadObj := c.trackPayload(payload)
+	idPayloadObj.waiter = waiter
+	if waiter != nil {
+		idPayloadObj.trace = waiter.trace
+	} else {
+		_, idPayloadObj.trace = startTrace(c.config.Tracer, c.config.clock, context.Background(), payload)
+	}
+	c.config.StatsCollector.OnEnqueued(payload)
+	c.recorder.recordEnqueue(c.config.clock.Now(), idPayloadObj)
+	c.certExpiry.check()
+
+	//filtered before waiting so everything in flight has been allowed, and
+	//is only handed back to be resent if it was
+	if !filtered && !c.replaying(payload) {
+		if err := filterToken(c.config.TokenFilter, payload.Token); err != nil {
+			c.logger.Warn("apns: payload filtered", "payload", payload.String(), "error", err.Error())
+			c.payloadFailed(idPayloadObj, FailureFiltered, err)
+			return nil
+		}
+	}
+
+	appleError := c.waitForRateLimit(errCloseChannel)
+	if appleError != nil {
+		return appleError
+	}
+
+	c.bufferPayload(idPayloadObj)
+	return nil
+}
+
+//Assign an id to a payload and keep track of it in the in flight buffer
+func (c *APNSConnection) trackPayload(payload *Payload) *idPayload {
+	idPayloadObj := &idPayload{
+		Payload: payload,
+		ID:      c.payloadIdCounter,
+	}
+	if c.timeSends {
+		idPayloadObj.receivedAt = time.Now()
+	}
+	if c.reopenedFor != nil && payload == c.reopenedFor {
+		idPayloadObj.reopen = c.reopen
+		c.reopenedFor = nil
+	}
+	c.payloadIdCounter++
+	atomic.AddInt64(&c.pending, 1)
+	c.evictExpired()
+	c.inFlightPayloadBuffer.PushFront(idPayloadObj)
+	//check to see if we've overrun our buffer
+	//if so, remove one from the buffer
+	if c.inFlightPayloadBuffer.Len() > c.config.InFlightPayloadBufferSize {
+		c.evicted(c.inFlightPayloadBuffer.Remove(c.inFlightPayloadBuffer.Back()).(*idPayload))
+		atomic.AddUint64(&c.inFlightEvicted, 1)
+	}
+	atomic.StoreInt64(&c.inFlightLen, int64(c.inFlightPayloadBuffer.Len()))
+	return idPayloadObj
+}
+
+//Frame every member of a send group
+//If an error from apple arrives while framing, the remaining members are
+//tracked but not written and the error is returned
+func (c *APNSConnection) bufferGroup(group *SendGroup, errCloseChannel chan *AppleError) *AppleError {
+	var appleError *AppleError
+	c.groups[group] = true
+	for i, payload := range group.payloads {
+		idPayloadObj := c.trackPayload(payload)
+		idPayloadObj.group = group
+		idPayloadObj.groupIndex = i
+		_, idPayloadObj.trace = startTrace(c.config.Tracer, c.config.clock, context.Background(), payload)
+		group.members[i] = idPayloadObj
+		c.config.StatsCollector.OnEnqueued(payload)
+		c.recorder.recordEnqueue(c.config.clock.Now(), idPayloadObj)
+
+		if appleError == nil {
+			appleError = c.waitForRateLimit(errCloseChannel)
+		}
+		if appleError == nil {
+			select {
+			case appleError = <-errCloseChannel:
+			default:
+				c.bufferPayload(idPayloadObj)
+			}
+		}
+	}
+	return appleError
+}
+
+//Block until the rate limiter allows another payload to be written
+//Anything already framed is flushed first so it isn't held up by the wait
+//Returns an error from apple if one arrives while waiting, or the read
+//error from closing the socket if the connection is abandoned (its ctx is
+//done or a Shutdown gave up) meanwhile
+func (c *APNSConnection) waitForRateLimit(errCloseChannel chan *AppleError) *AppleError {
+	if c.rateLimiter == nil {
+		return nil
+	}
+	delay := c.rateLimiter.reserve()
+	if delay <= 0 {
+		return nil
+	}
+	defer c.rateLimiter.doneWaiting()
+	c.config.StatsCollector.OnRateLimited(delay)
+
+	c.inFlightBufferLock.Lock()
+	c.flushBufferToSocket()
+	c.inFlightBufferLock.Unlock()
+
+	select {
+	case <-c.config.clock.After(delay):
+		return nil
+	case appleError := <-errCloseChannel:
+		return appleError
+	case <-c.abandonChannel:
+		//the payload waiting is handed back as unsent
+		c.noFlushDisconnect()
+		return <-errCloseChannel
+	}
+}
+
+//Current state of the connection's rate limiter
+//including whether a new connection is still ramping up to full rate
+func (c *APNSConnection) RateLimitState() RateLimitState {
+	if c.rateLimiter == nil {
+		return RateLimitState{}
+	}
+	return c.rateLimiter.state()
+}
+
 //Write buffer payload to tcp frame buffer and flush if tcp frame buffer full
 //THREADSAFE (with regard to interaction with the frameBuffer using frameBufferLock)
 func (c *APNSConnection) bufferPayload(idPayloadObj *idPayload) {
+	if err := idPayloadObj.Payload.Validate(); err != nil {
+		c.logger.Warn("apns: invalid payload", "payload", idPayloadObj.Payload.String(), "error", err.Error())
+		c.payloadFailed(idPayloadObj, FailureInvalidPayload, err)
+		return
+	}
+	//hooks run without the lock, they may take their time
+	if err := c.hooks.beforeSend(idPayloadObj.Payload); err != nil {
+		c.logger.Warn("apns: payload blocked", "payload", idPayloadObj.Payload.String(), "error", err.Error())
+		c.payloadFailed(idPayloadObj, FailureBlocked, err)
+		return
+	}
+
 	//acquire lock to tcp buffer to do length checking, buffer writing,
 	//and potentially flush buffer
 	c.inFlightBufferLock.Lock()
 
-	token, err := hex.DecodeString(idPayloadObj.Payload.Token)
+	token, err := idPayloadObj.Payload.binaryToken()
 	if err != nil {
-		fmt.Printf("Failed to decode token for payload %v\n", idPayloadObj.Payload)
-		c.Disconnect()
+		c.inFlightBufferLock.Unlock()
+		c.logger.Warn("apns: failed to decode token", "payload", idPayloadObj.Payload.String())
+		c.payloadFailed(idPayloadObj, FailureInvalidPayload, err)
 		return
 	}
-	payloadBytes, err := idPayloadObj.Payload.Marshal(c.config.MaxPayloadSize)
+	payloadBytes, err := idPayloadObj.Payload.AppendMarshal(c.payloadByteBuffer[:0], c.config.MaxPayloadSize)
+	c.payloadByteBuffer = payloadBytes
 	if err != nil {
-		fmt.Printf("Failed to marshall payload %v : %v\n", idPayloadObj.Payload, err)
-		c.Disconnect()
+		c.inFlightBufferLock.Unlock()
+		c.logger.Warn("apns: failed to marshal payload", "payload", idPayloadObj.Payload.String(), "error", err.Error())
+		c.payloadFailed(idPayloadObj, FailureInvalidPayload, err)
 		return
 	}
 
-	//write token
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint8(1))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint16(32))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, token)
-
-	//write payload
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint8(2))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint16(len(payloadBytes)))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, payloadBytes)
-
-	//write id
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint8(3))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint16(4))
-	binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, idPayloadObj.ID)
-
-	//write expire date if set
-	if idPayloadObj.Payload.ExpirationTime != 0 {
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint8(4))
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint16(4))
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, idPayloadObj.Payload.ExpirationTime)
-	}
-
-	//write priority if set correctly
-	if idPayloadObj.Payload.Priority == 10 || idPayloadObj.Payload.Priority == 5 {
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint8(5))
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, uint16(4))
-		binary.Write(c.inFlightItemByteBuffer, binary.BigEndian, idPayloadObj.Payload.Priority)
-	}
+	frame := appendBinaryFrame(c.frameByteBuffer[:0], token, payloadBytes, idPayloadObj.ID, idPayloadObj.Payload)
+	c.frameByteBuffer = frame
 
 	//check to see if we should flush inFlightTCPBuffer
-	if c.inFlightFrameByteBuffer.Len()+c.inFlightItemByteBuffer.Len() > TCP_FRAME_MAX {
+	maxFrameSize := c.config.MaxOutboundTCPFrameSize
+	if maxFrameSize == 0 {
+		maxFrameSize = TCP_FRAME_MAX
+	}
+	if c.inFlightFrameByteBuffer.Len()+len(frame)-binaryFrameHeaderLength > maxFrameSize {
 		c.flushBufferToSocket()
 	}
+	c.inFlightFrameByteBuffer.Write(frame)
+	c.framedCount++
+	idPayloadObj.trace.marshaled()
 
-	//write header info and item info
-	binary.Write(c.inFlightFrameByteBuffer, binary.BigEndian, uint8(2))
-	binary.Write(c.inFlightFrameByteBuffer, binary.BigEndian, uint32(c.inFlightItemByteBuffer.Len()))
-	c.inFlightItemByteBuffer.WriteTo(c.inFlightFrameByteBuffer)
-
-	c.inFlightItemByteBuffer.Reset()
+	if c.timeSends || idPayloadObj.waiter != nil {
+		idPayloadObj.framedAt = time.Now()
+	}
+	c.framedPayloads = append(c.framedPayloads, idPayloadObj)
+	//the scratch buffer is reused, so store a copy once unlocked
+	var stored []byte
+	if c.journal != nil {
+		stored = append([]byte(nil), payloadBytes...)
+	}
 
 	//unlock byte buffer when finished writing to it
 	c.inFlightBufferLock.Unlock()
+	c.journal.put(idPayloadObj.Payload, stored, c.config.MaxPayloadSize)
+
+	//write once MaxPayloadsPerWrite are framed rather than waiting for more
+	if c.config.MaxPayloadsPerWrite > 0 {
+		c.inFlightBufferLock.Lock()
+		if c.framedCount >= c.config.MaxPayloadsPerWrite {
+			c.flushBufferToSocket()
+		}
+		c.inFlightBufferLock.Unlock()
+	}
 }
 
 //NOT THREADSAFE (need to acquire inFlightBufferLock before calling)
@@ -411,10 +1311,67 @@ func (c *APNSConnection) flushBufferToSocket() {
 	bufBytes := c.inFlightFrameByteBuffer.Bytes()
 
 	//write to socket
-	_, writeErr := c.socket.Write(bufBytes)
+	writeStart := time.Now()
+	stalled, writeErr := c.writeFrame(bufBytes, timeoutSeconds(c.config.WriteTimeout), len(c.framedPayloads))
 	if writeErr != nil {
-		fmt.Printf("Error while writing to socket \n%v\n", writeErr)
-		defer c.noFlushDisconnect()
+		c.logger.Error("apns: failed to write to socket", "error", writeErr.Error())
+		if stalled != nil {
+			c.logger.Warn("apns: write stalled", "stalled", stalled.Stalled.String(), "written", stalled.Written,
+				"size", stalled.Size, "payloads", stalled.Payloads)
+			c.setStalledWrite(stalled)
+			defer c.closeTimedOut()
+		} else if !c.writeFailed {
+			c.writeFailed = true
+			//apple writes its error response before closing its side, so
+			//give it a moment to be read rather than reporting a drop
+			time.AfterFunc(writeErrorCloseDelay, c.noFlushDisconnect)
+		}
+	} else {
+		c.extendReadDeadline()
+		c.config.StatsCollector.OnWritten(c.framedCount, len(bufBytes), time.Since(writeStart))
 	}
 	c.inFlightFrameByteBuffer.Reset()
+	c.framedCount = 0
+
+	if len(c.framedPayloads) > 0 {
+		atomic.AddInt64(&c.pending, -int64(len(c.framedPayloads)))
+		if writeErr == nil {
+			if c.timeSends {
+				c.reportSendTimings(writeStart, time.Now())
+			}
+			writtenAt := c.config.clock.Now()
+			c.inFlight.written(writtenAt, len(c.framedPayloads))
+			for _, idPayloadObj := range c.framedPayloads {
+				idPayloadObj.writtenAt = writtenAt
+				idPayloadObj.trace.written(writtenAt)
+				if idPayloadObj.waiter != nil {
+					idPayloadObj.waiter.writtenAt = time.Now()
+					close(idPayloadObj.waiter.written)
+				} else {
+					//the binary protocol has nothing more to say about it
+					//unless it's rejected
+					idPayloadObj.trace.finish(nil, nil)
+				}
+			}
+		}
+		c.framedPayloads = c.framedPayloads[:0]
+	}
+}
+
+//Report the timing of each payload that was just flushed to the timing
+//callback and the StatsCollector
+func (c *APNSConnection) reportSendTimings(writeStart time.Time, writeEnd time.Time) {
+	for _, idPayloadObj := range c.framedPayloads {
+		timing := SendTiming{
+			Reopen:   idPayloadObj.reopen,
+			Marshal:  idPayloadObj.framedAt.Sub(idPayloadObj.receivedAt),
+			Buffered: writeStart.Sub(idPayloadObj.framedAt),
+			Write:    writeEnd.Sub(writeStart),
+			Total:    writeEnd.Sub(idPayloadObj.receivedAt) + idPayloadObj.reopen,
+		}
+		if c.config.SendTimingCallback != nil {
+			c.config.SendTimingCallback(idPayloadObj.Payload, timing)
+		}
+		c.config.StatsCollector.OnSendTiming(timing)
+	}
 }
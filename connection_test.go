@@ -2,12 +2,16 @@ package apns
 
 import (
 	"bytes"
+	"container/list"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/joekarl/go-libapns/apnstest"
 )
 
 /**
@@ -521,3 +525,200 @@ func TestConnectionShouldCloseAndReturnUnsentUpToBufferSizeOnAppleResponse(t *te
 
 	<-syncChan
 }
+
+func TestConnectionShouldFrameRawPayload(t *testing.T) {
+	socket := NewMockConnRejectId(false, 0)
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            10,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		})
+
+	raw := []byte(`{"aps":{"alert":"From elsewhere"}}`)
+	payload := &Payload{
+		RawPayload:     raw,
+		Token:          "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f",
+		ExpirationTime: 4000000000,
+		Priority:       10,
+	}
+
+	apn.SendChannel <- payload
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	written := socket.WrittenBytes.Bytes()
+	expectedItems := new(bytes.Buffer)
+	expectedItems.Write([]byte{2, 0, uint8(len(raw))})
+	expectedItems.Write(raw)
+	expectedItems.Write([]byte{3, 0, 4, 0, 0, 0, 0})
+	expectedItems.Write([]byte{4, 0, 4, 0xee, 0x6b, 0x28, 0x00})
+	expectedItems.Write([]byte{5, 0, 4, 10})
+
+	if !bytes.HasSuffix(written, expectedItems.Bytes()) {
+		fmt.Printf("Expected frame to end with payload, id, expiration and priority items but got %v\n", written)
+		t.FailNow()
+	}
+}
+
+func TestConnectionShouldSendPowerConsiderationsAsThrottled(t *testing.T) {
+	socket := NewMockConnRejectId(false, 0)
+
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            10,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		})
+
+	payload := &Payload{
+		AlertText: "Testing",
+		Token:     "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f",
+		Priority:  PriorityPowerConsiderations,
+	}
+
+	apn.SendChannel <- payload
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	written := socket.WrittenBytes.Bytes()
+	if !bytes.HasSuffix(written, []byte{5, 0, 4, PriorityThrottled}) {
+		t.Error(fmt.Sprintf("Expected frame to end with a priority 5 item but got %v", written))
+	}
+}
+
+func TestConnectionCloseStringShouldRedactTokens(t *testing.T) {
+	token := "740f4707bebcf74f9b7c25d48e3358945f6aa01da5ddb387462c7eaf61bb41ab"
+	unsent := list.New()
+	unsent.PushBack(&Payload{Token: token})
+	c := &ConnectionClose{
+		Error:          &AppleError{MessageID: 3, ErrorCode: 8, ErrorString: "INVALID_TOKEN"},
+		ErrorPayload:   &Payload{Token: token, AlertText: "Testing"},
+		UnsentPayloads: unsent,
+	}
+	expected := `ConnectionClose{error: INVALID_TOKEN (code 8, message id 3), error payload: Payload{token: 740f…41ab, alert: "Testing"}, unsent: 1}`
+	for _, s := range []string{c.String(), fmt.Sprintf("%v", c)} {
+		if s != expected {
+			t.Error(fmt.Sprintf("Expected %v but got %v", expected, s))
+		}
+		if strings.Contains(s, token) {
+			t.Error(fmt.Sprintf("Token leaked in %v", s))
+		}
+	}
+}
+
+// Wait for the connection to have made writes writes
+func waitForWrites(t *testing.T, stats *MemoryStatsCollector, writes uint64) StatsSnapshot {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		snapshot := stats.Snapshot()
+		if snapshot.Writes >= writes {
+			return snapshot
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("Expected %v writes but got %+v", writes, snapshot))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnectionShouldWriteMaxPayloadsPerWrite(t *testing.T) {
+	stats := NewMemoryStatsCollector()
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	config.FramingTimeout = 60000
+	config.MaxPayloadsPerWrite = 2
+	config.StatsCollector = stats
+	conn := socketAPNSConnection(socket, config)
+	defer conn.Disconnect()
+
+	for i := 0; i < 5; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+	snapshot := waitForWrites(t, stats, 2)
+	time.Sleep(10 * time.Millisecond)
+	if snapshot = stats.Snapshot(); snapshot.Writes != 2 || snapshot.Written != 4 {
+		t.Error(fmt.Sprintf("Expected two writes of two payloads, the fifth waiting, but got %+v", snapshot))
+	}
+}
+
+func TestConnectionShouldWriteMaxOutboundTCPFrameSize(t *testing.T) {
+	stats := NewMemoryStatsCollector()
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	config.FramingTimeout = 60000
+	//room for two of the test payloads' frames
+	config.MaxOutboundTCPFrameSize = 200
+	config.StatsCollector = stats
+	conn := socketAPNSConnection(socket, config)
+	defer conn.Disconnect()
+
+	for i := 0; i < 5; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+	snapshot := waitForWrites(t, stats, 2)
+	if snapshot.Written != 4 || snapshot.WrittenBytes > 400 {
+		t.Error(fmt.Sprintf("Expected two writes of two payloads but got %+v", snapshot))
+	}
+}
+
+func TestConnectionFramingTimeoutShouldBoundLatency(t *testing.T) {
+	stats := NewMemoryStatsCollector()
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	config.FramingTimeout = 20
+	config.StatsCollector = stats
+	conn := socketAPNSConnection(socket, config)
+	defer conn.Disconnect()
+
+	//payloads keep coming more often than FramingTimeout, but the first
+	//of each write doesn't wait for them to stop
+	for i := 0; i < 40; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if snapshot := stats.Snapshot(); snapshot.Writes < 2 || snapshot.Written == 0 {
+		t.Error(fmt.Sprintf("Expected payloads to be written while more arrived but got %+v", snapshot))
+	}
+}
+
+func benchmarkConnectionThroughput(b *testing.B, framingTimeout int) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := NewAPNSConnection(&APNSConfig{
+		CertificateBytes:          server.ClientCertPEM,
+		KeyBytes:                  server.ClientKeyPEM,
+		RootCAs:                   server.RootCAs,
+		GatewayAddr:               server.BinaryAddr(),
+		IgnoreProxyEnvironment:    true,
+		FramingTimeout:            framingTimeout,
+		InFlightPayloadBufferSize: 100,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Disconnect()
+	payload := groupTestPayload(0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.SendChannel <- payload
+	}
+	if _, err := server.WaitForNotifications(b.N, time.Minute); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkConnectionThroughputBatched(b *testing.B) {
+	benchmarkConnectionThroughput(b, 2)
+}
+
+func BenchmarkConnectionThroughputUnbatched(b *testing.B) {
+	benchmarkConnectionThroughput(b, -1)
+}
@@ -0,0 +1,203 @@
+package apns
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// Explain a failure marshaling custom fields by finding the first value
+// encoding/json can't handle, returning an error such as
+// Custom field "game.state.players[2].conn": unsupported type chan int
+// Only called once marshaling has failed so successful sends pay nothing.
+// Returns marshalErr as is if no offending value is found
+func customFieldsError(customFields map[string]interface{}, marshalErr error) error {
+	keys := make([]string, 0, len(customFields))
+	for key := range customFields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		walker := &customFieldWalker{visiting: make(map[uintptr]bool)}
+		if path, reason := walker.walk(key, reflect.ValueOf(customFields[key])); reason != "" {
+			return errors.New(fmt.Sprintf("Custom field %q: %v", path, reason))
+		}
+	}
+	return marshalErr
+}
+
+// Walks a custom field value the way encoding/json would
+type customFieldWalker struct {
+	//pointers, maps and slices on the current path, to detect cycles
+	visiting map[uintptr]bool
+}
+
+// Returns the path to the first unsupported value under v and why it
+// is unsupported, or an empty reason if v can be marshaled
+func (w *customFieldWalker) walk(path string, v reflect.Value) (string, string) {
+	if !v.IsValid() {
+		return "", ""
+	}
+
+	if v.Type().Implements(jsonMarshalerType) || v.Type().Implements(textMarshalerType) {
+		if !v.CanInterface() || ((v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil()) {
+			return "", ""
+		}
+		if marshaler, ok := v.Interface().(json.Marshaler); ok {
+			if _, err := marshaler.MarshalJSON(); err != nil {
+				return path, err.Error()
+			}
+		} else if _, err := v.Interface().(encoding.TextMarshaler).MarshalText(); err != nil {
+			return path, err.Error()
+		}
+		return "", ""
+	}
+
+	switch v.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return path, "unsupported type " + v.Type().String()
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return path, "unsupported value " + strconv.FormatFloat(f, 'g', -1, v.Type().Bits())
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			return w.walk(path, v.Elem())
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			return "", ""
+		}
+		return w.walkReference(path, v, func() (string, string) {
+			return w.walk(path, v.Elem())
+		})
+	case reflect.Map:
+		return w.walkMap(path, v)
+	case reflect.Slice:
+		if v.IsNil() || v.Type().Elem().Kind() == reflect.Uint8 {
+			//byte slices are encoded as base64
+			return "", ""
+		}
+		return w.walkReference(path, v, func() (string, string) {
+			return w.walkArray(path, v)
+		})
+	case reflect.Array:
+		return w.walkArray(path, v)
+	case reflect.Struct:
+		return w.walkStruct(path, v)
+	}
+	return "", ""
+}
+
+// Walk a pointer, map or slice, reporting a cycle if it is already on the path
+func (w *customFieldWalker) walkReference(path string, v reflect.Value,
+	walkFn func() (string, string)) (string, string) {
+	ptr := v.Pointer()
+	if w.visiting[ptr] {
+		return path, "encountered a cycle via " + v.Type().String()
+	}
+	w.visiting[ptr] = true
+	defer delete(w.visiting, ptr)
+	return walkFn()
+}
+
+func (w *customFieldWalker) walkMap(path string, v reflect.Value) (string, string) {
+	if v.IsNil() {
+		return "", ""
+	}
+	keyType := v.Type().Key()
+	switch keyType.Kind() {
+	case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+	default:
+		if !keyType.Implements(textMarshalerType) {
+			return path, "unsupported type " + v.Type().String()
+		}
+	}
+
+	return w.walkReference(path, v, func() (string, string) {
+		keys := v.MapKeys()
+		names := make([]string, len(keys))
+		for i, key := range keys {
+			names[i] = fmt.Sprint(key)
+		}
+		sort.Sort(mapKeysByName{keys, names})
+
+		for i, key := range keys {
+			if p, reason := w.walk(path+"."+names[i], v.MapIndex(key)); reason != "" {
+				return p, reason
+			}
+		}
+		return "", ""
+	})
+}
+
+func (w *customFieldWalker) walkArray(path string, v reflect.Value) (string, string) {
+	for i := 0; i < v.Len(); i++ {
+		if p, reason := w.walk(fmt.Sprintf("%v[%v]", path, i), v.Index(i)); reason != "" {
+			return p, reason
+		}
+	}
+	return "", ""
+}
+
+func (w *customFieldWalker) walkStruct(path string, v reflect.Value) (string, string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			//unexported fields are skipped by encoding/json
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		fieldPath := path
+		if !field.Anonymous || name != "" {
+			//embedded structs without a name are flattened into the parent
+			if name == "" {
+				name = field.Name
+			}
+			fieldPath = path + "." + name
+		}
+		if p, reason := w.walk(fieldPath, v.Field(i)); reason != "" {
+			return p, reason
+		}
+	}
+	return "", ""
+}
+
+// Sorts map keys by their formatted name so the same path is always reported
+type mapKeysByName struct {
+	keys  []reflect.Value
+	names []string
+}
+
+func (m mapKeysByName) Len() int {
+	return len(m.keys)
+}
+
+func (m mapKeysByName) Less(i, j int) bool {
+	return m.names[i] < m.names[j]
+}
+
+func (m mapKeysByName) Swap(i, j int) {
+	m.keys[i], m.keys[j] = m.keys[j], m.keys[i]
+	m.names[i], m.names[j] = m.names[j], m.names[i]
+}
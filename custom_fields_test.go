@@ -0,0 +1,128 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+type customFieldPlayer struct {
+	Name string   `json:"name"`
+	Conn chan int `json:"conn"`
+}
+
+type customFieldEmbedded struct {
+	Callback func()
+}
+
+type customFieldOuter struct {
+	customFieldEmbedded
+}
+
+type customFieldSkipped struct {
+	Name    string
+	Ignored chan int `json:"-"`
+	hidden  chan int
+}
+
+type failingMarshaler struct{}
+
+func (failingMarshaler) MarshalJSON() ([]byte, error) {
+	return nil, errors.New("cannot marshal")
+}
+
+func expectCustomFieldError(t *testing.T, customFields map[string]interface{}, expected string) {
+	p := Payload{
+		AlertText:    "Testing this payload",
+		CustomFields: customFields,
+	}
+	_, err := p.Marshal(2048)
+	if err == nil {
+		t.Error("Expected an error marshaling custom fields")
+		return
+	}
+	if err.Error() != expected {
+		t.Error(fmt.Sprintf("Expected error %v but got %v", expected, err))
+	}
+}
+
+func TestCustomFieldErrorNestedPath(t *testing.T) {
+	players := []interface{}{
+		map[string]interface{}{"name": "a"},
+		map[string]interface{}{"name": "b"},
+		&customFieldPlayer{Name: "c", Conn: make(chan int)},
+	}
+	expectCustomFieldError(t, map[string]interface{}{
+		"game": map[string]interface{}{
+			"state": map[string]interface{}{
+				"players": players,
+			},
+		},
+		"ok": "fine",
+	}, `Custom field "game.state.players[2].conn": unsupported type chan int`)
+}
+
+func TestCustomFieldErrorUnsupportedKinds(t *testing.T) {
+	expectCustomFieldError(t, map[string]interface{}{"c": make(chan int)},
+		`Custom field "c": unsupported type chan int`)
+	expectCustomFieldError(t, map[string]interface{}{"f": func() {}},
+		`Custom field "f": unsupported type func()`)
+	expectCustomFieldError(t, map[string]interface{}{"z": complex(1, 2)},
+		`Custom field "z": unsupported type complex128`)
+	expectCustomFieldError(t, map[string]interface{}{"m": map[bool]string{true: "yes"}},
+		`Custom field "m": unsupported type map[bool]string`)
+	expectCustomFieldError(t, map[string]interface{}{"a": [2]interface{}{1, make(chan bool)}},
+		`Custom field "a[1]": unsupported type chan bool`)
+	expectCustomFieldError(t, map[string]interface{}{"m": map[int]interface{}{7: func() {}}},
+		`Custom field "m.7": unsupported type func()`)
+}
+
+func TestCustomFieldErrorFloats(t *testing.T) {
+	expectCustomFieldError(t, map[string]interface{}{"score": math.NaN()},
+		`Custom field "score": unsupported value NaN`)
+	expectCustomFieldError(t, map[string]interface{}{"score": math.Inf(1)},
+		`Custom field "score": unsupported value +Inf`)
+	expectCustomFieldError(t, map[string]interface{}{"score": []float32{1, float32(math.Inf(-1))}},
+		`Custom field "score[1]": unsupported value -Inf`)
+}
+
+func TestCustomFieldErrorStructs(t *testing.T) {
+	expectCustomFieldError(t, map[string]interface{}{"s": customFieldOuter{
+		customFieldEmbedded: customFieldEmbedded{Callback: func() {}},
+	}}, `Custom field "s.Callback": unsupported type func()`)
+
+	//ignored and unexported fields aren't marshaled so aren't reported
+	p := Payload{
+		AlertText: "Testing this payload",
+		CustomFields: map[string]interface{}{"s": customFieldSkipped{
+			Ignored: make(chan int),
+			hidden:  make(chan int),
+		}},
+	}
+	if _, err := p.Marshal(2048); err != nil {
+		t.Error(fmt.Sprintf("Expected no error but got %v", err))
+	}
+}
+
+func TestCustomFieldErrorMarshaler(t *testing.T) {
+	expectCustomFieldError(t, map[string]interface{}{"list": []interface{}{"a", failingMarshaler{}}},
+		`Custom field "list[1]": cannot marshal`)
+}
+
+func TestCustomFieldErrorCycle(t *testing.T) {
+	cycle := map[string]interface{}{}
+	cycle["self"] = cycle
+	p := Payload{
+		AlertText:    "Testing this payload",
+		CustomFields: map[string]interface{}{"loop": cycle},
+	}
+	_, err := p.Marshal(2048)
+	if err == nil {
+		t.Fatal("Expected an error marshaling a cyclic custom field")
+	}
+	expected := `Custom field "loop.self": encountered a cycle via map[string]interface {}`
+	if err.Error() != expected {
+		t.Error(fmt.Sprintf("Expected error %v but got %v", expected, err))
+	}
+}
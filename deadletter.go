@@ -0,0 +1,77 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Hand a payload the connection has given up on to the DeadLetterHandler
+// Called on the connection's goroutines
+func (c *APNSConnection) deadLetter(payload *Payload, reason error) {
+	if c.config.DeadLetterHandler == nil {
+		return
+	}
+	c.config.DeadLetterHandler(payload, c.attempts(payload), reason)
+}
+
+// The number of connections that have taken the payload to send, this
+// one included, counting those it was handed back by when resent by an
+// APNSReconnectingConnection
+func (c *APNSConnection) attempts(payload *Payload) int {
+	if c.replays == nil {
+		return 1
+	}
+	return c.replays(payload) + 1
+}
+
+// Hand the payloads a closing connection gave up on to the
+// DeadLetterHandler: the payload apple rejected, unless the socket
+// dropped, and the members of its group that were cancelled with it
+// Called on the send go-routine once the connection has closed
+func (c *APNSConnection) deadLetterRejected(errorIdPayload *idPayload, cancelled []*idPayload, appleError *AppleError) {
+	if c.config.DeadLetterHandler == nil || errorIdPayload == nil || appleError.ErrorCode == 10 {
+		return
+	}
+	c.deadLetter(errorIdPayload.Payload, appleError)
+	for _, idPayloadObj := range cancelled {
+		c.deadLetter(idPayloadObj.Payload, errors.New(fmt.Sprintf(
+			"Payload was cancelled with its group after apple rejected %v: %v", errorIdPayload.Payload, appleError)))
+	}
+}
+
+// Hand payloads the reconnecting connection has given up on to the
+// DeadLetterHandler, forgetting their replays
+// reason is why, given each time the payload was handed back
+func (r *APNSReconnectingConnection) deadLetter(payloads []*Payload, reason func(payload *Payload, attempts []SendAttempt) error) {
+	attempts := make([][]SendAttempt, len(payloads))
+	r.replaysLock.Lock()
+	for i, payload := range payloads {
+		attempts[i] = r.replays[payload]
+		delete(r.replays, payload)
+	}
+	r.replaysLock.Unlock()
+	handler := r.config.ConnectionConfig.DeadLetterHandler
+	if handler == nil {
+		return
+	}
+	for i, payload := range payloads {
+		handler(payload, len(attempts[i]), reason(payload, attempts[i]))
+	}
+}
+
+// Times the payload has been handed back by a connection, safe to call
+// from the connections' goroutines
+func (r *APNSReconnectingConnection) replayCount(payload *Payload) int {
+	r.replaysLock.Lock()
+	defer r.replaysLock.Unlock()
+	return len(r.replays[payload])
+}
+
+// Hand a payload left unsent as the pool closes to the DeadLetterHandler,
+// attempts being 1 if a connection took it and 0 if it never left the
+// pool's queue
+func (p *APNSConnectionPool) deadLetter(payload *Payload, attempts int, reason error) {
+	if handler := p.config.ConnectionConfig.DeadLetterHandler; handler != nil {
+		handler(payload, attempts, reason)
+	}
+}
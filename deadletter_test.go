@@ -0,0 +1,252 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type deadLetter struct {
+	payload    *Payload
+	attempts   int
+	lastReason error
+}
+
+// DeadLetterHandler keeping every payload given up on
+type deadLetterRecorder struct {
+	lock    *sync.Mutex
+	letters []deadLetter
+}
+
+func newDeadLetterRecorder() *deadLetterRecorder {
+	return &deadLetterRecorder{lock: new(sync.Mutex)}
+}
+
+func (r *deadLetterRecorder) handler(payload *Payload, attempts int, lastReason error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.letters = append(r.letters, deadLetter{payload, attempts, lastReason})
+}
+
+// Wait for count dead letters, failing if more arrive or any payload is
+// given up on twice, and return them by payload
+func (r *deadLetterRecorder) expect(t *testing.T, count int) map[*Payload]deadLetter {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r.lock.Lock()
+		received := len(r.letters)
+		r.lock.Unlock()
+		if received >= count {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("Expected %v dead letters but got %v", count, received))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	//give any extra time to arrive
+	time.Sleep(50 * time.Millisecond)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	letters := make(map[*Payload]deadLetter)
+	for _, letter := range r.letters {
+		if _, ok := letters[letter.payload]; ok {
+			t.Error(fmt.Sprintf("Expected %v to be given up on once", letter.payload))
+		}
+		letters[letter.payload] = letter
+	}
+	if len(r.letters) != count {
+		t.Error(fmt.Sprintf("Expected %v dead letters but got %v", count, r.letters))
+	}
+	return letters
+}
+
+func TestDeadLetterShouldCatchInvalidAndRejectedPayloads(t *testing.T) {
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	recorder := newDeadLetterRecorder()
+	config.DeadLetterHandler = recorder.handler
+	conn := socketAPNSConnection(socket, config)
+
+	invalid := groupTestPayload(0)
+	invalid.Priority = 7
+	rejected := groupTestPayload(1)
+	for _, payload := range []*Payload{invalid, rejected, groupTestPayload(2)} {
+		conn.SendChannel <- payload
+	}
+	waitForSocketSends(t, socket, 2)
+	socket.reject(8, 1)
+	connectionClose := <-conn.CloseChannel
+
+	letters := recorder.expect(t, 2)
+	sendError := &SendError{}
+	if letter := letters[invalid]; letter.attempts != 1 || !errors.As(letter.lastReason, &sendError) ||
+		sendError.Kind != FailureInvalidPayload {
+		t.Error(fmt.Sprintf("Expected the invalid payload to be given up on but got %+v", letter))
+	}
+	appleError := &AppleError{}
+	if letter := letters[rejected]; letter.attempts != 1 || !errors.As(letter.lastReason, &appleError) ||
+		appleError.ErrorCode != 8 {
+		t.Error(fmt.Sprintf("Expected the rejected payload to be given up on but got %+v", letter))
+	}
+	//the payload after it is handed back to be resent, as before
+	if connectionClose.ErrorPayload != rejected || connectionClose.UnsentPayloads.Len() != 1 {
+		t.Error(fmt.Sprintf("Expected the close to be reported as usual but got %v", connectionClose))
+	}
+}
+
+func TestDeadLetterShouldCatchQueueDrops(t *testing.T) {
+	conn, release, tokens := queueTestConnection(t, QueueDropNewest)
+	recorder := newDeadLetterRecorder()
+	conn.config.DeadLetterHandler = recorder.handler
+
+	for i := 1; i <= 2; i++ {
+		if err := conn.Enqueue(groupTestPayload(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newest := groupTestPayload(3)
+	conn.Enqueue(newest)
+
+	letters := recorder.expect(t, 1)
+	queueFullError := &QueueFullError{}
+	if letter := letters[newest]; letter.attempts != 0 || !errors.As(letter.lastReason, &queueFullError) {
+		t.Error(fmt.Sprintf("Expected the dropped payload to be given up on but got %+v", letter))
+	}
+	close(release)
+	expectQueueTestTokens(t, tokens, 0, 1, 2)
+	closeQueueTestConnection(conn)
+}
+
+func TestDeadLetterShouldFireOnceAcrossReplaysAndClose(t *testing.T) {
+	recorder := newDeadLetterRecorder()
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig: &APNSConfig{
+			InFlightPayloadBufferSize: 100,
+			FramingTimeout:            1,
+			MaxPayloadSize:            2048,
+			DeadLetterHandler:         recorder.handler,
+		},
+		ReconnectBaseDelay: 1,
+		MaxReplayAttempts:  2,
+		dial:               dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := groupTestPayload(4)
+	invalid.Priority = 7
+	payloads := []*Payload{groupTestPayload(0), groupTestPayload(1), groupTestPayload(2), groupTestPayload(3), invalid}
+	for _, payload := range payloads {
+		conn.SendChannel <- payload
+	}
+	waitForPoolSends(t, dialer, []int{4})
+
+	//apple rejects the second, the two after it are resent on a new
+	//connection, which drops with no new connection to be had, so they're
+	//still waiting to be resent at Close
+	dialer.socket(0).reject(8, 1)
+	<-conn.CloseChannel
+	waitForPoolSends(t, dialer, []int{4, 2})
+	dialer.lock.Lock()
+	dialer.fail = true
+	dialer.lock.Unlock()
+	dialer.socket(1).Close()
+	for conn.replayCount(payloads[3]) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	conn.Close()
+	var connectionClose *ConnectionClose
+	for connectionClose = range conn.CloseChannel {
+	}
+
+	letters := recorder.expect(t, 4)
+	if letter := letters[payloads[1]]; letter.attempts != 1 || letter.lastReason.(*AppleError).ErrorCode != 8 {
+		t.Error(fmt.Sprintf("Expected the rejected payload to be given up on but got %+v", letter))
+	}
+	if letter := letters[invalid]; letter.attempts != 1 {
+		t.Error(fmt.Sprintf("Expected the invalid payload to be given up on but got %+v", letter))
+	}
+	for _, payload := range payloads[2:4] {
+		if letter := letters[payload]; letter.attempts != 2 || !strings.Contains(letter.lastReason.Error(), "before Close") {
+			t.Error(fmt.Sprintf("Expected %v to be given up on at Close but got %+v", payload, letter))
+		}
+	}
+	if connectionClose.UnsentPayloads.Len() != 2 {
+		t.Error(fmt.Sprintf("Expected the final close to still hold the unsent payloads but got %v", connectionClose))
+	}
+}
+
+func TestDeadLetterShouldCatchReplayExhaustion(t *testing.T) {
+	recorder := newDeadLetterRecorder()
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig: &APNSConfig{
+			InFlightPayloadBufferSize: 100,
+			FramingTimeout:            1,
+			MaxPayloadSize:            2048,
+			DeadLetterHandler:         recorder.handler,
+		},
+		ReconnectBaseDelay: 1,
+		MaxReplayAttempts:  1,
+		dial:               dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := groupTestPayload(0)
+	conn.SendChannel <- payload
+	waitForPoolSends(t, dialer, []int{1})
+	dialer.socket(0).Close()
+	waitForPoolSends(t, dialer, []int{1, 1})
+	dialer.socket(1).Close()
+	connectionClose := <-conn.CloseChannel
+
+	letters := recorder.expect(t, 1)
+	if letter := letters[payload]; letter.attempts != 2 || !strings.Contains(letter.lastReason.Error(), "MaxReplayAttempts") {
+		t.Error(fmt.Sprintf("Expected the payload to be given up on once replays ran out but got %+v", letter))
+	}
+	if connectionClose.UnsentPayloads.Len() != 1 {
+		t.Error(fmt.Sprintf("Expected the abandoned payload to be passed on as before but got %v", connectionClose))
+	}
+
+	//nothing is left for Close to give up on
+	conn.Close()
+	for range conn.CloseChannel {
+	}
+	recorder.expect(t, 1)
+}
+
+func TestDeadLetterShouldCatchPayloadsUnsentAtPoolClose(t *testing.T) {
+	pool, dialer := newPoolTestPool(t, 2, PoolRoundRobin)
+	recorder := newDeadLetterRecorder()
+	pool.config.ConnectionConfig.DeadLetterHandler = recorder.handler
+
+	//as in TestPoolCloseShouldAggregateUnsent, the payload queued for the
+	//connection that can't be replaced is never sent
+	dialer.lock.Lock()
+	dialer.fail = true
+	dialer.lock.Unlock()
+	dialer.socket(1).reject(10, 0)
+	<-pool.CloseChannel
+	for pool.Healthy() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	queued := groupTestPayload(1)
+	pool.members[1].queue <- queued
+	pool.SendChannel <- groupTestPayload(0)
+	waitForPoolSends(t, dialer, []int{1, 0})
+
+	pool.Close()
+	finalPoolClose(t, pool)
+	letters := recorder.expect(t, 1)
+	if letter := letters[queued]; letter.attempts != 0 || !strings.Contains(letter.lastReason.Error(), "before Close") {
+		t.Error(fmt.Sprintf("Expected the queued payload to be given up on but got %+v", letter))
+	}
+}
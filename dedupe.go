@@ -0,0 +1,194 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Matched by errors.Is for a payload dropped as a duplicate, see
+// DuplicateError
+var ErrDuplicate = errors.New("Duplicate payload")
+
+// A payload dropped rather than sent as it's identical to another: the
+// same token, collapse id and Fingerprint, so custom fields built in a
+// different order still match
+type DuplicateError struct {
+	// The payload dropped
+	Payload *Payload
+	// The payload earlier in the batch it duplicates (see
+	// BatchOptions.Dedupe), nil for one accepted within the config's
+	// DedupeWindow
+	Original *Payload
+	// When the payload it duplicates was accepted, zero within a batch
+	AcceptedAt time.Time
+}
+
+func (e *DuplicateError) Error() string {
+	if e.Original != nil {
+		return fmt.Sprintf("Duplicate of %v earlier in the batch", e.Original)
+	}
+	return fmt.Sprintf("Duplicate of %v accepted at %v", e.Payload, e.AcceptedAt.Format(time.RFC3339Nano))
+}
+
+func (e *DuplicateError) Is(target error) bool {
+	return target == ErrDuplicate
+}
+
+// Whether the payload wasn't sent as it duplicates another, so shouldn't
+// be counted as a failure
+func (r *Result) Duplicate() bool {
+	return errors.Is(r.Err, ErrDuplicate)
+}
+
+// Options for SendAllWithOptions and BroadcastWithOptions
+type BatchOptions struct {
+	// Drop any payload identical to one earlier in the batch (see
+	// DuplicateError) instead of sending it, reporting it with a Result
+	// whose Err is the *DuplicateError. If the first one fails its
+	// duplicates weren't sent either
+	// For a broadcast that's a repeated token (ignoring case), which is
+	// otherwise only sent once without a result of its own
+	Dedupe bool
+}
+
+// What makes two payloads the same notification
+type dedupeKey struct {
+	token       string
+	collapseId  string
+	fingerprint uint64
+}
+
+// The payload's dedupeKey, false if it can't be fingerprinted, in which
+// case it won't marshal either and is left to fail when sent
+func payloadDedupeKey(payload *Payload) (dedupeKey, bool) {
+	fingerprint, err := payload.Fingerprint()
+	if err != nil {
+		return dedupeKey{}, false
+	}
+	return dedupeKey{token: payload.Token, collapseId: payload.CollapseId, fingerprint: fingerprint}, true
+}
+
+// For each payload the one earlier in payloads it duplicates, or nil
+func batchDuplicates(payloads []*Payload) []*Payload {
+	originals := make([]*Payload, len(payloads))
+	seen := make(map[dedupeKey]*Payload, len(payloads))
+	for i, payload := range payloads {
+		if payload == nil {
+			continue
+		}
+		key, ok := payloadDedupeKey(payload)
+		if !ok {
+			continue
+		}
+		if original, ok := seen[key]; ok {
+			originals[i] = original
+			continue
+		}
+		seen[key] = payload
+	}
+	return originals
+}
+
+// Payloads accepted within a config's DedupeWindow, shared by every
+// connection made with it
+type dedupeWindow struct {
+	lock     *sync.Mutex
+	clock    clock
+	window   time.Duration
+	accepted map[dedupeKey]time.Time
+	//keys in the order they were accepted, for expiring them
+	order []dedupeEntry
+}
+
+type dedupeEntry struct {
+	key dedupeKey
+	at  time.Time
+}
+
+var dedupeWindowLock = new(sync.Mutex)
+
+func (config *APNSConfig) dedupeWindow() *dedupeWindow {
+	if config.DedupeWindow == 0 {
+		return nil
+	}
+	dedupeWindowLock.Lock()
+	defer dedupeWindowLock.Unlock()
+	if config.dedupe == nil {
+		config.dedupe = newDedupeWindow(config.clock, time.Duration(config.DedupeWindow)*time.Millisecond)
+	}
+	return config.dedupe
+}
+
+func (config *HTTP2Config) dedupeWindow() *dedupeWindow {
+	if config.DedupeWindow == 0 {
+		return nil
+	}
+	dedupeWindowLock.Lock()
+	defer dedupeWindowLock.Unlock()
+	if config.dedupe == nil {
+		config.dedupe = newDedupeWindow(config.clock, time.Duration(config.DedupeWindow)*time.Millisecond)
+	}
+	return config.dedupe
+}
+
+func newDedupeWindow(clock clock, window time.Duration) *dedupeWindow {
+	return &dedupeWindow{
+		lock:     new(sync.Mutex),
+		clock:    clock,
+		window:   window,
+		accepted: make(map[dedupeKey]time.Time),
+	}
+}
+
+// A *DuplicateError if an identical payload was accepted within the
+// window, otherwise nil. Safe to call on a nil window
+func (w *dedupeWindow) check(payload *Payload) error {
+	if w == nil {
+		return nil
+	}
+	key, ok := payloadDedupeKey(payload)
+	if !ok {
+		return nil
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.expire(w.clock.Now())
+	if at, ok := w.accepted[key]; ok {
+		return &DuplicateError{Payload: payload, AcceptedAt: at}
+	}
+	return nil
+}
+
+// Remember apple accepted the payload. Safe to call on a nil window
+func (w *dedupeWindow) accept(payload *Payload) {
+	if w == nil {
+		return
+	}
+	key, ok := payloadDedupeKey(payload)
+	if !ok {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	now := w.clock.Now()
+	w.expire(now)
+	w.accepted[key] = now
+	w.order = append(w.order, dedupeEntry{key: key, at: now})
+}
+
+// NOT THREADSAFE (need to acquire lock before calling)
+// Forget the payloads accepted longer than the window before now
+func (w *dedupeWindow) expire(now time.Time) {
+	expired := 0
+	for expired < len(w.order) && now.Sub(w.order[expired].at) >= w.window {
+		entry := w.order[expired]
+		//accepted again since is kept
+		if w.accepted[entry.key].Equal(entry.at) {
+			delete(w.accepted, entry.key)
+		}
+		expired++
+	}
+	w.order = append(w.order[:0], w.order[expired:]...)
+}
@@ -0,0 +1,152 @@
+package apns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The same notification as groupTestPayload(i), its custom fields built
+// in a different order
+func dedupeTestPayload(i int, reversed bool) *Payload {
+	payload := groupTestPayload(i)
+	payload.CollapseId = "score"
+	payload.CustomFields = map[string]interface{}{}
+	keys := []string{"game", "home", "away", "period"}
+	for k := range keys {
+		if reversed {
+			k = len(keys) - 1 - k
+		}
+		payload.CustomFields[keys[k]] = k
+	}
+	return payload
+}
+
+func TestSendAllShouldDropDuplicatesInBatch(t *testing.T) {
+	server, _, app := newManagerTestApps(t)
+	conn, err := NewHTTP2Connection(app.HTTP2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	otherCollapseId := dedupeTestPayload(0, false)
+	otherCollapseId.CollapseId = "period"
+	payloads := []*Payload{dedupeTestPayload(0, false), dedupeTestPayload(1, false), dedupeTestPayload(0, true),
+		otherCollapseId, dedupeTestPayload(1, true)}
+
+	results, err := conn.SendAllWithOptions(context.Background(), payloads, BatchOptions{Dedupe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	originals := map[int]int{2: 0, 4: 1}
+	for i, result := range results {
+		duplicate := &DuplicateError{}
+		if original, ok := originals[i]; ok {
+			if !result.Duplicate() || !errors.As(result.Err, &duplicate) || duplicate.Original != payloads[original] ||
+				result.Payload != payloads[i] {
+				t.Error(fmt.Sprintf("Expected payload %v to be dropped as a duplicate of %v but got %+v", i, original, result))
+			}
+		} else if !result.Accepted() || result.Duplicate() {
+			t.Error(fmt.Sprintf("Expected payload %v to be accepted but got %+v", i, result))
+		}
+	}
+	if received := server.Received(); len(received) != 3 {
+		t.Error(fmt.Sprintf("Expected 3 notifications but got %v", len(received)))
+	}
+
+	//sent as before without the option
+	results, err = conn.SendAll(context.Background(), payloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if !result.Accepted() {
+			t.Error(fmt.Sprintf("Expected payload %v to be accepted without deduplicating but got %+v", i, result))
+		}
+	}
+}
+
+func TestDedupeWindowShouldDropAcceptedDuplicates(t *testing.T) {
+	_, _, app := newManagerTestApps(t)
+	clock := newFakeClock()
+	app.HTTP2.clock = clock
+	app.HTTP2.DedupeWindow = 60000
+	conn, err := NewHTTP2Connection(app.HTTP2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if result, err := conn.Send(context.Background(), dedupeTestPayload(0, false)); err != nil || !result.Accepted() {
+		t.Fatal(fmt.Sprintf("Expected the payload to be accepted but got %+v, %v", result, err))
+	}
+	acceptedAt := clock.Now()
+	duplicate := &DuplicateError{}
+	if _, err := conn.Send(context.Background(), dedupeTestPayload(0, true)); !errors.As(err, &duplicate) ||
+		!duplicate.AcceptedAt.Equal(acceptedAt) || !errors.Is(err, ErrDuplicate) {
+		t.Error(fmt.Sprintf("Expected the identical payload to be dropped but got %v", err))
+	}
+	if result, err := conn.Send(context.Background(), dedupeTestPayload(1, false)); err != nil || !result.Accepted() {
+		t.Error(fmt.Sprintf("Expected another token to be accepted but got %+v, %v", result, err))
+	}
+
+	//shared by connections made with the config
+	other, err := NewHTTP2Connection(app.HTTP2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if results, _ := other.SendAll(context.Background(), []*Payload{dedupeTestPayload(0, false)}); !results[0].Duplicate() {
+		t.Error(fmt.Sprintf("Expected the payload to be dropped by another connection but got %+v", results[0]))
+	}
+
+	<-clock.After(time.Minute)
+	if result, err := conn.Send(context.Background(), dedupeTestPayload(0, false)); err != nil || !result.Accepted() {
+		t.Error(fmt.Sprintf("Expected the payload to be sent once the window is over but got %+v, %v", result, err))
+	}
+}
+
+func TestDedupeWindowShouldKeepPayloadsAcceptedAgain(t *testing.T) {
+	clock := newFakeClock()
+	window := newDedupeWindow(clock, time.Minute)
+	payload := dedupeTestPayload(0, false)
+	window.accept(payload)
+	<-clock.After(30 * time.Second)
+	window.accept(payload)
+	<-clock.After(30 * time.Second)
+	if err := window.check(payload); !errors.Is(err, ErrDuplicate) {
+		t.Error(fmt.Sprintf("Expected the payload accepted again to be remembered but got %v", err))
+	}
+	<-clock.After(30 * time.Second)
+	if err := window.check(payload); err != nil || len(window.accepted) != 0 || len(window.order) != 0 {
+		t.Error(fmt.Sprintf("Expected the payload to be forgotten but got %v", err))
+	}
+	if err := (*dedupeWindow)(nil).check(payload); err != nil {
+		t.Error(fmt.Sprintf("Expected no window to drop nothing but got %v", err))
+	}
+}
+
+func TestBroadcastShouldReportRepeatedTokens(t *testing.T) {
+	conn, _ := sendTestConnection(0)
+	tokens := broadcastTestTokens(2)
+	tokens = []string{tokens[0], strings.ToUpper(tokens[0]), tokens[1]}
+
+	results, err := conn.BroadcastWithOptions(context.Background(), &Payload{AlertText: "Testing broadcast"}, tokens,
+		BatchOptions{Dedupe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collected := collectBroadcast(results)
+	duplicate := &DuplicateError{}
+	if len(collected) != 3 || !collected[0].Accepted() || !errors.As(collected[1].Err, &duplicate) ||
+		duplicate.Original != collected[0].Payload || collected[1].Payload.Token != tokens[1] || !collected[2].Accepted() {
+		t.Error(fmt.Sprintf("Expected the repeated token to be reported as a duplicate but got %+v", collected))
+	}
+
+	conn.Disconnect()
+	<-conn.CloseChannel
+}
@@ -0,0 +1,159 @@
+package apns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// Dialer handing back one end of a net.Pipe, serving the other with a tls
+// server for the chain
+type pipeTestDialer struct {
+	chain *pinningTestChain
+	serve func(socket *tls.Conn)
+	lock  *sync.Mutex
+	addrs []string
+}
+
+func (d *pipeTestDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.lock.Lock()
+	d.addrs = append(d.addrs, network+" "+addr)
+	d.lock.Unlock()
+	client, server := net.Pipe()
+	go func() {
+		//a pipe has no buffer, so a session ticket written after the
+		//handshake would block until the client reads
+		socket := tls.Server(server, &tls.Config{
+			Certificates:           []tls.Certificate{d.chain.server},
+			ClientAuth:             tls.RequireAnyClientCert,
+			SessionTicketsDisabled: true,
+		})
+		defer socket.Close()
+		if socket.Handshake() == nil {
+			d.serve(socket)
+		}
+	}()
+	return client, nil
+}
+
+func (d *pipeTestDialer) dialed() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]string{}, d.addrs...)
+}
+
+func TestDialerShouldCarryTheConnection(t *testing.T) {
+	chain := newPinningTestChain(t)
+	ids := make(chan uint32, 10)
+	dialer := &pipeTestDialer{chain: chain, lock: new(sync.Mutex), serve: func(socket *tls.Conn) {
+		//read frames, rejecting the second payload
+		for {
+			header := make([]byte, 5)
+			if _, err := io.ReadFull(socket, header); err != nil {
+				return
+			}
+			frame := make([]byte, binary.BigEndian.Uint32(header[1:]))
+			if _, err := io.ReadFull(socket, frame); err != nil {
+				return
+			}
+			//items are id, length and data; the id item is the third
+			for i := 0; i < len(frame); {
+				itemLength := int(binary.BigEndian.Uint16(frame[i+1:]))
+				if frame[i] == 3 {
+					id := binary.BigEndian.Uint32(frame[i+3:])
+					ids <- id
+					if id == 1 {
+						response := []byte{8, 8, 0, 0, 0, 0}
+						binary.BigEndian.PutUint32(response[2:], id)
+						socket.Write(response)
+						return
+					}
+				}
+				i += 3 + itemLength
+			}
+		}
+	}}
+	certPEM, keyPEM := generateTestClientCert(t, "com.example.app")
+	conn, err := NewAPNSConnection(&APNSConfig{
+		CertificateBytes:       certPEM,
+		KeyBytes:               keyPEM,
+		GatewayHost:            "gateway.example.com",
+		RootCAs:                chain.roots,
+		IgnoreProxyEnvironment: true,
+		Dialer:                 dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialed := dialer.dialed(); len(dialed) != 1 || dialed[0] != "tcp gateway.example.com:2195" {
+		t.Error(fmt.Sprintf("Expected the gateway to be dialed but got %v", dialed))
+	}
+
+	conn.SendChannel <- groupTestPayload(0)
+	conn.SendChannel <- groupTestPayload(1)
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.Error == nil || connectionClose.Error.ErrorCode != 8 || connectionClose.ErrorPayload.Token != groupTestPayload(1).Token {
+		t.Error(fmt.Sprintf("Expected the second payload to be rejected but got %v", connectionClose))
+	}
+	if len(ids) != 2 {
+		t.Error(fmt.Sprintf("Expected 2 frames to be read but got %v", len(ids)))
+	}
+}
+
+func TestDialerFeedbackService(t *testing.T) {
+	chain := newPinningTestChain(t)
+	token, _ := hex.DecodeString(groupTestPayload(0).Token)
+	dialer := &pipeTestDialer{chain: chain, lock: new(sync.Mutex), serve: func(socket *tls.Conn) {
+		response := []byte{0, 0, 0, 1, 0, 32}
+		socket.Write(append(response, token...))
+	}}
+	certPEM, keyPEM := generateTestClientCert(t, "com.example.app")
+	responses, err := ConnectToFeedbackService(&APNSFeedbackServiceConfig{
+		CertificateBytes:       certPEM,
+		KeyBytes:               keyPEM,
+		GatewayHost:            "gateway.example.com",
+		RootCAs:                chain.roots,
+		IgnoreProxyEnvironment: true,
+		Dialer:                 dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responses.Len() != 1 || responses.Front().Value.(*FeedbackResponse).Token != groupTestPayload(0).Token {
+		t.Error(fmt.Sprintf("Expected the token as feedback but got %v responses", responses.Len()))
+	}
+	if dialed := dialer.dialed(); len(dialed) != 1 || dialed[0] != "tcp gateway.example.com:2196" {
+		t.Error(fmt.Sprintf("Expected the feedback service to be dialed but got %v", dialed))
+	}
+}
+
+func TestDialerShouldReachTheProxy(t *testing.T) {
+	chain := newPinningTestChain(t)
+	listener, _, port := chain.listen(t)
+	defer listener.Close()
+	proxy := newProxyTestServer(t, false, "", "", listener.Addr().String())
+	defer proxy.listener.Close()
+
+	dialed := []string{}
+	config := proxyTestConfig(t, chain, port)
+	config.ProxyURL = proxy.url("", "")
+	config.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Disconnect()
+	<-conn.CloseChannel
+	if len(dialed) != 1 || dialed[0] != proxy.listener.Addr().String() {
+		t.Error(fmt.Sprintf("Expected the proxy to be dialed but got %v", dialed))
+	}
+}
@@ -0,0 +1,109 @@
+package apns
+
+import (
+	"fmt"
+	"net"
+)
+
+// Which of apple's environments to send to, selecting the hosts of the
+// binary gateway, the feedback service and the HTTP/2 provider API
+type Environment int
+
+const (
+	// Apple's production hosts, what an unset Environment uses
+	EnvironmentProduction Environment = iota + 1
+	// Apple's sandbox hosts, for apps signed for development
+	EnvironmentDevelopment
+)
+
+const (
+	// Apple's binary protocol gateway
+	GatewayProductionHost = "gateway.push.apple.com"
+	// Apple's binary protocol gateway for development builds
+	GatewayDevelopmentHost = "gateway.sandbox.push.apple.com"
+	// Apple's feedback service
+	FeedbackProductionHost = "feedback.push.apple.com"
+	// Apple's feedback service for development builds
+	FeedbackDevelopmentHost = "feedback.sandbox.push.apple.com"
+)
+
+var environmentNames = map[Environment]string{
+	EnvironmentProduction:  "production",
+	EnvironmentDevelopment: "development",
+}
+
+func (e Environment) String() string {
+	if name, ok := environmentNames[e]; ok {
+		return name
+	}
+	if e == 0 {
+		return "unset"
+	}
+	return fmt.Sprintf("Environment(%d)", int(e))
+}
+
+// Apple's hosts for one service in each environment
+type appleHosts struct {
+	production  string
+	development string
+}
+
+var (
+	gatewayHosts  = appleHosts{GatewayProductionHost, GatewayDevelopmentHost}
+	feedbackHosts = appleHosts{FeedbackProductionHost, FeedbackDevelopmentHost}
+	http2Hosts    = appleHosts{HTTP2ProductionHost, HTTP2DevelopmentHost}
+)
+
+// The host for the environment, production if it isn't set
+func (h appleHosts) host(environment Environment) string {
+	if environment == EnvironmentDevelopment {
+		return h.development
+	}
+	return h.production
+}
+
+// Check an environment and the endpoint overrides of a config, addrField
+// naming the host:port override and hostField and portField the older
+// separate host and port, which may also be set as long as they match it
+// Returns the error lines, empty if valid
+func validateEndpoint(environment Environment, hosts appleHosts,
+	addrField string, addr string, hostField string, host string, portField string, port string) string {
+	errorStrs := ""
+	if environment != 0 && environment != EnvironmentProduction && environment != EnvironmentDevelopment {
+		errorStrs += "Invalid Environment. Should be EnvironmentProduction or EnvironmentDevelopment.\n"
+	}
+	if addr != "" {
+		addrHost, addrPort, err := net.SplitHostPort(addr)
+		if err != nil || addrHost == "" || addrPort == "" {
+			return errorStrs + fmt.Sprintf("Invalid %v %q. Should be host:port.\n", addrField, addr)
+		}
+		if (host != "" && host != addrHost) || (port != "" && port != addrPort) {
+			errorStrs += fmt.Sprintf("Invalid %v. Should be set instead of %v and %v, not as well as different ones.\n",
+				addrField, hostField, portField)
+		}
+		host = addrHost
+	}
+	if (environment == EnvironmentProduction && host == hosts.development) ||
+		(environment == EnvironmentDevelopment && host == hosts.production) {
+		errorStrs += fmt.Sprintf("Invalid Environment. %v is apple's host for the other environment.\n", host)
+	}
+	return errorStrs
+}
+
+// The host and port to connect to: those of a host:port override, or the
+// separate host and port, defaulting to apple's host for the environment
+// and defaultPort
+// addr should have been validated by validateEndpoint
+func resolveEndpoint(environment Environment, hosts appleHosts, addr string, host string, port string,
+	defaultPort string) (string, string) {
+	if addr != "" {
+		host, port, _ = net.SplitHostPort(addr)
+	}
+	if host == "" {
+		host = hosts.host(environment)
+	}
+	if port == "" {
+		port = defaultPort
+	}
+	return host, port
+}
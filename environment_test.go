@@ -0,0 +1,127 @@
+package apns
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/joekarl/go-libapns/apnstest"
+)
+
+func TestResolveEndpointShouldSelectAppleHosts(t *testing.T) {
+	cases := []struct {
+		environment Environment
+		hosts       appleHosts
+		addr        string
+		expected    string
+	}{
+		{0, gatewayHosts, "", "gateway.push.apple.com:2195"},
+		{EnvironmentProduction, gatewayHosts, "", "gateway.push.apple.com:2195"},
+		{EnvironmentDevelopment, gatewayHosts, "", "gateway.sandbox.push.apple.com:2195"},
+		{EnvironmentProduction, feedbackHosts, "", "feedback.push.apple.com:2195"},
+		{EnvironmentDevelopment, feedbackHosts, "", "feedback.sandbox.push.apple.com:2195"},
+		{EnvironmentProduction, http2Hosts, "", "api.push.apple.com:2195"},
+		{EnvironmentDevelopment, http2Hosts, "", "api.sandbox.push.apple.com:2195"},
+		{EnvironmentDevelopment, gatewayHosts, "relay.example.com:8443", "relay.example.com:8443"},
+	}
+	for _, c := range cases {
+		host, port := resolveEndpoint(c.environment, c.hosts, c.addr, "", "", "2195")
+		if actual := host + ":" + port; actual != c.expected {
+			t.Error(fmt.Sprintf("Expected %v for %v but got %v", c.expected, c.environment, actual))
+		}
+	}
+}
+
+func TestValidateEndpointShouldRejectContradictions(t *testing.T) {
+	cases := []struct {
+		environment Environment
+		addr        string
+		host        string
+		port        string
+		expected    string
+	}{
+		{Environment(3), "", "", "", "Invalid Environment"},
+		{0, "gateway.push.apple.com", "", "", "Should be host:port"},
+		{0, ":2195", "", "", "Should be host:port"},
+		{0, "localhost:2195", "gateway.push.apple.com", "", "not as well as different ones"},
+		{0, "localhost:2195", "", "2196", "not as well as different ones"},
+		{EnvironmentProduction, "gateway.sandbox.push.apple.com:2195", "", "", "other environment"},
+		{EnvironmentDevelopment, "", "gateway.push.apple.com", "", "other environment"},
+	}
+	for _, c := range cases {
+		errorStrs := validateEndpoint(c.environment, gatewayHosts, "GatewayAddr", c.addr, "GatewayHost", c.host, "GatewayPort", c.port)
+		if !strings.Contains(errorStrs, c.expected) {
+			t.Error(fmt.Sprintf("Expected %q for %+v but got %q", c.expected, c, errorStrs))
+		}
+	}
+
+	//as the config is defaulted in place, it's validated again on reconnect
+	valid := []struct {
+		environment Environment
+		addr        string
+		host        string
+		port        string
+	}{
+		{0, "", "", ""},
+		{EnvironmentDevelopment, "", "", ""},
+		{EnvironmentDevelopment, "", "gateway.sandbox.push.apple.com", "2195"},
+		{0, "localhost:2195", "localhost", "2195"},
+	}
+	for _, c := range valid {
+		if errorStrs := validateEndpoint(c.environment, gatewayHosts, "GatewayAddr", c.addr, "GatewayHost", c.host, "GatewayPort", c.port); errorStrs != "" {
+			t.Error(fmt.Sprintf("Expected %+v to be valid but got %q", c, errorStrs))
+		}
+	}
+}
+
+func TestConnectionShouldConnectToGatewayAddr(t *testing.T) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	config := &APNSConfig{
+		CertificateBytes: server.ClientCertPEM,
+		KeyBytes:         server.ClientKeyPEM,
+		RootCAs:          server.RootCAs,
+		GatewayAddr:      server.BinaryAddr(),
+		Environment:      EnvironmentDevelopment,
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := NewAPNSConnection(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.Endpoint() != server.BinaryAddr() {
+			t.Error(fmt.Sprintf("Expected the endpoint to be %v but got %v", server.BinaryAddr(), conn.Endpoint()))
+		}
+		conn.Disconnect()
+	}
+}
+
+func TestHTTP2ConnectionShouldSelectEnvironmentHost(t *testing.T) {
+	_, keyPEM := generateAuthKey(t)
+	conn, err := NewHTTP2Connection(&HTTP2Config{AuthKeyBytes: keyPEM, KeyID: "k", TeamID: "t",
+		Environment: EnvironmentDevelopment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Endpoint() != "api.sandbox.push.apple.com:443" {
+		t.Error(fmt.Sprintf("Expected the development host but got %v", conn.Endpoint()))
+	}
+
+	manager, err := NewChannelManager(&HTTP2Config{AuthKeyBytes: keyPEM, KeyID: "k", TeamID: "t",
+		Environment: EnvironmentDevelopment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manager.conn.Endpoint() != "api-manage-broadcast.sandbox.push.apple.com:2195" {
+		t.Error(fmt.Sprintf("Expected the development channel host but got %v", manager.conn.Endpoint()))
+	}
+
+	_, err = NewHTTP2Connection(&HTTP2Config{AuthKeyBytes: keyPEM, KeyID: "k", TeamID: "t",
+		Environment: EnvironmentDevelopment, GatewayAddr: "api.push.apple.com:443"})
+	if err == nil || !strings.Contains(err.Error(), "other environment") {
+		t.Error(fmt.Sprintf("Expected the production host to be rejected but got %v", err))
+	}
+}
@@ -0,0 +1,95 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// ExpirationTime value leaving expiration to Apple, which stores the
+	// notification and retries delivery for a limited time. The default
+	NoExpiration uint32 = 0
+	// ExpirationTime value for a notification that should only be
+	// delivered if the device can be reached right away, and never stored.
+	// Any time in the past means this, 1 is used as 0 means NoExpiration
+	ExpireImmediately uint32 = 1
+)
+
+// How far in the past an expiration may be before it is rejected,
+// allowing for clock differences between servers
+const ExpirationClockSkew = time.Minute
+
+// Set ExpirationTime from a time, a zero time means NoExpiration
+// Returns an error for a time more than ExpirationClockSkew in the past
+// (use SetTTL(0) or ExpireImmediately for that) or one too far in the
+// future to be sent
+func (p *Payload) SetExpiration(t time.Time) error {
+	return p.setExpiration(t, time.Now())
+}
+
+// Set ExpirationTime to d from now, rounded up to the next second
+// A zero duration means ExpireImmediately, not NoExpiration
+func (p *Payload) SetTTL(d time.Duration) error {
+	return p.setTTL(d, time.Now())
+}
+
+// Returns ExpirationTime as a time, and false for NoExpiration
+func (p *Payload) Expiration() (time.Time, bool) {
+	if p.ExpirationTime == NoExpiration {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(p.ExpirationTime), 0), true
+}
+
+func (p *Payload) setExpiration(t time.Time, now time.Time) error {
+	if t.IsZero() {
+		p.ExpirationTime = NoExpiration
+		return nil
+	}
+	expiration, err := expirationSeconds(t, now)
+	if err != nil {
+		return err
+	}
+	p.ExpirationTime = expiration
+	return nil
+}
+
+func (p *Payload) setTTL(d time.Duration, now time.Time) error {
+	if d < 0 {
+		return errors.New(fmt.Sprintf("TTL should be >= 0 but was %v", d))
+	}
+	if d == 0 {
+		p.ExpirationTime = ExpireImmediately
+		return nil
+	}
+	expiration, err := expirationSeconds(now.Add(d+time.Second-1), now)
+	if err != nil {
+		return err
+	}
+	p.ExpirationTime = expiration
+	return nil
+}
+
+// Convert to the UNIX seconds sent to apple, checking it is in range
+func expirationSeconds(t time.Time, now time.Time) (uint32, error) {
+	if t.Before(now.Add(-ExpirationClockSkew)) {
+		return 0, errors.New(fmt.Sprintf("Expiration %v is in the past", t.UTC().Format(time.RFC3339)))
+	}
+	if t.Unix() > math.MaxUint32 {
+		return 0, errors.New(fmt.Sprintf("Expiration %v is too far in the future", t.UTC().Format(time.RFC3339)))
+	}
+	return uint32(t.Unix()), nil
+}
+
+// Check an ExpirationTime set directly, catching durations passed as times
+func validateExpirationTime(expirationTime uint32, now time.Time) error {
+	if expirationTime == NoExpiration || expirationTime == ExpireImmediately {
+		return nil
+	}
+	if _, err := expirationSeconds(time.Unix(int64(expirationTime), 0), now); err != nil {
+		return errors.New(fmt.Sprintf("%v, should be UNIX seconds (see SetTTL for a duration)", err))
+	}
+	return nil
+}
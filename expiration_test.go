@@ -0,0 +1,87 @@
+package apns
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+var expirationTestNow = time.Unix(1700000000, 0)
+
+func TestSetExpiration(t *testing.T) {
+	p := &Payload{}
+	if err := p.setExpiration(expirationTestNow.Add(time.Hour), expirationTestNow); err != nil {
+		t.Fatal(err)
+	}
+	if p.ExpirationTime != 1700003600 {
+		t.Error(fmt.Sprintf("Expected 1700003600 but got %v", p.ExpirationTime))
+	}
+	if expiration, ok := p.Expiration(); !ok || !expiration.Equal(expirationTestNow.Add(time.Hour)) {
+		t.Error(fmt.Sprintf("Expected expiration in an hour but got %v", expiration))
+	}
+
+	if err := p.setExpiration(time.Time{}, expirationTestNow); err != nil || p.ExpirationTime != NoExpiration {
+		t.Error(fmt.Sprintf("Expected zero time to mean no expiration but got %v %v", p.ExpirationTime, err))
+	}
+	if _, ok := p.Expiration(); ok {
+		t.Error("Expected no expiration")
+	}
+}
+
+func TestSetExpirationShouldAllowClockSkew(t *testing.T) {
+	p := &Payload{}
+	if err := p.setExpiration(expirationTestNow.Add(-30*time.Second), expirationTestNow); err != nil {
+		t.Error(fmt.Sprintf("Expected expiration within the clock skew to be allowed but got %v", err))
+	}
+	p.ExpirationTime = 5
+	err := p.setExpiration(expirationTestNow.Add(-time.Hour), expirationTestNow)
+	if err == nil || !strings.Contains(err.Error(), "in the past") {
+		t.Error(fmt.Sprintf("Expected error for an expiration in the past but got %v", err))
+	}
+	if p.ExpirationTime != 5 {
+		t.Error("Expected ExpirationTime to be left alone on error")
+	}
+}
+
+func TestSetExpirationTooFarInFuture(t *testing.T) {
+	p := &Payload{}
+	if err := p.setExpiration(time.Unix(1<<33, 0), expirationTestNow); err == nil {
+		t.Error("Expected error for an expiration that doesn't fit in 32 bits")
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	p := &Payload{}
+	if err := p.setTTL(time.Hour, expirationTestNow); err != nil || p.ExpirationTime != 1700003600 {
+		t.Error(fmt.Sprintf("Expected 1700003600 but got %v %v", p.ExpirationTime, err))
+	}
+	//partial seconds round up so the ttl is never shortened
+	if err := p.setTTL(1500*time.Millisecond, expirationTestNow); err != nil || p.ExpirationTime != 1700000002 {
+		t.Error(fmt.Sprintf("Expected 1700000002 but got %v %v", p.ExpirationTime, err))
+	}
+	if err := p.setTTL(0, expirationTestNow); err != nil || p.ExpirationTime != ExpireImmediately {
+		t.Error(fmt.Sprintf("Expected zero ttl to expire immediately but got %v %v", p.ExpirationTime, err))
+	}
+	if err := p.setTTL(-time.Second, expirationTestNow); err == nil {
+		t.Error("Expected error for a negative ttl")
+	}
+}
+
+func TestValidateExpirationTime(t *testing.T) {
+	for _, expirationTime := range []uint32{NoExpiration, ExpireImmediately, 1700003600} {
+		if err := validateExpirationTime(expirationTime, expirationTestNow); err != nil {
+			t.Error(fmt.Sprintf("Expected %v to be valid but got %v", expirationTime, err))
+		}
+	}
+	//a duration passed where a time is expected
+	err := validateExpirationTime(3600, expirationTestNow)
+	if err == nil || !strings.Contains(err.Error(), "SetTTL") {
+		t.Error(fmt.Sprintf("Expected error for a duration as an expiration but got %v", err))
+	}
+
+	p := &Payload{Token: validateTestToken, AlertText: "Testing", ExpirationTime: 3600}
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "in the past") {
+		t.Error(fmt.Sprintf("Expected Validate to reject the expiration but got %v", err))
+	}
+}
@@ -4,7 +4,9 @@ package apns
 
 import (
 	"container/list"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -20,8 +22,36 @@ type APNSFeedbackServiceConfig struct {
 	CertificateBytes []byte
 	//bytes for key.pem : required
 	KeyBytes []byte
-	//apple gateway, defaults to "feedback.push.apple.com"
+	//apple gateway, defaults to apple's for Environment, "feedback.push.apple.com" (FeedbackProductionHost)
 	GatewayHost string
+	//which of apple's environments to read feedback from, selecting the gateway unless
+	//GatewayHost or FeedbackAddr is set, defaults to EnvironmentProduction
+	Environment Environment
+	//optional host:port of the feedback service, e.g. a test gateway or a relay, in place of
+	//GatewayHost and GatewayPort, which are set from it
+	FeedbackAddr string
+	//certificate authorities used to verify the gateway, defaults to the system roots
+	//only needed when connecting to a test gateway
+	RootCAs *x509.CertPool
+	//optional base64 SHA-256 SPKI fingerprints (see SPKIFingerprint), the connection fails
+	//with a PinningError unless the gateway's verified chain includes one of them
+	PinnedPublicKeys []string
+	//optional TLS versions, cipher suites etc. (see TLSOptions), defaults to crypto/tls's
+	TLS *TLSOptions
+	//optional proxy to connect through, http:// or https:// for HTTP CONNECT or socks5://,
+	//with user:password@ for authentication, defaults to HTTPS_PROXY (respecting NO_PROXY)
+	ProxyURL string
+	//connect directly unless ProxyURL is set, ignoring HTTPS_PROXY
+	IgnoreProxyEnvironment bool
+	//optional function to open the tcp connection to the gateway (or proxy) with, e.g. to bind
+	//a source address or to dial a net.Pipe in tests, defaults to a net.Dialer
+	//TLS is layered on top of the connection it returns
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+	//optional function to resolve the gateway's addresses with, defaults to net.DefaultResolver.LookupHost
+	//each address is tried in turn, those that failed in the last minute after the others
+	Resolver func(ctx context.Context, host string) ([]string, error)
+	//number of milliseconds to wait for each of the gateway's addresses to connect, defaults to 3000
+	DialAttemptTimeout int
 	//apple gateway port, defaults to "2196"
 	GatewayPort string
 	//number of seconds to wait for connection before bailing, defaults to 5 seconds
@@ -55,38 +85,54 @@ func ConnectToFeedbackService(config *APNSFeedbackServiceConfig) (*list.List, er
 	if config.CertificateBytes == nil || config.KeyBytes == nil {
 		errorStrs += "Invalid Key/Certificate bytes\n"
 	}
+	errorStrs += validatePinnedPublicKeys(config.PinnedPublicKeys)
+	errorStrs += validateTLSOptions(config.TLS, config.PinnedPublicKeys)
+	errorStrs += validateProxyURL(config.ProxyURL)
+	if config.DialAttemptTimeout < 0 {
+		errorStrs += "Invalid DialAttemptTimeout. Should be >= 0.\n"
+	}
+	errorStrs += validateEndpoint(config.Environment, feedbackHosts, "FeedbackAddr", config.FeedbackAddr,
+		"GatewayHost", config.GatewayHost, "GatewayPort", config.GatewayPort)
 
 	if errorStrs != "" {
 		return nil, errors.New(errorStrs)
 	}
 
-	if config.GatewayPort == "" {
-		config.GatewayPort = "2196"
-	}
-	if config.GatewayHost == "" {
-		config.GatewayHost = "feedback.push.apple.com"
-	}
+	config.GatewayHost, config.GatewayPort = resolveEndpoint(config.Environment, feedbackHosts,
+		config.FeedbackAddr, config.GatewayHost, config.GatewayPort, "2196")
 	if config.SocketTimeout == 0 {
 		config.SocketTimeout = 5
 	}
+	if config.DialAttemptTimeout == 0 {
+		config.DialAttemptTimeout = defaultDialAttemptTimeout
+	}
 	if config.TlsTimeout == 0 {
 		config.TlsTimeout = 5
 	}
 
-	x509Cert, err := tls.X509KeyPair(config.CertificateBytes, config.KeyBytes)
+	x509Cert, err := loadKeyPair(config.CertificateBytes, config.KeyBytes)
 	if err != nil {
 		//failed to validate key pair
 		return nil, err
 	}
 
-	tlsConf := &tls.Config{
-		Certificates: []tls.Certificate{x509Cert},
-		ServerName:   config.GatewayHost,
-	}
+	tlsConf := newTLSConfig(config.TLS, config.GatewayHost, config.RootCAs,
+		config.PinnedPublicKeys, []tls.Certificate{x509Cert})
 
-	tcpSocket, err := net.DialTimeout("tcp",
-		config.GatewayHost+":"+config.GatewayPort,
-		time.Duration(config.SocketTimeout)*time.Second)
+	proxy, err := proxyForGateway(config.ProxyURL, config.IgnoreProxyEnvironment,
+		config.GatewayHost, config.GatewayPort)
+	if err != nil {
+		return nil, err
+	}
+	tcpSocket, err := dialGateway(context.Background(), gatewayAddr{
+		host:           config.GatewayHost,
+		port:           config.GatewayPort,
+		proxy:          proxy,
+		dial:           config.Dialer,
+		resolve:        config.Resolver,
+		timeout:        time.Duration(config.SocketTimeout) * time.Second,
+		attemptTimeout: time.Duration(config.DialAttemptTimeout) * time.Millisecond,
+	}, &ConnectTiming{})
 	if err != nil {
 		//failed to connect to gateway
 		return nil, err
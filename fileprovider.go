@@ -0,0 +1,19 @@
+package apns
+
+// Create a push waking a File Provider extension to fetch changes to the
+// container (e.g. NSFileProviderWorkingSetContainerItemIdentifier) in the
+// domain, "" for the default domain
+// The topic needs the .pushkit.fileprovider suffix, e.g.
+// com.example.app.pushkit.fileprovider
+func NewFileProviderPayload(token string, containerIdentifier string, domain string) *Payload {
+	custom := map[string]interface{}{"container-identifier": containerIdentifier}
+	if domain != "" {
+		custom["domain"] = domain
+	}
+	return &Payload{
+		Token:            token,
+		ContentAvailable: 1,
+		PushType:         PushTypeFileProvider,
+		CustomFields:     custom,
+	}
+}
@@ -0,0 +1,74 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFileProviderPayload(t *testing.T) {
+	p := NewFileProviderPayload(validateTestToken, "NSFileProviderWorkingSetContainerItemIdentifier", "docs")
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	payloadBytes, err := p.MarshalAuto()
+	expected := `{"aps":{"content-available":1},"container-identifier":"NSFileProviderWorkingSetContainerItemIdentifier","domain":"docs"}`
+	if err != nil || string(payloadBytes) != expected {
+		t.Error(fmt.Sprintf("Expected %v but got %s, %v", expected, payloadBytes, err))
+	}
+
+	p = NewFileProviderPayload(validateTestToken, "root", "")
+	if _, ok := p.CustomFields["domain"]; ok {
+		t.Error("Expected no domain for the default domain")
+	}
+
+	p.Sound = "default"
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "File provider pushes can't have") {
+		t.Error(fmt.Sprintf("Expected a file provider push with a sound to be invalid but got %v", err))
+	}
+}
+
+func TestHTTP2SendShouldPostFileProviderPush(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(b)
+	})
+	defer server.Close()
+
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+
+	p := NewFileProviderPayload(validateTestToken, "root", "")
+	p.Topic = "com.example.app.pushkit.fileprovider"
+	if _, err := conn.Send(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	received := <-requests
+	if received.URL.Path != "/3/device/"+validateTestToken {
+		t.Error(fmt.Sprintf("Unexpected path %v", received.URL.Path))
+	}
+	headers := map[string]string{
+		"apns-push-type": "fileprovider",
+		"apns-topic":     "com.example.app.pushkit.fileprovider",
+		"apns-priority":  "",
+	}
+	for header, value := range headers {
+		if received.Header.Get(header) != value {
+			t.Error(fmt.Sprintf("Expected %v %q but got %q", header, value, received.Header.Get(header)))
+		}
+	}
+	if body := <-bodies; body != `{"aps":{"content-available":1},"container-identifier":"root"}` {
+		t.Error(fmt.Sprintf("Unexpected body %v", body))
+	}
+
+	p.Topic = "com.example.app"
+	if _, err := conn.Send(context.Background(), p); err == nil || !strings.Contains(err.Error(), ".pushkit.fileprovider") {
+		t.Error(fmt.Sprintf("Expected a file provider push without the suffix to fail but got %v", err))
+	}
+}
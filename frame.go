@@ -0,0 +1,238 @@
+package apns
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Binary protocol command 2 frame item ids
+const (
+	frameItemToken      = 1
+	frameItemPayload    = 2
+	frameItemIdentifier = 3
+	frameItemExpiration = 4
+	frameItemPriority   = 5
+)
+
+// Command byte and frame length before a frame's items
+const binaryFrameHeaderLength = 5
+
+// Largest frame ReadBinaryFrame reads, well over what a frame that apple
+// accepts holds, so a garbled length doesn't allocate gigabytes
+const maxBinaryFrameLength = 1 << 20
+
+// Command byte of apple's error response, then the status and identifier
+const (
+	errorResponseCommand = 8
+	errorResponseLength  = 6
+)
+
+// The items of a binary protocol command 2 frame, see ParseBinaryFrame
+type BinaryFrame struct {
+	// device token, as 64 hex characters
+	Token string
+	// payload json
+	Payload []byte
+	// identifier apple refers to the notification by in an error response
+	Identifier uint32
+	// when the notification expires, 0 if not set
+	ExpirationTime uint32
+	// 5 or 10, 0 if not set
+	Priority uint8
+}
+
+// The 6 byte response apple writes to a binary protocol connection before
+// closing it, for the notification it rejected, see ParseErrorResponse
+type ErrorResponse struct {
+	// always 8
+	Command uint8
+	// apple's status for the notification, see ErrorReasonFromStatus
+	Status ErrorReason
+	// identifier of the rejected notification's frame
+	Identifier uint32
+}
+
+// Encode a payload as the command 2 frame an APNSConnection writes for it,
+// with identifier for apple to refer to it by, e.g. to store frames ready
+// to be written to the gateway later. Frames can be written back to back
+// maxPayloadSize is as for Marshal, 0 for MaxPayloadSizeBinary as with
+// APNSConfig.MaxPayloadSize
+// BeforeSend hooks aren't run
+// Returns an error if the token isn't 64 hex characters, the payload
+// doesn't fit in maxPayloadSize once truncated or identifier is 0
+func MarshalBinaryFrame(payload *Payload, identifier uint32, maxPayloadSize int) ([]byte, error) {
+	if identifier == 0 {
+		return nil, errors.New("Invalid identifier. Should be > 0.")
+	}
+	if maxPayloadSize == 0 {
+		maxPayloadSize = MaxPayloadSizeBinary
+	}
+	token, err := payload.binaryToken()
+	if err != nil {
+		return nil, err
+	}
+	payloadBytes, err := payload.AppendMarshal(nil, maxPayloadSize)
+	if err != nil {
+		return nil, err
+	}
+	return appendBinaryFrame(nil, token, payloadBytes, identifier, payload), nil
+}
+
+// Decode a device token for a frame
+func decodeBinaryToken(token string) ([]byte, error) {
+	tokenBytes, err := hex.DecodeString(token)
+	if err == nil && len(tokenBytes) != 32 {
+		err = errors.New(fmt.Sprintf("Invalid token %q, should be 64 hex characters", token))
+	}
+	return tokenBytes, err
+}
+
+// Append the command 2 frame for a payload to dst, with its decoded token
+// and marshaled json, returning the extended slice
+// Shared by APNSConnection and MarshalBinaryFrame so they frame alike
+func appendBinaryFrame(dst []byte, token []byte, payloadBytes []byte, identifier uint32, payload *Payload) []byte {
+	start := len(dst)
+	dst = append(dst, 2, 0, 0, 0, 0)
+
+	dst = appendFrameItem(dst, frameItemToken, token)
+	dst = appendFrameItem(dst, frameItemPayload, payloadBytes)
+	dst = appendUint32FrameItem(dst, frameItemIdentifier, identifier)
+
+	//write expire date if set
+	if payload.ExpirationTime != 0 {
+		dst = appendUint32FrameItem(dst, frameItemExpiration, payload.ExpirationTime)
+	}
+
+	//write priority if set correctly
+	//the binary protocol only has 5 and 10, so 1 is sent as the closest, 5
+	priority := payload.Priority
+	if priority == PriorityPowerConsiderations {
+		priority = PriorityThrottled
+	}
+	if priority == PriorityImmediate || priority == PriorityThrottled {
+		//the priority has always been written as a single byte with an item
+		//length of 4, which apple accepts, so frames don't change
+		dst = append(dst, frameItemPriority, 0, 4, priority)
+	}
+
+	binary.BigEndian.PutUint32(dst[start+1:], uint32(len(dst)-start-binaryFrameHeaderLength))
+	return dst
+}
+
+func appendFrameItem(dst []byte, id uint8, item []byte) []byte {
+	dst = append(dst, id)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(item)))
+	return append(dst, item...)
+}
+
+func appendUint32FrameItem(dst []byte, id uint8, item uint32) []byte {
+	dst = append(dst, id, 0, 4)
+	return binary.BigEndian.AppendUint32(dst, item)
+}
+
+// Decode a command 2 frame, as written by an APNSConnection or
+// MarshalBinaryFrame, into its items
+// data should hold exactly one frame. Returns an error if it isn't a
+// command 2 frame, is cut short or has no token or payload
+func ParseBinaryFrame(data []byte) (*BinaryFrame, error) {
+	if len(data) < binaryFrameHeaderLength || data[0] != 2 {
+		return nil, errors.New("Invalid frame. Should start with command 2 and the frame length.")
+	}
+	items := data[binaryFrameHeaderLength:]
+	if length := binary.BigEndian.Uint32(data[1:binaryFrameHeaderLength]); int64(length) != int64(len(items)) {
+		return nil, errors.New(fmt.Sprintf("Invalid frame length %v, %v bytes of items follow", length, len(items)))
+	}
+
+	frame := &BinaryFrame{}
+	for len(items) > 0 {
+		if len(items) < 3 {
+			return nil, errors.New("Invalid frame, an item is cut short")
+		}
+		id := items[0]
+		length := int(binary.BigEndian.Uint16(items[1:3]))
+		if len(items) < 3+length {
+			if id != frameItemPriority || len(items) != 4 {
+				return nil, errors.New(fmt.Sprintf("Invalid frame, item %v is cut short", id))
+			}
+			//connections have always written the priority as a single byte
+			//with an item length of 4, ending the frame
+			length = 1
+		}
+		item := items[3 : 3+length]
+		items = items[3+length:]
+		switch id {
+		case frameItemToken:
+			frame.Token = hex.EncodeToString(item)
+		case frameItemPayload:
+			frame.Payload = append([]byte(nil), item...)
+		case frameItemIdentifier:
+			if length != 4 {
+				return nil, errors.New("Invalid frame, the identifier should be 4 bytes")
+			}
+			frame.Identifier = binary.BigEndian.Uint32(item)
+		case frameItemExpiration:
+			if length != 4 {
+				return nil, errors.New("Invalid frame, the expiration should be 4 bytes")
+			}
+			frame.ExpirationTime = binary.BigEndian.Uint32(item)
+		case frameItemPriority:
+			if length == 0 {
+				return nil, errors.New("Invalid frame, the priority is empty")
+			}
+			frame.Priority = item[length-1]
+		}
+	}
+	if frame.Token == "" || frame.Payload == nil {
+		return nil, errors.New("Invalid frame. Should have a token and a payload.")
+	}
+	return frame, nil
+}
+
+// Read one command 2 frame from r, e.g. a captured stream of frames, and
+// decode it as ParseBinaryFrame does. Item ids it doesn't know are skipped
+// Returns io.EOF if r ends before the frame starts and
+// io.ErrUnexpectedEOF if it ends part way through
+func ReadBinaryFrame(r io.Reader) (*BinaryFrame, error) {
+	header := make([]byte, binaryFrameHeaderLength, binaryFrameHeaderLength+64)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 2 {
+		return nil, errors.New(fmt.Sprintf("Invalid frame command %v. Should be 2.", header[0]))
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxBinaryFrameLength {
+		return nil, errors.New(fmt.Sprintf("Invalid frame length %v. Should be <= %v.", length, maxBinaryFrameLength))
+	}
+	data := append(header, make([]byte, length)...)
+	if _, err := io.ReadFull(r, data[binaryFrameHeaderLength:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return ParseBinaryFrame(data)
+}
+
+// Read apple's error response from r, e.g. a binary protocol connection
+// Returns io.EOF if r ends before the response starts and
+// io.ErrUnexpectedEOF if it ends part way through, other read errors are
+// returned as is. A response that isn't command 8 is an error
+func ParseErrorResponse(r io.Reader) (ErrorResponse, error) {
+	buffer := make([]byte, errorResponseLength)
+	if _, err := io.ReadFull(r, buffer); err != nil {
+		return ErrorResponse{}, err
+	}
+	response := ErrorResponse{
+		Command:    buffer[0],
+		Status:     ErrorReasonFromStatus(buffer[1]),
+		Identifier: binary.BigEndian.Uint32(buffer[2:]),
+	}
+	if response.Command != errorResponseCommand {
+		return response, errors.New(fmt.Sprintf("Invalid error response command %v. Should be 8.", response.Command))
+	}
+	return response, nil
+}
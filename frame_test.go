@@ -0,0 +1,149 @@
+package apns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestMarshalBinaryFrameShouldMatchConnection(t *testing.T) {
+	socket := NewMockConnRejectId(false, 0)
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            10,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		})
+
+	payload := &Payload{
+		AlertText:      "Testing",
+		Badge:          NewBadgeNumber(3),
+		Token:          "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f",
+		ExpirationTime: 4000000000,
+		Priority:       PriorityPowerConsiderations,
+	}
+	apn.SendChannel <- groupTestPayload(0)
+	apn.SendChannel <- payload
+	go apn.Shutdown(context.Background())
+	<-apn.CloseChannel
+
+	frame, err := MarshalBinaryFrame(payload, 1, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written := socket.WrittenBytes.Bytes(); !bytes.HasSuffix(written, frame) {
+		t.Error(fmt.Sprintf("Expected the connection to have written %v but got %v", frame, written))
+	}
+
+	parsed, err := ParseBinaryFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Token != payload.Token || string(parsed.Payload) != `{"aps":{"alert":"Testing","badge":3}}` ||
+		parsed.Identifier != 1 || parsed.ExpirationTime != 4000000000 || parsed.Priority != PriorityThrottled {
+		t.Error(fmt.Sprintf("Expected the frame's items to be parsed but got %+v", parsed))
+	}
+}
+
+func TestMarshalBinaryFrameShouldRejectInvalidPayloads(t *testing.T) {
+	tooLong := groupTestPayload(0)
+	tooLong.CustomFields = map[string]interface{}{"data": strings.Repeat("x", MaxPayloadSizeBinary)}
+	cases := map[string]struct {
+		payload    *Payload
+		identifier uint32
+	}{
+		"Invalid identifier": {groupTestPayload(0), 0},
+		"Invalid token":      {&Payload{AlertText: "Testing", Token: "not a token"}, 1},
+		"short token":        {&Payload{AlertText: "Testing", Token: "4ec5"}, 1},
+		"too long":           {tooLong, 1},
+	}
+	for name, c := range cases {
+		if _, err := MarshalBinaryFrame(c.payload, c.identifier, 0); err == nil {
+			t.Error(fmt.Sprintf("Expected %v to fail", name))
+		}
+	}
+}
+
+func TestParseBinaryFrameShouldRejectInvalidFrames(t *testing.T) {
+	frame, err := MarshalBinaryFrame(groupTestPayload(0), 7, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongCommand := append([]byte{1}, frame[1:]...)
+	noToken := []byte{2, 0, 0, 0, 7, 3, 0, 4, 0, 0, 0, 7}
+	frames := map[string][]byte{
+		"empty":         {},
+		"wrong command": wrongCommand,
+		"cut short":     frame[:len(frame)-3],
+		"trailing":      append(append([]byte(nil), frame...), 0),
+		"no token":      noToken,
+	}
+	for name, data := range frames {
+		if _, err := ParseBinaryFrame(data); err == nil {
+			t.Error(fmt.Sprintf("Expected the %v frame to fail", name))
+		}
+	}
+}
+
+func TestReadBinaryFrameShouldReadCapturedFrames(t *testing.T) {
+	first, _ := MarshalBinaryFrame(groupTestPayload(0), 1, 0)
+	second, _ := MarshalBinaryFrame(groupTestPayload(1), 2, 0)
+	//an item id the parser doesn't know of is skipped
+	unknown := append(append([]byte(nil), second...), 9, 0, 2, 1, 2)
+	binary.BigEndian.PutUint32(unknown[1:], uint32(len(unknown)-binaryFrameHeaderLength))
+
+	stream := iotest.OneByteReader(bytes.NewReader(append(append([]byte(nil), first...), unknown...)))
+	for i := 0; i < 2; i++ {
+		frame, err := ReadBinaryFrame(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Identifier != uint32(i+1) || frame.Token != groupTestPayload(i).Token {
+			t.Error(fmt.Sprintf("Expected frame %v but got %+v", i+1, frame))
+		}
+	}
+	if _, err := ReadBinaryFrame(stream); err != io.EOF {
+		t.Error(fmt.Sprintf("Expected the end of the frames but got %v", err))
+	}
+
+	for _, cut := range []int{3, len(first) - 1} {
+		if _, err := ReadBinaryFrame(bytes.NewReader(first[:cut])); err != io.ErrUnexpectedEOF {
+			t.Error(fmt.Sprintf("Expected a frame cut at %v to be short but got %v", cut, err))
+		}
+	}
+	huge := []byte{2, 0xff, 0xff, 0xff, 0xff}
+	if _, err := ReadBinaryFrame(bytes.NewReader(huge)); err == nil || err == io.ErrUnexpectedEOF {
+		t.Error(fmt.Sprintf("Expected the frame length to be refused but got %v", err))
+	}
+}
+
+func TestParseErrorResponse(t *testing.T) {
+	response, err := ParseErrorResponse(iotest.OneByteReader(bytes.NewReader([]byte{8, 8, 0, 0, 1, 2})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Command != 8 || response.Status != BinaryReasonInvalidToken || response.Identifier != 258 {
+		t.Error(fmt.Sprintf("Expected an invalid token for frame 258 but got %+v", response))
+	}
+
+	response, _ = ParseErrorResponse(bytes.NewReader([]byte{8, 42, 0, 0, 0, 1}))
+	if status, ok := response.Status.BinaryStatus(); !ok || status != 42 {
+		t.Error(fmt.Sprintf("Expected the unlisted status to be kept but got %+v", response))
+	}
+
+	if _, err := ParseErrorResponse(bytes.NewReader(nil)); err != io.EOF {
+		t.Error(fmt.Sprintf("Expected no response but got %v", err))
+	}
+	if _, err := ParseErrorResponse(bytes.NewReader([]byte{8, 8, 0})); err != io.ErrUnexpectedEOF {
+		t.Error(fmt.Sprintf("Expected a short response but got %v", err))
+	}
+	if _, err := ParseErrorResponse(bytes.NewReader([]byte{2, 8, 0, 0, 0, 1})); err == nil {
+		t.Error("Expected a response that isn't command 8 to fail")
+	}
+}
@@ -0,0 +1,117 @@
+package apns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of milliseconds to wait for each of the gateway's addresses to
+// connect by default, before moving on to the next
+const defaultDialAttemptTimeout = 3000
+
+// Resolves a host's addresses, as net.Resolver.LookupHost does
+type resolveFunc func(ctx context.Context, host string) ([]string, error)
+
+// How long an address that failed to connect is tried after the others
+var failedAddrTTL = time.Minute
+
+// Addresses that recently failed to connect, shared by every connection
+// so reconnects and pool members try a dead address last
+type failedAddrs struct {
+	lock  sync.Mutex
+	until map[string]time.Time
+}
+
+var recentlyFailedAddrs = &failedAddrs{until: make(map[string]time.Time)}
+
+func (f *failedAddrs) add(addr string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.until[addr] = time.Now().Add(failedAddrTTL)
+}
+
+func (f *failedAddrs) remove(addr string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.until, addr)
+}
+
+// addrs in the same order but with those that recently failed moved last,
+// still in order so all of them are tried if everything else fails
+func (f *failedAddrs) order(addrs []string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	now := time.Now()
+	healthy := make([]string, 0, len(addrs))
+	failed := []string{}
+	for _, addr := range addrs {
+		if until, ok := f.until[addr]; ok && now.Before(until) {
+			failed = append(failed, addr)
+		} else {
+			delete(f.until, addr)
+			healthy = append(healthy, addr)
+		}
+	}
+	return append(healthy, failed...)
+}
+
+// Resolve host and dial each of its addresses in turn, giving each
+// attemptTimeout (if > 0) until one connects or ctx is done
+// Records the dns and dial phases, the address connected to and those
+// that failed first into timing, and logs a failover with logger, or the
+// standard logger if nil
+func dialResolved(ctx context.Context, resolve resolveFunc, dial dialFunc, host, port string,
+	attemptTimeout time.Duration, logger Logger, timing *ConnectTiming) (net.Conn, error) {
+	dnsStart := time.Now()
+	ips, err := resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New(fmt.Sprintf("No addresses found for %v", host))
+	}
+	timing.DNS = time.Since(dnsStart)
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	dialStart := time.Now()
+	failures := []string{}
+	for _, addr := range recentlyFailedAddrs.order(addrs) {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if attemptTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, attemptTimeout)
+		}
+		socket, err := dial(attemptCtx, "tcp", addr)
+		cancel()
+		if err == nil {
+			recentlyFailedAddrs.remove(addr)
+			timing.Dial = time.Since(dialStart)
+			timing.Addr = socket.RemoteAddr().String()
+			if len(timing.FailedAddrs) > 0 && logger != nil {
+				logger.Warn("apns: connected after failover", "host", host, "addr", addr,
+					"failed_addrs", strings.Join(timing.FailedAddrs, ", "))
+			} else if len(timing.FailedAddrs) > 0 {
+				log.Printf("apns: connected to %v at %v after %v failed", host, addr,
+					strings.Join(timing.FailedAddrs, ", "))
+			}
+			return socket, nil
+		}
+		if ctx.Err() != nil {
+			//out of time overall rather than the address being down
+			return nil, ctx.Err()
+		}
+		recentlyFailedAddrs.add(addr)
+		timing.FailedAddrs = append(timing.FailedAddrs, addr)
+		failures = append(failures, err.Error())
+	}
+	return nil, errors.New(fmt.Sprintf("Couldn't connect to %v at any of its %v addresses: %v",
+		host, len(addrs), strings.Join(failures, "; ")))
+}
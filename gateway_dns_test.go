@@ -0,0 +1,180 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Resolver giving the same addresses for every host
+func staticTestResolver(ips ...string) func(ctx context.Context, host string) ([]string, error) {
+	return func(ctx context.Context, host string) ([]string, error) {
+		return ips, nil
+	}
+}
+
+// host:port for each ip, for loopback ones nothing listens on (refused
+// straight away) or unroutable ones from TEST-NET-1
+func downTestAddrs(port string, ips ...string) []string {
+	addrs := []string{}
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	return addrs
+}
+
+func forgetTestAddrs(addrs []string) {
+	for _, addr := range addrs {
+		recentlyFailedAddrs.remove(addr)
+	}
+}
+
+func TestGatewayDNSShouldFailOverToTheNextAddress(t *testing.T) {
+	chain := newPinningTestChain(t)
+	listener, host, port := chain.listen(t)
+	defer listener.Close()
+	down := downTestAddrs(port, "127.0.0.2")
+	defer forgetTestAddrs(down)
+
+	config := proxyTestConfig(t, chain, port)
+	config.Resolver = staticTestResolver("127.0.0.2", host)
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Disconnect()
+	<-conn.CloseChannel
+	timing := conn.ConnectTiming()
+	if timing.Addr != listener.Addr().String() {
+		t.Error(fmt.Sprintf("Expected to connect to %v but got %v", listener.Addr(), timing.Addr))
+	}
+	if len(timing.FailedAddrs) != 1 || timing.FailedAddrs[0] != down[0] {
+		t.Error(fmt.Sprintf("Expected %v to have failed but got %v", down, timing.FailedAddrs))
+	}
+
+	//the dead address is remembered and tried last on reconnecting
+	conn, err = NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Disconnect()
+	<-conn.CloseChannel
+	if failed := conn.ConnectTiming().FailedAddrs; len(failed) != 0 {
+		t.Error(fmt.Sprintf("Expected the failed address to be skipped but got %v", failed))
+	}
+}
+
+func TestGatewayDNSShouldFailWhenAllAddressesAreDown(t *testing.T) {
+	chain := newPinningTestChain(t)
+	listener, _, port := chain.listen(t)
+	listener.Close()
+	down := downTestAddrs(port, "127.0.0.2", "127.0.0.3")
+	defer forgetTestAddrs(down)
+
+	config := proxyTestConfig(t, chain, port)
+	config.Resolver = staticTestResolver("127.0.0.2", "127.0.0.3")
+	_, err := NewAPNSConnection(config)
+	if err == nil || !strings.Contains(err.Error(), "any of its 2 addresses") {
+		t.Fatal(fmt.Sprintf("Expected every address to fail but got %v", err))
+	}
+	for _, addr := range down {
+		if !strings.Contains(err.Error(), addr) {
+			t.Error(fmt.Sprintf("Expected %v in the error but got %v", addr, err))
+		}
+	}
+
+	//still tried when every address recently failed
+	timing := ConnectTiming{}
+	_, err = dialGateway(context.Background(), gatewayAddr{
+		host:    "gateway.example.com",
+		port:    port,
+		resolve: config.Resolver,
+	}, &timing)
+	if err == nil || len(timing.FailedAddrs) != 2 || timing.FailedAddrs[0] != down[0] {
+		t.Error(fmt.Sprintf("Expected both addresses to be tried again in order but got %v", timing.FailedAddrs))
+	}
+}
+
+func TestGatewayDNSShouldTimeOutEachAttempt(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	hanging := downTestAddrs(port, "192.0.2.1")
+	defer forgetTestAddrs(hanging)
+
+	//the first address never answers
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == hanging[0] {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	timing := ConnectTiming{}
+	start := time.Now()
+	socket, err := dialGateway(context.Background(), gatewayAddr{
+		host:           "gateway.example.com",
+		port:           port,
+		dial:           dial,
+		resolve:        staticTestResolver("192.0.2.1", "127.0.0.1"),
+		timeout:        5 * time.Second,
+		attemptTimeout: 50 * time.Millisecond,
+	}, &timing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket.Close()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Error(fmt.Sprintf("Expected to give up on the first address after 50ms but took %v", elapsed))
+	}
+	if timing.Addr != listener.Addr().String() || len(timing.FailedAddrs) != 1 {
+		t.Error(fmt.Sprintf("Expected to connect to the second address but got %+v", timing))
+	}
+}
+
+func TestGatewayDNSFailedAddrsShouldExpire(t *testing.T) {
+	defer func(ttl time.Duration) {
+		failedAddrTTL = ttl
+	}(failedAddrTTL)
+	failedAddrTTL = -time.Second
+	addrs := downTestAddrs("2195", "192.0.2.1", "192.0.2.2")
+	defer forgetTestAddrs(addrs)
+
+	recentlyFailedAddrs.add(addrs[0])
+	if ordered := recentlyFailedAddrs.order(addrs); ordered[0] != addrs[0] {
+		t.Error(fmt.Sprintf("Expected an expired failure to be forgotten but got %v", ordered))
+	}
+
+	failedAddrTTL = time.Minute
+	recentlyFailedAddrs.add(addrs[0])
+	if ordered := recentlyFailedAddrs.order(addrs); ordered[0] != addrs[1] || ordered[1] != addrs[0] {
+		t.Error(fmt.Sprintf("Expected the failed address last but got %v", ordered))
+	}
+}
+
+func TestGatewayDNSHTTP2(t *testing.T) {
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer server.Close()
+	down := downTestAddrs(config.Port, "127.0.0.2")
+	defer forgetTestAddrs(down)
+
+	config.Resolver = staticTestResolver("127.0.0.2", config.Host)
+	conn, err := NewHTTP2Connection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := conn.Send(context.Background(), http2TestPayload())
+	if err != nil || !result.Accepted() {
+		t.Error(fmt.Sprintf("Expected to fail over to the server but got %v", err))
+	}
+	if ordered := recentlyFailedAddrs.order(append(down, server.Listener.Addr().String())); ordered[0] == down[0] {
+		t.Error("Expected the down address to be remembered")
+	}
+}
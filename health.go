@@ -0,0 +1,92 @@
+package apns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// How long data written to the binary gateway may go unacknowledged before
+// Ping reports the connection dead. Well under the LivenessTimeout default
+// so a health check notices before the connection is torn down
+const pingAckWindow = 5 * time.Second
+
+// Make the connection now rather than on the first Send, minting the
+// provider token with token auth, so the first payload doesn't wait on the
+// tcp and tls handshakes
+// Nothing is sent to a device. Returns an error if apple can't be reached
+// Safe to call concurrently with sends, it's a no-op once connected
+func (c *HTTP2Connection) Connect(ctx context.Context) error {
+	if c.tokens != nil {
+		if _, err := c.tokens.current(); err != nil {
+			return err
+		}
+	}
+	return c.probe(ctx)
+}
+
+// Check apple is reachable over the connection, e.g. for a health check
+// endpoint. net/http doesn't expose HTTP/2 PING frames, so this makes a
+// request apple answers without sending a notification, which travels the
+// same multiplexed connection as sends and reconnects it if it's dropped
+// Safe to call concurrently with sends
+func (c *HTTP2Connection) Ping(ctx context.Context) error {
+	return c.probe(ctx)
+}
+
+// Make a GET apple rejects, any response means the connection works
+func (c *HTTP2Connection) probe(ctx context.Context) error {
+	request, err := http.NewRequest(http.MethodGet, c.baseURL+"/3/device/", nil)
+	if err != nil {
+		return err
+	}
+	response, err := c.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Cannot reach apple: %v", err))
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	if response.ProtoMajor != 2 {
+		return errors.New(fmt.Sprintf("Expected apple to answer over HTTP/2 but got %v", response.Proto))
+	}
+	return nil
+}
+
+// The binary connection is made by NewAPNSConnection, so this only checks
+// it's still open and accepting payloads
+// Safe to call concurrently with sends
+func (c *APNSConnection) Connect(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-c.sendListenerDone:
+		return errors.New("Connection is closed")
+	case <-c.stopChannel:
+		return errors.New("Connection is shutting down")
+	default:
+	}
+	return nil
+}
+
+// Check the binary connection is open and, where the socket's tcp state
+// can be seen (see APNSConfig.LivenessTimeout), that the gateway has
+// acknowledged what was written to it recently. The binary protocol has
+// no ping of its own, and apple only writes back to report an error
+// Safe to call concurrently with sends
+func (c *APNSConnection) Ping(ctx context.Context) error {
+	if err := c.Connect(ctx); err != nil {
+		return err
+	}
+	if c.ackState == nil {
+		return nil
+	}
+	if unacked, sinceAck, ok := c.ackState(); ok && unacked && sinceAck >= pingAckWindow {
+		return errors.New(fmt.Sprintf("Gateway hasn't acknowledged data written to it for %v", sinceAck))
+	}
+	return nil
+}
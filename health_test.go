@@ -0,0 +1,82 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTP2ConnectShouldConnectWithoutSending(t *testing.T) {
+	server, _, app := newManagerTestApps(t)
+	conn, err := NewHTTP2Connection(app.HTTP2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if server.Connections() != 1 || len(server.Received()) != 0 {
+		t.Error(fmt.Sprintf("Expected 1 connection and nothing received but got %v and %v",
+			server.Connections(), server.Received()))
+	}
+
+	//pings and sends share the one connection
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := conn.Ping(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			if _, err := conn.Send(context.Background(), groupTestPayload(i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if server.Connections() != 1 || len(server.Received()) != 10 {
+		t.Error(fmt.Sprintf("Expected 1 connection and 10 notifications but got %v and %v",
+			server.Connections(), len(server.Received())))
+	}
+
+	server.Close()
+	if err := conn.Ping(context.Background()); err == nil || !strings.Contains(err.Error(), "Cannot reach apple") {
+		t.Error(fmt.Sprintf("Expected the ping to fail once the server closed but got %v", err))
+	}
+}
+
+func TestPingShouldCheckBinaryConnection(t *testing.T) {
+	_, app, _ := newManagerTestApps(t)
+	conn, err := NewAPNSConnection(app.Pool.ConnectionConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Connect(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if err := conn.Ping(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	//data the gateway hasn't acknowledged in a while
+	conn.ackState = func() (bool, time.Duration, bool) {
+		return true, 10 * time.Second, true
+	}
+	if err := conn.Ping(context.Background()); err == nil || !strings.Contains(err.Error(), "acknowledged") {
+		t.Error(fmt.Sprintf("Expected the ping to fail for unacknowledged data but got %v", err))
+	}
+
+	conn.Disconnect()
+	for range conn.CloseChannel {
+	}
+	if err := conn.Ping(context.Background()); err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Error(fmt.Sprintf("Expected the ping to fail once disconnected but got %v", err))
+	}
+}
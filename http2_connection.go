@@ -0,0 +1,713 @@
+package apns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Apple's HTTP/2 provider API
+	HTTP2ProductionHost = "api.push.apple.com"
+	// Apple's HTTP/2 provider API for development builds
+	HTTP2DevelopmentHost = "api.sandbox.push.apple.com"
+)
+
+// Config for creating an HTTP/2 connection to Apple's provider API
+// Authenticates with either a certificate (CertificateBytes and KeyBytes)
+// or a provider token signed with a .p8 auth key (AuthKeyBytes or
+// AuthKeyFile, KeyID and TeamID)
+type HTTP2Config struct {
+	// bytes for cert.pem, for certificate auth
+	CertificateBytes []byte
+	// bytes for key.pem, for certificate auth
+	KeyBytes []byte
+	// contents of the .p8 auth key, for token auth
+	AuthKeyBytes []byte
+	// path to the .p8 auth key, for token auth if AuthKeyBytes isn't set
+	AuthKeyFile string
+	// 10 character key id of the auth key, for token auth
+	KeyID string
+	// 10 character team id the auth key belongs to, for token auth
+	TeamID string
+	// topic (bundle id) for payloads without a Topic, defaults to the
+	// certificate's bundle id with certificate auth
+	Topic string
+	// apple host, defaults to apple's for Environment, HTTP2ProductionHost
+	Host string
+	// which of apple's environments to send to, selecting the host unless
+	// Host or GatewayAddr is set, defaults to EnvironmentProduction
+	Environment Environment
+	// optional host:port to send to, e.g. a test server or a relay, in
+	// place of Host and Port, which are set from it
+	GatewayAddr string
+	// apple port, defaults to "443"
+	Port string
+	// certificate authorities used to verify the host, defaults to the system roots
+	// only needed when connecting to a test server
+	RootCAs *x509.CertPool
+	// optional base64 SHA-256 SPKI fingerprints (see SPKIFingerprint),
+	// requests fail with a PinningError unless the host's verified chain
+	// includes one of them
+	PinnedPublicKeys []string
+	// optional TLS versions, cipher suites etc. (see TLSOptions), defaults
+	// to crypto/tls's
+	TLS *TLSOptions
+	// optional proxy to connect through, http:// or https:// for HTTP
+	// CONNECT or socks5://, with user:password@ for authentication,
+	// defaults to HTTPS_PROXY (respecting NO_PROXY)
+	ProxyURL string
+	// connect directly unless ProxyURL is set, ignoring HTTPS_PROXY
+	IgnoreProxyEnvironment bool
+	// optional function to resolve the host's addresses with, defaults to
+	// net.DefaultResolver.LookupHost
+	// each address is tried in turn, those that failed in the last minute
+	// after the others
+	Resolver func(ctx context.Context, host string) ([]string, error)
+	// number of milliseconds to wait for each of the host's addresses to
+	// connect, defaults to 3000
+	DialAttemptTimeout int
+	// max number of bytes allowed in payload, defaults to the payload's MaxPayloadSize
+	MaxPayloadSize int
+	// number of seconds to wait for each request, defaults to 30
+	RequestTimeout int
+	// number of times a payload apple throttles (429 or 503) is resent
+	// once the Retry-After passes, defaults to 3, -1 to never resend
+	MaxThrottleRetries int
+	// max number of times a payload is posted, counting the first along
+	// with resends after throttling and with a new provider token, before
+	// Send gives up with an *AttemptsExceededError, defaults to 0 (only
+	// MaxThrottleRetries limits resends)
+	MaxAttempts int
+	// number of milliseconds to pause for a 429 or 503 without a
+	// Retry-After, doubling for each resend of the payload, defaults to 1000
+	ThrottleBackoff int
+	// max number of seconds to pause for, however long Retry-After asks,
+	// defaults to 60
+	MaxRetryAfter int
+	// optional callback invoked on every 410 for a device token, with when
+	// apple last knew the token was valid (zero if apple didn't say) to
+	// compare with when it was registered before deleting it
+	// called on the goroutine calling Send, before Send returns
+	UnregisteredCallback func(token string, lastSeen time.Time, payload *Payload)
+	// optional check of each payload's token before it's posted, e.g.
+	// against a list of devices not to notify, an error fails Send with a
+	// *SendError of FailureFiltered (see TokenFilteredError)
+	// called once per payload, not again when it's resent, on the goroutine
+	// calling Send. Not called for channel broadcasts, which have no token
+	TokenFilter func(token string) error
+	// number of milliseconds after apple accepts a payload that an
+	// identical one (the same token, collapse id and Fingerprint) is
+	// dropped with a DuplicateError instead of being sent, shared by every
+	// connection made with this config, defaults to 0 for none
+	DedupeWindow int
+	// number of days before the certificate expires to start warning about
+	// it, defaults to 30
+	CertExpiryWarningDays int
+	// optional callback invoked when the certificate is within
+	// CertExpiryWarningDays of expiring, checked on creating the connection
+	// and then daily as payloads are sent, a warning is logged if not set
+	// called on the goroutine calling Send, before Send returns
+	CertExpiryCallback func(cert *x509.Certificate, expiresAt time.Time)
+	// optional collector of send events (see StatsCollector), defaults to
+	// NoopStatsCollector
+	StatsCollector StatsCollector
+	// optional tracer starting a span for each notification sent (see
+	// Tracer), its ctx is passed on to the request
+	Tracer Tracer
+	// source of time, overridden in tests
+	clock clock
+	// BeforeSend and AfterSend hooks of connections made with this config
+	hooks *middleware
+	// payloads accepted within DedupeWindow, shared by connections made
+	// with this config
+	dedupe *dedupeWindow
+}
+
+// What apple said about a payload sent over HTTP/2
+type Result struct {
+	// The payload that was sent
+	Payload *Payload
+	// HTTP status returned by apple, 200 if the notification was accepted
+	StatusCode int
+	// Id the notification was sent with (apns-id, or apns-request-id for a
+	// broadcast), Payload.ApnsId or the one generated for it
+	// The binary protocol has no ids, so from APNSConnection it's
+	// Payload.ApnsId as is
+	ApnsID string
+	// The apns-id apple returned, which should always be ApnsID
+	ResponseApnsID string
+	// apns-request-id apple returned for a broadcast (Payload.ChannelId)
+	RequestID string
+	// apns-unique-id, only returned by HTTP2DevelopmentHost. Look it up in
+	// the Push Notifications Console to trace delivery
+	UniqueID string
+	// Apple's reason for rejecting the notification, e.g. BadDeviceToken,
+	// or from APNSConnection the binary status, e.g. INVALID_TOKEN
+	Reason ErrorReason
+	// For a 410 (Unregistered), when apple last knew the token was valid
+	Timestamp time.Time
+	// The error apple responded with, for a rejection from APNSConnection
+	AppleError *AppleError
+	// Throttled attempts (429 or 503) before this response, oldest first
+	Throttled []ThrottleAttempt
+	// Number of times the payload was sent, 1 unless it was resent: after
+	// being throttled or with a new provider token, or from APNSConnection
+	// handed back by the connections before (see
+	// APNSReconnectingConnection)
+	Attempts int
+	// Why the notification couldn't be sent, only set by SendAll and for
+	// AfterSend hooks, in which case StatusCode is 0 unless apple responded
+	Err error
+	// Where the time went sending the payload over HTTP/2, from the
+	// request's httptrace hooks, zero from APNSConnection
+	Timing SendTiming
+	//Retry-After apple sent with a 429 or 503
+	retryAfter string
+	//When the request apple responded to was posted
+	postedAt time.Time
+}
+
+// Whether apple accepted the notification
+func (r *Result) Accepted() bool {
+	return r.StatusCode == http.StatusOK
+}
+
+// Whether apple returned a different apns-id to the one that was sent,
+// meaning the response can't be trusted to be for this notification
+func (r *Result) ApnsIDMismatch() bool {
+	return r.ResponseApnsID != "" && !strings.EqualFold(r.ResponseApnsID, r.ApnsID)
+}
+
+// HTTP/2 connection to Apple's provider API
+// Unlike APNSConnection every payload gets its own response, so Send
+// returns whether it was accepted. Safe for concurrent use, requests are
+// multiplexed over a single connection
+type HTTP2Connection struct {
+	//for PendingCount and InFlightCount, updated atomically so kept first
+	//for their alignment on 32 bit platforms
+	pending  int64
+	inFlight int64
+
+	config  *HTTP2Config
+	client  *http.Client
+	baseURL string
+	//nil with certificate auth
+	tokens *providerTokenSource
+	//HTTP2Config.Topic or the certificate's bundle id
+	defaultTopic string
+	//warns before the certificate expires, nil with token auth
+	certExpiry *certExpiryMonitor
+	//pauses apple asked for with 429s and 503s
+	throttle *throttle
+	//the config's BeforeSend and AfterSend hooks
+	hooks *middleware
+	//the config's payloads accepted within DedupeWindow, nil without one
+	dedupe *dedupeWindow
+}
+
+// Reasons apple gives for a provider token it won't accept
+const (
+	reasonExpiredProviderToken = "ExpiredProviderToken"
+	reasonInvalidProviderToken = "InvalidProviderToken"
+)
+
+// Create a new HTTP/2 connection with the supplied config
+// If invalid config an error will be returned
+// The connection is made on the first Send
+// See HTTP2Config object for defaults
+func NewHTTP2Connection(config *HTTP2Config) (*HTTP2Connection, error) {
+	errorStrs := ""
+
+	certAuth := config.CertificateBytes != nil || config.KeyBytes != nil
+	tokenAuth := config.AuthKeyBytes != nil || config.AuthKeyFile != "" || config.KeyID != "" || config.TeamID != ""
+	if certAuth && tokenAuth {
+		errorStrs += "Should use either certificate or token auth, not both\n"
+	} else if certAuth && (config.CertificateBytes == nil || config.KeyBytes == nil) {
+		errorStrs += "Invalid Key/Certificate bytes\n"
+	} else if tokenAuth && ((config.AuthKeyBytes == nil && config.AuthKeyFile == "") || config.KeyID == "" || config.TeamID == "") {
+		errorStrs += "Token auth needs an auth key (AuthKeyBytes or AuthKeyFile), KeyID and TeamID\n"
+	} else if !certAuth && !tokenAuth {
+		errorStrs += "Should supply a Key/Certificate or an auth key for token auth\n"
+	}
+	if config.MaxPayloadSize < 0 {
+		errorStrs += "Invalid MaxPayloadSize. Should be greater than 0.\n"
+	}
+	if config.RequestTimeout < 0 {
+		errorStrs += "Invalid RequestTimeout. Should be >= 0.\n"
+	}
+	if config.MaxThrottleRetries < -1 {
+		errorStrs += "Invalid MaxThrottleRetries. Should be >= -1.\n"
+	}
+	if config.MaxAttempts < 0 {
+		errorStrs += "Invalid MaxAttempts. Should be >= 0.\n"
+	}
+	if config.ThrottleBackoff < 0 || config.MaxRetryAfter < 0 {
+		errorStrs += "Invalid ThrottleBackoff or MaxRetryAfter. Should be >= 0.\n"
+	}
+	if config.CertExpiryWarningDays < 0 {
+		errorStrs += "Invalid CertExpiryWarningDays. Should be >= 0.\n"
+	}
+	if config.DialAttemptTimeout < 0 {
+		errorStrs += "Invalid DialAttemptTimeout. Should be >= 0.\n"
+	}
+	if config.DedupeWindow < 0 {
+		errorStrs += "Invalid DedupeWindow. Should be >= 0.\n"
+	}
+	errorStrs += validatePinnedPublicKeys(config.PinnedPublicKeys)
+	errorStrs += validateTLSOptions(config.TLS, config.PinnedPublicKeys)
+	errorStrs += validateProxyURL(config.ProxyURL)
+	errorStrs += validateEndpoint(config.Environment, http2Hosts, "GatewayAddr", config.GatewayAddr,
+		"Host", config.Host, "Port", config.Port)
+
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+
+	config.Host, config.Port = resolveEndpoint(config.Environment, http2Hosts,
+		config.GatewayAddr, config.Host, config.Port, "443")
+	if config.RequestTimeout == 0 {
+		config.RequestTimeout = 30
+	}
+	if config.MaxThrottleRetries == 0 {
+		config.MaxThrottleRetries = 3
+	}
+	if config.ThrottleBackoff == 0 {
+		config.ThrottleBackoff = 1000
+	}
+	if config.MaxRetryAfter == 0 {
+		config.MaxRetryAfter = 60
+	}
+	if config.CertExpiryWarningDays == 0 {
+		config.CertExpiryWarningDays = 30
+	}
+	if config.DialAttemptTimeout == 0 {
+		config.DialAttemptTimeout = defaultDialAttemptTimeout
+	}
+	if config.clock == nil {
+		config.clock = realClock{}
+	}
+	if config.StatsCollector == nil {
+		config.StatsCollector = NoopStatsCollector{}
+	}
+
+	tlsConf := newTLSConfig(config.TLS, config.Host, config.RootCAs, config.PinnedPublicKeys, nil)
+
+	c := &HTTP2Connection{
+		config:       config,
+		baseURL:      "https://" + net.JoinHostPort(config.Host, config.Port),
+		defaultTopic: config.Topic,
+		throttle:     newThrottle(config.clock),
+		hooks:        config.middleware(),
+		dedupe:       config.dedupeWindow(),
+	}
+	if certAuth {
+		x509Cert, err := loadKeyPair(config.CertificateBytes, config.KeyBytes)
+		if err != nil {
+			//failed to validate key pair
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{x509Cert}
+		certExpiry, err := newCertExpiryMonitor(x509Cert, config.CertExpiryWarningDays,
+			config.CertExpiryCallback, nil, config.clock)
+		if err != nil {
+			return nil, err
+		}
+		c.certExpiry = certExpiry
+		if c.defaultTopic == "" {
+			c.defaultTopic = topicFromCertificate(certExpiry.leaf)
+		}
+	} else {
+		keyPEM := config.AuthKeyBytes
+		if keyPEM == nil {
+			var err error
+			if keyPEM, err = ioutil.ReadFile(config.AuthKeyFile); err != nil {
+				return nil, err
+			}
+		}
+		tokens, err := newProviderTokenSource(keyPEM, config.KeyID, config.TeamID, config.clock)
+		if err != nil {
+			return nil, err
+		}
+		c.tokens = tokens
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig:   tlsConf,
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   time.Hour,
+	}
+	proxy, err := proxyForGateway(config.ProxyURL, config.IgnoreProxyEnvironment, config.Host, config.Port)
+	if err != nil {
+		return nil, err
+	}
+	//our own dial to fail over between the host's addresses, and with a
+	//proxy our own tunnel rather than Transport.Proxy to report a *ProxyAuthError
+	//the dns and dial phases go to the trace of the request dialing, and
+	//the transport's handshake is timed by its hooks
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, _ := net.SplitHostPort(addr)
+		timing := &ConnectTiming{}
+		dialStart := time.Now()
+		socket, err := dialGateway(ctx, gatewayAddr{
+			host:           host,
+			port:           port,
+			proxy:          proxy,
+			resolve:        config.Resolver,
+			attemptTimeout: time.Duration(config.DialAttemptTimeout) * time.Millisecond,
+		}, timing)
+		if err == nil {
+			dialRequestTrace(ctx).dialed(dialStart, timing)
+		}
+		return socket, err
+	}
+	c.client = &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(config.RequestTimeout) * time.Second,
+	}
+	return c, nil
+}
+
+// Send a payload, waiting for apple's response
+// A Result is returned whenever apple responds, check Result.Accepted to
+// see whether the notification was. An error is returned for a payload
+// that can't be marshaled or when the request fails
+// With token auth a request rejected for its provider token is retried
+// once with a newly signed token
+// A payload apple throttles (429 or 503) is resent once Retry-After passes,
+// meanwhile pausing every Send to the device for a 429, or every Send for
+// a 503. After MaxThrottleRetries the last Result is returned with a
+// *ThrottledError holding each attempt, or with an *AttemptsExceededError
+// once the payload has been posted MaxAttempts times
+// A payload with a ChannelId is broadcast to the channel's subscribers
+// instead of sent to a device
+func (c *HTTP2Connection) Send(ctx context.Context, payload *Payload) (result *Result, err error) {
+	sendStart := time.Now()
+	c.certExpiry.check()
+	ctx, trace := startTrace(c.config.Tracer, c.config.clock, ctx, payload)
+	defer func() {
+		trace.finish(result, err)
+		c.hooks.afterSend(payload, result, err, NoopLogger{})
+	}()
+	maxPayloadSize := c.config.MaxPayloadSize
+	if maxPayloadSize == 0 {
+		maxPayloadSize = payload.MaxPayloadSize()
+	}
+	if err := payload.Validate(); err != nil {
+		return nil, err
+	}
+	//the payload is left alone as it may be shared between goroutines
+	topic := payload.Topic
+	if topic == "" {
+		topic = c.defaultTopic
+	}
+	if topic == "" {
+		return nil, errors.New("No topic, set Payload.Topic or HTTP2Config.Topic")
+	}
+	if err := validateTopic(topic, payload.ResolvedPushType()); err != nil {
+		return nil, err
+	}
+	if payload.ChannelId == "" {
+		if err := filterToken(c.config.TokenFilter, payload.Token); err != nil {
+			sendError := &SendError{Payload: payload, Kind: FailureFiltered, Time: c.config.clock.Now(), Err: err}
+			c.config.StatsCollector.OnFailed(sendError)
+			return nil, sendError
+		}
+	}
+	if err := c.dedupe.check(payload); err != nil {
+		return nil, err
+	}
+	if err := c.hooks.beforeSend(payload); err != nil {
+		return nil, err
+	}
+	apnsId := payload.ApnsId
+	if apnsId == "" {
+		apnsId = NewApnsId()
+		trace.identify(apnsId)
+	}
+	payloadBytes, err := payload.Marshal(maxPayloadSize)
+	if err != nil {
+		return nil, err
+	}
+	trace.marshaled()
+	marshaledAt := time.Now()
+	defer func() {
+		c.timeSend(result, sendStart, marshaledAt)
+	}()
+	c.config.StatsCollector.OnEnqueued(payload)
+
+	//throttled per device token, or channel for a broadcast
+	device := payload.Token
+	if payload.ChannelId != "" {
+		device = payload.ChannelId
+	}
+	throttled := []ThrottleAttempt{}
+	failed := []SendAttempt{}
+	atomic.AddInt64(&c.pending, 1)
+	for {
+		if !c.throttle.wait(ctx, device) {
+			atomic.AddInt64(&c.pending, -1)
+			if len(throttled) == 0 {
+				return nil, ctx.Err()
+			}
+			return nil, &ThrottledError{Payload: payload, Attempts: throttled, Err: ctx.Err()}
+		}
+		trace.written(c.config.clock.Now())
+		atomic.AddInt64(&c.pending, -1)
+		atomic.AddInt64(&c.inFlight, 1)
+		result, err := c.authorizedPost(ctx, payload, payloadBytes, topic, apnsId, &failed)
+		atomic.AddInt64(&c.inFlight, -1)
+		if err != nil || !throttledStatus(result.StatusCode) {
+			if result != nil && len(throttled) > 0 {
+				result.Throttled = throttled
+			}
+			c.reportResult(result)
+			return result, err
+		}
+
+		attempt := c.throttle.pause(device, result, c.retryAfter(result.retryAfter, len(throttled)+1))
+		c.config.StatsCollector.OnThrottled(payload, attempt)
+		throttled = append(throttled, attempt)
+		failed = append(failed, c.failedAttempt(result))
+		if len(throttled) > c.config.MaxThrottleRetries {
+			c.throttle.record(false)
+			c.reportResult(result)
+			result.Throttled = throttled
+			return result, &ThrottledError{Payload: payload, Attempts: throttled}
+		}
+		if c.attemptsExceeded(failed) {
+			c.throttle.record(false)
+			c.reportResult(result)
+			result.Throttled = throttled
+			return result, &AttemptsExceededError{Payload: payload, MaxAttempts: c.config.MaxAttempts, Attempts: failed,
+				setting: "MaxAttempts"}
+		}
+		c.throttle.record(true)
+		atomic.AddInt64(&c.pending, 1)
+	}
+}
+
+// A response apple rejected a post with, to be resent
+func (c *HTTP2Connection) failedAttempt(result *Result) SendAttempt {
+	return SendAttempt{
+		Time:   c.config.clock.Now(),
+		Reason: result.Reason,
+		Err:    errors.New(fmt.Sprintf("Rejected by apple with status %v: %v", result.StatusCode, result.Reason)),
+	}
+}
+
+// Whether the payload has been posted MaxAttempts times, all failing
+func (c *HTTP2Connection) attemptsExceeded(failed []SendAttempt) bool {
+	return c.config.MaxAttempts > 0 && len(failed) >= c.config.MaxAttempts
+}
+
+// Post a payload with the current provider token, retrying once with a
+// newly signed token if apple rejects it, unless that's MaxAttempts
+// The Result counts the posts in failed, with the rejected one added
+func (c *HTTP2Connection) authorizedPost(ctx context.Context, payload *Payload, payloadBytes []byte, topic string, apnsId string, failed *[]SendAttempt) (*Result, error) {
+	providerToken := ""
+	if c.tokens != nil {
+		var err error
+		if providerToken, err = c.tokens.current(); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := c.post(ctx, payload, payloadBytes, topic, apnsId, providerToken)
+	if err != nil || c.tokens == nil || result.StatusCode != http.StatusForbidden ||
+		(result.Reason != reasonExpiredProviderToken && result.Reason != reasonInvalidProviderToken) {
+		if result != nil {
+			result.Attempts = len(*failed) + 1
+		}
+		return result, err
+	}
+	*failed = append(*failed, c.failedAttempt(result))
+	if c.attemptsExceeded(*failed) {
+		result.Attempts = len(*failed)
+		return result, &AttemptsExceededError{Payload: payload, MaxAttempts: c.config.MaxAttempts, Attempts: *failed,
+			setting: "MaxAttempts"}
+	}
+
+	if providerToken, err = c.tokens.refresh(providerToken); err != nil {
+		return nil, err
+	}
+	result, err = c.post(ctx, payload, payloadBytes, topic, apnsId, providerToken)
+	if result != nil {
+		result.Attempts = len(*failed) + 1
+	}
+	return result, err
+}
+
+// Send every payload concurrently and wait for all of the responses
+// Results are in the same order as payloads, with Err set for any payload
+// that couldn't be sent (e.g. it fails to marshal, or ctx is done) without
+// affecting the rest. Returns once every payload is resolved, with
+// ctx.Err() if ctx was done first
+func (c *HTTP2Connection) SendAll(ctx context.Context, payloads []*Payload) ([]Result, error) {
+	return c.SendAllWithOptions(ctx, payloads, BatchOptions{})
+}
+
+// Send every payload as SendAll does, with options, e.g. to drop
+// duplicates (see BatchOptions)
+func (c *HTTP2Connection) SendAllWithOptions(ctx context.Context, payloads []*Payload, options BatchOptions) ([]Result, error) {
+	results := make([]Result, len(payloads))
+	var originals []*Payload
+	if options.Dedupe {
+		originals = batchDuplicates(payloads)
+	}
+	wg := new(sync.WaitGroup)
+	for i, payload := range payloads {
+		if originals != nil && originals[i] != nil {
+			results[i] = Result{Payload: payload, Err: &DuplicateError{Payload: payload, Original: originals[i]}}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, payload *Payload) {
+			defer wg.Done()
+			result, err := c.Send(ctx, payload)
+			if err != nil {
+				results[i] = Result{Payload: payload, Err: err}
+				return
+			}
+			results[i] = *result
+		}(i, payload)
+	}
+	wg.Wait()
+	return results, ctx.Err()
+}
+
+func (c *HTTP2Connection) post(ctx context.Context, payload *Payload, payloadBytes []byte, topic string, apnsId string, providerToken string) (*Result, error) {
+	url := c.baseURL + "/3/device/" + payload.Token
+	if payload.ChannelId != "" {
+		url = c.baseURL + "/4/broadcasts/apps/" + bundleIdForTopic(topic, payload.ResolvedPushType())
+	}
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payloadBytes))
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	if payload.ChannelId != "" {
+		request.Header.Set("apns-channel-id", payload.ChannelId)
+		request.Header.Set("apns-request-id", apnsId)
+	} else {
+		request.Header.Set("apns-id", apnsId)
+	}
+	request.Header.Set("apns-topic", topic)
+	if providerToken != "" {
+		request.Header.Set("Authorization", "bearer "+providerToken)
+	}
+	if payload.ExpirationTime != 0 {
+		request.Header.Set("apns-expiration", strconv.FormatUint(uint64(payload.ExpirationTime), 10))
+	}
+	if payload.Priority != 0 {
+		request.Header.Set("apns-priority", strconv.Itoa(int(payload.Priority)))
+	}
+	request.Header.Set("apns-push-type", string(payload.ResolvedPushType()))
+	if payload.CollapseId != "" {
+		request.Header.Set("apns-collapse-id", payload.CollapseId)
+	}
+
+	ctx, requestTrace := newRequestTrace(request.Context())
+	response, err := c.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	c.config.StatsCollector.OnWritten(1, len(payloadBytes), time.Since(requestTrace.start))
+	timing := requestTrace.timing()
+	if timing.Connected != nil {
+		c.config.StatsCollector.OnConnected(*timing.Connected)
+	}
+
+	result := &Result{
+		Payload:        payload,
+		StatusCode:     response.StatusCode,
+		ApnsID:         apnsId,
+		ResponseApnsID: response.Header.Get("apns-id"),
+		UniqueID:       response.Header.Get("apns-unique-id"),
+		RequestID:      response.Header.Get("apns-request-id"),
+		Timing:         timing,
+		retryAfter:     response.Header.Get("Retry-After"),
+		postedAt:       requestTrace.start,
+	}
+	if response.StatusCode == http.StatusOK {
+		io.Copy(ioutil.Discard, response.Body)
+		return result, nil
+	}
+
+	body := struct {
+		Reason    ErrorReason `json:"reason"`
+		Timestamp int64       `json:"timestamp"`
+	}{}
+	err = json.NewDecoder(io.LimitReader(response.Body, 4096)).Decode(&body)
+	if err == nil {
+		result.Reason = body.Reason
+		if body.Timestamp != 0 {
+			//milliseconds since the epoch
+			result.Timestamp = time.Unix(0, body.Timestamp*int64(time.Millisecond))
+		}
+	}
+	//reported even if the body is invalid, so no unregistered token is missed
+	if response.StatusCode == http.StatusGone && payload.ChannelId == "" && c.config.UnregisteredCallback != nil {
+		c.config.UnregisteredCallback(payload.Token, result.Timestamp, payload)
+	}
+	if err != nil {
+		return result, errors.New(fmt.Sprintf("Invalid response from apple with status %v: %v", response.StatusCode, err))
+	}
+	return result, nil
+}
+
+// Report apple's verdict on a payload to the StatsCollector
+func (c *HTTP2Connection) reportResult(result *Result) {
+	if result == nil {
+		return
+	}
+	if result.Accepted() {
+		c.config.StatsCollector.OnAcknowledged(result.Payload)
+		c.dedupe.accept(result.Payload)
+		return
+	}
+	c.config.StatsCollector.OnFailed(&SendError{
+		Payload: result.Payload,
+		Kind:    FailureRejected,
+		Reason:  result.Reason,
+		Time:    c.config.clock.Now(),
+		Err:     errors.New(fmt.Sprintf("Rejected by apple with status %v: %v", result.StatusCode, result.Reason)),
+	})
+}
+
+// Host and port requests are sent to (see HTTP2Config.Environment and
+// GatewayAddr)
+func (c *HTTP2Connection) Endpoint() string {
+	return net.JoinHostPort(c.config.Host, c.config.Port)
+}
+
+// When the connection's certificate expires, zero with token auth
+func (c *HTTP2Connection) CertExpiresAt() time.Time {
+	return c.certExpiry.expiresAt()
+}
+
+// Topics the connection's certificate can send to, e.g. com.example.app
+// and com.example.app.voip, nil with token auth
+func (c *HTTP2Connection) CertTopics() []string {
+	return c.certExpiry.topics()
+}
+
+// Close any idle connections to apple
+func (c *HTTP2Connection) Close() {
+	c.client.Transport.(*http.Transport).CloseIdleConnections()
+}
@@ -0,0 +1,697 @@
+package apns
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An HTTP/2 test server and a token auth config pointing at it
+func newHTTP2TestServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *HTTP2Config) {
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	_, keyPEM := generateAuthKey(t)
+	return server, &HTTP2Config{
+		AuthKeyBytes: keyPEM,
+		KeyID:        "ABC123DEFG",
+		TeamID:       "DEF123GHIJ",
+		Topic:        "com.example.app",
+		Host:         host,
+		Port:         port,
+		RootCAs:      roots,
+	}
+}
+
+// A self signed client certificate and key pem, with bundleId as the
+// UID like apple's push certificates if set
+func generateTestClientCert(t *testing.T, bundleId string) ([]byte, []byte) {
+	key, keyPEM := generateAuthKey(t)
+	subject := pkix.Name{CommonName: "Apple Push Services: " + bundleId}
+	if bundleId != "" {
+		subject.ExtraNames = []pkix.AttributeTypeAndValue{{Type: oidUserID, Value: bundleId}}
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM
+}
+
+func http2TestPayload() *Payload {
+	return &Payload{
+		Token:     "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8d",
+		AlertText: "Testing this payload",
+	}
+}
+
+func TestHTTP2SendShouldPostPayload(t *testing.T) {
+	var received *http.Request
+	var body string
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.Header().Set("apns-id", r.Header.Get("apns-id"))
+	})
+	defer server.Close()
+
+	conn, err := NewHTTP2Connection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	p := http2TestPayload()
+	p.Priority = PriorityThrottled
+	p.ExpirationTime = 4000000000
+	p.PushType = PushTypeAlert
+	p.ApnsId = "EC1BF194-B3B2-424A-89A9-5A918A6E6B5C"
+	result, err := conn.Send(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.Accepted() || result.ApnsID != p.ApnsId || result.ApnsIDMismatch() || result.Payload != p {
+		t.Error(fmt.Sprintf("Unexpected result %+v", result))
+	}
+	if received.ProtoMajor != 2 {
+		t.Error(fmt.Sprintf("Expected HTTP/2 but got %v", received.Proto))
+	}
+	if received.Method != http.MethodPost || received.URL.Path != "/3/device/"+p.Token {
+		t.Error(fmt.Sprintf("Unexpected request %v %v", received.Method, received.URL.Path))
+	}
+	if body != `{"aps":{"alert":"Testing this payload"}}` {
+		t.Error(fmt.Sprintf("Unexpected body %v", body))
+	}
+	expectedHeaders := map[string]string{
+		"apns-priority":   "5",
+		"apns-expiration": "4000000000",
+		"apns-push-type":  "alert",
+		"apns-id":         "EC1BF194-B3B2-424A-89A9-5A918A6E6B5C",
+		"apns-topic":      "com.example.app",
+	}
+	for header, expected := range expectedHeaders {
+		if actual := received.Header.Get(header); actual != expected {
+			t.Error(fmt.Sprintf("Expected %v header %v but got %v", header, expected, actual))
+		}
+	}
+}
+
+func TestHTTP2SendShouldValidatePayload(t *testing.T) {
+	requests := make(chan bool, 1)
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests <- true
+	})
+	defer server.Close()
+
+	conn, err := NewHTTP2Connection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	p := http2TestPayload()
+	p.PushType = "notification"
+	if _, err := conn.Send(context.Background(), p); err == nil || !strings.Contains(err.Error(), "Unknown push type") {
+		t.Error(fmt.Sprintf("Expected an unknown push type to fail but got %v", err))
+	}
+	if len(requests) != 0 {
+		t.Error("Should not send an invalid payload")
+	}
+}
+
+func TestHTTP2SendShouldAttachProviderToken(t *testing.T) {
+	tokens := make(chan string, 10)
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		tokens <- r.Header.Get("Authorization")
+	})
+	defer server.Close()
+
+	key, _ := parseAuthKey(config.AuthKeyBytes)
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Send(context.Background(), http2TestPayload()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, second := <-tokens, <-tokens
+	if !strings.HasPrefix(first, "bearer ") || first != second {
+		t.Error(fmt.Sprintf("Expected the same bearer token on every request but got %v and %v", first, second))
+	}
+	header, claims := verifyProviderToken(t, strings.TrimPrefix(first, "bearer "), key)
+	if header["kid"] != "ABC123DEFG" || claims["iss"] != "DEF123GHIJ" {
+		t.Error(fmt.Sprintf("Unexpected token %v %v", header, claims))
+	}
+}
+
+func TestHTTP2ShouldRetryOnceWithNewProviderToken(t *testing.T) {
+	for _, reason := range []string{"ExpiredProviderToken", "InvalidProviderToken"} {
+		lock := new(sync.Mutex)
+		tokens := []string{}
+		rejectAll := false
+		server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			tokens = append(tokens, r.Header.Get("Authorization"))
+			if len(tokens) == 1 || rejectAll {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, `{"reason":%q}`, reason)
+			}
+		})
+
+		conn, _ := NewHTTP2Connection(config)
+		result, err := conn.Send(context.Background(), http2TestPayload())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Accepted() || len(tokens) != 2 || tokens[0] == tokens[1] {
+			t.Error(fmt.Sprintf("Expected a retry with a new token to be accepted but got %+v with tokens %v", result, tokens))
+		}
+
+		//only retried once
+		lock.Lock()
+		rejectAll = true
+		tokens = tokens[:0]
+		lock.Unlock()
+		result, err = conn.Send(context.Background(), http2TestPayload())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Accepted() || result.Reason != ErrorReason(reason) || len(tokens) != 2 {
+			t.Error(fmt.Sprintf("Expected a single retry and then the rejection but got %+v after %v requests", result, len(tokens)))
+		}
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestHTTP2RejectionShouldNotRetry(t *testing.T) {
+	requests := 0
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("apns-id", "EC1BF194-B3B2-424A-89A9-5A918A6E6B5C")
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprint(w, `{"reason":"Unregistered","timestamp":1700000000123}`)
+	})
+	defer server.Close()
+
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+	result, err := conn.Send(context.Background(), http2TestPayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Accepted() || result.StatusCode != http.StatusGone || result.Reason != "Unregistered" || requests != 1 {
+		t.Error(fmt.Sprintf("Unexpected result %+v after %v requests", result, requests))
+	}
+	if !result.Timestamp.Equal(time.Unix(1700000000, 123000000)) {
+		t.Error(fmt.Sprintf("Expected timestamp with milliseconds but got %v", result.Timestamp))
+	}
+}
+
+func TestHTTP2ShouldReportUnregisteredTokens(t *testing.T) {
+	bodies := []string{
+		`{"reason":"Unregistered","timestamp":1700000000123}`,
+		`{"reason":"Unregistered"}`,
+		`not json`,
+	}
+	requests := 0
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprint(w, bodies[requests])
+		requests++
+	})
+	defer server.Close()
+
+	type unregistered struct {
+		token    string
+		lastSeen time.Time
+		payload  *Payload
+	}
+	reported := []unregistered{}
+	config.UnregisteredCallback = func(token string, lastSeen time.Time, payload *Payload) {
+		reported = append(reported, unregistered{token, lastSeen, payload})
+	}
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+
+	payloads := []*Payload{groupTestPayload(0), groupTestPayload(1), groupTestPayload(2)}
+	for _, payload := range payloads {
+		conn.Send(context.Background(), payload)
+	}
+
+	if len(reported) != 3 {
+		t.Fatal(fmt.Sprintf("Expected every 410 to be reported but got %v", len(reported)))
+	}
+	expectedLastSeen := []time.Time{time.Unix(1700000000, 123000000), {}, {}}
+	for i, r := range reported {
+		if r.token != payloads[i].Token || r.payload != payloads[i] || !r.lastSeen.Equal(expectedLastSeen[i]) {
+			t.Error(fmt.Sprintf("Expected %v to be reported last seen %v but got %+v", payloads[i].Token, expectedLastSeen[i], r))
+		}
+	}
+}
+
+func TestHTTP2ShouldNotReportOtherRejectionsAsUnregistered(t *testing.T) {
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"reason":"BadDeviceToken"}`)
+	})
+	defer server.Close()
+
+	config.UnregisteredCallback = func(token string, lastSeen time.Time, payload *Payload) {
+		t.Error(fmt.Sprintf("Unexpected unregistered report for %v", token))
+	}
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+	conn.Send(context.Background(), http2TestPayload())
+}
+
+func TestHTTP2CertificateAuthShouldNotSendProviderToken(t *testing.T) {
+	authorization := "unset"
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	})
+	defer server.Close()
+
+	certPEM, keyPEM := generateTestClientCert(t, "com.example.app")
+	config.AuthKeyBytes, config.KeyID, config.TeamID, config.Topic = nil, "", "", ""
+	config.CertificateBytes, config.KeyBytes = certPEM, keyPEM
+	conn, err := NewHTTP2Connection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Send(context.Background(), http2TestPayload()); err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		t.Error(fmt.Sprintf("Expected no authorization header but got %v", authorization))
+	}
+}
+
+func TestHTTP2SendShouldFailForInvalidPayload(t *testing.T) {
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Should not send an invalid payload")
+	})
+	defer server.Close()
+
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+	p := http2TestPayload()
+	p.CustomFields = map[string]interface{}{"aps": 1}
+	if _, err := conn.Send(context.Background(), p); err == nil {
+		t.Error("Expected an error for a payload that can't be marshaled")
+	}
+}
+
+func TestHTTP2SendAllShouldReportEachPayload(t *testing.T) {
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "00") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"reason":"BadDeviceToken"}`)
+		}
+	})
+	defer server.Close()
+
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+	payloads := []*Payload{groupTestPayload(0), groupTestPayload(1), groupTestPayload(2)}
+	payloads[0].ExtraData = "user 0"
+	payloads[2].CustomFields = map[string]interface{}{"aps": 1}
+	results, err := conn.SendAll(context.Background(), payloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if results[0].Accepted() || results[0].Reason != "BadDeviceToken" || results[0].Payload.ExtraData != "user 0" {
+		t.Error(fmt.Sprintf("Expected the first payload to be rejected but got %+v", results[0]))
+	}
+	if results[1].Err != nil || !results[1].Accepted() || results[1].Payload != payloads[1] {
+		t.Error(fmt.Sprintf("Expected the second payload to be accepted but got %+v", results[1]))
+	}
+	if results[2].Err == nil || results[2].Payload != payloads[2] {
+		t.Error(fmt.Sprintf("Expected the third payload to fail to marshal but got %+v", results[2]))
+	}
+}
+
+func TestHTTP2ConfigValidation(t *testing.T) {
+	_, keyPEM := generateAuthKey(t)
+	configs := map[string]*HTTP2Config{
+		"no auth":          {},
+		"both auth":        {CertificateBytes: []byte("c"), KeyBytes: []byte("k"), AuthKeyBytes: keyPEM, KeyID: "k", TeamID: "t"},
+		"missing key id":   {AuthKeyBytes: keyPEM, TeamID: "t"},
+		"missing key":      {CertificateBytes: []byte("c")},
+		"negative timeout": {AuthKeyBytes: keyPEM, KeyID: "k", TeamID: "t", RequestTimeout: -1},
+		"bad auth key":     {AuthKeyBytes: []byte("not pem"), KeyID: "k", TeamID: "t"},
+		"missing key file": {AuthKeyFile: "/does/not/exist.p8", KeyID: "k", TeamID: "t"},
+		"negative retries": {AuthKeyBytes: keyPEM, KeyID: "k", TeamID: "t", MaxThrottleRetries: -2},
+		"negative backoff": {AuthKeyBytes: keyPEM, KeyID: "k", TeamID: "t", ThrottleBackoff: -1},
+	}
+	for name, config := range configs {
+		if _, err := NewHTTP2Connection(config); err == nil {
+			t.Error(fmt.Sprintf("Expected %v to be invalid", name))
+		}
+	}
+
+	config := &HTTP2Config{AuthKeyBytes: keyPEM, KeyID: "k", TeamID: "t"}
+	if _, err := NewHTTP2Connection(config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != HTTP2ProductionHost || config.Port != "443" || config.RequestTimeout != 30 {
+		t.Error(fmt.Sprintf("Unexpected defaults %+v", config))
+	}
+}
+
+func TestHTTP2SendShouldSetCollapseId(t *testing.T) {
+	collapseIds := make(chan []string, 10)
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		collapseIds <- r.Header.Values("apns-collapse-id")
+	})
+	defer server.Close()
+
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+
+	p := http2TestPayload()
+	conn.Send(context.Background(), p)
+	if ids := <-collapseIds; len(ids) != 0 {
+		t.Error(fmt.Sprintf("Expected no collapse id header but got %v", ids))
+	}
+
+	p.CollapseId = strings.Repeat("c", MaxCollapseIdLength)
+	if _, err := conn.Send(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if ids := <-collapseIds; len(ids) != 1 || ids[0] != p.CollapseId {
+		t.Error(fmt.Sprintf("Expected collapse id header %v but got %v", p.CollapseId, ids))
+	}
+
+	p.CollapseId += "c"
+	if _, err := conn.Send(context.Background(), p); err == nil {
+		t.Error("Expected a collapse id over the limit to be rejected before sending")
+	}
+	if len(collapseIds) != 0 {
+		t.Error("Expected the request not to be sent")
+	}
+}
+
+func TestHTTP2SendShouldDefaultPushType(t *testing.T) {
+	pushTypes := make(chan string, 10)
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		pushTypes <- r.Header.Get("apns-push-type")
+	})
+	defer server.Close()
+
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+
+	conn.Send(context.Background(), http2TestPayload())
+	background := &Payload{Token: http2TestPayload().Token, ContentAvailable: 1}
+	conn.Send(context.Background(), background)
+	if alert, background := <-pushTypes, <-pushTypes; alert != "alert" || background != "background" {
+		t.Error(fmt.Sprintf("Expected alert and background push types but got %v and %v", alert, background))
+	}
+}
+
+func TestHTTP2SendShouldGenerateApnsId(t *testing.T) {
+	apnsIds := make(chan string, 10)
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		apnsIds <- r.Header.Get("apns-id")
+		w.Header().Set("apns-id", r.Header.Get("apns-id"))
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"reason":"BadDeviceToken"}`)
+	})
+	defer server.Close()
+
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+
+	p := http2TestPayload()
+	first, err := conn.Send(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := conn.Send(context.Background(), p)
+
+	//the id comes back with errors too
+	if sent := <-apnsIds; first.ApnsID != sent || !isValidApnsId(sent) || first.Reason != "BadDeviceToken" {
+		t.Error(fmt.Sprintf("Expected result for generated id %v but got %+v", sent, first))
+	}
+	if second.ApnsID == first.ApnsID {
+		t.Error("Expected a new id for each send")
+	}
+	if p.ApnsId != "" {
+		t.Error("Expected the payload to be left alone")
+	}
+}
+
+func TestHTTP2ShouldSurfaceApnsIdMismatch(t *testing.T) {
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("apns-id", "00000000-0000-4000-8000-000000000000")
+	})
+	defer server.Close()
+
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+
+	p := http2TestPayload()
+	p.ApnsId = "EC1BF194-B3B2-424A-89A9-5A918A6E6B5C"
+	result, _ := conn.Send(context.Background(), p)
+	if !result.ApnsIDMismatch() || result.ResponseApnsID != "00000000-0000-4000-8000-000000000000" {
+		t.Error(fmt.Sprintf("Expected a mismatch to be reported but got %+v", result))
+	}
+
+	//case doesn't matter
+	result.ResponseApnsID = strings.ToLower(p.ApnsId)
+	if result.ApnsIDMismatch() {
+		t.Error("Expected ids differing only in case to match")
+	}
+
+	p.ApnsId = "not a uuid"
+	if _, err := conn.Send(context.Background(), p); err == nil {
+		t.Error("Expected an invalid apns id to be rejected before sending")
+	}
+}
+
+func TestHTTP2ShouldCaptureUniqueId(t *testing.T) {
+	uniqueId := ""
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if uniqueId != "" {
+			w.Header().Set("apns-unique-id", uniqueId)
+		}
+	})
+	defer server.Close()
+
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+
+	uniqueId = "a8f4b2c1-1d2e-4f3a-9b8c-7d6e5f4a3b2c"
+	result, err := conn.Send(context.Background(), http2TestPayload())
+	if err != nil || result.UniqueID != uniqueId {
+		t.Error(fmt.Sprintf("Expected unique id %v but got %+v, %v", uniqueId, result, err))
+	}
+
+	//production doesn't send one
+	uniqueId = ""
+	result, err = conn.Send(context.Background(), http2TestPayload())
+	if err != nil || result.UniqueID != "" {
+		t.Error(fmt.Sprintf("Expected no unique id but got %+v, %v", result, err))
+	}
+}
+
+func TestHTTP2SendShouldSetTopic(t *testing.T) {
+	topics := make(chan string, 10)
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		topics <- r.Header.Get("apns-topic")
+	})
+	defer server.Close()
+
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+
+	p := http2TestPayload()
+	if _, err := conn.Send(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if topic := <-topics; topic != config.Topic {
+		t.Error(fmt.Sprintf("Expected the default topic but got %q", topic))
+	}
+
+	p.Topic = "com.example.other.voip"
+	p.PushType = PushTypeVoIP
+	p.AlertText = ""
+	if _, err := conn.Send(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if topic := <-topics; topic != p.Topic {
+		t.Error(fmt.Sprintf("Expected the payload's topic but got %q", topic))
+	}
+
+	//the default topic doesn't suit a voip push
+	p.Topic = ""
+	if _, err := conn.Send(context.Background(), p); err == nil || !strings.Contains(err.Error(), ".voip") {
+		t.Error(fmt.Sprintf("Expected a voip push without the .voip suffix to fail but got %v", err))
+	}
+	if len(topics) != 0 {
+		t.Error("Should not send a push with the wrong topic")
+	}
+}
+
+func TestHTTP2ShouldDefaultTopicToCertificateBundleId(t *testing.T) {
+	topics := make(chan string, 10)
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		topics <- r.Header.Get("apns-topic")
+	})
+	defer server.Close()
+	config.AuthKeyBytes, config.KeyID, config.TeamID, config.Topic = nil, "", "", ""
+
+	config.CertificateBytes, config.KeyBytes = generateTestClientCert(t, "com.example.cert")
+	conn, err := NewHTTP2Connection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Send(context.Background(), http2TestPayload()); err != nil {
+		t.Fatal(err)
+	}
+	if topic := <-topics; topic != "com.example.cert" {
+		t.Error(fmt.Sprintf("Expected the certificate's bundle id but got %q", topic))
+	}
+
+	//no bundle id to fall back on
+	config.CertificateBytes, config.KeyBytes = generateTestClientCert(t, "")
+	conn, _ = NewHTTP2Connection(config)
+	defer conn.Close()
+	if _, err := conn.Send(context.Background(), http2TestPayload()); err == nil || !strings.Contains(err.Error(), "No topic") {
+		t.Error(fmt.Sprintf("Expected an error without a topic but got %v", err))
+	}
+}
+
+func TestHTTP2SendShouldPostLocationPush(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(b)
+	})
+	defer server.Close()
+
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+
+	p := &Payload{
+		Token:    "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8d",
+		PushType: PushTypeLocation,
+		Topic:    "com.example.app.location-query",
+		Priority: PriorityImmediate,
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Send(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	received := <-requests
+	headers := map[string]string{
+		"apns-push-type": "location",
+		"apns-topic":     "com.example.app.location-query",
+		"apns-priority":  "10",
+	}
+	for header, value := range headers {
+		if received.Header.Get(header) != value {
+			t.Error(fmt.Sprintf("Expected %v %q but got %q", header, value, received.Header.Get(header)))
+		}
+	}
+	if body := <-bodies; body != `{"aps":{}}` {
+		t.Error(fmt.Sprintf("Expected an empty aps but got %v", body))
+	}
+
+	p.Topic = "com.example.app"
+	if _, err := conn.Send(context.Background(), p); err == nil || !strings.Contains(err.Error(), ".location-query") {
+		t.Error(fmt.Sprintf("Expected a location push without the .location-query suffix to fail but got %v", err))
+	}
+}
+
+func TestHTTP2SendShouldBroadcastToChannel(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(b)
+		w.Header().Set("apns-request-id", r.Header.Get("apns-request-id"))
+	})
+	defer server.Close()
+
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+
+	p := &Payload{
+		ChannelId:    "dHN0LXNyY2gtY2hubA==",
+		Topic:        "com.example.app.push-type.liveactivity",
+		PushType:     PushTypeLiveActivity,
+		CustomFields: map[string]interface{}{"score": 3},
+	}
+	p.AlertBody.Title = "Score"
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	result, err := conn.Send(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := <-requests
+	if received.URL.Path != "/4/broadcasts/apps/com.example.app" {
+		t.Error(fmt.Sprintf("Expected the broadcast endpoint but got %v", received.URL.Path))
+	}
+	headers := map[string]string{
+		"apns-channel-id": p.ChannelId,
+		"apns-push-type":  "liveactivity",
+		"apns-topic":      p.Topic,
+		"apns-id":         "",
+	}
+	for header, value := range headers {
+		if received.Header.Get(header) != value {
+			t.Error(fmt.Sprintf("Expected %v %q but got %q", header, value, received.Header.Get(header)))
+		}
+	}
+	if body := <-bodies; body != `{"aps":{"alert":{"title":"Score"}},"score":3}` {
+		t.Error(fmt.Sprintf("Unexpected body %v", body))
+	}
+	if !result.Accepted() || result.RequestID == "" || result.RequestID != result.ApnsID {
+		t.Error(fmt.Sprintf("Expected the request id to come back but got %+v", result))
+	}
+
+	p.Token = "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8d"
+	if _, err := conn.Send(context.Background(), p); err == nil || !strings.Contains(err.Error(), "not both") {
+		t.Error(fmt.Sprintf("Expected a payload with a token and channel id to fail but got %v", err))
+	}
+}
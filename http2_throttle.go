@@ -0,0 +1,225 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// One attempt at sending a payload that apple throttled, see ThrottledError
+type ThrottleAttempt struct {
+	// When apple responded
+	Time time.Time
+	// 429 (too many requests for the device) or 503 (service unavailable)
+	StatusCode int
+	// Apple's reason, e.g. TooManyRequests
+	Reason ErrorReason
+	// How long sending was paused for, Retry-After or the backoff when
+	// apple didn't say
+	RetryAfter time.Duration
+}
+
+// A payload apple kept throttling, returned by Send once
+// MaxThrottleRetries resends have been throttled too, or ctx is done
+// while waiting to resend
+type ThrottledError struct {
+	// The payload that wasn't sent
+	Payload *Payload
+	// Every throttled attempt, oldest first
+	Attempts []ThrottleAttempt
+	// ctx.Err() if ctx was done while waiting
+	Err error
+}
+
+func (e *ThrottledError) Error() string {
+	last := e.Attempts[len(e.Attempts)-1]
+	message := fmt.Sprintf("%v throttled by apple %d times, last with status %d (%v)",
+		e.Payload, len(e.Attempts), last.StatusCode, last.Reason)
+	if e.Err != nil {
+		message += ": " + e.Err.Error()
+	}
+	return message
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return e.Err
+}
+
+// Whether apple is throttling an HTTP2Connection, see ThrottleStats
+type ThrottleStats struct {
+	// When the pause on every request ends, after a 503, zero if not paused
+	PausedUntil time.Time
+	// Number of devices (or broadcast channels) paused after a 429
+	ThrottledDevices int
+	// Number of 429 responses
+	TooManyRequests uint64
+	// Number of 503 responses
+	ServiceUnavailable uint64
+	// Number of payloads resent after being throttled
+	Retries uint64
+	// Number of payloads given up on, see ThrottledError
+	Failed uint64
+}
+
+// Whether every request is currently paused
+func (s ThrottleStats) Throttled() bool {
+	return !s.PausedUntil.IsZero()
+}
+
+// The pauses apple has asked for, shared by every Send on a connection
+type throttle struct {
+	lock  *sync.Mutex
+	clock clock
+	//pause on every request, after a 503
+	until time.Time
+	//pauses per device token, or channel id for a broadcast, after a 429
+	devices map[string]time.Time
+
+	tooManyRequests    uint64
+	serviceUnavailable uint64
+	retries            uint64
+	failed             uint64
+}
+
+func newThrottle(clock clock) *throttle {
+	return &throttle{
+		lock:    new(sync.Mutex),
+		clock:   clock,
+		devices: make(map[string]time.Time),
+	}
+}
+
+// Whether apple throttled the request, so it can be resent later
+func throttledStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// How long a Retry-After header asks to wait, either a number of seconds
+// or an HTTP-date, false if it's missing or neither
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseUint(header, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	at, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+	if wait := at.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// Wait out any pause on the connection or the device, false if ctx is
+// done first
+func (t *throttle) wait(ctx context.Context, device string) bool {
+	for {
+		t.lock.Lock()
+		now := t.clock.Now()
+		until := t.until
+		if deviceUntil := t.devices[device]; deviceUntil.After(until) {
+			until = deviceUntil
+		}
+		t.lock.Unlock()
+		if !until.After(now) {
+			return true
+		}
+		select {
+		case <-t.clock.After(until.Sub(now)):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Pause the device for a 429 or the connection for a 503 (or for a 429
+// over provider token updates, which isn't about the device) for
+// retryAfter
+func (t *throttle) pause(device string, result *Result, retryAfter time.Duration) ThrottleAttempt {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.clock.Now()
+	until := now.Add(retryAfter)
+	if result.StatusCode == http.StatusServiceUnavailable || result.Reason == ReasonTooManyProviderTokenUpdates {
+		if until.After(t.until) {
+			t.until = until
+		}
+	} else if until.After(t.devices[device]) {
+		t.devices[device] = until
+	}
+	if result.StatusCode == http.StatusServiceUnavailable {
+		t.serviceUnavailable++
+	} else {
+		t.tooManyRequests++
+	}
+	t.prune(now)
+	return ThrottleAttempt{
+		Time:       now,
+		StatusCode: result.StatusCode,
+		Reason:     result.Reason,
+		RetryAfter: retryAfter,
+	}
+}
+
+// Forget pauses that have ended, called with the lock held
+func (t *throttle) prune(now time.Time) {
+	if !t.until.After(now) {
+		t.until = time.Time{}
+	}
+	for device, until := range t.devices {
+		if !until.After(now) {
+			delete(t.devices, device)
+		}
+	}
+}
+
+func (t *throttle) record(retried bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if retried {
+		t.retries++
+	} else {
+		t.failed++
+	}
+}
+
+// How long to pause for a throttled response: its Retry-After, or the
+// backoff doubled for each attempt if apple didn't say, capped at max
+func (c *HTTP2Connection) retryAfter(header string, attempt int) time.Duration {
+	max := time.Duration(c.config.MaxRetryAfter) * time.Second
+	wait, ok := parseRetryAfter(header, c.config.clock.Now())
+	if !ok {
+		wait = time.Duration(c.config.ThrottleBackoff) * time.Millisecond
+		for i := 1; i < attempt && wait < max; i++ {
+			wait *= 2
+		}
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// Current throttling by apple, safe to call from any goroutine
+func (c *HTTP2Connection) ThrottleStats() ThrottleStats {
+	t := c.throttle
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.prune(t.clock.Now())
+	return ThrottleStats{
+		PausedUntil:        t.until,
+		ThrottledDevices:   len(t.devices),
+		TooManyRequests:    t.tooManyRequests,
+		ServiceUnavailable: t.serviceUnavailable,
+		Retries:            t.retries,
+		Failed:             t.failed,
+	}
+}
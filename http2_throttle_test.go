@@ -0,0 +1,187 @@
+package apns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		header string
+		wait   time.Duration
+		ok     bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"", 0, false},
+		{"-5", 0, false},
+		{"soon", 0, false},
+	}
+	for _, test := range tests {
+		if wait, ok := parseRetryAfter(test.header, now); wait != test.wait || ok != test.ok {
+			t.Error(fmt.Sprintf("Expected %q to be %v, %v but got %v, %v", test.header, test.wait, test.ok, wait, ok))
+		}
+	}
+}
+
+// A connection to a server answering each request with the next of
+// responses (a status and Retry-After), then 200s
+func throttleTestConnection(t *testing.T, responses ...[2]string) (*HTTP2Connection, *fakeClock, func() []string, func()) {
+	lock := new(sync.Mutex)
+	tokens := []string{}
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		tokens = append(tokens, r.URL.Path[len("/3/device/"):])
+		if len(responses) == 0 {
+			return
+		}
+		response := responses[0]
+		responses = responses[1:]
+		if response[1] != "" {
+			w.Header().Set("Retry-After", response[1])
+		}
+		if response[0] == "503" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"reason":"ServiceUnavailable"}`)
+		} else {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"reason":"TooManyRequests"}`)
+		}
+	})
+	clock := newFakeClock()
+	config.clock = clock
+	config.MaxThrottleRetries = 2
+	conn, err := NewHTTP2Connection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requested := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, tokens...)
+	}
+	return conn, clock, requested, func() {
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestHTTP2ShouldRetryAfterServiceUnavailable(t *testing.T) {
+	conn, clock, requested, closeAll := throttleTestConnection(t, [2]string{"503", "5"})
+	defer closeAll()
+	start := clock.Now()
+
+	result, err := conn.Send(context.Background(), http2TestPayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Accepted() || len(requested()) != 2 || len(result.Throttled) != 1 {
+		t.Fatal(fmt.Sprintf("Expected the payload to be resent and accepted but got %+v", result))
+	}
+	if attempt := result.Throttled[0]; attempt.StatusCode != http.StatusServiceUnavailable ||
+		attempt.Reason != ReasonServiceUnavailable || attempt.RetryAfter != 5*time.Second {
+		t.Error(fmt.Sprintf("Unexpected attempt %+v", attempt))
+	}
+	if waited := clock.Now().Sub(start); waited != 5*time.Second {
+		t.Error(fmt.Sprintf("Expected to wait out the Retry-After but waited %v", waited))
+	}
+	stats := conn.ThrottleStats()
+	if stats.Throttled() || stats.ServiceUnavailable != 1 || stats.Retries != 1 || stats.Failed != 0 {
+		t.Error(fmt.Sprintf("Unexpected stats %+v", stats))
+	}
+}
+
+func TestHTTP2TooManyRequestsShouldOnlyPauseTheDevice(t *testing.T) {
+	conn, clock, requested, closeAll := throttleTestConnection(t, [2]string{"429", "30"})
+	defer closeAll()
+	conn.config.MaxThrottleRetries = -1
+	start := clock.Now()
+
+	throttled := http2TestPayload()
+	result, err := conn.Send(context.Background(), throttled)
+	throttledError := &ThrottledError{}
+	if !errors.As(err, &throttledError) || throttledError.Payload != throttled || len(throttledError.Attempts) != 1 ||
+		result.StatusCode != http.StatusTooManyRequests {
+		t.Fatal(fmt.Sprintf("Expected the payload not to be resent but got %+v, %v", result, err))
+	}
+	stats := conn.ThrottleStats()
+	if stats.Throttled() || stats.ThrottledDevices != 1 || stats.TooManyRequests != 1 || stats.Failed != 1 {
+		t.Error(fmt.Sprintf("Expected only the device to be paused but got %+v", stats))
+	}
+
+	//another device goes straight through
+	other := http2TestPayload()
+	other.Token = "5ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8d"
+	if result, err := conn.Send(context.Background(), other); err != nil || !result.Accepted() || !clock.Now().Equal(start) {
+		t.Error(fmt.Sprintf("Expected another device not to wait but got %+v, %v after %v", result, err, clock.Now().Sub(start)))
+	}
+
+	//the throttled device waits out the pause
+	if result, err := conn.Send(context.Background(), throttled); err != nil || !result.Accepted() {
+		t.Error(fmt.Sprintf("Expected the device to be sent to again but got %+v, %v", result, err))
+	}
+	if waited := clock.Now().Sub(start); waited != 30*time.Second || len(requested()) != 3 {
+		t.Error(fmt.Sprintf("Expected to wait 30s but waited %v with %v requests", waited, requested()))
+	}
+	if stats := conn.ThrottleStats(); stats.ThrottledDevices != 0 {
+		t.Error(fmt.Sprintf("Expected the pause to be over but got %+v", stats))
+	}
+}
+
+func TestHTTP2ThrottlingShouldBeReportedToTheStatsCollector(t *testing.T) {
+	conn, _, _, closeAll := throttleTestConnection(t, [2]string{"429", "30"}, [2]string{"503", ""})
+	defer closeAll()
+	conn.config.ThrottleBackoff = 500
+	stats := NewMemoryStatsCollector()
+	conn.config.StatsCollector = stats
+
+	if result, err := conn.Send(context.Background(), http2TestPayload()); err != nil || !result.Accepted() {
+		t.Fatal(fmt.Sprintf("Expected the payload to be resent and accepted but got %+v, %v", result, err))
+	}
+	snapshot := stats.Snapshot()
+	if snapshot.Throttled[http.StatusTooManyRequests] != 1 || snapshot.Throttled[http.StatusServiceUnavailable] != 1 ||
+		snapshot.ThrottledFor != 30*time.Second+time.Second || snapshot.Acknowledged != 1 || snapshot.Failed != 0 {
+		t.Error(fmt.Sprintf("Expected the 429's Retry-After and the 503's backoff to be reported but got %+v", snapshot))
+	}
+}
+
+func TestHTTP2ShouldGiveUpAfterMaxThrottleRetries(t *testing.T) {
+	date := newFakeClock().Now().Add(10 * time.Second).Format(http.TimeFormat)
+	//no Retry-After backs off, a long one is capped at MaxRetryAfter
+	conn, clock, requested, closeAll := throttleTestConnection(t,
+		[2]string{"503", date}, [2]string{"429", ""}, [2]string{"503", "3600"})
+	defer closeAll()
+	start := clock.Now()
+
+	payload := http2TestPayload()
+	result, err := conn.Send(context.Background(), payload)
+	throttledError := &ThrottledError{}
+	if !errors.As(err, &throttledError) || throttledError.Payload != payload || len(requested()) != 3 {
+		t.Fatal(fmt.Sprintf("Expected the payload to be given up on but got %v after %v requests", err, len(requested())))
+	}
+	waits := []time.Duration{}
+	for _, attempt := range throttledError.Attempts {
+		waits = append(waits, attempt.RetryAfter)
+	}
+	expected := []time.Duration{10 * time.Second, 2 * time.Second, time.Minute}
+	if fmt.Sprint(waits) != fmt.Sprint(expected) || len(result.Throttled) != 3 {
+		t.Error(fmt.Sprintf("Expected waits of %v but got %v", expected, waits))
+	}
+
+	stats := conn.ThrottleStats()
+	if !stats.Throttled() || !stats.PausedUntil.Equal(clock.Now().Add(time.Minute)) || stats.Retries != 2 || stats.Failed != 1 {
+		t.Error(fmt.Sprintf("Expected the connection to be paused but got %+v", stats))
+	}
+	if waited := clock.Now().Sub(start); waited != 12*time.Second {
+		t.Error(fmt.Sprintf("Expected to wait 12s but waited %v", waited))
+	}
+}
@@ -0,0 +1,126 @@
+package apns
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Phases of an HTTP/2 request, timed by the httptrace.ClientTrace of its
+// ctx. The transport calls the hooks from its own goroutines, so they're
+// locked
+type requestTrace struct {
+	lock                                    *sync.Mutex
+	start, gotConn, wroteRequest, firstByte time.Time
+	handshakeStart                          time.Time
+	//the connection dialed for the request, nil if it reused one
+	connected *ConnectTiming
+	dialStart time.Time
+}
+
+type requestTraceKey struct{}
+
+// ctx for a request, timing it with the returned requestTrace from now
+func newRequestTrace(ctx context.Context) (context.Context, *requestTrace) {
+	trace := &requestTrace{lock: new(sync.Mutex), start: time.Now()}
+	ctx = context.WithValue(ctx, requestTraceKey{}, trace)
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			trace.mark(&trace.gotConn)
+		},
+		TLSHandshakeStart: func() {
+			trace.mark(&trace.handshakeStart)
+		},
+		TLSHandshakeDone: trace.handshakeDone,
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			trace.mark(&trace.wroteRequest)
+		},
+		GotFirstResponseByte: func() {
+			trace.mark(&trace.firstByte)
+		},
+	}), trace
+}
+
+// The requestTrace of the request a dial is for, nil if none
+// The transport dials with a ctx keeping the request's values
+func dialRequestTrace(ctx context.Context) *requestTrace {
+	trace, _ := ctx.Value(requestTraceKey{}).(*requestTrace)
+	return trace
+}
+
+func (t *requestTrace) mark(at *time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	*at = time.Now()
+}
+
+// Record the dns and dial phases of the connection dialed for the
+// request, started at dialStart. Safe to call on a nil trace
+func (t *requestTrace) dialed(dialStart time.Time, timing *ConnectTiming) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.dialStart = dialStart
+	t.connected = timing
+}
+
+func (t *requestTrace) handshakeDone(state tls.ConnectionState, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err != nil || t.connected == nil {
+		return
+	}
+	now := time.Now()
+	t.connected.Handshake = now.Sub(t.handshakeStart)
+	t.connected.Total = now.Sub(t.dialStart)
+	t.connected.Resumed = state.DidResume
+}
+
+// The request's phases once apple responded, Connect, Write and FirstByte
+// adding up to Total, a phase whose hook wasn't called taking no time
+func (t *requestTrace) timing() SendTiming {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	end := t.firstByte
+	if end.IsZero() {
+		end = time.Now()
+	}
+	gotConn := laterOf(t.gotConn, t.start)
+	wroteRequest := laterOf(t.wroteRequest, gotConn)
+	timing := SendTiming{
+		Connect:   gotConn.Sub(t.start),
+		Write:     wroteRequest.Sub(gotConn),
+		FirstByte: end.Sub(wroteRequest),
+		Total:     end.Sub(t.start),
+	}
+	if t.connected != nil {
+		connected := *t.connected
+		timing.Connected = &connected
+	}
+	return timing
+}
+
+func laterOf(at time.Time, earliest time.Time) time.Time {
+	if at.Before(earliest) {
+		return earliest
+	}
+	return at
+}
+
+// Fill in the phases of Send before the last post of the payload apple
+// responded to, from Send being called at sendStart and the payload
+// being marshaled at marshaledAt, and report them to the StatsCollector
+// Safe to call with a nil result
+func (c *HTTP2Connection) timeSend(result *Result, sendStart time.Time, marshaledAt time.Time) {
+	if result == nil || result.postedAt.IsZero() {
+		return
+	}
+	result.Timing.Marshal = marshaledAt.Sub(sendStart)
+	result.Timing.Wait = result.postedAt.Sub(marshaledAt)
+	result.Timing.Total += result.Timing.Marshal + result.Timing.Wait
+	c.config.StatsCollector.OnSendTiming(result.Timing)
+}
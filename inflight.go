@@ -0,0 +1,84 @@
+package apns
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// How often the in flight buffer is checked for expired payloads, at most
+const expiredSweepInterval = time.Second
+
+// Snapshot of a connection's in flight buffer, the payloads kept so those
+// written after one apple rejects can be handed back as unsent
+// Apple only reports the payload it rejected, so the buffer must reach
+// back to it for the rest to be found: a rejection of a payload more than
+// Capacity payloads ago comes back with UnsentPayloadBufferOverflow set
+type InFlightBufferState struct {
+	// Number of payloads in the buffer
+	Len int
+	// Most payloads the buffer holds (see APNSConfig.InFlightPayloadBufferSize)
+	Capacity int
+	// Number of payloads pushed out of a full buffer
+	Evicted uint64
+	// Number of payloads removed once their ExpirationTime passed, as
+	// there's no point resending them
+	Expired uint64
+}
+
+// Current state of the connection's in flight buffer
+// Safe to call from any goroutine
+func (c *APNSConnection) InFlightBufferState() InFlightBufferState {
+	return InFlightBufferState{
+		Len:      int(atomic.LoadInt64(&c.inFlightLen)),
+		Capacity: c.config.InFlightPayloadBufferSize,
+		Evicted:  atomic.LoadUint64(&c.inFlightEvicted),
+		Expired:  atomic.LoadUint64(&c.inFlightExpired),
+	}
+}
+
+// Whether a payload's ExpirationTime has passed
+// ExpireImmediately isn't a deadline, it asks apple not to store the
+// notification, so such payloads never expire here
+func payloadExpired(payload *Payload, now time.Time) bool {
+	if payload.ExpirationTime == ExpireImmediately {
+		return false
+	}
+	expiration, ok := payload.Expiration()
+	return ok && now.After(expiration)
+}
+
+// Remove payloads whose ExpirationTime has passed from the in flight
+// buffer, reporting each to ExpiredPayloadCallback
+// Checks at most once per expiredSweepInterval, called on the send
+// go-routine before tracking a new payload
+func (c *APNSConnection) evictExpired() {
+	now := c.config.clock.Now()
+	if now.Sub(c.lastExpiredSweep) < expiredSweepInterval {
+		return
+	}
+	c.lastExpiredSweep = now
+
+	for e := c.inFlightPayloadBuffer.Front(); e != nil; {
+		next := e.Next()
+		idPayloadObj := e.Value.(*idPayload)
+		if payloadExpired(idPayloadObj.Payload, now) {
+			c.inFlightPayloadBuffer.Remove(e)
+			c.evicted(idPayloadObj)
+			atomic.AddUint64(&c.inFlightExpired, 1)
+			if c.config.ExpiredPayloadCallback != nil {
+				c.config.ExpiredPayloadCallback(idPayloadObj.Payload)
+			}
+		}
+		e = next
+	}
+	atomic.StoreInt64(&c.inFlightLen, int64(c.inFlightPayloadBuffer.Len()))
+}
+
+// Stop tracking a payload removed from the in flight buffer
+// It can no longer be resent, so it's acked if stored
+func (c *APNSConnection) evicted(idPayloadObj *idPayload) {
+	c.journal.ack(idPayloadObj.Payload)
+	if idPayloadObj.group != nil && idPayloadObj.group.evict() {
+		delete(c.groups, idPayloadObj.group)
+	}
+}
@@ -0,0 +1,120 @@
+package apns
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func inFlightTestConnection(bufferSize int) (*APNSConnection, *poolTestSocket, *fakeClock) {
+	clock := newFakeClock()
+	//expirations are checked against the real time when framing
+	clock.now = time.Now().Truncate(time.Second)
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	config.InFlightPayloadBufferSize = bufferSize
+	config.clock = clock
+	return socketAPNSConnection(socket, config), socket, clock
+}
+
+func expiringTestPayload(i int, expiration time.Time) *Payload {
+	payload := groupTestPayload(i)
+	payload.ExpirationTime = uint32(expiration.Unix())
+	return payload
+}
+
+func TestInFlightShouldEvictExpiredPayloads(t *testing.T) {
+	conn, socket, clock := inFlightTestConnection(100)
+	expired := []*Payload{}
+	conn.config.ExpiredPayloadCallback = func(payload *Payload) {
+		expired = append(expired, payload)
+	}
+	start := clock.Now()
+
+	past := expiringTestPayload(0, start.Add(-time.Second))
+	boundary := expiringTestPayload(1, start.Add(time.Second))
+	immediate := groupTestPayload(3)
+	immediate.ExpirationTime = ExpireImmediately
+	payloads := []*Payload{past, boundary, groupTestPayload(2), immediate}
+	for i, payload := range payloads {
+		conn.SendChannel <- payload
+		waitForSocketSends(t, socket, i+1)
+	}
+
+	//expiring right now isn't expired yet
+	<-clock.After(time.Second)
+	conn.SendChannel <- groupTestPayload(4)
+	waitForSocketSends(t, socket, 5)
+	state := conn.InFlightBufferState()
+	if state.Len != 4 || state.Expired != 1 || len(expired) != 1 || expired[0] != past {
+		t.Error(fmt.Sprintf("Expected only the past payload to be evicted but got %+v, %v", state, expired))
+	}
+
+	<-clock.After(time.Second)
+	conn.SendChannel <- groupTestPayload(5)
+	waitForSocketSends(t, socket, 6)
+	state = conn.InFlightBufferState()
+	if state.Len != 4 || state.Expired != 2 || state.Evicted != 0 || len(expired) != 2 || expired[1] != boundary {
+		t.Error(fmt.Sprintf("Expected the boundary payload to be evicted a second later but got %+v, %v", state, expired))
+	}
+
+	//rejecting the payload without an expiration hands back those after
+	//it, leaving out the expired ones
+	socket.reject(8, 2)
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.ErrorPayload != payloads[2] || connectionClose.UnsentPayloadBufferOverflow {
+		t.Error(fmt.Sprintf("Expected the rejected payload to be found but got %v", connectionClose))
+	}
+	unsent := connectionClose.UnsentPayloads
+	if unsent.Len() != 3 || unsent.Front().Value != immediate {
+		t.Error(fmt.Sprintf("Expected the three payloads after it to be unsent but got %v", connectionClose))
+	}
+}
+
+func TestInFlightShouldOnlyCheckExpiryEverySecond(t *testing.T) {
+	conn, socket, clock := inFlightTestConnection(100)
+	conn.SendChannel <- expiringTestPayload(0, clock.Now())
+	waitForSocketSends(t, socket, 1)
+
+	<-clock.After(500 * time.Millisecond)
+	conn.SendChannel <- groupTestPayload(1)
+	waitForSocketSends(t, socket, 2)
+	if state := conn.InFlightBufferState(); state.Expired != 0 {
+		t.Error(fmt.Sprintf("Expected no check within a second of the last but got %+v", state))
+	}
+
+	<-clock.After(500 * time.Millisecond)
+	conn.SendChannel <- groupTestPayload(2)
+	waitForSocketSends(t, socket, 3)
+	if state := conn.InFlightBufferState(); state.Expired != 1 || state.Len != 2 {
+		t.Error(fmt.Sprintf("Expected the expired payload to be evicted but got %+v", state))
+	}
+
+	conn.Disconnect()
+	<-conn.CloseChannel
+}
+
+func TestInFlightShouldReachBackBufferSizePayloads(t *testing.T) {
+	for _, sent := range []int{3, 4} {
+		conn, socket, _ := inFlightTestConnection(3)
+		for i := 0; i < sent; i++ {
+			conn.SendChannel <- groupTestPayload(i)
+		}
+		waitForSocketSends(t, socket, sent)
+		state := conn.InFlightBufferState()
+		if state.Len != 3 || state.Capacity != 3 || state.Evicted != uint64(sent-3) {
+			t.Error(fmt.Sprintf("Expected a full buffer after %v payloads but got %+v", sent, state))
+		}
+
+		socket.reject(8, 0)
+		connectionClose := <-conn.CloseChannel
+		if sent == 3 && (connectionClose.ErrorPayload == nil || connectionClose.UnsentPayloads.Len() != 2 ||
+			connectionClose.UnsentPayloadBufferOverflow) {
+			t.Error(fmt.Sprintf("Expected the first payload to still be in the buffer but got %v", connectionClose))
+		}
+		if sent == 4 && (connectionClose.ErrorPayload != nil || connectionClose.UnsentPayloads.Len() != 3 ||
+			!connectionClose.UnsentPayloadBufferOverflow) {
+			t.Error(fmt.Sprintf("Expected the first payload to have been evicted but got %v", connectionClose))
+		}
+	}
+}
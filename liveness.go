@@ -0,0 +1,50 @@
+package apns
+
+import (
+	"net"
+	"time"
+)
+
+// Whether a connection has written data the gateway hasn't acknowledged,
+// and how long ago the gateway last acknowledged anything
+// ok is false if the socket can't tell, e.g. it isn't tcp or the os isn't
+// supported
+type ackStateFunc func() (unacked bool, sinceAck time.Duration, ok bool)
+
+// The ack state of socket's tcp connection, nil if it has none we can see
+// (through a proxy, a custom Dialer's own connection type or on an os
+// without TCP_INFO)
+func socketAckState(socket net.Conn) ackStateFunc {
+	tcpSocket, ok := socket.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return tcpAckState(tcpSocket)
+}
+
+// go-routine tearing the connection down once written data has gone
+// unacknowledged for window, as happens when a NAT or firewall silently
+// drops the connection and writes would otherwise keep succeeding into the
+// send buffer for minutes
+// Everything still in the in flight buffer is handed back in the
+// ConnectionClose, so what was written into the dead connection is resent
+// rather than assumed delivered
+func (c *APNSConnection) livenessMonitor(window time.Duration, ackState ackStateFunc) {
+	interval := window / 4
+	for {
+		select {
+		case <-c.config.clock.After(interval):
+		case <-c.sendListenerDone:
+			return
+		}
+		unacked, sinceAck, ok := ackState()
+		if !ok {
+			return
+		}
+		if unacked && sinceAck >= window {
+			c.setTimedOut("ack", window)
+			c.closeTimedOut()
+			return
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package apns
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The kernel's view of the connection from TCP_INFO, tcpi_unacked being
+// the segments sent but not acknowledged and tcpi_last_ack_recv the
+// milliseconds since the last ack
+func tcpAckState(socket *net.TCPConn) ackStateFunc {
+	rawConn, err := socket.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	return func() (bool, time.Duration, bool) {
+		var info syscall.TCPInfo
+		var sysErr syscall.Errno
+		err := rawConn.Control(func(fd uintptr) {
+			size := uint32(unsafe.Sizeof(info))
+			_, _, sysErr = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+				uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+		})
+		if err != nil || sysErr != 0 {
+			return false, 0, false
+		}
+		return info.Unacked > 0, time.Duration(info.Last_ack_recv) * time.Millisecond, true
+	}
+}
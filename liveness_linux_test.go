@@ -0,0 +1,19 @@
+package apns
+
+import (
+	"net"
+	"syscall"
+)
+
+// Whether SO_KEEPALIVE is set on the socket
+func tcpKeepAliveEnabled(socket *net.TCPConn) (bool, bool) {
+	rawConn, err := socket.SyscallConn()
+	if err != nil {
+		return false, false
+	}
+	enabled := 0
+	controlErr := rawConn.Control(func(fd uintptr) {
+		enabled, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+	})
+	return enabled == 1, controlErr == nil && err == nil
+}
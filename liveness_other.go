@@ -0,0 +1,13 @@
+//go:build !linux
+
+package apns
+
+import (
+	"net"
+)
+
+// Only linux's TCP_INFO is read, elsewhere the liveness check is left to
+// TCP keepalive and WriteTimeout
+func tcpAckState(socket *net.TCPConn) ackStateFunc {
+	return nil
+}
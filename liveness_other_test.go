@@ -0,0 +1,12 @@
+//go:build !linux
+
+package apns
+
+import (
+	"net"
+)
+
+// SO_KEEPALIVE is only read back on linux
+func tcpKeepAliveEnabled(socket *net.TCPConn) (bool, bool) {
+	return false, false
+}
@@ -0,0 +1,137 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLivenessShouldTearDownAnUnacknowledgedConnection(t *testing.T) {
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	config.clock = newFakeClock()
+	conn := socketAPNSConnection(socket, config)
+	conn.SendChannel <- groupTestPayload(0)
+	conn.SendChannel <- groupTestPayload(1)
+	for socket.sent() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	//written, but the gateway went quiet 31 seconds ago
+	go conn.livenessMonitor(30*time.Second, func() (bool, time.Duration, bool) {
+		return true, 31 * time.Second, true
+	})
+	select {
+	case connectionClose := <-conn.CloseChannel:
+		if connectionClose.Timeout == nil || connectionClose.Timeout.Op != "ack" || connectionClose.Timeout.After != 30*time.Second {
+			t.Error(fmt.Sprintf("Expected an ack timeout but got %v", connectionClose))
+		}
+		//nothing was acknowledged, so both are handed back to be resent
+		if connectionClose.ErrorPayload == nil || connectionClose.UnsentPayloads.Len() != 1 {
+			t.Error(fmt.Sprintf("Expected both payloads to be handed back but got %v", connectionClose))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the connection to be torn down")
+	}
+}
+
+func TestLivenessShouldLeaveAnAcknowledgedConnection(t *testing.T) {
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	config.clock = newFakeClock()
+	conn := socketAPNSConnection(socket, config)
+
+	checks := int32(0)
+	done := make(chan bool)
+	go func() {
+		conn.livenessMonitor(30*time.Second, func() (bool, time.Duration, bool) {
+			switch atomic.AddInt32(&checks, 1) {
+			case 1:
+				//acknowledged recently
+				return true, time.Second, true
+			case 2:
+				//quiet, but with nothing waiting for an ack
+				return false, time.Hour, true
+			}
+			return false, 0, false
+		})
+		close(done)
+	}()
+	<-done
+	if checks != 3 {
+		t.Error(fmt.Sprintf("Expected the monitor to stop once the ack state is unknown but got %v checks", checks))
+	}
+
+	conn.Disconnect()
+	if connectionClose := <-conn.CloseChannel; connectionClose.Timeout != nil {
+		t.Error(fmt.Sprintf("Expected no timeout but got %v", connectionClose))
+	}
+}
+
+func TestLivenessAckStateOfALoopbackConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		server, err := listener.Accept()
+		if err == nil {
+			server.Read(make([]byte, 16))
+			server.Close()
+		}
+	}()
+	socket, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	ackState := socketAckState(socket)
+	if ackState == nil {
+		t.Skip("TCP_INFO isn't supported on this os")
+	}
+	socket.Write([]byte("ping"))
+	deadline := time.Now().Add(time.Second)
+	for {
+		unacked, _, ok := ackState()
+		if !ok {
+			t.Fatal("Expected the ack state of a tcp connection")
+		}
+		if !unacked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected loopback to acknowledge the write")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if socketAckState(&poolTestSocket{}) != nil {
+		t.Error("Expected no ack state for a connection that isn't tcp")
+	}
+}
+
+func TestLivenessKeepAlive(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	for keepAlive, expected := range map[time.Duration]bool{0: true, 5 * time.Second: true, -time.Second: false} {
+		socket, err := dialGateway(context.Background(), gatewayAddr{host: host, port: port, keepAlive: keepAlive}, &ConnectTiming{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		enabled, ok := tcpKeepAliveEnabled(socket.(*net.TCPConn))
+		if ok && enabled != expected {
+			t.Error(fmt.Sprintf("Expected keepalive %v with a period of %v", expected, keepAlive))
+		}
+		socket.Close()
+	}
+}
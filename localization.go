@@ -0,0 +1,90 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Checks the %@ and %n$@ placeholders in LocKey and TitleLocKey match the
+// number of LocArgs and TitleLocArgs supplied, so the device doesn't show
+// a broken string. %% is a literal percent sign
+// Placeholders are counted the way the device fills them in: each %@ takes
+// the next arg, and %n$@ takes arg n, so "%2$@ %1$@" needs 2 args
+// Keys that aren't set aren't checked
+func (a *APSAlertBody) ValidateLocalization() error {
+	errorStrs := ""
+	if err := validateLocKey("Loc key", a.LocKey, "loc args", a.LocArgs); err != nil {
+		errorStrs += err.Error() + "\n"
+	}
+	if err := validateLocKey("Title loc key", a.TitleLocKey, "title loc args", a.TitleLocArgs); err != nil {
+		errorStrs += err.Error() + "\n"
+	}
+	if errorStrs != "" {
+		return errors.New(errorStrs[:len(errorStrs)-1])
+	}
+	return nil
+}
+
+func validateLocKey(keyName string, key string, argsName string, args []string) error {
+	if key == "" {
+		return nil
+	}
+	placeholders, err := countLocPlaceholders(key)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%v %q %v", keyName, key, err))
+	}
+	if placeholders != len(args) {
+		return errors.New(fmt.Sprintf("%v %q has %v placeholders but %v %v were supplied",
+			keyName, key, placeholders, len(args), argsName))
+	}
+	return nil
+}
+
+// Number of args a format string needs, the highest arg used by either
+// a %@ or %n$@ placeholder
+func countLocPlaceholders(format string) (int, error) {
+	sequential := 0
+	highest := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		switch {
+		case i < len(format) && format[i] == '%':
+			continue
+		case i < len(format) && format[i] == '@':
+			sequential++
+			if sequential > highest {
+				highest = sequential
+			}
+			continue
+		}
+
+		//positional, digits then $@
+		start := i
+		for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+			i++
+		}
+		if i == start || i+1 >= len(format) || format[i] != '$' || format[i+1] != '@' {
+			end := i + 1
+			if i < len(format) && format[i] == '$' {
+				end++
+			}
+			if end > len(format) {
+				end = len(format)
+			}
+			return 0, errors.New(fmt.Sprintf("has unsupported format specifier %q at %v, only %%@, %%n$@ and %%%% are allowed", format[start-1:end], start-1))
+		}
+		position, err := strconv.Atoi(format[start:i])
+		if err != nil || position < 1 {
+			return 0, errors.New(fmt.Sprintf("has invalid positional specifier %q", format[start-1:i+2]))
+		}
+		if position > highest {
+			highest = position
+		}
+		i++
+	}
+	return highest, nil
+}
@@ -0,0 +1,76 @@
+package apns
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCountLocPlaceholders(t *testing.T) {
+	cases := map[string]int{
+		"":                         0,
+		"No placeholders":          0,
+		"%@ invited you":           1,
+		"%@ invited you to %@":     2,
+		"%2$@ invited %1$@":        2,
+		"%3$@ only the third":      3,
+		"%1$@ and %1$@ again":      1,
+		"100%% sure %@":            1,
+		"%%@ is literal":           0,
+		"%@ then %2$@ then %@":     2,
+		"%10$@ double digit":       10,
+		"trailing %%":              0,
+		"mixed %1$@ %@ %@ %@ %2$@": 3,
+	}
+	for format, expected := range cases {
+		count, err := countLocPlaceholders(format)
+		if err != nil {
+			t.Error(fmt.Sprintf("Unexpected error for %q: %v", format, err))
+		}
+		if count != expected {
+			t.Error(fmt.Sprintf("Expected %v placeholders in %q but got %v", expected, format, count))
+		}
+	}
+}
+
+func TestCountLocPlaceholdersInvalid(t *testing.T) {
+	for _, format := range []string{"%d points", "trailing %", "%1 no dollar", "%1$d wrong type", "%0$@ zero", "50% off"} {
+		if _, err := countLocPlaceholders(format); err == nil {
+			t.Error(fmt.Sprintf("Expected error for %q", format))
+		}
+	}
+}
+
+func TestValidateLocalization(t *testing.T) {
+	valid := []APSAlertBody{
+		{},
+		{Body: "no loc keys"},
+		{LocKey: "%@ invited you to %@", LocArgs: []string{"Bob", "chess"}},
+		{LocKey: "GAME_START"},
+		{TitleLocKey: "%2$@ vs %1$@", TitleLocArgs: []string{"a", "b"}},
+	}
+	for _, body := range valid {
+		if err := body.ValidateLocalization(); err != nil {
+			t.Error(fmt.Sprintf("Expected %+v to be valid but got %v", body, err))
+		}
+	}
+
+	body := APSAlertBody{
+		LocKey:       "%@ invited you to %@ at %@",
+		LocArgs:      []string{"Bob", "chess"},
+		TitleLocKey:  "Invite",
+		TitleLocArgs: []string{"extra"},
+	}
+	err := body.ValidateLocalization()
+	if err == nil {
+		t.Fatal("Expected mismatched args to be invalid")
+	}
+	for _, expected := range []string{
+		`Loc key "%@ invited you to %@ at %@" has 3 placeholders but 2 loc args were supplied`,
+		`Title loc key "Invite" has 0 placeholders but 1 title loc args were supplied`,
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Error(fmt.Sprintf("Expected %q in %v", expected, err))
+		}
+	}
+}
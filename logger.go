@@ -0,0 +1,37 @@
+package apns
+
+// Receives what a connection is doing as a message and key-value pairs,
+// set with APNSConfig.Logger, e.g. a *slog.Logger or an adapter to
+// another structured logger
+// Events are logged as the connection is established (gateway address,
+// whether the tls session was resumed), on an error response from apple
+// (reason, identifier), when the connection closes (error, payloads left
+// unsent), as an APNSReconnectingConnection starts and finishes resending
+// payloads, and when Shutdown completes. Payloads and device tokens are
+// logged redacted, as in Payload.String
+// Called on the connection's goroutines, so it must be safe for
+// concurrent use
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// Logger that discards everything, the default
+type NoopLogger struct{}
+
+func (NoopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (NoopLogger) Info(msg string, keyvals ...interface{})  {}
+func (NoopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (NoopLogger) Error(msg string, keyvals ...interface{}) {}
+
+// The logger to use, NoopLogger if none is set
+// The config isn't defaulted, as an unset Logger leaves the certificate
+// expiry and failover warnings going to the standard logger
+func configLogger(logger Logger) Logger {
+	if logger == nil {
+		return NoopLogger{}
+	}
+	return logger
+}
@@ -0,0 +1,160 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A *slog.Logger can be set as the Logger
+var _ Logger = slog.Default()
+
+type loggedEvent struct {
+	level   string
+	msg     string
+	keyvals map[string]interface{}
+}
+
+// Logger keeping every event
+type recordingLogger struct {
+	lock   *sync.Mutex
+	events []loggedEvent
+}
+
+func newRecordingLogger() *recordingLogger {
+	return &recordingLogger{lock: new(sync.Mutex)}
+}
+
+func (l *recordingLogger) log(level string, msg string, keyvals []interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	event := loggedEvent{level: level, msg: msg, keyvals: make(map[string]interface{})}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		event.keyvals[keyvals[i].(string)] = keyvals[i+1]
+	}
+	l.events = append(l.events, event)
+}
+
+func (l *recordingLogger) Debug(msg string, keyvals ...interface{}) { l.log("debug", msg, keyvals) }
+func (l *recordingLogger) Info(msg string, keyvals ...interface{})  { l.log("info", msg, keyvals) }
+func (l *recordingLogger) Warn(msg string, keyvals ...interface{})  { l.log("warn", msg, keyvals) }
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) { l.log("error", msg, keyvals) }
+
+// Wait for an event with msg, returning the first
+func (l *recordingLogger) waitFor(t *testing.T, msg string) loggedEvent {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		l.lock.Lock()
+		for _, event := range l.events {
+			if event.msg == msg {
+				l.lock.Unlock()
+				return event
+			}
+		}
+		l.lock.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("Expected %q to be logged", msg))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Fail if any event has one of the tokens in full
+func (l *recordingLogger) expectRedacted(t *testing.T, payloads []*Payload) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, event := range l.events {
+		logged := fmt.Sprint(event.msg, event.keyvals)
+		for _, payload := range payloads {
+			if strings.Contains(logged, payload.Token) {
+				t.Error(fmt.Sprintf("Expected tokens to be redacted but got %v", logged))
+			}
+		}
+	}
+}
+
+func TestLoggerShouldLogConnectionEvents(t *testing.T) {
+	gateway, config := newDropTestGateway(t, 0, 0)
+	defer gateway.Close()
+	logger := newRecordingLogger()
+	config.Logger = logger
+
+	conn, err := NewAPNSConnectionContext(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected := logger.waitFor(t, "apns: connected")
+	if connected.level != "info" || connected.keyvals["gateway"] != conn.ConnectTiming().Addr || connected.keyvals["tls_resumed"] != false {
+		t.Error(fmt.Sprintf("Expected the gateway connected to but got %+v", connected))
+	}
+
+	invalid := groupTestPayload(2)
+	invalid.Priority = 7
+	payloads := []*Payload{groupTestPayload(0), groupTestPayload(1), invalid}
+	for _, payload := range payloads {
+		conn.SendContext(context.Background(), payload)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := conn.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-conn.CloseChannel
+
+	if event := logger.waitFor(t, "apns: invalid payload"); event.level != "warn" || event.keyvals["payload"] != invalid.String() {
+		t.Error(fmt.Sprintf("Expected the invalid payload to be logged but got %+v", event))
+	}
+	if event := logger.waitFor(t, "apns: connection closed"); event.keyvals["unsent"] != 0 {
+		t.Error(fmt.Sprintf("Expected nothing unsent but got %+v", event))
+	}
+	if event := logger.waitFor(t, "apns: shut down"); event.keyvals["payloads"] != uint32(3) || event.keyvals["unsent"] != 0 {
+		t.Error(fmt.Sprintf("Expected the shutdown summary but got %+v", event))
+	}
+	logger.expectRedacted(t, payloads)
+}
+
+func TestLoggerShouldLogRejectionsAndReplays(t *testing.T) {
+	logger := newRecordingLogger()
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig:   &APNSConfig{InFlightPayloadBufferSize: 100, FramingTimeout: 1, MaxPayloadSize: 2048, Logger: logger},
+		ReconnectBaseDelay: 1,
+		dial:               dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloads := []*Payload{groupTestPayload(0), groupTestPayload(1), groupTestPayload(2)}
+	for _, payload := range payloads {
+		conn.SendChannel <- payload
+	}
+	waitForPoolSends(t, dialer, []int{3})
+	dialer.socket(0).reject(8, 1)
+	<-conn.CloseChannel
+	waitForPoolSends(t, dialer, []int{3, 1})
+
+	if event := logger.waitFor(t, "apns: error response received"); event.level != "warn" ||
+		event.keyvals["reason"] != string(BinaryReasonInvalidToken) || event.keyvals["identifier"] != uint32(1) {
+		t.Error(fmt.Sprintf("Expected the rejection's reason and identifier but got %+v", event))
+	}
+	if event := logger.waitFor(t, "apns: connection closed"); event.keyvals["unsent"] != 1 ||
+		event.keyvals["error_payload"] != payloads[1].String() {
+		t.Error(fmt.Sprintf("Expected the close with the payload left unsent but got %+v", event))
+	}
+	if event := logger.waitFor(t, "apns: replay started"); event.keyvals["payloads"] != 1 {
+		t.Error(fmt.Sprintf("Expected a replay of the payload after the rejected one but got %+v", event))
+	}
+	if event := logger.waitFor(t, "apns: replay finished"); event.keyvals["payloads"] != 1 {
+		t.Error(fmt.Sprintf("Expected the replay to finish but got %+v", event))
+	}
+	logger.expectRedacted(t, payloads)
+
+	conn.Close()
+	for range conn.CloseChannel {
+	}
+}
@@ -0,0 +1,336 @@
+package apns
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Config of one app of an APNSManager, exactly one of Pool and HTTP2
+// should be set. Choose apple's environment with the config's Environment
+type ManagedApp struct {
+	// pool of binary connections to send over, with certificate auth
+	Pool *APNSPoolConfig
+	// HTTP/2 connection to send over, with certificate or token auth
+	HTTP2 *HTTP2Config
+}
+
+// Config for creating an APNSManager
+type APNSManagerConfig struct {
+	// apps to send for, keyed by bundle id, more can be added with AddApp
+	Apps map[string]*ManagedApp
+	// number of payloads sent to an HTTP/2 app at once before Send blocks,
+	// defaults to 100
+	MaxConcurrentHTTP2Sends int
+}
+
+// A result of sending for one of an APNSManager's apps
+// Binary connections only report failures, so their payloads have no
+// Result; a rejection is passed on as the Close of the connection, as
+// from APNSConnectionPool.CloseChannel
+type AppResult struct {
+	// bundle id of the app the payload was sent for
+	AppID string
+	// apple's verdict on a payload sent over HTTP/2, nil if it couldn't be
+	// sent, with Err set, or for a Close
+	Result *Result
+	// why a payload couldn't be sent over HTTP/2, or an error from apple
+	// along with Result (see HTTP2Connection.Send)
+	Err error
+	// the payload sent over HTTP/2, nil for a Close
+	Payload *Payload
+	// the close of one of the app's binary connections
+	Close *ConnectionClose
+}
+
+// Sends for many apps, each with its own certificate or auth key, over
+// a connection (or pool of binary connections) per app. Connections are
+// made on an app's first Send and kept until it's removed
+// Results from every app are passed on to ResultChannel tagged with the
+// app's id. Safe for concurrent use, apps can be added and removed while
+// sending
+type APNSManager struct {
+	// Channel results are received on, should be read until closed
+	ResultChannel chan *AppResult
+
+	config *APNSManagerConfig
+	apps   map[string]*managedApp
+	lock   *sync.Mutex
+	closed bool
+	// apps being removed, guarded by lock
+	removing *sync.WaitGroup
+}
+
+// One app of the manager and its connection, once made
+type managedApp struct {
+	id     string
+	config *ManagedApp
+	// guards connecting, so only one Send makes the connection
+	connectLock *sync.Mutex
+	pool        *APNSConnectionPool
+	http2       *HTTP2Connection
+	// Sends still using the connection, added to under the manager's lock
+	// while the app hasn't been removed
+	sends *sync.WaitGroup
+	// limits the HTTP/2 sends in progress
+	http2Sends chan bool
+	// set once the connection is being closed, guarded by the manager's lock
+	draining bool
+	// receives the pool's final close
+	poolClosed chan *ConnectionClose
+}
+
+// Create a new manager for the supplied apps
+// If invalid config an error will be returned
+// No connection is made until an app is sent for
+// See APNSManagerConfig object for defaults
+func NewAPNSManager(config *APNSManagerConfig) (*APNSManager, error) {
+	errorStrs := ""
+
+	if config.MaxConcurrentHTTP2Sends < 0 {
+		errorStrs += "Invalid MaxConcurrentHTTP2Sends. Should be > 0.\n"
+	}
+	for id, app := range config.Apps {
+		errorStrs += validateManagedApp(id, app)
+	}
+
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+
+	if config.MaxConcurrentHTTP2Sends == 0 {
+		config.MaxConcurrentHTTP2Sends = 100
+	}
+
+	m := &APNSManager{
+		ResultChannel: make(chan *AppResult),
+		config:        config,
+		apps:          make(map[string]*managedApp),
+		lock:          new(sync.Mutex),
+		removing:      new(sync.WaitGroup),
+	}
+	for id, app := range config.Apps {
+		m.apps[id] = m.newManagedApp(id, app)
+	}
+	return m, nil
+}
+
+func validateManagedApp(id string, app *ManagedApp) string {
+	if id == "" {
+		return "Invalid app id. Should be the app's bundle id.\n"
+	}
+	if app == nil || (app.Pool == nil) == (app.HTTP2 == nil) {
+		return fmt.Sprintf("Invalid app %v. Should set either Pool or HTTP2.\n", id)
+	}
+	if app.Pool != nil && app.Pool.ConnectionConfig == nil {
+		return fmt.Sprintf("Invalid app %v. Pool should have a ConnectionConfig.\n", id)
+	}
+	return ""
+}
+
+func (m *APNSManager) newManagedApp(id string, config *ManagedApp) *managedApp {
+	return &managedApp{
+		id:          id,
+		config:      config,
+		connectLock: new(sync.Mutex),
+		sends:       new(sync.WaitGroup),
+		http2Sends:  make(chan bool, m.config.MaxConcurrentHTTP2Sends),
+	}
+}
+
+// Add an app to send for
+// Returns an error if the config is invalid, an app with the id was
+// already added or the manager is closed
+func (m *APNSManager) AddApp(id string, app *ManagedApp) error {
+	if errorStrs := validateManagedApp(id, app); errorStrs != "" {
+		return errors.New(errorStrs)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return errors.New("Cannot add app, manager is closed")
+	}
+	if _, ok := m.apps[id]; ok {
+		return errors.New(fmt.Sprintf("Cannot add app %v, it was already added", id))
+	}
+	m.apps[id] = m.newManagedApp(id, app)
+	return nil
+}
+
+// Ids of the apps being sent for
+func (m *APNSManager) Apps() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ids := make([]string, 0, len(m.apps))
+	for id := range m.apps {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Remove an app, draining its connection once the sends in progress for
+// it have been made
+// Blocks until the app has drained, returning a ConnectionClose holding
+// its unsent payloads. ResultChannel should be read meanwhile
+func (m *APNSManager) RemoveApp(id string) (*ConnectionClose, error) {
+	m.lock.Lock()
+	app, ok := m.apps[id]
+	if !ok {
+		m.lock.Unlock()
+		return nil, errors.New(fmt.Sprintf("Cannot remove app %v, it wasn't added", id))
+	}
+	delete(m.apps, id)
+	app.draining = true
+	m.removing.Add(1)
+	m.lock.Unlock()
+
+	defer m.removing.Done()
+	return m.drain(app), nil
+}
+
+// Send a payload for the app
+// Payloads for a binary app are sent on its pool's SendChannel, and for
+// an HTTP/2 one in the background with its result passed on to
+// ResultChannel. Blocks while the app's connection is made, and while
+// its pool's queues or MaxConcurrentHTTP2Sends are full
+// Returns an error if the app wasn't added, was removed or its
+// connection couldn't be made
+func (m *APNSManager) Send(id string, payload *Payload) error {
+	m.lock.Lock()
+	app, ok := m.apps[id]
+	if m.closed {
+		m.lock.Unlock()
+		return errors.New("Cannot send payload, manager is closed")
+	}
+	if !ok {
+		m.lock.Unlock()
+		return errors.New(fmt.Sprintf("Cannot send payload, no app %v", id))
+	}
+	app.sends.Add(1)
+	m.lock.Unlock()
+
+	if err := m.connect(app); err != nil {
+		app.sends.Done()
+		return err
+	}
+	if app.pool != nil {
+		app.pool.SendChannel <- payload
+		app.sends.Done()
+		return nil
+	}
+
+	app.http2Sends <- true
+	go func() {
+		defer app.sends.Done()
+		result, err := app.http2.Send(context.Background(), payload)
+		<-app.http2Sends
+		m.ResultChannel <- &AppResult{AppID: app.id, Result: result, Err: err, Payload: payload}
+	}()
+	return nil
+}
+
+// Make the app's connection unless it already has one
+func (m *APNSManager) connect(app *managedApp) error {
+	app.connectLock.Lock()
+	defer app.connectLock.Unlock()
+	if app.pool != nil || app.http2 != nil {
+		return nil
+	}
+
+	if app.config.HTTP2 != nil {
+		conn, err := NewHTTP2Connection(app.config.HTTP2)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Cannot connect app %v: %v", app.id, err))
+		}
+		app.http2 = conn
+		return nil
+	}
+	pool, err := NewAPNSConnectionPool(app.config.Pool)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Cannot connect app %v: %v", app.id, err))
+	}
+	app.pool = pool
+	app.poolClosed = make(chan *ConnectionClose, 1)
+	go m.poolListener(app)
+	return nil
+}
+
+// go-routine passing on the closes of an app's pool, keeping the final
+// one for drain
+func (m *APNSManager) poolListener(app *managedApp) {
+	var last *ConnectionClose
+	for connectionClose := range app.pool.CloseChannel {
+		m.lock.Lock()
+		draining := app.draining
+		m.lock.Unlock()
+		if !draining {
+			m.ResultChannel <- &AppResult{AppID: app.id, Close: connectionClose}
+			continue
+		}
+		//the last close while draining is the pool's final one
+		if last != nil {
+			m.ResultChannel <- &AppResult{AppID: app.id, Close: last}
+		}
+		last = connectionClose
+	}
+	app.poolClosed <- last
+}
+
+// Wait for the app's sends to finish then close its connection, returning
+// its unsent payloads
+func (m *APNSManager) drain(app *managedApp) *ConnectionClose {
+	app.sends.Wait()
+
+	app.connectLock.Lock()
+	defer app.connectLock.Unlock()
+	if app.pool != nil {
+		app.pool.Close()
+		if connectionClose := <-app.poolClosed; connectionClose != nil {
+			return connectionClose
+		}
+	}
+	if app.http2 != nil {
+		app.http2.Close()
+	}
+	return &ConnectionClose{UnsentPayloads: list.New(), Time: time.Now()}
+}
+
+// Stop accepting payloads and drain every app's connection
+// Blocks until every app has drained, returning a ConnectionClose for each
+// holding its unsent payloads, keyed by app id, then closes ResultChannel.
+// ResultChannel should be read meanwhile
+func (m *APNSManager) Close() map[string]*ConnectionClose {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return map[string]*ConnectionClose{}
+	}
+	m.closed = true
+	apps := m.apps
+	m.apps = make(map[string]*managedApp)
+	for _, app := range apps {
+		app.draining = true
+	}
+	m.lock.Unlock()
+
+	closes := make(map[string]*ConnectionClose)
+	closesLock := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+	for id, app := range apps {
+		wg.Add(1)
+		go func(id string, app *managedApp) {
+			defer wg.Done()
+			connectionClose := m.drain(app)
+			closesLock.Lock()
+			closes[id] = connectionClose
+			closesLock.Unlock()
+		}(id, app)
+	}
+	wg.Wait()
+	m.removing.Wait()
+	close(m.ResultChannel)
+	return closes
+}
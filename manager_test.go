@@ -0,0 +1,197 @@
+package apns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joekarl/go-libapns/apnstest"
+)
+
+func newManagerTestApps(t *testing.T) (*apnstest.Server, *ManagedApp, *ManagedApp) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	binary := &ManagedApp{Pool: &APNSPoolConfig{
+		Size: 1,
+		ConnectionConfig: &APNSConfig{
+			CertificateBytes:       server.ClientCertPEM,
+			KeyBytes:               server.ClientKeyPEM,
+			RootCAs:                server.RootCAs,
+			GatewayAddr:            server.BinaryAddr(),
+			IgnoreProxyEnvironment: true,
+			FramingTimeout:         1,
+		},
+	}}
+	_, keyPEM := generateAuthKey(t)
+	host, port, _ := net.SplitHostPort(server.HTTP2Addr())
+	http2 := &ManagedApp{HTTP2: &HTTP2Config{
+		AuthKeyBytes:           keyPEM,
+		KeyID:                  "ABC123DEFG",
+		TeamID:                 "DEF123GHIJ",
+		Topic:                  "com.example.other",
+		Host:                   host,
+		Port:                   port,
+		RootCAs:                server.RootCAs,
+		IgnoreProxyEnvironment: true,
+	}}
+	return server, binary, http2
+}
+
+// Read the manager's results until ResultChannel is closed
+func collectManagerResults(manager *APNSManager) (func() []*AppResult, chan bool) {
+	lock := new(sync.Mutex)
+	var results []*AppResult
+	done := make(chan bool)
+	go func() {
+		for result := range manager.ResultChannel {
+			lock.Lock()
+			results = append(results, result)
+			lock.Unlock()
+		}
+		close(done)
+	}()
+	return func() []*AppResult {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]*AppResult(nil), results...)
+	}, done
+}
+
+func TestManagerShouldConnectLazilyAndTagResults(t *testing.T) {
+	server, binary, http2 := newManagerTestApps(t)
+	manager, err := NewAPNSManager(&APNSManagerConfig{Apps: map[string]*ManagedApp{
+		"com.example.app":   binary,
+		"com.example.other": http2,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, done := collectManagerResults(manager)
+	if server.Connections() != 0 {
+		t.Error("Expected no connection to be made before sending")
+	}
+
+	rejected := groupTestPayload(1)
+	server.RejectToken(rejected.Token, "BadDeviceToken")
+	for i := 0; i < 3; i++ {
+		if err := manager.Send("com.example.app", groupTestPayload(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := manager.Send("com.example.other", groupTestPayload(10+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the gateway closes the connection after the rejection, so the last
+	//binary payload is handed back unsent
+	if _, err := server.WaitForNotifications(5, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	closes := manager.Close()
+	<-done
+	if len(closes) != 2 || closes["com.example.app"] == nil || closes["com.example.other"] == nil {
+		t.Error(fmt.Sprintf("Expected a close for each app but got %v", closes))
+	}
+	apps := make(map[string]int)
+	for _, result := range results() {
+		apps[result.AppID]++
+		switch result.AppID {
+		case "com.example.app":
+			if result.Close == nil || result.Close.ErrorPayload == nil || result.Close.ErrorPayload.Token != rejected.Token {
+				t.Error(fmt.Sprintf("Expected the rejection to be tagged with the app but got %+v", result))
+			}
+		case "com.example.other":
+			if result.Err != nil || !result.Result.Accepted() || result.Payload == nil {
+				t.Error(fmt.Sprintf("Expected the HTTP/2 payload to be accepted but got %+v", result))
+			}
+		}
+	}
+	if apps["com.example.app"] != 1 || apps["com.example.other"] != 3 {
+		t.Error(fmt.Sprintf("Expected a rejection and three results but got %v", apps))
+	}
+	if err := manager.Send("com.example.other", groupTestPayload(0)); err == nil {
+		t.Error("Expected sending after Close to fail")
+	}
+}
+
+func TestManagerShouldAddAndRemoveApps(t *testing.T) {
+	server, binary, http2 := newManagerTestApps(t)
+	manager, err := NewAPNSManager(&APNSManagerConfig{Apps: map[string]*ManagedApp{"com.example.app": binary}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, done := collectManagerResults(manager)
+
+	if err := manager.Send("com.example.other", groupTestPayload(0)); err == nil {
+		t.Error("Expected sending for an unknown app to fail")
+	}
+	if err := manager.AddApp("com.example.app", http2); err == nil {
+		t.Error("Expected adding an app twice to fail")
+	}
+
+	//add and remove an app while another is sent for
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := manager.Send("com.example.app", groupTestPayload(i)); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		if err := manager.AddApp("com.example.other", http2); err != nil {
+			t.Fatal(err)
+		}
+		if err := manager.Send("com.example.other", groupTestPayload(100+i)); err != nil {
+			t.Error(err)
+		}
+		connectionClose, err := manager.RemoveApp("com.example.other")
+		if err != nil || connectionClose.UnsentPayloads.Len() != 0 {
+			t.Error(fmt.Sprintf("Expected the app to drain but got %v, %v", connectionClose, err))
+		}
+	}
+	wg.Wait()
+	if _, err := manager.RemoveApp("com.example.other"); err == nil {
+		t.Error("Expected removing an unknown app to fail")
+	}
+	if apps := manager.Apps(); len(apps) != 1 || apps[0] != "com.example.app" {
+		t.Error(fmt.Sprintf("Expected only the binary app to be left but got %v", apps))
+	}
+
+	closes := manager.Close()
+	<-done
+	if closes["com.example.app"] == nil || closes["com.example.app"].UnsentPayloads.Len() != 0 {
+		t.Error(fmt.Sprintf("Expected the binary app to drain but got %v", closes))
+	}
+	if _, err := server.WaitForNotifications(23, 2*time.Second); err != nil {
+		t.Error(fmt.Sprintf("Expected every payload to be sent but got %v", err))
+	}
+}
+
+func TestManagerConfigValidation(t *testing.T) {
+	_, binary, http2 := newManagerTestApps(t)
+	_, err := NewAPNSManager(&APNSManagerConfig{
+		MaxConcurrentHTTP2Sends: -1,
+		Apps: map[string]*ManagedApp{
+			"":                binary,
+			"com.example.app": {Pool: binary.Pool, HTTP2: http2.HTTP2},
+			"com.example.new": {Pool: &APNSPoolConfig{}},
+		},
+	})
+	if err == nil {
+		t.Fatal("Expected the config to be invalid")
+	}
+	for _, expected := range []string{"MaxConcurrentHTTP2Sends", "Invalid app id", "com.example.app. Should set either", "ConnectionConfig"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Error(fmt.Sprintf("Expected %q in %v", expected, err))
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package apns
+
+// Options controlling how a payload is fit into the max payload size
+type MarshalOptions struct {
+	// Custom field keys that may be removed when the payload is too long,
+	// in the order they should be dropped (lowest priority first).
+	// Fields are only dropped until the payload fits, and alert
+	// truncation is only attempted once every listed field is gone
+	DroppableCustomFields []string
+}
+
+// Details of what was done to fit a payload into the max payload size
+type MarshalInfo struct {
+	// Custom field keys that were dropped, in the order they were dropped
+	DroppedCustomFields []string
+	// Whether the alert text had to be truncated
+	Truncated bool
+}
+
+// Convert a Payload into json the same as Marshal, but first dropping
+// droppable custom fields (see MarshalOptions) if the payload is too long
+// The supplied CustomFields map is never modified
+func (p *Payload) MarshalWithOptions(maxPayloadSize int, options MarshalOptions) ([]byte, MarshalInfo, error) {
+	info := MarshalInfo{}
+
+	if p.RawPayload != nil {
+		jsonStr, err := p.Marshal(maxPayloadSize)
+		return jsonStr, info, err
+	}
+
+	size, err := p.Size()
+	if err != nil {
+		return nil, info, err
+	}
+
+	trimmed := p
+	for _, key := range options.DroppableCustomFields {
+		if size <= maxPayloadSize {
+			break
+		}
+		if _, ok := trimmed.CustomFields[key]; !ok {
+			continue
+		}
+
+		if trimmed == p {
+			//copy before removing anything so the caller's map is untouched
+			copied := *p
+			copied.CustomFields = make(map[string]interface{}, len(p.CustomFields))
+			for k, v := range p.CustomFields {
+				copied.CustomFields[k] = v
+			}
+			trimmed = &copied
+		}
+		delete(trimmed.CustomFields, key)
+		info.DroppedCustomFields = append(info.DroppedCustomFields, key)
+
+		size, err = trimmed.Size()
+		if err != nil {
+			return nil, info, err
+		}
+	}
+
+	jsonStr, err := trimmed.Marshal(maxPayloadSize)
+	if err != nil {
+		return nil, info, err
+	}
+	info.Truncated = size > maxPayloadSize
+	return jsonStr, info, nil
+}
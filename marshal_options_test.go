@@ -0,0 +1,108 @@
+package apns
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func droppableTestPayload() Payload {
+	return Payload{
+		AlertText: "Testing this payload",
+		CustomFields: map[string]interface{}{
+			"id":      55,
+			"preview": strings.Repeat("p", 100),
+			"debug":   strings.Repeat("d", 100),
+		},
+	}
+}
+
+func TestMarshalWithOptionsDropsFieldsInOrderUntilFits(t *testing.T) {
+	p := droppableTestPayload()
+
+	json, info, err := p.MarshalWithOptions(200, MarshalOptions{
+		DroppableCustomFields: []string{"debug", "preview"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(json) > 200 {
+		t.Error(fmt.Sprintf("Expected payload to be less than %v but was %v", 200, len(json)))
+	}
+	if len(info.DroppedCustomFields) != 1 || info.DroppedCustomFields[0] != "debug" {
+		t.Error(fmt.Sprintf("Expected only debug to be dropped but got %v", info.DroppedCustomFields))
+	}
+	if info.Truncated {
+		t.Error("Expected no truncation once a field was dropped")
+	}
+	if strings.Contains(string(json), "\"debug\"") || !strings.Contains(string(json), "\"preview\"") {
+		t.Error(fmt.Sprintf("Expected debug to be removed and preview kept but got %v", string(json)))
+	}
+	if len(p.CustomFields) != 3 {
+		t.Error("MarshalWithOptions should not modify the supplied custom fields")
+	}
+}
+
+func TestMarshalWithOptionsTruncatesAfterDroppingEverything(t *testing.T) {
+	p := droppableTestPayload()
+	p.AlertText = strings.Repeat("a", 250)
+
+	json, info, err := p.MarshalWithOptions(256, MarshalOptions{
+		DroppableCustomFields: []string{"missing", "debug", "preview"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(json) > 256 {
+		t.Error(fmt.Sprintf("Expected payload to be less than %v but was %v", 256, len(json)))
+	}
+	if len(info.DroppedCustomFields) != 2 || info.DroppedCustomFields[0] != "debug" || info.DroppedCustomFields[1] != "preview" {
+		t.Error(fmt.Sprintf("Expected debug and preview to be dropped but got %v", info.DroppedCustomFields))
+	}
+	if !info.Truncated {
+		t.Error("Expected the alert to be truncated")
+	}
+}
+
+func TestMarshalWithOptionsNoDropWhenFits(t *testing.T) {
+	p := droppableTestPayload()
+
+	_, info, err := p.MarshalWithOptions(MaxPayloadSizeAlert, MarshalOptions{
+		DroppableCustomFields: []string{"debug", "preview"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.DroppedCustomFields) != 0 || info.Truncated {
+		t.Error(fmt.Sprintf("Expected nothing to be dropped or truncated but got %+v", info))
+	}
+}
+
+func TestMarshalWithOptionsOversizedRequiredFieldShouldError(t *testing.T) {
+	p := droppableTestPayload()
+	p.CustomFields["huge"] = strings.Repeat("h", 300)
+
+	_, _, err := p.MarshalWithOptions(256, MarshalOptions{
+		DroppableCustomFields: []string{"debug", "preview"},
+	})
+	if err == nil {
+		t.Error("Should have thrown marshaling error for a required field larger than the payload size")
+	}
+}
+
+func TestMarshalWithOptionsOversizedDroppableFieldIsDropped(t *testing.T) {
+	p := droppableTestPayload()
+	p.CustomFields["huge"] = strings.Repeat("h", 300)
+
+	json, info, err := p.MarshalWithOptions(256, MarshalOptions{
+		DroppableCustomFields: []string{"huge"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(json) > 256 || len(info.DroppedCustomFields) != 1 {
+		t.Error(fmt.Sprintf("Expected huge to be dropped but got %+v and %v", info, string(json)))
+	}
+}
@@ -0,0 +1,203 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var middlewareLock = new(sync.Mutex)
+
+// Hooks run around each send, registered with RegisterBeforeSend and
+// RegisterAfterSend and kept on the config, so they apply to every
+// connection made with it
+type middleware struct {
+	lock   *sync.RWMutex
+	before []func(payload *Payload) error
+	after  []func(payload *Payload, result Result)
+}
+
+// The hooks of connections made with this config, shared by every one of
+// them (e.g. by a pool or reconnects)
+func (config *APNSConfig) middleware() *middleware {
+	middlewareLock.Lock()
+	defer middlewareLock.Unlock()
+	if config.hooks == nil {
+		config.hooks = newMiddleware()
+	}
+	return config.hooks
+}
+
+func (config *HTTP2Config) middleware() *middleware {
+	middlewareLock.Lock()
+	defer middlewareLock.Unlock()
+	if config.hooks == nil {
+		config.hooks = newMiddleware()
+	}
+	return config.hooks
+}
+
+func newMiddleware() *middleware {
+	return &middleware{lock: new(sync.RWMutex)}
+}
+
+func (m *middleware) registerBefore(hook func(payload *Payload) error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.before = append(m.before, hook)
+}
+
+func (m *middleware) registerAfter(hook func(payload *Payload, result Result)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.after = append(m.after, hook)
+}
+
+// Run the BeforeSend hooks in the order registered, stopping at the first
+// to return an error or panic, which is returned
+func (m *middleware) beforeSend(payload *Payload) error {
+	m.lock.RLock()
+	hooks := m.before
+	m.lock.RUnlock()
+	for _, hook := range hooks {
+		if err := runBeforeSend(hook, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runBeforeSend(hook func(payload *Payload) error, payload *Payload) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("BeforeSend hook panicked: %v", r))
+		}
+	}()
+	return hook(payload)
+}
+
+// Run the AfterSend hooks in the order registered with the outcome of
+// sending payload, a failed one's Result holding its error in Err
+// A hook that panics is logged and the rest still run
+func (m *middleware) afterSend(payload *Payload, result *Result, err error, logger Logger) {
+	m.lock.RLock()
+	hooks := m.after
+	m.lock.RUnlock()
+	if len(hooks) == 0 {
+		return
+	}
+	outcome := Result{Payload: payload, ApnsID: payload.ApnsId}
+	if result != nil {
+		outcome = *result
+	}
+	if err != nil {
+		outcome.Err = err
+	}
+	for _, hook := range hooks {
+		runAfterSend(hook, payload, outcome, logger)
+	}
+}
+
+func runAfterSend(hook func(payload *Payload, result Result), payload *Payload, result Result, logger Logger) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("apns: AfterSend hook panicked", "payload", payload.String(), "panic", fmt.Sprint(r))
+		}
+	}()
+	hook(payload, result)
+}
+
+// Run the AfterSend hooks for the payloads not passed to Send that apple
+// has now said something about, in the order they were sent: the one it
+// rejected and those it read before, or everything written if it shut
+// down cleanly. A dropped socket doesn't say, they're handed back unsent
+// Called on the send go-routine once the connection has closed
+func (c *APNSConnection) afterSendOnClose(errorIdPayload *idPayload, appleError *AppleError) {
+	if appleError.ErrorCode == 10 {
+		return
+	}
+	for e := c.inFlightPayloadBuffer.Back(); e != nil; e = e.Prev() {
+		idPayloadObj := e.Value.(*idPayload)
+		if idPayloadObj.waiter != nil || idPayloadObj.failed || idPayloadObj.unsent || idPayloadObj.writtenAt.IsZero() {
+			continue
+		}
+		if idPayloadObj == errorIdPayload {
+			c.hooks.afterSend(idPayloadObj.Payload, c.rejectedResult(idPayloadObj.Payload, appleError), nil, c.logger)
+		} else {
+			c.hooks.afterSend(idPayloadObj.Payload, c.acceptedResult(idPayloadObj.Payload), nil, c.logger)
+		}
+	}
+}
+
+// Register a hook run on each payload once it's validated, before it's
+// framed, e.g. to stamp a custom field on every payload
+// An error (or panic) fails the payload with FailureBlocked, reported as
+// any payload that can't be framed is, rather than sending it
+// Hooks run in the order registered, on the connection's send
+// go-routine, and again for each resend. They are kept on the config, so
+// apply to every connection made with it, and must be safe for
+// concurrent use
+func (c *APNSConnection) RegisterBeforeSend(hook func(payload *Payload) error) {
+	c.hooks.registerBefore(hook)
+}
+
+// Register a hook run with the outcome of each payload once it's known
+// A Result with Err set is passed for a payload that failed: it was
+// invalid, blocked by a BeforeSend hook or, for Send, ctx was done or the
+// connection closed first. The binary protocol only reports rejections,
+// so for payloads not passed to Send the outcome is only known when apple
+// rejects one, passing its rejection, or closes, passing an accepted
+// Result for those it read before; the hooks aren't run for payloads
+// handed back as unsent, or that left the in flight buffer first
+// Hooks run in the order registered, on the connection's goroutines (the
+// caller's for Send), and a panic is logged rather than stopping the
+// connection. They are kept on the config as for RegisterBeforeSend
+func (c *APNSConnection) RegisterAfterSend(hook func(payload *Payload, result Result)) {
+	c.hooks.registerAfter(hook)
+}
+
+// Register a hook run on each payload before it's sent, see
+// APNSConnection.RegisterBeforeSend
+// It runs on every connection, including those made later
+func (r *APNSReconnectingConnection) RegisterBeforeSend(hook func(payload *Payload) error) {
+	r.config.ConnectionConfig.middleware().registerBefore(hook)
+}
+
+// Register a hook run with the outcome of each payload, see
+// APNSConnection.RegisterAfterSend
+// It runs on every connection, including those made later
+func (r *APNSReconnectingConnection) RegisterAfterSend(hook func(payload *Payload, result Result)) {
+	r.config.ConnectionConfig.middleware().registerAfter(hook)
+}
+
+// Register a hook run on each payload before it's sent, see
+// APNSConnection.RegisterBeforeSend
+// It runs on every connection of the pool, including replacements
+func (p *APNSConnectionPool) RegisterBeforeSend(hook func(payload *Payload) error) {
+	p.config.ConnectionConfig.middleware().registerBefore(hook)
+}
+
+// Register a hook run with the outcome of each payload, see
+// APNSConnection.RegisterAfterSend
+// It runs on every connection of the pool, including replacements
+func (p *APNSConnectionPool) RegisterAfterSend(hook func(payload *Payload, result Result)) {
+	p.config.ConnectionConfig.middleware().registerAfter(hook)
+}
+
+// Register a hook run on each payload once it's validated, before it's
+// marshaled, e.g. to stamp a custom field on every payload
+// An error (or panic) is returned by Send rather than sending the payload
+// Hooks run in the order registered, on the goroutine calling Send, so
+// they must be safe for concurrent use
+func (c *HTTP2Connection) RegisterBeforeSend(hook func(payload *Payload) error) {
+	c.hooks.registerBefore(hook)
+}
+
+// Register a hook run with the outcome of each Send: apple's response,
+// or a Result with Err set if there was none (the payload was invalid,
+// blocked by a BeforeSend hook, or the request failed)
+// Hooks run in the order registered, on the goroutine calling Send, and a
+// panic is recovered rather than returned
+func (c *HTTP2Connection) RegisterAfterSend(hook func(payload *Payload, result Result)) {
+	c.hooks.registerAfter(hook)
+}
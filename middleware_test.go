@@ -0,0 +1,191 @@
+package apns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// AfterSend hook keeping every outcome
+type recordingAfterSend struct {
+	lock    *sync.Mutex
+	results []Result
+}
+
+func (r *recordingAfterSend) hook(payload *Payload, result Result) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.results = append(r.results, result)
+}
+
+// Wait for count outcomes, returning them in the order reported
+func (r *recordingAfterSend) waitFor(t *testing.T, count int) []Result {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r.lock.Lock()
+		if len(r.results) >= count {
+			defer r.lock.Unlock()
+			return r.results
+		}
+		reported := len(r.results)
+		r.lock.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("Expected %v outcomes but got %v", count, reported))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBeforeSendShouldRunHooksInOrder(t *testing.T) {
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	sendErrors := make(chan *SendError, 10)
+	config.SendErrorCallback = func(sendError *SendError) {
+		sendErrors <- sendError
+	}
+	conn := socketAPNSConnection(socket, config)
+
+	blocked := groupTestPayload(1)
+	panicking := groupTestPayload(2)
+	var order []string
+	conn.RegisterBeforeSend(func(payload *Payload) error {
+		order = append(order, "stamp")
+		payload.CustomFields = map[string]interface{}{"correlation": "abc123"}
+		return nil
+	})
+	conn.RegisterBeforeSend(func(payload *Payload) error {
+		order = append(order, "opt out")
+		if payload == blocked {
+			return errors.New("Opted out")
+		}
+		if payload == panicking {
+			panic("hook bug")
+		}
+		return nil
+	})
+	for _, payload := range []*Payload{groupTestPayload(0), blocked, panicking, groupTestPayload(3)} {
+		conn.SendChannel <- payload
+	}
+	waitForSocketSends(t, socket, 2)
+
+	if fmt.Sprint(order) != "[stamp opt out stamp opt out stamp opt out stamp opt out]" {
+		t.Error(fmt.Sprintf("Expected the hooks to run in order for each payload but got %v", order))
+	}
+	socket.lock.Lock()
+	stamped := bytes.Count(socket.written.Bytes(), []byte(`"correlation":"abc123"`))
+	socket.lock.Unlock()
+	if stamped != 2 {
+		t.Error(fmt.Sprintf("Expected the stamped field to be sent with both payloads but got %v", stamped))
+	}
+	for _, payload := range []*Payload{blocked, panicking} {
+		sendError := <-sendErrors
+		if sendError.Payload != payload || sendError.Kind != FailureBlocked {
+			t.Error(fmt.Sprintf("Expected %v to be blocked but got %v", payload, sendError))
+		}
+	}
+
+	conn.Disconnect()
+	<-conn.CloseChannel
+}
+
+func TestAfterSendShouldReportOutcomes(t *testing.T) {
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	config.SendSettleWindow = 5000
+	conn := socketAPNSConnection(socket, config)
+	after := &recordingAfterSend{lock: new(sync.Mutex)}
+	conn.RegisterAfterSend(func(payload *Payload, result Result) {
+		panic("hook bug")
+	})
+	conn.RegisterAfterSend(after.hook)
+
+	//a Send, and two more apple reads before rejecting the last
+	delivered := groupTestPayload(0)
+	outcome := make(chan *Result, 1)
+	go func() {
+		result, _ := conn.Send(context.Background(), delivered)
+		outcome <- result
+	}()
+	waitForSocketSends(t, socket, 1)
+	payloads := []*Payload{groupTestPayload(1), groupTestPayload(2), groupTestPayload(3)}
+	for _, payload := range payloads {
+		conn.SendChannel <- payload
+	}
+	invalid := groupTestPayload(4)
+	invalid.Priority = 7
+	conn.SendChannel <- invalid
+	waitForSocketSends(t, socket, 4)
+	socket.reject(8, 3)
+	<-outcome
+	<-conn.CloseChannel
+
+	//Send's verdict is reported by the goroutine waiting on it, so may come
+	//in any order with the rest
+	results := []Result{}
+	var verdict Result
+	for _, result := range after.waitFor(t, 5) {
+		if result.Payload == delivered {
+			verdict = result
+		} else {
+			results = append(results, result)
+		}
+	}
+	if !verdict.Accepted() {
+		t.Error(fmt.Sprintf("Expected Send's verdict but got %+v", verdict))
+	}
+	if len(results) != 4 {
+		t.Fatal(fmt.Sprintf("Expected an outcome for each payload but got %+v", results))
+	}
+	if results[0].Payload != invalid || results[0].Err == nil {
+		t.Error(fmt.Sprintf("Expected the invalid payload to fail first but got %+v", results[0]))
+	}
+	for i, payload := range payloads[:2] {
+		if result := results[i+1]; result.Payload != payload || !result.Accepted() || result.Err != nil {
+			t.Error(fmt.Sprintf("Expected payload %v read before the rejection to be accepted but got %+v", i+1, result))
+		}
+	}
+	if result := results[3]; result.Payload != payloads[2] || result.Reason != BinaryReasonInvalidToken {
+		t.Error(fmt.Sprintf("Expected the rejection but got %+v", result))
+	}
+}
+
+func TestHTTP2HooksShouldWrapSend(t *testing.T) {
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer server.Close()
+	conn, err := NewHTTP2Connection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	blocked := http2TestPayload()
+	conn.RegisterBeforeSend(func(payload *Payload) error {
+		if payload == blocked {
+			return errors.New("Opted out")
+		}
+		return nil
+	})
+	after := &recordingAfterSend{lock: new(sync.Mutex)}
+	conn.RegisterAfterSend(after.hook)
+
+	accepted := http2TestPayload()
+	if result, err := conn.Send(context.Background(), accepted); err != nil || !result.Accepted() {
+		t.Error(fmt.Sprintf("Expected the payload to be accepted but got %v, %v", result, err))
+	}
+	if _, err := conn.Send(context.Background(), blocked); err == nil || err.Error() != "Opted out" {
+		t.Error(fmt.Sprintf("Expected the hook's error but got %v", err))
+	}
+
+	results := after.waitFor(t, 2)
+	if results[0].Payload != accepted || !results[0].Accepted() {
+		t.Error(fmt.Sprintf("Expected apple's response but got %+v", results[0]))
+	}
+	if results[1].Payload != blocked || results[1].StatusCode != 0 || results[1].Err == nil {
+		t.Error(fmt.Sprintf("Expected the blocked payload's error but got %+v", results[1]))
+	}
+}
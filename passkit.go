@@ -0,0 +1,20 @@
+package apns
+
+// The payload for a Wallet pass update, an empty json object
+const passKitPayload = "{}"
+
+// Create a payload telling Wallet a pass has been updated, sent to the
+// push token the device registered for the pass
+// Apple wants the payload to be exactly {} with the pass type identifier
+// (e.g. pass.com.example.ticket) as the topic. Wallet then fetches the
+// latest version of the pass from your web service
+// Only the ExpirationTime and Priority should be changed, anything else
+// is rejected by Validate and Marshal
+func NewPassKitPayload(token string, passTypeId string) *Payload {
+	return &Payload{
+		Token:      token,
+		Topic:      passTypeId,
+		PushType:   PushTypeAlert,
+		RawPayload: []byte(passKitPayload),
+	}
+}
@@ -0,0 +1,69 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestPassKitPayloadShouldBeEmpty(t *testing.T) {
+	p := NewPassKitPayload(validateTestToken, "pass.com.example.ticket")
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	payloadBytes, err := p.Marshal(MaxPayloadSizeBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloadBytes) != 2 || string(payloadBytes) != "{}" {
+		t.Error(fmt.Sprintf("Expected an empty json object but got %s", payloadBytes))
+	}
+	if p.Topic != "pass.com.example.ticket" || p.ResolvedPushType() != PushTypeAlert {
+		t.Error(fmt.Sprintf("Unexpected topic or push type %v", p))
+	}
+
+	p.AlertText = "Updated"
+	if err := p.Validate(); err == nil {
+		t.Error("Expected an alert on a pass update to be invalid")
+	}
+}
+
+func TestPassKitPayloadShouldNotShareBytes(t *testing.T) {
+	first := NewPassKitPayload(validateTestToken, "pass.com.example.ticket")
+	payloadBytes, err := first.Marshal(MaxPayloadSizeBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadBytes[0] = '['
+	first.RawPayload[1] = ']'
+
+	payloadBytes, err = NewPassKitPayload(validateTestToken, "pass.com.example.ticket").Marshal(MaxPayloadSizeBinary)
+	if err != nil || string(payloadBytes) != "{}" {
+		t.Error(fmt.Sprintf("Expected changing one pass update not to change the next but got %s, %v", payloadBytes, err))
+	}
+	if string(first.RawPayload) != "{]" {
+		t.Error(fmt.Sprintf("Expected Marshal to return a copy but the payload is %s", first.RawPayload))
+	}
+}
+
+func TestHTTP2SendShouldPostPassKitPayload(t *testing.T) {
+	type request struct{ body, topic, pushType string }
+	requests := make(chan request, 1)
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{string(body), r.Header.Get("apns-topic"), r.Header.Get("apns-push-type")}
+	})
+	defer server.Close()
+
+	conn, _ := NewHTTP2Connection(config)
+	defer conn.Close()
+	if _, err := conn.Send(context.Background(), NewPassKitPayload(validateTestToken, "pass.com.example.ticket")); err != nil {
+		t.Fatal(err)
+	}
+	received := <-requests
+	if received.body != "{}" || received.topic != "pass.com.example.ticket" || received.pushType != "alert" {
+		t.Error(fmt.Sprintf("Unexpected pass update request %+v", received))
+	}
+}
@@ -0,0 +1,111 @@
+package apns
+
+import (
+	"sync"
+)
+
+// Whether sending is paused, with a channel closed on the next change so
+// a send loop can wait for it alongside everything else
+type pauseSwitch struct {
+	lock    *sync.Mutex
+	paused  bool
+	changed chan bool
+}
+
+func newPauseSwitch() *pauseSwitch {
+	return &pauseSwitch{
+		lock:    new(sync.Mutex),
+		changed: make(chan bool),
+	}
+}
+
+func (s *pauseSwitch) set(paused bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.paused == paused {
+		return
+	}
+	s.paused = paused
+	close(s.changed)
+	s.changed = make(chan bool)
+}
+
+// Whether sending is paused, and a channel closed once that changes
+func (s *pauseSwitch) state() (bool, <-chan bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.paused, s.changed
+}
+
+// Stop taking payloads, e.g. to stop bad content going out, without
+// closing the connection
+// Payloads already framed are still written, and those written are
+// tracked for apple's errors as usual. Payloads sent on SendChannel, by
+// Send or in send groups wait until Resume, and Enqueue keeps queueing up
+// to SendQueueSize (then applies the QueueFullPolicy)
+// Shutting down, draining or disconnecting while paused sends nothing
+// more: queued payloads are handed back in the ConnectionClose's
+// UnsentPayloads
+// Safe to call from any goroutine
+func (c *APNSConnection) Pause() {
+	c.pauses.set(true)
+}
+
+// Start taking payloads again after Pause, in the order they were sent
+func (c *APNSConnection) Resume() {
+	c.pauses.set(false)
+}
+
+// Whether the connection is paused
+func (c *APNSConnection) Paused() bool {
+	paused, _ := c.pauses.state()
+	return paused
+}
+
+// Stop handing payloads to the connections, without closing them
+// Payloads sent on SendChannel wait in the connections' queues, and once
+// MaxPendingPerConnection are queued for each SendChannel blocks. What's
+// been handed over is still written, see APNSConnection.Pause. Send and
+// SendAll aren't held up, pause the connections for those
+// Closing while paused sends nothing more, the queued payloads are in the
+// final ConnectionClose's UnsentPayloads
+// Safe to call from any goroutine
+func (p *APNSConnectionPool) Pause() {
+	p.pauses.set(true)
+}
+
+// Start handing payloads to the connections again after Pause, in the
+// order they were queued
+func (p *APNSConnectionPool) Resume() {
+	p.pauses.set(false)
+}
+
+// Whether the pool is paused
+func (p *APNSConnectionPool) Paused() bool {
+	paused, _ := p.pauses.state()
+	return paused
+}
+
+// Stop sending, without closing the connection, so that payloads sent on
+// SendChannel wait (and it blocks) until Resume
+// The connection stays open and reconnects if dropped, and what was
+// written before is tracked for apple's errors as usual. Payloads waiting
+// to be resent are held, ahead of anything new. StatePaused is reported
+// while paused
+// Closing while paused sends nothing more, the held payloads are in the
+// final ConnectionClose's UnsentPayloads
+// Safe to call from any goroutine
+func (r *APNSReconnectingConnection) Pause() {
+	r.pauses.set(true)
+}
+
+// Start sending again after Pause, resends first
+func (r *APNSReconnectingConnection) Resume() {
+	r.pauses.set(false)
+}
+
+// Whether the connection is paused
+func (r *APNSReconnectingConnection) Paused() bool {
+	paused, _ := r.pauses.state()
+	return paused
+}
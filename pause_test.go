@@ -0,0 +1,152 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joekarl/go-libapns/apnstest"
+)
+
+// Check the server received exactly the payloads from groupTestPayload
+// numbered from first to last, in order
+func expectPausedPayloads(t *testing.T, server *apnstest.Server, first int, last int) {
+	received, err := server.WaitForNotifications(last+1, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	received = server.Received()
+	if len(received) != last+1 {
+		t.Fatal(fmt.Sprintf("Expected %v notifications but got %v", last+1, len(received)))
+	}
+	for i := first; i <= last; i++ {
+		if expected := fmt.Sprintf("Testing%v", i); !strings.Contains(string(received[i].Payload), expected) {
+			t.Error(fmt.Sprintf("Expected notification %v to be %v but got %s", i, expected, received[i].Payload))
+		}
+	}
+}
+
+func TestPauseShouldHoldQueuedPayloads(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	conn, err := NewAPNSConnection(app.Pool.ConnectionConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SendChannel <- groupTestPayload(0)
+	expectPausedPayloads(t, server, 0, 0)
+
+	conn.Pause()
+	if !conn.Paused() {
+		t.Error("Expected the connection to be paused")
+	}
+	for i := 1; i <= 3; i++ {
+		if err := conn.Enqueue(groupTestPayload(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if received := len(server.Received()); received != 1 {
+		t.Fatal(fmt.Sprintf("Expected nothing sent while paused but got %v notifications", received))
+	}
+	conn.Resume()
+	expectPausedPayloads(t, server, 1, 3)
+
+	//shutting down while paused hands the queue back
+	conn.Pause()
+	conn.Enqueue(groupTestPayload(4))
+	conn.Enqueue(groupTestPayload(5))
+	go conn.Shutdown(context.Background())
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.UnsentPayloads.Len() != 2 || connectionClose.UnsentPayloads.Front().Value.(*Payload).AlertText != "Testing4" {
+		t.Error(fmt.Sprintf("Expected the queued payloads to be unsent but got %+v", connectionClose))
+	}
+	if received := len(server.Received()); received != 4 {
+		t.Error(fmt.Sprintf("Expected nothing more sent but got %v notifications", received))
+	}
+}
+
+func TestPoolPauseShouldHoldPayloads(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	pool, err := NewAPNSConnectionPool(app.Pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Pause()
+	for i := 0; i < 3; i++ {
+		pool.SendChannel <- groupTestPayload(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if received := len(server.Received()); received != 0 {
+		t.Fatal(fmt.Sprintf("Expected nothing sent while paused but got %v notifications", received))
+	}
+	pool.Resume()
+	expectPausedPayloads(t, server, 0, 2)
+
+	pool.Pause()
+	pool.SendChannel <- groupTestPayload(3)
+	pool.SendChannel <- groupTestPayload(4)
+	pool.Close()
+	var connectionClose *ConnectionClose
+	for connectionClose = range pool.CloseChannel {
+	}
+	if connectionClose.UnsentPayloads.Len() != 2 {
+		t.Error(fmt.Sprintf("Expected the held payloads to be unsent but got %v", connectionClose.UnsentPayloads.Len()))
+	}
+	if received := len(server.Received()); received != 3 {
+		t.Error(fmt.Sprintf("Expected nothing more sent but got %v notifications", received))
+	}
+}
+
+func TestReconnectPauseShouldReportState(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{ConnectionConfig: app.Pool.ConnectionConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Pause()
+	waitForState(t, conn, StatePaused)
+
+	sent := make(chan bool)
+	go func() {
+		conn.SendChannel <- groupTestPayload(0)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("Expected SendChannel to block while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.Resume()
+	<-sent
+	expectPausedPayloads(t, server, 0, 0)
+	if state := conn.State(); state != StateConnected {
+		t.Error(fmt.Sprintf("Expected to be connected once resumed but was %v", state))
+	}
+
+	conn.Pause()
+	waitForState(t, conn, StatePaused)
+	conn.Close()
+	for range conn.CloseChannel {
+	}
+	states := []ConnectionState{}
+	for event := range conn.StateEvents() {
+		states = append(states, event.State)
+	}
+	expected := []ConnectionState{StateConnected, StatePaused, StateConnected, StatePaused, StateClosed}
+	if fmt.Sprint(states) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expected, states))
+	}
+}
+
+func waitForState(t *testing.T, conn *APNSReconnectingConnection, state ConnectionState) {
+	deadline := time.Now().Add(5 * time.Second)
+	for conn.State() != state {
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("Expected to be %v but was %v", state, conn.State()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -1,9 +1,67 @@
 package apns
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// Max number of bytes in a regular (non VoIP) push payload
+	MaxPayloadSizeAlert = 4096
+	// Max number of bytes in a VoIP push payload
+	MaxPayloadSizeVoIP = 5120
+	// Max number of bytes accepted by the binary gateway protocol
+	MaxPayloadSizeBinary = 2048
+	// Max number of bytes accepted by devices prior to iOS 8
+	MaxPayloadSizeLegacy = 256
+	// Max number of bytes in a Payload.CollapseId
+	MaxCollapseIdLength = 64
+)
+
+// Returned by Marshal, and Validate, for a payload with nothing for apple
+// to deliver: no alert, badge, sound, content available or custom fields
+// PassKit pass updates (RawPayload, see NewPassKitPayload) are meant to
+// be empty, and VoIP, MDM and location pushes are handed to the app (or
+// device) whatever they hold, so they aren't checked
+var ErrEmptyPayload = errors.New("Empty payload, should set an alert, badge, sound, content available or custom fields")
+
+// The type of push notification being sent, sent as apns-push-type over
+// HTTP/2 and used to select payload limits
+type PushType string
+
+const (
+	PushTypeAlert        PushType = "alert"
+	PushTypeBackground   PushType = "background"
+	PushTypeVoIP         PushType = "voip"
+	PushTypeComplication PushType = "complication"
+	PushTypeFileProvider PushType = "fileprovider"
+	PushTypeMDM          PushType = "mdm"
+	PushTypeLocation     PushType = "location"
+	PushTypeLiveActivity PushType = "liveactivity"
+	PushTypePushToTalk   PushType = "pushtotalk"
+)
+
+// Every push type apple accepts
+var pushTypes = []PushType{
+	PushTypeAlert, PushTypeBackground, PushTypeVoIP, PushTypeComplication, PushTypeFileProvider,
+	PushTypeMDM, PushTypeLocation, PushTypeLiveActivity, PushTypePushToTalk,
+}
+
+// Values for Payload.Priority
+const (
+	// Send right away, only for pushes that alert, sound or badge the device
+	PriorityImmediate uint8 = 10
+	// Send at a time that conserves power, required for background pushes
+	PriorityThrottled uint8 = 5
+	// Prioritize the device's power over everything else, HTTP/2 only.
+	// The binary gateway doesn't support it so sends it as PriorityThrottled
+	PriorityPowerConsiderations uint8 = 1
 )
 
 //Object describing a push notification payload
@@ -21,20 +79,88 @@ type Payload struct {
 
 	// Any custom fields to be added to the apns payload
 	// These exist outside of the `aps` namespace
+	// Values are encoded with encoding/json, so values implementing
+	// json.Marshaler are used as is, and json.RawMessage values are
+	// embedded verbatim (after checking they are valid json)
+	// If a value can't be encoded the error names its path, e.g. "game.players[2].conn"
+	// The marshaled payload always has "aps" first followed by the custom
+	// fields in sorted key order, so the output is byte for byte stable
 	CustomFields map[string]interface{}
 
+	// By default <, > and & in custom fields are escaped (e.g. \u003c) as
+	// encoding/json does. Set to write them as is, which keeps urls and
+	// html snippets shorter. Size and truncation account for the setting
+	DisableHTMLEscaping bool
+
+	// By default Marshal fails with an InvalidUTF8Error if the alert,
+	// sound, category or a custom field string isn't valid UTF-8. Set to
+	// replace each invalid byte with U+FFFD instead, as encoding/json does
+	SanitizeUTF8 bool
+
 	// Payload server fields
 	// UNIX time in seconds when the payload is invalid
+	// NoExpiration (0) leaves it to Apple, see SetExpiration and SetTTL
+	// for setting it from a time.Time or time.Duration
 	ExpirationTime uint32
-	// Must be either 5 or 10, if not one of these two values will default to 5
+	// One of the Priority constants, or 0 to leave it to Apple (10 for
+	// alerts, 5 for background pushes). Validate rejects any other value
+	// and priority 10 on a content available only push
 	Priority uint8
 
 	// Device push token, should contain no spaces
 	Token string
 
+	// Notifications with the same collapse id are shown as one, only the
+	// latest is displayed. At most MaxCollapseIdLength bytes
+	// Sent as apns-collapse-id, HTTP/2 only: the binary protocol has no
+	// equivalent so APNSConnection ignores it
+	CollapseId string
+
+	// Id for the notification, a UUID sent as apns-id so it can be matched
+	// up with apple's delivery logs. HTTP/2 only, when empty one is
+	// generated for each send (see Result.ApnsID)
+	ApnsId string
+
+	// Type of push notification, sent as apns-push-type over HTTP/2 and
+	// used by MarshalAuto to pick the payload size limit
+	// When empty it is worked out from the payload, see ResolvedPushType
+	PushType PushType
+
+	// Bundle id the notification is for, sent as apns-topic. HTTP/2 only,
+	// when empty the connection's HTTP2Config.Topic is used
+	// VoIP, complication, Live Activity, location and file provider pushes
+	// need the matching suffix, e.g. com.example.app.voip
+	Topic string
+
+	// Base64 id of a broadcast channel to send the notification to, in
+	// place of Token. HTTP/2 only, the notification is broadcast to every
+	// device subscribed to the channel, e.g. for a Live Activity
+	ChannelId string
+
+	// Fully formed json payload to send as is. When set, Marshal only
+	// checks it is valid json within the size limit, no truncation is done.
+	// Cannot be combined with the alert, badge, sound, category,
+	// content available, or custom fields
+	RawPayload []byte
+
+	// Builds the "aps" dictionary in place of the alert, badge, sound,
+	// category and content available fields, which can't be set with it,
+	// e.g. RawAps to use aps keys the library doesn't know of. Its json
+	// is sent as is, so the alert isn't truncated to fit: a payload too
+	// long fails as it does without an alert. Custom fields still apply
+	ApsOverride ApsMarshaler
+
 	// Any extra data to be associated with this payload,
 	// Will not be sent to apple but will be held onto for error cases
 	ExtraData interface{}
+
+	// Json marshaled once by Broadcast and shared by every token's payload,
+	// used in place of marshaling while the max payload size matches
+	broadcastBody     []byte
+	broadcastBodySize int
+
+	// Token decoded for the binary protocol, see binaryToken
+	decodedToken atomic.Value
 }
 
 type APSAlertBody struct {
@@ -53,6 +179,21 @@ type APSAlertBody struct {
 	TitleLocArgs []string `json:"title-loc-args,omitempty"`
 }
 
+//Whether or not any of the alert body fields are set
+func (a *APSAlertBody) isEmpty() bool {
+	return a.Body == "" && a.otherFieldsEmpty()
+}
+
+//Whether Body is the only field set, so the alert can be sent as a string
+func (a *APSAlertBody) isBodyOnly() bool {
+	return a.Body != "" && a.otherFieldsEmpty()
+}
+
+func (a *APSAlertBody) otherFieldsEmpty() bool {
+	return a.ActionLocKey == "" && a.LocKey == "" && len(a.LocArgs) == 0 &&
+		a.LaunchImage == "" && a.Title == "" && a.TitleLocKey == "" && len(a.TitleLocArgs) == 0
+}
+
 type alertBodyAps struct {
 	Alert            APSAlertBody
 	Badge            BadgeNumber
@@ -71,125 +212,347 @@ type simpleAps struct {
 
 // Convert a Payload into a json object and then converted to a byte array
 // If the number of converted bytes is greater than the maxPayloadSize
-// an attempt will be made to truncate the AlertText
+// an attempt will be made to truncate the AlertText (or AlertBody.Body),
+// clipped on a character boundary with room left for any escaping
 // If this cannot be done, then an error will be returned
 func (p *Payload) Marshal(maxPayloadSize int) ([]byte, error) {
-	if p.isSimple() {
-		return p.marshalSimplePayload(maxPayloadSize)
-	} else {
-		return p.marshalAlertBodyPayload(maxPayloadSize)
+	if p.broadcastBody != nil && p.broadcastBodySize == maxPayloadSize {
+		return p.broadcastBody, nil
 	}
+	if p.RawPayload != nil {
+		return p.marshalRawPayload(maxPayloadSize)
+	}
+	return p.AppendMarshal(nil, maxPayloadSize)
 }
 
-//Whether or not to use simple aps format or not
-func (p *Payload) isSimple() bool {
-	return p.AlertText != ""
-}
-
-//Helper method to generate a json compatible map with aps key + custom fields
-//will return error if custom field named aps supplied
-func constructFullPayload(aps interface{}, customFields map[string]interface{}) (map[string]interface{}, error) {
-	var fullPayload = make(map[string]interface{})
-	fullPayload["aps"] = aps
-	for key, value := range customFields {
-		if key == "aps" {
-			return nil, errors.New("Cannot have a custom field named aps")
+// Same as Marshal, but appends the json to dst and returns the extended
+// slice, so callers can reuse one buffer across payloads and
+// avoid allocating for each marshal. dst is returned unchanged on error.
+// Safe to call from many goroutines, as long as each has its own dst
+func (p *Payload) AppendMarshal(dst []byte, maxPayloadSize int) ([]byte, error) {
+	if p.broadcastBody != nil && p.broadcastBodySize == maxPayloadSize {
+		return append(dst, p.broadcastBody...), nil
+	}
+	if p.RawPayload != nil {
+		raw, err := p.marshalRawPayload(maxPayloadSize)
+		if err != nil {
+			return dst, err
 		}
-		fullPayload[key] = value
+		return append(dst, raw...), nil
 	}
-	return fullPayload, nil
+	if p.isEmpty() {
+		return dst, ErrEmptyPayload
+	}
+	if !p.SanitizeUTF8 {
+		if err := p.validateUTF8(); err != nil {
+			return dst, err
+		}
+	}
+	aps, err := p.aps()
+	if err != nil {
+		return dst, err
+	}
+	return appendFullPayload(dst, aps, p.CustomFields, !p.DisableHTMLEscaping, maxPayloadSize)
 }
 
-//Handle simple payload case with just text alert
-//Handle truncating of alert text if too long for maxPayloadSize
-func (p *Payload) marshalSimplePayload(maxPayloadSize int) ([]byte, error) {
-	var jsonStr []byte
-
-	//use simple payload
-	aps := simpleAps{
-		Alert:            p.AlertText,
-		Badge:            p.Badge,
-		Sound:            p.Sound,
-		Category:         p.Category,
-		ContentAvailable: p.ContentAvailable,
-	}
+// Convert a Payload into a json object, using the max payload size
+// for the payload's PushType (see MaxPayloadSize)
+// Truncation and errors are handled the same as in Marshal
+func (p *Payload) MarshalAuto() ([]byte, error) {
+	return p.Marshal(p.MaxPayloadSize())
+}
 
-	fullPayload, err := constructFullPayload(aps, p.CustomFields)
+// Same as Marshal, but with the json indented for reading (see json.Indent)
+// The size limit and truncation apply to the compact form that is sent,
+// so whether this succeeds, and what is truncated, matches Marshal exactly
+func (p *Payload) MarshalIndent(maxPayloadSize int, prefix, indent string) ([]byte, error) {
+	jsonStr, err := p.Marshal(maxPayloadSize)
 	if err != nil {
 		return nil, err
 	}
+	var buffer bytes.Buffer
+	if err := json.Indent(&buffer, jsonStr, prefix, indent); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
 
-	jsonStr, err = json.Marshal(fullPayload)
+// The payload as indented json for logging, using the max payload size for
+// its PushType. If it can't be marshaled the error is returned in its place
+func (p *Payload) PrettyString() string {
+	jsonStr, err := p.MarshalIndent(p.MaxPayloadSize(), "", "  ")
 	if err != nil {
-		return nil, err
+		return fmt.Sprintf("<invalid payload: %v>", err)
 	}
+	return string(jsonStr)
+}
 
-	payloadLen := len(jsonStr)
+// Returns the max number of bytes Apple allows for the payload's PushType
+// Note that the binary gateway has its own lower limit (MaxPayloadSizeBinary)
+// which the APNSConnection applies through APNSConfig.MaxPayloadSize
+func (p *Payload) MaxPayloadSize() int {
+	if p.PushType == PushTypeVoIP {
+		return MaxPayloadSizeVoIP
+	}
+	return MaxPayloadSizeAlert
+}
 
-	if payloadLen > maxPayloadSize {
-		clipSize := payloadLen - (maxPayloadSize) + 3 //need extra characters for ellipse
-		if clipSize > len(p.AlertText) {
-			return nil, errors.New(fmt.Sprintf("Payload was too long to successfully marshall to less than %v", maxPayloadSize))
+// Returns the number of bytes the payload will marshal to before any
+// truncation is applied. This is exact: if it is <= maxPayloadSize then
+// Marshal(maxPayloadSize) will return exactly this many bytes, otherwise
+// Marshal will attempt to truncate the alert text to fit.
+func (p *Payload) Size() (int, error) {
+	if p.RawPayload != nil {
+		if err := p.validateRawPayload(); err != nil {
+			return 0, err
 		}
-		aps.Alert = aps.Alert[:len(aps.Alert)-clipSize] + "..."
-		fullPayload["aps"] = aps
-		if err != nil {
-			return nil, err
+		return len(p.RawPayload), nil
+	}
+	if !p.SanitizeUTF8 {
+		if err := p.validateUTF8(); err != nil {
+			return 0, err
 		}
+	}
+	aps, err := p.aps()
+	if err != nil {
+		return 0, err
+	}
+	jsonStr, err := marshalFullPayload(aps, p.CustomFields, !p.DisableHTMLEscaping)
+	if err != nil {
+		return 0, err
+	}
+	return len(jsonStr), nil
+}
 
-		jsonStr, err = json.Marshal(fullPayload)
+//Build the aps object used for the payload
+//Returns an error if the payload's ApsOverride can't be used
+func (p *Payload) aps() (apsJsonWriter, error) {
+	if p.ApsOverride != nil {
+		override, err := p.marshalApsOverride()
 		if err != nil {
 			return nil, err
 		}
+		return override, nil
 	}
-
-	return jsonStr, nil
+	if p.isSimple() {
+		aps := p.simpleAps()
+		return &aps, nil
+	}
+	aps := p.alertBodyAps()
+	return &aps, nil
 }
 
-//Handle complet payload case with alert object
-//Handle truncating of alert text if too long for maxPayloadSize
-func (p *Payload) marshalAlertBodyPayload(maxPayloadSize int) ([]byte, error) {
-	var jsonStr []byte
+// Returns PushType, or when it isn't set the type apple expects for the
+// payload: PushTypeBackground for a content available only push,
+// otherwise PushTypeAlert
+func (p *Payload) ResolvedPushType() PushType {
+	if p.PushType != "" {
+		return p.PushType
+	}
+	if p.isBackgroundOnly() {
+		return PushTypeBackground
+	}
+	return PushTypeAlert
+}
 
-	// Use APSAlertBody payload
-	aps := alertBodyAps{
-		Alert:            p.AlertBody,
-		Badge:            p.Badge,
-		Sound:            p.Sound,
-		Category:         p.Category,
-		ContentAvailable: p.ContentAvailable,
+//Whether there's nothing for apple to deliver, see ErrEmptyPayload
+func (p *Payload) isEmpty() bool {
+	if p.ApsOverride != nil {
+		return false
+	}
+	if p.PushType == PushTypeVoIP || p.PushType == PushTypeMDM || p.PushType == PushTypeLocation {
+		return false
 	}
+	return p.AlertText == "" && p.AlertBody.isEmpty() && !p.Badge.IsSet() && p.Sound == "" &&
+		p.ContentAvailable == 0 && len(p.CustomFields) == 0
+}
+
+//Whether this is a background push, with content available and nothing
+//shown to the user
+func (p *Payload) isBackgroundOnly() bool {
+	return p.ApsOverride == nil && p.ContentAvailable != 0 && p.AlertText == "" && p.AlertBody.isEmpty() &&
+		!p.Badge.IsSet() && p.Sound == ""
+}
 
-	fullPayload, err := constructFullPayload(aps, p.CustomFields)
+//Whether or not to use simple aps format or not
+//Payloads without any alert use it too, so no empty alert is sent, as do
+//alert bodies with only a Body, sent as the shorter plain string
+func (p *Payload) isSimple() bool {
+	return p.AlertText != "" || p.AlertBody.isEmpty() || p.AlertBody.isBodyOnly()
+}
+
+// Scratch space used to write the full payload
+type fullPayloadState struct {
+	buffer bytes.Buffer
+	//encodes custom field values straight into buffer
+	encoder *json.Encoder
+	keys    []string
+}
+
+// Pool of write state so repeated marshals reuse their buffers.
+// Nothing from a payload is kept once the state is returned to the pool
+var fullPayloadPool = sync.Pool{
+	New: func() interface{} {
+		state := new(fullPayloadState)
+		state.encoder = json.NewEncoder(&state.buffer)
+		return state
+	},
+}
+
+//Helper method to marshal the aps object + custom fields into json
+//will return error if custom field named aps supplied
+func marshalFullPayload(aps apsJsonWriter, customFields map[string]interface{}, escapeHTML bool) ([]byte, error) {
+	jsonStr, err := appendFullPayload(nil, aps, customFields, escapeHTML, math.MaxInt32)
 	if err != nil {
 		return nil, err
 	}
+	return jsonStr, nil
+}
 
-	jsonStr, err = json.Marshal(fullPayload)
-	if err != nil {
-		return nil, err
+//Append the json for the aps object + custom fields to dst
+//The output is deterministic: aps first, then the custom fields in sorted key order
+//The aps object is written directly, only custom field values go through encoding/json
+//escapeHTML controls whether <, > and & are escaped in custom fields
+//If it is longer than maxPayloadSize the alert text is clipped to fit,
+//without encoding anything a second time
+func appendFullPayload(dst []byte, aps apsJsonWriter, customFields map[string]interface{}, escapeHTML bool, maxPayloadSize int) ([]byte, error) {
+	if _, ok := customFields["aps"]; ok {
+		return dst, errors.New("Cannot have a custom field named aps")
 	}
+	if err := validateRawCustomFields(customFields); err != nil {
+		return dst, err
+	}
+
+	state := fullPayloadPool.Get().(*fullPayloadState)
+	defer func() {
+		state.buffer.Reset()
+		state.keys = state.keys[:0]
+		fullPayloadPool.Put(state)
+	}()
 
-	payloadLen := len(jsonStr)
+	state.buffer.WriteString(`{"aps":`)
+	alert := aps.writeJson(&state.buffer)
 
-	if payloadLen > maxPayloadSize {
-		clipSize := payloadLen - (maxPayloadSize) + 3 //need extra characters for ellipse
-		if clipSize > len(p.AlertBody.Body) {
-			return nil, errors.New(fmt.Sprintf("Payload was too long to successfully marshall to less than %v", maxPayloadSize))
+	if len(customFields) > 0 {
+		for key := range customFields {
+			state.keys = append(state.keys, key)
 		}
-		aps.Alert.Body = aps.Alert.Body[:len(aps.Alert.Body)-clipSize] + "..."
-		fullPayload["aps"] = aps
-		if err != nil {
-			return nil, err
+		sort.Strings(state.keys)
+		state.encoder.SetEscapeHTML(escapeHTML)
+
+		for _, key := range state.keys {
+			state.buffer.WriteByte(',')
+			writeJsonStringEscaping(&state.buffer, key, escapeHTML)
+			state.buffer.WriteByte(':')
+			if err := state.encoder.Encode(customFields[key]); err != nil {
+				return dst, customFieldsError(customFields, err)
+			}
+			//drop the newline Encode adds
+			state.buffer.Truncate(state.buffer.Len() - 1)
 		}
+	}
+	state.buffer.WriteByte('}')
 
-		jsonStr, err = json.Marshal(fullPayload)
-		if err != nil {
-			return nil, err
-		}
+	jsonStr := state.buffer.Bytes()
+	if len(jsonStr) <= maxPayloadSize {
+		return append(dst, jsonStr...), nil
 	}
 
-	return jsonStr, nil
+	//everything but the alert text stays as written, so the alert gets
+	//whatever space is left over once the ellipse is added
+	if alert.start < 0 {
+		return dst, payloadTooLongError(maxPayloadSize)
+	}
+	budget := maxPayloadSize - (len(jsonStr) - (alert.end - alert.start)) - 3
+	if budget < 0 {
+		return dst, payloadTooLongError(maxPayloadSize)
+	}
+	//escaping doesn't depend on what comes before, so the clipped alert
+	//encodes to a prefix of what was already written
+	_, encodedLen := clipJsonString(alert.text, budget)
+	dst = append(dst, jsonStr[:alert.start+encodedLen]...)
+	dst = append(dst, "..."...)
+	return append(dst, jsonStr[alert.end:]...), nil
+}
+
+//Make sure a raw payload isn't mixed with fields that would be ignored
+//and that it is well formed json
+func (p *Payload) validateRawPayload() error {
+	if p.AlertText != "" || !p.AlertBody.isEmpty() || p.Badge.IsSet() || p.Sound != "" ||
+		p.Category != "" || p.ContentAvailable != 0 || len(p.CustomFields) > 0 || p.ApsOverride != nil {
+		return errors.New("Cannot set RawPayload along with alert, badge, sound, category, content available, custom fields, or ApsOverride")
+	}
+	if !json.Valid(p.RawPayload) {
+		return errors.New("RawPayload is not valid json")
+	}
+	return nil
+}
+
+//Handle a pre-marshaled payload, returned as a copy so changing the result
+//can't change the payload
+//No truncation is attempted if it is too long for maxPayloadSize
+func (p *Payload) marshalRawPayload(maxPayloadSize int) ([]byte, error) {
+	if err := p.validateRawPayload(); err != nil {
+		return nil, err
+	}
+	if len(p.RawPayload) > maxPayloadSize {
+		return nil, payloadTooLongError(maxPayloadSize)
+	}
+	return append([]byte(nil), p.RawPayload...), nil
+}
+
+//Error returned when a payload cannot fit into maxPayloadSize
+func payloadTooLongError(maxPayloadSize int) error {
+	return errors.New(fmt.Sprintf("Payload was too long to successfully marshall to less than %v", maxPayloadSize))
+}
+
+//Build the aps object for a simple text alert
+func (p *Payload) simpleAps() simpleAps {
+	alert := p.AlertText
+	if alert == "" {
+		alert = p.AlertBody.Body
+	}
+	return simpleAps{
+		Alert:            alert,
+		Badge:            p.Badge,
+		Sound:            p.Sound,
+		Category:         p.Category,
+		ContentAvailable: p.ContentAvailable,
+	}
+}
+
+//Build the aps object for an alert body
+func (p *Payload) alertBodyAps() alertBodyAps {
+	return alertBodyAps{
+		Alert:            p.AlertBody,
+		Badge:            p.Badge,
+		Sound:            p.Sound,
+		Category:         p.Category,
+		ContentAvailable: p.ContentAvailable,
+	}
+}
+
+//Make sure any json.RawMessage custom fields are valid json so they
+//can be embedded verbatim
+func validateRawCustomFields(customFields map[string]interface{}) error {
+	for key, value := range customFields {
+		var raw json.RawMessage
+		switch v := value.(type) {
+		case json.RawMessage:
+			raw = v
+		case *json.RawMessage:
+			if v == nil {
+				continue
+			}
+			raw = *v
+		default:
+			continue
+		}
+		if !json.Valid(raw) {
+			return errors.New(fmt.Sprintf("Custom field %q is not valid json", key))
+		}
+	}
+	return nil
 }
 
 func (s simpleAps) MarshalJSON() ([]byte, error) {
@@ -0,0 +1,156 @@
+package apns
+
+// Builds up a Payload one field at a time, e.g.
+//
+//	payload, err := apns.NewPayload(token).Alert("hi").Badge(3).Custom("k", v).Build()
+//
+// Whether the alert is sent as simple text or as an alert body is worked
+// out by Build: text alone is sent as AlertText, while setting any other
+// alert field (Title, LocKey, ...) sends the text as AlertBody.Body
+// A builder shouldn't be used again after Build
+type PayloadBuilder struct {
+	payload      Payload
+	alert        string
+	customFields map[string]interface{}
+}
+
+// Start building a payload for the device token
+func NewPayload(token string) *PayloadBuilder {
+	return &PayloadBuilder{payload: Payload{Token: token}}
+}
+
+// Text of the alert
+func (b *PayloadBuilder) Alert(text string) *PayloadBuilder {
+	b.alert = text
+	return b
+}
+
+func (b *PayloadBuilder) Title(title string) *PayloadBuilder {
+	b.payload.AlertBody.Title = title
+	return b
+}
+
+func (b *PayloadBuilder) TitleLocKey(key string) *PayloadBuilder {
+	b.payload.AlertBody.TitleLocKey = key
+	return b
+}
+
+func (b *PayloadBuilder) TitleLocArgs(args ...string) *PayloadBuilder {
+	b.payload.AlertBody.TitleLocArgs = args
+	return b
+}
+
+func (b *PayloadBuilder) LocKey(key string) *PayloadBuilder {
+	b.payload.AlertBody.LocKey = key
+	return b
+}
+
+func (b *PayloadBuilder) LocArgs(args ...string) *PayloadBuilder {
+	b.payload.AlertBody.LocArgs = args
+	return b
+}
+
+func (b *PayloadBuilder) ActionLocKey(key string) *PayloadBuilder {
+	b.payload.AlertBody.ActionLocKey = key
+	return b
+}
+
+func (b *PayloadBuilder) LaunchImage(image string) *PayloadBuilder {
+	b.payload.AlertBody.LaunchImage = image
+	return b
+}
+
+func (b *PayloadBuilder) Badge(badge int) *PayloadBuilder {
+	b.payload.Badge = NewBadgeNumber(badge)
+	return b
+}
+
+func (b *PayloadBuilder) Sound(sound string) *PayloadBuilder {
+	b.payload.Sound = sound
+	return b
+}
+
+func (b *PayloadBuilder) Category(category string) *PayloadBuilder {
+	b.payload.Category = category
+	return b
+}
+
+// Mark the push as having new content for a background fetch
+func (b *PayloadBuilder) ContentAvailable() *PayloadBuilder {
+	b.payload.ContentAvailable = 1
+	return b
+}
+
+// Add a custom field outside of the aps namespace, setting the same key
+// again replaces the value
+func (b *PayloadBuilder) Custom(key string, value interface{}) *PayloadBuilder {
+	if b.customFields == nil {
+		b.customFields = make(map[string]interface{})
+	}
+	b.customFields[key] = value
+	return b
+}
+
+// One of the Priority constants
+func (b *PayloadBuilder) Priority(priority uint8) *PayloadBuilder {
+	b.payload.Priority = priority
+	return b
+}
+
+// UNIX time in seconds when the payload is invalid
+func (b *PayloadBuilder) ExpirationTime(expirationTime uint32) *PayloadBuilder {
+	b.payload.ExpirationTime = expirationTime
+	return b
+}
+
+// Show only the latest notification with the same collapse id, HTTP/2 only
+func (b *PayloadBuilder) CollapseId(collapseId string) *PayloadBuilder {
+	b.payload.CollapseId = collapseId
+	return b
+}
+
+// UUID sent as apns-id, HTTP/2 only
+func (b *PayloadBuilder) ApnsId(apnsId string) *PayloadBuilder {
+	b.payload.ApnsId = apnsId
+	return b
+}
+
+// Bundle id sent as apns-topic, HTTP/2 only
+func (b *PayloadBuilder) Topic(topic string) *PayloadBuilder {
+	b.payload.Topic = topic
+	return b
+}
+
+// Broadcast channel to send to instead of a device, HTTP/2 only
+// Use with an empty token
+func (b *PayloadBuilder) ChannelId(channelId string) *PayloadBuilder {
+	b.payload.ChannelId = channelId
+	return b
+}
+
+func (b *PayloadBuilder) PushType(pushType PushType) *PayloadBuilder {
+	b.payload.PushType = pushType
+	return b
+}
+
+// Data held onto for error cases, never sent to apple
+func (b *PayloadBuilder) ExtraData(extraData interface{}) *PayloadBuilder {
+	b.payload.ExtraData = extraData
+	return b
+}
+
+// Resolve the alert format and validate the payload (see Payload.Validate)
+func (b *PayloadBuilder) Build() (*Payload, error) {
+	p := b.payload
+	if p.AlertBody.isEmpty() {
+		p.AlertText = b.alert
+	} else {
+		p.AlertBody.Body = b.alert
+	}
+	p.CustomFields = b.customFields
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
@@ -0,0 +1,91 @@
+package apns
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const builderTestToken = "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8d"
+
+func TestBuilderSimpleAlert(t *testing.T) {
+	p, err := NewPayload(builderTestToken).Alert("hi").Badge(3).Sound("default").
+		Custom("k", "v").Priority(10).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Payload{
+		Token:        builderTestToken,
+		AlertText:    "hi",
+		Badge:        NewBadgeNumber(3),
+		Sound:        "default",
+		CustomFields: map[string]interface{}{"k": "v"},
+		Priority:     10,
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Error(fmt.Sprintf("Expected %+v but got %+v", expected, p))
+	}
+}
+
+func TestBuilderShouldPromoteToAlertBody(t *testing.T) {
+	//order of the calls doesn't matter
+	for _, b := range []*PayloadBuilder{
+		NewPayload(builderTestToken).Alert("hi").LocKey("GREETING %@ %@").LocArgs("a", "b"),
+		NewPayload(builderTestToken).LocKey("GREETING %@ %@").LocArgs("a", "b").Alert("hi"),
+	} {
+		p, err := b.Title("t").Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.AlertText != "" {
+			t.Error(fmt.Sprintf("Expected no AlertText but got %v", p.AlertText))
+		}
+		expected := APSAlertBody{Body: "hi", Title: "t", LocKey: "GREETING %@ %@", LocArgs: []string{"a", "b"}}
+		if !reflect.DeepEqual(p.AlertBody, expected) {
+			t.Error(fmt.Sprintf("Expected %+v but got %+v", expected, p.AlertBody))
+		}
+	}
+}
+
+func TestBuilderMarshalsLikeStruct(t *testing.T) {
+	p, err := NewPayload(builderTestToken).Alert("hi").Title("t").ContentAvailable().Category("c").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	json, _ := p.Marshal(256)
+	expectedJson := `{"aps":{"alert":{"body":"hi","title":"t"},"category":"c","content-available":1}}`
+	if string(json) != expectedJson {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expectedJson, string(json)))
+	}
+}
+
+func TestBuilderCustomApsShouldError(t *testing.T) {
+	_, err := NewPayload(builderTestToken).Alert("hi").Custom("aps", 1).Build()
+	if err == nil || !strings.Contains(err.Error(), "aps") {
+		t.Error(fmt.Sprintf("Expected error for a custom field named aps but got %v", err))
+	}
+}
+
+func TestBuilderShouldListEveryProblem(t *testing.T) {
+	_, err := NewPayload("not hex").Alert("hi").Priority(7).Custom("bad", make(chan int)).Build()
+	if err == nil {
+		t.Fatal("Expected invalid payload")
+	}
+	for _, expected := range []string{"token", "priority", `"bad"`} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Error(fmt.Sprintf("Expected %q in error %v", expected, err))
+		}
+	}
+}
+
+func TestBuilderCustomShouldReplaceKey(t *testing.T) {
+	p, err := NewPayload(builderTestToken).Custom("k", 1).Custom("k", 2).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.CustomFields) != 1 || p.CustomFields["k"] != 2 {
+		t.Error(fmt.Sprintf("Expected latest custom value but got %v", p.CustomFields))
+	}
+}
@@ -0,0 +1,84 @@
+package apns
+
+import (
+	"reflect"
+)
+
+// ExtraData values implementing this are copied by Clone, otherwise the
+// clone shares the same ExtraData value
+type ExtraDataCloner interface {
+	CloneExtraData() interface{}
+}
+
+// Returns a deep copy of the payload that can be modified without
+// affecting the original, e.g. to send a template payload to many tokens
+// CustomFields are copied along with any maps and slices nested inside
+// them, as are the alert body arg slices, RawPayload and a RawAps
+// ApsOverride. Pointers and
+// struct values inside custom fields are copied shallowly. ExtraData is
+// shared unless it implements ExtraDataCloner
+func (p *Payload) Clone() *Payload {
+	clone := *p
+	clone.AlertBody.LocArgs = cloneStrings(p.AlertBody.LocArgs)
+	clone.AlertBody.TitleLocArgs = cloneStrings(p.AlertBody.TitleLocArgs)
+	if p.CustomFields != nil {
+		clone.CustomFields = cloneValue(reflect.ValueOf(p.CustomFields)).Interface().(map[string]interface{})
+	}
+	if p.RawPayload != nil {
+		clone.RawPayload = append([]byte{}, p.RawPayload...)
+	}
+	if raw, ok := p.ApsOverride.(RawAps); ok && raw != nil {
+		clone.ApsOverride = append(RawAps{}, raw...)
+	}
+	if cloner, ok := p.ExtraData.(ExtraDataCloner); ok {
+		clone.ExtraData = cloner.CloneExtraData()
+	}
+	return &clone
+}
+
+func cloneStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	return append([]string{}, values...)
+}
+
+// Copy maps, slices and arrays all the way down, anything else as is
+func cloneValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		clone := reflect.New(v.Type()).Elem()
+		clone.Set(cloneValue(v.Elem()))
+		return clone
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		clone := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			clone.SetMapIndex(iter.Key(), cloneValue(iter.Value()))
+		}
+		return clone
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		clone := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			clone.Index(i).Set(cloneValue(v.Index(i)))
+		}
+		return clone
+	case reflect.Array:
+		clone := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			clone.Index(i).Set(cloneValue(v.Index(i)))
+		}
+		return clone
+	default:
+		return v
+	}
+}
@@ -0,0 +1,95 @@
+package apns
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func cloneTestPayload() *Payload {
+	return &Payload{
+		Token:     "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8d",
+		AlertBody: APSAlertBody{Body: "Testing", LocArgs: []string{"a", "b"}, TitleLocArgs: []string{"t"}},
+		Badge:     NewBadgeNumber(2),
+		CustomFields: map[string]interface{}{
+			"num":    55,
+			"nested": map[string]interface{}{"list": []interface{}{"x", map[string]interface{}{"deep": 1}}},
+			"ints":   []int{1, 2, 3},
+			"raw":    json.RawMessage(`{"a":1}`),
+		},
+	}
+}
+
+func TestCloneShouldEqualOriginal(t *testing.T) {
+	p := cloneTestPayload()
+	clone := p.Clone()
+	if !reflect.DeepEqual(p, clone) {
+		t.Error(fmt.Sprintf("Expected %+v but got %+v", p, clone))
+	}
+
+	original, _ := p.Marshal(256)
+	cloned, _ := clone.Marshal(256)
+	if string(original) != string(cloned) {
+		t.Error(fmt.Sprintf("Expected %v but got %v", string(original), string(cloned)))
+	}
+}
+
+func TestMutatingCloneShouldNotAffectOriginal(t *testing.T) {
+	p := cloneTestPayload()
+	expected, _ := p.Marshal(256)
+
+	clone := p.Clone()
+	clone.Token = "00"
+	clone.Badge = NewBadgeNumber(9)
+	clone.AlertBody.LocArgs[0] = "changed"
+	clone.AlertBody.TitleLocArgs[0] = "changed"
+	clone.CustomFields["num"] = 1
+	clone.CustomFields["added"] = true
+	nested := clone.CustomFields["nested"].(map[string]interface{})
+	nested["added"] = true
+	list := nested["list"].([]interface{})
+	list[0] = "changed"
+	list[1].(map[string]interface{})["deep"] = 2
+	clone.CustomFields["ints"].([]int)[0] = 100
+	clone.CustomFields["raw"].(json.RawMessage)[1] = 'b'
+
+	if p.Token != cloneTestPayload().Token || p.Badge.Number() != 2 {
+		t.Error("Expected original token and badge to be untouched")
+	}
+	if actual, _ := p.Marshal(256); string(actual) != string(expected) {
+		t.Error(fmt.Sprintf("Expected original to be untouched %v but got %v", string(expected), string(actual)))
+	}
+}
+
+func TestCloneNilFields(t *testing.T) {
+	p := &Payload{AlertText: "Testing"}
+	clone := p.Clone()
+	if clone.CustomFields != nil || clone.AlertBody.LocArgs != nil || clone.RawPayload != nil {
+		t.Error(fmt.Sprintf("Expected nil fields to stay nil but got %+v", clone))
+	}
+}
+
+type testClonableExtraData struct {
+	values []int
+}
+
+func (d *testClonableExtraData) CloneExtraData() interface{} {
+	return &testClonableExtraData{values: append([]int{}, d.values...)}
+}
+
+func TestCloneExtraData(t *testing.T) {
+	shared := &struct{ value int }{1}
+	p := &Payload{ExtraData: shared}
+	if p.Clone().ExtraData != shared {
+		t.Error("Expected ExtraData to be shared when it can't be cloned")
+	}
+
+	clonable := &testClonableExtraData{values: []int{1}}
+	p.ExtraData = clonable
+	clone := p.Clone().ExtraData.(*testClonableExtraData)
+	clone.values[0] = 2
+	if clone == clonable || clonable.values[0] != 1 {
+		t.Error("Expected ExtraData to be cloned with CloneExtraData")
+	}
+}
@@ -0,0 +1,174 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Every field of a Payload, as encoded by EncodePayload
+type encodedPayload struct {
+	AlertText           string                     `json:"alert_text,omitempty"`
+	Badge               *int                       `json:"badge,omitempty"`
+	Sound               string                     `json:"sound,omitempty"`
+	ContentAvailable    int                        `json:"content_available,omitempty"`
+	Category            string                     `json:"category,omitempty"`
+	AlertBody           *APSAlertBody              `json:"alert_body,omitempty"`
+	CustomFields        map[string]json.RawMessage `json:"custom_fields,omitempty"`
+	DisableHTMLEscaping bool                       `json:"disable_html_escaping,omitempty"`
+	SanitizeUTF8        bool                       `json:"sanitize_utf8,omitempty"`
+	ExpirationTime      uint32                     `json:"expiration,omitempty"`
+	Priority            uint8                      `json:"priority,omitempty"`
+	Token               string                     `json:"token,omitempty"`
+	CollapseId          string                     `json:"collapse_id,omitempty"`
+	ApnsId              string                     `json:"apns_id,omitempty"`
+	PushType            PushType                   `json:"push_type,omitempty"`
+	Topic               string                     `json:"topic,omitempty"`
+	ChannelId           string                     `json:"channel_id,omitempty"`
+	RawPayload          []byte                     `json:"raw_payload,omitempty"`
+	ApsOverride         json.RawMessage            `json:"aps_override,omitempty"`
+	ExtraData           []byte                     `json:"extra_data,omitempty"`
+}
+
+// Serialize every field of a payload, e.g. to put it on a durable queue,
+// to be rebuilt with DecodePayload. This isn't what's sent to apple, see
+// Marshal for that
+// ExtraData is encoded with codec (which may be the one set as
+// APNSConfig.ExtraDataCodec), and left out if codec is nil
+// Returns an error if a custom field, ApsOverride or ExtraData can't be
+// encoded
+func EncodePayload(payload *Payload, codec ExtraDataCodec) ([]byte, error) {
+	encoded := encodedPayload{
+		AlertText:           payload.AlertText,
+		Sound:               payload.Sound,
+		ContentAvailable:    payload.ContentAvailable,
+		Category:            payload.Category,
+		DisableHTMLEscaping: payload.DisableHTMLEscaping,
+		SanitizeUTF8:        payload.SanitizeUTF8,
+		ExpirationTime:      payload.ExpirationTime,
+		Priority:            payload.Priority,
+		Token:               payload.Token,
+		CollapseId:          payload.CollapseId,
+		ApnsId:              payload.ApnsId,
+		PushType:            payload.PushType,
+		Topic:               payload.Topic,
+		ChannelId:           payload.ChannelId,
+		RawPayload:          payload.RawPayload,
+	}
+	if payload.Badge.IsSet() {
+		badge := payload.Badge.Number()
+		encoded.Badge = &badge
+	}
+	if !payload.AlertBody.isEmpty() {
+		encoded.AlertBody = &payload.AlertBody
+	}
+	if payload.CustomFields != nil {
+		encoded.CustomFields = make(map[string]json.RawMessage, len(payload.CustomFields))
+		for key, value := range payload.CustomFields {
+			valueJson, err := json.Marshal(value)
+			if err != nil {
+				return nil, customFieldsError(payload.CustomFields, err)
+			}
+			encoded.CustomFields[key] = valueJson
+		}
+	}
+	if payload.ApsOverride != nil {
+		apsJson, err := payload.ApsOverride.MarshalAps()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to marshal ApsOverride: %v", err))
+		}
+		encoded.ApsOverride = apsJson
+	}
+	if payload.ExtraData != nil && codec != nil {
+		extraData, err := codec.EncodeExtraData(payload.ExtraData)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to encode ExtraData: %v", err))
+		}
+		encoded.ExtraData = extraData
+	}
+	return json.Marshal(&encoded)
+}
+
+// Rebuild a payload serialized by EncodePayload
+// Custom fields come back as encoding/json decodes them, with numbers as
+// json.Number so none lose precision, and marshal to the same json
+// An ApsOverride comes back as the RawAps it marshaled to
+// ExtraData is decoded with codec, and left nil if codec is nil
+func DecodePayload(data []byte, codec ExtraDataCodec) (*Payload, error) {
+	encoded := encodedPayload{}
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to decode payload: %v", err))
+	}
+	payload := &Payload{
+		AlertText:           encoded.AlertText,
+		Sound:               encoded.Sound,
+		ContentAvailable:    encoded.ContentAvailable,
+		Category:            encoded.Category,
+		DisableHTMLEscaping: encoded.DisableHTMLEscaping,
+		SanitizeUTF8:        encoded.SanitizeUTF8,
+		ExpirationTime:      encoded.ExpirationTime,
+		Priority:            encoded.Priority,
+		Token:               encoded.Token,
+		CollapseId:          encoded.CollapseId,
+		ApnsId:              encoded.ApnsId,
+		PushType:            encoded.PushType,
+		Topic:               encoded.Topic,
+		ChannelId:           encoded.ChannelId,
+		RawPayload:          encoded.RawPayload,
+	}
+	if encoded.Badge != nil {
+		payload.Badge = NewBadgeNumber(*encoded.Badge)
+	}
+	if encoded.AlertBody != nil {
+		payload.AlertBody = *encoded.AlertBody
+	}
+	if encoded.CustomFields != nil {
+		payload.CustomFields = make(map[string]interface{}, len(encoded.CustomFields))
+		for key, valueJson := range encoded.CustomFields {
+			decoder := json.NewDecoder(bytes.NewReader(valueJson))
+			decoder.UseNumber()
+			var value interface{}
+			if err := decoder.Decode(&value); err != nil {
+				return nil, errors.New(fmt.Sprintf("Failed to decode custom field %q: %v", key, err))
+			}
+			payload.CustomFields[key] = value
+		}
+	}
+	if encoded.ApsOverride != nil {
+		payload.ApsOverride = RawAps(encoded.ApsOverride)
+	}
+	if encoded.ExtraData != nil && codec != nil {
+		extraData, err := codec.DecodeExtraData(encoded.ExtraData)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to decode ExtraData: %v", err))
+		}
+		payload.ExtraData = extraData
+	}
+	return payload, nil
+}
+
+// Encodes every field but ExtraData, as EncodePayload does without a
+// codec, so payloads can be passed to encoding/json as is
+func (p *Payload) MarshalJSON() ([]byte, error) {
+	return EncodePayload(p, nil)
+}
+
+func (p *Payload) UnmarshalJSON(data []byte) error {
+	payload, err := DecodePayload(data, nil)
+	if err != nil {
+		return err
+	}
+	*p = *payload
+	return nil
+}
+
+// Encodes every field but ExtraData, as MarshalJSON does, so payloads can
+// be passed to encoding/gob without registering custom field types
+func (p *Payload) GobEncode() ([]byte, error) {
+	return EncodePayload(p, nil)
+}
+
+func (p *Payload) GobDecode(data []byte) error {
+	return p.UnmarshalJSON(data)
+}
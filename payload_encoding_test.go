@@ -0,0 +1,146 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A payload with every field set, other than RawPayload which can't be
+// combined with the others
+func fullEncodingTestPayload() *Payload {
+	return &Payload{
+		AlertText:        "Testing",
+		Badge:            NewBadgeNumber(0),
+		Sound:            "default",
+		ContentAvailable: 1,
+		Category:         "c",
+		AlertBody: APSAlertBody{
+			Body: "b", ActionLocKey: "a", LocKey: "l %@", LocArgs: []string{"x"}, LaunchImage: "i",
+			Title: "t", TitleLocKey: "tl", TitleLocArgs: []string{"y", "z"},
+		},
+		CustomFields: map[string]interface{}{
+			"s":      "<a&b>",
+			"n":      json.Number("12345678901234567890"),
+			"nested": map[string]interface{}{"list": []interface{}{true, nil, "v"}},
+		},
+		DisableHTMLEscaping: true,
+		SanitizeUTF8:        true,
+		ExpirationTime:      4000000000,
+		Priority:            PriorityThrottled,
+		Token:               builderTestToken,
+		CollapseId:          "collapse",
+		ApnsId:              "6b4ea8a6-0a1c-4e4f-b8d2-3f6f6d2b6e1a",
+		PushType:            PushTypeAlert,
+		Topic:               "com.example.app",
+		ChannelId:           "ZGF0YQ==",
+		ExtraData:           "extra",
+	}
+}
+
+func withoutExtraData(p *Payload) *Payload {
+	clone := *p
+	clone.ExtraData = nil
+	return &clone
+}
+
+func TestPayloadShouldRoundTripJSON(t *testing.T) {
+	payloads := []*Payload{fullEncodingTestPayload(), {Token: builderTestToken, RawPayload: []byte(`{"aps":{}}`)}, {}}
+	for _, payload := range payloads {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := &Payload{}
+		if err := json.Unmarshal(data, decoded); err != nil {
+			t.Fatal(err)
+		}
+		if expected := withoutExtraData(payload); !reflect.DeepEqual(decoded, expected) {
+			t.Error(fmt.Sprintf("Expected %#v but got %#v", expected, decoded))
+		}
+	}
+}
+
+func TestPayloadShouldRoundTripGob(t *testing.T) {
+	payloads := []*Payload{fullEncodingTestPayload(), {Token: builderTestToken, RawPayload: []byte(`{"aps":{}}`)}, {}}
+	buffer := new(bytes.Buffer)
+	encoder := gob.NewEncoder(buffer)
+	for _, payload := range payloads {
+		if err := encoder.Encode(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decoder := gob.NewDecoder(buffer)
+	for _, payload := range payloads {
+		decoded := &Payload{}
+		if err := decoder.Decode(decoded); err != nil {
+			t.Fatal(err)
+		}
+		if expected := withoutExtraData(payload); !reflect.DeepEqual(decoded, expected) {
+			t.Error(fmt.Sprintf("Expected %#v but got %#v", expected, decoded))
+		}
+	}
+}
+
+func TestDecodedPayloadShouldMarshalTheSame(t *testing.T) {
+	payload := fullEncodingTestPayload()
+	payload.CustomFields["n"] = 42
+	payload.CustomFields["raw"] = json.RawMessage(`{"k":[1,2]}`)
+	data, err := EncodePayload(payload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodePayload(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := payload.Marshal(MaxPayloadSizeAlert)
+	if marshaled, _ := decoded.Marshal(MaxPayloadSizeAlert); string(marshaled) != string(expected) {
+		t.Error(fmt.Sprintf("Expected %s but got %s", expected, marshaled))
+	}
+}
+
+type testExtraDataCodec struct{}
+
+func (testExtraDataCodec) EncodeExtraData(extraData interface{}) ([]byte, error) {
+	if s, ok := extraData.(string); ok {
+		return []byte(s), nil
+	}
+	return nil, errors.New("not a string")
+}
+
+func (testExtraDataCodec) DecodeExtraData(data []byte) (interface{}, error) {
+	return string(data), nil
+}
+
+func TestEncodePayloadShouldUseExtraDataCodec(t *testing.T) {
+	payload := fullEncodingTestPayload()
+	data, err := EncodePayload(payload, testExtraDataCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodePayload(data, testExtraDataCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, payload) {
+		t.Error(fmt.Sprintf("Expected %#v but got %#v", payload, decoded))
+	}
+	if decoded, _ := DecodePayload(data, nil); decoded.ExtraData != nil {
+		t.Error(fmt.Sprintf("Expected no ExtraData without a codec but got %v", decoded.ExtraData))
+	}
+
+	payload.ExtraData = 3
+	if _, err := EncodePayload(payload, testExtraDataCodec{}); err == nil || !strings.Contains(err.Error(), "ExtraData") {
+		t.Error(fmt.Sprintf("Expected the ExtraData to fail to encode but got %v", err))
+	}
+	payload.CustomFields["bad"] = make(chan int)
+	if _, err := EncodePayload(payload, nil); err == nil || !strings.Contains(err.Error(), `"bad"`) {
+		t.Error(fmt.Sprintf("Expected the custom field to fail to encode but got %v", err))
+	}
+}
@@ -0,0 +1,61 @@
+package apns
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// Returns a hash of everything about the payload that affects the
+// notification: the token, the marshaled aps and custom fields (before
+// any truncation), expiration, priority, push type, collapse id, topic and channel id.
+// ApnsId and ExtraData are ignored, so resends of a payload match
+// Custom fields are hashed in sorted key order, so the fingerprint doesn't
+// depend on how the map was built and is stable across process restarts
+// and versions of go, making it suitable for deduplicating payloads.
+// Returns an error if the custom fields or ApsOverride can't be marshaled
+func (p *Payload) Fingerprint() (uint64, error) {
+	jsonStr := p.RawPayload
+	if jsonStr == nil {
+		aps, err := p.aps()
+		if err != nil {
+			return 0, err
+		}
+		//escaping doesn't change the meaning, so is always the same here
+		jsonStr, err = marshalFullPayload(aps, p.CustomFields, true)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	hash := fnv.New64a()
+	//lengths keep the fields from running into each other
+	var scratch [8]byte
+	writeField := func(field []byte) {
+		binary.BigEndian.PutUint32(scratch[:4], uint32(len(field)))
+		hash.Write(scratch[:4])
+		hash.Write(field)
+	}
+	writeField([]byte(p.Token))
+	writeField(jsonStr)
+	writeField([]byte(p.PushType))
+	//only when set, so fingerprints from before these fields are unchanged,
+	//each tagged so the same value in another field doesn't match
+	optionalFields := []struct {
+		tag   byte
+		value string
+	}{
+		{'c', p.CollapseId},
+		{'t', p.Topic},
+		{'h', p.ChannelId},
+	}
+	for _, field := range optionalFields {
+		if field.value != "" {
+			writeField([]byte{field.tag})
+			writeField([]byte(field.value))
+		}
+	}
+	binary.BigEndian.PutUint32(scratch[:4], p.ExpirationTime)
+	scratch[4] = p.Priority
+	hash.Write(scratch[:5])
+	return hash.Sum64(), nil
+}
@@ -0,0 +1,100 @@
+package apns
+
+import (
+	"fmt"
+	"testing"
+)
+
+func fingerprintTestPayload() *Payload {
+	return &Payload{
+		Token:          "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8d",
+		AlertText:      "Testing this payload",
+		Badge:          NewBadgeNumber(2),
+		Sound:          "test.aiff",
+		Category:       "category",
+		ExpirationTime: 1500000000,
+		CustomFields:   map[string]interface{}{"a": 1, "b": []string{"x"}, "c": map[string]interface{}{"y": 1, "z": 2}},
+	}
+}
+
+func fingerprint(t *testing.T, p *Payload) uint64 {
+	f, err := p.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFingerprintShouldIgnoreCustomFieldOrder(t *testing.T) {
+	p := fingerprintTestPayload()
+	other := fingerprintTestPayload()
+	other.CustomFields = map[string]interface{}{}
+	for _, key := range []string{"c", "b", "a"} {
+		other.CustomFields[key] = p.CustomFields[key]
+	}
+	other.CustomFields["c"] = map[string]interface{}{"z": 2, "y": 1}
+	other.ExtraData = "ignored"
+
+	for i := 0; i < 10; i++ {
+		if fingerprint(t, p) != fingerprint(t, other) {
+			t.Fatal("Expected payloads differing only in custom field order to have the same fingerprint")
+		}
+	}
+}
+
+func TestFingerprintShouldBeStable(t *testing.T) {
+	//changing this value breaks deduplication across a deploy
+	expected := uint64(0x9cd6a0d71debd5cd)
+	if f := fingerprint(t, fingerprintTestPayload()); f != expected {
+		t.Error(fmt.Sprintf("Expected fingerprint %#x but got %#x", expected, f))
+	}
+}
+
+func TestFingerprintShouldChangeWithContent(t *testing.T) {
+	base := fingerprint(t, fingerprintTestPayload())
+	changes := map[string]func(p *Payload){
+		"token":      func(p *Payload) { p.Token = p.Token[:62] + "00" },
+		"alert":      func(p *Payload) { p.AlertText = "Other" },
+		"badge":      func(p *Payload) { p.Badge = NewBadgeNumber(3) },
+		"no badge":   func(p *Payload) { p.Badge.UnSet() },
+		"sound":      func(p *Payload) { p.Sound = "other.aiff" },
+		"category":   func(p *Payload) { p.Category = "other" },
+		"custom":     func(p *Payload) { p.CustomFields["a"] = 2 },
+		"expiration": func(p *Payload) { p.ExpirationTime++ },
+		"priority":   func(p *Payload) { p.Priority = 10 },
+		"push type":  func(p *Payload) { p.PushType = PushTypeVoIP },
+	}
+	for name, change := range changes {
+		p := fingerprintTestPayload()
+		change(p)
+		if fingerprint(t, p) == base {
+			t.Error(fmt.Sprintf("Expected fingerprint to change with %v", name))
+		}
+	}
+}
+
+func TestFingerprintShouldTellOptionalFieldsApart(t *testing.T) {
+	fields := map[string]func(p *Payload){
+		"collapse id": func(p *Payload) { p.CollapseId = "com.example.app" },
+		"topic":       func(p *Payload) { p.Topic = "com.example.app" },
+		"channel id":  func(p *Payload) { p.ChannelId = "com.example.app" },
+	}
+	seen := map[uint64]string{}
+	for name, set := range fields {
+		p := fingerprintTestPayload()
+		set(p)
+		f := fingerprint(t, p)
+		if other, ok := seen[f]; ok {
+			t.Error(fmt.Sprintf("Expected the same value as the %v and %v to have different fingerprints", name, other))
+		}
+		seen[f] = name
+	}
+}
+
+func TestFingerprintInvalidCustomFieldShouldError(t *testing.T) {
+	p := fingerprintTestPayload()
+	p.CustomFields["aps"] = 1
+	if _, err := p.Fingerprint(); err == nil {
+		t.Error("Expected error for a custom field named aps")
+	}
+}
@@ -0,0 +1,265 @@
+package apns
+
+import (
+	"bytes"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Writes an aps object straight into a buffer, producing the same
+// bytes encoding/json does with the aps MarshalJSON methods
+// Returns where the text that may be truncated to fit was written
+type apsJsonWriter interface {
+	writeJson(buffer *bytes.Buffer) truncatableText
+}
+
+// The alert text within a written payload, which can be clipped to make
+// the payload fit. start and end are the buffer offsets of the encoded
+// text (inside the quotes), both -1 if there is no text to clip
+type truncatableText struct {
+	text  string
+	start int
+	end   int
+}
+
+var noTruncatableText = truncatableText{start: -1, end: -1}
+
+// Writes the comma separated members of a json object
+type jsonObjectWriter struct {
+	buffer *bytes.Buffer
+	count  int
+}
+
+func newJsonObjectWriter(buffer *bytes.Buffer) jsonObjectWriter {
+	buffer.WriteByte('{')
+	return jsonObjectWriter{buffer: buffer}
+}
+
+// Write a key and colon, ready for the value
+func (o *jsonObjectWriter) key(key string) {
+	if o.count > 0 {
+		o.buffer.WriteByte(',')
+	}
+	o.count++
+	writeJsonString(o.buffer, key)
+	o.buffer.WriteByte(':')
+}
+
+func (o *jsonObjectWriter) stringValue(key string, value string) {
+	o.key(key)
+	writeJsonString(o.buffer, value)
+}
+
+// Write text as a json string value, remembering where it went
+func (o *jsonObjectWriter) truncatableValue(key string, text string) truncatableText {
+	o.key(key)
+	start := o.buffer.Len() + 1
+	writeJsonString(o.buffer, text)
+	return truncatableText{text: text, start: start, end: o.buffer.Len() - 1}
+}
+
+func (o *jsonObjectWriter) intValue(key string, value int) {
+	o.key(key)
+	var scratch [20]byte
+	o.buffer.Write(strconv.AppendInt(scratch[:0], int64(value), 10))
+}
+
+func (o *jsonObjectWriter) stringsValue(key string, values []string) {
+	o.key(key)
+	o.buffer.WriteByte('[')
+	for i, value := range values {
+		if i > 0 {
+			o.buffer.WriteByte(',')
+		}
+		writeJsonString(o.buffer, value)
+	}
+	o.buffer.WriteByte(']')
+}
+
+func (o *jsonObjectWriter) close() {
+	o.buffer.WriteByte('}')
+}
+
+// Keys are written in sorted order to match the map based MarshalJSON
+func (s *simpleAps) writeJson(buffer *bytes.Buffer) truncatableText {
+	alert := noTruncatableText
+	o := newJsonObjectWriter(buffer)
+	if s.Alert != "" {
+		alert = o.truncatableValue("alert", s.Alert)
+	}
+	if s.Badge.IsSet() {
+		o.intValue("badge", s.Badge.Number())
+	}
+	if s.Category != "" {
+		o.stringValue("category", s.Category)
+	}
+	if s.ContentAvailable != 0 {
+		o.intValue("content-available", s.ContentAvailable)
+	}
+	if s.Sound != "" {
+		o.stringValue("sound", s.Sound)
+	}
+	o.close()
+	return alert
+}
+
+func (a *alertBodyAps) writeJson(buffer *bytes.Buffer) truncatableText {
+	o := newJsonObjectWriter(buffer)
+	o.key("alert")
+	body := a.Alert.writeJson(buffer)
+	if a.Badge.IsSet() {
+		o.intValue("badge", a.Badge.Number())
+	}
+	if a.Category != "" {
+		o.stringValue("category", a.Category)
+	}
+	if a.ContentAvailable != 0 {
+		o.intValue("content-available", a.ContentAvailable)
+	}
+	if a.Sound != "" {
+		o.stringValue("sound", a.Sound)
+	}
+	o.close()
+	return body
+}
+
+// Fields are written in declaration order, as encoding/json does for structs
+// An empty body is left out, so title or loc-key only alerts don't show a
+// blank line. Returns where the body was written, none when left out
+func (a *APSAlertBody) writeJson(buffer *bytes.Buffer) truncatableText {
+	body := noTruncatableText
+	o := newJsonObjectWriter(buffer)
+	if a.Body != "" {
+		body = o.truncatableValue("body", a.Body)
+	}
+	if a.ActionLocKey != "" {
+		o.stringValue("action-loc-key", a.ActionLocKey)
+	}
+	if a.LocKey != "" {
+		o.stringValue("loc-key", a.LocKey)
+	}
+	if len(a.LocArgs) > 0 {
+		o.stringsValue("loc-args", a.LocArgs)
+	}
+	if a.LaunchImage != "" {
+		o.stringValue("launch-image", a.LaunchImage)
+	}
+	if a.Title != "" {
+		o.stringValue("title", a.Title)
+	}
+	if a.TitleLocKey != "" {
+		o.stringValue("title-loc-key", a.TitleLocKey)
+	}
+	if len(a.TitleLocArgs) > 0 {
+		o.stringsValue("title-loc-args", a.TitleLocArgs)
+	}
+	o.close()
+	return body
+}
+
+const jsonHexDigits = "0123456789abcdef"
+
+// Write s as a json string, escaped exactly as encoding/json does
+// (including html escaping and replacing invalid utf8)
+func writeJsonString(buffer *bytes.Buffer, s string) {
+	writeJsonStringEscaping(buffer, s, true)
+}
+
+// Write s as a json string, escaping <, > and & only if escapeHTML is set,
+// matching a json.Encoder with SetEscapeHTML(escapeHTML)
+func writeJsonStringEscaping(buffer *bytes.Buffer, s string, escapeHTML bool) {
+	buffer.WriteByte('"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && (!escapeHTML || (b != '<' && b != '>' && b != '&')) {
+				i++
+				continue
+			}
+			buffer.WriteString(s[start:i])
+			switch b {
+			case '\\', '"':
+				buffer.WriteByte('\\')
+				buffer.WriteByte(b)
+			case '\b':
+				buffer.WriteString(`\b`)
+			case '\f':
+				buffer.WriteString(`\f`)
+			case '\n':
+				buffer.WriteString(`\n`)
+			case '\r':
+				buffer.WriteString(`\r`)
+			case '\t':
+				buffer.WriteString(`\t`)
+			default:
+				//control characters and <, >, &
+				buffer.WriteString(`\u00`)
+				buffer.WriteByte(jsonHexDigits[b>>4])
+				buffer.WriteByte(jsonHexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			buffer.WriteString(s[start:i])
+			buffer.WriteString("\ufffd")
+			i += size
+			start = i
+			continue
+		}
+		//line and paragraph separators break javascript parsers
+		if c == '\u2028' || c == '\u2029' {
+			buffer.WriteString(s[start:i])
+			buffer.WriteString(`\u202`)
+			buffer.WriteByte(jsonHexDigits[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buffer.WriteString(s[start:])
+	buffer.WriteByte('"')
+}
+
+// Number of bytes a character takes once escaped by writeJsonString,
+// given the first byte of s and the size of the character it starts
+func jsonEncodedCharLen(s string) (encodedLen int, size int) {
+	if b := s[0]; b < utf8.RuneSelf {
+		switch {
+		case b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&':
+			return 1, 1
+		case b == '"' || b == '\\' || b == '\b' || b == '\f' || b == '\n' || b == '\r' || b == '\t':
+			return 2, 1
+		default:
+			return 6, 1
+		}
+	}
+	c, size := utf8.DecodeRuneInString(s)
+	switch {
+	case c == utf8.RuneError && size == 1:
+		return len("\ufffd"), 1
+	case c == '\u2028' || c == '\u2029':
+		return 6, size
+	default:
+		return size, size
+	}
+}
+
+// Find the longest prefix of s, ending on a character boundary, whose
+// escaped form fits in budget bytes
+// Returns the length of the prefix and of its escaped form
+func clipJsonString(s string, budget int) (int, int) {
+	encodedLen := 0
+	for i := 0; i < len(s); {
+		charLen, size := jsonEncodedCharLen(s[i:])
+		if encodedLen+charLen > budget {
+			return i, encodedLen
+		}
+		encodedLen += charLen
+		i += size
+	}
+	return len(s), encodedLen
+}
@@ -0,0 +1,203 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// The encoding/json based path the payload writer replaced: the aps
+// MarshalJSON methods, then each custom field marshaled in sorted order
+func referenceMarshal(t *testing.T, p *Payload) string {
+	var aps interface{} = p.alertBodyAps()
+	if p.isSimple() {
+		aps = p.simpleAps()
+	}
+	apsJson, err := json.Marshal(aps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	for key := range p.CustomFields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := `{"aps":` + string(apsJson)
+	for _, key := range keys {
+		keyJson, _ := json.Marshal(key)
+		valueJson, err := json.Marshal(p.CustomFields[key])
+		if err != nil {
+			t.Fatal(err)
+		}
+		result += "," + string(keyJson) + ":" + string(valueJson)
+	}
+	return result + "}"
+}
+
+var trickyStrings = []string{
+	"",
+	"plain text",
+	"quotes \" and \\ backslashes",
+	"<html> & entities",
+	"control \x00\x01\x1f\b\f\n\r\t characters",
+	"unicode ünïcødé 日本語 and emoji 😀",
+	"separators   and  ",
+	"invalid utf8 \xff\xfe and truncated \xe6\x97",
+	"\x7f delete",
+}
+
+func TestPayloadWriterMatchesEncodingJsonForSimpleAps(t *testing.T) {
+	for _, s := range trickyStrings {
+		for _, badge := range []BadgeNumber{{}, NewBadgeNumber(0), NewBadgeNumber(-1), NewBadgeNumber(99)} {
+			p := &Payload{
+				AlertText:        "alert " + s,
+				Badge:            badge,
+				Sound:            s,
+				Category:         s,
+				ContentAvailable: len(s) % 2,
+				SanitizeUTF8:     true,
+			}
+			payloadJson, err := p.Marshal(4096)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := referenceMarshal(t, p); string(payloadJson) != expected {
+				t.Error(fmt.Sprintf("Expected %v but got %v", expected, string(payloadJson)))
+			}
+		}
+	}
+}
+
+func TestPayloadWriterMatchesEncodingJsonForAlertBody(t *testing.T) {
+	for _, s := range trickyStrings {
+		p := &Payload{
+			AlertBody: APSAlertBody{
+				Body:         s,
+				ActionLocKey: s,
+				LocKey:       s,
+				LocArgs:      []string{s, "arg"},
+				LaunchImage:  s,
+				Title:        s,
+				TitleLocKey:  s,
+				TitleLocArgs: []string{s},
+			},
+			Badge:        NewBadgeNumber(3),
+			Sound:        s,
+			SanitizeUTF8: true,
+		}
+		payloadJson, err := p.Marshal(4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := referenceMarshal(t, p); string(payloadJson) != expected {
+			t.Error(fmt.Sprintf("Expected %v but got %v", expected, string(payloadJson)))
+		}
+	}
+
+	//no alert at all still writes an empty alert object
+	p := &Payload{ContentAvailable: 1, AlertBody: APSAlertBody{LocArgs: []string{}}}
+	payloadJson, _ := p.Marshal(4096)
+	if expected := referenceMarshal(t, p); string(payloadJson) != expected {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expected, string(payloadJson)))
+	}
+}
+
+func TestPayloadWriterMatchesEncodingJsonForCustomFields(t *testing.T) {
+	raw := json.RawMessage(`{ "spaced" : [1, 2] , "html":"<b>" }`)
+	customFields := map[string]interface{}{
+		"num":     55,
+		"float":   1.5,
+		"nil":     nil,
+		"raw":     raw,
+		"rawPtr":  &raw,
+		"marshal": testMarshalerField{Value: "<x>"},
+		"nested":  map[string]interface{}{"b": []interface{}{"x", 2, true}, "a": trickyStrings},
+		"bytes":   []byte("base64 me"),
+	}
+	for i, s := range trickyStrings {
+		customFields[fmt.Sprintf("key %v %v", i, s)] = s
+	}
+
+	p := &Payload{
+		AlertText:    "Testing this payload",
+		CustomFields: customFields,
+		SanitizeUTF8: true,
+	}
+	payloadJson, err := p.Marshal(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := referenceMarshal(t, p); string(payloadJson) != expected {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expected, string(payloadJson)))
+	}
+}
+
+func TestClipJsonStringMatchesWriter(t *testing.T) {
+	for _, s := range trickyStrings {
+		buffer := &bytes.Buffer{}
+		writeJsonString(buffer, s)
+		for budget := 0; budget <= buffer.Len(); budget++ {
+			n, encodedLen := clipJsonString(s, budget)
+			if encodedLen > budget {
+				t.Error(fmt.Sprintf("Clip of %q to %v was %v bytes", s, budget, encodedLen))
+			}
+			clipped := &bytes.Buffer{}
+			writeJsonString(clipped, s[:n])
+			if clipped.Len()-2 != encodedLen {
+				t.Error(fmt.Sprintf("Clip of %q to %v estimated %v bytes but encodes to %v", s, budget, encodedLen, clipped.Len()-2))
+			}
+			//the clipped encoding is a prefix of the full one
+			if !bytes.HasPrefix(buffer.Bytes(), clipped.Bytes()[:clipped.Len()-1]) {
+				t.Error(fmt.Sprintf("Clip of %q to %v isn't a prefix: %s", s, budget, clipped.Bytes()))
+			}
+		}
+	}
+}
+
+func TestPayloadWriterMatchesEncoderWithoutHTMLEscaping(t *testing.T) {
+	customFields := map[string]interface{}{
+		"raw":    json.RawMessage(`{"html":"<b>"}`),
+		"nested": map[string]interface{}{"<key>": trickyStrings},
+	}
+	for i, s := range trickyStrings {
+		customFields[fmt.Sprintf("key %v %v", i, s)] = s
+	}
+	p := &Payload{
+		AlertText:           "<alert> & stays escaped",
+		CustomFields:        customFields,
+		DisableHTMLEscaping: true,
+		SanitizeUTF8:        true,
+	}
+	payloadJson, err := p.Marshal(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apsJson, _ := json.Marshal(p.simpleAps())
+	expected := &bytes.Buffer{}
+	expected.WriteString(`{"aps":` + string(apsJson))
+	encoder := json.NewEncoder(expected)
+	encoder.SetEscapeHTML(false)
+	keys := []string{}
+	for key := range customFields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		expected.WriteByte(',')
+		encoder.Encode(key)
+		expected.Truncate(expected.Len() - 1)
+		expected.WriteByte(':')
+		encoder.Encode(customFields[key])
+		expected.Truncate(expected.Len() - 1)
+	}
+	expected.WriteByte('}')
+
+	if string(payloadJson) != expected.String() {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expected.String(), string(payloadJson)))
+	}
+}
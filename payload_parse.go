@@ -0,0 +1,174 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Build a ready to send Payload from a json document, e.g. one written by
+// hand for a campaign, rather than from apple's aps wire format:
+//
+//	{
+//	  "token": "4ec5...",
+//	  "alert": {"title": "Sale", "body": "50% off today"},
+//	  "badge": 3,
+//	  "sound": "default",
+//	  "custom": {"campaign": "spring"},
+//	  "ttl": "6h",
+//	  "priority": 10
+//	}
+//
+// Keys, all optional other than token or channel-id:
+//
+//	token              device token, hex encoded
+//	channel-id         base64 broadcast channel, in place of token
+//	alert              alert text, or an object with the APSAlertBody keys
+//	                   (body, title, title-loc-key, title-loc-args, loc-key,
+//	                   loc-args, action-loc-key, launch-image)
+//	badge              badge number, an integer >= 0
+//	sound              sound file name
+//	category           notification category
+//	content-available  true for a background fetch
+//	custom             object of custom fields outside of aps
+//	expiration         UNIX seconds, or an RFC 3339 time
+//	ttl                duration from now, e.g. "90m", in place of expiration
+//	priority           1, 5 or 10
+//	push-type          one of the PushType constants, e.g. "background"
+//	topic              bundle id sent as apns-topic
+//	collapse-id        collapse id sent as apns-collapse-id
+//	apns-id            UUID sent as apns-id
+//
+// Numbers in custom are kept as json.Number so large integers aren't
+// rounded. Returns an error listing every unknown key and badly typed
+// value, along with the problems found by Payload.Validate
+func ParsePayload(data []byte) (*Payload, error) {
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid payload json: %v", err))
+	}
+	if document == nil {
+		return nil, errors.New("Invalid payload json, should be an object")
+	}
+
+	keys := make([]string, 0, len(document))
+	for key := range document {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	p := &Payload{}
+	errorStrs := ""
+	if _, ok := document["expiration"]; ok {
+		if _, ok := document["ttl"]; ok {
+			errorStrs += "Should set either expiration or ttl, not both\n"
+		}
+	}
+	for _, key := range keys {
+		if err := p.parseKey(key, document[key]); err != nil {
+			errorStrs += err.Error() + "\n"
+		}
+	}
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Set the field for one key of a ParsePayload document
+func (p *Payload) parseKey(key string, value json.RawMessage) error {
+	var err error
+	switch key {
+	case "token":
+		err = json.Unmarshal(value, &p.Token)
+	case "channel-id":
+		err = json.Unmarshal(value, &p.ChannelId)
+	case "alert":
+		err = p.parseAlert(value)
+	case "badge":
+		var badge int
+		if err = json.Unmarshal(value, &badge); err == nil {
+			err = p.Badge.Set(badge)
+		}
+	case "sound":
+		err = json.Unmarshal(value, &p.Sound)
+	case "category":
+		err = json.Unmarshal(value, &p.Category)
+	case "content-available":
+		var contentAvailable bool
+		if err = json.Unmarshal(value, &contentAvailable); err == nil && contentAvailable {
+			p.ContentAvailable = 1
+		}
+	case "custom":
+		decoder := json.NewDecoder(bytes.NewReader(value))
+		decoder.UseNumber()
+		if err = decoder.Decode(&p.CustomFields); err == nil && p.CustomFields == nil {
+			err = errors.New("should be an object")
+		}
+	case "expiration":
+		err = p.parseExpiration(value)
+	case "ttl":
+		var ttl string
+		var d time.Duration
+		if err = json.Unmarshal(value, &ttl); err == nil {
+			if d, err = time.ParseDuration(ttl); err == nil {
+				err = p.SetTTL(d)
+			}
+		}
+	case "priority":
+		err = json.Unmarshal(value, &p.Priority)
+	case "push-type":
+		err = json.Unmarshal(value, &p.PushType)
+	case "topic":
+		err = json.Unmarshal(value, &p.Topic)
+	case "collapse-id":
+		err = json.Unmarshal(value, &p.CollapseId)
+	case "apns-id":
+		err = json.Unmarshal(value, &p.ApnsId)
+	default:
+		return errors.New(fmt.Sprintf("Unknown key %q", key))
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid %v %s: %v", key, value, err))
+	}
+	return nil
+}
+
+// Set the alert from text or an object of alert body keys
+func (p *Payload) parseAlert(value json.RawMessage) error {
+	if len(value) > 0 && value[0] == '"' {
+		return json.Unmarshal(value, &p.AlertText)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p.AlertBody); err != nil {
+		return err
+	}
+	if p.AlertBody.isEmpty() {
+		return errors.New("should be text or an object with body, title or loc-key")
+	}
+	return nil
+}
+
+// Set the expiration from UNIX seconds or an RFC 3339 time
+func (p *Payload) parseExpiration(value json.RawMessage) error {
+	if len(value) > 0 && value[0] == '"' {
+		var text string
+		if err := json.Unmarshal(value, &text); err != nil {
+			return err
+		}
+		t, err := time.Parse(time.RFC3339, text)
+		if err != nil {
+			return err
+		}
+		return p.SetExpiration(t)
+	}
+	return json.Unmarshal(value, &p.ExpirationTime)
+}
@@ -0,0 +1,101 @@
+package apns
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePayload(t *testing.T) {
+	p, err := ParsePayload([]byte(`{
+		"token": "` + builderTestToken + `",
+		"alert": {"title": "Sale", "body": "50% off today", "loc-args": ["a"]},
+		"badge": 3,
+		"sound": "default",
+		"category": "offers",
+		"custom": {"campaign": "spring", "id": 12345678901234567890},
+		"expiration": 4000000000,
+		"priority": 10,
+		"collapse-id": "sale"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Payload{
+		Token:          builderTestToken,
+		AlertBody:      APSAlertBody{Title: "Sale", Body: "50% off today", LocArgs: []string{"a"}},
+		Badge:          NewBadgeNumber(3),
+		Sound:          "default",
+		Category:       "offers",
+		CustomFields:   map[string]interface{}{"campaign": "spring", "id": json.Number("12345678901234567890")},
+		ExpirationTime: 4000000000,
+		Priority:       PriorityImmediate,
+		CollapseId:     "sale",
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Error(fmt.Sprintf("Expected %+v but got %+v", expected, p))
+	}
+	payloadJson, _ := p.Marshal(MaxPayloadSizeAlert)
+	expectedJson := `{"aps":{"alert":{"body":"50% off today","loc-args":["a"],"title":"Sale"},"badge":3,"category":"offers","sound":"default"},` +
+		`"campaign":"spring","id":12345678901234567890}`
+	if string(payloadJson) != expectedJson {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expectedJson, string(payloadJson)))
+	}
+}
+
+func TestParsePayloadShouldAcceptAlternateForms(t *testing.T) {
+	p, err := ParsePayload([]byte(`{"token": "` + builderTestToken + `", "alert": "hi", "ttl": "1h"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiration, _ := p.Expiration(); p.AlertText != "hi" || expiration.Sub(time.Now()) < 59*time.Minute {
+		t.Error(fmt.Sprintf("Expected an alert expiring in an hour but got %+v", p))
+	}
+
+	p, err = ParsePayload([]byte(`{"token": "` + builderTestToken + `", "content-available": true,
+		"push-type": "background", "priority": 5, "expiration": "2096-10-01T00:00:00Z"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ContentAvailable != 1 || p.PushType != PushTypeBackground || p.ExpirationTime != 3999888000 {
+		t.Error(fmt.Sprintf("Expected a background push but got %+v", p))
+	}
+}
+
+func TestParsePayloadShouldCollectErrors(t *testing.T) {
+	_, err := ParsePayload([]byte(`{
+		"token": "` + builderTestToken + `",
+		"alert": {"body": "hi", "subtitle": "x"},
+		"badge": "3",
+		"sound": 1,
+		"priority": 300,
+		"expiration": 4000000000,
+		"ttl": "1h",
+		"colour": "red"
+	}`))
+	if err == nil {
+		t.Fatal("Expected the document to be invalid")
+	}
+	for _, expected := range []string{`Unknown key "colour"`, "Invalid alert", `"subtitle"`, "Invalid badge",
+		"Invalid sound", "Invalid priority", "either expiration or ttl"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Error(fmt.Sprintf("Expected %q in %v", expected, err))
+		}
+	}
+
+	for document, expected := range map[string]string{
+		`[]`:   "Invalid payload json",
+		`null`: "should be an object",
+		`{"token": "` + builderTestToken + `", "badge": -1}`:   "Number must be >= 0",
+		`{"token": "` + builderTestToken + `", "priority": 7}`: "Invalid priority 7",
+		`{"alert": "hi"}`:                       "Invalid token",
+		`{"token": "` + builderTestToken + `"}`: ErrEmptyPayload.Error(),
+	} {
+		if _, err := ParsePayload([]byte(document)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Error(fmt.Sprintf("Expected %q for %v but got %v", expected, document, err))
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package apns
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keeps payloads a connection has taken until apple accepts them, so the
+// send queue and in flight buffer survive a crash, set with
+// APNSConfig.PayloadStore
+// Put is called with each payload as it's enqueued, Ack once it's
+// accepted or failed for good, and Pending as a connection starts to
+// recover what a previous process left behind. Ids sort in the order they
+// were put, and Pending should pass entries in that order
+// Called on the connection's goroutines, so it must be safe for
+// concurrent use
+type PayloadStore interface {
+	// Store data under id, replacing anything already stored under it
+	Put(id string, data []byte) error
+	// Remove the entry stored under id, if there is one
+	Ack(id string) error
+	// Call each with every entry stored, in id order
+	Pending(each func(id string, data []byte)) error
+}
+
+// Encodes Payload.ExtraData for a PayloadStore, set with
+// APNSConfig.ExtraDataCodec. Without one ExtraData isn't stored, so
+// recovered payloads have none
+type ExtraDataCodec interface {
+	EncodeExtraData(extraData interface{}) ([]byte, error)
+	DecodeExtraData(data []byte) (interface{}, error)
+}
+
+// PayloadStore keeping entries in memory, so nothing survives the process
+// as is the case without a store. Useful to recover payloads into a new
+// connection made with a different config
+type MemoryPayloadStore struct {
+	lock    *sync.Mutex
+	entries map[string][]byte
+}
+
+func NewMemoryPayloadStore() *MemoryPayloadStore {
+	return &MemoryPayloadStore{lock: new(sync.Mutex), entries: make(map[string][]byte)}
+}
+
+func (s *MemoryPayloadStore) Put(id string, data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries[id] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *MemoryPayloadStore) Ack(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.entries, id)
+	return nil
+}
+
+// Entries put or acked while each runs may or may not be passed
+func (s *MemoryPayloadStore) Pending(each func(id string, data []byte)) error {
+	s.lock.Lock()
+	ids := make([]string, 0, len(s.entries))
+	for id := range s.entries {
+		ids = append(ids, id)
+	}
+	entries := make(map[string][]byte, len(s.entries))
+	for id, data := range s.entries {
+		entries[id] = data
+	}
+	s.lock.Unlock()
+	sort.Strings(ids)
+	for _, id := range ids {
+		each(id, entries[id])
+	}
+	return nil
+}
+
+// Number of entries stored
+func (s *MemoryPayloadStore) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.entries)
+}
+
+// PayloadStore keeping each entry in a file of its own in a directory,
+// a reference for stores on other storage
+// Each Put writes a temporary file, syncs it and renames it into place,
+// so a crash leaves either the whole entry or none of it
+type FilePayloadStore struct {
+	dir string
+}
+
+const filePayloadStoreExt = ".payload"
+
+// Create a FilePayloadStore in dir, creating the directory if need be
+// Only one process should use the directory at a time
+func NewFilePayloadStore(dir string) (*FilePayloadStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FilePayloadStore{dir: dir}, nil
+}
+
+// Ids are hex encoded into the file names, which keeps them safe for
+// any id and sorting in the same order
+func (s *FilePayloadStore) path(id string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(id))+filePayloadStoreExt)
+}
+
+func (s *FilePayloadStore) Put(id string, data []byte) error {
+	file, err := os.CreateTemp(s.dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), s.path(id))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func (s *FilePayloadStore) Ack(id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Files that aren't entries, e.g. a temporary file left by a crash during
+// Put, are skipped
+func (s *FilePayloadStore) Pending(each func(id string, data []byte)) error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, filePayloadStoreExt) {
+			continue
+		}
+		id, err := hex.DecodeString(strings.TrimSuffix(name, filePayloadStoreExt))
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, name))
+		if os.IsNotExist(err) {
+			//acked meanwhile
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		each(string(id), data)
+	}
+	return nil
+}
+
+// What's stored of a payload: the token, the fields sent alongside the
+// body, and the marshaled body, which a recovered payload sends as its
+// RawPayload
+type storedPayload struct {
+	Token          string          `json:"token,omitempty"`
+	ChannelId      string          `json:"channel_id,omitempty"`
+	Priority       uint8           `json:"priority,omitempty"`
+	ExpirationTime uint32          `json:"expiration,omitempty"`
+	Topic          string          `json:"topic,omitempty"`
+	CollapseId     string          `json:"collapse_id,omitempty"`
+	ApnsId         string          `json:"apns_id,omitempty"`
+	PushType       PushType        `json:"push_type,omitempty"`
+	Body           json.RawMessage `json:"body"`
+	ExtraData      []byte          `json:"extra_data,omitempty"`
+}
+
+// Serialize a payload for a PayloadStore, body being its marshaled json
+func encodeStoredPayload(payload *Payload, body []byte, codec ExtraDataCodec) ([]byte, error) {
+	stored := storedPayload{
+		Token:          payload.Token,
+		ChannelId:      payload.ChannelId,
+		Priority:       payload.Priority,
+		ExpirationTime: payload.ExpirationTime,
+		Topic:          payload.Topic,
+		CollapseId:     payload.CollapseId,
+		ApnsId:         payload.ApnsId,
+		PushType:       payload.PushType,
+		Body:           body,
+	}
+	if payload.ExtraData != nil && codec != nil {
+		extraData, err := codec.EncodeExtraData(payload.ExtraData)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to encode ExtraData: %v", err))
+		}
+		stored.ExtraData = extraData
+	}
+	return json.Marshal(&stored)
+}
+
+// Rebuild a payload serialized by encodeStoredPayload
+func decodeStoredPayload(data []byte, codec ExtraDataCodec) (*Payload, error) {
+	stored := storedPayload{}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	payload := &Payload{
+		Token:          stored.Token,
+		ChannelId:      stored.ChannelId,
+		Priority:       stored.Priority,
+		ExpirationTime: stored.ExpirationTime,
+		Topic:          stored.Topic,
+		CollapseId:     stored.CollapseId,
+		ApnsId:         stored.ApnsId,
+		PushType:       stored.PushType,
+		RawPayload:     []byte(stored.Body),
+	}
+	if stored.ExtraData != nil && codec != nil {
+		extraData, err := codec.DecodeExtraData(stored.ExtraData)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to decode ExtraData: %v", err))
+		}
+		payload.ExtraData = extraData
+	}
+	return payload, nil
+}
+
+var payloadJournalLock = new(sync.Mutex)
+
+// Counter making ids put within the same nanosecond unique
+var payloadStoreSeq uint32
+
+// Tracks which payloads are in the config's PayloadStore under which id,
+// shared by every connection made with the config so a payload resent
+// on another connection is stored once and acked once
+type payloadJournal struct {
+	store  PayloadStore
+	codec  ExtraDataCodec
+	logger Logger
+	lock   *sync.Mutex
+	ids    map[*Payload]string
+	//ids of the payloads in ids, so Pending entries a connection already
+	//has aren't recovered again
+	stored map[string]bool
+}
+
+// The journal of the config's PayloadStore, nil if it has none
+func (config *APNSConfig) payloadJournal() *payloadJournal {
+	if config.PayloadStore == nil {
+		return nil
+	}
+	payloadJournalLock.Lock()
+	defer payloadJournalLock.Unlock()
+	if config.journal == nil {
+		config.journal = &payloadJournal{
+			store:  config.PayloadStore,
+			codec:  config.ExtraDataCodec,
+			logger: configLogger(config.Logger),
+			lock:   new(sync.Mutex),
+			ids:    make(map[*Payload]string),
+			stored: make(map[string]bool),
+		}
+	}
+	return config.journal
+}
+
+func newPayloadStoreId() string {
+	return fmt.Sprintf("%016x-%08x", time.Now().UnixNano(), atomic.AddUint32(&payloadStoreSeq, 1))
+}
+
+// Put a payload in the store unless it's there already, body being its
+// marshaled json, or nil to marshal it with maxPayloadSize
+// A payload that can't be marshaled isn't stored, it fails when framed
+func (j *payloadJournal) put(payload *Payload, body []byte, maxPayloadSize int) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	_, ok := j.ids[payload]
+	j.lock.Unlock()
+	if ok {
+		return
+	}
+	var err error
+	if body == nil {
+		if body, err = payload.Marshal(maxPayloadSize); err != nil {
+			return
+		}
+	}
+	data, err := encodeStoredPayload(payload, body, j.codec)
+	if err != nil {
+		j.logger.Error("apns: failed to store payload", "payload", payload.String(), "error", err.Error())
+		return
+	}
+
+	id := newPayloadStoreId()
+	j.lock.Lock()
+	if _, ok := j.ids[payload]; ok {
+		j.lock.Unlock()
+		return
+	}
+	j.ids[payload] = id
+	j.stored[id] = true
+	j.lock.Unlock()
+	if err := j.store.Put(id, data); err != nil {
+		j.logger.Error("apns: failed to store payload", "payload", payload.String(), "error", err.Error())
+		j.forget(payload)
+	}
+}
+
+// Ack a payload that's been accepted or failed for good, if it's stored
+func (j *payloadJournal) ack(payload *Payload) {
+	if j == nil {
+		return
+	}
+	id, ok := j.forget(payload)
+	if !ok {
+		return
+	}
+	if err := j.store.Ack(id); err != nil {
+		j.logger.Error("apns: failed to ack stored payload", "payload", payload.String(), "error", err.Error())
+	}
+}
+
+// Stop tracking a payload, returning the id it was stored under
+func (j *payloadJournal) forget(payload *Payload) (string, bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	id, ok := j.ids[payload]
+	if ok {
+		delete(j.ids, payload)
+		delete(j.stored, id)
+	}
+	return id, ok
+}
+
+// The stored payloads no connection made with the config has, in the
+// order they were put, tracked from now on as if just put
+// Entries that can't be decoded are logged and left in the store
+func (j *payloadJournal) pending() []*Payload {
+	recovered := []*Payload{}
+	err := j.store.Pending(func(id string, data []byte) {
+		j.lock.Lock()
+		known := j.stored[id]
+		j.lock.Unlock()
+		if known {
+			return
+		}
+		payload, err := decodeStoredPayload(data, j.codec)
+		if err != nil {
+			j.logger.Error("apns: failed to decode stored payload", "id", id, "error", err.Error())
+			return
+		}
+		j.lock.Lock()
+		defer j.lock.Unlock()
+		if j.stored[id] {
+			return
+		}
+		j.ids[payload] = id
+		j.stored[id] = true
+		recovered = append(recovered, payload)
+	})
+	if err != nil {
+		j.logger.Error("apns: failed to read stored payloads", "error", err.Error())
+	}
+	return recovered
+}
+
+// Re-enqueue the payloads left in the config's PayloadStore, e.g. by a
+// process that crashed, as the connection starts
+// Those the connection closes before taking are left for the next
+// connection made with the config to recover
+func (c *APNSConnection) recoverStored() {
+	recovered := c.journal.pending()
+	for i, payload := range recovered {
+		if !c.requeue(payload) {
+			for _, left := range recovered[i:] {
+				c.journal.forget(left)
+			}
+			recovered = recovered[:i]
+			break
+		}
+	}
+	if len(recovered) > 0 {
+		c.logger.Info("apns: recovered stored payloads", "payloads", len(recovered))
+	}
+}
+
+// Put a payload on the queue, waiting for room whatever the
+// QueueFullPolicy, returning false if the connection closes or shuts
+// down first
+func (c *APNSConnection) requeue(payload *Payload) bool {
+	c.queueLock.RLock()
+	defer c.queueLock.RUnlock()
+	defer c.reportQueueDepth()
+	if c.queueClosed {
+		return false
+	}
+	select {
+	case c.queue <- payload:
+		return true
+	case <-c.stopChannel:
+		return false
+	case <-c.queueDone:
+		return false
+	}
+}
+
+// Ack the stored payloads apple has now said something about: the one it
+// rejected, the group members cancelled with it and those it read before,
+// or everything written if it shut down cleanly. A dropped socket doesn't
+// say, they're handed back unsent and stay stored
+// Called on the send go-routine once the connection has closed
+func (c *APNSConnection) ackOnClose(cancelled []*idPayload, appleError *AppleError) {
+	if c.journal == nil || appleError.ErrorCode == 10 {
+		return
+	}
+	for e := c.inFlightPayloadBuffer.Back(); e != nil; e = e.Prev() {
+		idPayloadObj := e.Value.(*idPayload)
+		if idPayloadObj.failed || idPayloadObj.unsent || idPayloadObj.writtenAt.IsZero() {
+			continue
+		}
+		c.journal.ack(idPayloadObj.Payload)
+	}
+	for _, idPayloadObj := range cancelled {
+		c.journal.ack(idPayloadObj.Payload)
+	}
+}
@@ -0,0 +1,158 @@
+package apns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// ExtraDataCodec for string ExtraData
+type stringExtraDataCodec struct{}
+
+func (stringExtraDataCodec) EncodeExtraData(extraData interface{}) ([]byte, error) {
+	s, ok := extraData.(string)
+	if !ok {
+		return nil, errors.New("Not a string")
+	}
+	return []byte(s), nil
+}
+
+func (stringExtraDataCodec) DecodeExtraData(data []byte) (interface{}, error) {
+	return string(data), nil
+}
+
+func waitForStoredPayloads(t *testing.T, store *MemoryPayloadStore, expected int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for store.Len() != expected {
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("Expected %v payloads to be stored but got %v", expected, store.Len()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPayloadStoreShouldAckSettledPayloadsAndRecoverTheRest(t *testing.T) {
+	store := NewMemoryPayloadStore()
+	config := shutdownTestConfig()
+	config.PayloadStore = store
+	socket := newPoolTestSocket()
+	conn := socketAPNSConnection(socket, config)
+
+	invalid := groupTestPayload(3)
+	invalid.Priority = 7
+	if err := conn.Enqueue(groupTestPayload(0)); err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []*Payload{groupTestPayload(1), groupTestPayload(2), invalid} {
+		conn.SendChannel <- payload
+	}
+	waitForSocketSends(t, socket, 3)
+	if store.Len() != 3 {
+		t.Error(fmt.Sprintf("Expected the valid payloads to be stored but got %v", store.Len()))
+	}
+
+	//apple read the first and rejected the second, the third is unsent
+	socket.reject(8, 1)
+	<-conn.CloseChannel
+	waitForStoredPayloads(t, store, 1)
+
+	//a connection made in another process recovers it
+	recoverConfig := shutdownTestConfig()
+	recoverConfig.PayloadStore = store
+	recoverSocket := newPoolTestSocket()
+	recoverConn := socketAPNSConnection(recoverSocket, recoverConfig)
+	waitForSocketSends(t, recoverSocket, 1)
+	if alerts := recoverSocket.alerts(3); fmt.Sprint(alerts) != "[0 0 1]" {
+		t.Error(fmt.Sprintf("Expected the unsent payload to be recovered but got %v", alerts))
+	}
+	recoverConn.SendChannel <- groupTestPayload(4)
+	waitForSocketSends(t, recoverSocket, 2)
+	recoverSocket.reject(8, 1)
+	<-recoverConn.CloseChannel
+	waitForStoredPayloads(t, store, 0)
+}
+
+func TestPayloadStoreShouldKeepPayloadsAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFilePayloadStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := shutdownTestConfig()
+	config.PayloadStore = store
+	config.ExtraDataCodec = stringExtraDataCodec{}
+	socket := newPoolTestSocket()
+	conn := socketAPNSConnection(socket, config)
+
+	payload := groupTestPayload(0)
+	payload.Priority = PriorityThrottled
+	payload.SetExpiration(time.Now().Add(time.Hour))
+	payload.Topic = "com.example.app"
+	payload.CollapseId = "score"
+	payload.ApnsId = NewApnsId()
+	payload.ExtraData = "order-42"
+	conn.SendChannel <- payload
+	waitForSocketSends(t, socket, 1)
+	//a dropped socket doesn't say whether apple read it
+	socket.Close()
+	<-conn.CloseChannel
+
+	restarted, err := NewFilePayloadStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recoverConfig := shutdownTestConfig()
+	recoverConfig.PayloadStore = restarted
+	recoverConfig.ExtraDataCodec = stringExtraDataCodec{}
+	recovered := make(chan *Payload, 1)
+	recoverConfig.middleware().registerBefore(func(payload *Payload) error {
+		recovered <- payload
+		return nil
+	})
+	recoverConn := socketAPNSConnection(newPoolTestSocket(), recoverConfig)
+	defer recoverConn.Disconnect()
+
+	var got *Payload
+	select {
+	case got = <-recovered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the stored payload to be recovered")
+	}
+	body, _ := payload.Marshal(2048)
+	if got.Token != payload.Token || got.Priority != payload.Priority || got.ExpirationTime != payload.ExpirationTime ||
+		got.Topic != payload.Topic || got.CollapseId != payload.CollapseId || got.ApnsId != payload.ApnsId ||
+		!bytes.Equal(got.RawPayload, body) || got.ExtraData != "order-42" {
+		t.Error(fmt.Sprintf("Expected the payload's fields to be stored but got %+v", got))
+	}
+}
+
+func TestFilePayloadStoreShouldPassPendingInIdOrder(t *testing.T) {
+	store, err := NewFilePayloadStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"b", "c/d", "a"} {
+		if err := store.Put(id, []byte(id+" data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Put("b", []byte("b replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Ack("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Ack("missing"); err != nil {
+		t.Error(fmt.Sprintf("Expected acking a missing id to succeed but got %v", err))
+	}
+
+	pending := []string{}
+	err = store.Pending(func(id string, data []byte) {
+		pending = append(pending, fmt.Sprintf("%v=%s", id, data))
+	})
+	if err != nil || fmt.Sprint(pending) != "[b=b replaced c/d=c/d data]" {
+		t.Error(fmt.Sprintf("Expected the entries left in id order but got %v, %v", pending, err))
+	}
+}
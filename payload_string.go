@@ -0,0 +1,101 @@
+package apns
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Max number of characters of alert text included by String
+const stringAlertLength = 32
+
+// A short summary of the payload for logging, e.g.
+//
+//	Payload{token: 740f…41ab, alert: "Hello", badge: 3, sound: default, custom: [game_id]}
+//
+// The token is redacted to its first and last 4 characters, long alert
+// text is clipped, only the keys of custom fields are shown and
+// ExtraData is left out entirely, so it is safe to log
+func (p Payload) String() string {
+	parts := []string{"token: " + redactToken(p.Token)}
+	if p.AlertText != "" {
+		parts = append(parts, "alert: "+clipForString(p.AlertText))
+	}
+	if p.AlertBody.Body != "" {
+		parts = append(parts, "body: "+clipForString(p.AlertBody.Body))
+	}
+	if p.AlertBody.Title != "" {
+		parts = append(parts, "title: "+clipForString(p.AlertBody.Title))
+	}
+	if p.AlertBody.LocKey != "" {
+		parts = append(parts, "loc-key: "+p.AlertBody.LocKey)
+	}
+	if p.Badge.IsSet() {
+		parts = append(parts, fmt.Sprintf("badge: %v", p.Badge.Number()))
+	}
+	if p.Sound != "" {
+		parts = append(parts, "sound: "+p.Sound)
+	}
+	if p.Category != "" {
+		parts = append(parts, "category: "+p.Category)
+	}
+	if p.ContentAvailable != 0 {
+		parts = append(parts, "content-available")
+	}
+	if p.Priority != 0 {
+		parts = append(parts, fmt.Sprintf("priority: %v", p.Priority))
+	}
+	if p.ExpirationTime != 0 {
+		parts = append(parts, "expiration: "+time.Unix(int64(p.ExpirationTime), 0).UTC().Format(time.RFC3339))
+	}
+	if p.PushType != "" {
+		parts = append(parts, "push-type: "+string(p.PushType))
+	}
+	if p.ChannelId != "" {
+		parts = append(parts, "channel-id: "+p.ChannelId)
+	}
+	if p.Topic != "" {
+		parts = append(parts, "topic: "+p.Topic)
+	}
+	if p.CollapseId != "" {
+		parts = append(parts, "collapse-id: "+p.CollapseId)
+	}
+	if p.ApnsId != "" {
+		parts = append(parts, "apns-id: "+p.ApnsId)
+	}
+	if len(p.CustomFields) > 0 {
+		keys := make([]string, 0, len(p.CustomFields))
+		for key := range p.CustomFields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		parts = append(parts, fmt.Sprintf("custom: %v", keys))
+	}
+	if p.RawPayload != nil {
+		parts = append(parts, fmt.Sprintf("raw: %v bytes", len(p.RawPayload)))
+	}
+	if p.ApsOverride != nil {
+		parts = append(parts, "aps override")
+	}
+	return "Payload{" + strings.Join(parts, ", ") + "}"
+}
+
+// Keep only the first and last 4 characters of a token, e.g. 740f…41ab
+// Tokens too short to redact that way are hidden completely
+func redactToken(token string) string {
+	if len(token) <= 8 {
+		return "…"
+	}
+	return token[:4] + "…" + token[len(token)-4:]
+}
+
+// Quote text, clipping it to stringAlertLength characters
+func clipForString(text string) string {
+	if utf8.RuneCountInString(text) <= stringAlertLength {
+		return fmt.Sprintf("%q", text)
+	}
+	clipped := []rune(text)[:stringAlertLength]
+	return fmt.Sprintf("%q", string(clipped)+"…")
+}
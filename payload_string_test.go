@@ -0,0 +1,51 @@
+package apns
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const stringTestToken = "740f4707bebcf74f9b7c25d48e3358945f6aa01da5ddb387462c7eaf61bb41ab"
+
+func TestPayloadStringShouldRedactToken(t *testing.T) {
+	p := Payload{
+		Token:          stringTestToken,
+		AlertText:      "Hello",
+		Badge:          NewBadgeNumber(3),
+		Sound:          "default",
+		Priority:       10,
+		ExpirationTime: 1500000000,
+		CustomFields:   map[string]interface{}{"b": "secret value", "a": 1},
+		ExtraData:      &struct{ internal string }{"noisy"},
+	}
+	expected := `Payload{token: 740f…41ab, alert: "Hello", badge: 3, sound: default, priority: 10, expiration: 2017-07-14T02:40:00Z, custom: [a b]}`
+
+	for _, s := range []string{p.String(), fmt.Sprintf("%v", p), fmt.Sprintf("%+v", &p)} {
+		if s != expected {
+			t.Error(fmt.Sprintf("Expected %v but got %v", expected, s))
+		}
+		if strings.Contains(s, stringTestToken) || strings.Contains(s, stringTestToken[4:60]) {
+			t.Error(fmt.Sprintf("Token leaked in %v", s))
+		}
+		if strings.Contains(s, "secret value") || strings.Contains(s, "noisy") {
+			t.Error(fmt.Sprintf("Custom values or extra data leaked in %v", s))
+		}
+	}
+}
+
+func TestPayloadStringShouldClipAlert(t *testing.T) {
+	p := Payload{
+		AlertBody: APSAlertBody{Body: strings.Repeat("日本", 20), LocKey: "KEY"},
+	}
+	expected := `Payload{token: …, body: "` + strings.Repeat("日本", 16) + `…", loc-key: KEY}`
+	if s := p.String(); s != expected {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expected, s))
+	}
+}
+
+func TestShortTokenShouldBeHidden(t *testing.T) {
+	if s := (Payload{Token: "abcdef12"}).String(); strings.Contains(s, "abcd") {
+		t.Error(fmt.Sprintf("Expected short token to be hidden but got %v", s))
+	}
+}
@@ -1,8 +1,12 @@
 package apns
 
 import (
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestSimpleMarshal(t *testing.T) {
@@ -400,6 +404,470 @@ func TestAlertBodyMarshalThrowErrorIfPayloadTooBigWithCustomFields(t *testing.T)
 	}
 }
 
+func TestAlertBodyWithoutBodyShouldOmitBody(t *testing.T) {
+	expected := map[string]string{
+		"title":       `{"aps":{"alert":{"title":"Your turn"}}}`,
+		"loc key":     `{"aps":{"alert":{"loc-key":"GAME_PLAY_REQUEST","loc-args":["Jenna"]},"sound":"chime"}}`,
+		"body, title": `{"aps":{"alert":{"body":"Jenna moved","title":"Your turn"}}}`,
+	}
+	payloads := map[string]*Payload{
+		"title":       {AlertBody: APSAlertBody{Title: "Your turn"}},
+		"loc key":     {AlertBody: APSAlertBody{LocKey: "GAME_PLAY_REQUEST", LocArgs: []string{"Jenna"}}, Sound: "chime"},
+		"body, title": {AlertBody: APSAlertBody{Body: "Jenna moved", Title: "Your turn"}},
+	}
+	for name, p := range payloads {
+		payloadJson, err := p.Marshal(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(payloadJson) != expected[name] {
+			t.Error(fmt.Sprintf("Expected %v to marshal to %v but got %v", name, expected[name], string(payloadJson)))
+		}
+
+		//without a body there's nothing to truncate
+		size, _ := p.Size()
+		_, err = p.Marshal(size - 1)
+		if name != "body, title" && err == nil {
+			t.Error(fmt.Sprintf("Expected %v to be too long rather than truncated", name))
+		} else if name == "body, title" && err != nil {
+			t.Error(fmt.Sprintf("Expected %v to truncate the body but got %v", name, err))
+		}
+	}
+}
+
+func TestAlertBodyWithOnlyBodyShouldMarshalAsString(t *testing.T) {
+	p := Payload{AlertBody: APSAlertBody{Body: "Testing this payload"}, Badge: NewBadgeNumber(1)}
+	payloadJson, err := p.Marshal(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"aps":{"alert":"Testing this payload","badge":1}}`; string(payloadJson) != expected {
+		t.Error(fmt.Sprintf("Expected the compact alert %v but got %v", expected, string(payloadJson)))
+	}
+	dictionary := Payload{AlertBody: APSAlertBody{Body: "Testing this payload", Title: "t"}, Badge: NewBadgeNumber(1)}
+	if size, _ := dictionary.Size(); size-len(`,"title":"t"`) != len(payloadJson)+len(`{"body":}`) {
+		t.Error(fmt.Sprintf("Expected the compact alert to save the dictionary but got %v and %v bytes", len(payloadJson), size))
+	}
+
+	//truncation clips the string the same way
+	truncated, err := p.Marshal(len(payloadJson) - 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"aps":{"alert":"Testing this...","badge":1}}`; string(truncated) != expected {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expected, string(truncated)))
+	}
+
+	//any other alert field needs the dictionary
+	others := []APSAlertBody{
+		{ActionLocKey: "a"}, {LocKey: "l"}, {LocArgs: []string{"x"}}, {LaunchImage: "i"},
+		{Title: "t"}, {TitleLocKey: "tl"}, {TitleLocArgs: []string{"y"}},
+	}
+	for _, alert := range others {
+		alert.Body = "Testing this payload"
+		p := Payload{AlertBody: alert}
+		payloadJson, err := p.Marshal(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(payloadJson), `{"aps":{"alert":{"body":"Testing this payload",`) {
+			t.Error(fmt.Sprintf("Expected %+v to use the dictionary but got %v", alert, string(payloadJson)))
+		}
+	}
+}
+
+func TestCustomFieldNamedApsShouldError(t *testing.T) {
+	p := Payload{
+		AlertText:    "Testing this payload",
+		CustomFields: map[string]interface{}{"aps": "nope"},
+	}
+
+	_, err := p.Marshal(256)
+	if err == nil {
+		t.Error("Should have thrown error for custom field named aps")
+	}
+
+	p = Payload{
+		AlertBody:    APSAlertBody{Body: "Testing this payload"},
+		CustomFields: map[string]interface{}{"aps": "nope", "num": 55},
+	}
+
+	_, err = p.Marshal(256)
+	if err == nil {
+		t.Error("Should have thrown error for custom field named aps")
+	}
+}
+
+func TestMarshalWithoutCustomFieldsShouldNotBuildMap(t *testing.T) {
+	aps := simpleAps{
+		Alert: "Testing this payload",
+		Badge: NewBadgeNumber(2),
+	}
+	p := Payload{
+		AlertText: "Testing this payload",
+		Badge:     NewBadgeNumber(2),
+	}
+
+	apsAllocs := testing.AllocsPerRun(100, func() {
+		json.Marshal(aps)
+	})
+	payloadAllocs := testing.AllocsPerRun(100, func() {
+		p.Marshal(256)
+	})
+
+	//only allowed the cost of boxing the aps object and its wrapper
+	if payloadAllocs > apsAllocs+3 {
+		t.Error(fmt.Sprintf("Expected at most %v allocations but got %v", apsAllocs+3, payloadAllocs))
+	}
+}
+
+func TestMarshalWithSharedCustomFieldsShouldReuseMap(t *testing.T) {
+	customFields := map[string]interface{}{
+		"num": 55,
+		"str": "string",
+	}
+	aps := simpleAps{
+		Alert: "Testing this payload",
+		Badge: NewBadgeNumber(2),
+	}
+	merged := map[string]interface{}{
+		"aps": aps,
+		"num": 55,
+		"str": "string",
+	}
+	//payloads sharing a custom field map, as in a broadcast
+	p1 := Payload{
+		AlertText:    "Testing this payload",
+		Badge:        NewBadgeNumber(2),
+		CustomFields: customFields,
+		Token:        "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f",
+	}
+	p2 := p1
+	p2.Token = "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8e"
+
+	mergedAllocs := testing.AllocsPerRun(100, func() {
+		json.Marshal(merged)
+	})
+	payloadAllocs := testing.AllocsPerRun(100, func() {
+		p1.Marshal(256)
+		p2.Marshal(256)
+	})
+
+	//only allowed the cost of boxing the aps object on top of marshalling
+	//an already merged map
+	if payloadAllocs > 2*(mergedAllocs+1) {
+		t.Error(fmt.Sprintf("Expected at most %v allocations but got %v", 2*(mergedAllocs+1), payloadAllocs))
+	}
+
+	if len(customFields) != 2 {
+		t.Error("Marshal should not modify the supplied custom fields")
+	}
+}
+
+func TestEmptyPayloadShouldNotSendAlert(t *testing.T) {
+	p := &Payload{Token: "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8d"}
+	payloadBytes, err := p.Marshal(MaxPayloadSizeAlert)
+	if err != ErrEmptyPayload {
+		t.Error(fmt.Sprintf("Expected ErrEmptyPayload but got %s, %v", payloadBytes, err))
+	}
+
+	p.CustomFields = map[string]interface{}{"id": 1}
+	payloadBytes, err = p.Marshal(MaxPayloadSizeAlert)
+	if err != nil || string(payloadBytes) != `{"aps":{},"id":1}` {
+		t.Error(fmt.Sprintf("Expected only the custom fields but got %s, %v", payloadBytes, err))
+	}
+}
+
+func TestMaxPayloadSizeByPushType(t *testing.T) {
+	p := Payload{}
+	if p.MaxPayloadSize() != MaxPayloadSizeAlert {
+		t.Error(fmt.Sprintf("Expected default max payload size %v but got %v", MaxPayloadSizeAlert, p.MaxPayloadSize()))
+	}
+
+	p.PushType = PushTypeBackground
+	if p.MaxPayloadSize() != MaxPayloadSizeAlert {
+		t.Error(fmt.Sprintf("Expected background max payload size %v but got %v", MaxPayloadSizeAlert, p.MaxPayloadSize()))
+	}
+
+	p.PushType = PushTypeVoIP
+	if p.MaxPayloadSize() != MaxPayloadSizeVoIP {
+		t.Error(fmt.Sprintf("Expected voip max payload size %v but got %v", MaxPayloadSizeVoIP, p.MaxPayloadSize()))
+	}
+}
+
+func TestMarshalAutoUsesPushTypeLimit(t *testing.T) {
+	customFields := map[string]interface{}{
+		"data": strings.Repeat("a", 4500),
+	}
+
+	p := Payload{
+		AlertText:    "Testing this payload",
+		CustomFields: customFields,
+	}
+
+	_, err := p.MarshalAuto()
+	if err == nil {
+		t.Error("Should have thrown marshaling error for alert push over 4096 bytes")
+	}
+
+	p = Payload{
+		ContentAvailable: 1,
+		PushType:         PushTypeVoIP,
+		CustomFields:     customFields,
+	}
+
+	json, err := p.MarshalAuto()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(json) > MaxPayloadSizeVoIP {
+		t.Error(fmt.Sprintf("Expected payload to be less than %v but was %v", MaxPayloadSizeVoIP, len(json)))
+	}
+}
+
+func TestMarshalAutoTruncate(t *testing.T) {
+	p := Payload{
+		AlertText: strings.Repeat("a", 6000),
+	}
+
+	json, err := p.MarshalAuto()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(json) != MaxPayloadSizeAlert {
+		t.Error(fmt.Sprintf("Expected payload to be truncated to %v but was %v", MaxPayloadSizeAlert, len(json)))
+	}
+
+	p.PushType = PushTypeVoIP
+
+	json, err = p.MarshalAuto()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(json) != MaxPayloadSizeVoIP {
+		t.Error(fmt.Sprintf("Expected payload to be truncated to %v but was %v", MaxPayloadSizeVoIP, len(json)))
+	}
+}
+
+func TestSizeMatchesMarshal(t *testing.T) {
+	customFields := map[string]interface{}{
+		"num": 55,
+		"str": "string <&> with escaping",
+		"arr": []interface{}{"a", 2, 3.5},
+		"obj": map[string]interface{}{
+			"obja": "a",
+			"objb": []string{"b", "c"},
+		},
+	}
+
+	payloads := []Payload{
+		{
+			AlertText:        "Testing this payload",
+			Badge:            NewBadgeNumber(2),
+			ContentAvailable: 1,
+			Sound:            "test.aiff",
+			Category:         "TEST_CATEGORY",
+		},
+		{
+			Badge: NewBadgeNumber(0),
+			AlertBody: APSAlertBody{
+				Body:         "Testing this payload",
+				ActionLocKey: "act-loc-key",
+				LocKey:       "loc-key",
+				LocArgs:      []string{"arg1", "arg2"},
+				Title:        "title",
+			},
+		},
+		{
+			AlertText:    "Testing this \"payload\" \u2603",
+			CustomFields: customFields,
+		},
+		{
+			AlertBody:    APSAlertBody{Body: "Testing this payload"},
+			CustomFields: customFields,
+		},
+	}
+
+	for _, p := range payloads {
+		size, err := p.Size()
+		if err != nil {
+			t.Error(err)
+		}
+
+		json, err := p.Marshal(MaxPayloadSizeAlert)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if size != len(json) {
+			t.Error(fmt.Sprintf("Expected size %v to match marshaled length %v for %v", size, len(json), string(json)))
+		}
+	}
+}
+
+func TestSizeIsUntruncatedSize(t *testing.T) {
+	p := Payload{
+		AlertText: strings.Repeat("a", 300),
+	}
+
+	size, err := p.Size()
+	if err != nil {
+		t.Error(err)
+	}
+
+	json, err := p.Marshal(MaxPayloadSizeLegacy)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if size <= MaxPayloadSizeLegacy || len(json) > MaxPayloadSizeLegacy {
+		t.Error(fmt.Sprintf("Expected untruncated size %v and truncated length %v", size, len(json)))
+	}
+}
+
+func TestSizeWithCustomFieldNamedApsShouldError(t *testing.T) {
+	p := Payload{
+		AlertText:    "Testing this payload",
+		CustomFields: map[string]interface{}{"aps": "nope"},
+	}
+
+	_, err := p.Size()
+	if err == nil {
+		t.Error("Should have thrown error for custom field named aps")
+	}
+}
+
+func TestRawPayloadMarshal(t *testing.T) {
+	raw := []byte(`{"aps":{"alert":"From elsewhere","mutable-content":1},"id":5}`)
+	p := Payload{
+		RawPayload: raw,
+		Token:      "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f",
+		Priority:   10,
+	}
+
+	json, err := p.Marshal(256)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(json) != string(raw) {
+		t.Error(fmt.Sprintf("Expected %v but got %v", string(raw), string(json)))
+	}
+
+	size, err := p.Size()
+	if err != nil {
+		t.Error(err)
+	}
+	if size != len(raw) {
+		t.Error(fmt.Sprintf("Expected size %v but got %v", len(raw), size))
+	}
+}
+
+func TestRawPayloadTooLongShouldNotTruncate(t *testing.T) {
+	p := Payload{
+		RawPayload: []byte(`{"aps":{"alert":"` + strings.Repeat("a", 300) + `"}}`),
+	}
+
+	_, err := p.Marshal(256)
+	if err == nil {
+		t.Error("Should have thrown error for raw payload over max payload size")
+	}
+}
+
+func TestRawPayloadInvalidJsonShouldError(t *testing.T) {
+	p := Payload{
+		RawPayload: []byte(`{"aps":{"alert":"missing end"`),
+	}
+
+	_, err := p.Marshal(256)
+	if err == nil {
+		t.Error("Should have thrown error for invalid raw payload")
+	}
+
+	_, err = p.Size()
+	if err == nil {
+		t.Error("Should have thrown error for invalid raw payload")
+	}
+}
+
+func TestRawPayloadWithOtherFieldsShouldError(t *testing.T) {
+	raw := []byte(`{"aps":{"alert":"From elsewhere"}}`)
+	payloads := []Payload{
+		{RawPayload: raw, AlertText: "Testing"},
+		{RawPayload: raw, AlertBody: APSAlertBody{Title: "Testing"}},
+		{RawPayload: raw, Badge: NewBadgeNumber(0)},
+		{RawPayload: raw, Sound: "test.aiff"},
+		{RawPayload: raw, Category: "TEST_CATEGORY"},
+		{RawPayload: raw, ContentAvailable: 1},
+		{RawPayload: raw, CustomFields: map[string]interface{}{"num": 55}},
+	}
+
+	for _, p := range payloads {
+		_, err := p.Marshal(256)
+		if err == nil {
+			t.Error(fmt.Sprintf("Should have thrown error for raw payload combined with other fields %v", p))
+		}
+	}
+}
+
+type testMarshalerField struct {
+	Value string
+}
+
+func (f testMarshalerField) MarshalJSON() ([]byte, error) {
+	return []byte(`{"custom":"` + f.Value + `"}`), nil
+}
+
+func TestMarshalWithRawAndMarshalerCustomFields(t *testing.T) {
+	rawBlob := json.RawMessage(`{"upstream":[1,2,{"deep":true}],"n":12345678901234567890}`)
+	customFields := map[string]interface{}{
+		"raw":     rawBlob,
+		"rawptr":  &rawBlob,
+		"nested":  map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{1, "two"}}},
+		"slice":   []int{1, 2, 3},
+		"int":     int64(9007199254740993),
+		"float":   float64(123456789),
+		"number":  json.Number("12345678901234567890"),
+		"custom":  testMarshalerField{Value: "val"},
+		"customp": &testMarshalerField{Value: "ptr"},
+	}
+
+	p := Payload{
+		AlertText:    "Testing",
+		CustomFields: customFields,
+	}
+
+	json, err := p.Marshal(MaxPayloadSizeAlert)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expectedJson := `{"aps":{"alert":"Testing"},"custom":{"custom":"val"},"customp":{"custom":"ptr"},` +
+		`"float":123456789,"int":9007199254740993,"nested":{"a":{"b":[1,"two"]}},"number":12345678901234567890,` +
+		`"raw":{"upstream":[1,2,{"deep":true}],"n":12345678901234567890},` +
+		`"rawptr":{"upstream":[1,2,{"deep":true}],"n":12345678901234567890},"slice":[1,2,3]}`
+	if string(json) != expectedJson {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expectedJson, string(json)))
+	}
+}
+
+func TestMarshalWithInvalidRawCustomFieldShouldError(t *testing.T) {
+	p := Payload{
+		AlertText: "Testing",
+		CustomFields: map[string]interface{}{
+			"raw": json.RawMessage(`{"upstream":`),
+		},
+	}
+
+	_, err := p.Marshal(MaxPayloadSizeAlert)
+	if err == nil || !strings.Contains(err.Error(), "raw") {
+		t.Error(fmt.Sprintf("Should have thrown error naming the invalid raw field but got %v", err))
+	}
+}
+
 func BenchmarkSimpleMarshalTruncate256WithCustomFields(b *testing.B) {
 	customFields := map[string]interface{}{
 		"num": 55,
@@ -516,3 +984,537 @@ func BenchmarkAlertBodyMarshalTruncate1024WithCustomFields(b *testing.B) {
 		p.Marshal(1024)
 	}
 }
+
+func TestMarshalShouldPutApsFirst(t *testing.T) {
+	p := Payload{
+		AlertText: "Testing this payload",
+		CustomFields: map[string]interface{}{
+			"zed":  1,
+			"acme": "a",
+			"Aps2": true,
+		},
+	}
+
+	json, err := p.Marshal(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedJson := "{\"aps\":{\"alert\":\"Testing this payload\"},\"Aps2\":true,\"acme\":\"a\",\"zed\":1}"
+	if string(json) != expectedJson {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expectedJson, string(json)))
+	}
+}
+
+func TestMarshalShouldBeStable(t *testing.T) {
+	customFields := map[string]interface{}{}
+	for i := 0; i < 50; i++ {
+		customFields[fmt.Sprintf("key%v", i)] = map[string]interface{}{
+			"b": i,
+			"a": []interface{}{"x", i},
+		}
+	}
+	p := Payload{
+		AlertBody:    APSAlertBody{Body: "Testing this payload", Title: "Title"},
+		Badge:        NewBadgeNumber(3),
+		CustomFields: customFields,
+	}
+
+	first, err := p.Marshal(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		again, _ := p.Marshal(4096)
+		if string(again) != string(first) {
+			t.Fatal(fmt.Sprintf("Expected identical output but got %v and %v", string(first), string(again)))
+		}
+	}
+}
+
+func TestMarshalShouldEscapeCustomFieldKeys(t *testing.T) {
+	customFields := map[string]interface{}{
+		"quote\"key": 1,
+		"<html>":     2,
+		"ünïcode":    3,
+		"tab\tkey":   4,
+	}
+	p := Payload{
+		AlertText:    "Testing this payload",
+		CustomFields: customFields,
+	}
+
+	payloadJson, err := p.Marshal(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//same escaping as encoding/json, aps aside
+	merged := map[string]interface{}{}
+	for key, value := range customFields {
+		merged[key] = value
+	}
+	expected, _ := json.Marshal(merged)
+	expectedJson := "{\"aps\":{\"alert\":\"Testing this payload\"}," + string(expected[1:])
+	if string(payloadJson) != expectedJson {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expectedJson, string(payloadJson)))
+	}
+}
+
+func BenchmarkSimpleMarshal(b *testing.B) {
+	p := Payload{
+		AlertText:        "Testing this payload",
+		Badge:            NewBadgeNumber(2),
+		ContentAvailable: 1,
+		Sound:            "test.aiff",
+		Category:         "TEST_CATEGORY",
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Marshal(2048)
+	}
+}
+
+func BenchmarkAlertBodyMarshalWithCustomFields(b *testing.B) {
+	customFields := map[string]interface{}{
+		"num":  55,
+		"str":  "string",
+		"arr":  []interface{}{"a", 2},
+		"game": map[string]interface{}{"id": "abc123", "turn": 12, "players": []string{"a", "b"}},
+		"obj": map[string]string{
+			"obja": "a",
+			"objb": "b",
+		},
+	}
+
+	p := Payload{
+		Badge:        NewBadgeNumber(2),
+		Sound:        "test.aiff",
+		CustomFields: customFields,
+		AlertBody: APSAlertBody{
+			Body:    "Your turn in the game with a friend",
+			LocKey:  "loc-key",
+			LocArgs: []string{"arg1", "arg2"},
+			Title:   "Your turn",
+		},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Marshal(2048)
+	}
+}
+
+func TestAppendMarshalShouldAppend(t *testing.T) {
+	p := Payload{
+		AlertText:    "Testing this payload",
+		CustomFields: map[string]interface{}{"num": 55},
+	}
+	expected, _ := p.Marshal(256)
+
+	dst := []byte("prefix")
+	dst, err := p.AppendMarshal(dst, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dst) != "prefix"+string(expected) {
+		t.Error(fmt.Sprintf("Expected %v but got %v", "prefix"+string(expected), string(dst)))
+	}
+}
+
+func TestAppendMarshalShouldTruncateOnlyThePayload(t *testing.T) {
+	p := Payload{
+		AlertText: strings.Repeat("long text ", 50),
+	}
+	expected, err := p.Marshal(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := make([]byte, 0, 1024)
+	dst = append(dst, strings.Repeat("x", 300)...)
+	dst, err = p.AppendMarshal(dst, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dst[300:]) != string(expected) || len(dst)-300 > 256 {
+		t.Error(fmt.Sprintf("Expected %v but got %v", string(expected), string(dst[300:])))
+	}
+}
+
+func TestAppendMarshalShouldReturnDstOnError(t *testing.T) {
+	p := Payload{
+		AlertText:    "Testing this payload",
+		CustomFields: map[string]interface{}{"aps": 1},
+	}
+	dst := []byte("prefix")
+	result, err := p.AppendMarshal(dst, 256)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if string(result) != "prefix" {
+		t.Error(fmt.Sprintf("Expected dst back unchanged but got %v", string(result)))
+	}
+}
+
+func TestAppendMarshalShouldReuseDst(t *testing.T) {
+	p := Payload{
+		AlertText: "Testing this payload",
+		Badge:     NewBadgeNumber(2),
+	}
+	dst := make([]byte, 0, 512)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		dst, _ = p.AppendMarshal(dst[:0], 256)
+	})
+	//only boxing the aps object
+	if allocs > 1 {
+		t.Error(fmt.Sprintf("Expected at most 1 allocation but got %v", allocs))
+	}
+}
+
+func TestMarshalShouldBeSafeForConcurrentUse(t *testing.T) {
+	payloads := make([]*Payload, 8)
+	expected := make([]string, len(payloads))
+	for i := range payloads {
+		payloads[i] = &Payload{
+			AlertBody: APSAlertBody{Body: strings.Repeat(fmt.Sprintf("body %v ", i), 40)},
+			CustomFields: map[string]interface{}{
+				"index":  i,
+				"nested": map[string]interface{}{"list": []interface{}{i, "x"}},
+			},
+		}
+		jsonStr, err := payloads[i].Marshal(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[i] = string(jsonStr)
+	}
+
+	errs := make(chan string, 64)
+	done := make(chan bool)
+	for g := 0; g < 16; g++ {
+		go func(g int) {
+			var dst []byte
+			for n := 0; n < 200; n++ {
+				i := (g + n) % len(payloads)
+				var err error
+				dst, err = payloads[i].AppendMarshal(dst[:0], 256)
+				if err != nil || string(dst) != expected[i] {
+					errs <- fmt.Sprintf("payload %v marshaled to %v (%v)", i, string(dst), err)
+					break
+				}
+			}
+			done <- true
+		}(g)
+	}
+	for g := 0; g < 16; g++ {
+		<-done
+	}
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func BenchmarkAlertBodyAppendMarshalWithCustomFields(b *testing.B) {
+	customFields := map[string]interface{}{
+		"num":  55,
+		"str":  "string",
+		"arr":  []interface{}{"a", 2},
+		"game": map[string]interface{}{"id": "abc123", "turn": 12, "players": []string{"a", "b"}},
+		"obj": map[string]string{
+			"obja": "a",
+			"objb": "b",
+		},
+	}
+
+	p := Payload{
+		Badge:        NewBadgeNumber(2),
+		Sound:        "test.aiff",
+		CustomFields: customFields,
+		AlertBody: APSAlertBody{
+			Body:    "Your turn in the game with a friend",
+			LocKey:  "loc-key",
+			LocArgs: []string{"arg1", "arg2"},
+			Title:   "Your turn",
+		},
+	}
+	dst := make([]byte, 0, 2048)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst, _ = p.AppendMarshal(dst[:0], 2048)
+	}
+}
+
+func BenchmarkSimpleAppendMarshalParallel(b *testing.B) {
+	p := Payload{
+		AlertText: "Testing this payload",
+		Badge:     NewBadgeNumber(2),
+		Sound:     "test.aiff",
+		CustomFields: map[string]interface{}{
+			"num": 55,
+		},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		dst := make([]byte, 0, 2048)
+		for pb.Next() {
+			dst, _ = p.AppendMarshal(dst[:0], 2048)
+		}
+	})
+}
+
+func TestMarshalTruncateAtExactBoundary(t *testing.T) {
+	p := Payload{
+		AlertText: "Testing this payload with a message right on the limit",
+		Badge:     NewBadgeNumber(2),
+	}
+	size, _ := p.Size()
+
+	json, err := p.Marshal(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(json) != size || strings.Contains(string(json), "...") {
+		t.Error(fmt.Sprintf("Expected untruncated payload of %v bytes but got %v", size, string(json)))
+	}
+
+	//one byte short clips the 3 for the ellipse plus one more
+	json, err = p.Marshal(size - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedJson := `{"aps":{"alert":"Testing this payload with a message right on the l...","badge":2}}`
+	if string(json) != expectedJson {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expectedJson, string(json)))
+	}
+	if len(json) != size-1 {
+		t.Error(fmt.Sprintf("Expected payload of %v bytes but was %v", size-1, len(json)))
+	}
+}
+
+func TestMarshalTruncateToJustEllipse(t *testing.T) {
+	p := Payload{
+		AlertBody: APSAlertBody{Body: "Some body text"},
+		CustomFields: map[string]interface{}{
+			"extra": strings.Repeat("x", 100),
+		},
+	}
+	size, _ := p.Size()
+	withoutBody := size - len(p.AlertBody.Body)
+
+	json, err := p.Marshal(withoutBody + 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(json), `{"aps":{"alert":"..."}`) {
+		t.Error(fmt.Sprintf("Expected body to be just the ellipse but got %v", string(json)))
+	}
+
+	if _, err := p.Marshal(withoutBody + 2); err == nil {
+		t.Error("Expected error when there is no room for the ellipse")
+	}
+}
+
+func TestMarshalTruncateShouldAccountForEscaping(t *testing.T) {
+	alerts := []string{
+		strings.Repeat(`"quoted" <b>&amp;</b> `, 20),
+		strings.Repeat("emoji 😀 日本語 ", 20),
+		strings.Repeat("control \x01\n\t and separators   ", 20),
+		strings.Repeat("invalid \xff\xe6\x97 utf8 ", 20),
+	}
+	for _, alert := range alerts {
+		for _, simple := range []bool{true, false} {
+			p := Payload{CustomFields: map[string]interface{}{"id": 12}, SanitizeUTF8: true}
+			if simple {
+				p.AlertText = alert
+			} else {
+				p.AlertBody.Body = alert
+			}
+			size, _ := p.Size()
+			for max := size; max > size-200; max-- {
+				payloadJson, err := p.Marshal(max)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(payloadJson) > max {
+					t.Fatal(fmt.Sprintf("Expected payload to be at most %v but was %v", max, len(payloadJson)))
+				}
+				//anything more than one escaped character short means the clip was too eager
+				if len(payloadJson) < max-6 {
+					t.Error(fmt.Sprintf("Expected payload close to %v but was %v", max, len(payloadJson)))
+				}
+				decoded := map[string]interface{}{}
+				if err := json.Unmarshal(payloadJson, &decoded); err != nil {
+					t.Fatal(fmt.Sprintf("Truncated payload is invalid json %v: %v", err, string(payloadJson)))
+				}
+				if max < size && !strings.HasSuffix(truncatedAlert(decoded), "...") {
+					t.Error(fmt.Sprintf("Expected alert to end with an ellipse %v", string(payloadJson)))
+				}
+			}
+		}
+	}
+}
+
+func truncatedAlert(decoded map[string]interface{}) string {
+	alert := decoded["aps"].(map[string]interface{})["alert"]
+	if body, ok := alert.(map[string]interface{}); ok {
+		return body["body"].(string)
+	}
+	return alert.(string)
+}
+
+func TestTruncateShouldNotSplitCharacters(t *testing.T) {
+	p := Payload{AlertText: "日本語日本語日本語"}
+	size, _ := p.Size()
+	for max := size - 1; max >= size-len(p.AlertText)+3; max-- {
+		payloadJson, err := p.Marshal(max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !utf8.Valid(payloadJson) || strings.Contains(string(payloadJson), "�") {
+			t.Error(fmt.Sprintf("Expected whole characters to be kept but got %v", string(payloadJson)))
+		}
+	}
+}
+
+func TestTruncateShouldNotAllocateMore(t *testing.T) {
+	p := Payload{
+		AlertText:    strings.Repeat("Testing this payload ", 20),
+		CustomFields: map[string]interface{}{"num": 55},
+	}
+	dst := make([]byte, 0, 512)
+
+	fits := testing.AllocsPerRun(100, func() {
+		dst, _ = p.AppendMarshal(dst[:0], 512)
+	})
+	truncated := testing.AllocsPerRun(100, func() {
+		dst, _ = p.AppendMarshal(dst[:0], 256)
+	})
+	if truncated > fits {
+		t.Error(fmt.Sprintf("Expected truncating to cost no more allocations than fitting, got %v vs %v", truncated, fits))
+	}
+}
+
+func TestDisableHTMLEscaping(t *testing.T) {
+	p := Payload{
+		AlertText:    "Testing <this> payload",
+		CustomFields: map[string]interface{}{"url": "https://example.com/?a=1&b=<2>"},
+	}
+	escaped, _ := p.Marshal(256)
+	expectedJson := `{"aps":{"alert":"Testing \u003cthis\u003e payload"},"url":"https://example.com/?a=1\u0026b=\u003c2\u003e"}`
+	if string(escaped) != expectedJson {
+		t.Error(fmt.Sprintf("Expected html to be escaped by default %v but got %v", expectedJson, string(escaped)))
+	}
+
+	p.DisableHTMLEscaping = true
+	unescaped, _ := p.Marshal(256)
+	//only custom fields are affected
+	expectedJson = `{"aps":{"alert":"Testing \u003cthis\u003e payload"},"url":"https://example.com/?a=1&b=<2>"}`
+	if string(unescaped) != expectedJson {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expectedJson, string(unescaped)))
+	}
+}
+
+func TestDisableHTMLEscapingSizeAndTruncation(t *testing.T) {
+	p := Payload{
+		AlertText:           strings.Repeat("Testing this payload ", 10),
+		CustomFields:        map[string]interface{}{"html": strings.Repeat("<p>&</p>", 10)},
+		DisableHTMLEscaping: true,
+	}
+	size, err := p.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	json, _ := p.Marshal(size)
+	if len(json) != size {
+		t.Error(fmt.Sprintf("Expected size %v to match marshaled length %v", size, len(json)))
+	}
+
+	json, err = p.Marshal(size - 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(json) != size-10 {
+		t.Error(fmt.Sprintf("Expected truncation to %v bytes but was %v", size-10, len(json)))
+	}
+}
+
+func TestMarshalIndentMatchesMarshal(t *testing.T) {
+	payloads := []Payload{
+		{AlertText: "Testing this payload", Badge: NewBadgeNumber(2), CustomFields: map[string]interface{}{"num": 55, "list": []int{1, 2}}},
+		{AlertBody: APSAlertBody{Body: "Testing", Title: "Title", LocArgs: []string{"a", "b"}}, Sound: "test.aiff"},
+		{RawPayload: []byte(`{"aps":{"alert":"raw"}}`)},
+	}
+	for _, p := range payloads {
+		compact, err := p.Marshal(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indented, err := p.MarshalIndent(256, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(indented), "\n  ") {
+			t.Error(fmt.Sprintf("Expected indented json but got %v", string(indented)))
+		}
+
+		var fromCompact, fromIndented interface{}
+		json.Unmarshal(compact, &fromCompact)
+		json.Unmarshal(indented, &fromIndented)
+		if !reflect.DeepEqual(fromCompact, fromIndented) {
+			t.Error(fmt.Sprintf("Expected %v but got %v", fromCompact, fromIndented))
+		}
+	}
+}
+
+func TestMarshalIndentSizeAppliesToCompactForm(t *testing.T) {
+	p := Payload{
+		AlertText:    "Testing this payload",
+		CustomFields: map[string]interface{}{"a": 1, "b": 2, "c": 3},
+	}
+	size, _ := p.Size()
+
+	indented, err := p.MarshalIndent(size, "", "        ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indented) <= size || strings.Contains(string(indented), "...") {
+		t.Error(fmt.Sprintf("Expected indentation to not count towards or force truncation %v", string(indented)))
+	}
+
+	//truncation matches the compact form
+	compact, _ := p.Marshal(size - 5)
+	indented, _ = p.MarshalIndent(size-5, "", "  ")
+	var fromCompact, fromIndented interface{}
+	json.Unmarshal(compact, &fromCompact)
+	json.Unmarshal(indented, &fromIndented)
+	if !reflect.DeepEqual(fromCompact, fromIndented) {
+		t.Error(fmt.Sprintf("Expected %v but got %v", fromCompact, fromIndented))
+	}
+
+	if _, err := p.MarshalIndent(10, "", "  "); err == nil {
+		t.Error("Expected error for a payload that can't fit")
+	}
+}
+
+func TestPrettyString(t *testing.T) {
+	p := Payload{AlertText: "Testing this payload", Badge: NewBadgeNumber(2)}
+	expected := "{\n  \"aps\": {\n    \"alert\": \"Testing this payload\",\n    \"badge\": 2\n  }\n}"
+	if p.PrettyString() != expected {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expected, p.PrettyString()))
+	}
+
+	p.CustomFields = map[string]interface{}{"aps": 1}
+	if !strings.HasPrefix(p.PrettyString(), "<invalid payload: ") {
+		t.Error(fmt.Sprintf("Expected the error in place of the payload but got %v", p.PrettyString()))
+	}
+}
@@ -0,0 +1,111 @@
+package apns
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Check the payload can be sent, returning an error listing every
+// problem found:
+// the token must be hex encoded (or a base64 ChannelId set instead), the
+// push type known and consistent with the payload, the topic suffixed to
+// suit the push type (if set), the priority one of the Priority constants
+// (or unset) and not 10 for a background push, the collapse id at most
+// MaxCollapseIdLength bytes, the apns id a UUID (or unset), the
+// expiration not in the past (other than ExpireImmediately), custom
+// fields must marshal (and not be named aps), loc keys must have an
+// arg for each placeholder (see APSAlertBody.ValidateLocalization) and
+// there must be something to deliver, ErrEmptyPayload being returned as
+// is when that's the only problem
+// The size limit isn't checked, see Size for that
+func (p *Payload) Validate() error {
+	errorStrs := ""
+	if p.ChannelId != "" {
+		if p.Token != "" {
+			errorStrs += "Should set either Token or ChannelId, not both\n"
+		}
+		if channelId, err := base64.StdEncoding.DecodeString(p.ChannelId); err != nil || len(channelId) == 0 {
+			errorStrs += fmt.Sprintf("Invalid channel id %q, should be base64 encoded\n", p.ChannelId)
+		}
+	} else if !isHexToken(p.Token) {
+		errorStrs += fmt.Sprintf("Invalid token %q, should be hex encoded\n", p.Token)
+	}
+	switch p.Priority {
+	case 0, PriorityThrottled:
+	case PriorityPowerConsiderations:
+		if p.PushType == PushTypeLocation {
+			errorStrs += "Location pushes should use priority 5 or 10\n"
+		}
+	case PriorityImmediate:
+		//other push types, e.g. complication, carry content available too
+		if p.ResolvedPushType() == PushTypeBackground {
+			errorStrs += "Content available only (background) pushes can't use priority 10, use PriorityThrottled\n"
+		}
+	default:
+		errorStrs += fmt.Sprintf("Invalid priority %v, should be 1, 5 or 10\n", p.Priority)
+	}
+	if err := p.validatePushType(); err != nil {
+		errorStrs += err.Error() + "\n"
+	}
+	if p.Topic != "" {
+		if err := validateTopic(p.Topic, p.ResolvedPushType()); err != nil {
+			errorStrs += err.Error() + "\n"
+		}
+	}
+	if p.ApnsId != "" && !isValidApnsId(p.ApnsId) {
+		errorStrs += fmt.Sprintf("Invalid ApnsId %q, should be a UUID\n", p.ApnsId)
+	}
+	if len(p.CollapseId) > MaxCollapseIdLength {
+		errorStrs += fmt.Sprintf("CollapseId is %v bytes, should be at most %v\n", len(p.CollapseId), MaxCollapseIdLength)
+	}
+	if err := validateExpirationTime(p.ExpirationTime, time.Now()); err != nil {
+		errorStrs += err.Error() + "\n"
+	}
+	if _, err := p.Size(); err != nil {
+		errorStrs += err.Error() + "\n"
+	}
+	if p.AlertText == "" {
+		if err := p.AlertBody.ValidateLocalization(); err != nil {
+			errorStrs += err.Error() + "\n"
+		}
+	}
+	if p.RawPayload == nil && p.isEmpty() {
+		if errorStrs == "" {
+			return ErrEmptyPayload
+		}
+		errorStrs += ErrEmptyPayload.Error() + "\n"
+	}
+	if errorStrs != "" {
+		return errors.New(errorStrs)
+	}
+	return nil
+}
+
+// Check the push type is one apple knows and suits the payload
+func (p *Payload) validatePushType() error {
+	known := p.PushType == ""
+	for _, pushType := range pushTypes {
+		known = known || p.PushType == pushType
+	}
+	if !known {
+		return errors.New(fmt.Sprintf("Unknown push type %q, should be one of %v", p.PushType, pushTypes))
+	}
+
+	hasAlert := p.AlertText != "" || !p.AlertBody.isEmpty() || p.Badge.IsSet() || p.Sound != ""
+	if !hasAlert {
+		return nil
+	}
+	switch p.PushType {
+	case PushTypeBackground:
+		return errors.New("Background pushes can't have an alert, badge or sound, use PushTypeAlert")
+	case PushTypeVoIP:
+		return errors.New("VoIP pushes can't have an alert, badge or sound, the app reports the call to CallKit instead")
+	case PushTypeComplication:
+		return errors.New("Complication pushes can't have an alert, badge or sound, the watch app updates its complication instead")
+	case PushTypeFileProvider:
+		return errors.New("File provider pushes can't have an alert, badge or sound, they only wake the extension")
+	}
+	return nil
+}
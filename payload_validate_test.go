@@ -0,0 +1,192 @@
+package apns
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const validateTestToken = "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8d"
+
+func TestValidPayloadShouldValidate(t *testing.T) {
+	payloads := []*Payload{
+		{Token: validateTestToken, AlertText: "Testing this payload", Priority: 10},
+		{Token: validateTestToken, AlertBody: APSAlertBody{LocKey: "%@ says hi", LocArgs: []string{"Bob"}}},
+		{Token: validateTestToken, RawPayload: []byte(`{"aps":{}}`)},
+	}
+	for _, p := range payloads {
+		if err := p.Validate(); err != nil {
+			t.Error(fmt.Sprintf("Expected %v to be valid but got %v", p, err))
+		}
+	}
+}
+
+func TestValidateShouldListEveryProblem(t *testing.T) {
+	p := &Payload{
+		Token:        "not hex",
+		Priority:     7,
+		AlertBody:    APSAlertBody{LocKey: "%@ says %@", LocArgs: []string{"Bob"}},
+		CustomFields: map[string]interface{}{"aps": 1},
+	}
+	err := p.Validate()
+	if err == nil {
+		t.Fatal("Expected invalid payload")
+	}
+	for _, expected := range []string{"token", "priority", "aps", "2 placeholders but 1 loc args"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Error(fmt.Sprintf("Expected %q in error %v", expected, err))
+		}
+	}
+}
+
+func TestValidatePriority(t *testing.T) {
+	for _, priority := range []uint8{0, PriorityPowerConsiderations, PriorityThrottled, PriorityImmediate} {
+		p := &Payload{Token: validateTestToken, AlertText: "Testing", Priority: priority}
+		if err := p.Validate(); err != nil {
+			t.Error(fmt.Sprintf("Expected priority %v to be valid but got %v", priority, err))
+		}
+	}
+	for _, priority := range []uint8{2, 7, 11} {
+		p := &Payload{Token: validateTestToken, AlertText: "Testing", Priority: priority}
+		if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "Invalid priority") {
+			t.Error(fmt.Sprintf("Expected priority %v to be invalid but got %v", priority, err))
+		}
+	}
+}
+
+func TestValidateBackgroundPushPriority(t *testing.T) {
+	p := &Payload{Token: validateTestToken, ContentAvailable: 1, Priority: PriorityImmediate}
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "Content available only") {
+		t.Error(fmt.Sprintf("Expected priority 10 to be invalid for a background push but got %v", err))
+	}
+
+	p.Priority = PriorityThrottled
+	if err := p.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	//fine once it shows something to the user
+	p = &Payload{Token: validateTestToken, ContentAvailable: 1, Badge: NewBadgeNumber(1), Priority: PriorityImmediate}
+	if err := p.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateCollapseIdLength(t *testing.T) {
+	p := &Payload{Token: validateTestToken, AlertText: "Testing", CollapseId: strings.Repeat("c", MaxCollapseIdLength)}
+	if err := p.Validate(); err != nil {
+		t.Error(fmt.Sprintf("Expected a %v byte collapse id to be valid but got %v", MaxCollapseIdLength, err))
+	}
+	p.CollapseId += "c"
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "CollapseId is 65 bytes") {
+		t.Error(fmt.Sprintf("Expected a 65 byte collapse id to be invalid but got %v", err))
+	}
+}
+
+func TestResolvedPushType(t *testing.T) {
+	cases := []struct {
+		payload  Payload
+		expected PushType
+	}{
+		{Payload{AlertText: "Testing"}, PushTypeAlert},
+		{Payload{Badge: NewBadgeNumber(1)}, PushTypeAlert},
+		{Payload{ContentAvailable: 1}, PushTypeBackground},
+		{Payload{ContentAvailable: 1, Sound: "default"}, PushTypeAlert},
+		{Payload{ContentAvailable: 1, PushType: PushTypeComplication}, PushTypeComplication},
+	}
+	for _, c := range cases {
+		if actual := c.payload.ResolvedPushType(); actual != c.expected {
+			t.Error(fmt.Sprintf("Expected %v for %v but got %v", c.expected, c.payload, actual))
+		}
+	}
+}
+
+func TestValidatePushType(t *testing.T) {
+	for _, pushType := range pushTypes {
+		p := &Payload{Token: validateTestToken, ContentAvailable: 1, PushType: pushType}
+		if err := p.Validate(); err != nil {
+			t.Error(fmt.Sprintf("Expected push type %v to be valid but got %v", pushType, err))
+		}
+	}
+
+	p := &Payload{Token: validateTestToken, AlertText: "Testing", PushType: "notification"}
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), `Unknown push type "notification"`) {
+		t.Error(fmt.Sprintf("Expected an unknown push type to be invalid but got %v", err))
+	}
+
+	p = &Payload{Token: validateTestToken, AlertBody: APSAlertBody{Body: "Testing"}, PushType: PushTypeBackground}
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "Background pushes can't have an alert") {
+		t.Error(fmt.Sprintf("Expected a background push with an alert to be invalid but got %v", err))
+	}
+
+	p = &Payload{Token: validateTestToken, CustomFields: map[string]interface{}{"a": 1}, PushType: PushTypeBackground, Priority: PriorityImmediate}
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "priority 10") {
+		t.Error(fmt.Sprintf("Expected a background push with priority 10 to be invalid but got %v", err))
+	}
+}
+
+func TestValidateLocationPriority(t *testing.T) {
+	p := &Payload{Token: validateTestToken, PushType: PushTypeLocation, Topic: "com.example.app.location-query"}
+	for _, priority := range []uint8{0, PriorityThrottled, PriorityImmediate} {
+		p.Priority = priority
+		if err := p.Validate(); err != nil {
+			t.Error(fmt.Sprintf("Expected a location push with priority %v to be valid but got %v", priority, err))
+		}
+	}
+	p.Priority = PriorityPowerConsiderations
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "Location pushes should use priority 5 or 10") {
+		t.Error(fmt.Sprintf("Expected a location push with priority 1 to be invalid but got %v", err))
+	}
+}
+
+func TestValidateChannelId(t *testing.T) {
+	p := &Payload{ChannelId: "dHN0LXNyY2gtY2hubA==", AlertText: "Testing"}
+	if err := p.Validate(); err != nil {
+		t.Error(fmt.Sprintf("Expected a broadcast without a token to be valid but got %v", err))
+	}
+
+	p.Token = validateTestToken
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "either Token or ChannelId") {
+		t.Error(fmt.Sprintf("Expected a token and channel id to be invalid but got %v", err))
+	}
+
+	p = &Payload{ChannelId: "not base64!", AlertText: "Testing"}
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "Invalid channel id") {
+		t.Error(fmt.Sprintf("Expected an invalid channel id to be rejected but got %v", err))
+	}
+}
+
+func TestValidateEmptyPayload(t *testing.T) {
+	delivered := map[string]*Payload{
+		"badge only":         {Token: validateTestToken, Badge: NewBadgeNumber(0)},
+		"sound only":         {Token: validateTestToken, Sound: "default"},
+		"alert body only":    {Token: validateTestToken, AlertBody: APSAlertBody{Title: "Testing"}},
+		"content available":  {Token: validateTestToken, ContentAvailable: 1},
+		"custom fields only": {Token: validateTestToken, CustomFields: map[string]interface{}{"id": 1}},
+		"passkit":            NewPassKitPayload(validateTestToken, "pass.com.example.ticket"),
+		"mdm":                {Token: validateTestToken, PushType: PushTypeMDM},
+		"location":           {Token: validateTestToken, PushType: PushTypeLocation, Topic: "com.example.app.location-query"},
+		"voip":               {Token: validateTestToken, PushType: PushTypeVoIP},
+	}
+	for name, p := range delivered {
+		if err := p.Validate(); err != nil {
+			t.Error(fmt.Sprintf("Expected the %v payload to be valid but got %v", name, err))
+		}
+		if _, err := p.Marshal(MaxPayloadSizeAlert); err != nil {
+			t.Error(fmt.Sprintf("Expected the %v payload to marshal but got %v", name, err))
+		}
+	}
+
+	empty := &Payload{Token: validateTestToken, Category: "GAME", ExpirationTime: uint32(time.Now().Unix() + 60)}
+	if err := empty.Validate(); err != ErrEmptyPayload {
+		t.Error(fmt.Sprintf("Expected ErrEmptyPayload but got %v", err))
+	}
+	if _, err := empty.Marshal(MaxPayloadSizeAlert); err != ErrEmptyPayload {
+		t.Error(fmt.Sprintf("Expected ErrEmptyPayload from Marshal but got %v", err))
+	}
+	empty.Token = "nope"
+	if err := empty.Validate(); err == nil || !strings.Contains(err.Error(), ErrEmptyPayload.Error()) || !strings.Contains(err.Error(), "Invalid token") {
+		t.Error(fmt.Sprintf("Expected both problems to be listed but got %v", err))
+	}
+}
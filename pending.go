@@ -0,0 +1,143 @@
+package apns
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The payloads a binary connection wrote within the last SendSettleWindow,
+// which apple may still reject. Writes are kept as batches, one per flush,
+// so counting only locks this and not the send path
+type inFlightWindow struct {
+	lock    *sync.Mutex
+	window  time.Duration
+	batches []writtenBatch
+	count   int
+}
+
+type writtenBatch struct {
+	at    time.Time
+	count int
+}
+
+func newInFlightWindow(window time.Duration) *inFlightWindow {
+	return &inFlightWindow{lock: new(sync.Mutex), window: window}
+}
+
+// Count count payloads written at at
+func (w *inFlightWindow) written(at time.Time, count int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.batches = append(w.batches, writtenBatch{at: at, count: count})
+	w.count += count
+}
+
+// Number of payloads written within the window before now
+func (w *inFlightWindow) inFlight(now time.Time) int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	settled := 0
+	for settled < len(w.batches) && now.Sub(w.batches[settled].at) >= w.window {
+		w.count -= w.batches[settled].count
+		settled++
+	}
+	w.batches = append(w.batches[:0], w.batches[settled:]...)
+	return w.count
+}
+
+// Forget every write, once the connection has closed and apple has nothing
+// more to say about them
+func (w *inFlightWindow) reset() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.batches = w.batches[:0]
+	w.count = 0
+}
+
+// Number of payloads given to the connection but not yet written to the
+// socket: those waiting on the Enqueue queue, taken off SendChannel or
+// Send and waiting to be framed, or framed and waiting to be flushed
+// 0 once the connection has closed, everything unwritten is then in the
+// ConnectionClose's UnsentPayloads
+// Safe to call from any goroutine, it takes no locks
+func (c *APNSConnection) PendingCount() int {
+	return len(c.queue) + int(atomic.LoadInt64(&c.pending))
+}
+
+// Number of payloads written within the last SendSettleWindow, which apple
+// could still reject. The binary protocol never confirms a payload, so
+// after the window it's taken as accepted, as Send does
+// 0 once the connection has closed
+// Safe to call from any goroutine
+func (c *APNSConnection) InFlightCount() int {
+	return c.inFlight.inFlight(c.config.clock.Now())
+}
+
+// Number of sends waiting to post to apple, held up by a throttle (see
+// ThrottledError) or waiting to retry
+// Safe to call from any goroutine, it takes no locks
+func (c *HTTP2Connection) PendingCount() int {
+	return int(atomic.LoadInt64(&c.pending))
+}
+
+// Number of sends posted to apple and waiting for the response
+// Safe to call from any goroutine, it takes no locks
+func (c *HTTP2Connection) InFlightCount() int {
+	return int(atomic.LoadInt64(&c.inFlight))
+}
+
+// The work waiting on one of a pool's connections, see MemberCounts
+type PoolMemberCounts struct {
+	// Payloads queued for the connection (see
+	// APNSPoolConfig.MaxPendingPerConnection) plus its PendingCount
+	Pending int
+	// The connection's InFlightCount
+	InFlight int
+	// Whether the connection is open, false while it's being replaced when
+	// only the payloads queued for it are counted
+	Connected bool
+}
+
+// Pending and in flight counts for each of the pool's connections, in
+// the order they were opened
+// Safe to call from any goroutine
+func (p *APNSConnectionPool) MemberCounts() []PoolMemberCounts {
+	p.lock.Lock()
+	conns := make([]*APNSConnection, len(p.members))
+	for i, m := range p.members {
+		conns[i] = m.conn
+	}
+	p.lock.Unlock()
+
+	counts := make([]PoolMemberCounts, len(conns))
+	for i, conn := range conns {
+		counts[i].Pending = len(p.members[i].queue)
+		if conn != nil {
+			counts[i].Pending += conn.PendingCount()
+			counts[i].InFlight = conn.InFlightCount()
+			counts[i].Connected = true
+		}
+	}
+	return counts
+}
+
+// Number of payloads waiting to be written across the pool's connections,
+// see MemberCounts
+func (p *APNSConnectionPool) PendingCount() int {
+	pending := 0
+	for _, counts := range p.MemberCounts() {
+		pending += counts.Pending
+	}
+	return pending
+}
+
+// Number of payloads written within the last SendSettleWindow across the
+// pool's connections, see MemberCounts
+func (p *APNSConnectionPool) InFlightCount() int {
+	inFlight := 0
+	for _, counts := range p.MemberCounts() {
+		inFlight += counts.InFlight
+	}
+	return inFlight
+}
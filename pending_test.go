@@ -0,0 +1,152 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Something with PendingCount and InFlightCount
+type workCounter interface {
+	PendingCount() int
+	InFlightCount() int
+}
+
+// Wait for the counts to reach pending and inFlight
+func waitForCounts(t *testing.T, counter workCounter, pending int, inFlight int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for counter.PendingCount() != pending || counter.InFlightCount() != inFlight {
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("Expected %v pending and %v in flight but got %v and %v",
+				pending, inFlight, counter.PendingCount(), counter.InFlightCount()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnectionShouldCountPendingAndInFlight(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	config := app.Pool.ConnectionConfig
+	config.SendSettleWindow = 1000
+	config.DrainLinger = -1
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Pause()
+	for i := 0; i < 3; i++ {
+		if err := conn.Enqueue(groupTestPayload(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForCounts(t, conn, 3, 0)
+
+	conn.Resume()
+	if _, err := server.WaitForNotifications(3, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if pending, inFlight := conn.PendingCount(), conn.InFlightCount(); pending != 0 || inFlight != 3 {
+		t.Error(fmt.Sprintf("Expected the written payloads to be in flight but got %v pending and %v in flight", pending, inFlight))
+	}
+	//taken as accepted once the settle window is over
+	waitForCounts(t, conn, 0, 0)
+
+	conn.Enqueue(groupTestPayload(3))
+	conn.Enqueue(groupTestPayload(4))
+	unsent, err := conn.Drain(context.Background())
+	if err != nil || len(unsent) != 0 {
+		t.Fatal(fmt.Sprintf("Expected the drain to succeed but got %v, %v", unsent, err))
+	}
+	if pending, inFlight := conn.PendingCount(), conn.InFlightCount(); pending != 0 || inFlight != 0 {
+		t.Error(fmt.Sprintf("Expected nothing pending after the drain but got %v pending and %v in flight", pending, inFlight))
+	}
+	<-conn.CloseChannel
+}
+
+func TestConnectionCountsShouldClearOnRejection(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	config := app.Pool.ConnectionConfig
+	config.SendSettleWindow = 5000
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := groupTestPayload(1)
+	server.RejectToken(rejected.Token, "INVALID_TOKEN")
+	conn.Enqueue(groupTestPayload(0))
+	conn.Enqueue(rejected)
+	conn.Enqueue(groupTestPayload(2))
+	<-conn.CloseChannel
+	if pending, inFlight := conn.PendingCount(), conn.InFlightCount(); pending != 0 || inFlight != 0 {
+		t.Error(fmt.Sprintf("Expected nothing counted once closed but got %v pending and %v in flight", pending, inFlight))
+	}
+}
+
+func TestHTTP2ConnectionShouldCountPendingAndInFlight(t *testing.T) {
+	server, _, app := newManagerTestApps(t)
+	conn, err := NewHTTP2Connection(app.HTTP2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	server.SetDelay(300 * time.Millisecond)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		if result, err := conn.Send(context.Background(), groupTestPayload(0)); err != nil || !result.Accepted() {
+			t.Error(fmt.Sprintf("Expected the payload to be accepted but got %+v, %v", result, err))
+		}
+	}()
+	waitForCounts(t, conn, 0, 1)
+	<-done
+	waitForCounts(t, conn, 0, 0)
+
+	//waiting out a throttle is pending
+	server.SetDelay(0)
+	server.Throttle(1, http.StatusTooManyRequests, time.Second)
+	done = make(chan bool)
+	go func() {
+		defer close(done)
+		conn.Send(context.Background(), groupTestPayload(1))
+	}()
+	waitForCounts(t, conn, 1, 0)
+	<-done
+	waitForCounts(t, conn, 0, 0)
+}
+
+func TestPoolShouldCountPendingByMember(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	app.Pool.Size = 2
+	app.Pool.ConnectionConfig.SendSettleWindow = 1000
+	app.Pool.ConnectionConfig.DrainLinger = -1
+	pool, err := NewAPNSConnectionPool(app.Pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.Pause()
+	for i := 0; i < 4; i++ {
+		pool.SendChannel <- groupTestPayload(i)
+	}
+	waitForCounts(t, pool, 4, 0)
+	members := pool.MemberCounts()
+	if len(members) != 2 || members[0].Pending+members[1].Pending != 4 || !members[0].Connected || !members[1].Connected {
+		t.Error(fmt.Sprintf("Expected the payloads queued across 2 connections but got %+v", members))
+	}
+
+	pool.Resume()
+	if _, err := server.WaitForNotifications(4, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitForCounts(t, pool, 0, 0)
+
+	pool.Close()
+	finalPoolClose(t, pool)
+	if pending, inFlight := pool.PendingCount(), pool.InFlightCount(); pending != 0 || inFlight != 0 {
+		t.Error(fmt.Sprintf("Expected nothing pending once closed but got %v pending and %v in flight", pending, inFlight))
+	}
+}
@@ -0,0 +1,69 @@
+package apns
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+)
+
+// Returned (wrapped by the handshake or HTTP request) when none of the
+// certificates apple's side presented has a pinned public key
+type PinningError struct {
+	// The host connected to
+	Host string
+	// SPKI fingerprints of the certificates that were presented
+	Fingerprints []string
+}
+
+func (e *PinningError) Error() string {
+	return fmt.Sprintf("No certificate presented by %v matches a pinned public key (got %v)", e.Host, e.Fingerprints)
+}
+
+// The base64 SHA-256 of a certificate's SubjectPublicKeyInfo, the same
+// pin-sha256 value HPKP uses, for PinnedPublicKeys
+// e.g. from a pem file with
+// openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func SPKIFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Error message for any pins that aren't a base64 SHA-256 fingerprint,
+// "" if they're all valid
+func validatePinnedPublicKeys(pins []string) string {
+	errorStrs := ""
+	for _, pin := range pins {
+		if sum, err := base64.StdEncoding.DecodeString(pin); err != nil || len(sum) != sha256.Size {
+			errorStrs += fmt.Sprintf("Invalid PinnedPublicKeys %q. Should be a base64 SHA-256 fingerprint.\n", pin)
+		}
+	}
+	return errorStrs
+}
+
+// A tls.Config VerifyPeerCertificate checking the verified chain includes
+// one of pins, nil if there are no pins
+// Runs after the usual verification against RootCAs, so a pin is only
+// accepted as part of a valid chain
+func pinnedPublicKeyVerifier(host string, pins []string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(pins) == 0 {
+		return nil
+	}
+	pinned := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		pinned[pin] = true
+	}
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		pinningError := &PinningError{Host: host}
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				fingerprint := SPKIFingerprint(cert)
+				if pinned[fingerprint] {
+					return nil
+				}
+				pinningError.Fingerprints = append(pinningError.Fingerprints, fingerprint)
+			}
+		}
+		return pinningError
+	}
+}
@@ -0,0 +1,222 @@
+package apns
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A root CA and a server certificate for 127.0.0.1 and
+// gateway.example.com signed by it
+type pinningTestChain struct {
+	root   *x509.Certificate
+	leaf   *x509.Certificate
+	server tls.Certificate
+	roots  *x509.CertPool
+	//state of each handshake the listener completes
+	states chan tls.ConnectionState
+}
+
+func newPinningTestChain(t *testing.T) *pinningTestChain {
+	rootKey, _ := generateAuthKey(t)
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(10),
+		Subject:               pkix.Name{CommonName: "test root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := x509.ParseCertificate(rootDER)
+
+	leafKey, _ := generateAuthKey(t)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(11),
+		Subject:      pkix.Name{CommonName: "test gateway"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"gateway.example.com"},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, root, &leafKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(leafDER)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return &pinningTestChain{
+		root:   root,
+		leaf:   leaf,
+		server: tls.Certificate{Certificate: [][]byte{leafDER, rootDER}, PrivateKey: leafKey},
+		roots:  roots,
+		states: make(chan tls.ConnectionState, 10),
+	}
+}
+
+// Listen for tls connections with the chain's server certificate, closing
+// each once the handshake is done
+func (c *pinningTestChain) listen(t *testing.T) (net.Listener, string, string) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{c.server},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			socket, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if socket.(*tls.Conn).Handshake() == nil {
+				select {
+				case c.states <- socket.(*tls.Conn).ConnectionState():
+				default:
+				}
+			}
+			socket.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	return listener, host, port
+}
+
+// The fingerprint of a key that isn't in the chain
+func otherPinningTestFingerprint(t *testing.T) string {
+	return SPKIFingerprint(newPinningTestChain(t).root)
+}
+
+func expectPinningError(t *testing.T, name string, err error) {
+	pinningError := &PinningError{}
+	if !errors.As(err, &pinningError) {
+		t.Error(fmt.Sprintf("Expected a pinning error for %v but got %v", name, err))
+	} else if len(pinningError.Fingerprints) == 0 {
+		t.Error(fmt.Sprintf("Expected the presented fingerprints for %v", name))
+	}
+}
+
+func TestSPKIFingerprint(t *testing.T) {
+	chain := newPinningTestChain(t)
+	fingerprint := SPKIFingerprint(chain.leaf)
+	if len(fingerprint) != 44 || fingerprint == SPKIFingerprint(chain.root) {
+		t.Error(fmt.Sprintf("Expected a distinct base64 SHA-256 but got %v", fingerprint))
+	}
+	if validatePinnedPublicKeys([]string{fingerprint}) != "" {
+		t.Error("Expected the fingerprint to be a valid pin")
+	}
+	if validatePinnedPublicKeys([]string{"abc", fingerprint[:40]}) == "" {
+		t.Error("Expected invalid pins to be refused")
+	}
+}
+
+func TestPinningConnection(t *testing.T) {
+	chain := newPinningTestChain(t)
+	listener, host, port := chain.listen(t)
+	defer listener.Close()
+	certPEM, keyPEM := generateTestClientCert(t, "com.example.app")
+	config := func(pin string) *APNSConfig {
+		return &APNSConfig{
+			CertificateBytes: certPEM,
+			KeyBytes:         keyPEM,
+			GatewayHost:      host,
+			GatewayPort:      port,
+			RootCAs:          chain.roots,
+			PinnedPublicKeys: []string{pin},
+		}
+	}
+
+	//pinning either the root or the leaf is enough
+	for name, cert := range map[string]*x509.Certificate{"root": chain.root, "leaf": chain.leaf} {
+		conn, err := NewAPNSConnection(config(SPKIFingerprint(cert)))
+		if err != nil {
+			t.Error(fmt.Sprintf("Expected to connect with the %v pinned but got %v", name, err))
+			continue
+		}
+		conn.Disconnect()
+		<-conn.CloseChannel
+	}
+
+	_, err := NewAPNSConnection(config(otherPinningTestFingerprint(t)))
+	expectPinningError(t, "the gateway", err)
+
+	if _, err := NewAPNSConnection(config("not a pin")); err == nil {
+		t.Error("Expected an error for an invalid pin")
+	}
+}
+
+func TestPinningFeedbackService(t *testing.T) {
+	chain := newPinningTestChain(t)
+	listener, host, port := chain.listen(t)
+	defer listener.Close()
+	certPEM, keyPEM := generateTestClientCert(t, "com.example.app")
+	config := func(pin string) *APNSFeedbackServiceConfig {
+		return &APNSFeedbackServiceConfig{
+			CertificateBytes: certPEM,
+			KeyBytes:         keyPEM,
+			GatewayHost:      host,
+			GatewayPort:      port,
+			RootCAs:          chain.roots,
+			PinnedPublicKeys: []string{pin},
+		}
+	}
+
+	responses, err := ConnectToFeedbackService(config(SPKIFingerprint(chain.root)))
+	if err != nil || responses.Len() != 0 {
+		t.Error(fmt.Sprintf("Expected no feedback with the root pinned but got %v", err))
+	}
+
+	_, err = ConnectToFeedbackService(config(otherPinningTestFingerprint(t)))
+	expectPinningError(t, "the feedback service", err)
+}
+
+func TestPinningHTTP2(t *testing.T) {
+	chain := newPinningTestChain(t)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{chain.server}}
+	server.StartTLS()
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	certPEM, keyPEM := generateTestClientCert(t, "com.example.app")
+	connection := func(pin string) *HTTP2Connection {
+		conn, err := NewHTTP2Connection(&HTTP2Config{
+			CertificateBytes: certPEM,
+			KeyBytes:         keyPEM,
+			Host:             host,
+			Port:             port,
+			RootCAs:          chain.roots,
+			PinnedPublicKeys: []string{pin},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	result, err := connection(SPKIFingerprint(chain.root)).Send(context.Background(), http2TestPayload())
+	if err != nil || !result.Accepted() {
+		t.Error(fmt.Sprintf("Expected the payload to be accepted with the root pinned but got %v", err))
+	}
+
+	_, err = connection(otherPinningTestFingerprint(t)).Send(context.Background(), http2TestPayload())
+	expectPinningError(t, "HTTP/2", err)
+}
@@ -0,0 +1,475 @@
+package apns
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"unicode/utf16"
+)
+
+// Just enough of PKCS#12 (RFC 7292) to read the .p12 bundles apple's
+// developer portal and keychain export, and the ones openssl makes: the
+// certificates and private key, encrypted with the legacy PKCS#12 schemes
+// (3DES and RC2) or PBES2 (AES), verified with a HMAC
+
+var (
+	oidDataContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+
+	oidKeyBag              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidPKCS8ShroudedKeyBag = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+
+	oidPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBEWithSHAAnd128BitRC2CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 5}
+	oidPBEWithSHAAnd40BitRC2CBC      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 6}
+	oidPBES2                         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2                        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe pkcs12ContentInfo
+	MacData  pkcs12MacData `asn1:"optional"`
+}
+
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type pkcs12EncryptedData struct {
+	Version              int
+	EncryptedContentInfo pkcs12EncryptedContentInfo
+}
+
+type pkcs12EncryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type pkcs12SafeBag struct {
+	Id         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	Id    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type pkcs12CertBag struct {
+	Id   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type pkcs12MacData struct {
+	Mac        pkcs12DigestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type pkcs12DigestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pkcs12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	Prf            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// Certificates and private keys found in a .p12 bundle
+type pkcs12Contents struct {
+	certificates []*x509.Certificate
+	keys         []interface{}
+}
+
+// Decode a .p12 bundle, verifying its MAC with password
+func decodePKCS12(data []byte, password string) (*pkcs12Contents, error) {
+	pfx := pfxPdu{}
+	if err := unmarshalDER(data, &pfx); err != nil {
+		return nil, corruptCertificate(err)
+	}
+	if pfx.Version != 3 {
+		return nil, corruptCertificate(errors.New(fmt.Sprintf("unsupported PKCS#12 version %v", pfx.Version)))
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidDataContentType) {
+		return nil, corruptCertificate(errors.New("only password protected PKCS#12 bundles are supported"))
+	}
+	authSafe := []byte{}
+	if err := unmarshalDER(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return nil, corruptCertificate(err)
+	}
+
+	//PKCS#12 schemes use the password as a null terminated BMPString,
+	//though some tools leave an empty password out altogether
+	bmpPassword := bmpString(password)
+	if pfx.MacData.Mac.Algorithm.Algorithm != nil {
+		err := verifyPKCS12MAC(&pfx.MacData, authSafe, bmpPassword)
+		if err == ErrIncorrectPassword && password == "" {
+			bmpPassword = nil
+			err = verifyPKCS12MAC(&pfx.MacData, authSafe, bmpPassword)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	contentInfos := []pkcs12ContentInfo{}
+	if err := unmarshalDER(authSafe, &contentInfos); err != nil {
+		return nil, corruptCertificate(err)
+	}
+	contents := &pkcs12Contents{}
+	for _, contentInfo := range contentInfos {
+		safeContents := []byte{}
+		switch {
+		case contentInfo.ContentType.Equal(oidDataContentType):
+			if err := unmarshalDER(contentInfo.Content.Bytes, &safeContents); err != nil {
+				return nil, corruptCertificate(err)
+			}
+		case contentInfo.ContentType.Equal(oidEncryptedDataContentType):
+			encryptedData := pkcs12EncryptedData{}
+			if err := unmarshalDER(contentInfo.Content.Bytes, &encryptedData); err != nil {
+				return nil, corruptCertificate(err)
+			}
+			info := encryptedData.EncryptedContentInfo
+			var err error
+			safeContents, err = pbeDecrypt(info.ContentEncryptionAlgorithm, password, bmpPassword, info.EncryptedContent)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, corruptCertificate(errors.New("only password protected PKCS#12 bundles are supported"))
+		}
+		if err := contents.addSafeContents(safeContents, password, bmpPassword); err != nil {
+			return nil, err
+		}
+	}
+	return contents, nil
+}
+
+// Collect the certificates and keys from a list of safe bags
+func (contents *pkcs12Contents) addSafeContents(data []byte, password string, bmpPassword []byte) error {
+	bags := []pkcs12SafeBag{}
+	if err := unmarshalDER(data, &bags); err != nil {
+		return corruptCertificate(err)
+	}
+	for _, bag := range bags {
+		switch {
+		case bag.Id.Equal(oidCertBag):
+			certBag := pkcs12CertBag{}
+			if err := unmarshalDER(bag.Value.Bytes, &certBag); err != nil {
+				return corruptCertificate(err)
+			}
+			if !certBag.Id.Equal(oidX509Certificate) {
+				continue
+			}
+			certificate, err := x509.ParseCertificate(certBag.Data)
+			if err != nil {
+				return corruptCertificate(err)
+			}
+			contents.certificates = append(contents.certificates, certificate)
+		case bag.Id.Equal(oidPKCS8ShroudedKeyBag):
+			key, err := decryptPKCS8PrivateKey(bag.Value.Bytes, password, bmpPassword)
+			if err != nil {
+				return err
+			}
+			contents.keys = append(contents.keys, key)
+		case bag.Id.Equal(oidKeyBag):
+			key, err := x509.ParsePKCS8PrivateKey(bag.Value.Bytes)
+			if err != nil {
+				return corruptCertificate(err)
+			}
+			contents.keys = append(contents.keys, key)
+		}
+	}
+	return nil
+}
+
+// Decrypt and parse a DER EncryptedPrivateKeyInfo
+func decryptPKCS8PrivateKey(der []byte, password string, bmpPassword []byte) (interface{}, error) {
+	info := encryptedPrivateKeyInfo{}
+	if err := unmarshalDER(der, &info); err != nil {
+		return nil, corruptCertificate(err)
+	}
+	decrypted, err := pbeDecrypt(info.Algorithm, password, bmpPassword, info.EncryptedData)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(decrypted)
+	if err != nil {
+		//decrypted with the wrong password but happened to be padded right
+		return nil, ErrIncorrectPassword
+	}
+	return key, nil
+}
+
+// Check the bundle's HMAC, the only way to tell a wrong password from
+// corrupt data
+func verifyPKCS12MAC(macData *pkcs12MacData, message []byte, password []byte) error {
+	hashFunc, err := pkcs12DigestHash(macData.Mac.Algorithm.Algorithm)
+	if err != nil {
+		return corruptCertificate(err)
+	}
+	key := pkcs12KDF(hashFunc, password, macData.MacSalt, macData.Iterations, 3, hashFunc().Size())
+	mac := hmac.New(hashFunc, key)
+	mac.Write(message)
+	if !hmac.Equal(mac.Sum(nil), macData.Mac.Digest) {
+		return ErrIncorrectPassword
+	}
+	return nil
+}
+
+func pkcs12DigestHash(algorithm asn1.ObjectIdentifier) (func() hash.Hash, error) {
+	switch {
+	case algorithm.Equal(oidSHA1):
+		return sha1.New, nil
+	case algorithm.Equal(oidSHA256):
+		return sha256.New, nil
+	case algorithm.Equal(oidSHA384):
+		return sha512.New384, nil
+	case algorithm.Equal(oidSHA512):
+		return sha512.New, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported digest algorithm %v", algorithm))
+}
+
+// Decrypt data encrypted with a PKCS#12 or PBES2 password based scheme
+// PKCS#12 schemes use bmpPassword, PBES2 the password's utf-8 bytes
+func pbeDecrypt(algorithm pkix.AlgorithmIdentifier, password string, bmpPassword []byte, data []byte) ([]byte, error) {
+	var block cipher.Block
+	var iv []byte
+	switch {
+	case algorithm.Algorithm.Equal(oidPBES2):
+		var err error
+		block, iv, err = pbes2Cipher(algorithm, password)
+		if err != nil {
+			return nil, err
+		}
+	case algorithm.Algorithm.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC),
+		algorithm.Algorithm.Equal(oidPBEWithSHAAnd128BitRC2CBC),
+		algorithm.Algorithm.Equal(oidPBEWithSHAAnd40BitRC2CBC):
+		params := pkcs12PBEParams{}
+		if err := unmarshalDER(algorithm.Parameters.FullBytes, &params); err != nil {
+			return nil, corruptCertificate(err)
+		}
+		keySize := 24
+		if algorithm.Algorithm.Equal(oidPBEWithSHAAnd128BitRC2CBC) {
+			keySize = 16
+		} else if algorithm.Algorithm.Equal(oidPBEWithSHAAnd40BitRC2CBC) {
+			keySize = 5
+		}
+		key := pkcs12KDF(sha1.New, bmpPassword, params.Salt, params.Iterations, 1, keySize)
+		iv = pkcs12KDF(sha1.New, bmpPassword, params.Salt, params.Iterations, 2, 8)
+		var err error
+		if keySize == 24 {
+			block, err = des.NewTripleDESCipher(key)
+		} else {
+			block, err = newRC2Cipher(key, keySize*8)
+		}
+		if err != nil {
+			return nil, corruptCertificate(err)
+		}
+	default:
+		return nil, corruptCertificate(errors.New(fmt.Sprintf("unsupported encryption algorithm %v", algorithm.Algorithm)))
+	}
+
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 || len(iv) != block.BlockSize() {
+		return nil, corruptCertificate(errors.New("encrypted data is not a whole number of blocks"))
+	}
+	decrypted := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, data)
+
+	//a wrong password almost always leaves invalid padding
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, ErrIncorrectPassword
+	}
+	for _, b := range decrypted[len(decrypted)-padding:] {
+		if int(b) != padding {
+			return nil, ErrIncorrectPassword
+		}
+	}
+	return decrypted[:len(decrypted)-padding], nil
+}
+
+// The cipher and iv for PBES2 (RFC 8018) with PBKDF2
+func pbes2Cipher(algorithm pkix.AlgorithmIdentifier, password string) (cipher.Block, []byte, error) {
+	params := pbes2Params{}
+	if err := unmarshalDER(algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, nil, corruptCertificate(err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, nil, corruptCertificate(errors.New(fmt.Sprintf("unsupported key derivation function %v", params.KeyDerivationFunc.Algorithm)))
+	}
+	kdfParams := pbkdf2Params{}
+	if err := unmarshalDER(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, nil, corruptCertificate(err)
+	}
+
+	var prf func() hash.Hash
+	switch prfAlgorithm := kdfParams.Prf.Algorithm; {
+	case prfAlgorithm == nil || prfAlgorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case prfAlgorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case prfAlgorithm.Equal(oidHMACWithSHA384):
+		prf = sha512.New384
+	case prfAlgorithm.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, nil, corruptCertificate(errors.New(fmt.Sprintf("unsupported PBKDF2 function %v", prfAlgorithm)))
+	}
+
+	scheme := params.EncryptionScheme.Algorithm
+	keySize := 0
+	switch {
+	case scheme.Equal(oidAES128CBC):
+		keySize = 16
+	case scheme.Equal(oidAES192CBC):
+		keySize = 24
+	case scheme.Equal(oidAES256CBC):
+		keySize = 32
+	case scheme.Equal(oidDESEDE3CBC):
+		keySize = 24
+	default:
+		return nil, nil, corruptCertificate(errors.New(fmt.Sprintf("unsupported encryption scheme %v", scheme)))
+	}
+	iv := []byte{}
+	if err := unmarshalDER(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, nil, corruptCertificate(err)
+	}
+
+	key, err := pbkdf2.Key(prf, password, kdfParams.Salt, kdfParams.IterationCount, keySize)
+	if err != nil {
+		return nil, nil, corruptCertificate(err)
+	}
+	var block cipher.Block
+	if scheme.Equal(oidDESEDE3CBC) {
+		block, err = des.NewTripleDESCipher(key)
+	} else {
+		block, err = aes.NewCipher(key)
+	}
+	if err != nil {
+		return nil, nil, corruptCertificate(err)
+	}
+	return block, iv, nil
+}
+
+// The PKCS#12 key derivation function (RFC 7292 appendix B), id 1 for
+// keys, 2 for ivs and 3 for MAC keys
+func pkcs12KDF(hashFunc func() hash.Hash, password, salt []byte, iterations int, id byte, size int) []byte {
+	v := hashFunc().BlockSize()
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fillBlocks(salt, v), fillBlocks(password, v)...)
+
+	out := []byte{}
+	for {
+		h := hashFunc()
+		h.Write(d)
+		h.Write(i)
+		a := h.Sum(nil)
+		for r := 1; r < iterations; r++ {
+			h.Reset()
+			h.Write(a)
+			a = h.Sum(a[:0])
+		}
+		out = append(out, a...)
+		if len(out) >= size {
+			return out[:size]
+		}
+
+		//add a (repeated to a block) + 1 to every block of i
+		b := fillBlocks(a, v)
+		for j := 0; j < len(i); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(i[j+k]) + int(b[k]) + carry
+				i[j+k] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+}
+
+// data repeated to fill whole blocks of v bytes
+func fillBlocks(data []byte, v int) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	filled := make([]byte, v*((len(data)+v-1)/v))
+	for i := range filled {
+		filled[i] = data[i%len(data)]
+	}
+	return filled
+}
+
+// password as a null terminated big endian UTF-16 string
+func bmpString(password string) []byte {
+	encoded := utf16.Encode([]rune(password))
+	bmp := make([]byte, 0, 2*len(encoded)+2)
+	for _, c := range encoded {
+		bmp = append(bmp, byte(c>>8), byte(c))
+	}
+	return append(bmp, 0, 0)
+}
+
+// asn1.Unmarshal, failing on trailing data
+func unmarshalDER(data []byte, out interface{}) error {
+	rest, err := asn1.Unmarshal(data, out)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return errors.New("trailing data after ASN.1 structure")
+	}
+	return nil
+}
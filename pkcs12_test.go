@@ -0,0 +1,24 @@
+package apns
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestBMPStringShouldBeNullTerminated(t *testing.T) {
+	expected := []byte{0, 's', 0, 'e', 0x20, 0xac, 0, 0}
+	if encoded := bmpString("se€"); !bytes.Equal(encoded, expected) {
+		t.Error(fmt.Sprintf("Expected %x but got %x", expected, encoded))
+	}
+}
+
+func TestDecodePKCS12ShouldCollectCertificatesAndKeys(t *testing.T) {
+	contents, err := decodePKCS12(certificateTestP12Bytes(t, certificateTestLegacyP12), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contents.certificates) != 1 || len(contents.keys) != 1 {
+		t.Error(fmt.Sprintf("Expected 1 certificate and key but got %v and %v", len(contents.certificates), len(contents.keys)))
+	}
+}
@@ -0,0 +1,511 @@
+package apns
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How an APNSConnectionPool spreads payloads over its connections
+type PoolStrategy int
+
+const (
+	// Each payload goes to the next connection in turn
+	PoolRoundRobin PoolStrategy = iota
+	// Each payload goes to the connection with the fewest queued payloads
+	PoolLeastPending
+	// Payloads go to a connection picked by a hash of the device token, so
+	// those for one device are sent in order over the same connection
+	// While that connection is being replaced its tokens move to the next
+	// open one, payloads already queued for it wait for the replacement
+	PoolTokenHash
+)
+
+// Config for creating a pool of APNS connections
+type APNSPoolConfig struct {
+	// config every connection is made with : required
+	ConnectionConfig *APNSConfig
+	// number of connections to open, defaults to 4
+	Size int
+	// number of payloads queued for each connection before sends to it
+	// block, defaults to 100
+	MaxPendingPerConnection int
+	// how payloads are spread over the connections, defaults to PoolRoundRobin
+	Strategy PoolStrategy
+	// number of milliseconds between attempts to replace a connection that
+	// closed, defaults to 1000
+	ReconnectInterval int
+	// number of ConnectionCloses CloseChannel holds unread, defaults to 0
+	CloseBufferSize int
+	// what's done with a ConnectionClose when CloseChannel is full,
+	// defaults to CloseBlock
+	CloseFullPolicy CloseFullPolicy
+	// number of payloads a connection sends before it's replaced with a
+	// new one, defaults to 0 (no limit)
+	// One connection is replaced at a time, one that's due meanwhile
+	// carries on sending until it can be, and the first connections'
+	// limits are spread between 1 and 2 times this so they aren't all
+	// replaced together
+	MaxNotificationsPerConnection int
+	// number of milliseconds a connection is kept open before it's
+	// replaced as for MaxNotificationsPerConnection, defaults to 0 (no
+	// limit)
+	MaxConnectionAge int
+	// opens a connection, overridden in tests
+	dial func(config *APNSConfig) (*APNSConnection, error)
+}
+
+// A pool of APNS connections sharing one config
+// Payloads sent on SendChannel are spread over the connections (see
+// PoolStrategy). When a connection closes its ConnectionClose is passed
+// on to CloseChannel, as for a single connection, and it is replaced;
+// payloads still queued for it are sent on the replacement
+// Close drains every connection, ending with a single ConnectionClose
+// holding all of their unsent payloads before CloseChannel is closed
+// A connection whose close hasn't been read can't be replaced, so with a
+// consumer that may stall set CloseBufferSize and a CloseFullPolicy that
+// drops closes rather than waiting
+type APNSConnectionPool struct {
+	// Channel to send payloads on
+	SendChannel chan *Payload
+	// Channel that connection closes are received on, should be read
+	// until closed
+	CloseChannel chan *ConnectionClose
+
+	config    *APNSPoolConfig
+	members   []*poolMember
+	lock      *sync.Mutex
+	next      int
+	closing   chan bool
+	closeOnce *sync.Once
+	wg        *sync.WaitGroup
+	// Pause and Resume
+	pauses *pauseSwitch
+
+	// unsent payloads gathered while draining, guarded by lock
+	unsent         *list.List
+	bufferOverflow bool
+	// CloseStats counts
+	closes *closeCounts
+	// whether a member's connection is being replaced, guarded by lock
+	recycling bool
+}
+
+// One connection of the pool and the payloads queued for it
+type poolMember struct {
+	queue chan *Payload
+	// nil while being replaced, guarded by the pool's lock
+	conn *APNSConnection
+}
+
+// Create a new pool, opening all of its connections
+// If invalid config, or a connection can't be opened, an error will be
+// returned
+// See APNSPoolConfig object for defaults
+func NewAPNSConnectionPool(config *APNSPoolConfig) (*APNSConnectionPool, error) {
+	errorStrs := ""
+
+	if config.ConnectionConfig == nil {
+		errorStrs += "Invalid ConnectionConfig, should be set\n"
+	}
+	if config.Size < 0 {
+		errorStrs += "Invalid Size. Should be > 0.\n"
+	}
+	if config.MaxPendingPerConnection < 0 {
+		errorStrs += "Invalid MaxPendingPerConnection. Should be > 0.\n"
+	}
+	if config.Strategy != PoolRoundRobin && config.Strategy != PoolLeastPending && config.Strategy != PoolTokenHash {
+		errorStrs += "Invalid Strategy. Should be PoolRoundRobin, PoolLeastPending or PoolTokenHash.\n"
+	}
+	if config.ReconnectInterval < 0 {
+		errorStrs += "Invalid ReconnectInterval. Should be >= 0.\n"
+	}
+	if config.MaxNotificationsPerConnection < 0 || config.MaxConnectionAge < 0 {
+		errorStrs += "Invalid MaxNotificationsPerConnection or MaxConnectionAge. Should be >= 0.\n"
+	}
+	if config.CloseBufferSize < 0 {
+		errorStrs += "Invalid CloseBufferSize. Should be >= 0.\n"
+	}
+	if _, ok := closeFullPolicyNames[config.CloseFullPolicy]; !ok {
+		errorStrs += "Invalid CloseFullPolicy. Should be CloseBlock, CloseDrop or CloseDeadLetter.\n"
+	}
+
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+
+	if config.Size == 0 {
+		config.Size = 4
+	}
+	if config.MaxPendingPerConnection == 0 {
+		config.MaxPendingPerConnection = 100
+	}
+	if config.ReconnectInterval == 0 {
+		config.ReconnectInterval = 1000
+	}
+	if config.dial == nil {
+		config.dial = NewAPNSConnection
+	}
+	connectionConfig := config.ConnectionConfig
+	if connectionConfig.MaxNotificationsPerSecond > 0 && connectionConfig.poolRateLimiter == nil {
+		if connectionConfig.clock == nil {
+			connectionConfig.clock = realClock{}
+		}
+		connectionConfig.poolRateLimiter = newRateLimiter(connectionConfig.clock,
+			connectionConfig.MaxNotificationsPerSecond, connectionConfig.RateLimitBurst,
+			connectionConfig.SlowStartFraction, time.Duration(connectionConfig.SlowStartRampTime)*time.Millisecond)
+	}
+
+	p := &APNSConnectionPool{
+		SendChannel:  make(chan *Payload),
+		CloseChannel: make(chan *ConnectionClose, config.CloseBufferSize),
+		config:       config,
+		lock:         new(sync.Mutex),
+		closing:      make(chan bool),
+		closeOnce:    new(sync.Once),
+		wg:           new(sync.WaitGroup),
+		pauses:       newPauseSwitch(),
+		unsent:       list.New(),
+		closes:       new(closeCounts),
+	}
+	for i := 0; i < config.Size; i++ {
+		conn, err := config.dial(config.ConnectionConfig)
+		if err != nil {
+			for _, m := range p.members {
+				m.conn.Disconnect()
+			}
+			return nil, err
+		}
+		p.members = append(p.members, &poolMember{
+			queue: make(chan *Payload, config.MaxPendingPerConnection),
+			conn:  conn,
+		})
+	}
+
+	for i, m := range p.members {
+		p.wg.Add(1)
+		go p.memberListener(m, float64(config.Size+i)/float64(config.Size))
+	}
+	go p.sendListener()
+	return p, nil
+}
+
+// Stop accepting payloads and disconnect every connection once the
+// payloads queued for it have been sent
+// Returns straight away, the pool is closed once the final
+// ConnectionClose has been received from CloseChannel
+// Closing SendChannel does the same
+func (p *APNSConnectionPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+}
+
+// Number of connections currently open, those being replaced aren't
+// counted
+func (p *APNSConnectionPool) Healthy() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	healthy := 0
+	for _, m := range p.members {
+		if m.conn != nil {
+			healthy++
+		}
+	}
+	return healthy
+}
+
+// State of the rate limiter shared by the pool's connections, so Waiting
+// counts the payloads held up across all of them
+func (p *APNSConnectionPool) RateLimitState() RateLimitState {
+	limiter := p.config.ConnectionConfig.poolRateLimiter
+	if limiter == nil {
+		return RateLimitState{}
+	}
+	return limiter.state()
+}
+
+// Send a payload on one of the open connections, picked as for
+// SendChannel, and wait for apple's verdict (see APNSConnection.Send)
+// Payloads queued on SendChannel aren't waited for, so it may overtake them
+// Safe to call from many goroutines
+func (p *APNSConnectionPool) Send(ctx context.Context, payload *Payload) (*Result, error) {
+	send, err := p.startSend(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+	return send.wait(ctx)
+}
+
+// Send every payload over the pool's connections and wait for all of
+// their verdicts (see APNSConnection.SendAll)
+func (p *APNSConnectionPool) SendAll(ctx context.Context, payloads []*Payload) ([]Result, error) {
+	return sendAll(ctx, payloads, BatchOptions{}, p.startSend)
+}
+
+// Send every payload over the pool's connections with options (see
+// APNSConnection.SendAllWithOptions)
+func (p *APNSConnectionPool) SendAllWithOptions(ctx context.Context, payloads []*Payload, options BatchOptions) ([]Result, error) {
+	return sendAll(ctx, payloads, options, p.startSend)
+}
+
+// Hand a payload to one of the open connections for Send
+func (p *APNSConnectionPool) startSend(ctx context.Context, payload *Payload) (*syncSend, error) {
+	select {
+	case <-p.closing:
+		return nil, errors.New("Cannot send payload, pool is closed")
+	default:
+	}
+	m := p.pickFor(payload)
+	p.lock.Lock()
+	conn := m.conn
+	p.lock.Unlock()
+	if conn == nil {
+		return nil, errors.New("Cannot send payload, no connections are open")
+	}
+	return conn.startSend(ctx, payload)
+}
+
+// go-routine handing payloads from SendChannel to the members
+func (p *APNSConnectionPool) sendListener() {
+	defer func() {
+		for _, m := range p.members {
+			close(m.queue)
+		}
+		go p.finish()
+	}()
+
+	for {
+		select {
+		case payload, ok := <-p.SendChannel:
+			if !ok {
+				p.Close()
+				return
+			}
+			//blocks once the member has MaxPendingPerConnection queued
+			select {
+			case p.pickFor(payload).queue <- payload:
+			case <-p.closing:
+				p.addUnsent(payload)
+				return
+			}
+		case <-p.closing:
+			return
+		}
+	}
+}
+
+// Choose the member for the next payload, preferring open connections
+func (p *APNSConnectionPool) pick() *poolMember {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var picked *poolMember
+	for i := range p.members {
+		m := p.members[(p.next+i)%len(p.members)]
+		if m.conn == nil {
+			continue
+		}
+		if p.config.Strategy == PoolRoundRobin {
+			picked = m
+			break
+		}
+		if picked == nil || len(m.queue) < len(picked.queue) {
+			picked = m
+		}
+	}
+	if picked == nil {
+		//all being replaced, queue for whichever comes back
+		picked = p.members[p.next%len(p.members)]
+	}
+	p.next++
+	return picked
+}
+
+// Choose the member for a payload, by its token with PoolTokenHash
+func (p *APNSConnectionPool) pickFor(payload *Payload) *poolMember {
+	if p.config.Strategy != PoolTokenHash {
+		return p.pick()
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.ToLower(payload.Token)))
+	shard := int(hash.Sum32() % uint32(len(p.members)))
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i := range p.members {
+		if m := p.members[(shard+i)%len(p.members)]; m.conn != nil {
+			return m
+		}
+	}
+	//all being replaced, queue for the token's own
+	return p.members[shard]
+}
+
+// go-routine feeding a member's queue to its connection, replacing the
+// connection whenever it closes
+// stagger scales the first connection's recycle limits
+func (p *APNSConnectionPool) memberListener(m *poolMember, stagger float64) {
+	defer p.wg.Done()
+
+	p.lock.Lock()
+	conn := m.conn
+	p.lock.Unlock()
+
+	//payload taken off the queue that the connection closed before taking
+	var carried *Payload
+	recycling := newRecycleTracker(p.config.MaxNotificationsPerConnection, p.config.MaxConnectionAge, stagger)
+	for {
+		if conn == nil {
+			if conn = p.replace(m); conn == nil {
+				//closing, nothing left to send these on
+				if carried != nil {
+					p.addUnsent(carried)
+				}
+				for payload := range m.queue {
+					p.addUnsent(payload)
+				}
+				return
+			}
+		}
+
+		paused, pauseChanged := p.pauses.state()
+		if paused {
+			select {
+			case <-pauseChanged:
+			case connectionClose := <-conn.CloseChannel:
+				p.memberClosed(m, connectionClose)
+				conn = nil
+			case <-p.closing:
+				//send nothing more, hand back what's queued after what
+				//the connection had
+				p.drain(conn)
+				if carried != nil {
+					p.addUnsent(carried)
+				}
+				for payload := range m.queue {
+					p.addUnsent(payload)
+				}
+				return
+			}
+			continue
+		}
+
+		recycling.track(conn)
+		if carried == nil {
+			if recycling.due() {
+				conn = p.recycle(m, conn, recycling)
+				continue
+			}
+			select {
+			case <-pauseChanged:
+				continue
+			case <-recycling.aged():
+				continue
+			case payload, ok := <-m.queue:
+				if !ok {
+					p.drain(conn)
+					return
+				}
+				carried = payload
+			case connectionClose := <-conn.CloseChannel:
+				p.memberClosed(m, connectionClose)
+				conn = nil
+				continue
+			}
+		}
+
+		select {
+		case conn.SendChannel <- carried:
+			carried = nil
+			recycling.count()
+		case connectionClose := <-conn.CloseChannel:
+			p.memberClosed(m, connectionClose)
+			conn = nil
+		}
+	}
+}
+
+// Pass on the close of a member's connection and mark it for replacement
+func (p *APNSConnectionPool) memberClosed(m *poolMember, connectionClose *ConnectionClose) {
+	p.lock.Lock()
+	m.conn = nil
+	p.lock.Unlock()
+	p.passOn(connectionClose)
+}
+
+// Open a new connection for the member, retrying every ReconnectInterval
+// Returns nil if the pool starts closing first
+func (p *APNSConnectionPool) replace(m *poolMember) *APNSConnection {
+	for {
+		select {
+		case <-p.closing:
+			return nil
+		default:
+		}
+		if conn, err := p.config.dial(p.config.ConnectionConfig); err == nil {
+			conn.config.StatsCollector.OnReconnect()
+			p.lock.Lock()
+			m.conn = conn
+			p.lock.Unlock()
+			return conn
+		}
+		select {
+		case <-time.After(time.Duration(p.config.ReconnectInterval) * time.Millisecond):
+		case <-p.closing:
+			return nil
+		}
+	}
+}
+
+// Shut a member's connection down now its queue is empty, keeping its
+// unsent payloads for the final ConnectionClose
+func (p *APNSConnectionPool) drain(conn *APNSConnection) {
+	connectionClose := conn.shutdownForClose()
+	if connectionClose == nil {
+		return
+	}
+
+	p.lock.Lock()
+	p.unsent.PushBackList(connectionClose.UnsentPayloads)
+	p.bufferOverflow = p.bufferOverflow || connectionClose.UnsentPayloadBufferOverflow
+	p.lock.Unlock()
+	reason := errors.New(fmt.Sprintf("Payload was not sent before Close: %v", connectionClose.Error))
+	if connectionClose.ErrorPayload != nil && connectionClose.Error.ErrorCode == 10 {
+		//the socket closing doesn't say whether apple read it
+		p.deadLetter(connectionClose.ErrorPayload, 1, reason)
+	}
+	for e := connectionClose.UnsentPayloads.Front(); e != nil; e = e.Next() {
+		p.deadLetter(e.Value.(*Payload), 1, reason)
+	}
+
+	//apple rejected a payload while draining, or didn't close in time, pass
+	//the close on
+	connectionClose.UnsentPayloads = list.New()
+	connectionClose.UnsentPayloadBufferOverflow = false
+	p.passOn(connectionClose)
+}
+
+// Keep a payload no connection took for the final ConnectionClose
+func (p *APNSConnectionPool) addUnsent(payload *Payload) {
+	p.lock.Lock()
+	p.unsent.PushBack(payload)
+	p.lock.Unlock()
+	p.deadLetter(payload, 0, errors.New("Payload was not sent before Close"))
+}
+
+// Send the final ConnectionClose once every member has drained
+func (p *APNSConnectionPool) finish() {
+	p.wg.Wait()
+	p.CloseChannel <- &ConnectionClose{
+		UnsentPayloads:              p.unsent,
+		UnsentPayloadBufferOverflow: p.bufferOverflow,
+		Time:                        time.Now(),
+	}
+	close(p.CloseChannel)
+}
@@ -0,0 +1,366 @@
+package apns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Mock gateway socket for the pool, safe to inspect while in use
+type poolTestSocket struct {
+	lock      *sync.Mutex
+	written   *bytes.Buffer
+	responses chan []byte
+	closed    chan bool
+	closeOnce *sync.Once
+}
+
+func newPoolTestSocket() *poolTestSocket {
+	return &poolTestSocket{
+		lock:      new(sync.Mutex),
+		written:   new(bytes.Buffer),
+		responses: make(chan []byte, 1),
+		closed:    make(chan bool),
+		closeOnce: new(sync.Once),
+	}
+}
+
+// Respond with an error for the payload id, closing the connection
+func (s *poolTestSocket) reject(errorCode uint8, id uint32) {
+	s.responses <- []byte{8, errorCode, byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+}
+
+// Number of test payloads written
+func (s *poolTestSocket) sent() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return bytes.Count(s.written.Bytes(), []byte("Testing"))
+}
+
+func (s *poolTestSocket) Read(b []byte) (int, error) {
+	select {
+	case response := <-s.responses:
+		return copy(b, response), nil
+	case <-s.closed:
+		return 0, errors.New("Socket Closed")
+	}
+}
+func (s *poolTestSocket) Write(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.written.Write(b)
+}
+func (s *poolTestSocket) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+func (s *poolTestSocket) LocalAddr() net.Addr                { return nil }
+func (s *poolTestSocket) RemoteAddr() net.Addr               { return nil }
+func (s *poolTestSocket) SetDeadline(t time.Time) error      { return nil }
+func (s *poolTestSocket) SetReadDeadline(t time.Time) error  { return nil }
+func (s *poolTestSocket) SetWriteDeadline(t time.Time) error { return nil }
+
+// Dials connections over poolTestSockets, keeping hold of the sockets
+type poolTestDialer struct {
+	lock    *sync.Mutex
+	sockets []*poolTestSocket
+	fail    bool
+}
+
+func (d *poolTestDialer) dial(config *APNSConfig) (*APNSConnection, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.fail {
+		return nil, errors.New("Dial failed")
+	}
+	socket := newPoolTestSocket()
+	d.sockets = append(d.sockets, socket)
+	return socketAPNSConnection(socket, config), nil
+}
+
+func (d *poolTestDialer) socket(i int) *poolTestSocket {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if i >= len(d.sockets) {
+		return nil
+	}
+	return d.sockets[i]
+}
+
+func newPoolTestPool(t *testing.T, size int, strategy PoolStrategy) (*APNSConnectionPool, *poolTestDialer) {
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	pool, err := NewAPNSConnectionPool(&APNSPoolConfig{
+		ConnectionConfig: &APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		},
+		Size:              size,
+		Strategy:          strategy,
+		ReconnectInterval: 5,
+		dial:              dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool, dialer
+}
+
+// Wait for the sockets to have had the number of payloads written
+func waitForPoolSends(t *testing.T, dialer *poolTestDialer, expected []int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		actual := make([]int, len(expected))
+		matched := true
+		for i := range expected {
+			if socket := dialer.socket(i); socket != nil {
+				actual[i] = socket.sent()
+			}
+			matched = matched && actual[i] == expected[i]
+		}
+		if matched {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("Expected %v payloads written to each socket but got %v", expected, actual))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func finalPoolClose(t *testing.T, pool *APNSConnectionPool) *ConnectionClose {
+	var last *ConnectionClose
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case connectionClose, ok := <-pool.CloseChannel:
+			if !ok {
+				return last
+			}
+			last = connectionClose
+		case <-timeout:
+			t.Fatal("Pool didn't close")
+		}
+	}
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	pool, dialer := newPoolTestPool(t, 3, PoolRoundRobin)
+	for i := 0; i < 6; i++ {
+		pool.SendChannel <- groupTestPayload(i)
+	}
+	waitForPoolSends(t, dialer, []int{2, 2, 2})
+
+	pool.Close()
+	connectionClose := finalPoolClose(t, pool)
+	if connectionClose.Error != nil || connectionClose.UnsentPayloads.Len() != 0 {
+		t.Error(fmt.Sprintf("Expected a clean close but got %v", connectionClose))
+	}
+}
+
+func TestPoolPick(t *testing.T) {
+	members := []*poolMember{}
+	for i := 0; i < 3; i++ {
+		members = append(members, &poolMember{queue: make(chan *Payload, 10), conn: &APNSConnection{}})
+	}
+	pool := &APNSConnectionPool{config: &APNSPoolConfig{Strategy: PoolLeastPending}, members: members, lock: new(sync.Mutex)}
+
+	members[0].queue <- groupTestPayload(0)
+	members[0].queue <- groupTestPayload(1)
+	members[2].queue <- groupTestPayload(2)
+	if picked := pool.pick(); picked != members[1] {
+		t.Error("Expected the member with the fewest pending to be picked")
+	}
+
+	//connections being replaced are skipped
+	members[1].conn = nil
+	if picked := pool.pick(); picked != members[2] {
+		t.Error("Expected the open member with the fewest pending to be picked")
+	}
+
+	pool.config.Strategy = PoolRoundRobin
+	pool.next = 0
+	picks := []*poolMember{pool.pick(), pool.pick(), pool.pick()}
+	if picks[0] != members[0] || picks[1] != members[2] || picks[2] != members[2] {
+		t.Error("Expected round robin to skip the member being replaced")
+	}
+
+	//nothing open, queue anyway
+	members[0].conn, members[2].conn = nil, nil
+	if picked := pool.pick(); picked == nil {
+		t.Error("Expected a member to be picked")
+	}
+}
+
+func TestPoolShouldReplaceClosedConnection(t *testing.T) {
+	pool, dialer := newPoolTestPool(t, 2, PoolRoundRobin)
+	pool.SendChannel <- groupTestPayload(0)
+	pool.SendChannel <- groupTestPayload(1)
+	waitForPoolSends(t, dialer, []int{1, 1})
+
+	//apple rejects the first connection's payload
+	dialer.socket(0).reject(8, 0)
+	connectionClose := <-pool.CloseChannel
+	if connectionClose.Error.ErrorCode != 8 || connectionClose.ErrorPayload == nil || connectionClose.ErrorPayload.AlertText != "Testing0" {
+		t.Error(fmt.Sprintf("Expected the rejection to be passed on but got %v", connectionClose))
+	}
+
+	//the replacement carries on
+	deadline := time.Now().Add(2 * time.Second)
+	for dialer.socket(2) == nil || pool.Healthy() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the closed connection to be replaced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 2; i < 6; i++ {
+		pool.SendChannel <- groupTestPayload(i)
+	}
+	waitForPoolSends(t, dialer, []int{1, 3, 2})
+
+	pool.Close()
+	if connectionClose := finalPoolClose(t, pool); connectionClose.UnsentPayloads.Len() != 0 {
+		t.Error(fmt.Sprintf("Expected nothing unsent but got %v", connectionClose))
+	}
+}
+
+func TestPoolCloseShouldAggregateUnsent(t *testing.T) {
+	pool, dialer := newPoolTestPool(t, 2, PoolRoundRobin)
+
+	//the second connection can't be replaced, so payloads queued for it
+	//are never sent
+	dialer.lock.Lock()
+	dialer.fail = true
+	dialer.lock.Unlock()
+	dialer.socket(1).reject(10, 0)
+	connectionClose := <-pool.CloseChannel
+	if connectionClose.Error.ErrorCode != 10 {
+		t.Error(fmt.Sprintf("Expected the shutdown to be passed on but got %v", connectionClose))
+	}
+	for pool.Healthy() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	pool.members[1].queue <- groupTestPayload(1)
+	pool.SendChannel <- groupTestPayload(0)
+	waitForPoolSends(t, dialer, []int{1, 0})
+
+	pool.Close()
+	connectionClose = finalPoolClose(t, pool)
+	if connectionClose.UnsentPayloads.Len() != 1 || connectionClose.UnsentPayloads.Front().Value.(*Payload).AlertText != "Testing1" {
+		t.Error(fmt.Sprintf("Expected the queued payload to be unsent but got %v", connectionClose))
+	}
+}
+
+func TestPoolCloseShouldAccountForEveryPayload(t *testing.T) {
+	for cycle := 0; cycle < 100; cycle++ {
+		pool, dialer := newPoolTestPool(t, 1, PoolRoundRobin)
+		count := 20
+		for i := 0; i < count; i++ {
+			pool.SendChannel <- groupTestPayload(i)
+		}
+		pool.Close()
+
+		unsent := 0
+		for connectionClose := range pool.CloseChannel {
+			unsent += connectionClose.UnsentPayloads.Len()
+			if connectionClose.ErrorPayload != nil {
+				unsent++
+			}
+		}
+		if sent := dialer.socket(0).sent(); sent+unsent != count {
+			t.Fatal(fmt.Sprintf("Expected all %v payloads to be sent or unsent on cycle %v but %v were sent and %v unsent",
+				count, cycle, sent, unsent))
+		}
+	}
+}
+
+func TestPoolConfigValidation(t *testing.T) {
+	configs := map[string]*APNSPoolConfig{
+		"no connection config": {},
+		"negative size":        {ConnectionConfig: &APNSConfig{}, Size: -1},
+		"negative pending":     {ConnectionConfig: &APNSConfig{}, MaxPendingPerConnection: -1},
+		"unknown strategy":     {ConnectionConfig: &APNSConfig{}, Strategy: 7},
+		"negative reconnect":   {ConnectionConfig: &APNSConfig{}, ReconnectInterval: -1},
+	}
+	for name, config := range configs {
+		if _, err := NewAPNSConnectionPool(config); err == nil {
+			t.Error(fmt.Sprintf("Expected %v to be invalid", name))
+		}
+	}
+
+	dialer := &poolTestDialer{lock: new(sync.Mutex), fail: true}
+	if _, err := NewAPNSConnectionPool(&APNSPoolConfig{ConnectionConfig: &APNSConfig{}, dial: dialer.dial}); err == nil {
+		t.Error("Expected an error when a connection can't be opened")
+	}
+}
+
+func TestPoolTokenHashShouldKeepEachDeviceInOrder(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	app.Pool.Size = 4
+	app.Pool.Strategy = PoolTokenHash
+	pool, err := NewAPNSConnectionPool(app.Pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer finalPoolClose(t, pool)
+	defer pool.Close()
+
+	tokens := []string{groupTestPayload(1).Token, groupTestPayload(2).Token}
+	count := 50
+	for i := 0; i < count; i++ {
+		pool.SendChannel <- &Payload{Token: tokens[i%2], AlertText: fmt.Sprintf("Testing%v", i)}
+	}
+	received, err := server.WaitForNotifications(count, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := map[string]int{}
+	connections := map[string]int{}
+	for _, notification := range received {
+		var sequence int
+		alert := string(notification.Payload)
+		fmt.Sscanf(alert[strings.Index(alert, "Testing")+len("Testing"):], "%d", &sequence)
+		if previous, ok := last[notification.Token]; ok && sequence < previous {
+			t.Error(fmt.Sprintf("Expected %v in order but got %v after %v", notification.Token, sequence, previous))
+		}
+		last[notification.Token] = sequence
+		if connection, ok := connections[notification.Token]; ok && connection != notification.Connection {
+			t.Error(fmt.Sprintf("Expected %v on one connection but got %v and %v", notification.Token, connection, notification.Connection))
+		}
+		connections[notification.Token] = notification.Connection
+	}
+}
+
+func TestPoolTokenHashShouldMoveShardOfConnectionBeingReplaced(t *testing.T) {
+	members := []*poolMember{}
+	for i := 0; i < 3; i++ {
+		members = append(members, &poolMember{queue: make(chan *Payload, 10), conn: &APNSConnection{}})
+	}
+	pool := &APNSConnectionPool{config: &APNSPoolConfig{Strategy: PoolTokenHash}, members: members, lock: new(sync.Mutex)}
+
+	payload := groupTestPayload(0)
+	picked := pool.pickFor(payload)
+	if pool.pickFor(payload) != picked || pool.pickFor(&Payload{Token: strings.ToUpper(payload.Token)}) != picked {
+		t.Error("Expected a token to always be picked for the same member")
+	}
+
+	picked.conn = nil
+	moved := pool.pickFor(payload)
+	if moved == picked || moved.conn == nil {
+		t.Error("Expected the token to move to an open member")
+	}
+	for _, m := range members {
+		m.conn = nil
+	}
+	if pool.pickFor(payload) != picked {
+		t.Error("Expected the token's own member with nothing open")
+	}
+}
@@ -0,0 +1,128 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How long a provider token is used before a new one is signed. Apple
+// rejects tokens older than an hour, and refreshing more often than
+// every 20 minutes gets TooManyProviderTokenUpdates
+const ProviderTokenRefreshInterval = 50 * time.Minute
+
+// Signs and caches the ES256 provider tokens (JWTs) used for token based
+// auth, see HTTP2Config.AuthKeyBytes
+// Safe for concurrent use, every request shares the current token
+type providerTokenSource struct {
+	key    *ecdsa.PrivateKey
+	keyID  string
+	teamID string
+	clock  clock
+
+	lock     *sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+func newProviderTokenSource(keyPEM []byte, keyID string, teamID string, c clock) (*providerTokenSource, error) {
+	key, err := parseAuthKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &providerTokenSource{
+		key:    key,
+		keyID:  keyID,
+		teamID: teamID,
+		clock:  c,
+		lock:   new(sync.Mutex),
+	}, nil
+}
+
+// Parse the .p8 key downloaded from Apple, a PKCS#8 P-256 private key
+// (a SEC 1 "EC PRIVATE KEY" is accepted too)
+func parseAuthKey(keyPEM []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("Auth key is not PEM encoded, expected the contents of the .p8 file")
+	}
+
+	var key interface{}
+	var err error
+	if block.Type == "EC PRIVATE KEY" {
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid auth key: %v", err))
+	}
+
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ecKey.Curve != elliptic.P256() {
+		return nil, errors.New("Invalid auth key: should be an ECDSA P-256 key")
+	}
+	return ecKey, nil
+}
+
+// Returns the current token, signing a new one once it is
+// ProviderTokenRefreshInterval old
+func (s *providerTokenSource) current() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.clock.Now()
+	if s.token == "" || now.Sub(s.issuedAt) >= ProviderTokenRefreshInterval {
+		if err := s.sign(now); err != nil {
+			return "", err
+		}
+	}
+	return s.token, nil
+}
+
+// Sign a new token after apple rejected the rejected token, returning
+// the token to retry with. If another request already replaced the
+// rejected token that one is returned, so a burst of rejections only
+// signs once
+func (s *providerTokenSource) refresh(rejected string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.token == rejected {
+		if err := s.sign(s.clock.Now()); err != nil {
+			return "", err
+		}
+	}
+	return s.token, nil
+}
+
+// Must hold lock
+func (s *providerTokenSource) sign(now time.Time) error {
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": s.keyID})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": s.teamID, "iat": now.Unix()})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, sig, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+	if err != nil {
+		return err
+	}
+	//JWS wants the two 32 byte integers back to back, not ASN.1
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	sig.FillBytes(signature[32:])
+
+	s.token = signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+	s.issuedAt = now
+	return nil
+}
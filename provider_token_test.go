@@ -0,0 +1,149 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func generateAuthKey(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// Check the token is a valid ES256 JWT signed by key, returning its header and claims
+func verifyProviderToken(t *testing.T, token string, key *ecdsa.PrivateKey) (map[string]interface{}, map[string]interface{}) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatal(fmt.Sprintf("Expected 3 parts to the token but got %v", token))
+	}
+	decoded := make([][]byte, 3)
+	for i, part := range parts {
+		var err error
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(part); err != nil {
+			t.Fatal(fmt.Sprintf("Expected unpadded base64url but got %v: %v", part, err))
+		}
+	}
+
+	header := map[string]interface{}{}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(decoded[0], &header); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(decoded[1], &claims); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded[2]) != 64 {
+		t.Fatal(fmt.Sprintf("Expected a 64 byte signature but got %v", len(decoded[2])))
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(decoded[2][:32])
+	s := new(big.Int).SetBytes(decoded[2][32:])
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Error("Expected the token signature to verify")
+	}
+	return header, claims
+}
+
+func TestProviderTokenStructure(t *testing.T) {
+	key, keyPEM := generateAuthKey(t)
+	clock := newFakeClock()
+	tokens, err := newProviderTokenSource(keyPEM, "ABC123DEFG", "DEF123GHIJ", clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := tokens.current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, claims := verifyProviderToken(t, token, key)
+	if len(header) != 2 || header["alg"] != "ES256" || header["kid"] != "ABC123DEFG" {
+		t.Error(fmt.Sprintf("Unexpected header %v", header))
+	}
+	if len(claims) != 2 || claims["iss"] != "DEF123GHIJ" || claims["iat"] != float64(clock.Now().Unix()) {
+		t.Error(fmt.Sprintf("Unexpected claims %v", claims))
+	}
+}
+
+func TestProviderTokenShouldBeCachedUntilRefreshInterval(t *testing.T) {
+	_, keyPEM := generateAuthKey(t)
+	clock := newFakeClock()
+	tokens, _ := newProviderTokenSource(keyPEM, "ABC123DEFG", "DEF123GHIJ", clock)
+
+	first, _ := tokens.current()
+	clock.After(ProviderTokenRefreshInterval - time.Second)
+	if token, _ := tokens.current(); token != first {
+		t.Error("Expected the token to be reused before the refresh interval")
+	}
+
+	clock.After(time.Second)
+	second, _ := tokens.current()
+	if second == first {
+		t.Error("Expected a new token after the refresh interval")
+	}
+	if ProviderTokenRefreshInterval < 20*time.Minute || ProviderTokenRefreshInterval >= time.Hour {
+		t.Error("Refresh interval should be between apple's 20 minute and 60 minute limits")
+	}
+}
+
+func TestProviderTokenRefreshShouldOnlySignOncePerRejection(t *testing.T) {
+	_, keyPEM := generateAuthKey(t)
+	clock := newFakeClock()
+	tokens, _ := newProviderTokenSource(keyPEM, "ABC123DEFG", "DEF123GHIJ", clock)
+
+	rejected, _ := tokens.current()
+	refreshed, err := tokens.refresh(rejected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed == rejected {
+		t.Error("Expected a new token after a rejection")
+	}
+	//a second request rejected with the same old token gets the new one
+	if again, _ := tokens.refresh(rejected); again != refreshed {
+		t.Error("Expected the already refreshed token")
+	}
+	if current, _ := tokens.current(); current != refreshed {
+		t.Error("Expected the refreshed token to be current")
+	}
+}
+
+func TestParseAuthKey(t *testing.T) {
+	key, keyPEM := generateAuthKey(t)
+	if parsed, err := parseAuthKey(keyPEM); err != nil || !parsed.Equal(key) {
+		t.Error(fmt.Sprintf("Expected the PKCS#8 key to parse but got %v", err))
+	}
+
+	der, _ := x509.MarshalECPrivateKey(key)
+	if _, err := parseAuthKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		t.Error(fmt.Sprintf("Expected the SEC 1 key to parse but got %v", err))
+	}
+
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ = x509.MarshalPKCS8PrivateKey(p384)
+	if _, err := parseAuthKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err == nil {
+		t.Error("Expected a P-384 key to be rejected")
+	}
+	if _, err := parseAuthKey([]byte("not pem")); err == nil {
+		t.Error("Expected non PEM to be rejected")
+	}
+}
@@ -0,0 +1,272 @@
+package apns
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Returned when a proxy refuses our credentials, or needs some and none
+// were given
+type ProxyAuthError struct {
+	// The proxy's host:port
+	Proxy string
+	// What the proxy said, e.g. 407 Proxy Authentication Required
+	Reason string
+}
+
+func (e *ProxyAuthError) Error() string {
+	return fmt.Sprintf("Proxy %v refused authentication: %v", e.Proxy, e.Reason)
+}
+
+// The proxy settings of HTTPS_PROXY and NO_PROXY for a url, overridden in
+// tests as net/http only reads the environment once
+var proxyFromEnvironment = func(u *url.URL) (*url.URL, error) {
+	return http.ProxyFromEnvironment(&http.Request{URL: u})
+}
+
+// Error message if proxyURL isn't a proxy we can connect through, "" if
+// it's valid or not set
+func validateProxyURL(proxyURL string) string {
+	if proxyURL == "" {
+		return ""
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Host == "" {
+		return fmt.Sprintf("Invalid ProxyURL %q. Should be like http://host:port or socks5://host:port.\n", proxyURL)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return ""
+	}
+	return fmt.Sprintf("Invalid ProxyURL scheme %q. Should be http, https or socks5.\n", u.Scheme)
+}
+
+// The proxy to reach host:port through, proxyURL if set or otherwise from
+// the environment unless ignored, nil to connect directly
+func proxyForGateway(proxyURL string, ignoreEnvironment bool, host, port string) (*url.URL, error) {
+	if proxyURL != "" {
+		return url.Parse(proxyURL)
+	}
+	if ignoreEnvironment {
+		return nil, nil
+	}
+	return proxyFromEnvironment(&url.URL{Scheme: "https", Host: net.JoinHostPort(host, port)})
+}
+
+// host:port of the proxy, with the scheme's default port if it has none
+func proxyAddr(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	defaults := map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}
+	return net.JoinHostPort(proxy.Hostname(), defaults[proxy.Scheme])
+}
+
+// Opens a tcp connection, as net.Dialer.DialContext does
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Dial the proxy and have it open a tunnel to host:port
+// The tunnel is only set up, the tls handshake with apple happens over it
+// as it would directly
+func dialThroughProxy(ctx context.Context, dial dialFunc, proxy *url.URL, host, port string) (net.Conn, error) {
+	addr := proxyAddr(proxy)
+	socket, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	//the whole negotiation has to finish before ctx's deadline
+	deadline, _ := ctx.Deadline()
+	socket.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		socket.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	switch proxy.Scheme {
+	case "https":
+		tlsSocket := tls.Client(socket, &tls.Config{ServerName: proxy.Hostname()})
+		if err = tlsSocket.HandshakeContext(ctx); err == nil {
+			socket, err = connectTunnel(tlsSocket, proxy, addr, host, port)
+		}
+	case "socks5", "socks5h":
+		err = socks5Tunnel(socket, proxy, addr, host, port)
+	default:
+		socket, err = connectTunnel(socket, proxy, addr, host, port)
+	}
+	if err != nil {
+		socket.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	socket.SetDeadline(time.Time{})
+	return socket, nil
+}
+
+// Open a tunnel with an HTTP CONNECT request
+func connectTunnel(socket net.Conn, proxy *url.URL, addr, host, port string) (net.Conn, error) {
+	target := net.JoinHostPort(host, port)
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(socket); err != nil {
+		return socket, err
+	}
+
+	reader := bufio.NewReader(socket)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return socket, err
+	}
+	response.Body.Close()
+	if response.StatusCode == http.StatusProxyAuthRequired {
+		return socket, &ProxyAuthError{Proxy: addr, Reason: response.Status}
+	}
+	if response.StatusCode != http.StatusOK {
+		return socket, errors.New(fmt.Sprintf("Proxy %v refused to connect to %v: %v", addr, target, response.Status))
+	}
+	if reader.Buffered() > 0 {
+		//apple speaks second so this shouldn't happen, but don't lose it
+		return &bufferedConn{Conn: socket, reader: reader}, nil
+	}
+	return socket, nil
+}
+
+// A connection with data already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Reasons a SOCKS5 proxy gives for not connecting (RFC 1928)
+var socks5Replies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Open a tunnel with a SOCKS5 CONNECT, authenticating with a username and
+// password (RFC 1929) if the proxy url has them
+func socks5Tunnel(socket net.Conn, proxy *url.URL, addr, host, port string) error {
+	methods := []byte{0}
+	if proxy.User != nil {
+		methods = []byte{2}
+	}
+	if _, err := socket.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(socket, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return errors.New(fmt.Sprintf("Proxy %v is not a SOCKS5 proxy", addr))
+	}
+	switch reply[1] {
+	case 0:
+	case 2:
+		if proxy.User == nil {
+			return &ProxyAuthError{Proxy: addr, Reason: "username and password required"}
+		}
+		username := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("Proxy username and password should be at most 255 bytes")
+		}
+		auth := []byte{1, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := socket.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(socket, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return &ProxyAuthError{Proxy: addr, Reason: "username or password rejected"}
+		}
+	default:
+		return &ProxyAuthError{Proxy: addr, Reason: "no acceptable authentication method"}
+	}
+
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return err
+	}
+	request := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(append(request, 1), ip.To4()...)
+	} else if ip != nil {
+		request = append(append(request, 4), ip.To16()...)
+	} else if len(host) > 255 {
+		return errors.New(fmt.Sprintf("Host %v is too long for a SOCKS5 proxy", host))
+	} else {
+		//let the proxy resolve the name
+		request = append(append(request, 3, byte(len(host))), host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(portNumber))
+	if _, err := socket.Write(request); err != nil {
+		return err
+	}
+
+	//version, reply, reserved and the bound address
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(socket, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		reason, ok := socks5Replies[header[1]]
+		if !ok {
+			reason = fmt.Sprintf("error %v", header[1])
+		}
+		return errors.New(fmt.Sprintf("Proxy %v refused to connect to %v: %v", addr, net.JoinHostPort(host, port), reason))
+	}
+	boundSize := 0
+	switch header[3] {
+	case 1:
+		boundSize = net.IPv4len
+	case 4:
+		boundSize = net.IPv6len
+	case 3:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(socket, size); err != nil {
+			return err
+		}
+		boundSize = int(size[0])
+	default:
+		return errors.New(fmt.Sprintf("Proxy %v replied with an unknown address type %v", addr, header[3]))
+	}
+	_, err = io.ReadFull(socket, make([]byte, boundSize+2))
+	return err
+}
@@ -0,0 +1,157 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// What Enqueue does when a connection's send queue is full
+type QueueFullPolicy int
+
+const (
+	// Wait for room in the queue, as sending on SendChannel does
+	QueueBlock QueueFullPolicy = iota
+	// Wait up to APNSConfig.QueueFullTimeout for room, then drop the payload
+	QueueBlockWithTimeout
+	// Drop the payload being enqueued
+	QueueDropNewest
+	// Drop the payload that has been queued longest to make room
+	QueueDropOldest
+)
+
+var queueFullPolicyNames = map[QueueFullPolicy]string{
+	QueueBlock:            "block",
+	QueueBlockWithTimeout: "block with timeout",
+	QueueDropNewest:       "drop newest",
+	QueueDropOldest:       "drop oldest",
+}
+
+func (p QueueFullPolicy) String() string {
+	if name, ok := queueFullPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("QueueFullPolicy(%d)", int(p))
+}
+
+// Why a payload was dropped because the send queue was full, the Err of
+// the SendError returned by Enqueue and passed to
+// APNSConfig.SendErrorCallback so it can be kept elsewhere
+type QueueFullError struct {
+	// The payload that was dropped, not necessarily the one being enqueued
+	// with QueueDropOldest
+	Payload *Payload
+	// The policy that dropped it
+	Policy QueueFullPolicy
+	// The queue's capacity (see APNSConfig.SendQueueSize)
+	QueueSize int
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("Send queue full (%v payloads), %v dropped %v", e.QueueSize, e.Policy, e.Payload)
+}
+
+// Queue a payload to be sent, applying the config's QueueFullPolicy if
+// the connection has fallen SendQueueSize payloads behind
+// Returns a *SendError wrapping a *QueueFullError if the payload was
+// dropped, a *SendError of FailureInvalidPayload if its Token isn't 64
+// hex characters or of FailureFiltered if the TokenFilter refused it, or
+// an error if the connection is closed or shutting down; payloads still queued when the
+// connection closes are handed back in the ConnectionClose's UnsentPayloads
+// Safe to call from many goroutines and alongside SendChannel, which
+// always blocks
+func (c *APNSConnection) Enqueue(payload *Payload) error {
+	c.queueLock.RLock()
+	defer c.queueLock.RUnlock()
+	defer c.reportQueueDepth()
+	if c.queueClosed {
+		return errors.New("Cannot send payload, connection is closed")
+	}
+	//refused now rather than failing once it's framed
+	if _, err := payload.binaryToken(); err != nil {
+		sendError := c.sendFailed(payload, FailureInvalidPayload, err)
+		c.deadLetter(payload, sendError)
+		return sendError
+	}
+	if err := filterToken(c.config.TokenFilter, payload.Token); err != nil {
+		return c.tokenFiltered(payload, err)
+	}
+	c.journal.put(payload, nil, c.config.MaxPayloadSize)
+	select {
+	case c.queue <- payload:
+		return nil
+	default:
+	}
+
+	var timeout <-chan time.Time
+	switch c.config.QueueFullPolicy {
+	case QueueDropNewest:
+		return c.queueFull(payload)
+	case QueueDropOldest:
+		for {
+			select {
+			case oldest := <-c.queue:
+				c.queueFull(oldest)
+			default:
+			}
+			select {
+			case c.queue <- payload:
+				return nil
+			default:
+			}
+		}
+	case QueueBlockWithTimeout:
+		timeout = c.config.clock.After(time.Duration(c.config.QueueFullTimeout) * time.Millisecond)
+	}
+	select {
+	case c.queue <- payload:
+		return nil
+	case <-timeout:
+		return c.queueFull(payload)
+	case <-c.stopChannel:
+		c.journal.ack(payload)
+		return errors.New("Cannot send payload, connection is shutting down")
+	case <-c.queueDone:
+		c.journal.ack(payload)
+		return errors.New("Cannot send payload, connection is closed")
+	}
+}
+
+// Report how many payloads are waiting in the queue to the StatsCollector
+func (c *APNSConnection) reportQueueDepth() {
+	c.config.StatsCollector.OnQueueDepth(len(c.queue))
+}
+
+// Report a dropped payload, which no connection took
+func (c *APNSConnection) queueFull(payload *Payload) *SendError {
+	sendError := c.sendFailed(payload, FailureQueueFull, &QueueFullError{
+		Payload:   payload,
+		Policy:    c.config.QueueFullPolicy,
+		QueueSize: cap(c.queue),
+	})
+	if c.config.DeadLetterHandler != nil {
+		c.config.DeadLetterHandler(payload, 0, sendError)
+	}
+	c.journal.ack(payload)
+	return sendError
+}
+
+// Stop taking payloads on the queue, returning those still on it in the
+// order they were queued
+// Called by the send go-routine once the connection has closed
+func (c *APNSConnection) closeQueue() []*Payload {
+	//wake blocked Enqueues so they let go of the read lock
+	close(c.queueDone)
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+	c.queueClosed = true
+	queued := []*Payload{}
+	for {
+		select {
+		case payload := <-c.queue:
+			queued = append(queued, payload)
+		default:
+			return queued
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package apns
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A connection to a gateway that doesn't read until release is closed,
+// with a payload stuck being written so nothing leaves the queue
+func queueTestConnection(t *testing.T, policy QueueFullPolicy) (*APNSConnection, chan bool, chan string) {
+	release := make(chan bool)
+	tokens := make(chan string, 10)
+	config := timeoutTestConfig(t, func(socket *tls.Conn) {
+		<-release
+		readTimeoutTestFrames(socket, tokens)
+	})
+	config.WriteTimeout = 5
+	config.ReadTimeout = 5
+	config.SendQueueSize = 2
+	config.QueueFullPolicy = policy
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SendChannel <- groupTestPayload(0)
+	//let the framing timeout pass so the write is under way
+	time.Sleep(100 * time.Millisecond)
+	return conn, release, tokens
+}
+
+func expectQueueTestTokens(t *testing.T, tokens chan string, expected ...int) {
+	for _, i := range expected {
+		select {
+		case token := <-tokens:
+			if token != groupTestPayload(i).Token {
+				t.Error(fmt.Sprintf("Expected payload %v to be written but got %v", i, token))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal(fmt.Sprintf("Expected payload %v to be written", i))
+		}
+	}
+	select {
+	case token := <-tokens:
+		t.Error(fmt.Sprintf("Expected no more payloads but got %v", token))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func closeQueueTestConnection(conn *APNSConnection) {
+	conn.Disconnect()
+	for range conn.CloseChannel {
+	}
+}
+
+func TestQueueShouldDropNewestWhenFull(t *testing.T) {
+	conn, release, tokens := queueTestConnection(t, QueueDropNewest)
+	dropped := []*SendError{}
+	conn.config.SendErrorCallback = func(err *SendError) {
+		dropped = append(dropped, err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		if err := conn.Enqueue(groupTestPayload(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newest := groupTestPayload(3)
+	err := conn.Enqueue(newest)
+	queueFullError := &QueueFullError{}
+	if !errors.As(err, &queueFullError) || queueFullError.Payload != newest ||
+		queueFullError.Policy != QueueDropNewest || queueFullError.QueueSize != 2 {
+		t.Error(fmt.Sprintf("Expected the newest payload to be dropped but got %v", err))
+	}
+	if len(dropped) != 1 || dropped[0] != err || dropped[0].Kind != FailureQueueFull {
+		t.Error(fmt.Sprintf("Expected the drop to be reported once but got %v", dropped))
+	}
+
+	close(release)
+	expectQueueTestTokens(t, tokens, 0, 1, 2)
+	closeQueueTestConnection(conn)
+}
+
+func TestQueueShouldDropOldestWhenFull(t *testing.T) {
+	conn, release, tokens := queueTestConnection(t, QueueDropOldest)
+	dropped := []*SendError{}
+	conn.config.SendErrorCallback = func(err *SendError) {
+		dropped = append(dropped, err)
+	}
+
+	oldest := groupTestPayload(1)
+	for i, payload := range []*Payload{oldest, groupTestPayload(2), groupTestPayload(3)} {
+		if err := conn.Enqueue(payload); err != nil {
+			t.Error(fmt.Sprintf("Expected payload %v to be queued but got %v", i+1, err))
+		}
+	}
+	if len(dropped) != 1 || dropped[0].Payload != oldest || dropped[0].Err.(*QueueFullError).Policy != QueueDropOldest {
+		t.Error(fmt.Sprintf("Expected the oldest payload to be dropped but got %v", dropped))
+	}
+
+	close(release)
+	expectQueueTestTokens(t, tokens, 0, 2, 3)
+	closeQueueTestConnection(conn)
+}
+
+func TestQueueShouldDropAfterTheTimeout(t *testing.T) {
+	conn, release, tokens := queueTestConnection(t, QueueBlockWithTimeout)
+	conn.config.QueueFullTimeout = 200
+
+	for i := 1; i <= 2; i++ {
+		if err := conn.Enqueue(groupTestPayload(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	err := conn.Enqueue(groupTestPayload(3))
+	queueFullError := &QueueFullError{}
+	if !errors.As(err, &queueFullError) || queueFullError.Policy != QueueBlockWithTimeout {
+		t.Error(fmt.Sprintf("Expected the payload to be dropped but got %v", err))
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Error(fmt.Sprintf("Expected Enqueue to wait for room but it gave up after %v", elapsed))
+	}
+
+	close(release)
+	expectQueueTestTokens(t, tokens, 0, 1, 2)
+	closeQueueTestConnection(conn)
+}
+
+func TestQueueShouldBlockUntilThereIsRoom(t *testing.T) {
+	conn, release, tokens := queueTestConnection(t, QueueBlock)
+
+	for i := 1; i <= 2; i++ {
+		if err := conn.Enqueue(groupTestPayload(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	enqueued := make(chan error, 1)
+	go func() {
+		enqueued <- conn.Enqueue(groupTestPayload(3))
+	}()
+	select {
+	case err := <-enqueued:
+		t.Fatal(fmt.Sprintf("Expected Enqueue to block but got %v", err))
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-enqueued; err != nil {
+		t.Error(fmt.Sprintf("Expected the payload to be queued once there was room but got %v", err))
+	}
+	expectQueueTestTokens(t, tokens, 0, 1, 2, 3)
+	closeQueueTestConnection(conn)
+}
+
+func TestQueueShouldHandBackQueuedPayloadsOnClose(t *testing.T) {
+	stall := make(chan bool)
+	defer close(stall)
+	config := timeoutTestConfig(t, func(socket *tls.Conn) {
+		<-stall
+	})
+	config.ReadTimeout = 5
+	config.SendQueueSize = 2
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SendChannel <- groupTestPayload(0)
+	time.Sleep(100 * time.Millisecond)
+	//whether or not they're taken off the queue once the write times out,
+	//they're handed back in order
+	queued := []*Payload{groupTestPayload(1), groupTestPayload(2)}
+	for _, payload := range queued {
+		if err := conn.Enqueue(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case connectionClose := <-conn.CloseChannel:
+		unsent := connectionClose.UnsentPayloads
+		if unsent.Len() != 2 || unsent.Front().Value != queued[0] || unsent.Back().Value != queued[1] {
+			t.Error(fmt.Sprintf("Expected the queued payloads to be handed back but got %v", connectionClose))
+		}
+		if connectionClose.ErrorPayload == nil || connectionClose.UnsentPayloadBufferOverflow {
+			t.Error(fmt.Sprintf("Expected the stalled payload to be handed back but got %v", connectionClose))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the stalled write to close the connection")
+	}
+
+	if err := conn.Enqueue(groupTestPayload(3)); err == nil || !strings.Contains(err.Error(), "connection is closed") {
+		t.Error(fmt.Sprintf("Expected a closed connection error but got %v", err))
+	}
+}
+
+func TestQueueShouldReportDropsFromManyGoroutines(t *testing.T) {
+	conn, release, _ := queueTestConnection(t, QueueDropNewest)
+	lock := new(sync.Mutex)
+	reported := 0
+	conn.config.SendErrorCallback = func(err *SendError) {
+		lock.Lock()
+		reported++
+		lock.Unlock()
+	}
+
+	wg := new(sync.WaitGroup)
+	errs := make(chan error, 10)
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- conn.Enqueue(groupTestPayload(i))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	dropped := 0
+	for err := range errs {
+		if err != nil {
+			dropped++
+		}
+	}
+	if dropped != 8 || reported != 8 {
+		t.Error(fmt.Sprintf("Expected 8 of 10 payloads to be dropped but got %v (%v reported)", dropped, reported))
+	}
+
+	close(release)
+	closeQueueTestConnection(conn)
+}
+
+func TestQueueValidation(t *testing.T) {
+	config := timeoutTestConfig(t, nil)
+	config.QueueFullPolicy = QueueFullPolicy(9)
+	if _, err := NewAPNSConnection(config); err == nil || !strings.Contains(err.Error(), "QueueFullPolicy") {
+		t.Error(fmt.Sprintf("Expected an invalid QueueFullPolicy error but got %v", err))
+	}
+	if name := (QueueDropOldest).String(); name != "drop oldest" {
+		t.Error(fmt.Sprintf("Expected drop oldest but got %v", name))
+	}
+}
@@ -0,0 +1,190 @@
+package apns
+
+import (
+	"sync"
+	"time"
+)
+
+// Source of time for the connection, replaceable in tests
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Snapshot of a connection's rate limiter
+type RateLimitState struct {
+	// Whether rate limiting is enabled for the connection
+	Enabled bool
+	// The notifications per second currently allowed
+	CurrentRate float64
+	// The notifications per second allowed once fully ramped up
+	TargetRate float64
+	// Whether the connection is still ramping up to the target rate
+	Ramping bool
+	// Number of payloads that have had to wait to be written
+	Waits uint64
+	// Total time payloads have waited to be written, counting the whole
+	// wait for those that gave up on it
+	Waited time.Duration
+	// Number of payloads waiting right now, more than one when the limiter
+	// is shared by a pool's connections
+	Waiting int
+}
+
+// Token bucket limiting how quickly payloads are written, implemented by
+// scheduling the earliest time the next payload may go out
+// When slow start is configured, the allowed rate begins at a fraction
+// of the target and ramps linearly up to it over the ramp duration,
+// measured from when the limiter was created
+// A pool's connections each have their own limiter, so each ramps up from
+// its own start (a replacement too), which also takes from the bucket
+// shared by the pool
+type rateLimiter struct {
+	clock             clock
+	rate              float64
+	burst             float64
+	slowStartFraction float64
+	slowStartRamp     time.Duration
+	start             time.Time
+	next              time.Time
+	lock              *sync.Mutex
+	//the pool's bucket, nil unless the limiter is a pool connection's
+	shared *rateLimiter
+	//for RateLimitState, guarded by lock
+	waits   uint64
+	waited  time.Duration
+	waiting int
+}
+
+func newRateLimiter(c clock, rate float64, burst int, slowStartFraction float64,
+	slowStartRamp time.Duration) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	now := c.Now()
+	limiter := &rateLimiter{
+		clock:             c,
+		rate:              rate,
+		burst:             float64(burst),
+		slowStartFraction: slowStartFraction,
+		slowStartRamp:     slowStartRamp,
+		start:             now,
+		lock:              new(sync.Mutex),
+	}
+	//start with a full bucket
+	limiter.next = now.Add(-limiter.burstWindowAt(now))
+	return limiter
+}
+
+// Whether slow start applies to this limiter at all
+func (r *rateLimiter) slowStart() bool {
+	return r.slowStartRamp > 0 && r.slowStartFraction > 0 && r.slowStartFraction < 1
+}
+
+// Fraction of the target rate allowed at the given time
+func (r *rateLimiter) rampAt(now time.Time) float64 {
+	if !r.slowStart() {
+		return 1
+	}
+	elapsed := now.Sub(r.start)
+	if elapsed >= r.slowStartRamp {
+		return 1
+	}
+	progress := float64(elapsed) / float64(r.slowStartRamp)
+	return r.slowStartFraction + (1-r.slowStartFraction)*progress
+}
+
+func (r *rateLimiter) rateAt(now time.Time) float64 {
+	return r.rate * r.rampAt(now)
+}
+
+// How far behind now the schedule may fall, which is what allows a burst
+// The burst is scaled down along with the rate while ramping, but is
+// always allowed at least one notification
+func (r *rateLimiter) burstWindowAt(now time.Time) time.Duration {
+	burst := r.burst * r.rampAt(now)
+	if burst <= 1 {
+		return 0
+	}
+	return time.Duration((burst - 1) / r.rateAt(now) * float64(time.Second))
+}
+
+// Take a token, from the shared bucket too if there is one, returning how
+// long the caller must wait before sending
+func (r *rateLimiter) reserve() time.Duration {
+	delay := r.take()
+	if r.shared != nil {
+		if shared := r.shared.take(); shared > delay {
+			delay = shared
+		}
+	}
+	if delay > 0 {
+		r.startWaiting(delay)
+		if r.shared != nil {
+			r.shared.startWaiting(delay)
+		}
+	}
+	return delay
+}
+
+// Take a token from this limiter's own bucket
+func (r *rateLimiter) take() time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.clock.Now()
+	if earliest := now.Add(-r.burstWindowAt(now)); r.next.Before(earliest) {
+		r.next = earliest
+	}
+
+	sendAt := r.next
+	if sendAt.Before(now) {
+		sendAt = now
+	}
+	r.next = r.next.Add(time.Duration(float64(time.Second) / r.rateAt(sendAt)))
+	return sendAt.Sub(now)
+}
+
+func (r *rateLimiter) startWaiting(delay time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.waits++
+	r.waited += delay
+	r.waiting++
+}
+
+// A wait reserve returned has finished, or been given up on
+func (r *rateLimiter) doneWaiting() {
+	r.lock.Lock()
+	r.waiting--
+	r.lock.Unlock()
+	if r.shared != nil {
+		r.shared.doneWaiting()
+	}
+}
+
+func (r *rateLimiter) state() RateLimitState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.clock.Now()
+	return RateLimitState{
+		Enabled:     true,
+		CurrentRate: r.rateAt(now),
+		TargetRate:  r.rate,
+		Ramping:     r.rampAt(now) < 1,
+		Waits:       r.waits,
+		Waited:      r.waited,
+		Waiting:     r.waiting,
+	}
+}
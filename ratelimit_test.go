@@ -0,0 +1,406 @@
+package apns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Clock that only moves when waited on, so pacing can be tested
+// without sleeping
+type fakeClock struct {
+	now  time.Time
+	lock *sync.Mutex
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:  time.Unix(1000000, 0),
+		lock: new(sync.Mutex),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+/**
+ * Mock connection recording when each write arrives
+ */
+type MockConnRecordWrites struct {
+	WrittenBytes *bytes.Buffer
+	CloseChannel chan bool
+	Clock        clock
+	WriteTimes   *[]time.Time
+	lock         *sync.Mutex
+}
+
+func NewMockConnRecordWrites(c clock) MockConnRecordWrites {
+	return MockConnRecordWrites{
+		WrittenBytes: new(bytes.Buffer),
+		CloseChannel: make(chan bool, 1),
+		Clock:        c,
+		WriteTimes:   &[]time.Time{},
+		lock:         new(sync.Mutex),
+	}
+}
+
+func (conn MockConnRecordWrites) Read(b []byte) (n int, err error) {
+	<-conn.CloseChannel
+	return -1, errors.New("Socket Closed")
+}
+func (conn MockConnRecordWrites) Write(b []byte) (n int, err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.WrittenBytes.Write(b)
+	*conn.WriteTimes = append(*conn.WriteTimes, conn.Clock.Now())
+	return len(b), nil
+}
+func (conn MockConnRecordWrites) Close() error {
+	conn.CloseChannel <- true
+	return nil
+}
+func (conn MockConnRecordWrites) LocalAddr() net.Addr {
+	return nil
+}
+func (conn MockConnRecordWrites) RemoteAddr() net.Addr {
+	return nil
+}
+func (conn MockConnRecordWrites) SetDeadline(t time.Time) error {
+	return nil
+}
+func (conn MockConnRecordWrites) SetReadDeadline(t time.Time) error {
+	return nil
+}
+func (conn MockConnRecordWrites) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn MockConnRecordWrites) Gaps() []time.Duration {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	gaps := []time.Duration{}
+	times := *conn.WriteTimes
+	for i := 1; i < len(times); i++ {
+		gaps = append(gaps, times[i].Sub(times[i-1]))
+	}
+	return gaps
+}
+
+func sendRateLimited(t *testing.T, config *APNSConfig, count int) (*APNSConnection, MockConnRecordWrites) {
+	socket := NewMockConnRecordWrites(config.clock)
+	apn := socketAPNSConnection(socket, config)
+
+	for i := 0; i < count; i++ {
+		apn.SendChannel <- groupTestPayload(i % 256)
+	}
+	return apn, socket
+}
+
+// Close once everything sent has been written, which Disconnect doesn't
+// wait for
+func closeRateLimited(apn *APNSConnection) {
+	apn.Shutdown(context.Background())
+	<-apn.CloseChannel
+}
+
+func TestRateLimitShouldPaceWrites(t *testing.T) {
+	apn, socket := sendRateLimited(t, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		MaxNotificationsPerSecond: 100,
+		clock:                     newFakeClock(),
+	}, 20)
+	closeRateLimited(apn)
+
+	gaps := socket.Gaps()
+	if len(gaps) != 19 {
+		t.Fatalf("Expected 19 gaps between writes but got %v", len(gaps))
+	}
+	for i, gap := range gaps {
+		if gap != 10*time.Millisecond {
+			t.Errorf("Expected gap %v to be 10ms but was %v", i, gap)
+		}
+	}
+}
+
+func TestRateLimitShouldReportWaitsToTheStatsCollector(t *testing.T) {
+	stats := NewMemoryStatsCollector()
+	apn, _ := sendRateLimited(t, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		MaxNotificationsPerSecond: 100,
+		RateLimitBurst:            5,
+		StatsCollector:            stats,
+		clock:                     newFakeClock(),
+	}, 20)
+	closeRateLimited(apn)
+
+	snapshot := stats.Snapshot()
+	state := apn.RateLimitState()
+	if snapshot.RateLimitWaits != 15 || snapshot.RateLimitWaits != state.Waits || snapshot.RateLimitWaited != state.Waited ||
+		snapshot.RateLimitWaited < 15*10*time.Millisecond {
+		t.Error(fmt.Sprintf("Expected the 15 payloads past the burst to report their waits but got %+v and %+v",
+			snapshot, state))
+	}
+}
+
+func TestRateLimitShouldAllowBurst(t *testing.T) {
+	apn, socket := sendRateLimited(t, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		MaxNotificationsPerSecond: 100,
+		RateLimitBurst:            5,
+		clock:                     newFakeClock(),
+	}, 10)
+	closeRateLimited(apn)
+
+	gaps := socket.Gaps()
+	for i := 0; i < 4; i++ {
+		if gaps[i] != 0 {
+			t.Errorf("Expected burst gap %v to be 0 but was %v", i, gaps[i])
+		}
+	}
+	for i := 4; i < len(gaps); i++ {
+		if gaps[i] != 10*time.Millisecond {
+			t.Errorf("Expected gap %v to be 10ms but was %v", i, gaps[i])
+		}
+	}
+}
+
+func TestRateLimitSlowStartShouldRampUp(t *testing.T) {
+	apn, socket := sendRateLimited(t, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		MaxNotificationsPerSecond: 100,
+		SlowStartFraction:         0.1,
+		SlowStartRampTime:         1000,
+		clock:                     newFakeClock(),
+	}, 1)
+
+	state := apn.RateLimitState()
+	if !state.Enabled || !state.Ramping || state.TargetRate != 100 {
+		t.Errorf("Expected new connection to be ramping toward 100/s but got %+v", state)
+	}
+
+	for i := 1; i < 150; i++ {
+		apn.SendChannel <- groupTestPayload(i % 256)
+	}
+
+	state = apn.RateLimitState()
+	if state.Ramping || state.CurrentRate != 100 {
+		t.Errorf("Expected connection to have ramped up to 100/s but got %+v", state)
+	}
+	closeRateLimited(apn)
+
+	gaps := socket.Gaps()
+	//starts at 10% of the rate so the first wait is ~100ms
+	if math.Abs(float64(gaps[0]-100*time.Millisecond)) > float64(5*time.Millisecond) {
+		t.Errorf("Expected first gap to be close to 100ms but was %v", gaps[0])
+	}
+	for i := 1; i < len(gaps); i++ {
+		if gaps[i] > gaps[i-1]+time.Millisecond {
+			t.Errorf("Expected gaps to shrink while ramping but gap %v was %v after %v", i, gaps[i], gaps[i-1])
+		}
+	}
+	last := gaps[len(gaps)-1]
+	if math.Abs(float64(last-10*time.Millisecond)) > float64(time.Millisecond) {
+		t.Errorf("Expected final gap to be close to 10ms but was %v", last)
+	}
+
+	//the linear ramp from 10/s to 100/s allows ~55 notifications in the first second
+	times := *socket.WriteTimes
+	inFirstSecond := 0
+	for _, written := range times {
+		if written.Sub(times[0]) < time.Second {
+			inFirstSecond++
+		}
+	}
+	if inFirstSecond < 45 || inFirstSecond > 65 {
+		t.Errorf("Expected around 55 notifications in the first second but got %v", inFirstSecond)
+	}
+}
+
+func TestRateLimitDisabledByDefault(t *testing.T) {
+	apn, socket := sendRateLimited(t, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            -1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		clock:                     newFakeClock(),
+	}, 10)
+
+	if apn.RateLimitState().Enabled {
+		t.Error("Expected rate limiting to be disabled by default")
+	}
+	closeRateLimited(apn)
+
+	for i, gap := range socket.Gaps() {
+		if gap != 0 {
+			t.Errorf("Expected no wait between writes but gap %v was %v", i, gap)
+		}
+	}
+}
+
+func TestRateLimitShouldBeSharedByAPool(t *testing.T) {
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	pool, err := NewAPNSConnectionPool(&APNSPoolConfig{
+		ConnectionConfig: &APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			MaxNotificationsPerSecond: 100,
+		},
+		Size: 4,
+		dial: dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//30 at 100 a second takes 290ms for the pool, not 70ms for each of 4
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		pool.SendChannel <- groupTestPayload(i)
+	}
+	for sent := 0; sent < 30; {
+		sent = 0
+		for i := 0; i < 4; i++ {
+			sent += dialer.socket(i).sent()
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal(fmt.Sprintf("Only %v of 30 payloads were sent", sent))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Error(fmt.Sprintf("Expected the pool to send at 100 a second but it took %v", elapsed))
+	}
+	state := pool.RateLimitState()
+	if !state.Enabled || state.Waits < 25 || state.Waited < 200*time.Millisecond || state.Waiting != 0 {
+		t.Error(fmt.Sprintf("Expected the waits to be counted but got %+v", state))
+	}
+
+	pool.Close()
+	finalPoolClose(t, pool)
+}
+
+func TestRateLimitShouldRampUpAReplacementPoolConnection(t *testing.T) {
+	clock := newFakeClock()
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	connsLock := new(sync.Mutex)
+	conns := []*APNSConnection{}
+	pool, err := NewAPNSConnectionPool(&APNSPoolConfig{
+		ConnectionConfig: &APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            -1,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			MaxNotificationsPerSecond: 100,
+			SlowStartFraction:         0.1,
+			SlowStartRampTime:         1000,
+			clock:                     clock,
+		},
+		Size:              1,
+		ReconnectInterval: 5,
+		dial: func(config *APNSConfig) (*APNSConnection, error) {
+			conn, err := dialer.dial(config)
+			connsLock.Lock()
+			conns = append(conns, conn)
+			connsLock.Unlock()
+			return conn, err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the pool ramps up, then its connection drops
+	clock.After(2 * time.Second)
+	if state := pool.RateLimitState(); state.Ramping {
+		t.Errorf("Expected the pool to have ramped up but got %+v", state)
+	}
+	dialer.socket(0).Close()
+	<-pool.CloseChannel
+	deadline := time.Now().Add(2 * time.Second)
+	for dialer.socket(1) == nil || pool.Healthy() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the dropped connection to be replaced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	//the replacement starts again at 10% of the rate
+	connsLock.Lock()
+	replacement := conns[1]
+	connsLock.Unlock()
+	if state := replacement.RateLimitState(); !state.Ramping || state.CurrentRate != 10 {
+		t.Errorf("Expected the replacement to be ramping from 10/s but got %+v", state)
+	}
+	start := clock.Now()
+	pool.SendChannel <- groupTestPayload(0)
+	pool.SendChannel <- groupTestPayload(1)
+	waitForSocketSends(t, dialer.socket(1), 2)
+	if waited := clock.Now().Sub(start); waited < 90*time.Millisecond {
+		t.Errorf("Expected the replacement's second write to wait ~100ms but it waited %v", waited)
+	}
+
+	pool.Close()
+	finalPoolClose(t, pool)
+}
+
+func TestRateLimitShouldReleaseAWaitWhenAbandoned(t *testing.T) {
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	//the second payload waits 10 seconds
+	config.MaxNotificationsPerSecond = 0.1
+	conn := socketAPNSConnection(socket, config)
+	ctx, cancel := context.WithCancel(context.Background())
+	go conn.contextListener(ctx)
+
+	conn.SendChannel <- groupTestPayload(0)
+	conn.SendChannel <- groupTestPayload(1)
+	waitForSocketSends(t, socket, 1)
+	for conn.RateLimitState().Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case connectionClose := <-conn.CloseChannel:
+		if connectionClose.UnsentPayloads.Len() != 1 || connectionClose.UnsentPayloads.Front().Value.(*Payload).Token != groupTestPayload(1).Token {
+			t.Error(fmt.Sprintf("Expected the waiting payload to be handed back but got %v", connectionClose))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected cancelling to release the wait")
+	}
+	if state := conn.RateLimitState(); state.Waiting != 0 || state.Waits != 1 {
+		t.Error(fmt.Sprintf("Expected the wait to be over but got %+v", state))
+	}
+}
@@ -0,0 +1,55 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func TestRC2PiTableShouldBeAPermutation(t *testing.T) {
+	seen := make(map[byte]bool)
+	for _, b := range rc2PiTable {
+		seen[b] = true
+	}
+	if len(seen) != 256 {
+		t.Error(fmt.Sprintf("Expected 256 distinct bytes but got %v", len(seen)))
+	}
+}
+
+// Test vectors from RFC 2268
+func TestRC2ShouldMatchRFCVectors(t *testing.T) {
+	vectors := []struct {
+		key           string
+		effectiveBits int
+		plaintext     string
+		ciphertext    string
+	}{
+		{"0000000000000000", 63, "0000000000000000", "ebb773f993278eff"},
+		{"ffffffffffffffff", 64, "ffffffffffffffff", "278b27e42e2f0d49"},
+		{"3000000000000000", 64, "1000000000000001", "30649edf9be7d2c2"},
+		{"88", 64, "0000000000000000", "61a8a244adacccf0"},
+		{"88bca90e90875a", 64, "0000000000000000", "6ccf4308974c267f"},
+		{"88bca90e90875a7f0f79c384627bafb2", 64, "0000000000000000", "1a807d272bbe5db1"},
+		{"88bca90e90875a7f0f79c384627bafb2", 128, "0000000000000000", "2269552ab0f85ca6"},
+	}
+	for _, v := range vectors {
+		key, _ := hex.DecodeString(v.key)
+		plaintext, _ := hex.DecodeString(v.plaintext)
+		ciphertext, _ := hex.DecodeString(v.ciphertext)
+		block, err := newRC2Cipher(key, v.effectiveBits)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := make([]byte, 8)
+		block.Encrypt(out, plaintext)
+		if !bytes.Equal(out, ciphertext) {
+			t.Error(fmt.Sprintf("Expected key %v (%v bits) to encrypt to %v but got %x", v.key, v.effectiveBits, v.ciphertext, out))
+		}
+		block.Decrypt(out, ciphertext)
+		if !bytes.Equal(out, plaintext) {
+			t.Error(fmt.Sprintf("Expected key %v (%v bits) to decrypt to %v but got %x", v.key, v.effectiveBits, v.plaintext, out))
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package apns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Apple's reason for rejecting a notification: the reason field of an
+// HTTP/2 response, or the name of a binary protocol status
+// (APPLE_PUSH_RESPONSES). Reasons apple adds later are kept as they are,
+// so they survive unchanged even though they aren't one of the constants
+type ErrorReason string
+
+// Reasons for a binary protocol rejection, see ErrorReasonFromStatus
+const (
+	BinaryReasonNoErrors           ErrorReason = "NO_ERRORS"
+	BinaryReasonProcessingError    ErrorReason = "PROCESSING_ERROR"
+	BinaryReasonMissingDeviceToken ErrorReason = "MISSING_DEVICE_TOKEN"
+	BinaryReasonMissingTopic       ErrorReason = "MISSING_TOPIC"
+	BinaryReasonMissingPayload     ErrorReason = "MISSING_PAYLOAD"
+	BinaryReasonInvalidTokenSize   ErrorReason = "INVALID_TOKEN_SIZE"
+	BinaryReasonInvalidTopicSize   ErrorReason = "INVALID_TOPIC_SIZE"
+	BinaryReasonInvalidPayloadSize ErrorReason = "INVALID_PAYLOAD_SIZE"
+	BinaryReasonInvalidToken       ErrorReason = "INVALID_TOKEN"
+	BinaryReasonShutdown           ErrorReason = "SHUTDOWN"
+	BinaryReasonInvalidFrameItemId ErrorReason = "INVALID_FRAME_ITEM_ID"
+	BinaryReasonUnknown            ErrorReason = "UNKNOWN"
+)
+
+// Reasons for an HTTP/2 rejection, see Apple's "Handling notification
+// responses from APNs"
+const (
+	// 400 Bad Request
+	ReasonBadCollapseId          ErrorReason = "BadCollapseId"
+	ReasonBadDeviceToken         ErrorReason = "BadDeviceToken"
+	ReasonBadExpirationDate      ErrorReason = "BadExpirationDate"
+	ReasonBadMessageId           ErrorReason = "BadMessageId"
+	ReasonBadPriority            ErrorReason = "BadPriority"
+	ReasonBadTopic               ErrorReason = "BadTopic"
+	ReasonDeviceTokenNotForTopic ErrorReason = "DeviceTokenNotForTopic"
+	ReasonDuplicateHeaders       ErrorReason = "DuplicateHeaders"
+	ReasonIdleTimeout            ErrorReason = "IdleTimeout"
+	ReasonInvalidPushType        ErrorReason = "InvalidPushType"
+	ReasonMissingDeviceToken     ErrorReason = "MissingDeviceToken"
+	ReasonMissingTopic           ErrorReason = "MissingTopic"
+	ReasonPayloadEmpty           ErrorReason = "PayloadEmpty"
+	ReasonTopicDisallowed        ErrorReason = "TopicDisallowed"
+	// 403 Forbidden
+	ReasonBadCertificate            ErrorReason = "BadCertificate"
+	ReasonBadCertificateEnvironment ErrorReason = "BadCertificateEnvironment"
+	ReasonExpiredProviderToken      ErrorReason = reasonExpiredProviderToken
+	ReasonForbidden                 ErrorReason = "Forbidden"
+	ReasonInvalidProviderToken      ErrorReason = reasonInvalidProviderToken
+	ReasonMissingProviderToken      ErrorReason = "MissingProviderToken"
+	ReasonUnrelatedKeyIdInToken     ErrorReason = "UnrelatedKeyIdInToken"
+	// 404 Not Found
+	ReasonBadPath ErrorReason = "BadPath"
+	// 405 Method Not Allowed
+	ReasonMethodNotAllowed ErrorReason = "MethodNotAllowed"
+	// 410 Gone
+	ReasonExpiredToken ErrorReason = "ExpiredToken"
+	ReasonUnregistered ErrorReason = "Unregistered"
+	// 413 Payload Too Large
+	ReasonPayloadTooLarge ErrorReason = "PayloadTooLarge"
+	// 429 Too Many Requests
+	ReasonTooManyProviderTokenUpdates ErrorReason = "TooManyProviderTokenUpdates"
+	ReasonTooManyRequests             ErrorReason = "TooManyRequests"
+	// 500 Internal Server Error
+	ReasonInternalServerError ErrorReason = "InternalServerError"
+	// 503 Service Unavailable
+	ReasonServiceUnavailable ErrorReason = "ServiceUnavailable"
+	ReasonShutdown           ErrorReason = "Shutdown"
+)
+
+// Prefix of the reason for a binary status missing from APPLE_PUSH_RESPONSES
+const binaryStatusReasonPrefix = "STATUS_"
+
+var knownErrorReasons = buildKnownErrorReasons()
+
+func buildKnownErrorReasons() map[ErrorReason]bool {
+	knownErrorReasons := map[ErrorReason]bool{}
+	for _, name := range APPLE_PUSH_RESPONSES {
+		knownErrorReasons[ErrorReason(name)] = true
+	}
+	for _, reason := range []ErrorReason{
+		ReasonBadCollapseId, ReasonBadDeviceToken, ReasonBadExpirationDate, ReasonBadMessageId,
+		ReasonBadPriority, ReasonBadTopic, ReasonDeviceTokenNotForTopic, ReasonDuplicateHeaders,
+		ReasonIdleTimeout, ReasonInvalidPushType, ReasonMissingDeviceToken, ReasonMissingTopic,
+		ReasonPayloadEmpty, ReasonTopicDisallowed, ReasonBadCertificate, ReasonBadCertificateEnvironment,
+		ReasonExpiredProviderToken, ReasonForbidden, ReasonInvalidProviderToken, ReasonMissingProviderToken,
+		ReasonUnrelatedKeyIdInToken, ReasonBadPath, ReasonMethodNotAllowed, ReasonExpiredToken,
+		ReasonUnregistered, ReasonPayloadTooLarge, ReasonTooManyProviderTokenUpdates, ReasonTooManyRequests,
+		ReasonInternalServerError, ReasonServiceUnavailable, ReasonShutdown,
+	} {
+		knownErrorReasons[reason] = true
+	}
+	return knownErrorReasons
+}
+
+// The reason for a binary protocol status byte, its name in
+// APPLE_PUSH_RESPONSES or STATUS_<n> for one that isn't listed, which
+// BinaryStatus turns back into the byte
+func ErrorReasonFromStatus(status uint8) ErrorReason {
+	if name, ok := APPLE_PUSH_RESPONSES[status]; ok {
+		return ErrorReason(name)
+	}
+	return ErrorReason(binaryStatusReasonPrefix + strconv.Itoa(int(status)))
+}
+
+// The reason field of an HTTP/2 error response body, e.g.
+// {"reason":"BadDeviceToken"}
+// Returns an error if the body isn't json or has no reason
+func ParseErrorReason(body []byte) (ErrorReason, error) {
+	parsed := struct {
+		Reason ErrorReason `json:"reason"`
+	}{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "", err
+	}
+	if parsed.Reason == "" {
+		return "", errors.New(fmt.Sprintf("No reason in response %q", body))
+	}
+	return parsed.Reason, nil
+}
+
+func (r ErrorReason) String() string {
+	return string(r)
+}
+
+// The binary protocol status byte for the reason, false for an HTTP/2
+// reason
+func (r ErrorReason) BinaryStatus() (uint8, bool) {
+	for status, name := range APPLE_PUSH_RESPONSES {
+		if string(r) == name {
+			return status, true
+		}
+	}
+	if digits := strings.TrimPrefix(string(r), binaryStatusReasonPrefix); digits != string(r) {
+		if status, err := strconv.ParseUint(digits, 10, 8); err == nil {
+			return uint8(status), true
+		}
+	}
+	return 0, false
+}
+
+// Whether the reason is one of the constants, false for one apple added
+// since (or STATUS_<n>)
+func (r ErrorReason) IsKnown() bool {
+	return knownErrorReasons[r]
+}
+
+// Whether the device token will never be accepted again for this topic,
+// so it should be deleted
+func (r ErrorReason) IsTokenInvalid() bool {
+	switch r {
+	case ReasonBadDeviceToken, ReasonUnregistered, ReasonExpiredToken,
+		BinaryReasonInvalidToken, BinaryReasonInvalidTokenSize:
+		return true
+	}
+	return false
+}
+
+// Whether the same notification may be accepted if resent later, as the
+// rejection was down to apple, the rate it was sent at or an expired
+// provider token rather than the notification itself
+// Reasons that aren't known are treated as not retryable
+func (r ErrorReason) IsRetryable() bool {
+	switch r {
+	case ReasonIdleTimeout, ReasonExpiredProviderToken, ReasonTooManyProviderTokenUpdates,
+		ReasonTooManyRequests, ReasonInternalServerError, ReasonServiceUnavailable, ReasonShutdown,
+		BinaryReasonProcessingError, BinaryReasonShutdown, BinaryReasonUnknown:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package apns
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestErrorReasonShouldRoundTripBinaryStatuses(t *testing.T) {
+	for status := 0; status < 256; status++ {
+		reason := ErrorReasonFromStatus(uint8(status))
+		if back, ok := reason.BinaryStatus(); !ok || back != uint8(status) {
+			t.Error(fmt.Sprintf("Expected %v to round trip but got %v (%v)", status, back, reason))
+		}
+	}
+	if reason := ErrorReasonFromStatus(8); reason != BinaryReasonInvalidToken || !reason.IsKnown() {
+		t.Error(fmt.Sprintf("Expected INVALID_TOKEN but got %v", reason))
+	}
+	if reason := ErrorReasonFromStatus(42); reason.String() != "STATUS_42" || reason.IsKnown() {
+		t.Error(fmt.Sprintf("Expected an unknown status to keep its value but got %v", reason))
+	}
+	if _, ok := ReasonBadDeviceToken.BinaryStatus(); ok {
+		t.Error("Expected an HTTP/2 reason to have no binary status")
+	}
+}
+
+func TestErrorReasonShouldParseResponses(t *testing.T) {
+	reason, err := ParseErrorReason([]byte(`{"reason":"Unregistered","timestamp":1700000000000}`))
+	if err != nil || reason != ReasonUnregistered || !reason.IsKnown() {
+		t.Error(fmt.Sprintf("Expected Unregistered but got %v, %v", reason, err))
+	}
+
+	//a reason apple adds later survives unchanged
+	reason, err = ParseErrorReason([]byte(`{"reason":"SomethingNew"}`))
+	if err != nil || reason.String() != "SomethingNew" || reason.IsKnown() || reason.IsRetryable() || reason.IsTokenInvalid() {
+		t.Error(fmt.Sprintf("Expected the unknown reason to be kept but got %v, %v", reason, err))
+	}
+	encoded, _ := json.Marshal(struct {
+		Reason ErrorReason `json:"reason"`
+	}{reason})
+	if string(encoded) != `{"reason":"SomethingNew"}` {
+		t.Error(fmt.Sprintf("Expected the reason to encode as it was but got %s", encoded))
+	}
+
+	for _, body := range []string{`not json`, `{}`} {
+		if _, err := ParseErrorReason([]byte(body)); err == nil {
+			t.Error(fmt.Sprintf("Expected an error for %v", body))
+		}
+	}
+}
+
+func TestErrorReasonPredicates(t *testing.T) {
+	tokenInvalid := []ErrorReason{ReasonBadDeviceToken, ReasonUnregistered, ReasonExpiredToken,
+		BinaryReasonInvalidToken, BinaryReasonInvalidTokenSize}
+	retryable := []ErrorReason{ReasonTooManyRequests, ReasonInternalServerError, ReasonServiceUnavailable,
+		ReasonShutdown, ReasonIdleTimeout, ReasonExpiredProviderToken, ReasonTooManyProviderTokenUpdates,
+		BinaryReasonProcessingError, BinaryReasonShutdown, BinaryReasonUnknown}
+	neither := []ErrorReason{ReasonPayloadTooLarge, ReasonBadTopic, ReasonDeviceTokenNotForTopic,
+		ReasonTopicDisallowed, BinaryReasonInvalidPayloadSize, BinaryReasonMissingTopic}
+
+	for _, reason := range tokenInvalid {
+		if !reason.IsTokenInvalid() || reason.IsRetryable() {
+			t.Error(fmt.Sprintf("Expected %v to invalidate the token and not be retryable", reason))
+		}
+	}
+	for _, reason := range retryable {
+		if reason.IsTokenInvalid() || !reason.IsRetryable() {
+			t.Error(fmt.Sprintf("Expected %v to be retryable", reason))
+		}
+	}
+	for _, reason := range neither {
+		if reason.IsTokenInvalid() || reason.IsRetryable() || !reason.IsKnown() {
+			t.Error(fmt.Sprintf("Expected %v to be neither retryable nor invalidate the token", reason))
+		}
+	}
+}
@@ -0,0 +1,760 @@
+package apns
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Config for creating an APNS connection that reconnects by itself
+type APNSReconnectConfig struct {
+	// config every connection is made with : required
+	ConnectionConfig *APNSConfig
+	// number of milliseconds to wait before the first reconnect attempt,
+	// doubling after each failed attempt, defaults to 100
+	ReconnectBaseDelay int
+	// max number of milliseconds to wait between attempts, defaults to 30000
+	ReconnectMaxDelay int
+	// number of failed attempts in a row before giving up, defaults to 0 (never give up)
+	MaxReconnectAttempts int
+	// number of events buffered on EventChannel, and on StateEvents,
+	// defaults to 100
+	EventBufferSize int
+	// number of times a payload is resent before it's given up on and
+	// passed on to CloseChannel, so one that keeps the connection dropping
+	// can't do so forever, defaults to 5, -1 for no limit
+	// The DeadLetterHandler gets an *AttemptsExceededError with each time
+	// it was handed back
+	MaxReplayAttempts int
+	// number of milliseconds before a connection drops without an error
+	// from apple within which written payloads are resent, as apple may
+	// not have read them, those written earlier are taken as delivered
+	// (payloads never written are always resent), defaults to 10000, -1 to
+	// resend everything in flight
+	// A drop for unacknowledged data (see APNSConfig.LivenessTimeout)
+	// widens the window by the timeout
+	ReplayWindow int
+	// optional circuit breaker (see CircuitBreakerConfig), while open no
+	// connection attempts are made and payloads are failed fast, passed on
+	// to CloseChannel with ConnectionClose.CircuitOpen set
+	CircuitBreaker *CircuitBreakerConfig
+	// number of milliseconds without a payload after which the connection
+	// is shut down cleanly, to be reopened by the next payload, defaults to
+	// 0 (stay connected)
+	// Closing for being idle isn't a disconnect, there's no backoff and no
+	// ReconnectEvent, see StateIdle
+	IdleTimeout int
+	// number of payloads a connection sends before it's replaced with a
+	// new one, defaults to 0 (no limit)
+	// The new connection is opened before the old one shuts down, and
+	// StateRecycling is reported meanwhile
+	MaxNotificationsPerConnection int
+	// number of milliseconds a connection is kept open before it's
+	// replaced as for MaxNotificationsPerConnection, defaults to 0 (no
+	// limit)
+	MaxConnectionAge int
+	// opens a connection, overridden in tests
+	dial func(config *APNSConfig) (*APNSConnection, error)
+}
+
+// What happened to an APNSReconnectingConnection
+type ReconnectEventType int
+
+const (
+	// The connection closed, Close says why
+	ReconnectDisconnected ReconnectEventType = iota
+	// Waiting Delay before reconnect attempt Attempt
+	ReconnectAttempt
+	// Reconnect attempt Attempt failed with Err
+	ReconnectFailed
+	// Reconnected after Attempt attempts
+	ReconnectConnected
+	// MaxReconnectAttempts failed in a row, or the certificate expired, the
+	// connection is closing
+	ReconnectGaveUp
+)
+
+var reconnectEventTypeNames = map[ReconnectEventType]string{
+	ReconnectDisconnected: "DISCONNECTED",
+	ReconnectAttempt:      "ATTEMPT",
+	ReconnectFailed:       "FAILED",
+	ReconnectConnected:    "CONNECTED",
+	ReconnectGaveUp:       "GAVE_UP",
+}
+
+func (t ReconnectEventType) String() string {
+	if name, ok := reconnectEventTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ReconnectEventType(%d)", int(t))
+}
+
+// Reported on APNSReconnectingConnection.EventChannel
+type ReconnectEvent struct {
+	Type ReconnectEventType
+	// Number of the reconnect attempt, counting from 1 after each disconnect
+	Attempt int
+	// How long until the attempt, for ReconnectAttempt
+	Delay time.Duration
+	// Why the attempt failed, for ReconnectFailed
+	Err error
+	// How the connection closed, for ReconnectDisconnected
+	Close *ConnectionClose
+}
+
+// An APNS connection that reconnects whenever apple drops it
+// Payloads the dropped connection reports as unsent are sent again on the
+// next connection ahead of anything new, so SendChannel stays usable
+// throughout. As the binary protocol only reports failures, when a
+// connection drops without an error from apple the payloads it wrote
+// within ReplayWindow of the drop are resent, along with any it never
+// wrote, so a payload may be delivered twice but isn't lost, while those
+// that went out long before, e.g. ahead of an idle drop, aren't repeated
+// Payloads apple rejects are passed on to CloseChannel as a
+// ConnectionClose with the ErrorPayload (and no unsent payloads, they're
+// resent). A payload handed back more than MaxReplayAttempts times is
+// passed on as a ConnectionClose with it in UnsentPayloads (and no
+// ErrorPayload) rather than resent again. Close, or giving up after
+// MaxReconnectAttempts, sends a final ConnectionClose holding whatever
+// wasn't sent and closes CloseChannel
+// With a CircuitBreaker, once connections keep failing payloads are
+// passed on straight away with ConnectionClose.CircuitOpen set, rather
+// than held until a connection can be made
+type APNSReconnectingConnection struct {
+	// Channel to send payloads on
+	SendChannel chan *Payload
+	// Channel that rejections and the final close are received on, should
+	// be read until closed
+	CloseChannel chan *ConnectionClose
+	// Channel that reconnect events are received on, events are dropped
+	// if it is full
+	EventChannel chan *ReconnectEvent
+
+	config    *APNSReconnectConfig
+	closing   chan bool
+	closeOnce *sync.Once
+	// tracks rejections still being passed on to CloseChannel
+	forwards *sync.WaitGroup
+	// nil without a CircuitBreaker
+	breaker *circuitBreaker
+	// current state, and StateEvents
+	states *stateTracker
+	// Pause and Resume
+	pauses *pauseSwitch
+
+	// payloads to send again, oldest first, ahead of SendChannel
+	retry []*Payload
+	// each time a payload in retry, or resent on the current connection,
+	// has been handed back, locked as the connections read it for the
+	// DeadLetterHandler
+	replays     map[*Payload][]SendAttempt
+	replaysLock *sync.Mutex
+	// payloads resent on the current connection
+	replayed []*Payload
+	// whether payloads handed back are being resent, and how many have
+	// been, for the Logger
+	replaying    bool
+	replayResent int
+	logger       Logger
+	// set when the connection closes with an error
+	lastError              *AppleError
+	unsentBufferOverflowed bool
+}
+
+// Create a new reconnecting connection, making the first connection
+// before returning
+// If invalid config, or the first connection can't be made, an error will
+// be returned
+// See APNSReconnectConfig object for defaults
+func NewAPNSReconnectingConnection(config *APNSReconnectConfig) (*APNSReconnectingConnection, error) {
+	errorStrs := ""
+
+	if config.ConnectionConfig == nil {
+		errorStrs += "Invalid ConnectionConfig, should be set\n"
+	}
+	if config.ReconnectBaseDelay < 0 || config.ReconnectMaxDelay < 0 {
+		errorStrs += "Invalid ReconnectBaseDelay or ReconnectMaxDelay. Should be >= 0.\n"
+	}
+	if config.MaxReconnectAttempts < 0 {
+		errorStrs += "Invalid MaxReconnectAttempts. Should be >= 0.\n"
+	}
+	if config.EventBufferSize < 0 {
+		errorStrs += "Invalid EventBufferSize. Should be >= 0.\n"
+	}
+	if config.MaxReplayAttempts < -1 {
+		errorStrs += "Invalid MaxReplayAttempts. Should be >= -1.\n"
+	}
+	if config.ReplayWindow < -1 {
+		errorStrs += "Invalid ReplayWindow. Should be >= -1.\n"
+	}
+	if config.IdleTimeout < 0 {
+		errorStrs += "Invalid IdleTimeout. Should be >= 0.\n"
+	}
+	if config.MaxNotificationsPerConnection < 0 || config.MaxConnectionAge < 0 {
+		errorStrs += "Invalid MaxNotificationsPerConnection or MaxConnectionAge. Should be >= 0.\n"
+	}
+	errorStrs += validateCircuitBreakerConfig(config.CircuitBreaker)
+
+	if errorStrs != "" {
+		return nil, errors.New(errorStrs)
+	}
+
+	if config.ReconnectBaseDelay == 0 {
+		config.ReconnectBaseDelay = 100
+	}
+	if config.ReconnectMaxDelay == 0 {
+		config.ReconnectMaxDelay = 30000
+	}
+	if config.EventBufferSize == 0 {
+		config.EventBufferSize = 100
+	}
+	if config.MaxReplayAttempts == 0 {
+		config.MaxReplayAttempts = 5
+	}
+	if config.ReplayWindow == 0 {
+		config.ReplayWindow = 10000
+	}
+	if config.dial == nil {
+		config.dial = NewAPNSConnection
+	}
+
+	conn, err := config.dial(config.ConnectionConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &APNSReconnectingConnection{
+		SendChannel:  make(chan *Payload),
+		CloseChannel: make(chan *ConnectionClose),
+		EventChannel: make(chan *ReconnectEvent, config.EventBufferSize),
+		config:       config,
+		closing:      make(chan bool),
+		closeOnce:    new(sync.Once),
+		forwards:     new(sync.WaitGroup),
+		replays:      make(map[*Payload][]SendAttempt),
+		replaysLock:  new(sync.Mutex),
+		breaker:      newCircuitBreaker(config.CircuitBreaker),
+		states:       newStateTracker(config.EventBufferSize),
+		pauses:       newPauseSwitch(),
+		logger:       configLogger(config.ConnectionConfig.Logger),
+	}
+	conn.replays = r.replayCount
+	r.connected(conn, 0)
+	go r.sendListener(conn)
+	return r, nil
+}
+
+// Stop accepting payloads and disconnect, sending anything waiting to be
+// resent first if connected
+// Returns straight away, the connection is closed once the final
+// ConnectionClose has been received from CloseChannel
+// Closing SendChannel does the same
+func (r *APNSReconnectingConnection) Close() {
+	r.closeOnce.Do(func() {
+		close(r.closing)
+	})
+}
+
+// Current state of the link to apple
+// Safe to call from any goroutine
+func (r *APNSReconnectingConnection) State() ConnectionState {
+	return r.states.current()
+}
+
+// Channel state changes are received on, closed after StateClosed
+// Up to EventBufferSize events are held, dropping the oldest when full,
+// so a slow reader never holds up sending. Use State for the latest
+func (r *APNSReconnectingConnection) StateEvents() <-chan *ConnectionStateEvent {
+	return r.states.events
+}
+
+func (r *APNSReconnectingConnection) connected(conn *APNSConnection, reopen time.Duration) {
+	timing := conn.ConnectTiming()
+	r.states.set(&ConnectionStateEvent{State: StateConnected, Addr: timing.Addr, ResumedTLS: timing.Resumed,
+		Reopen: reopen})
+}
+
+// The delay before reconnect attempt (counting from 1): base doubled for
+// each attempt up to max, then jittered to between half and all of that
+// so connections dropped together don't all reconnect at once
+func reconnectDelay(attempt int, base time.Duration, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// go-routine feeding SendChannel, and the payloads to resend, to the
+// current connection
+func (r *APNSReconnectingConnection) sendListener(conn *APNSConnection) {
+	//the payload that reopened an idle connection, sent ahead of anything else
+	var reopenedFor *Payload
+	recycling := newRecycleTracker(r.config.MaxNotificationsPerConnection, r.config.MaxConnectionAge, 1)
+	for {
+		if conn == nil {
+			if conn = r.reconnect(); conn == nil {
+				r.finish()
+				return
+			}
+		}
+		recycling.track(conn)
+
+		paused, pauseChanged := r.pauses.state()
+		if paused {
+			if reopenedFor != nil {
+				r.retry = append([]*Payload{reopenedFor}, r.retry...)
+				reopenedFor = nil
+			}
+			var open bool
+			if conn, open = r.waitPaused(conn, pauseChanged); !open {
+				r.finish()
+				return
+			}
+			continue
+		}
+
+		var next *Payload
+		if reopenedFor != nil {
+			next = reopenedFor
+		} else if len(r.retry) > 0 {
+			next = r.retry[0]
+		} else {
+			if recycling.due() {
+				conn = r.recycle(conn, recycling)
+				continue
+			}
+			var idle <-chan time.Time
+			if r.config.IdleTimeout > 0 {
+				idle = time.After(time.Duration(r.config.IdleTimeout) * time.Millisecond)
+			}
+			select {
+			case <-pauseChanged:
+				continue
+			case <-recycling.aged():
+				continue
+			case next = <-r.SendChannel:
+				if next == nil {
+					//channel was closed
+					r.Close()
+					r.drain(conn)
+					r.finish()
+					return
+				}
+			case connectionClose := <-conn.CloseChannel:
+				r.handleClose(connectionClose)
+				conn = nil
+				continue
+			case <-r.closing:
+				r.drain(conn)
+				r.finish()
+				return
+			case <-idle:
+				var open bool
+				if conn, reopenedFor, open = r.idle(conn); !open {
+					r.finish()
+					return
+				}
+				continue
+			}
+		}
+
+		select {
+		case conn.SendChannel <- next:
+			reopenedFor = nil
+			recycling.count()
+			r.breaker.success(false)
+			if len(r.retry) > 0 && r.retry[0] == next {
+				r.retry = r.retry[1:]
+				r.replayed = append(r.replayed, next)
+				r.replayNext()
+			}
+		case connectionClose := <-conn.CloseChannel:
+			if len(r.retry) == 0 || r.retry[0] != next {
+				r.retry = append([]*Payload{next}, r.retry...)
+			}
+			reopenedFor = nil
+			r.handleClose(connectionClose)
+			conn = nil
+		}
+	}
+}
+
+// Hold off sending until resumed, the connection closes or Close is
+// called, when it's shut down without sending anything more
+// Returns the connection, nil if it closed, and false if closed
+func (r *APNSReconnectingConnection) waitPaused(conn *APNSConnection, pauseChanged <-chan bool) (*APNSConnection, bool) {
+	r.states.set(&ConnectionStateEvent{State: StatePaused, Pending: len(r.retry)})
+	select {
+	case <-pauseChanged:
+		if paused, _ := r.pauses.state(); !paused {
+			r.connected(conn, 0)
+		}
+		return conn, true
+	case connectionClose := <-conn.CloseChannel:
+		r.handleClose(connectionClose)
+		return nil, true
+	case <-r.closing:
+		r.shutdown(conn)
+		return nil, false
+	}
+}
+
+// Shut the idle connection down, then wait for the next payload and
+// reopen the connection for it straight away rather than backing off
+// Returns the new connection and the payload to send on it first, or no
+// connection if one has to be reconnected (the payload is left in retry),
+// and false if closed meanwhile
+func (r *APNSReconnectingConnection) idle(conn *APNSConnection) (*APNSConnection, *Payload, bool) {
+	timeout := time.Duration(r.config.IdleTimeout) * time.Millisecond
+	r.drain(conn)
+	if len(r.retry) > 0 {
+		//apple rejected something as it shut down, or didn't confirm what
+		//was in flight, so resend over a new connection as for a drop
+		return nil, nil, true
+	}
+	r.logger.Info("apns: idle connection closed", "idle", timeout)
+	r.states.set(&ConnectionStateEvent{State: StateIdle, Idle: timeout})
+
+	var next *Payload
+	select {
+	case next = <-r.SendChannel:
+		if next == nil {
+			//channel was closed
+			r.Close()
+			return nil, nil, false
+		}
+	case <-r.closing:
+		return nil, nil, false
+	}
+
+	reopenStart := time.Now()
+	conn, err := r.config.dial(r.config.ConnectionConfig)
+	if err != nil {
+		r.logger.Warn("apns: failed to reopen idle connection", "error", err.Error())
+		r.breaker.failure()
+		r.retry = append(r.retry, next)
+		return nil, nil, true
+	}
+	reopen := time.Since(reopenStart)
+	conn.replays = r.replayCount
+	conn.reopenedFor = next
+	conn.reopen = reopen
+	r.connected(conn, reopen)
+	return conn, next, true
+}
+
+// Queue what a closed connection didn't send to be resent, passing on
+// any payload apple rejected
+func (r *APNSReconnectingConnection) handleClose(connectionClose *ConnectionClose) {
+	r.event(&ReconnectEvent{Type: ReconnectDisconnected, Close: connectionClose})
+	//a drop, or apple failing to process, rather than a bad payload
+	if connectionClose.Error.ErrorCode == 10 || connectionClose.Error.Reason().IsRetryable() {
+		r.breaker.failure()
+	}
+
+	resend := []*Payload{}
+	if connectionClose.Error.ErrorCode == 10 {
+		//the socket dropped (or apple shut down), so the error payload
+		//may not have been delivered either
+		if connectionClose.ErrorPayload != nil {
+			resend = append(resend, connectionClose.ErrorPayload)
+		}
+	} else {
+		r.lastError = connectionClose.Error
+	}
+	for e := connectionClose.UnsentPayloads.Front(); e != nil; e = e.Next() {
+		resend = append(resend, e.Value.(*Payload))
+	}
+	if connectionClose.Error.ErrorCode == 10 && connectionClose.Error.MessageID == 0 {
+		resend = r.suspects(connectionClose, resend)
+	}
+	resend, abandoned := r.countReplays(resend, connectionClose)
+	r.retry = append(resend, r.retry...)
+	if len(resend) > 0 {
+		if !r.replaying {
+			r.replaying = true
+			r.replayResent = 0
+		}
+		r.logger.Info("apns: replay started", "payloads", len(resend), "pending", len(r.retry),
+			"abandoned", abandoned.Len())
+	}
+	r.unsentBufferOverflowed = r.unsentBufferOverflowed || connectionClose.UnsentPayloadBufferOverflow
+
+	r.states.set(&ConnectionStateEvent{State: StateDisconnected, Error: connectionClose.Error, Pending: len(r.retry)})
+
+	if connectionClose.Error.ErrorCode != 10 && connectionClose.ErrorPayload != nil {
+		r.forward(&ConnectionClose{
+			Error:                       connectionClose.Error,
+			ErrorPayload:                connectionClose.ErrorPayload,
+			UnsentPayloads:              list.New(),
+			UnsentPayloadBufferOverflow: connectionClose.UnsentPayloadBufferOverflow,
+			Time:                        connectionClose.Time,
+		})
+	}
+	if abandoned.Len() > 0 {
+		r.forward(&ConnectionClose{
+			Error:          connectionClose.Error,
+			UnsentPayloads: abandoned,
+			Time:           connectionClose.Time,
+		})
+	}
+}
+
+// The payloads a drop without an error from apple may have lost: those
+// never written, or written within ReplayWindow of the drop
+func (r *APNSReconnectingConnection) suspects(connectionClose *ConnectionClose, resend []*Payload) []*Payload {
+	if r.config.ReplayWindow < 0 {
+		return resend
+	}
+	window := time.Duration(r.config.ReplayWindow) * time.Millisecond
+	if timeout := connectionClose.Timeout; timeout != nil && timeout.Op == "ack" {
+		window += timeout.After
+	}
+	since := connectionClose.Time.Add(-window)
+	suspects := make([]*Payload, 0, len(resend))
+	for _, payload := range resend {
+		writtenAt, written := connectionClose.writtenAt[payload]
+		if !written || !writtenAt.Before(since) {
+			suspects = append(suspects, payload)
+		}
+	}
+	return suspects
+}
+
+// Count another replay of each payload handed back by the close, about to
+// be resent, leaving out (and returning) those past MaxReplayAttempts
+func (r *APNSReconnectingConnection) countReplays(resend []*Payload, connectionClose *ConnectionClose) ([]*Payload, *list.List) {
+	handedBack := make(map[*Payload]bool, len(resend))
+	for _, payload := range resend {
+		handedBack[payload] = true
+	}
+	r.forgetReplayed(handedBack)
+
+	var err error = connectionClose.Error
+	if connectionClose.StalledWrite != nil {
+		err = connectionClose.StalledWrite
+	} else if connectionClose.Timeout != nil {
+		err = connectionClose.Timeout
+	}
+	attempt := SendAttempt{Time: connectionClose.Time, Reason: connectionClose.Error.Reason(), Err: err}
+	r.replaysLock.Lock()
+	kept := make([]*Payload, 0, len(resend))
+	abandoned := []*Payload{}
+	for _, payload := range resend {
+		r.replays[payload] = append(r.replays[payload], attempt)
+		if r.config.MaxReplayAttempts > 0 && len(r.replays[payload]) > r.config.MaxReplayAttempts {
+			abandoned = append(abandoned, payload)
+			continue
+		}
+		kept = append(kept, payload)
+	}
+	r.replaysLock.Unlock()
+
+	r.deadLetter(abandoned, func(payload *Payload, attempts []SendAttempt) error {
+		return &AttemptsExceededError{Payload: payload, MaxAttempts: r.config.MaxReplayAttempts + 1, Attempts: attempts,
+			setting: "MaxReplayAttempts"}
+	})
+	abandonedList := list.New()
+	for _, payload := range abandoned {
+		r.config.ConnectionConfig.payloadJournal().ack(payload)
+		abandonedList.PushBack(payload)
+	}
+	return kept, abandonedList
+}
+
+// Stop counting replays of the payloads resent on the closed connection
+// that it didn't hand back, they were delivered (or rejected)
+func (r *APNSReconnectingConnection) forgetReplayed(handedBack map[*Payload]bool) {
+	r.replaysLock.Lock()
+	defer r.replaysLock.Unlock()
+	for _, payload := range r.replayed {
+		if !handedBack[payload] {
+			delete(r.replays, payload)
+		}
+	}
+	r.replayed = nil
+}
+
+// Count a payload resent, logging the end of the replay once every
+// payload handed back has been
+func (r *APNSReconnectingConnection) replayNext() {
+	r.replayResent++
+	if !r.replaying || len(r.retry) > 0 {
+		return
+	}
+	r.replaying = false
+	r.logger.Info("apns: replay finished", "payloads", r.replayResent)
+}
+
+// Pass a close on to CloseChannel without holding up the resends
+func (r *APNSReconnectingConnection) forward(connectionClose *ConnectionClose) {
+	r.forwards.Add(1)
+	go func() {
+		defer r.forwards.Done()
+		r.CloseChannel <- connectionClose
+	}()
+}
+
+// Dial until connected, backing off between attempts
+// Returns nil when closing, after MaxReconnectAttempts or once the
+// certificate has expired
+func (r *APNSReconnectingConnection) reconnect() *APNSConnection {
+	base := time.Duration(r.config.ReconnectBaseDelay) * time.Millisecond
+	max := time.Duration(r.config.ReconnectMaxDelay) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		if open := r.breaker.allow(); open != nil {
+			if !r.failFast(open) {
+				return nil
+			}
+			attempt--
+			continue
+		}
+		delay := reconnectDelay(attempt, base, max)
+		r.event(&ReconnectEvent{Type: ReconnectAttempt, Attempt: attempt, Delay: delay})
+		r.states.set(&ConnectionStateEvent{State: StateReconnecting, Attempt: attempt, NextDelay: delay})
+		select {
+		case <-time.After(delay):
+		case <-r.closing:
+			return nil
+		}
+
+		conn, err := r.config.dial(r.config.ConnectionConfig)
+		if err == nil {
+			conn.replays = r.replayCount
+			conn.config.StatsCollector.OnReconnect()
+			r.breaker.success(true)
+			r.event(&ReconnectEvent{Type: ReconnectConnected, Attempt: attempt})
+			r.connected(conn, 0)
+			return conn
+		}
+		r.breaker.failure()
+		r.event(&ReconnectEvent{Type: ReconnectFailed, Attempt: attempt, Err: err})
+		//no point retrying a certificate that has expired
+		expired := &CertificateExpiredError{}
+		if errors.As(err, &expired) || (r.config.MaxReconnectAttempts > 0 && attempt >= r.config.MaxReconnectAttempts) {
+			r.event(&ReconnectEvent{Type: ReconnectGaveUp, Attempt: attempt})
+			return nil
+		}
+	}
+}
+
+// While the circuit breaker is open pass every payload, those waiting to
+// be resent and any sent meanwhile, straight on to CloseChannel until
+// it's time to probe
+// Returns false if closed meanwhile
+func (r *APNSReconnectingConnection) failFast(open *CircuitOpenError) bool {
+	r.states.set(&ConnectionStateEvent{State: StateThrottled, Until: open.Until})
+	r.failOpen(r.retry, open)
+	r.retry = nil
+	r.forgetReplayed(nil)
+
+	wait := r.config.CircuitBreaker.clock.After(open.Until.Sub(r.config.CircuitBreaker.clock.Now()))
+	for {
+		select {
+		case <-wait:
+			return true
+		case payload := <-r.SendChannel:
+			if payload == nil {
+				//channel was closed
+				r.Close()
+				return false
+			}
+			r.failOpen([]*Payload{payload}, open)
+		case <-r.closing:
+			return false
+		}
+	}
+}
+
+// Pass payloads failed by the open circuit breaker on to CloseChannel
+func (r *APNSReconnectingConnection) failOpen(payloads []*Payload, open *CircuitOpenError) {
+	if len(payloads) == 0 {
+		return
+	}
+	unsent := list.New()
+	for _, payload := range payloads {
+		unsent.PushBack(payload)
+	}
+	r.deadLetter(payloads, func(payload *Payload, attempts []SendAttempt) error { return open })
+	r.forward(&ConnectionClose{
+		UnsentPayloads: unsent,
+		CircuitOpen:    open,
+		Time:           time.Now(),
+	})
+}
+
+// State of the circuit breaker, CircuitClosed without one
+// Safe to call from any goroutine
+func (r *APNSReconnectingConnection) CircuitState() CircuitState {
+	return r.breaker.currentState()
+}
+
+// Send anything waiting to be resent, then shut down
+// Whatever apple reports as unsent is left in retry
+func (r *APNSReconnectingConnection) drain(conn *APNSConnection) {
+	for len(r.retry) > 0 {
+		select {
+		case conn.SendChannel <- r.retry[0]:
+			r.replayed = append(r.replayed, r.retry[0])
+			r.retry = r.retry[1:]
+			r.replayNext()
+		case connectionClose := <-conn.CloseChannel:
+			r.handleClose(connectionClose)
+			return
+		}
+	}
+	r.shutdown(conn)
+}
+
+// Shut the connection down, leaving whatever apple reports as unsent in
+// retry
+func (r *APNSReconnectingConnection) shutdown(conn *APNSConnection) {
+	connectionClose := conn.shutdownForClose()
+	if connectionClose == nil {
+		r.forgetReplayed(nil)
+		return
+	}
+	r.handleClose(connectionClose)
+}
+
+// Send the final ConnectionClose with everything left to resend
+func (r *APNSReconnectingConnection) finish() {
+	reason := errors.New("Payload was not sent before Close")
+	select {
+	case <-r.closing:
+	default:
+		reason = errors.New("Payload was not sent before giving up reconnecting")
+	}
+	unsent := list.New()
+	for _, payload := range r.retry {
+		unsent.PushBack(payload)
+	}
+	r.deadLetter(r.retry, func(payload *Payload, attempts []SendAttempt) error { return reason })
+	r.retry = nil
+	r.states.set(&ConnectionStateEvent{State: StateClosed, Unsent: unsent.Len()})
+	r.forwards.Wait()
+	r.CloseChannel <- &ConnectionClose{
+		Error:                       r.lastError,
+		UnsentPayloads:              unsent,
+		UnsentPayloadBufferOverflow: r.unsentBufferOverflowed,
+		Time:                        time.Now(),
+	}
+	close(r.CloseChannel)
+}
+
+func (r *APNSReconnectingConnection) event(event *ReconnectEvent) {
+	select {
+	case r.EventChannel <- event:
+	default:
+	}
+}
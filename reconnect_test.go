@@ -0,0 +1,405 @@
+package apns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joekarl/go-libapns/apnstest"
+)
+
+// An apnstest server that drops each of its first drops connections
+// after reading dropAfter frames, without a response
+// As nothing is known to have been delivered when a connection drops
+// like this, its payloads are all resent, so later connections are kept
+// open for them to get through
+type dropTestGateway struct {
+	*apnstest.Server
+}
+
+func newDropTestGateway(t *testing.T, drops int, dropAfter int) (*dropTestGateway, *APNSConfig) {
+	server, err := apnstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.DropAfter(dropAfter, drops)
+	host, port, _ := net.SplitHostPort(server.BinaryAddr())
+	return &dropTestGateway{server}, &APNSConfig{
+		CertificateBytes: server.ClientCertPEM,
+		KeyBytes:         server.ClientKeyPEM,
+		GatewayHost:      host,
+		GatewayPort:      port,
+		RootCAs:          server.RootCAs,
+		FramingTimeout:   1,
+	}
+}
+
+// Number of distinct tokens received
+func (g *dropTestGateway) distinct() int {
+	tokens := make(map[string]bool)
+	for _, notification := range g.Received() {
+		tokens[notification.Token] = true
+	}
+	return len(tokens)
+}
+
+func TestReconnectDelay(t *testing.T) {
+	base, max := 100*time.Millisecond, time.Second
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, full := range expected {
+		full *= time.Millisecond
+		for j := 0; j < 20; j++ {
+			delay := reconnectDelay(i+1, base, max)
+			if delay < full/2 || delay > full {
+				t.Error(fmt.Sprintf("Expected attempt %v to wait between %v and %v but got %v", i+1, full/2, full, delay))
+			}
+		}
+	}
+}
+
+func TestReconnectShouldNotLosePayloadsWhenDropped(t *testing.T) {
+	gateway, config := newDropTestGateway(t, 3, 7)
+	defer gateway.Close()
+
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig:   config,
+		ReconnectBaseDelay: 1,
+		ReconnectMaxDelay:  10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 50
+	for i := 0; i < count; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for gateway.distinct() < count {
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("Only %v of %v payloads were received", gateway.distinct(), count))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	conn.Close()
+	var connectionClose *ConnectionClose
+	for connectionClose = range conn.CloseChannel {
+	}
+	if connectionClose.UnsentPayloads.Len() != 0 || connectionClose.UnsentPayloadBufferOverflow {
+		t.Error(fmt.Sprintf("Expected nothing unsent but got %v", connectionClose))
+	}
+
+	disconnects, reconnects := 0, 0
+	for len(conn.EventChannel) > 0 {
+		switch event := <-conn.EventChannel; event.Type {
+		case ReconnectDisconnected:
+			disconnects++
+		case ReconnectConnected:
+			reconnects++
+		}
+	}
+	if disconnects != 3 || reconnects != 3 {
+		t.Error(fmt.Sprintf("Expected 3 disconnects and reconnects but got %v and %v", disconnects, reconnects))
+	}
+}
+
+func TestReconnectShouldPassOnRejections(t *testing.T) {
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig:   &APNSConfig{InFlightPayloadBufferSize: 100, FramingTimeout: 1, MaxPayloadSize: 2048},
+		ReconnectBaseDelay: 1,
+		dial:               dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+	waitForPoolSends(t, dialer, []int{3})
+
+	//apple rejects the second, the third is resent
+	dialer.socket(0).reject(8, 1)
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.Error.ErrorCode != 8 || connectionClose.ErrorPayload.AlertText != "Testing1" || connectionClose.UnsentPayloads.Len() != 0 {
+		t.Error(fmt.Sprintf("Expected the rejection to be passed on but got %v", connectionClose))
+	}
+	waitForPoolSends(t, dialer, []int{3, 1})
+
+	conn.Close()
+	for connectionClose = range conn.CloseChannel {
+	}
+	if connectionClose.UnsentPayloads.Len() != 0 || connectionClose.Error.ErrorCode != 8 {
+		t.Error(fmt.Sprintf("Unexpected final close %v", connectionClose))
+	}
+}
+
+func TestReconnectCloseShouldAccountForEveryPayload(t *testing.T) {
+	for cycle := 0; cycle < 100; cycle++ {
+		dialer := &poolTestDialer{lock: new(sync.Mutex)}
+		conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+			ConnectionConfig:   &APNSConfig{InFlightPayloadBufferSize: 100, FramingTimeout: 1, MaxPayloadSize: 2048},
+			ReconnectBaseDelay: 1,
+			dial:               dialer.dial,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 20
+		for i := 0; i < count; i++ {
+			conn.SendChannel <- groupTestPayload(i)
+		}
+		conn.Close()
+
+		unsent := 0
+		for connectionClose := range conn.CloseChannel {
+			unsent += connectionClose.UnsentPayloads.Len()
+		}
+		if sent := dialer.socket(0).sent(); sent+unsent != count {
+			t.Fatal(fmt.Sprintf("Expected all %v payloads to be sent or unsent on cycle %v but %v were sent and %v unsent",
+				count, cycle, sent, unsent))
+		}
+	}
+}
+
+// Number of times each test payload's alert was written to the socket
+func (s *poolTestSocket) alerts(count int) []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	alerts := make([]int, count)
+	for i := range alerts {
+		alerts[i] = bytes.Count(s.written.Bytes(), []byte(fmt.Sprintf("\"Testing%d\"", i)))
+	}
+	return alerts
+}
+
+func TestReconnectShouldNotResendDeliveredPayloadsAfterAnIdleDrop(t *testing.T) {
+	clock := newFakeClock()
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig:   &APNSConfig{InFlightPayloadBufferSize: 100, FramingTimeout: 1, MaxPayloadSize: 2048, clock: clock},
+		ReconnectBaseDelay: 1,
+		ReplayWindow:       5000,
+		dial:               dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the first three go out well before the connection drops, the last
+	//two just before it
+	for i := 0; i < 3; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+	waitForPoolSends(t, dialer, []int{3})
+	clock.After(time.Minute)
+	for i := 3; i < 5; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+	waitForPoolSends(t, dialer, []int{5})
+	clock.After(time.Second)
+
+	dialer.socket(0).Close()
+	waitForPoolSends(t, dialer, []int{5, 2})
+	if alerts := dialer.socket(1).alerts(5); fmt.Sprint(alerts) != "[0 0 0 1 1]" {
+		t.Error(fmt.Sprintf("Expected only the payloads written within the window to be resent but got %v", alerts))
+	}
+
+	conn.Close()
+	var connectionClose *ConnectionClose
+	for connectionClose = range conn.CloseChannel {
+	}
+	if connectionClose.UnsentPayloads.Len() != 0 {
+		t.Error(fmt.Sprintf("Expected nothing unsent but got %v", connectionClose))
+	}
+}
+
+func TestReconnectShouldReplayPayloadsAfterARejection(t *testing.T) {
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig:   &APNSConfig{InFlightPayloadBufferSize: 100, FramingTimeout: 1, MaxPayloadSize: 2048},
+		ReconnectBaseDelay: 1,
+		dial:               dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, rejected := 8, 3
+	for i := 0; i < count; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+	waitForPoolSends(t, dialer, []int{count})
+
+	dialer.socket(0).reject(8, uint32(rejected))
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.ErrorPayload == nil || connectionClose.ErrorPayload.AlertText != fmt.Sprintf("Testing%d", rejected) {
+		t.Error(fmt.Sprintf("Expected only the rejected payload to be passed on but got %v", connectionClose))
+	}
+	waitForPoolSends(t, dialer, []int{count, count - rejected - 1})
+
+	//everything after the rejected payload is resent once, in order
+	replayed := dialer.socket(1).alerts(count)
+	for i, sends := range replayed {
+		if (i <= rejected && sends != 0) || (i > rejected && sends != 1) {
+			t.Error(fmt.Sprintf("Expected payloads after %v to be resent once but got %v", rejected, replayed))
+			break
+		}
+	}
+	conn.SendChannel <- groupTestPayload(count)
+	waitForPoolSends(t, dialer, []int{count, count - rejected})
+
+	conn.Close()
+	for connectionClose = range conn.CloseChannel {
+	}
+	if connectionClose.UnsentPayloads.Len() != 0 {
+		t.Error(fmt.Sprintf("Unexpected final close %v", connectionClose))
+	}
+}
+
+func TestReconnectShouldStopReplayingAfterMaxReplayAttempts(t *testing.T) {
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig:   &APNSConfig{InFlightPayloadBufferSize: 100, FramingTimeout: 1, MaxPayloadSize: 2048},
+		ReconnectBaseDelay: 1,
+		MaxReplayAttempts:  2,
+		dial:               dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a payload every connection drops on
+	poison := groupTestPayload(0)
+	conn.SendChannel <- poison
+	expected := []int{1}
+	for i := 0; i < 3; i++ {
+		waitForPoolSends(t, dialer, expected)
+		dialer.socket(i).Close()
+		expected = append(expected, 1)
+	}
+
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.ErrorPayload != nil || connectionClose.UnsentPayloads.Len() != 1 ||
+		connectionClose.UnsentPayloads.Front().Value != poison {
+		t.Error(fmt.Sprintf("Expected the payload to be given up on but got %v", connectionClose))
+	}
+
+	//the connection carries on without it
+	conn.SendChannel <- groupTestPayload(1)
+	waitForPoolSends(t, dialer, []int{1, 1, 1, 1})
+	conn.Close()
+	for connectionClose = range conn.CloseChannel {
+	}
+	if connectionClose.UnsentPayloads.Len() != 0 {
+		t.Error(fmt.Sprintf("Unexpected final close %v", connectionClose))
+	}
+}
+
+func TestReconnectShouldForgetReplaysOnceDelivered(t *testing.T) {
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig:   &APNSConfig{InFlightPayloadBufferSize: 100, FramingTimeout: 1, MaxPayloadSize: 2048},
+		ReconnectBaseDelay: 1,
+		MaxReplayAttempts:  1,
+		dial:               dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloads := []*Payload{groupTestPayload(0), groupTestPayload(1)}
+	for _, payload := range payloads {
+		conn.SendChannel <- payload
+	}
+	waitForPoolSends(t, dialer, []int{2})
+	dialer.socket(0).Close()
+	waitForPoolSends(t, dialer, []int{2, 2})
+
+	//rejecting the second shows the first was delivered
+	dialer.socket(1).reject(8, 1)
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.ErrorPayload != payloads[1] || connectionClose.UnsentPayloads.Len() != 0 {
+		t.Error(fmt.Sprintf("Expected the rejection to be passed on but got %v", connectionClose))
+	}
+
+	//so sending it again starts its count afresh
+	waitForPoolSends(t, dialer, []int{2, 2, 0})
+	conn.SendChannel <- payloads[0]
+	waitForPoolSends(t, dialer, []int{2, 2, 1})
+	dialer.socket(2).Close()
+	waitForPoolSends(t, dialer, []int{2, 2, 1, 1})
+
+	conn.Close()
+	for connectionClose = range conn.CloseChannel {
+	}
+	if connectionClose.UnsentPayloads.Len() != 0 {
+		t.Error(fmt.Sprintf("Unexpected final close %v", connectionClose))
+	}
+}
+
+func TestReconnectShouldGiveUp(t *testing.T) {
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig:     &APNSConfig{InFlightPayloadBufferSize: 100, FramingTimeout: 1, MaxPayloadSize: 2048},
+		ReconnectBaseDelay:   1,
+		MaxReconnectAttempts: 3,
+		dial:                 dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SendChannel <- groupTestPayload(0)
+	waitForPoolSends(t, dialer, []int{1})
+	dialer.lock.Lock()
+	dialer.fail = true
+	dialer.lock.Unlock()
+	dialer.socket(0).Close()
+
+	var connectionClose *ConnectionClose
+	for connectionClose = range conn.CloseChannel {
+	}
+	//the dropped connection's only payload can't be known to have arrived
+	if connectionClose.UnsentPayloads.Len() != 1 {
+		t.Error(fmt.Sprintf("Expected the payload to be handed back but got %v", connectionClose))
+	}
+
+	failures := 0
+	var last *ReconnectEvent
+	for len(conn.EventChannel) > 0 {
+		last = <-conn.EventChannel
+		if last.Type == ReconnectFailed {
+			failures++
+			if last.Err == nil || last.Err.Error() != errors.New("Dial failed").Error() {
+				t.Error(fmt.Sprintf("Expected the dial error but got %v", last.Err))
+			}
+		}
+	}
+	if failures != 3 || last.Type != ReconnectGaveUp {
+		t.Error(fmt.Sprintf("Expected 3 failures then giving up but got %v failures ending with %v", failures, last.Type))
+	}
+}
+
+func TestReconnectConfigValidation(t *testing.T) {
+	configs := map[string]*APNSReconnectConfig{
+		"no connection config": {},
+		"negative delay":       {ConnectionConfig: &APNSConfig{}, ReconnectBaseDelay: -1},
+		"negative attempts":    {ConnectionConfig: &APNSConfig{}, MaxReconnectAttempts: -1},
+		"negative events":      {ConnectionConfig: &APNSConfig{}, EventBufferSize: -1},
+		"negative replays":     {ConnectionConfig: &APNSConfig{}, MaxReplayAttempts: -2},
+		"negative window":      {ConnectionConfig: &APNSConfig{}, ReplayWindow: -2},
+		"bad error rate":       {ConnectionConfig: &APNSConfig{}, CircuitBreaker: &CircuitBreakerConfig{MaxErrorRate: 2}},
+	}
+	for name, config := range configs {
+		if _, err := NewAPNSReconnectingConnection(config); err == nil {
+			t.Error(fmt.Sprintf("Expected %v to be invalid", name))
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package apns
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	mathrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of events in a recording
+const (
+	RecordingEventEnqueue    = "enqueue"
+	RecordingEventResponse   = "response"
+	RecordingEventReadError  = "read_error"
+	RecordingEventDisconnect = "disconnect"
+	RecordingEventClose      = "close"
+	RecordingEventTruncated  = "truncated"
+)
+
+// A single line of a recording, recordings are newline delimited json
+type RecordingEvent struct {
+	// One of the RecordingEvent* constants
+	Type string `json:"type"`
+	// When the event happened
+	At time.Time `json:"at"`
+	// Number of the connection the event is from, counting from 1 in the
+	// order the connections sharing the Recorder were made
+	Connection int `json:"connection,omitempty"`
+	// Identifier the connection assigned to an enqueued payload
+	ID uint32 `json:"id"`
+	// The enqueued payload
+	Payload *RecordedPayload `json:"payload,omitempty"`
+	// For payloads sent as part of a SendGroup, the id of the group's
+	// first member and the number of members
+	Group     *uint32 `json:"group,omitempty"`
+	GroupSize int     `json:"group_size,omitempty"`
+	// Raw error response bytes read from the gateway
+	Response []byte `json:"response,omitempty"`
+	// Socket error that closed the connection
+	Error string `json:"error,omitempty"`
+	// What the connection reported when it closed
+	Disposition *CloseDisposition `json:"disposition,omitempty"`
+}
+
+// Serializable form of the Payload fields that affect what is sent
+// ExtraData is never recorded
+type RecordedPayload struct {
+	AlertText           string                 `json:"alert_text,omitempty"`
+	AlertBody           *APSAlertBody          `json:"alert_body,omitempty"`
+	Badge               *int                   `json:"badge,omitempty"`
+	Sound               string                 `json:"sound,omitempty"`
+	ContentAvailable    int                    `json:"content_available,omitempty"`
+	Category            string                 `json:"category,omitempty"`
+	CustomFields        map[string]interface{} `json:"custom_fields,omitempty"`
+	DisableHTMLEscaping bool                   `json:"disable_html_escaping,omitempty"`
+	SanitizeUTF8        bool                   `json:"sanitize_utf8,omitempty"`
+	ExpirationTime      uint32                 `json:"expiration_time,omitempty"`
+	Priority            uint8                  `json:"priority,omitempty"`
+	Token               string                 `json:"token"`
+	CollapseId          string                 `json:"collapse_id,omitempty"`
+	ApnsId              string                 `json:"apns_id,omitempty"`
+	PushType            PushType               `json:"push_type,omitempty"`
+	Topic               string                 `json:"topic,omitempty"`
+	ChannelId           string                 `json:"channel_id,omitempty"`
+	RawPayload          []byte                 `json:"raw_payload,omitempty"`
+	ApsOverride         json.RawMessage        `json:"aps_override,omitempty"`
+}
+
+// Outcome of a connection close, with payloads identified by their ids
+type CloseDisposition struct {
+	ErrorCode      uint8    `json:"error_code"`
+	ErrorPayloadID *uint32  `json:"error_payload_id,omitempty"`
+	UnsentIDs      []uint32 `json:"unsent_ids"`
+	BufferOverflow bool     `json:"buffer_overflow"`
+}
+
+// Options for a Recorder
+type RecorderOptions struct {
+	// Probability (0 to 1) that the recorder records anything at all,
+	// so recording can be enabled on a fraction of connections.
+	// Defaults to 1 when 0
+	SampleRate float64
+	// Stop recording after this many events, writing a truncated event,
+	// defaults to 0 (no limit)
+	MaxEvents int
+	// Replace device tokens with a consistent pseudonym
+	RedactTokens bool
+	// Replace alert text and custom field strings with filler of
+	// the same byte length
+	RedactContent bool
+}
+
+// Records the externally observable inputs of a connection (enqueued
+// payloads, gateway responses and lifecycle events) so that an incident
+// can be replayed with ReplayRecording. Set on APNSConfig.Recorder
+// Safe for concurrent use, so a pool or reconnecting connection can share
+// one between the connections it makes: each connection's events are
+// numbered by RecordingEvent.Connection. SampleRate and MaxEvents apply to
+// the recording as a whole
+type Recorder struct {
+	encoder     *json.Encoder
+	options     RecorderOptions
+	enabled     bool
+	events      int
+	stopped     bool
+	tokenKey    []byte
+	err         error
+	connections int
+	lock        *sync.Mutex
+}
+
+// The events of one connection sharing a Recorder, nil when not recording
+type connectionRecorder struct {
+	recorder   *Recorder
+	connection int
+}
+
+// Create a recorder writing newline delimited json events to w
+func NewRecorder(w io.Writer, options RecorderOptions) *Recorder {
+	if options.SampleRate == 0 {
+		options.SampleRate = 1
+	}
+	r := &Recorder{
+		encoder: json.NewEncoder(w),
+		options: options,
+		enabled: mathrand.Float64() < options.SampleRate,
+		lock:    new(sync.Mutex),
+	}
+	if options.RedactTokens {
+		r.tokenKey = make([]byte, 32)
+		rand.Read(r.tokenKey)
+	}
+	return r
+}
+
+// Whether this recorder was sampled and is recording
+func (r *Recorder) Enabled() bool {
+	return r.enabled
+}
+
+// The first error encountered writing the recording, if any
+func (r *Recorder) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+// Number the next connection recording its events, nil if r is or isn't
+// recording
+func (r *Recorder) connection() *connectionRecorder {
+	if r == nil || !r.enabled {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.connections++
+	return &connectionRecorder{recorder: r, connection: r.connections}
+}
+
+func (r *Recorder) record(event *RecordingEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.stopped || r.err != nil {
+		return
+	}
+	if r.options.MaxEvents > 0 && r.events >= r.options.MaxEvents {
+		r.stopped = true
+		event = &RecordingEvent{Type: RecordingEventTruncated, At: event.At}
+	}
+	r.events++
+	r.err = r.encoder.Encode(event)
+}
+
+func (c *connectionRecorder) record(event *RecordingEvent) {
+	if c == nil {
+		return
+	}
+	event.Connection = c.connection
+	c.recorder.record(event)
+}
+
+func (c *connectionRecorder) recordEnqueue(at time.Time, idPayloadObj *idPayload) {
+	if c == nil {
+		return
+	}
+	event := &RecordingEvent{
+		Type:    RecordingEventEnqueue,
+		At:      at,
+		ID:      idPayloadObj.ID,
+		Payload: c.recorder.recordPayload(idPayloadObj.Payload),
+	}
+	if group := idPayloadObj.group; group != nil {
+		event.Group = &group.members[0].ID
+		event.GroupSize = len(group.members)
+	}
+	c.record(event)
+}
+
+func (c *connectionRecorder) recordResponse(at time.Time, response []byte) {
+	c.record(&RecordingEvent{
+		Type:     RecordingEventResponse,
+		At:       at,
+		Response: response,
+	})
+}
+
+func (c *connectionRecorder) recordReadError(at time.Time, err error) {
+	c.record(&RecordingEvent{
+		Type:  RecordingEventReadError,
+		At:    at,
+		Error: err.Error(),
+	})
+}
+
+func (c *connectionRecorder) recordDisconnect(at time.Time) {
+	c.record(&RecordingEvent{
+		Type: RecordingEventDisconnect,
+		At:   at,
+	})
+}
+
+func (c *connectionRecorder) recordClose(at time.Time, disposition *CloseDisposition) {
+	c.record(&RecordingEvent{
+		Type:        RecordingEventClose,
+		At:          at,
+		Disposition: disposition,
+	})
+}
+
+// Snapshot the payload, applying any redaction
+func (r *Recorder) recordPayload(p *Payload) *RecordedPayload {
+	recorded := &RecordedPayload{
+		AlertText:           p.AlertText,
+		Sound:               p.Sound,
+		ContentAvailable:    p.ContentAvailable,
+		Category:            p.Category,
+		CustomFields:        p.CustomFields,
+		DisableHTMLEscaping: p.DisableHTMLEscaping,
+		SanitizeUTF8:        p.SanitizeUTF8,
+		ExpirationTime:      p.ExpirationTime,
+		Priority:            p.Priority,
+		Token:               p.Token,
+		CollapseId:          p.CollapseId,
+		ApnsId:              p.ApnsId,
+		PushType:            p.PushType,
+		Topic:               p.Topic,
+		ChannelId:           p.ChannelId,
+		RawPayload:          p.RawPayload,
+	}
+	if !p.AlertBody.isEmpty() {
+		alertBody := p.AlertBody
+		recorded.AlertBody = &alertBody
+	}
+	if p.Badge.IsSet() {
+		badge := p.Badge.Number()
+		recorded.Badge = &badge
+	}
+	if p.ApsOverride != nil {
+		//an override that fails to marshal fails to send, so isn't needed
+		if apsJson, err := p.ApsOverride.MarshalAps(); err == nil && json.Valid(apsJson) {
+			recorded.ApsOverride = apsJson
+		}
+	}
+
+	if r.options.RedactTokens {
+		hash := sha256.Sum256(append(append([]byte{}, r.tokenKey...), p.Token...))
+		recorded.Token = hex.EncodeToString(hash[:])
+	}
+	if r.options.RedactContent {
+		recorded.AlertText = redactString(recorded.AlertText)
+		if recorded.AlertBody != nil {
+			recorded.AlertBody.Body = redactString(recorded.AlertBody.Body)
+			recorded.AlertBody.Title = redactString(recorded.AlertBody.Title)
+			recorded.AlertBody.LocArgs = redactStrings(recorded.AlertBody.LocArgs)
+			recorded.AlertBody.TitleLocArgs = redactStrings(recorded.AlertBody.TitleLocArgs)
+		}
+		if recorded.CustomFields != nil {
+			recorded.CustomFields = redactValue(recorded.CustomFields).(map[string]interface{})
+		}
+		if recorded.RawPayload != nil {
+			recorded.RawPayload = []byte(`{"redacted":"` + strings.Repeat("x", len(recorded.RawPayload)) + `"}`)
+		}
+		if recorded.ApsOverride != nil {
+			recorded.ApsOverride = json.RawMessage(`{"redacted":"` + strings.Repeat("x", len(recorded.ApsOverride)) + `"}`)
+		}
+	}
+	return recorded
+}
+
+// Convert the recorded payload back into a Payload
+func (rp *RecordedPayload) Payload() *Payload {
+	p := &Payload{
+		AlertText:           rp.AlertText,
+		Sound:               rp.Sound,
+		ContentAvailable:    rp.ContentAvailable,
+		Category:            rp.Category,
+		CustomFields:        rp.CustomFields,
+		DisableHTMLEscaping: rp.DisableHTMLEscaping,
+		SanitizeUTF8:        rp.SanitizeUTF8,
+		ExpirationTime:      rp.ExpirationTime,
+		Priority:            rp.Priority,
+		Token:               rp.Token,
+		CollapseId:          rp.CollapseId,
+		ApnsId:              rp.ApnsId,
+		PushType:            rp.PushType,
+		Topic:               rp.Topic,
+		ChannelId:           rp.ChannelId,
+		RawPayload:          rp.RawPayload,
+	}
+	if rp.AlertBody != nil {
+		p.AlertBody = *rp.AlertBody
+	}
+	if rp.Badge != nil {
+		p.Badge = NewBadgeNumber(*rp.Badge)
+	}
+	if rp.ApsOverride != nil {
+		p.ApsOverride = RawAps(rp.ApsOverride)
+	}
+	return p
+}
+
+func redactString(s string) string {
+	return strings.Repeat("x", len(s))
+}
+
+func redactStrings(strs []string) []string {
+	if strs == nil {
+		return nil
+	}
+	redacted := make([]string, len(strs))
+	for i, s := range strs {
+		redacted[i] = redactString(s)
+	}
+	return redacted
+}
+
+// Copy a custom field value replacing every string inside it
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return redactString(v)
+	case []string:
+		return redactStrings(v)
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, inner := range v {
+			redacted[key] = redactValue(inner)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, inner := range v {
+			redacted[i] = redactValue(inner)
+		}
+		return redacted
+	default:
+		return v
+	}
+}
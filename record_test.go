@@ -0,0 +1,191 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Send count payloads over a connection that rejects rejectId and
+// return the recording
+func recordIncident(t *testing.T, count int, rejectId uint32, options RecorderOptions) *bytes.Buffer {
+	recording := new(bytes.Buffer)
+	socket := NewMockConnRejectId(true, rejectId)
+	c := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            10,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		Recorder:                  NewRecorder(recording, options),
+	})
+	for i := 0; i < count; i++ {
+		c.SendChannel <- groupTestPayload(i)
+	}
+	select {
+	case <-c.CloseChannel:
+	case <-time.After(time.Second):
+		t.Fatal("Connection never closed")
+	}
+	<-c.sendListenerDone
+	c.noFlushDisconnect()
+	return recording
+}
+
+func decodeRecording(t *testing.T, recording []byte) []*RecordingEvent {
+	events, err := readRecording(bytes.NewReader(recording))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestRecorderShouldRecordIncident(t *testing.T) {
+	recording := recordIncident(t, 5, 2, RecorderOptions{})
+	events := decodeRecording(t, recording.Bytes())
+
+	types := []string{}
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	expected := "enqueue enqueue enqueue enqueue enqueue response close"
+	if strings.Join(types, " ") != expected {
+		t.Fatalf("Expected events %v but got %v", expected, types)
+	}
+	if events[4].ID != 4 || events[4].Payload.Token != groupTestPayload(4).Token {
+		t.Errorf("Unexpected enqueue event %+v", events[4])
+	}
+	if !bytes.Equal(events[5].Response, []byte{8, 8, 0, 0, 0, 2}) {
+		t.Errorf("Unexpected response %v", events[5].Response)
+	}
+
+	disposition := events[6].Disposition
+	if disposition.ErrorCode != 8 || disposition.ErrorPayloadID == nil || *disposition.ErrorPayloadID != 2 {
+		t.Errorf("Unexpected disposition %+v", disposition)
+	}
+	if len(disposition.UnsentIDs) != 2 || disposition.UnsentIDs[0] != 3 || disposition.UnsentIDs[1] != 4 {
+		t.Errorf("Expected unsent ids [3 4] but got %v", disposition.UnsentIDs)
+	}
+}
+
+func TestRecorderShouldRedact(t *testing.T) {
+	recording := recordIncident(t, 3, 1, RecorderOptions{RedactTokens: true, RedactContent: true})
+
+	for i := 0; i < 3; i++ {
+		payload := groupTestPayload(i)
+		if bytes.Contains(recording.Bytes(), []byte(payload.Token)) {
+			t.Errorf("Recording contains token %v", payload.Token)
+		}
+		if bytes.Contains(recording.Bytes(), []byte(payload.AlertText)) {
+			t.Errorf("Recording contains alert %v", payload.AlertText)
+		}
+	}
+
+	events := decodeRecording(t, recording.Bytes())
+	tokens := map[string]bool{}
+	for _, event := range events[:3] {
+		if len(event.Payload.Token) != 64 {
+			t.Errorf("Expected a 64 character pseudonym but got %v", event.Payload.Token)
+		}
+		if len(event.Payload.AlertText) != len(groupTestPayload(0).AlertText) {
+			t.Errorf("Expected redacted alert to keep its length but got %v", event.Payload.AlertText)
+		}
+		tokens[event.Payload.Token] = true
+	}
+	if len(tokens) != 3 {
+		t.Errorf("Expected distinct pseudonyms per token but got %v", tokens)
+	}
+}
+
+func TestRecorderShouldRedactCustomFields(t *testing.T) {
+	r := NewRecorder(new(bytes.Buffer), RecorderOptions{RedactContent: true})
+	payload := &Payload{
+		AlertText: "hi",
+		CustomFields: map[string]interface{}{
+			"name":   "secret",
+			"nested": map[string]interface{}{"list": []interface{}{"abc", 4}},
+			"count":  2,
+		},
+	}
+	recorded := r.recordPayload(payload)
+
+	jsonBytes, _ := json.Marshal(recorded.CustomFields)
+	if string(jsonBytes) != `{"count":2,"name":"xxxxxx","nested":{"list":["xxx",4]}}` {
+		t.Errorf("Unexpected redacted custom fields %s", jsonBytes)
+	}
+	if payload.CustomFields["name"] != "secret" {
+		t.Error("Redaction modified the payload")
+	}
+}
+
+func TestRecorderShouldStopAtMaxEvents(t *testing.T) {
+	recording := recordIncident(t, 5, 2, RecorderOptions{MaxEvents: 2})
+	events := decodeRecording(t, recording.Bytes())
+
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events but got %v", len(events))
+	}
+	if events[2].Type != RecordingEventTruncated {
+		t.Errorf("Expected truncated event but got %v", events[2].Type)
+	}
+}
+
+func TestRecorderShouldSample(t *testing.T) {
+	r := NewRecorder(new(bytes.Buffer), RecorderOptions{SampleRate: 1e-12})
+	if r.Enabled() {
+		t.Error("Expected recorder to not be sampled")
+	}
+
+	recording := recordIncident(t, 3, 1, RecorderOptions{SampleRate: 1e-12})
+	if recording.Len() != 0 {
+		t.Errorf("Expected nothing recorded but got %v bytes", recording.Len())
+	}
+}
+
+func TestRecorderShouldBeSharedBetweenConnections(t *testing.T) {
+	recording := new(bytes.Buffer)
+	config := &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            10,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		Recorder:                  NewRecorder(recording, RecorderOptions{}),
+	}
+	//each connection rejects a different payload
+	conns := []*APNSConnection{
+		socketAPNSConnection(NewMockConnRejectId(true, 1), config),
+		socketAPNSConnection(NewMockConnRejectId(true, 3), config),
+	}
+	done := make(chan bool)
+	for _, c := range conns {
+		go func(c *APNSConnection) {
+			for i := 0; i < 5; i++ {
+				c.SendChannel <- groupTestPayload(i)
+			}
+			<-c.CloseChannel
+			<-c.sendListenerDone
+			c.noFlushDisconnect()
+			done <- true
+		}(c)
+	}
+	<-done
+	<-done
+
+	connections := map[int]int{}
+	for _, event := range decodeRecording(t, recording.Bytes()) {
+		connections[event.Connection]++
+	}
+	if len(connections) != 2 || connections[1] == 0 || connections[2] == 0 {
+		t.Fatalf("Expected events from connections 1 and 2 but got %v", connections)
+	}
+	for connection, rejected := range map[int]uint32{1: 1, 2: 3} {
+		report, err := ReplayRecordingConnection(bytes.NewReader(recording.Bytes()), connection, APNSConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Divergences) != 0 || report.Enqueued != 5 || *report.Replayed.ErrorPayloadID != rejected {
+			t.Errorf("Expected connection %v to replay on its own but got %+v", connection, report)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package apns
+
+import (
+	"time"
+)
+
+// Counts what a connection has sent and how long it's been open, to tell
+// when it's due to be replaced (see MaxNotificationsPerConnection and
+// MaxConnectionAge)
+// Used by the send loop that owns the connection, so isn't locked
+type recycleTracker struct {
+	maxSent int
+	maxAge  time.Duration
+	// limits are scaled by this for the first connection, so a pool's
+	// members opened together aren't all due at once
+	stagger float64
+	// the connection being counted, nil before the first
+	conn   *APNSConnection
+	sent   int
+	opened time.Time
+	// no attempt is made until then, after one failed
+	notBefore time.Time
+}
+
+func newRecycleTracker(maxSent int, maxAge int, stagger float64) *recycleTracker {
+	return &recycleTracker{
+		maxSent: maxSent,
+		maxAge:  time.Duration(maxAge) * time.Millisecond,
+		stagger: stagger,
+	}
+}
+
+// Start counting again if conn is a new connection
+func (t *recycleTracker) track(conn *APNSConnection) {
+	if conn == t.conn {
+		return
+	}
+	if t.conn != nil {
+		t.stagger = 1
+	}
+	t.conn = conn
+	t.sent = 0
+	t.opened = time.Now()
+}
+
+// Count a payload handed to the connection
+func (t *recycleTracker) count() {
+	t.sent++
+}
+
+// Whether the connection has sent enough, or is old enough, to replace
+func (t *recycleTracker) due() bool {
+	if time.Now().Before(t.notBefore) {
+		return false
+	}
+	if t.maxSent > 0 && float64(t.sent) >= float64(t.maxSent)*t.stagger {
+		return true
+	}
+	return t.maxAge > 0 && time.Since(t.opened) >= t.age()
+}
+
+// Fires once the connection is old enough to replace, nil without a
+// MaxConnectionAge
+func (t *recycleTracker) aged() <-chan time.Time {
+	if t.maxAge <= 0 {
+		return nil
+	}
+	wait := time.Until(t.opened.Add(t.age()))
+	if postponed := time.Until(t.notBefore); postponed > wait {
+		wait = postponed
+	}
+	return time.After(wait)
+}
+
+// Hold off replacing the connection for d, after an attempt failed
+func (t *recycleTracker) postpone(d time.Duration) {
+	t.notBefore = time.Now().Add(d)
+}
+
+func (t *recycleTracker) age() time.Duration {
+	return time.Duration(float64(t.maxAge) * t.stagger)
+}
+
+// Replace the connection, opening the new one before shutting the old one
+// down so there's no gap. What's waiting on SendChannel is sent on the new
+// connection, after anything the old one hands back
+// Returns the connection to carry on with, the old one if a new one
+// couldn't be opened
+func (r *APNSReconnectingConnection) recycle(conn *APNSConnection, recycling *recycleTracker) *APNSConnection {
+	replacement, err := r.config.dial(r.config.ConnectionConfig)
+	if err != nil {
+		r.logger.Warn("apns: failed to open replacement connection", "error", err.Error())
+		recycling.postpone(time.Duration(r.config.ReconnectMaxDelay) * time.Millisecond)
+		return conn
+	}
+	age := time.Since(recycling.opened)
+	r.logger.Info("apns: recycling connection", "notifications", recycling.sent, "age", age)
+	r.states.set(&ConnectionStateEvent{State: StateRecycling, Notifications: recycling.sent, Age: age})
+	r.drain(conn)
+	replacement.replays = r.replayCount
+	r.connected(replacement, 0)
+	return replacement
+}
+
+// Replace a member's connection, switching Send and the member's queue to
+// the new one before shutting the old one down. Only one member is
+// replaced at a time, the others wait ReconnectInterval to try again
+// Returns the connection to carry on with, the old one if it wasn't
+// replaced
+func (p *APNSConnectionPool) recycle(m *poolMember, conn *APNSConnection, recycling *recycleTracker) *APNSConnection {
+	retry := time.Duration(p.config.ReconnectInterval) * time.Millisecond
+	p.lock.Lock()
+	if p.recycling {
+		p.lock.Unlock()
+		recycling.postpone(retry)
+		return conn
+	}
+	p.recycling = true
+	p.lock.Unlock()
+	defer func() {
+		p.lock.Lock()
+		p.recycling = false
+		p.lock.Unlock()
+	}()
+
+	logger := configLogger(p.config.ConnectionConfig.Logger)
+	replacement, err := p.config.dial(p.config.ConnectionConfig)
+	if err != nil {
+		logger.Warn("apns: failed to open replacement connection", "error", err.Error())
+		recycling.postpone(retry)
+		return conn
+	}
+	logger.Info("apns: recycling connection", "notifications", recycling.sent, "age", time.Since(recycling.opened))
+	p.lock.Lock()
+	m.conn = replacement
+	p.lock.Unlock()
+	if connectionClose := conn.shutdownForClose(); connectionClose != nil {
+		//apple rejected a payload as it shut down, or didn't close in time
+		p.passOn(connectionClose)
+	}
+	return replacement
+}
@@ -0,0 +1,113 @@
+package apns
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReconnectShouldRecycleAfterMaxNotifications(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	config := app.Pool.ConnectionConfig
+	config.SendSettleWindow = 50
+	config.DrainLinger = -1
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig:              config,
+		MaxNotificationsPerConnection: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+	expectPausedPayloads(t, server, 0, 6)
+	for i, notification := range server.Received() {
+		if expected := i/3 + 1; notification.Connection != expected {
+			t.Error(fmt.Sprintf("Expected notification %v on connection %v but got %v", i, expected, notification.Connection))
+		}
+	}
+
+	conn.Close()
+	for connectionClose := range conn.CloseChannel {
+		if connectionClose.UnsentPayloads.Len() != 0 {
+			t.Error(fmt.Sprintf("Expected nothing unsent but got %+v", connectionClose))
+		}
+	}
+	recycled := 0
+	for event := range conn.StateEvents() {
+		if event.State == StateRecycling {
+			recycled++
+			if event.Notifications != 3 || event.Age <= 0 {
+				t.Error(fmt.Sprintf("Expected 3 notifications sent before recycling but got %+v", event))
+			}
+		}
+	}
+	if recycled != 2 {
+		t.Error(fmt.Sprintf("Expected 2 recycles but got %v", recycled))
+	}
+}
+
+func TestReconnectShouldRecycleAfterMaxAge(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	config := app.Pool.ConnectionConfig
+	config.SendSettleWindow = 50
+	config.DrainLinger = -1
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig: config,
+		MaxConnectionAge: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SendChannel <- groupTestPayload(0)
+	expectPausedPayloads(t, server, 0, 0)
+	waitForState(t, conn, StateRecycling)
+	waitForState(t, conn, StateConnected)
+	conn.SendChannel <- groupTestPayload(1)
+	expectPausedPayloads(t, server, 0, 1)
+	if received := server.Received(); received[1].Connection == received[0].Connection {
+		t.Error(fmt.Sprintf("Expected a new connection once the first was too old but got %v", received[1].Connection))
+	}
+	conn.Close()
+	for range conn.CloseChannel {
+	}
+}
+
+func TestPoolShouldRecycleOneConnectionAtATime(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	config := app.Pool.ConnectionConfig
+	config.SendSettleWindow = 50
+	config.DrainLinger = -1
+	app.Pool.Size = 2
+	app.Pool.ReconnectInterval = 1
+	app.Pool.MaxNotificationsPerConnection = 2
+	pool, err := NewAPNSConnectionPool(app.Pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case pool.SendChannel <- groupTestPayload(i):
+		case <-time.After(5 * time.Second):
+			t.Fatal(fmt.Sprintf("Expected payload %v to be taken", i))
+		}
+	}
+	if _, err := server.WaitForNotifications(10, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	//a connection due while the other is replaced carries on meanwhile
+	perConnection := map[int]int{}
+	for _, notification := range server.Received() {
+		perConnection[notification.Connection]++
+	}
+	if len(perConnection) < 3 {
+		t.Error(fmt.Sprintf("Expected the connections to be recycled but got %v", perConnection))
+	}
+
+	pool.Close()
+	if connectionClose := finalPoolClose(t, pool); connectionClose.UnsentPayloads.Len() != 0 {
+		t.Error(fmt.Sprintf("Expected nothing unsent but got %v", connectionClose.UnsentPayloads.Len()))
+	}
+}
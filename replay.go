@@ -0,0 +1,301 @@
+package apns
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"time"
+)
+
+// Result of replaying a recording
+type ReplayReport struct {
+	// Number of payloads fed to the replayed connection
+	Enqueued int
+	// How the recorded connection closed, nil if the recording has no close event
+	Recorded *CloseDisposition
+	// How the replayed connection closed
+	Replayed *CloseDisposition
+	// Human readable differences between the recorded and replayed outcomes,
+	// empty if the replay reproduced the recording
+	Divergences []string
+}
+
+// Replay a recording made by a Recorder against a scripted gateway and
+// report whether the connection reaches the same outcome.
+//
+// The recorded payloads are fed to a fresh connection built from config
+// (so in flight buffer size, payload size, etc. should match production),
+// and the recorded gateway response is delivered once every payload the
+// original connection accepted before closing has been fed in. The replay
+// is driven by the order of events rather than their timestamps, so framing
+// and rate limiting delays are not reproduced. Rate limiting and recording
+// are turned off for the replayed connection.
+//
+// A recording shared by several connections (e.g. a pool's) is replayed
+// for the first connection in it, see ReplayRecordingConnection for the
+// others.
+func ReplayRecording(r io.Reader, config APNSConfig) (*ReplayReport, error) {
+	return ReplayRecordingConnection(r, 0, config)
+}
+
+// Replay the events of one connection in a recording, numbered by
+// RecordingEvent.Connection, as ReplayRecording does
+// A connection of 0 replays the first connection in the recording
+func ReplayRecordingConnection(r io.Reader, connection int, config APNSConfig) (*ReplayReport, error) {
+	recorded, err := readRecording(r)
+	if err != nil {
+		return nil, err
+	}
+	if connection == 0 && len(recorded) > 0 {
+		connection = recorded[0].Connection
+	}
+	events := []*RecordingEvent{}
+	for _, event := range recorded {
+		//the truncation stops every connection's events
+		if event.Connection == connection || event.Type == RecordingEventTruncated {
+			events = append(events, event)
+		}
+	}
+	if len(events) == 0 {
+		return nil, errors.New(fmt.Sprintf("Recording has no events for connection %v", connection))
+	}
+
+	config.Recorder = nil
+	config.MaxNotificationsPerSecond = 0
+	config.clock = realClock{}
+	if config.InFlightPayloadBufferSize == 0 {
+		config.InFlightPayloadBufferSize = 10000
+	}
+	if config.MaxOutboundTCPFrameSize == 0 {
+		config.MaxOutboundTCPFrameSize = TCP_FRAME_MAX
+	}
+	if config.FramingTimeout == 0 {
+		config.FramingTimeout = 10
+	}
+	if config.MaxPayloadSize == 0 {
+		config.MaxPayloadSize = MaxPayloadSizeBinary
+	}
+
+	socket := newReplayConn()
+	c := socketAPNSConnection(socket, &config)
+	report := &ReplayReport{}
+	ids := make(map[*Payload]uint32)
+
+	var response []byte
+	var readError string
+	disconnected := false
+	var connClose *ConnectionClose
+
+	for i := 0; i < len(events); i++ {
+		event := events[i]
+		switch event.Type {
+		case RecordingEventEnqueue:
+			if event.Payload == nil {
+				return nil, fmt.Errorf("Recording event %v is an enqueue without a payload", i)
+			}
+			if connClose != nil {
+				report.Divergences = append(report.Divergences,
+					fmt.Sprintf("payload %v was enqueued after the replayed connection closed", event.ID))
+				continue
+			}
+			if event.Group != nil {
+				if i+event.GroupSize > len(events) {
+					return nil, fmt.Errorf("Recording event %v is a group of %v members but the recording ends first", i, event.GroupSize)
+				}
+				group := c.NewSendGroup()
+				for _, member := range events[i : i+event.GroupSize] {
+					payload := member.Payload.Payload()
+					ids[payload] = member.ID
+					group.Add(payload)
+				}
+				i += event.GroupSize - 1
+				report.Enqueued += event.GroupSize
+				if err := group.Commit(); err != nil {
+					report.Divergences = append(report.Divergences,
+						fmt.Sprintf("group starting at payload %v was not sent: %v", event.ID, err))
+				}
+				continue
+			}
+			payload := event.Payload.Payload()
+			ids[payload] = event.ID
+			report.Enqueued++
+			select {
+			case c.SendChannel <- payload:
+			case connClose = <-c.CloseChannel:
+				report.Divergences = append(report.Divergences,
+					fmt.Sprintf("replayed connection closed before payload %v was enqueued", event.ID))
+			}
+		case RecordingEventResponse:
+			response = event.Response
+		case RecordingEventReadError:
+			readError = event.Error
+		case RecordingEventDisconnect:
+			disconnected = true
+		case RecordingEventClose:
+			report.Recorded = event.Disposition
+		case RecordingEventTruncated:
+			return nil, fmt.Errorf("Recording was truncated after %v events and cannot be replayed", i)
+		default:
+			return nil, fmt.Errorf("Recording event %v has unknown type %q", i, event.Type)
+		}
+	}
+
+	//release whatever closed the original connection
+	if connClose == nil {
+		switch {
+		case response != nil:
+			socket.respond(response, nil)
+		case disconnected:
+			c.Disconnect()
+		case readError != "":
+			socket.respond(nil, errors.New(readError))
+		default:
+			//the recording ended with the connection still open
+			c.Disconnect()
+		}
+		select {
+		case connClose = <-c.CloseChannel:
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("Replayed connection did not close")
+		}
+	}
+	c.noFlushDisconnect()
+
+	report.Replayed = replayDisposition(connClose, ids)
+	if report.Recorded == nil {
+		report.Divergences = append(report.Divergences, "recording has no close event to compare against")
+	} else {
+		report.Divergences = append(report.Divergences, compareDispositions(report.Recorded, report.Replayed)...)
+	}
+	return report, nil
+}
+
+// Decode every event of a newline delimited json recording
+func readRecording(r io.Reader) ([]*RecordingEvent, error) {
+	var events []*RecordingEvent
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for {
+		event := &RecordingEvent{}
+		err := decoder.Decode(event)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid recording event %v: %v", len(events), err)
+		}
+		events = append(events, event)
+	}
+}
+
+// Describe a connection close in terms of the recorded payload ids
+func replayDisposition(connClose *ConnectionClose, ids map[*Payload]uint32) *CloseDisposition {
+	disposition := &CloseDisposition{
+		BufferOverflow: connClose.UnsentPayloadBufferOverflow,
+	}
+	if connClose.Error != nil {
+		disposition.ErrorCode = connClose.Error.ErrorCode
+	}
+	if connClose.ErrorPayload != nil {
+		id := ids[connClose.ErrorPayload]
+		disposition.ErrorPayloadID = &id
+	}
+	for e := connClose.UnsentPayloads.Front(); e != nil; e = e.Next() {
+		disposition.UnsentIDs = append(disposition.UnsentIDs, ids[e.Value.(*Payload)])
+	}
+	return disposition
+}
+
+func compareDispositions(recorded, replayed *CloseDisposition) []string {
+	var divergences []string
+	if recorded.ErrorCode != replayed.ErrorCode {
+		divergences = append(divergences, fmt.Sprintf("error code: recorded %v, replayed %v",
+			recorded.ErrorCode, replayed.ErrorCode))
+	}
+	if !reflect.DeepEqual(recorded.ErrorPayloadID, replayed.ErrorPayloadID) {
+		divergences = append(divergences, fmt.Sprintf("error payload: recorded %v, replayed %v",
+			formatPayloadID(recorded.ErrorPayloadID), formatPayloadID(replayed.ErrorPayloadID)))
+	}
+	if len(recorded.UnsentIDs) != 0 || len(replayed.UnsentIDs) != 0 {
+		if !reflect.DeepEqual(recorded.UnsentIDs, replayed.UnsentIDs) {
+			divergences = append(divergences, fmt.Sprintf("unsent payloads: recorded %v, replayed %v",
+				recorded.UnsentIDs, replayed.UnsentIDs))
+		}
+	}
+	if recorded.BufferOverflow != replayed.BufferOverflow {
+		divergences = append(divergences, fmt.Sprintf("buffer overflow: recorded %v, replayed %v",
+			recorded.BufferOverflow, replayed.BufferOverflow))
+	}
+	return divergences
+}
+
+func formatPayloadID(id *uint32) string {
+	if id == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%v", *id)
+}
+
+type replayRead struct {
+	data []byte
+	err  error
+}
+
+// Scripted gateway socket, discards writes and returns whatever
+// the replay hands to respond from Read
+type replayConn struct {
+	reads chan replayRead
+}
+
+func newReplayConn() *replayConn {
+	return &replayConn{
+		reads: make(chan replayRead, 2),
+	}
+}
+
+func (conn *replayConn) respond(data []byte, err error) {
+	select {
+	case conn.reads <- replayRead{data: data, err: err}:
+	default:
+	}
+}
+
+func (conn *replayConn) Read(b []byte) (int, error) {
+	read := <-conn.reads
+	if read.err != nil {
+		return 0, read.err
+	}
+	return copy(b, read.data), nil
+}
+
+func (conn *replayConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (conn *replayConn) Close() error {
+	conn.respond(nil, errors.New("Socket Closed"))
+	return nil
+}
+
+func (conn *replayConn) LocalAddr() net.Addr {
+	return nil
+}
+
+func (conn *replayConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (conn *replayConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn *replayConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn *replayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,149 @@
+package apns
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayShouldReproduceIncident(t *testing.T) {
+	recording := recordIncident(t, 5, 2, RecorderOptions{})
+
+	report, err := ReplayRecording(recording, APNSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Divergences) != 0 {
+		t.Errorf("Expected no divergences but got %v", report.Divergences)
+	}
+	if report.Enqueued != 5 {
+		t.Errorf("Expected 5 payloads enqueued but got %v", report.Enqueued)
+	}
+	if report.Replayed.ErrorPayloadID == nil || *report.Replayed.ErrorPayloadID != 2 {
+		t.Errorf("Unexpected replayed disposition %+v", report.Replayed)
+	}
+}
+
+func TestReplayShouldReproduceRedactedIncident(t *testing.T) {
+	recording := recordIncident(t, 5, 3, RecorderOptions{RedactTokens: true, RedactContent: true})
+
+	report, err := ReplayRecording(recording, APNSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Divergences) != 0 {
+		t.Errorf("Expected no divergences but got %v", report.Divergences)
+	}
+}
+
+func TestReplayShouldReportDivergence(t *testing.T) {
+	recording := recordIncident(t, 5, 2, RecorderOptions{})
+	tampered := strings.Replace(recording.String(), `"unsent_ids":[3,4]`, `"unsent_ids":[4]`, 1)
+
+	report, err := ReplayRecording(strings.NewReader(tampered), APNSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Divergences) != 1 || !strings.HasPrefix(report.Divergences[0], "unsent payloads") {
+		t.Errorf("Expected unsent payloads divergence but got %v", report.Divergences)
+	}
+}
+
+func TestReplayShouldUseConfigBufferSize(t *testing.T) {
+	recording := recordIncident(t, 5, 1, RecorderOptions{})
+
+	//a smaller in flight buffer loses the error payload
+	report, err := ReplayRecording(recording, APNSConfig{InFlightPayloadBufferSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Divergences) == 0 {
+		t.Error("Expected divergences with a smaller in flight buffer")
+	}
+	if !report.Replayed.BufferOverflow {
+		t.Errorf("Expected replayed buffer overflow but got %+v", report.Replayed)
+	}
+}
+
+func TestReplayShouldReproduceDisconnect(t *testing.T) {
+	recording := new(bytes.Buffer)
+	socket := NewMockConnRejectId(false, 0)
+	c := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            10,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		Recorder:                  NewRecorder(recording, RecorderOptions{}),
+	})
+	for i := 0; i < 3; i++ {
+		c.SendChannel <- groupTestPayload(i)
+	}
+	c.Disconnect()
+	select {
+	case <-c.CloseChannel:
+	case <-time.After(time.Second):
+		t.Fatal("Connection never closed")
+	}
+	<-c.sendListenerDone
+
+	report, err := ReplayRecording(recording, APNSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Divergences) != 0 {
+		t.Errorf("Expected no divergences but got %v", report.Divergences)
+	}
+	if report.Replayed.ErrorCode != 10 {
+		t.Errorf("Expected error code 10 but got %v", report.Replayed.ErrorCode)
+	}
+}
+
+func TestReplayShouldReproduceSendGroup(t *testing.T) {
+	recording := new(bytes.Buffer)
+	socket := NewMockConnRejectId(true, 2)
+	c := socketAPNSConnection(socket, &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            10,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+		Recorder:                  NewRecorder(recording, RecorderOptions{}),
+	})
+	c.SendChannel <- groupTestPayload(0)
+	group := c.NewSendGroup()
+	for i := 1; i < 4; i++ {
+		group.Add(groupTestPayload(i))
+	}
+	if err := group.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	c.SendChannel <- groupTestPayload(4)
+	select {
+	case <-c.CloseChannel:
+	case <-time.After(time.Second):
+		t.Fatal("Connection never closed")
+	}
+	<-c.sendListenerDone
+	c.noFlushDisconnect()
+
+	report, err := ReplayRecording(recording, APNSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Divergences) != 0 {
+		t.Errorf("Expected no divergences but got %v", report.Divergences)
+	}
+	//cancelled group member 3 is not reported unsent
+	if len(report.Replayed.UnsentIDs) != 1 || report.Replayed.UnsentIDs[0] != 4 {
+		t.Errorf("Expected unsent ids [4] but got %v", report.Replayed.UnsentIDs)
+	}
+}
+
+func TestReplayShouldRejectTruncatedRecording(t *testing.T) {
+	recording := recordIncident(t, 5, 2, RecorderOptions{MaxEvents: 2})
+
+	_, err := ReplayRecording(recording, APNSConfig{})
+	if err == nil {
+		t.Error("Expected error replaying a truncated recording")
+	}
+}
@@ -0,0 +1,262 @@
+package apns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A payload passed to APNSConnection.Send, waiting for its outcome
+type syncSend struct {
+	conn    *APNSConnection
+	payload *Payload
+	// closed once the payload has been written to the socket, at writtenAt
+	written   chan bool
+	writtenAt time.Time
+	// receives the outcome if the connection closes first
+	outcome chan *syncSendOutcome
+	// reports the payload to the StatsCollector as acknowledged once, by
+	// whichever of the settle window and the close comes first
+	acknowledgeOnce *sync.Once
+	// the payload's span, nil without a Tracer, ended by wait
+	trace *sendTrace
+}
+
+type syncSendOutcome struct {
+	result *Result
+	err    error
+}
+
+// Send a payload and wait for apple's verdict on it
+// The binary protocol only reports rejections, so once the payload is
+// written Send waits SendSettleWindow milliseconds for apple to reject it
+// before reporting it accepted. It's reported accepted sooner if apple
+// rejects a payload sent after it, as apple reads them in order
+// A rejection is returned as a Result with the AppleError, its name as
+// the Reason and a StatusCode like HTTP/2's (400, or 500 for processing
+// errors and 503 for shutdowns). An error is returned if ctx is done, the
+// payload is invalid or filtered (see APNSConfig.TokenFilter), or the
+// connection closes before apple reads it
+// (the payload may be resent)
+// Safe to call from many goroutines, and alongside SendChannel
+func (c *APNSConnection) Send(ctx context.Context, payload *Payload) (*Result, error) {
+	send, err := c.startSend(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+	return send.wait(ctx)
+}
+
+// Send every payload, as Send does, and wait for all of their verdicts
+// The payloads are handed to the connection in order without waiting for
+// each other, so the settle windows overlap. Results are in the same
+// order as payloads, with Err set for any payload that couldn't be sent
+// (invalid, the connection closed, or ctx done) without affecting the
+// rest. Returns once every payload is resolved, with ctx.Err() if ctx was
+// done first
+func (c *APNSConnection) SendAll(ctx context.Context, payloads []*Payload) ([]Result, error) {
+	return sendAll(ctx, payloads, BatchOptions{}, c.startSend)
+}
+
+// Send every payload as SendAll does, with options, e.g. to drop
+// duplicates (see BatchOptions)
+func (c *APNSConnection) SendAllWithOptions(ctx context.Context, payloads []*Payload, options BatchOptions) ([]Result, error) {
+	return sendAll(ctx, payloads, options, c.startSend)
+}
+
+// Hand a payload to the connection for Send
+func (c *APNSConnection) startSend(ctx context.Context, payload *Payload) (send *syncSend, err error) {
+	ctx, trace := startTrace(c.config.Tracer, c.config.clock, ctx, payload)
+	defer func() {
+		if err != nil {
+			trace.finish(nil, err)
+			c.hooks.afterSend(payload, nil, err, c.logger)
+		}
+	}()
+	//checked here as a payload failing to frame closes the connection
+	if err := payload.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := payload.binaryToken(); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid token %q, should be 64 hex characters", payload.Token))
+	}
+	if err := filterToken(c.config.TokenFilter, payload.Token); err != nil {
+		return nil, c.tokenFiltered(payload, err)
+	}
+	if err := c.dedupe.check(payload); err != nil {
+		return nil, err
+	}
+	if _, err := payload.Marshal(c.config.MaxPayloadSize); err != nil {
+		return nil, err
+	}
+
+	send = &syncSend{
+		conn:            c,
+		payload:         payload,
+		written:         make(chan bool),
+		outcome:         make(chan *syncSendOutcome, 1),
+		acknowledgeOnce: new(sync.Once),
+		trace:           trace,
+	}
+	select {
+	case c.syncSendChannel <- send:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.stopChannel:
+		return nil, errors.New("Cannot send payload, connection is shutting down")
+	case <-c.sendListenerDone:
+		return nil, errors.New("Cannot send payload, connection is closed")
+	}
+	return send, nil
+}
+
+// Wait for the outcome of a payload handed to the connection
+func (s *syncSend) wait(ctx context.Context) (result *Result, err error) {
+	defer func() {
+		s.trace.finish(result, err)
+		s.conn.hooks.afterSend(s.payload, result, err, s.conn.logger)
+	}()
+	//nothing is left waiting on the connection if given up on, the
+	//outcome is buffered and dropped
+	written := s.written
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-written:
+			written = nil
+			//the window runs from the write, not from when this noticed it
+			settleWindow := time.Duration(s.conn.config.SendSettleWindow) * time.Millisecond
+			timer := time.NewTimer(settleWindow - time.Since(s.writtenAt))
+			defer timer.Stop()
+			settled = timer.C
+		case <-settled:
+			s.acknowledge()
+			return s.conn.acceptedResult(s.payload), nil
+		case outcome := <-s.outcome:
+			return outcome.result, outcome.err
+		case <-s.conn.sendListenerDone:
+			select {
+			case outcome := <-s.outcome:
+				return outcome.result, outcome.err
+			default:
+				return nil, errors.New("Payload was not sent before the connection closed")
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Report the outcome of a payload still in flight when the connection
+// closed with appleError
+// Called on the send go-routine
+func (s *syncSend) resolve(idPayloadObj *idPayload, errorIdPayload *idPayload, appleError *AppleError) {
+	outcome := &syncSendOutcome{}
+	switch {
+	case idPayloadObj == errorIdPayload && appleError.ErrorCode != 10:
+		outcome.result = s.conn.rejectedResult(s.payload, appleError)
+	case idPayloadObj.unsent || idPayloadObj == errorIdPayload:
+		//a shutdown or dropped socket doesn't say whether the payload it
+		//reports was read
+		outcome.err = errors.New(fmt.Sprintf("Payload was not sent before the connection closed: %v", appleError))
+	default:
+		//apple read it before the payload it rejected
+		s.acknowledge()
+		outcome.result = s.conn.acceptedResult(s.payload)
+	}
+	select {
+	case s.outcome <- outcome:
+	default:
+	}
+}
+
+// Report the payload to the StatsCollector as acknowledged, once, and
+// ack it if stored
+func (s *syncSend) acknowledge() {
+	s.acknowledgeOnce.Do(func() {
+		s.conn.config.StatsCollector.OnAcknowledged(s.payload)
+		s.conn.journal.ack(s.payload)
+		s.conn.dedupe.accept(s.payload)
+	})
+}
+
+// Report a payload that couldn't be framed
+// Called on the send go-routine
+func (s *syncSend) fail(err error) {
+	select {
+	case s.outcome <- &syncSendOutcome{err: err}:
+	default:
+	}
+}
+
+// Start every send in order so they're written in order, then wait for
+// them together
+func sendAll(ctx context.Context, payloads []*Payload, options BatchOptions,
+	start func(ctx context.Context, payload *Payload) (*syncSend, error)) ([]Result, error) {
+	results := make([]Result, len(payloads))
+	sends := make([]*syncSend, len(payloads))
+	var originals []*Payload
+	if options.Dedupe {
+		originals = batchDuplicates(payloads)
+	}
+	for i, payload := range payloads {
+		results[i].Payload = payload
+		if originals != nil && originals[i] != nil {
+			results[i].Err = &DuplicateError{Payload: payload, Original: originals[i]}
+			continue
+		}
+		sends[i], results[i].Err = start(ctx, payload)
+	}
+
+	wg := new(sync.WaitGroup)
+	for i, send := range sends {
+		if send == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, send *syncSend) {
+			defer wg.Done()
+			result, err := send.wait(ctx)
+			if err != nil {
+				results[i].Err = err
+				return
+			}
+			results[i] = *result
+		}(i, send)
+	}
+	wg.Wait()
+	return results, ctx.Err()
+}
+
+func rejectedResult(payload *Payload, appleError *AppleError) *Result {
+	return &Result{
+		Payload:    payload,
+		StatusCode: binaryErrorStatus(appleError.ErrorCode),
+		ApnsID:     payload.ApnsId,
+		Reason:     appleError.Reason(),
+		AppleError: appleError,
+	}
+}
+
+func acceptedResult(payload *Payload) *Result {
+	return &Result{
+		Payload:    payload,
+		StatusCode: http.StatusOK,
+		ApnsID:     payload.ApnsId,
+	}
+}
+
+// The HTTP/2 status closest to a binary protocol error code
+func binaryErrorStatus(errorCode uint8) int {
+	switch errorCode {
+	case 1, 255:
+		return http.StatusInternalServerError
+	case 10:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
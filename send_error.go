@@ -0,0 +1,138 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// How a payload failed, see SendError
+type FailureKind int
+
+const (
+	// The payload couldn't be framed, its token isn't 64 hex characters
+	// or its json couldn't be marshaled within MaxPayloadSize
+	FailureInvalidPayload FailureKind = iota
+	// Apple rejected the payload, with Reason its reason and Err the
+	// *AppleError from APNSConnection
+	FailureRejected
+	// The connection closed before apple read the payload, so it can be
+	// resent
+	FailureUnsent
+	// The payload was dropped by the QueueFullPolicy, Err is the
+	// *QueueFullError
+	FailureQueueFull
+	// A BeforeSend hook returned an error (Err) or panicked, see
+	// APNSConnection.RegisterBeforeSend
+	FailureBlocked
+	// The config's TokenFilter refused the payload's token, Err is the
+	// *TokenFilteredError
+	FailureFiltered
+)
+
+var failureKindNames = map[FailureKind]string{
+	FailureInvalidPayload: "invalid payload",
+	FailureRejected:       "rejected",
+	FailureUnsent:         "unsent",
+	FailureQueueFull:      "queue full",
+	FailureBlocked:        "blocked",
+	FailureFiltered:       "filtered",
+}
+
+func (k FailureKind) String() string {
+	if name, ok := failureKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("FailureKind(%d)", int(k))
+}
+
+// A payload the connection failed to deliver, always holding the exact
+// Payload given to it so its Token and ExtraData can be read back
+// Reported by ConnectionClose.SendErrors, Enqueue and
+// APNSConfig.SendErrorCallback
+type SendError struct {
+	// The payload that failed
+	Payload *Payload
+	// How it failed
+	Kind FailureKind
+	// Apple's reason for rejecting it, only set for FailureRejected
+	Reason ErrorReason
+	// When it failed, the close for those reported by the ConnectionClose
+	Time time.Time
+	// The underlying error
+	Err error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("%v %v: %v", e.Payload, e.Kind, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Every payload the close reports as failed, in the order they were
+// sent: the ErrorPayload, as rejected unless the socket dropped, then
+// the UnsentPayloads
+func (c *ConnectionClose) SendErrors() []*SendError {
+	sendErrors := []*SendError{}
+	unsentErr := errors.New("Payload was not sent before the connection closed")
+	if c.Error != nil {
+		unsentErr = errors.New(fmt.Sprintf("Payload was not sent before the connection closed: %v", c.Error))
+	} else if c.CircuitOpen != nil {
+		unsentErr = c.CircuitOpen
+	}
+	if c.ErrorPayload != nil {
+		sendError := &SendError{Payload: c.ErrorPayload, Kind: FailureUnsent, Time: c.Time, Err: unsentErr}
+		//the socket closing doesn't say whether apple read it
+		if c.Error != nil && c.Error.ErrorCode != 10 {
+			sendError.Kind, sendError.Reason, sendError.Err = FailureRejected, c.Error.Reason(), c.Error
+		}
+		sendErrors = append(sendErrors, sendError)
+	}
+	if c.UnsentPayloads != nil {
+		for e := c.UnsentPayloads.Front(); e != nil; e = e.Next() {
+			sendErrors = append(sendErrors, &SendError{
+				Payload: e.Value.(*Payload),
+				Kind:    FailureUnsent,
+				Time:    c.Time,
+				Err:     unsentErr,
+			})
+		}
+	}
+	return sendErrors
+}
+
+// Report a payload that failed outside of a close to SendErrorCallback
+func (c *APNSConnection) sendFailed(payload *Payload, kind FailureKind, err error) *SendError {
+	sendError := &SendError{
+		Payload: payload,
+		Kind:    kind,
+		Time:    c.config.clock.Now(),
+		Err:     err,
+	}
+	c.config.StatsCollector.OnFailed(sendError)
+	if c.config.SendErrorCallback != nil {
+		c.config.SendErrorCallback(sendError)
+	}
+	return sendError
+}
+
+// Drop a payload that couldn't be framed, or a BeforeSend hook blocked,
+// rather than close the connection over it, reporting it instead of
+// handing it back as resending won't help
+// Called on the send go-routine
+func (c *APNSConnection) payloadFailed(idPayloadObj *idPayload, kind FailureKind, err error) {
+	idPayloadObj.failed = true
+	atomic.AddInt64(&c.pending, -1)
+	sendError := c.sendFailed(idPayloadObj.Payload, kind, err)
+	c.deadLetter(idPayloadObj.Payload, sendError)
+	c.journal.ack(idPayloadObj.Payload)
+	idPayloadObj.trace.finish(nil, sendError)
+	if idPayloadObj.waiter != nil {
+		idPayloadObj.waiter.fail(sendError)
+	} else {
+		c.hooks.afterSend(idPayloadObj.Payload, nil, sendError, c.logger)
+	}
+}
@@ -0,0 +1,157 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type sendErrorTestData struct {
+	UserID int
+}
+
+func sendErrorTestPayload(i int) *Payload {
+	payload := groupTestPayload(i)
+	payload.ExtraData = &sendErrorTestData{UserID: i}
+	return payload
+}
+
+func expectSendError(t *testing.T, sendError *SendError, payload *Payload, kind FailureKind) {
+	if sendError.Payload != payload || sendError.Kind != kind || sendError.Time.IsZero() {
+		t.Error(fmt.Sprintf("Expected %v for %v but got %v", kind, payload, sendError))
+		return
+	}
+	if data, ok := sendError.Payload.ExtraData.(*sendErrorTestData); !ok || data != payload.ExtraData {
+		t.Error(fmt.Sprintf("Expected the ExtraData to survive but got %v", sendError.Payload.ExtraData))
+	}
+}
+
+func TestSendErrorShouldReportInvalidPayloads(t *testing.T) {
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	failed := make(chan *SendError, 1)
+	config.SendErrorCallback = func(err *SendError) {
+		failed <- err
+	}
+	conn := socketAPNSConnection(socket, config)
+
+	invalid := sendErrorTestPayload(0)
+	invalid.Token = "not a token"
+	conn.SendChannel <- invalid
+	sendError := <-failed
+	expectSendError(t, sendError, invalid, FailureInvalidPayload)
+
+	//the connection carries on without it
+	conn.SendChannel <- sendErrorTestPayload(1)
+	waitForSocketSends(t, socket, 1)
+	conn.Disconnect()
+	connectionClose := <-conn.CloseChannel
+	for _, sendError := range connectionClose.SendErrors() {
+		if sendError.Payload == invalid {
+			t.Error(fmt.Sprintf("Expected the invalid payload not to be handed back but got %v", connectionClose))
+		}
+	}
+}
+
+func TestSendErrorShouldReportPayloadsFailingValidation(t *testing.T) {
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	failed := make(chan *SendError, 1)
+	config.SendErrorCallback = func(err *SendError) {
+		failed <- err
+	}
+	conn := socketAPNSConnection(socket, config)
+
+	invalid := sendErrorTestPayload(0)
+	invalid.Priority = 7
+	conn.SendChannel <- invalid
+	sendError := <-failed
+	expectSendError(t, sendError, invalid, FailureInvalidPayload)
+	if !strings.Contains(sendError.Error(), "Invalid priority") {
+		t.Error(fmt.Sprintf("Expected the validation error but got %v", sendError))
+	}
+
+	conn.SendChannel <- sendErrorTestPayload(1)
+	waitForSocketSends(t, socket, 1)
+	conn.Disconnect()
+	<-conn.CloseChannel
+	if alerts := socket.alerts(2); alerts[0] != 0 {
+		t.Error(fmt.Sprintf("Expected the invalid payload not to be written but got %v", alerts))
+	}
+}
+
+func TestSendErrorShouldReportRejections(t *testing.T) {
+	socket := newPoolTestSocket()
+	conn := socketAPNSConnection(socket, shutdownTestConfig())
+	payloads := []*Payload{sendErrorTestPayload(0), sendErrorTestPayload(1), sendErrorTestPayload(2)}
+	for _, payload := range payloads {
+		conn.SendChannel <- payload
+	}
+	waitForSocketSends(t, socket, 3)
+	socket.reject(8, 1)
+
+	connectionClose := <-conn.CloseChannel
+	sendErrors := connectionClose.SendErrors()
+	if len(sendErrors) != 2 {
+		t.Fatal(fmt.Sprintf("Expected the rejected and unsent payloads but got %v", sendErrors))
+	}
+	expectSendError(t, sendErrors[0], payloads[1], FailureRejected)
+	appleError := &AppleError{}
+	if !errors.As(sendErrors[0], &appleError) || appleError.ErrorCode != 8 || sendErrors[0].Reason != BinaryReasonInvalidToken {
+		t.Error(fmt.Sprintf("Expected apple's error but got %v", sendErrors[0].Err))
+	}
+	expectSendError(t, sendErrors[1], payloads[2], FailureUnsent)
+	if sendErrors[1].Time != connectionClose.Time {
+		t.Error(fmt.Sprintf("Expected the close's time but got %v", sendErrors[1].Time))
+	}
+}
+
+func TestSendErrorShouldReportADroppedConnection(t *testing.T) {
+	socket := newPoolTestSocket()
+	conn := socketAPNSConnection(socket, shutdownTestConfig())
+	payloads := []*Payload{sendErrorTestPayload(0), sendErrorTestPayload(1)}
+	for _, payload := range payloads {
+		conn.SendChannel <- payload
+	}
+	waitForSocketSends(t, socket, 2)
+	socket.Close()
+
+	sendErrors := (<-conn.CloseChannel).SendErrors()
+	if len(sendErrors) != 2 {
+		t.Fatal(fmt.Sprintf("Expected both payloads to be unsent but got %v", sendErrors))
+	}
+	for i, sendError := range sendErrors {
+		expectSendError(t, sendError, payloads[i], FailureUnsent)
+		if !strings.Contains(sendError.Error(), "not sent before the connection closed") {
+			t.Error(fmt.Sprintf("Expected the close in the error but got %v", sendError))
+		}
+	}
+}
+
+func TestSendErrorShouldReportQueueOverflow(t *testing.T) {
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	config.SendQueueSize = 1
+	config.QueueFullPolicy = QueueDropNewest
+	//the second payload holds up the connection waiting for the rate limiter
+	config.MaxNotificationsPerSecond = 0.001
+	conn := socketAPNSConnection(socket, config)
+	for i := 0; i < 2; i++ {
+		conn.SendChannel <- sendErrorTestPayload(i)
+	}
+	if err := conn.Enqueue(sendErrorTestPayload(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := sendErrorTestPayload(3)
+	err := conn.Enqueue(dropped)
+	sendError := &SendError{}
+	if !errors.As(err, &sendError) {
+		t.Fatal(fmt.Sprintf("Expected a SendError but got %v", err))
+	}
+	expectSendError(t, sendError, dropped, FailureQueueFull)
+
+	conn.Disconnect()
+	<-conn.CloseChannel
+}
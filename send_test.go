@@ -0,0 +1,221 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sendTestConnection(settleWindow int) (*APNSConnection, *poolTestSocket) {
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	config.SendSettleWindow = settleWindow
+	return socketAPNSConnection(socket, config), socket
+}
+
+func TestSendShouldAcceptAfterSettleWindow(t *testing.T) {
+	conn, _ := sendTestConnection(20)
+	payload := groupTestPayload(0)
+	payload.ApnsId = "ec1bf194-b3b2-4f1c-9e26-c0a43b2b2d4a"
+
+	result, err := conn.Send(context.Background(), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Accepted() || result.Payload != payload || result.ApnsID != payload.ApnsId {
+		t.Error(fmt.Sprintf("Expected the payload to be accepted but got %v", result))
+	}
+
+	conn.Disconnect()
+	<-conn.CloseChannel
+}
+
+func TestSendShouldValidatePayload(t *testing.T) {
+	conn, socket := sendTestConnection(20)
+	payload := groupTestPayload(0)
+	payload.PushType = PushTypeBackground
+
+	if _, err := conn.Send(context.Background(), payload); err == nil || !strings.Contains(err.Error(), "Background pushes can't have an alert") {
+		t.Error(fmt.Sprintf("Expected a background push with an alert to fail but got %v", err))
+	}
+	conn.Disconnect()
+	<-conn.CloseChannel
+	if sent := socket.sent(); sent != 0 {
+		t.Error(fmt.Sprintf("Expected nothing written but %v payloads were", sent))
+	}
+}
+
+func TestSendShouldReportRejection(t *testing.T) {
+	conn, socket := sendTestConnection(5000)
+	go func() {
+		waitForSocketSends(t, socket, 1)
+		socket.reject(8, 0)
+	}()
+
+	result, err := conn.Send(context.Background(), groupTestPayload(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Accepted() || result.StatusCode != http.StatusBadRequest || result.Reason != "INVALID_TOKEN" ||
+		result.AppleError == nil || result.AppleError.ErrorCode != 8 {
+		t.Error(fmt.Sprintf("Expected the payload to be rejected but got %v", result))
+	}
+	<-conn.CloseChannel
+}
+
+func TestSendShouldResolveConcurrentSends(t *testing.T) {
+	conn, socket := sendTestConnection(5000)
+	type outcome struct {
+		result *Result
+		err    error
+	}
+	outcomes := make(chan outcome)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			result, err := conn.Send(context.Background(), groupTestPayload(i))
+			outcomes <- outcome{result, err}
+		}(i)
+	}
+	waitForSocketSends(t, socket, 3)
+
+	//the first is accepted straight away, the third was never read
+	start := time.Now()
+	socket.reject(8, 1)
+	accepted, rejected, failed := 0, 0, 0
+	for i := 0; i < 3; i++ {
+		o := <-outcomes
+		switch {
+		case o.err != nil:
+			failed++
+		case o.result.Accepted():
+			accepted++
+		default:
+			rejected++
+		}
+	}
+	if accepted != 1 || rejected != 1 || failed != 1 {
+		t.Error(fmt.Sprintf("Expected one of each outcome but got %v accepted, %v rejected and %v failed", accepted, rejected, failed))
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Expected the outcomes without waiting for the settle window")
+	}
+	<-conn.CloseChannel
+}
+
+func TestSendShouldRespectContext(t *testing.T) {
+	conn, _ := sendTestConnection(5000)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := conn.Send(ctx, groupTestPayload(0)); err != context.DeadlineExceeded {
+		t.Error(fmt.Sprintf("Expected the send to be abandoned but got %v", err))
+	}
+
+	//the connection isn't left waiting on the abandoned send
+	if _, err := conn.Send(context.Background(), &Payload{Token: "zzz", AlertText: "Testing"}); err == nil {
+		t.Error("Expected an invalid token to be refused")
+	}
+	conn.Disconnect()
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.ErrorPayload == nil {
+		t.Error(fmt.Sprintf("Expected the abandoned payload to still be reported but got %v", connectionClose))
+	}
+
+	if _, err := conn.Send(context.Background(), groupTestPayload(1)); err == nil {
+		t.Error("Expected sending on a closed connection to fail")
+	}
+}
+
+func TestPoolSend(t *testing.T) {
+	pool, dialer := newPoolTestPool(t, 2, PoolRoundRobin)
+	for i := 0; i < 2; i++ {
+		result, err := pool.Send(context.Background(), groupTestPayload(i))
+		if err != nil || !result.Accepted() {
+			t.Error(fmt.Sprintf("Expected the payload to be accepted but got %v, %v", result, err))
+		}
+	}
+	waitForPoolSends(t, dialer, []int{1, 1})
+
+	pool.Close()
+	finalPoolClose(t, pool)
+	if _, err := pool.Send(context.Background(), groupTestPayload(2)); err == nil {
+		t.Error("Expected sending on a closed pool to fail")
+	}
+}
+
+func TestSendAllShouldReportEachPayload(t *testing.T) {
+	conn, socket := sendTestConnection(5000)
+	payloads := []*Payload{groupTestPayload(0), groupTestPayload(1), groupTestPayload(2), groupTestPayload(3)}
+	payloads[1].ExtraData = "user 1"
+	payloads[2].CustomFields = map[string]interface{}{"aps": 1}
+
+	go func() {
+		waitForSocketSends(t, socket, 3)
+		//the second payload written is the second given
+		socket.reject(8, 1)
+	}()
+	results, err := conn.SendAll(context.Background(), payloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != len(payloads) {
+		t.Fatal(fmt.Sprintf("Expected %v results but got %v", len(payloads), len(results)))
+	}
+	for i, result := range results {
+		if result.Payload != payloads[i] {
+			t.Error(fmt.Sprintf("Expected result %v to be for payload %v", i, i))
+		}
+	}
+	if results[0].Err != nil || !results[0].Accepted() {
+		t.Error(fmt.Sprintf("Expected the first payload to be accepted but got %+v", results[0]))
+	}
+	if results[1].Err != nil || results[1].Reason != "INVALID_TOKEN" || results[1].Payload.ExtraData != "user 1" {
+		t.Error(fmt.Sprintf("Expected the second payload to be rejected but got %+v", results[1]))
+	}
+	if results[2].Err == nil || results[2].StatusCode != 0 {
+		t.Error(fmt.Sprintf("Expected the third payload to fail to marshal but got %+v", results[2]))
+	}
+	if results[3].Err == nil {
+		t.Error(fmt.Sprintf("Expected the fourth payload to be unsent but got %+v", results[3]))
+	}
+	<-conn.CloseChannel
+}
+
+func TestSendAllShouldRespectContext(t *testing.T) {
+	conn, _ := sendTestConnection(5000)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	results, err := conn.SendAll(ctx, []*Payload{groupTestPayload(0), groupTestPayload(1)})
+	if err != context.DeadlineExceeded {
+		t.Error(fmt.Sprintf("Expected the deadline to pass but got %v", err))
+	}
+	for i, result := range results {
+		if result.Err != context.DeadlineExceeded {
+			t.Error(fmt.Sprintf("Expected result %v to be abandoned but got %+v", i, result))
+		}
+	}
+	conn.Disconnect()
+	<-conn.CloseChannel
+}
+
+func TestPoolSendAll(t *testing.T) {
+	pool, dialer := newPoolTestPool(t, 2, PoolRoundRobin)
+	results, err := pool.SendAll(context.Background(), []*Payload{groupTestPayload(0), groupTestPayload(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Err != nil || !result.Accepted() {
+			t.Error(fmt.Sprintf("Expected result %v to be accepted but got %+v", i, result))
+		}
+	}
+	waitForPoolSends(t, dialer, []int{1, 1})
+
+	pool.Close()
+	finalPoolClose(t, pool)
+}
@@ -0,0 +1,220 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Outcome of a single member of a SendGroup
+type GroupMemberStatus int
+
+const (
+	// The group hasn't resolved yet
+	GroupMemberPending GroupMemberStatus = iota
+	// The member was sent and nothing in the group was rejected
+	GroupMemberSent
+	// The member failed validation or was rejected by Apple
+	GroupMemberRejected
+	// A sibling was rejected so this member was never delivered
+	GroupMemberCancelled
+	// A sibling was rejected but this member had already been delivered
+	GroupMemberTooLate
+	// The member was not sent because of a failure outside the group,
+	// it will be in the ConnectionClose.UnsentPayloads list
+	GroupMemberUnsent
+	// The config's TokenFilter refused the member, so like a member that
+	// failed validation nothing in the group was sent
+	GroupMemberFiltered
+)
+
+var groupMemberStatusNames = map[GroupMemberStatus]string{
+	GroupMemberPending:   "PENDING",
+	GroupMemberSent:      "SENT",
+	GroupMemberRejected:  "REJECTED",
+	GroupMemberCancelled: "CANCELLED",
+	GroupMemberTooLate:   "TOO_LATE",
+	GroupMemberUnsent:    "UNSENT",
+	GroupMemberFiltered:  "FILTERED",
+}
+
+func (s GroupMemberStatus) String() string {
+	if name, ok := groupMemberStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("GroupMemberStatus(%d)", int(s))
+}
+
+// A set of related payloads with best effort both-or-neither semantics.
+//
+// All members are validated on Commit and if any fails nothing is sent.
+// Once committed the members are framed back to back, and if Apple rejects
+// one of them the siblings that weren't delivered are reported as cancelled
+// and left out of the connection's unsent payloads so they aren't resent.
+// Siblings that were already delivered cannot be recalled and are reported
+// as too late.
+//
+// As the binary protocol only reports failures, the group resolves when
+// the connection closes (or once all members have been pushed out of
+// the in flight buffer)
+type SendGroup struct {
+	conn      *APNSConnection
+	payloads  []*Payload
+	members   []*idPayload
+	statuses  []GroupMemberStatus
+	committed bool
+	evicted   int
+	lock      *sync.Mutex
+	done      chan bool
+}
+
+// Create a new, empty, send group for this connection
+func (c *APNSConnection) NewSendGroup() *SendGroup {
+	return &SendGroup{
+		conn: c,
+		lock: new(sync.Mutex),
+		done: make(chan bool),
+	}
+}
+
+// Add a payload to the group, must be called before Commit
+func (g *SendGroup) Add(payload *Payload) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.committed {
+		return errors.New("Cannot add to a send group that has been committed")
+	}
+	g.payloads = append(g.payloads, payload)
+	g.statuses = append(g.statuses, GroupMemberPending)
+	return nil
+}
+
+// Validate every member and send the group
+// If any member fails validation, that member is marked rejected, the rest
+// cancelled, and nothing is sent. A member the TokenFilter refused is
+// marked filtered instead, and the error returned matches ErrTokenFiltered
+func (g *SendGroup) Commit() error {
+	g.lock.Lock()
+	if g.committed {
+		g.lock.Unlock()
+		return errors.New("Send group has already been committed")
+	}
+	if len(g.payloads) == 0 {
+		g.lock.Unlock()
+		return errors.New("Cannot commit an empty send group")
+	}
+	g.committed = true
+	g.members = make([]*idPayload, len(g.payloads))
+
+	for i, payload := range g.payloads {
+		err := g.validateMember(payload)
+		if err != nil {
+			g.resolve(GroupMemberCancelled)
+			g.statuses[i] = GroupMemberRejected
+			g.lock.Unlock()
+			return fmt.Errorf("Send group member %v is invalid: %v", i, err)
+		}
+		if err := filterToken(g.conn.config.TokenFilter, payload.Token); err != nil {
+			g.resolve(GroupMemberCancelled)
+			g.statuses[i] = GroupMemberFiltered
+			g.lock.Unlock()
+			return fmt.Errorf("Send group member %v is filtered: %w", i, g.conn.tokenFiltered(payload, err))
+		}
+	}
+	g.lock.Unlock()
+
+	select {
+	case g.conn.groupChannel <- g:
+		return nil
+	case <-g.conn.sendListenerDone:
+		g.lock.Lock()
+		g.resolve(GroupMemberUnsent)
+		g.lock.Unlock()
+		return errors.New("Cannot commit send group, connection is closed")
+	case <-g.conn.stopChannel:
+		g.lock.Lock()
+		g.resolve(GroupMemberUnsent)
+		g.lock.Unlock()
+		return errors.New("Cannot commit send group, connection is shutting down")
+	}
+}
+
+// Snapshot of each member's status, in the order they were added
+func (g *SendGroup) Status() []GroupMemberStatus {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	statuses := make([]GroupMemberStatus, len(g.statuses))
+	copy(statuses, g.statuses)
+	return statuses
+}
+
+// Closed once every member's status is final
+func (g *SendGroup) Done() <-chan bool {
+	return g.done
+}
+
+// Make sure a member could be framed by the connection
+func (g *SendGroup) validateMember(payload *Payload) error {
+	if payload == nil {
+		return errors.New("Payload is nil")
+	}
+	//the connection fails an invalid payload on its own, which would
+	//leave its siblings to be sent
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+	if _, err := payload.binaryToken(); err != nil {
+		return err
+	}
+	_, err := payload.Marshal(g.conn.config.MaxPayloadSize)
+	return err
+}
+
+// NOT THREADSAFE (need to acquire lock before calling)
+// Set every member to status and mark the group done
+func (g *SendGroup) resolve(status GroupMemberStatus) {
+	for i := range g.statuses {
+		g.statuses[i] = status
+	}
+	close(g.done)
+}
+
+// Called by the connection when a member is pushed out of the in flight buffer
+// Returns true if the group resolved because no members are left to track
+func (g *SendGroup) evict() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.evicted++
+	if g.evicted < len(g.members) {
+		return false
+	}
+	g.resolve(GroupMemberSent)
+	return true
+}
+
+// Called by the connection when it closes to work out each member's status
+func (g *SendGroup) finalize(rejected bool, errorIdPayload *idPayload) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for i, member := range g.members {
+		switch {
+		case member.failed:
+			g.statuses[i] = GroupMemberRejected
+		case rejected && member == errorIdPayload:
+			g.statuses[i] = GroupMemberRejected
+		case rejected && member.unsent:
+			g.statuses[i] = GroupMemberCancelled
+		case rejected:
+			g.statuses[i] = GroupMemberTooLate
+		case member.unsent:
+			g.statuses[i] = GroupMemberUnsent
+		default:
+			g.statuses[i] = GroupMemberSent
+		}
+	}
+	close(g.done)
+}
@@ -0,0 +1,341 @@
+package apns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+/**
+ * Mock connection that rejects a given payload id after the first write
+ */
+type MockConnRejectId struct {
+	WrittenBytes *bytes.Buffer
+	ReadChannel  chan *uint32
+	Reject       bool
+	RejectId     uint32
+	rejectOnce   *sync.Once
+}
+
+func NewMockConnRejectId(reject bool, rejectId uint32) MockConnRejectId {
+	return MockConnRejectId{
+		WrittenBytes: new(bytes.Buffer),
+		ReadChannel:  make(chan *uint32, 2),
+		Reject:       reject,
+		RejectId:     rejectId,
+		rejectOnce:   new(sync.Once),
+	}
+}
+
+func (conn MockConnRejectId) Read(b []byte) (n int, err error) {
+	errorId := <-conn.ReadChannel
+	if errorId == nil {
+		return -1, errors.New("Socket Closed")
+	}
+	b[0] = uint8(8) //command
+	b[1] = uint8(8) //invalid token
+	//write error id in big endian
+	b[2] = byte(*errorId >> 24)
+	b[3] = byte(*errorId >> 16)
+	b[4] = byte(*errorId >> 8)
+	b[5] = byte(*errorId)
+	return 6, nil
+}
+func (conn MockConnRejectId) Write(b []byte) (n int, err error) {
+	conn.WrittenBytes.Write(b)
+	if conn.Reject {
+		conn.rejectOnce.Do(func() {
+			rejectId := conn.RejectId
+			conn.ReadChannel <- &rejectId
+		})
+	}
+	return len(b), nil
+}
+func (conn MockConnRejectId) Close() error {
+	conn.ReadChannel <- nil
+	return nil
+}
+func (conn MockConnRejectId) LocalAddr() net.Addr {
+	return nil
+}
+func (conn MockConnRejectId) RemoteAddr() net.Addr {
+	return nil
+}
+func (conn MockConnRejectId) SetDeadline(t time.Time) error {
+	return nil
+}
+func (conn MockConnRejectId) SetReadDeadline(t time.Time) error {
+	return nil
+}
+func (conn MockConnRejectId) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func groupTestConnection(socket net.Conn) *APNSConnection {
+	return socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            50,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		})
+}
+
+func groupTestPayload(i int) *Payload {
+	return &Payload{
+		AlertText: fmt.Sprintf("Testing%v", i),
+		Token:     fmt.Sprintf("4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c%02x", i),
+	}
+}
+
+func expectGroupStatus(t *testing.T, group *SendGroup, expected []GroupMemberStatus) {
+	select {
+	case <-group.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Send group never resolved")
+	}
+
+	statuses := group.Status()
+	if len(statuses) != len(expected) {
+		t.Fatalf("Expected %v statuses but got %v", expected, statuses)
+	}
+	for i := range expected {
+		if statuses[i] != expected[i] {
+			t.Errorf("Expected statuses %v but got %v", expected, statuses)
+			return
+		}
+	}
+}
+
+func expectUnsentTokens(t *testing.T, connectionClose *ConnectionClose, expected []*Payload) {
+	if connectionClose.UnsentPayloads.Len() != len(expected) {
+		t.Fatalf("Expected %v unsent payloads but got %v", len(expected), connectionClose.UnsentPayloads.Len())
+	}
+	i := 0
+	for e := connectionClose.UnsentPayloads.Front(); e != nil; e = e.Next() {
+		if e.Value.(*Payload) != expected[i] {
+			t.Errorf("Expected unsent payload %v to be %v but got %v", i, expected[i].Token, e.Value.(*Payload).Token)
+		}
+		i++
+	}
+}
+
+func TestSendGroupSentWhenNothingRejected(t *testing.T) {
+	socket := NewMockConnRejectId(false, 0)
+	apn := groupTestConnection(socket)
+
+	group := apn.NewSendGroup()
+	group.Add(groupTestPayload(0))
+
+	if err := group.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	apn.Disconnect()
+	connectionClose := <-apn.CloseChannel
+
+	expectUnsentTokens(t, connectionClose, []*Payload{})
+	expectGroupStatus(t, group, []GroupMemberStatus{GroupMemberSent})
+}
+
+func TestSendGroupRejectedFirstMemberCancelsSiblings(t *testing.T) {
+	socket := NewMockConnRejectId(true, 0)
+	apn := groupTestConnection(socket)
+
+	group := apn.NewSendGroup()
+	for i := 0; i < 3; i++ {
+		group.Add(groupTestPayload(i))
+	}
+
+	if err := group.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	connectionClose := <-apn.CloseChannel
+	if connectionClose.ErrorPayload != group.payloads[0] {
+		t.Errorf("Expected first member to be the error payload but got %v", connectionClose.ErrorPayload)
+	}
+	expectUnsentTokens(t, connectionClose, []*Payload{})
+	expectGroupStatus(t, group, []GroupMemberStatus{GroupMemberRejected, GroupMemberCancelled, GroupMemberCancelled})
+}
+
+func TestSendGroupRejectedMiddleMemberIsTooLateForEarlierSiblings(t *testing.T) {
+	socket := NewMockConnRejectId(true, 1)
+	apn := groupTestConnection(socket)
+
+	group := apn.NewSendGroup()
+	for i := 0; i < 3; i++ {
+		group.Add(groupTestPayload(i))
+	}
+
+	if err := group.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	connectionClose := <-apn.CloseChannel
+	expectUnsentTokens(t, connectionClose, []*Payload{})
+	expectGroupStatus(t, group, []GroupMemberStatus{GroupMemberTooLate, GroupMemberRejected, GroupMemberCancelled})
+}
+
+func TestSendGroupRejectionOutsideGroupLeavesMembersUnsent(t *testing.T) {
+	socket := NewMockConnRejectId(true, 0)
+	apn := groupTestConnection(socket)
+
+	before := groupTestPayload(10)
+	apn.SendChannel <- before
+
+	group := apn.NewSendGroup()
+	group.Add(groupTestPayload(0))
+	group.Add(groupTestPayload(1))
+
+	if err := group.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	connectionClose := <-apn.CloseChannel
+	if connectionClose.ErrorPayload != before {
+		t.Errorf("Expected payload before the group to be the error payload but got %v", connectionClose.ErrorPayload)
+	}
+	expectUnsentTokens(t, connectionClose, group.payloads)
+	expectGroupStatus(t, group, []GroupMemberStatus{GroupMemberUnsent, GroupMemberUnsent})
+}
+
+func TestSendGroupRejectionOnlyCancelsGroupMembers(t *testing.T) {
+	socket := NewMockConnRejectId(true, 0)
+	apn := groupTestConnection(socket)
+
+	group := apn.NewSendGroup()
+	group.Add(groupTestPayload(0))
+	group.Add(groupTestPayload(1))
+
+	if err := group.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	after := groupTestPayload(10)
+	apn.SendChannel <- after
+
+	connectionClose := <-apn.CloseChannel
+	expectUnsentTokens(t, connectionClose, []*Payload{after})
+	expectGroupStatus(t, group, []GroupMemberStatus{GroupMemberRejected, GroupMemberCancelled})
+}
+
+func TestSendGroupValidationFailureSendsNothing(t *testing.T) {
+	socket := NewMockConnRejectId(false, 0)
+	apn := groupTestConnection(socket)
+
+	invalid := groupTestPayload(1)
+	invalid.Token = "not hex"
+
+	group := apn.NewSendGroup()
+	group.Add(groupTestPayload(0))
+	group.Add(invalid)
+	group.Add(groupTestPayload(2))
+
+	if err := group.Commit(); err == nil {
+		t.Error("Expected commit to fail validation")
+	}
+
+	expectGroupStatus(t, group, []GroupMemberStatus{GroupMemberCancelled, GroupMemberRejected, GroupMemberCancelled})
+
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	if socket.WrittenBytes.Len() != 0 {
+		t.Errorf("Expected nothing to be written but %v bytes were", socket.WrittenBytes.Len())
+	}
+}
+
+func TestSendGroupInvalidMemberSendsNothing(t *testing.T) {
+	socket := NewMockConnRejectId(false, 0)
+	apn := groupTestConnection(socket)
+
+	invalid := groupTestPayload(1)
+	invalid.Priority = 7
+
+	group := apn.NewSendGroup()
+	group.Add(groupTestPayload(0))
+	group.Add(invalid)
+	group.Add(groupTestPayload(2))
+
+	if err := group.Commit(); err == nil {
+		t.Error("Expected commit to fail validation")
+	}
+
+	expectGroupStatus(t, group, []GroupMemberStatus{GroupMemberCancelled, GroupMemberRejected, GroupMemberCancelled})
+
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	if socket.WrittenBytes.Len() != 0 {
+		t.Errorf("Expected nothing to be written but %v bytes were", socket.WrittenBytes.Len())
+	}
+}
+
+func TestSendGroupCannotChangeAfterCommit(t *testing.T) {
+	socket := NewMockConnRejectId(false, 0)
+	apn := groupTestConnection(socket)
+
+	group := apn.NewSendGroup()
+	if err := group.Commit(); err == nil {
+		t.Error("Expected commit of an empty group to fail")
+	}
+
+	group.Add(groupTestPayload(0))
+	if err := group.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := group.Add(groupTestPayload(1)); err == nil {
+		t.Error("Expected add after commit to fail")
+	}
+	if err := group.Commit(); err == nil {
+		t.Error("Expected second commit to fail")
+	}
+
+	apn.Disconnect()
+	<-apn.CloseChannel
+}
+
+func TestSendGroupCommitOnClosedConnection(t *testing.T) {
+	socket := NewMockConnRejectId(false, 0)
+	apn := groupTestConnection(socket)
+
+	apn.Disconnect()
+	<-apn.CloseChannel
+
+	group := apn.NewSendGroup()
+	group.Add(groupTestPayload(0))
+	if err := group.Commit(); err == nil {
+		t.Error("Expected commit on a closed connection to fail")
+	}
+
+	expectGroupStatus(t, group, []GroupMemberStatus{GroupMemberUnsent})
+}
+
+func TestSendGroupResolvesWhenEvictedFromInFlightBuffer(t *testing.T) {
+	socket := NewMockConnRejectId(false, 0)
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 1,
+			FramingTimeout:            10,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+		})
+
+	group := apn.NewSendGroup()
+	group.Add(groupTestPayload(0))
+	if err := group.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	apn.SendChannel <- groupTestPayload(1)
+
+	expectGroupStatus(t, group, []GroupMemberStatus{GroupMemberSent})
+
+	apn.Disconnect()
+	<-apn.CloseChannel
+}
@@ -0,0 +1,198 @@
+package apns
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Stop accepting payloads and shut down once apple has read everything
+// already sent, or ctx is done
+// Anything waiting to be framed is flushed and the write side of the
+// socket closed, then apple closes its side once it has read the lot.
+// If apple rejects a payload first the connection closes as usual,
+// otherwise the ConnectionClose has error code 0 (NO_ERRORS) and nothing
+// unsent. If ctx is done first the connection is closed as Disconnect
+// does, leaving everything in flight in UnsentPayloads as apple never
+// confirmed it, and ctx.Err() is returned
+// Payloads sent after Shutdown is called aren't taken, see SendContext
+// The ConnectionClose is still received from CloseChannel
+func (c *APNSConnection) Shutdown(ctx context.Context) error {
+	c.stop()
+	select {
+	case <-c.sendListenerDone:
+		c.logShutdown(nil)
+		return nil
+	case <-ctx.Done():
+		c.abandon()
+		c.noFlushDisconnect()
+		<-c.sendListenerDone
+		c.logShutdown(ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// Log how a Shutdown went: the payloads taken, those left unsent and
+// how the connection closed
+func (c *APNSConnection) logShutdown(err error) {
+	event := []interface{}{"payloads", c.payloadIdCounter}
+	if c.finalClose != nil {
+		event = append(event, "unsent", c.finalClose.UnsentPayloads.Len(), "close", c.finalClose.Error.ErrorString)
+	}
+	if err != nil {
+		c.logger.Warn("apns: shutdown gave up", append(event, "error", err.Error())...)
+		return
+	}
+	c.logger.Info("apns: shut down", event...)
+}
+
+// Stop accepting payloads and close once everything already given to the
+// connection has been written, returning the payloads that weren't
+// Payloads waiting on the Enqueue queue are written too, then the socket
+// is kept open for DrainLinger as apple reports rejections
+// asynchronously, before shutting down as Shutdown does. The payloads
+// returned are none if nothing was rejected, those after the rejected
+// payload if apple rejected one, or everything in flight if the socket
+// dropped or ctx is done first, when ctx.Err() is returned, so they can
+// be handed on to be sent later
+// The ConnectionClose is still received from CloseChannel
+func (c *APNSConnection) Drain(ctx context.Context) ([]*Payload, error) {
+	c.stopOnce.Do(func() {
+		c.draining = true
+		close(c.stopChannel)
+	})
+	err := c.Shutdown(ctx)
+
+	unsent := []*Payload{}
+	if c.finalClose == nil {
+		return unsent, err
+	}
+	if c.finalClose.ErrorPayload != nil && c.finalClose.Error.ErrorCode == 10 {
+		//the socket closing doesn't say whether apple read it
+		unsent = append(unsent, c.finalClose.ErrorPayload)
+	}
+	for e := c.finalClose.UnsentPayloads.Front(); e != nil; e = e.Next() {
+		unsent = append(unsent, e.Value.(*Payload))
+	}
+	return unsent, err
+}
+
+// Shut down for a pool or APNSReconnectingConnection that's closing, so
+// every payload already handed to the connection is written first rather
+// than racing a Disconnect, waiting up to SendSettleWindow (a second if
+// unset) for apple to close its side
+// Returns nil after a clean shutdown, otherwise the ConnectionClose: a
+// rejection, or everything in flight if apple didn't close in time
+func (c *APNSConnection) shutdownForClose() *ConnectionClose {
+	window := time.Duration(c.config.SendSettleWindow) * time.Millisecond
+	if window <= 0 {
+		window = time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), window)
+	defer cancel()
+	c.Shutdown(ctx)
+	connectionClose := <-c.CloseChannel
+	if connectionClose.Error.ErrorCode == 0 && connectionClose.Timeout == nil {
+		return nil
+	}
+	return connectionClose
+}
+
+// Send a payload, giving up if ctx is done before the connection takes it
+// so a push stuck behind a slow connection can be abandoned
+// Returns ctx.Err() if given up, or an error if the connection is closed
+// or shutting down
+func (c *APNSConnection) SendContext(ctx context.Context, payload *Payload) error {
+	select {
+	case c.SendChannel <- payload:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.stopChannel:
+		return errors.New("Cannot send payload, connection is shutting down")
+	case <-c.sendListenerDone:
+		return errors.New("Cannot send payload, connection is closed")
+	}
+}
+
+// go-routine closing the connection once the ctx it was created with is done
+func (c *APNSConnection) contextListener(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		c.abandon()
+		c.stop()
+	case <-c.sendListenerDone:
+	}
+}
+
+func (c *APNSConnection) stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopChannel)
+	})
+}
+
+func (c *APNSConnection) abandon() {
+	c.abandonOnce.Do(func() {
+		close(c.abandonChannel)
+	})
+}
+
+func (c *APNSConnection) abandoned() bool {
+	select {
+	case <-c.abandonChannel:
+		return true
+	default:
+		return false
+	}
+}
+
+// Flush anything framed, then close the write side of the socket so
+// apple closes its side once it has read everything
+// Sockets that can't be half closed, and abandoned shutdowns, are closed
+// outright as Disconnect does
+// Called on the send go-routine
+func (c *APNSConnection) shutdownSocket() {
+	c.recorder.recordDisconnect(c.config.clock.Now())
+	c.inFlightBufferLock.Lock()
+	c.flushBufferToSocket()
+	c.inFlightBufferLock.Unlock()
+
+	socket, ok := c.socket.(interface {
+		CloseWrite() error
+	})
+	if !ok || c.abandoned() || socket.CloseWrite() != nil {
+		c.noFlushDisconnect()
+	}
+}
+
+// Accept the payloads left on the Enqueue queue for a Drain
+// Returns an error from apple if one arrives while waiting, leaving the
+// rest queued to be handed back as unsent
+// Called on the send go-routine
+func (c *APNSConnection) drainQueue(errCloseChannel chan *AppleError) *AppleError {
+	for {
+		select {
+		case payload := <-c.queue:
+			if appleError := c.acceptPayload(payload, nil, true, errCloseChannel); appleError != nil {
+				return appleError
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// Flush anything framed for a Drain, returning a channel that fires once
+// apple has had DrainLinger to reject any of it
+// Called on the send go-routine
+func (c *APNSConnection) lingerSocket() <-chan time.Time {
+	c.inFlightBufferLock.Lock()
+	c.flushBufferToSocket()
+	c.inFlightBufferLock.Unlock()
+
+	linger := time.Duration(c.config.DrainLinger) * time.Millisecond
+	if linger < 0 {
+		linger = 0
+	}
+	return c.config.clock.After(linger)
+}
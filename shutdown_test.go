@@ -0,0 +1,292 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Mock gateway socket that can be half closed, as a tls connection can
+type halfCloseTestSocket struct {
+	*poolTestSocket
+	halfClosed chan bool
+	once       *sync.Once
+}
+
+func newHalfCloseTestSocket() *halfCloseTestSocket {
+	return &halfCloseTestSocket{
+		poolTestSocket: newPoolTestSocket(),
+		halfClosed:     make(chan bool),
+		once:           new(sync.Once),
+	}
+}
+
+func (s *halfCloseTestSocket) CloseWrite() error {
+	s.once.Do(func() { close(s.halfClosed) })
+	return nil
+}
+
+func shutdownTestConfig() *APNSConfig {
+	return &APNSConfig{
+		InFlightPayloadBufferSize: 10000,
+		FramingTimeout:            1,
+		MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+		MaxPayloadSize:            2048,
+	}
+}
+
+func waitForSocketSends(t *testing.T, socket *poolTestSocket, expected int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for socket.sent() != expected {
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("Expected %v payloads to be written but got %v", expected, socket.sent()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShutdownShouldWaitForGateway(t *testing.T) {
+	gateway, config := newDropTestGateway(t, 0, 0)
+	defer gateway.Close()
+
+	conn, err := NewAPNSConnectionContext(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := conn.SendContext(context.Background(), groupTestPayload(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := conn.Shutdown(ctx); err != nil {
+		t.Error(fmt.Sprintf("Expected a clean shutdown but got %v", err))
+	}
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.Error.ErrorCode != 0 || connectionClose.ErrorPayload != nil || connectionClose.UnsentPayloads.Len() != 0 {
+		t.Error(fmt.Sprintf("Expected nothing unsent but got %v", connectionClose))
+	}
+	if gateway.distinct() != 10 {
+		t.Error(fmt.Sprintf("Expected 10 payloads to be received but got %v", gateway.distinct()))
+	}
+}
+
+func TestShutdownShouldReportRejections(t *testing.T) {
+	socket := newHalfCloseTestSocket()
+	conn := socketAPNSConnection(socket, shutdownTestConfig())
+	for i := 0; i < 3; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+	waitForSocketSends(t, socket.poolTestSocket, 3)
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- conn.Shutdown(context.Background())
+	}()
+	<-socket.halfClosed
+	socket.reject(8, 1)
+
+	if err := <-shutdown; err != nil {
+		t.Error(fmt.Sprintf("Expected shutdown to succeed but got %v", err))
+	}
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.Error.ErrorCode != 8 || connectionClose.ErrorPayload.AlertText != "Testing1" ||
+		connectionClose.UnsentPayloads.Len() != 1 ||
+		connectionClose.UnsentPayloads.Front().Value.(*Payload).AlertText != "Testing2" {
+		t.Error(fmt.Sprintf("Expected the rejection with one unsent payload but got %v", connectionClose))
+	}
+}
+
+func TestShutdownShouldGiveUpAtDeadline(t *testing.T) {
+	socket := newHalfCloseTestSocket()
+	conn := socketAPNSConnection(socket, shutdownTestConfig())
+	for i := 0; i < 2; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+	waitForSocketSends(t, socket.poolTestSocket, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := conn.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error(fmt.Sprintf("Expected the deadline to pass but got %v", err))
+	}
+	connectionClose := <-conn.CloseChannel
+	//apple never confirmed either payload
+	if connectionClose.Error.ErrorCode != 10 || connectionClose.UnsentPayloads.Len() != 1 {
+		t.Error(fmt.Sprintf("Expected the payloads in flight to be reported but got %v", connectionClose))
+	}
+}
+
+func TestShutdownShouldCloseSocketsThatCantHalfClose(t *testing.T) {
+	socket := newPoolTestSocket()
+	conn := socketAPNSConnection(socket, shutdownTestConfig())
+	for i := 0; i < 2; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+
+	if err := conn.Shutdown(context.Background()); err != nil {
+		t.Error(fmt.Sprintf("Expected a clean shutdown but got %v", err))
+	}
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.Error.ErrorCode != 0 || connectionClose.UnsentPayloads.Len() != 0 {
+		t.Error(fmt.Sprintf("Expected nothing unsent but got %v", connectionClose))
+	}
+	if socket.sent() != 2 {
+		t.Error(fmt.Sprintf("Expected both payloads to be flushed but got %v", socket.sent()))
+	}
+
+	if err := conn.SendContext(context.Background(), groupTestPayload(2)); err == nil {
+		t.Error("Expected sending after shutdown to fail")
+	}
+}
+
+func TestContextShouldCloseConnection(t *testing.T) {
+	gateway, config := newDropTestGateway(t, 0, 0)
+	defer gateway.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := NewAPNSConnectionContext(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SendChannel <- groupTestPayload(0)
+	cancel()
+
+	select {
+	case connectionClose := <-conn.CloseChannel:
+		if connectionClose.Error.ErrorCode != 10 || connectionClose.Error.MessageID != 0 {
+			t.Error(fmt.Sprintf("Expected the close from disconnecting but got %v", connectionClose))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection didn't close when its context was cancelled")
+	}
+}
+
+func TestContextShouldStopConnecting(t *testing.T) {
+	gateway, config := newDropTestGateway(t, 0, 0)
+	defer gateway.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewAPNSConnectionContext(ctx, config); err == nil {
+		t.Error("Expected connecting with a cancelled context to fail")
+	}
+}
+
+func TestSendContextShouldGiveUp(t *testing.T) {
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	//the second payload holds up the connection waiting for the rate limiter
+	config.MaxNotificationsPerSecond = 0.001
+	conn := socketAPNSConnection(socket, config)
+	for i := 0; i < 2; i++ {
+		if err := conn.SendContext(context.Background(), groupTestPayload(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := conn.SendContext(ctx, groupTestPayload(2)); err != context.DeadlineExceeded {
+		t.Error(fmt.Sprintf("Expected the send to be abandoned but got %v", err))
+	}
+
+	conn.Disconnect()
+	<-conn.CloseChannel
+}
+
+func TestDrainShouldWriteQueuedPayloads(t *testing.T) {
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	config.SendQueueSize = 5
+	config.DrainLinger = 50
+	//holds the payloads up on the queue while the first are written
+	config.MaxNotificationsPerSecond = 50
+	conn := socketAPNSConnection(socket, config)
+	for i := 0; i < 5; i++ {
+		if err := conn.Enqueue(groupTestPayload(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	unsent, err := conn.Drain(context.Background())
+	if err != nil || len(unsent) != 0 {
+		t.Error(fmt.Sprintf("Expected a clean drain but got %v, %v", unsent, err))
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Error(fmt.Sprintf("Expected the socket to linger but it closed after %v", elapsed))
+	}
+	if socket.sent() != 5 {
+		t.Error(fmt.Sprintf("Expected every queued payload to be written but got %v", socket.sent()))
+	}
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.Error.ErrorCode != 0 || connectionClose.UnsentPayloads.Len() != 0 {
+		t.Error(fmt.Sprintf("Expected nothing unsent but got %v", connectionClose))
+	}
+
+	if err := conn.Enqueue(groupTestPayload(5)); err == nil {
+		t.Error("Expected enqueueing after a drain to fail")
+	}
+}
+
+func TestDrainShouldReportRejectionsWhileLingering(t *testing.T) {
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	config.DrainLinger = 5000
+	conn := socketAPNSConnection(socket, config)
+	for i := 0; i < 3; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+
+	type drained struct {
+		unsent []*Payload
+		err    error
+	}
+	drain := make(chan drained)
+	go func() {
+		unsent, err := conn.Drain(context.Background())
+		drain <- drained{unsent, err}
+	}()
+	waitForSocketSends(t, socket, 3)
+	socket.reject(8, 1)
+
+	select {
+	case result := <-drain:
+		if result.err != nil || len(result.unsent) != 1 || result.unsent[0].AlertText != "Testing2" {
+			t.Error(fmt.Sprintf("Expected the payload after the rejected one to be unsent but got %v, %v", result.unsent, result.err))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the rejection to end the linger")
+	}
+	connectionClose := <-conn.CloseChannel
+	if connectionClose.Error.ErrorCode != 8 || connectionClose.ErrorPayload.AlertText != "Testing1" {
+		t.Error(fmt.Sprintf("Expected the rejection to be reported but got %v", connectionClose))
+	}
+}
+
+func TestDrainShouldGiveUpAtDeadline(t *testing.T) {
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	config.DrainLinger = 5000
+	conn := socketAPNSConnection(socket, config)
+	for i := 0; i < 2; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	unsent, err := conn.Drain(ctx)
+	if err != context.DeadlineExceeded {
+		t.Error(fmt.Sprintf("Expected the deadline to pass but got %v", err))
+	}
+	//apple never confirmed either payload
+	if len(unsent) != 2 || unsent[0].AlertText != "Testing0" || unsent[1].AlertText != "Testing1" {
+		t.Error(fmt.Sprintf("Expected the payloads in flight to be returned but got %v", unsent))
+	}
+	<-conn.CloseChannel
+}
@@ -0,0 +1,14 @@
+package apns
+
+// Create a silent (background) push carrying the custom fields, waking
+// the app with content available and nothing shown to the user
+// Apple throttles these, so they are sent at PriorityThrottled
+func NewSilentPush(token string, custom map[string]interface{}) *Payload {
+	return &Payload{
+		Token:            token,
+		ContentAvailable: 1,
+		PushType:         PushTypeBackground,
+		Priority:         PriorityThrottled,
+		CustomFields:     custom,
+	}
+}
@@ -0,0 +1,20 @@
+package apns
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSilentPush(t *testing.T) {
+	p := NewSilentPush(validateTestToken, map[string]interface{}{"sync": true})
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	payloadBytes, err := p.MarshalAuto()
+	if err != nil || string(payloadBytes) != `{"aps":{"content-available":1},"sync":true}` {
+		t.Error(fmt.Sprintf("Unexpected silent push %s, %v", payloadBytes, err))
+	}
+	if p.ResolvedPushType() != PushTypeBackground || p.Priority != PriorityThrottled {
+		t.Error(fmt.Sprintf("Expected a throttled background push but got %v", p))
+	}
+}
@@ -0,0 +1,108 @@
+package apns
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Frames are written in chunks of at most this many bytes, the most a
+	// TLS record holds, each given WriteTimeout, so a large batch on a slow
+	// link isn't taken for a stall as long as it keeps moving
+	writeChunkSize = 16 * 1024
+	// How long past WriteTimeout a chunk's write may go before the
+	// watchdog closes the socket under it, for a connection that doesn't
+	// honor write deadlines (e.g. from a custom Dialer)
+	writeWatchdogGrace = time.Second
+)
+
+// A write to the socket that stopped making progress, e.g. as the
+// gateway's receive window closed, reported in the ConnectionClose that
+// tore the connection down (see ConnectionClose.StalledWrite). The frame
+// being written and everything in flight are handed back as unsent, so
+// an APNSReconnectingConnection resends them
+// Unwraps to the connection's write TimeoutError
+type StalledWriteError struct {
+	// How long the chunk being written was stuck before the write was
+	// abandoned
+	Stalled time.Duration
+	// The bound it passed, APNSConfig.WriteTimeout
+	After time.Duration
+	// Bytes of the frame written before the stall
+	Written int
+	// Bytes in the frame
+	Size int
+	// Payloads in the frame
+	Payloads int
+}
+
+func (e *StalledWriteError) Error() string {
+	return fmt.Sprintf("Write stalled for %v after %v of %v bytes (%v payloads)", e.Stalled, e.Written, e.Size, e.Payloads)
+}
+
+// Always true, as for a net.Error
+func (e *StalledWriteError) Timeout() bool {
+	return true
+}
+
+func (e *StalledWriteError) Unwrap() error {
+	return &TimeoutError{Op: "write", After: e.After}
+}
+
+// Write frame to the socket a chunk at a time, each chunk given timeout
+// by its write deadline and a watchdog closing the socket should the
+// deadline not be honored
+// Returns a *StalledWriteError with the error if a chunk couldn't be
+// written in time, timeout 0 writes the frame as is with no bound
+func (c *APNSConnection) writeFrame(frame []byte, timeout time.Duration, payloads int) (*StalledWriteError, error) {
+	if timeout <= 0 {
+		_, err := c.socket.Write(frame)
+		return nil, err
+	}
+
+	fired := int32(0)
+	watchdog := time.AfterFunc(timeout+writeWatchdogGrace, func() {
+		atomic.StoreInt32(&fired, 1)
+		c.closeTimedOut()
+	})
+	defer watchdog.Stop()
+
+	written := 0
+	for written < len(frame) {
+		end := written + writeChunkSize
+		if end > len(frame) {
+			end = len(frame)
+		}
+		chunkStart := time.Now()
+		watchdog.Reset(timeout + writeWatchdogGrace)
+		c.socket.SetWriteDeadline(chunkStart.Add(timeout))
+		n, err := c.socket.Write(frame[written:end])
+		written += n
+		if err != nil {
+			if isTimeout(err) || atomic.LoadInt32(&fired) == 1 {
+				return &StalledWriteError{Stalled: time.Since(chunkStart), After: timeout,
+					Written: written, Size: len(frame), Payloads: payloads}, err
+			}
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// Remember the write that stalled, along with the write timeout, to
+// report it in the ConnectionClose
+func (c *APNSConnection) setStalledWrite(stalled *StalledWriteError) {
+	c.setTimedOut("write", stalled.After)
+	c.timeoutLock.Lock()
+	defer c.timeoutLock.Unlock()
+	if c.stalledWrite == nil {
+		c.stalledWrite = stalled
+	}
+}
+
+func (c *APNSConnection) stalledWriteError() *StalledWriteError {
+	c.timeoutLock.Lock()
+	defer c.timeoutLock.Unlock()
+	return c.stalledWrite
+}
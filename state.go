@@ -0,0 +1,137 @@
+package apns
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// State of an APNSReconnectingConnection's link to apple
+type ConnectionState int
+
+const (
+	// Connected and sending
+	StateConnected ConnectionState = iota
+	// The connection closed, it's reconnected unless closing
+	StateDisconnected
+	// Waiting to make a reconnect attempt
+	StateReconnecting
+	// The CircuitBreaker is open, no connection is attempted and payloads
+	// are failed fast until it probes again
+	StateThrottled
+	// Closed for good, by Close or giving up reconnecting
+	StateClosed
+	// Shut down after APNSReconnectConfig.IdleTimeout without a payload,
+	// the next payload reopens the connection
+	StateIdle
+	// Paused, see APNSReconnectingConnection.Pause
+	StatePaused
+	// Replacing the connection after MaxNotificationsPerConnection or
+	// MaxConnectionAge, StateConnected follows once the old one has shut
+	// down
+	StateRecycling
+)
+
+var connectionStateNames = map[ConnectionState]string{
+	StateConnected:    "CONNECTED",
+	StateDisconnected: "DISCONNECTED",
+	StateReconnecting: "RECONNECTING",
+	StateThrottled:    "THROTTLED",
+	StateClosed:       "CLOSED",
+	StateIdle:         "IDLE",
+	StatePaused:       "PAUSED",
+	StateRecycling:    "RECYCLING",
+}
+
+func (s ConnectionState) String() string {
+	if name, ok := connectionStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("ConnectionState(%d)", int(s))
+}
+
+// A change of state, received on APNSReconnectingConnection.StateEvents
+// Only the fields for the State are set
+type ConnectionStateEvent struct {
+	State ConnectionState
+	// When the state changed
+	Time time.Time
+	// Gateway (or proxy) connected to, for StateConnected
+	Addr string
+	// Whether the tls session was resumed, for StateConnected
+	ResumedTLS bool
+	// How long the payload that reopened an idle connection waited for it,
+	// for StateConnected after StateIdle
+	Reopen time.Duration
+	// Why the connection closed, for StateDisconnected: apple's error, or
+	// code 10 for a drop or shutdown
+	Error *AppleError
+	// Payloads waiting to be resent, for StateDisconnected and StatePaused
+	Pending int
+	// Number of the reconnect attempt, counting from 1 after each
+	// disconnect, for StateReconnecting
+	Attempt int
+	// How long until the attempt, for StateReconnecting
+	NextDelay time.Duration
+	// When the CircuitBreaker next probes, for StateThrottled
+	Until time.Time
+	// How long there had been no payload, for StateIdle
+	Idle time.Duration
+	// Payloads the connection being replaced took, and how long it was
+	// open, for StateRecycling
+	Notifications int
+	Age           time.Duration
+	// Payloads that weren't sent, handed back in the final
+	// ConnectionClose, for StateClosed
+	Unsent int
+}
+
+// Tracks the current state, passing changes on to a bounded channel
+// that drops its oldest event when full, so sending never waits on it
+type stateTracker struct {
+	lock   *sync.Mutex
+	state  ConnectionState
+	events chan *ConnectionStateEvent
+	closed bool
+}
+
+func newStateTracker(bufferSize int) *stateTracker {
+	return &stateTracker{
+		lock:   new(sync.Mutex),
+		events: make(chan *ConnectionStateEvent, bufferSize),
+	}
+}
+
+func (t *stateTracker) current() ConnectionState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.state
+}
+
+// Set the state, stamping the event with the time, and closing the
+// channel after StateClosed
+func (t *stateTracker) set(event *ConnectionStateEvent) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	event.Time = time.Now()
+	t.state = event.State
+	for sent := false; !sent; {
+		select {
+		case t.events <- event:
+			sent = true
+		default:
+			//full, drop the oldest unless a reader just took it
+			select {
+			case <-t.events:
+			default:
+			}
+		}
+	}
+	if event.State == StateClosed {
+		t.closed = true
+		close(t.events)
+	}
+}
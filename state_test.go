@@ -0,0 +1,143 @@
+package apns
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReconnectShouldReportStateChanges(t *testing.T) {
+	gateway, config := newDropTestGateway(t, 1, 5)
+	defer gateway.Close()
+
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig:   config,
+		ReconnectBaseDelay: 1,
+		ReconnectMaxDelay:  10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := conn.State(); state != StateConnected {
+		t.Error(fmt.Sprintf("Expected to start connected but was %v", state))
+	}
+
+	count := 10
+	for i := 0; i < count; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for gateway.distinct() < count {
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("Only %v of %v payloads were received", gateway.distinct(), count))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	conn.Close()
+	for range conn.CloseChannel {
+	}
+	events := []*ConnectionStateEvent{}
+	for event := range conn.StateEvents() {
+		events = append(events, event)
+	}
+
+	expected := []ConnectionState{StateConnected, StateDisconnected, StateReconnecting, StateConnected}
+	if len(events) < len(expected)+1 {
+		t.Fatal(fmt.Sprintf("Expected at least %v events but got %v", len(expected)+1, len(events)))
+	}
+	for i, state := range expected {
+		if events[i].State != state {
+			t.Error(fmt.Sprintf("Expected event %v to be %v but got %+v", i, state, events[i]))
+		}
+	}
+	if events[0].Addr != gateway.BinaryAddr() || events[3].Addr != gateway.BinaryAddr() {
+		t.Error(fmt.Sprintf("Expected the gateway address but got %v and %v", events[0].Addr, events[3].Addr))
+	}
+	if disconnected := events[1]; disconnected.Error == nil || disconnected.Error.ErrorCode != 10 || disconnected.Pending == 0 {
+		t.Error(fmt.Sprintf("Expected the drop to leave payloads to resend but got %+v", disconnected))
+	}
+	if reconnecting := events[2]; reconnecting.Attempt != 1 || reconnecting.NextDelay > 10*time.Millisecond {
+		t.Error(fmt.Sprintf("Expected the first reconnect attempt but got %+v", reconnecting))
+	}
+	if closed := events[len(events)-1]; closed.State != StateClosed || closed.Unsent != 0 || conn.State() != StateClosed {
+		t.Error(fmt.Sprintf("Expected the last event to close with nothing unsent but got %+v", closed))
+	}
+}
+
+func TestStateEventsShouldDropOldestWhenFull(t *testing.T) {
+	tracker := newStateTracker(2)
+	for attempt := 1; attempt <= 5; attempt++ {
+		tracker.set(&ConnectionStateEvent{State: StateReconnecting, Attempt: attempt})
+	}
+	tracker.set(&ConnectionStateEvent{State: StateClosed})
+	//changes after closing are ignored
+	tracker.set(&ConnectionStateEvent{State: StateConnected})
+
+	events := []*ConnectionStateEvent{}
+	for event := range tracker.events {
+		events = append(events, event)
+	}
+	if len(events) != 2 || events[0].Attempt != 5 || events[1].State != StateClosed || tracker.current() != StateClosed {
+		t.Error(fmt.Sprintf("Expected the last attempt and the close but got %v", events))
+	}
+}
+
+func TestReconnectShouldCloseAndReopenIdleConnection(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	timings := make(chan SendTiming, 2)
+	config := app.Pool.ConnectionConfig
+	config.SendTimingCallback = func(payload *Payload, timing SendTiming) {
+		timings <- timing
+	}
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig: config,
+		IdleTimeout:      50,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		conn.Close()
+		for range conn.CloseChannel {
+		}
+	}()
+
+	conn.SendChannel <- groupTestPayload(0)
+	if timing := <-timings; timing.Reopen != 0 {
+		t.Error(fmt.Sprintf("Expected no reopen for the first payload but got %v", timing.Reopen))
+	}
+	for conn.State() != StateIdle {
+		time.Sleep(time.Millisecond)
+	}
+	conn.SendChannel <- groupTestPayload(1)
+	if timing := <-timings; timing.Reopen <= 0 || timing.Total < timing.Reopen {
+		t.Error(fmt.Sprintf("Expected the reopen to be part of the payload's timing but got %+v", timing))
+	}
+	if _, err := server.WaitForNotifications(2, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if server.Connections() != 2 {
+		t.Error(fmt.Sprintf("Expected the payload to reopen the connection but got %v connections", server.Connections()))
+	}
+
+	expected := []ConnectionState{StateConnected, StateIdle, StateConnected}
+	for i, state := range expected {
+		event := <-conn.StateEvents()
+		if event.State != state {
+			t.Fatal(fmt.Sprintf("Expected event %v to be %v but got %+v", i, state, event))
+		}
+		if state == StateIdle && event.Idle != 50*time.Millisecond {
+			t.Error(fmt.Sprintf("Expected the idle timeout but got %+v", event))
+		}
+		if i == 2 && event.Reopen <= 0 {
+			t.Error(fmt.Sprintf("Expected the reopen time but got %+v", event))
+		}
+	}
+	//an idle close isn't a disconnect
+	select {
+	case event := <-conn.EventChannel:
+		t.Error(fmt.Sprintf("Expected no reconnect events but got %+v", event))
+	default:
+	}
+}
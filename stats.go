@@ -0,0 +1,300 @@
+package apns
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Receives events from the send and receive paths of a connection, set
+// with APNSConfig.StatsCollector or HTTP2Config.StatsCollector
+// Methods are called on the connection's own goroutines, often with its
+// buffers locked, so they must be safe for concurrent use and return
+// quickly. NoopStatsCollector is used when none is set, and
+// MemoryStatsCollector keeps counts for Snapshot
+type StatsCollector interface {
+	// A payload was taken by the connection, off SendChannel, the Enqueue
+	// queue, Send or a send group
+	OnEnqueued(payload *Payload)
+	// The number of payloads waiting in the Enqueue queue changed
+	OnQueueDepth(depth int)
+	// A write of payloads notifications, bytes long, took latency
+	// APNSConnection writes a frame of payloads at a time, HTTP2Connection
+	// one request, with latency until apple's response
+	OnWritten(payloads int, bytes int, latency time.Duration)
+	// Apple accepted a payload: a 200 over HTTP/2, or for APNSConnection a
+	// payload passed to Send once it settles, as the binary protocol only
+	// reports rejections
+	OnAcknowledged(payload *Payload)
+	// A payload failed: apple rejected it, it couldn't be framed or it was
+	// dropped by the QueueFullPolicy
+	OnFailed(err *SendError)
+	// An APNSReconnectingConnection or pool connected again
+	OnReconnect()
+	// A connection to the gateway was made, with how long resolving,
+	// dialing and the tls handshake took. Over HTTP/2 that's each
+	// connection the transport dials for a request
+	OnConnected(timing ConnectTiming)
+	// A payload was sent, with where the time went (see SendTiming): once
+	// written over the binary protocol, on apple's response over HTTP/2
+	OnSendTiming(timing SendTiming)
+	// A payload has to wait before being written, as the rate limiter (see
+	// APNSConfig.MaxNotificationsPerSecond) has nothing left for it
+	OnRateLimited(wait time.Duration)
+	// Apple throttled a payload sent over HTTP/2 with a 429 or 503, and
+	// sending to the device (or every send) is paused for
+	// attempt.RetryAfter. Called for each throttled attempt, whether or
+	// not the payload is resent
+	OnThrottled(payload *Payload, attempt ThrottleAttempt)
+}
+
+// StatsCollector that ignores everything, the default
+type NoopStatsCollector struct{}
+
+func (NoopStatsCollector) OnEnqueued(payload *Payload)                              {}
+func (NoopStatsCollector) OnQueueDepth(depth int)                                   {}
+func (NoopStatsCollector) OnWritten(payloads int, bytes int, latency time.Duration) {}
+func (NoopStatsCollector) OnAcknowledged(payload *Payload)                          {}
+func (NoopStatsCollector) OnFailed(err *SendError)                                  {}
+func (NoopStatsCollector) OnReconnect()                                             {}
+func (NoopStatsCollector) OnConnected(timing ConnectTiming)                         {}
+func (NoopStatsCollector) OnSendTiming(timing SendTiming)                           {}
+func (NoopStatsCollector) OnRateLimited(wait time.Duration)                         {}
+func (NoopStatsCollector) OnThrottled(payload *Payload, attempt ThrottleAttempt)    {}
+
+// Upper bounds of the write latency histogram's buckets, the last bucket
+// of StatsSnapshot.WriteLatencyBuckets counts everything slower
+var WriteLatencyBounds = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Counts kept by a MemoryStatsCollector
+type StatsSnapshot struct {
+	// Payloads taken by the connection
+	Enqueued uint64
+	// Payloads written
+	Written uint64
+	// Bytes written
+	WrittenBytes uint64
+	// Writes made (frames, or HTTP/2 requests)
+	Writes uint64
+	// Payloads apple accepted
+	Acknowledged uint64
+	// Payloads that failed, not counting those filtered
+	Failed uint64
+	// Payloads refused by a TokenFilter
+	Filtered uint64
+	// Failed payloads by apple's reason, or the FailureKind for those
+	// apple didn't reject, e.g. "queue full"
+	FailedByReason map[string]uint64
+	// Times a connection was made again
+	Reconnects uint64
+	// Payloads last waiting in the Enqueue queue
+	QueueDepth int
+	// Total time spent writing
+	WriteLatencyTotal time.Duration
+	// Slowest write
+	WriteLatencyMax time.Duration
+	// Number of writes within each of WriteLatencyBounds, and one more for
+	// those slower
+	WriteLatencyBuckets []uint64
+	// Connections made to the gateway
+	Connects uint64
+	// Total time spent making them, resolving, dialing and in the handshake
+	ConnectTiming ConnectTiming
+	// Payloads with a SendTiming
+	SendTimings uint64
+	// Each phase totalled over every SendTiming, Connected is nil
+	SendTimingTotal SendTiming
+	// Number of SendTimings whose Total is within each of
+	// WriteLatencyBounds, and one more for those slower
+	SendLatencyBuckets []uint64
+	// Payloads that had to wait for the rate limiter
+	RateLimitWaits uint64
+	// Total time they were to wait
+	RateLimitWaited time.Duration
+	// HTTP/2 attempts apple throttled, by status (429 or 503)
+	Throttled map[int]uint64
+	// Total time sending was paused for them
+	ThrottledFor time.Duration
+}
+
+// Mean time per write, zero before any
+func (s StatsSnapshot) WriteLatencyMean() time.Duration {
+	if s.Writes == 0 {
+		return 0
+	}
+	return s.WriteLatencyTotal / time.Duration(s.Writes)
+}
+
+// The bucket of WriteLatencyBounds latency falls in
+func latencyBucket(latency time.Duration) int {
+	for i, bound := range WriteLatencyBounds {
+		if latency <= bound {
+			return i
+		}
+	}
+	return len(WriteLatencyBounds)
+}
+
+// StatsCollector keeping counts in memory, read with Snapshot
+// Share one between connections to total them
+type MemoryStatsCollector struct {
+	enqueued, written, writtenBytes, writes uint64
+	acknowledged, failed, reconnects        uint64
+	filtered, connects, sendTimings         uint64
+	rateLimitWaits                          uint64
+	queueDepth                              int64
+	latencyTotal, latencyMax                int64
+	rateLimitWaited, throttledFor           int64
+	//DNS, Dial, Handshake and Total of every ConnectTiming
+	connectTotals [4]int64
+	//each phase of every SendTiming, in the order of its fields
+	sendTotals         [8]int64
+	latencyBuckets     []uint64
+	sendLatencyBuckets []uint64
+
+	failedLock     *sync.Mutex
+	failedByReason map[string]uint64
+	//guarded by failedLock too
+	throttled map[int]uint64
+}
+
+func NewMemoryStatsCollector() *MemoryStatsCollector {
+	return &MemoryStatsCollector{
+		latencyBuckets:     make([]uint64, len(WriteLatencyBounds)+1),
+		sendLatencyBuckets: make([]uint64, len(WriteLatencyBounds)+1),
+		failedLock:         new(sync.Mutex),
+		failedByReason:     make(map[string]uint64),
+		throttled:          make(map[int]uint64),
+	}
+}
+
+func (s *MemoryStatsCollector) OnEnqueued(payload *Payload) {
+	atomic.AddUint64(&s.enqueued, 1)
+}
+
+func (s *MemoryStatsCollector) OnQueueDepth(depth int) {
+	atomic.StoreInt64(&s.queueDepth, int64(depth))
+}
+
+func (s *MemoryStatsCollector) OnWritten(payloads int, bytes int, latency time.Duration) {
+	atomic.AddUint64(&s.written, uint64(payloads))
+	atomic.AddUint64(&s.writtenBytes, uint64(bytes))
+	atomic.AddUint64(&s.writes, 1)
+	atomic.AddInt64(&s.latencyTotal, int64(latency))
+	for {
+		max := atomic.LoadInt64(&s.latencyMax)
+		if int64(latency) <= max || atomic.CompareAndSwapInt64(&s.latencyMax, max, int64(latency)) {
+			break
+		}
+	}
+	atomic.AddUint64(&s.latencyBuckets[latencyBucket(latency)], 1)
+}
+
+func (s *MemoryStatsCollector) OnAcknowledged(payload *Payload) {
+	atomic.AddUint64(&s.acknowledged, 1)
+}
+
+func (s *MemoryStatsCollector) OnFailed(err *SendError) {
+	if err.Kind == FailureFiltered {
+		atomic.AddUint64(&s.filtered, 1)
+		return
+	}
+	atomic.AddUint64(&s.failed, 1)
+	reason := string(err.Reason)
+	if reason == "" {
+		reason = err.Kind.String()
+	}
+	s.failedLock.Lock()
+	s.failedByReason[reason]++
+	s.failedLock.Unlock()
+}
+
+func (s *MemoryStatsCollector) OnReconnect() {
+	atomic.AddUint64(&s.reconnects, 1)
+}
+
+func (s *MemoryStatsCollector) OnConnected(timing ConnectTiming) {
+	atomic.AddUint64(&s.connects, 1)
+	for i, phase := range []time.Duration{timing.DNS, timing.Dial, timing.Handshake, timing.Total} {
+		atomic.AddInt64(&s.connectTotals[i], int64(phase))
+	}
+}
+
+func (s *MemoryStatsCollector) OnSendTiming(timing SendTiming) {
+	atomic.AddUint64(&s.sendTimings, 1)
+	for i, phase := range []time.Duration{timing.Reopen, timing.Marshal, timing.Buffered, timing.Wait,
+		timing.Connect, timing.Write, timing.FirstByte, timing.Total} {
+		atomic.AddInt64(&s.sendTotals[i], int64(phase))
+	}
+	atomic.AddUint64(&s.sendLatencyBuckets[latencyBucket(timing.Total)], 1)
+}
+
+func (s *MemoryStatsCollector) OnRateLimited(wait time.Duration) {
+	atomic.AddUint64(&s.rateLimitWaits, 1)
+	atomic.AddInt64(&s.rateLimitWaited, int64(wait))
+}
+
+func (s *MemoryStatsCollector) OnThrottled(payload *Payload, attempt ThrottleAttempt) {
+	atomic.AddInt64(&s.throttledFor, int64(attempt.RetryAfter))
+	s.failedLock.Lock()
+	s.throttled[attempt.StatusCode]++
+	s.failedLock.Unlock()
+}
+
+// The counts so far
+func (s *MemoryStatsCollector) Snapshot() StatsSnapshot {
+	snapshot := StatsSnapshot{
+		Enqueued:            atomic.LoadUint64(&s.enqueued),
+		Written:             atomic.LoadUint64(&s.written),
+		WrittenBytes:        atomic.LoadUint64(&s.writtenBytes),
+		Writes:              atomic.LoadUint64(&s.writes),
+		Acknowledged:        atomic.LoadUint64(&s.acknowledged),
+		Failed:              atomic.LoadUint64(&s.failed),
+		Filtered:            atomic.LoadUint64(&s.filtered),
+		Reconnects:          atomic.LoadUint64(&s.reconnects),
+		QueueDepth:          int(atomic.LoadInt64(&s.queueDepth)),
+		WriteLatencyTotal:   time.Duration(atomic.LoadInt64(&s.latencyTotal)),
+		WriteLatencyMax:     time.Duration(atomic.LoadInt64(&s.latencyMax)),
+		WriteLatencyBuckets: make([]uint64, len(s.latencyBuckets)),
+		FailedByReason:      make(map[string]uint64),
+		Connects:            atomic.LoadUint64(&s.connects),
+		SendTimings:         atomic.LoadUint64(&s.sendTimings),
+		SendLatencyBuckets:  make([]uint64, len(s.sendLatencyBuckets)),
+		RateLimitWaits:      atomic.LoadUint64(&s.rateLimitWaits),
+		RateLimitWaited:     time.Duration(atomic.LoadInt64(&s.rateLimitWaited)),
+		Throttled:           make(map[int]uint64),
+		ThrottledFor:        time.Duration(atomic.LoadInt64(&s.throttledFor)),
+	}
+	for i := range s.latencyBuckets {
+		snapshot.WriteLatencyBuckets[i] = atomic.LoadUint64(&s.latencyBuckets[i])
+		snapshot.SendLatencyBuckets[i] = atomic.LoadUint64(&s.sendLatencyBuckets[i])
+	}
+	connect := make([]time.Duration, len(s.connectTotals))
+	for i := range s.connectTotals {
+		connect[i] = time.Duration(atomic.LoadInt64(&s.connectTotals[i]))
+	}
+	snapshot.ConnectTiming = ConnectTiming{DNS: connect[0], Dial: connect[1], Handshake: connect[2], Total: connect[3]}
+	send := make([]time.Duration, len(s.sendTotals))
+	for i := range s.sendTotals {
+		send[i] = time.Duration(atomic.LoadInt64(&s.sendTotals[i]))
+	}
+	snapshot.SendTimingTotal = SendTiming{Reopen: send[0], Marshal: send[1], Buffered: send[2], Wait: send[3],
+		Connect: send[4], Write: send[5], FirstByte: send[6], Total: send[7]}
+	s.failedLock.Lock()
+	for reason, count := range s.failedByReason {
+		snapshot.FailedByReason[reason] = count
+	}
+	for status, count := range s.throttled {
+		snapshot.Throttled[status] = count
+	}
+	s.failedLock.Unlock()
+	return snapshot
+}
@@ -0,0 +1,171 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStatsCollectorShouldCountSends(t *testing.T) {
+	stats := NewMemoryStatsCollector()
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	config.StatsCollector = stats
+	conn := socketAPNSConnection(socket, config)
+
+	for i := 0; i < 3; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+	invalid := groupTestPayload(3)
+	invalid.Token = "not a token"
+	conn.SendChannel <- invalid
+	if _, err := conn.Send(context.Background(), groupTestPayload(4)); err != nil {
+		t.Fatal(err)
+	}
+	waitForSocketSends(t, socket, 4)
+
+	socket.reject(8, 1)
+	<-conn.CloseChannel
+	snapshot := stats.Snapshot()
+	if snapshot.Enqueued != 5 || snapshot.Written != 4 || snapshot.Writes == 0 || snapshot.WrittenBytes == 0 {
+		t.Error(fmt.Sprintf("Unexpected write counts %+v", snapshot))
+	}
+	if snapshot.Acknowledged != 1 || snapshot.Failed != 2 || snapshot.FailedByReason[string(BinaryReasonInvalidToken)] != 1 ||
+		snapshot.FailedByReason[FailureInvalidPayload.String()] != 1 {
+		t.Error(fmt.Sprintf("Unexpected outcomes %+v", snapshot))
+	}
+	writes := uint64(0)
+	for _, count := range snapshot.WriteLatencyBuckets {
+		writes += count
+	}
+	if writes != snapshot.Writes || snapshot.WriteLatencyMax < snapshot.WriteLatencyMean() {
+		t.Error(fmt.Sprintf("Unexpected latencies %+v", snapshot))
+	}
+}
+
+func TestMemoryStatsCollectorShouldReportQueueDepth(t *testing.T) {
+	stats := NewMemoryStatsCollector()
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	config.StatsCollector = stats
+	//the second payload holds up the connection waiting for the rate limiter
+	config.MaxNotificationsPerSecond = 0.001
+	config.SendQueueSize = 2
+	config.QueueFullPolicy = QueueDropNewest
+	conn := socketAPNSConnection(socket, config)
+	for i := 0; i < 2; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+	for i := 2; i < 4; i++ {
+		if err := conn.Enqueue(groupTestPayload(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if depth := stats.Snapshot().QueueDepth; depth != 2 {
+		t.Error(fmt.Sprintf("Expected 2 payloads queued but got %v", depth))
+	}
+	conn.Disconnect()
+	<-conn.CloseChannel
+}
+
+func TestMemoryStatsCollectorShouldCountReconnects(t *testing.T) {
+	stats := NewMemoryStatsCollector()
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig: &APNSConfig{InFlightPayloadBufferSize: 100, FramingTimeout: 1, MaxPayloadSize: 2048,
+			StatsCollector: stats},
+		ReconnectBaseDelay: 1,
+		dial:               dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer.socket(0).Close()
+	conn.SendChannel <- groupTestPayload(0)
+	waitForPoolSends(t, dialer, []int{0, 1})
+	conn.Close()
+	for range conn.CloseChannel {
+	}
+	if reconnects := stats.Snapshot().Reconnects; reconnects != 1 {
+		t.Error(fmt.Sprintf("Expected a reconnect but got %v", reconnects))
+	}
+}
+
+func TestMemoryStatsCollectorShouldCountHTTP2Responses(t *testing.T) {
+	requests := 0
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"reason":"BadDeviceToken"}`)
+		}
+	})
+	defer server.Close()
+	stats := NewMemoryStatsCollector()
+	config.StatsCollector = stats
+	conn, err := NewHTTP2Connection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Send(context.Background(), http2TestPayload()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := stats.Snapshot()
+	if snapshot.Enqueued != 2 || snapshot.Writes != 2 || snapshot.Written != 2 || snapshot.Acknowledged != 1 ||
+		snapshot.Failed != 1 || snapshot.FailedByReason[string(ReasonBadDeviceToken)] != 1 {
+		t.Error(fmt.Sprintf("Unexpected counts %+v", snapshot))
+	}
+}
+
+func TestMemoryStatsCollectorLatencyBuckets(t *testing.T) {
+	stats := NewMemoryStatsCollector()
+	for _, latency := range []time.Duration{time.Millisecond, 2 * time.Millisecond, 2 * time.Second} {
+		stats.OnWritten(1, 10, latency)
+	}
+	snapshot := stats.Snapshot()
+	buckets := snapshot.WriteLatencyBuckets
+	if buckets[0] != 1 || buckets[1] != 1 || buckets[len(buckets)-1] != 1 || snapshot.WriteLatencyMax != 2*time.Second {
+		t.Error(fmt.Sprintf("Unexpected buckets %v", snapshot))
+	}
+	if mean := snapshot.WriteLatencyMean(); mean != 2003*time.Millisecond/3 {
+		t.Error(fmt.Sprintf("Unexpected mean %v", mean))
+	}
+}
+
+// A socket that discards what is written
+type statsBenchmarkSocket struct {
+	*poolTestSocket
+}
+
+func (s statsBenchmarkSocket) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func benchmarkSendWithStats(b *testing.B, stats StatsCollector) {
+	config := shutdownTestConfig()
+	config.StatsCollector = stats
+	conn := socketAPNSConnection(statsBenchmarkSocket{newPoolTestSocket()}, config)
+	payload := groupTestPayload(0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.SendChannel <- payload
+	}
+	conn.Disconnect()
+	<-conn.CloseChannel
+}
+
+func BenchmarkSendNoopStats(b *testing.B) {
+	benchmarkSendWithStats(b, NoopStatsCollector{})
+}
+
+func BenchmarkSendMemoryStats(b *testing.B) {
+	benchmarkSendWithStats(b, NewMemoryStatsCollector())
+}
@@ -0,0 +1,179 @@
+package apns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Anything payloads can be sent on and waited for, an APNSConnection,
+// APNSConnectionPool or HTTP2Connection
+type Sender interface {
+	Send(ctx context.Context, payload *Payload) (*Result, error)
+}
+
+// Options for SendStream
+type StreamOptions struct {
+	// number of payloads waiting for apple's verdict at once, defaults to 100
+	Concurrency int
+	// longest line read, in bytes, longer lines are reported as malformed,
+	// defaults to 64KB
+	MaxLineSize int
+	// called with each payload's line number and outcome once resolved,
+	// may be called from many goroutines at once
+	OnResult func(line int, result *Result, err error)
+}
+
+// A line of a stream that couldn't be parsed into a payload
+type MalformedLine struct {
+	// line number, from 1
+	Line int
+	Err  error
+}
+
+// What happened to the lines of a stream passed to SendStream
+type StreamSummary struct {
+	// lines read, including blank and malformed ones
+	Lines int
+	// payloads apple accepted
+	Sent int
+	// payloads apple rejected, counted by reason
+	Failed map[ErrorReason]int
+	// line numbers of payloads that weren't resolved, because the
+	// connection closed or the send was cancelled, in order. They may
+	// have reached apple, so resending them could deliver some twice
+	Unsent []int
+	// line numbers of payloads the sender's TokenFilter refused, in order
+	Filtered []int
+	// lines that couldn't be parsed, which were skipped
+	Malformed []MalformedLine
+}
+
+// Send a notification for every line of r, each a json document as
+// taken by ParsePayload, e.g. a bulk export, without reading it all in
+// Up to Concurrency payloads are sent at once with sender's Send, so
+// reading blocks while the connection is backed up. Blank lines are
+// skipped, and malformed ones reported in the summary without stopping
+// the stream
+// Returns once every payload read is resolved. If ctx is done reading
+// stops and the payloads still waiting are reported as Unsent, along
+// with ctx.Err(). An error reading r is returned likewise once the
+// payloads already read are resolved
+func SendStream(ctx context.Context, sender Sender, r io.Reader, options StreamOptions) (*StreamSummary, error) {
+	if options.Concurrency < 0 || options.MaxLineSize < 0 {
+		return nil, errors.New("Invalid StreamOptions. Concurrency and MaxLineSize should be >= 0.")
+	}
+	if options.Concurrency == 0 {
+		options.Concurrency = 100
+	}
+	if options.MaxLineSize == 0 {
+		options.MaxLineSize = 64 * 1024
+	}
+
+	summary := &StreamSummary{Failed: make(map[ErrorReason]int)}
+	summaryLock := new(sync.Mutex)
+	slots := make(chan bool, options.Concurrency)
+	wg := new(sync.WaitGroup)
+	reader := bufio.NewReader(r)
+
+	var streamErr error
+	for streamErr == nil {
+		if streamErr = ctx.Err(); streamErr != nil {
+			break
+		}
+		line, tooLong, readErr := readStreamLine(reader, options.MaxLineSize)
+		if readErr != nil && (readErr != io.EOF || (len(line) == 0 && !tooLong)) {
+			if readErr != io.EOF {
+				streamErr = readErr
+			}
+			break
+		}
+		summary.Lines++
+		lineNumber := summary.Lines
+
+		if tooLong {
+			err := errors.New(fmt.Sprintf("Line is longer than %v bytes", options.MaxLineSize))
+			summary.Malformed = append(summary.Malformed, MalformedLine{lineNumber, err})
+			continue
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		payload, err := ParsePayload(line)
+		if err != nil {
+			summary.Malformed = append(summary.Malformed, MalformedLine{lineNumber, err})
+			continue
+		}
+
+		select {
+		case slots <- true:
+		case <-ctx.Done():
+			summaryLock.Lock()
+			summary.Unsent = append(summary.Unsent, lineNumber)
+			summaryLock.Unlock()
+			streamErr = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := sender.Send(ctx, payload)
+			<-slots
+			summaryLock.Lock()
+			switch {
+			case errors.Is(err, ErrTokenFiltered):
+				summary.Filtered = append(summary.Filtered, lineNumber)
+			case err != nil:
+				summary.Unsent = append(summary.Unsent, lineNumber)
+			case result.Accepted():
+				summary.Sent++
+			default:
+				summary.Failed[result.Reason]++
+			}
+			summaryLock.Unlock()
+			if options.OnResult != nil {
+				options.OnResult(lineNumber, result, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Ints(summary.Unsent)
+	sort.Ints(summary.Filtered)
+	if streamErr == nil {
+		streamErr = ctx.Err()
+	}
+	return summary, streamErr
+}
+
+// Read a line without its newline, discarding the rest of a line longer
+// than maxLineSize
+// Returns io.EOF with the last line if it has no newline
+func readStreamLine(reader *bufio.Reader, maxLineSize int) ([]byte, bool, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > maxLineSize+1 {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		if tooLong || len(line) > maxLineSize {
+			return nil, true, err
+		}
+		return line, false, err
+	}
+}
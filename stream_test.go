@@ -0,0 +1,94 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func streamTestLine(i int) string {
+	return fmt.Sprintf(`{"token": "%064x", "alert": "Testing%v"}`, i+1, i)
+}
+
+func TestSendStream(t *testing.T) {
+	server, _, app := newManagerTestApps(t)
+	conn, err := NewHTTP2Connection(app.HTTP2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server.RejectToken(fmt.Sprintf("%064x", 3), "BadDeviceToken")
+
+	lines := []string{streamTestLine(0), "", streamTestLine(1), `{"token": "nope"`, streamTestLine(2),
+		`{"token": "` + builderTestToken + `", "colour": "red"}`, strings.Repeat("x", 300)}
+	for i := 3; i < 50; i++ {
+		lines = append(lines, streamTestLine(i))
+	}
+	resultsLock := new(sync.Mutex)
+	results := 0
+	summary, err := SendStream(context.Background(), conn, strings.NewReader(strings.Join(lines, "\n")),
+		StreamOptions{Concurrency: 4, MaxLineSize: 256, OnResult: func(line int, result *Result, err error) {
+			resultsLock.Lock()
+			results++
+			resultsLock.Unlock()
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.Lines != len(lines) || summary.Sent != 49 || !reflect.DeepEqual(summary.Failed, map[ErrorReason]int{"BadDeviceToken": 1}) ||
+		len(summary.Unsent) != 0 || results != 50 {
+		t.Error(fmt.Sprintf("Expected 49 sent and 1 rejected of %v lines but got %+v", len(lines), summary))
+	}
+	if len(summary.Malformed) != 3 || summary.Malformed[0].Line != 4 || summary.Malformed[1].Line != 6 ||
+		summary.Malformed[2].Line != 7 || !strings.Contains(summary.Malformed[2].Err.Error(), "longer than 256") {
+		t.Error(fmt.Sprintf("Expected lines 4, 6 and 7 to be malformed but got %+v", summary.Malformed))
+	}
+	if received := server.Received(); len(received) != 50 {
+		t.Error(fmt.Sprintf("Expected 50 notifications but got %v", len(received)))
+	}
+}
+
+// Accepts the first accept payloads, then blocks until the send is cancelled
+type blockingSender struct {
+	lock   *sync.Mutex
+	accept int
+}
+
+func (s *blockingSender) Send(ctx context.Context, payload *Payload) (*Result, error) {
+	s.lock.Lock()
+	s.accept--
+	accept := s.accept >= 0
+	s.lock.Unlock()
+	if accept {
+		return acceptedResult(payload), nil
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSendStreamShouldStopWhenCancelled(t *testing.T) {
+	lines := make([]string, 1000)
+	for i := range lines {
+		lines[i] = streamTestLine(i)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	started := time.Now()
+	summary, err := SendStream(ctx, &blockingSender{lock: new(sync.Mutex), accept: 10},
+		strings.NewReader(strings.Join(lines, "\n")), StreamOptions{Concurrency: 5})
+	if err != context.Canceled {
+		t.Error(fmt.Sprintf("Expected the stream to be cancelled but got %v", err))
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Error(fmt.Sprintf("Expected the stream to stop promptly but took %v", elapsed))
+	}
+	if summary.Sent != 10 || len(summary.Unsent) != summary.Lines-10 || summary.Lines >= len(lines) {
+		t.Error(fmt.Sprintf("Expected 10 sent and the rest read unsent but got %+v", summary))
+	}
+}
@@ -0,0 +1,77 @@
+package apns
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Why a connection was closed for taking too long, see
+// ConnectionClose.Timeout
+type TimeoutError struct {
+	// "write" when a frame took longer than APNSConfig.WriteTimeout to
+	// write, "read" when nothing was written for APNSConfig.ReadTimeout,
+	// "ack" when written data went unacknowledged for
+	// APNSConfig.LivenessTimeout
+	Op string
+	// The timeout that passed
+	After time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("Connection timed out after %v waiting to %v", e.After, e.Op)
+}
+
+// Always true, as for a net.Error
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Duration of a timeout config field in seconds, 0 for no timeout
+// (negative)
+func timeoutSeconds(seconds int) time.Duration {
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Whether err is a socket operation passing its deadline
+func isTimeout(err error) bool {
+	netErr := net.Error(nil)
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Remember the first timeout to close the connection, to report it in the
+// ConnectionClose
+func (c *APNSConnection) setTimedOut(op string, after time.Duration) {
+	c.timeoutLock.Lock()
+	defer c.timeoutLock.Unlock()
+	if c.timedOut == nil {
+		c.timedOut = &TimeoutError{Op: op, After: after}
+	}
+}
+
+func (c *APNSConnection) timeoutError() *TimeoutError {
+	c.timeoutLock.Lock()
+	defer c.timeoutLock.Unlock()
+	return c.timedOut
+}
+
+// Close the socket after a timeout, skipping tls's close_notify which
+// would wait on the stalled connection again
+func (c *APNSConnection) closeTimedOut() {
+	if tlsSocket, ok := c.socket.(*tls.Conn); ok {
+		tlsSocket.NetConn().Close()
+	}
+	c.socket.Close()
+}
+
+// Push the idle deadline back to ReadTimeout from now, after a write
+func (c *APNSConnection) extendReadDeadline() {
+	if readTimeout := timeoutSeconds(c.config.ReadTimeout); readTimeout > 0 {
+		c.socket.SetReadDeadline(time.Now().Add(readTimeout))
+	}
+}
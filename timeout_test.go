@@ -0,0 +1,298 @@
+package apns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Config for a pipe gateway served by serve, with every timeout a second
+func timeoutTestConfig(t *testing.T, serve func(socket *tls.Conn)) *APNSConfig {
+	chain := newPinningTestChain(t)
+	dialer := &pipeTestDialer{chain: chain, lock: new(sync.Mutex), serve: serve}
+	certPEM, keyPEM := generateTestClientCert(t, "com.example.app")
+	return &APNSConfig{
+		CertificateBytes:       certPEM,
+		KeyBytes:               keyPEM,
+		GatewayHost:            "gateway.example.com",
+		RootCAs:                chain.roots,
+		IgnoreProxyEnvironment: true,
+		Dialer:                 dialer.dial,
+		FramingTimeout:         1,
+		SocketTimeout:          1,
+		TlsTimeout:             1,
+		WriteTimeout:           1,
+		ReadTimeout:            1,
+	}
+}
+
+// Read frames, recording their tokens, until the socket closes
+func readTimeoutTestFrames(socket io.Reader, tokens chan string) {
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(socket, header); err != nil {
+			return
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(socket, frame); err != nil {
+			return
+		}
+		//the token item comes first
+		tokens <- hex.EncodeToString(frame[3:35])
+	}
+}
+
+func TestTimeoutShouldBoundDialing(t *testing.T) {
+	config := timeoutTestConfig(t, nil)
+	config.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	start := time.Now()
+	_, err := NewAPNSConnection(config)
+	if err == nil || time.Since(start) > 3*time.Second {
+		t.Error(fmt.Sprintf("Expected dialing to time out after a second but got %v after %v", err, time.Since(start)))
+	}
+}
+
+func TestTimeoutShouldBoundTheHandshake(t *testing.T) {
+	config := timeoutTestConfig(t, nil)
+	stall := make(chan bool)
+	defer close(stall)
+	config.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			//read the client hello and never answer
+			server.Read(make([]byte, 1024))
+			<-stall
+			server.Close()
+		}()
+		return client, nil
+	}
+	start := time.Now()
+	_, err := NewAPNSConnection(config)
+	if !isTimeout(err) || time.Since(start) > 3*time.Second {
+		t.Error(fmt.Sprintf("Expected the handshake to time out after a second but got %v after %v", err, time.Since(start)))
+	}
+}
+
+func TestTimeoutShouldCloseAStalledWrite(t *testing.T) {
+	stall := make(chan bool)
+	defer close(stall)
+	//never reads, so the first frame can't be written
+	config := timeoutTestConfig(t, func(socket *tls.Conn) {
+		<-stall
+	})
+	//not idle while the write is stuck
+	config.ReadTimeout = 5
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SendChannel <- groupTestPayload(0)
+	conn.SendChannel <- groupTestPayload(1)
+	select {
+	case connectionClose := <-conn.CloseChannel:
+		if connectionClose.Timeout == nil || connectionClose.Timeout.Op != "write" || connectionClose.Timeout.After != time.Second {
+			t.Error(fmt.Sprintf("Expected a write timeout but got %v", connectionClose))
+		}
+		if connectionClose.Error.ErrorCode != 10 || connectionClose.UnsentPayloads.Len() != 1 || connectionClose.ErrorPayload == nil {
+			t.Error(fmt.Sprintf("Expected both payloads to be handed back but got %v", connectionClose))
+		}
+		if !strings.Contains(connectionClose.String(), "timeout: Connection timed out after 1s waiting to write") {
+			t.Error(fmt.Sprintf("Expected the timeout in the summary but got %v", connectionClose))
+		}
+		stalled, timeout := connectionClose.StalledWrite, &TimeoutError{}
+		if stalled == nil || stalled.Stalled < time.Second || stalled.Written != 0 || stalled.Size == 0 ||
+			stalled.Payloads == 0 || !errors.As(stalled, &timeout) || timeout.Op != "write" {
+			t.Error(fmt.Sprintf("Expected the stalled write of the first frame but got %+v", stalled))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the stalled write to close the connection")
+	}
+}
+
+// Reads at about bytesPerSecond
+type slowTimeoutTestReader struct {
+	reader         io.Reader
+	bytesPerSecond int
+}
+
+func (r *slowTimeoutTestReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	time.Sleep(time.Duration(n) * time.Second / time.Duration(r.bytesPerSecond))
+	return n, err
+}
+
+func TestTimeoutShouldNotStallALargeWrite(t *testing.T) {
+	tokens := make(chan string, 40)
+	//a full frame takes over WriteTimeout, each 16KB chunk of it half
+	config := timeoutTestConfig(t, func(socket *tls.Conn) {
+		readTimeoutTestFrames(&slowTimeoutTestReader{reader: socket, bytesPerSecond: 32 * 1024}, tokens)
+	})
+	config.FramingTimeout = 500
+	config.ReadTimeout = 10
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 30; i++ {
+		payload := groupTestPayload(i)
+		payload.CustomFields = map[string]interface{}{"padding": strings.Repeat("x", 1800)}
+		conn.SendChannel <- payload
+	}
+	deadline := time.After(10 * time.Second)
+	for received := 0; received < 30; received++ {
+		select {
+		case <-tokens:
+		case connectionClose := <-conn.CloseChannel:
+			t.Fatal(fmt.Sprintf("Expected the slow write to keep going but the connection closed with %v", connectionClose))
+		case <-deadline:
+			t.Fatal(fmt.Sprintf("Only %v of 30 payloads were written", received))
+		}
+	}
+	conn.Disconnect()
+	<-conn.CloseChannel
+}
+
+// A connection ignoring write deadlines, as one from a custom Dialer may
+type deadlineIgnoringConn struct {
+	net.Conn
+}
+
+func (c deadlineIgnoringConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func TestTimeoutWatchdogShouldCloseAStalledWrite(t *testing.T) {
+	stall := make(chan bool)
+	defer close(stall)
+	config := timeoutTestConfig(t, func(socket *tls.Conn) {
+		<-stall
+	})
+	config.ReadTimeout = 5
+	dial := config.Dialer
+	config.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return deadlineIgnoringConn{conn}, nil
+	}
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SendChannel <- groupTestPayload(0)
+	select {
+	case connectionClose := <-conn.CloseChannel:
+		stalled := connectionClose.StalledWrite
+		if stalled == nil || stalled.Stalled < time.Second+writeWatchdogGrace || connectionClose.ErrorPayload == nil {
+			t.Error(fmt.Sprintf("Expected the watchdog to close the stalled write but got %v", connectionClose))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the watchdog to close the connection")
+	}
+}
+
+func TestTimeoutShouldCloseAnIdleConnection(t *testing.T) {
+	tokens := make(chan string, 10)
+	config := timeoutTestConfig(t, func(socket *tls.Conn) {
+		readTimeoutTestFrames(socket, tokens)
+	})
+	start := time.Now()
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a write pushes the idle deadline back
+	time.Sleep(600 * time.Millisecond)
+	conn.SendChannel <- groupTestPayload(0)
+	select {
+	case connectionClose := <-conn.CloseChannel:
+		if connectionClose.Timeout == nil || connectionClose.Timeout.Op != "read" {
+			t.Error(fmt.Sprintf("Expected a read timeout but got %v", connectionClose))
+		}
+		if elapsed := time.Since(start); elapsed < 1400*time.Millisecond {
+			t.Error(fmt.Sprintf("Expected the write to keep the connection open but it closed after %v", elapsed))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the idle connection to be closed")
+	}
+	if len(tokens) != 1 {
+		t.Error(fmt.Sprintf("Expected the payload to be written but got %v", len(tokens)))
+	}
+}
+
+func TestTimeoutShouldReconnectAndResend(t *testing.T) {
+	stall := make(chan bool)
+	defer close(stall)
+	tokens := make(chan string, 10)
+	connections := int32(0)
+	config := timeoutTestConfig(t, func(socket *tls.Conn) {
+		//the first connection stalls, the rest read
+		if atomic.AddInt32(&connections, 1) == 1 {
+			<-stall
+			return
+		}
+		readTimeoutTestFrames(socket, tokens)
+	})
+	config.ReadTimeout = 5
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig:   config,
+		ReconnectBaseDelay: 1,
+		ReconnectMaxDelay:  10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+	received := map[string]bool{}
+	deadline := time.After(5 * time.Second)
+	for len(received) < 3 {
+		select {
+		case token := <-tokens:
+			received[token] = true
+		case <-deadline:
+			t.Fatal(fmt.Sprintf("Only %v of 3 payloads were resent", len(received)))
+		}
+	}
+	conn.Close()
+	for range conn.CloseChannel {
+	}
+
+	timedOut := false
+	for len(conn.EventChannel) > 0 {
+		if event := <-conn.EventChannel; event.Type == ReconnectDisconnected {
+			timedOut = timedOut || (event.Close.Timeout != nil && event.Close.Timeout.Op == "write" && event.Close.StalledWrite != nil)
+		}
+	}
+	if !timedOut {
+		t.Error("Expected a disconnect for the write timeout")
+	}
+}
+
+func TestTimeoutValidation(t *testing.T) {
+	config := timeoutTestConfig(t, nil)
+	config.WriteTimeout = -2
+	if _, err := NewAPNSConnection(config); err == nil || !strings.Contains(err.Error(), "WriteTimeout") {
+		t.Error(fmt.Sprintf("Expected an invalid WriteTimeout error but got %v", err))
+	}
+}
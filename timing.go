@@ -0,0 +1,65 @@
+package apns
+
+import (
+	"time"
+)
+
+// Timing breakdown of establishing a connection to the gateway
+type ConnectTiming struct {
+	// Time spent resolving the gateway host
+	DNS time.Duration
+	// Time spent establishing the tcp connection
+	Dial time.Duration
+	// Time spent on the tls handshake
+	Handshake time.Duration
+	// Total time from starting to resolve until the handshake completed
+	Total time.Duration
+	// Address of the gateway that was connected to, or of the proxy when
+	// connecting through one
+	Addr string
+	// Proxy connected through (see APNSConfig.ProxyURL), "" if direct
+	Proxy string
+	// Addresses of the gateway that failed to connect before Addr did, in
+	// the order they were tried (see APNSConfig.DialAttemptTimeout)
+	FailedAddrs []string
+	// Whether the tls handshake resumed a session from an earlier
+	// connection (see APNSConfig.TLSSessionCacheSize)
+	Resumed bool
+}
+
+// Timing breakdown of sending a single payload
+// The phases are contiguous so Reopen + Marshal + Buffered + Wait +
+// Connect + Write + FirstByte == Total. Over the binary protocol Wait,
+// Connect and FirstByte are 0, and over HTTP/2 (see Result.Timing) Reopen
+// and Buffered are
+type SendTiming struct {
+	// Time the payload waited for an APNSReconnectingConnection to reopen
+	// its connection after closing it for being idle (see
+	// APNSReconnectConfig.IdleTimeout), 0 for every other payload
+	Reopen time.Duration
+	// Time spent marshalling and framing the payload, over HTTP/2
+	// everything Send did before it was ready to post
+	Marshal time.Duration
+	// Time the framed payload waited in the frame buffer before being flushed
+	// (see APNSConfig.FramingTimeout)
+	Buffered time.Duration
+	// Time the HTTP/2 payload waited to be posted for the last time: paused
+	// while apple throttled it, along with the attempts before (see
+	// Result.Throttled)
+	Wait time.Duration
+	// Time the HTTP/2 request waited for a connection, dialing one if need
+	// be (see Connected)
+	Connect time.Duration
+	// Time spent writing the frame containing the payload to the socket, or
+	// the HTTP/2 request
+	Write time.Duration
+	// Time from the HTTP/2 request being written until the first byte of
+	// apple's response
+	FirstByte time.Duration
+	// Time from the connection receiving the payload off the SendChannel
+	// (or from the reopen starting) until the write completed, or from
+	// Send being called until apple's response over HTTP/2
+	Total time.Duration
+	// The connection dialed for the HTTP/2 request, nil if it reused one
+	Connected *ConnectTiming
+}
@@ -0,0 +1,220 @@
+package apns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+/**
+ * Mock connection that takes a while to complete writes
+ */
+type MockConnSlowWrite struct {
+	WrittenBytes *bytes.Buffer
+	CloseChannel chan bool
+	WriteDelay   time.Duration
+}
+
+func (conn MockConnSlowWrite) Read(b []byte) (n int, err error) {
+	<-conn.CloseChannel
+	return -1, errors.New("Socket Closed")
+}
+func (conn MockConnSlowWrite) Write(b []byte) (n int, err error) {
+	time.Sleep(conn.WriteDelay)
+	conn.WrittenBytes.Write(b)
+	return len(b), nil
+}
+func (conn MockConnSlowWrite) Close() error {
+	defer func() { conn.CloseChannel <- true }()
+	return nil
+}
+func (conn MockConnSlowWrite) LocalAddr() net.Addr {
+	return nil
+}
+func (conn MockConnSlowWrite) RemoteAddr() net.Addr {
+	return nil
+}
+func (conn MockConnSlowWrite) SetDeadline(t time.Time) error {
+	return nil
+}
+func (conn MockConnSlowWrite) SetReadDeadline(t time.Time) error {
+	return nil
+}
+func (conn MockConnSlowWrite) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func TestSendTimingShouldAddUpToObservedLatency(t *testing.T) {
+	writeDelay := 50 * time.Millisecond
+	framingTimeout := 10
+
+	socket := MockConnSlowWrite{
+		WrittenBytes: new(bytes.Buffer),
+		CloseChannel: make(chan bool, 1),
+		WriteDelay:   writeDelay,
+	}
+
+	timingChannel := make(chan SendTiming, 1)
+	apn := socketAPNSConnection(socket,
+		&APNSConfig{
+			InFlightPayloadBufferSize: 10000,
+			FramingTimeout:            framingTimeout,
+			MaxOutboundTCPFrameSize:   TCP_FRAME_MAX,
+			MaxPayloadSize:            2048,
+			SendTimingCallback: func(payload *Payload, timing SendTiming) {
+				timingChannel <- timing
+			},
+		})
+
+	payload := &Payload{
+		AlertText: "Testing",
+		Token:     "4ec500020d8350072d2417ba566feda10b2b266558371a65ba67fede21393c8f",
+	}
+
+	start := time.Now()
+	apn.SendChannel <- payload
+	timing := <-timingChannel
+	observed := time.Since(start)
+
+	if timing.Marshal+timing.Buffered+timing.Write != timing.Total {
+		t.Error(fmt.Sprintf("Expected phases to add up to total but got %+v", timing))
+	}
+	if timing.Write < writeDelay {
+		t.Error(fmt.Sprintf("Expected write phase of at least %v but got %v", writeDelay, timing.Write))
+	}
+	if timing.Buffered < time.Duration(framingTimeout)*time.Millisecond/2 {
+		t.Error(fmt.Sprintf("Expected buffered phase close to framing timeout but got %v", timing.Buffered))
+	}
+	tolerance := 20 * time.Millisecond
+	if timing.Total > observed || observed-timing.Total > tolerance {
+		t.Error(fmt.Sprintf("Expected total %v to be within %v of observed %v", timing.Total, tolerance, observed))
+	}
+
+	apn.Disconnect()
+}
+
+func TestHTTP2SendTimingShouldAddUpToObservedLatency(t *testing.T) {
+	delay := 100 * time.Millisecond
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+	})
+	defer server.Close()
+	stats := NewMemoryStatsCollector()
+	config.StatsCollector = stats
+	conn, err := NewHTTP2Connection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tolerance := 20 * time.Millisecond
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		result, err := conn.Send(context.Background(), http2TestPayload())
+		observed := time.Since(start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		timing := result.Timing
+		if timing.Marshal+timing.Wait+timing.Connect+timing.Write+timing.FirstByte != timing.Total ||
+			timing.Reopen != 0 || timing.Buffered != 0 {
+			t.Error(fmt.Sprintf("Expected phases to add up to total but got %+v", timing))
+		}
+		if timing.FirstByte < delay {
+			t.Error(fmt.Sprintf("Expected first byte phase of at least %v but got %v", delay, timing.FirstByte))
+		}
+		if timing.Total > observed || observed-timing.Total > tolerance {
+			t.Error(fmt.Sprintf("Expected total %v to be within %v of observed %v", timing.Total, tolerance, observed))
+		}
+		//the first request dials, the second reuses its connection
+		if i == 0 && (timing.Connected == nil || timing.Connected.Handshake == 0 ||
+			timing.Connected.Total < timing.Connected.Dial+timing.Connected.Handshake || timing.Connect < timing.Connected.Handshake) {
+			t.Error(fmt.Sprintf("Expected the first request to time its connection but got %+v", timing.Connected))
+		}
+		if i == 1 && timing.Connected != nil {
+			t.Error(fmt.Sprintf("Expected the second request to reuse the connection but got %+v", timing.Connected))
+		}
+	}
+
+	snapshot := stats.Snapshot()
+	buckets := uint64(0)
+	for _, count := range snapshot.SendLatencyBuckets {
+		buckets += count
+	}
+	if snapshot.Connects != 1 || snapshot.ConnectTiming.Handshake == 0 || snapshot.SendTimings != 2 ||
+		snapshot.SendTimingTotal.FirstByte < 2*delay || buckets != 2 {
+		t.Error(fmt.Sprintf("Expected the timings to be collected but got %+v", snapshot))
+	}
+}
+
+func TestSendTimingShouldBeCollected(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	stats := NewMemoryStatsCollector()
+	config := app.Pool.ConnectionConfig
+	config.StatsCollector = stats
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeQueueTestConnection(conn)
+
+	conn.SendChannel <- groupTestPayload(0)
+	if _, err := server.WaitForNotifications(1, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	//reported once the write returns, which may be after the server read it
+	deadline := time.Now().Add(time.Second)
+	for stats.Snapshot().SendTimings == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	snapshot := stats.Snapshot()
+	total := snapshot.SendTimingTotal
+	if snapshot.Connects != 1 || snapshot.ConnectTiming.Handshake != conn.ConnectTiming().Handshake ||
+		snapshot.SendTimings != 1 || total.Marshal+total.Buffered+total.Write != total.Total {
+		t.Error(fmt.Sprintf("Expected the connection and send to be timed but got %+v", snapshot))
+	}
+}
+
+func TestDialGatewayShouldRecordTiming(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	timing := ConnectTiming{}
+	socket, err := dialGateway(context.Background(), gatewayAddr{host: host, port: port, timeout: time.Second}, &timing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	if timing.Addr != listener.Addr().String() {
+		t.Error(fmt.Sprintf("Expected connected address %v but got %v", listener.Addr(), timing.Addr))
+	}
+	if timing.Dial <= 0 {
+		t.Error("Expected dial phase to be recorded")
+	}
+}
+
+func TestDialGatewayShouldFailWhenNothingListening(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	timing := ConnectTiming{}
+	_, err = dialGateway(context.Background(), gatewayAddr{host: host, port: port, timeout: time.Second}, &timing)
+	if err == nil {
+		t.Error("Expected dial to a closed port to fail")
+	}
+}
@@ -0,0 +1,116 @@
+package apns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// TLS settings for the connection to apple, for APNSConfig.TLS,
+// HTTP2Config.TLS and APNSFeedbackServiceConfig.TLS
+// Anything left unset (or a nil *TLSOptions) uses the crypto/tls default
+type TLSOptions struct {
+	// minimum TLS version, e.g. tls.VersionTLS12, defaults to crypto/tls's (TLS 1.2)
+	MinVersion uint16
+	// maximum TLS version, defaults to the newest crypto/tls supports
+	MaxVersion uint16
+	// cipher suites to offer for TLS 1.2 and below, defaults to crypto/tls's
+	// TLS 1.3 suites can't be configured
+	CipherSuites []uint16
+	// name to verify the host's certificate for, defaults to the host
+	ServerName string
+	// DANGEROUS: don't verify the host's certificate at all, so anyone
+	// between you and apple can read and change push traffic. Only for an
+	// intercepting proxy that can't be trusted with RootCAs instead
+	DangerousInsecureSkipVerify bool
+	// optional complete config to start from. It's cloned and given the
+	// client certificate and any of the options above that are set, along
+	// with RootCAs, ServerName and pinning unless it has its own
+	Base *tls.Config
+}
+
+// Error message for contradictory options, "" if they're valid
+func validateTLSOptions(options *TLSOptions, pins []string) string {
+	if options == nil {
+		return ""
+	}
+	errorStrs := ""
+
+	for _, version := range []uint16{options.MinVersion, options.MaxVersion} {
+		if version != 0 && (version < tls.VersionTLS10 || version > tls.VersionTLS13) {
+			errorStrs += fmt.Sprintf("Invalid TLS version %#x. Should be between tls.VersionTLS10 and tls.VersionTLS13.\n", version)
+		}
+	}
+	if options.MinVersion != 0 && options.MaxVersion != 0 && options.MinVersion > options.MaxVersion {
+		errorStrs += "Invalid TLS MinVersion. Should be <= MaxVersion.\n"
+	}
+
+	if len(options.CipherSuites) > 0 && options.MinVersion == tls.VersionTLS13 {
+		errorStrs += "Invalid TLS CipherSuites. They don't apply with a MinVersion of TLS 1.3.\n"
+	}
+	known := map[uint16]bool{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.ID] = true
+	}
+	for _, suite := range options.CipherSuites {
+		if !known[suite] {
+			errorStrs += fmt.Sprintf("Invalid TLS cipher suite %#x.\n", suite)
+		}
+	}
+
+	skipVerify := options.DangerousInsecureSkipVerify || (options.Base != nil && options.Base.InsecureSkipVerify)
+	if skipVerify && len(pins) > 0 {
+		errorStrs += "Invalid PinnedPublicKeys. Pinning needs the certificate verified, so can't be used with InsecureSkipVerify.\n"
+	}
+	return errorStrs
+}
+
+// The tls.Config for connecting to host with the client certificates
+func newTLSConfig(options *TLSOptions, host string, rootCAs *x509.CertPool, pins []string, certificates []tls.Certificate) *tls.Config {
+	if options == nil {
+		options = &TLSOptions{}
+	}
+	tlsConf := &tls.Config{}
+	if options.Base != nil {
+		tlsConf = options.Base.Clone()
+	}
+	if certificates != nil {
+		tlsConf.Certificates = certificates
+	}
+
+	if options.ServerName != "" {
+		tlsConf.ServerName = options.ServerName
+	} else if tlsConf.ServerName == "" {
+		tlsConf.ServerName = host
+	}
+	if tlsConf.RootCAs == nil {
+		tlsConf.RootCAs = rootCAs
+	}
+	if options.MinVersion != 0 {
+		tlsConf.MinVersion = options.MinVersion
+	}
+	if options.MaxVersion != 0 {
+		tlsConf.MaxVersion = options.MaxVersion
+	}
+	if options.CipherSuites != nil {
+		tlsConf.CipherSuites = options.CipherSuites
+	}
+	if options.DangerousInsecureSkipVerify {
+		tlsConf.InsecureSkipVerify = true
+	}
+
+	if verifyPins := pinnedPublicKeyVerifier(host, pins); verifyPins != nil {
+		//run after the base config's own check
+		if verify := tlsConf.VerifyPeerCertificate; verify != nil {
+			tlsConf.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+				if err := verify(rawCerts, verifiedChains); err != nil {
+					return err
+				}
+				return verifyPins(rawCerts, verifiedChains)
+			}
+		} else {
+			tlsConf.VerifyPeerCertificate = verifyPins
+		}
+	}
+	return tlsConf
+}
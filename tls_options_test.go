@@ -0,0 +1,167 @@
+package apns
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Connect to the chain's listener with options, returning the server's
+// side of the handshake
+func connectWithTLSOptions(t *testing.T, chain *pinningTestChain, options *TLSOptions, roots bool) (tls.ConnectionState, error) {
+	listener, host, port := chain.listen(t)
+	defer listener.Close()
+	certPEM, keyPEM := generateTestClientCert(t, "com.example.app")
+	config := &APNSConfig{
+		CertificateBytes: certPEM,
+		KeyBytes:         keyPEM,
+		GatewayHost:      host,
+		GatewayPort:      port,
+		TLS:              options,
+	}
+	if roots {
+		config.RootCAs = chain.roots
+	}
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	conn.Disconnect()
+	<-conn.CloseChannel
+	select {
+	case state := <-chain.states:
+		return state, nil
+	case <-time.After(time.Second):
+		t.Fatal("Expected the server to complete the handshake")
+		return tls.ConnectionState{}, nil
+	}
+}
+
+func TestTLSOptionsShouldDefaultToCryptoTLS(t *testing.T) {
+	state, err := connectWithTLSOptions(t, newPinningTestChain(t), nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != tls.VersionTLS13 || state.ServerName != "" {
+		t.Error(fmt.Sprintf("Expected TLS 1.3 without a server name for an ip but got %#x and %q", state.Version, state.ServerName))
+	}
+	if len(state.PeerCertificates) != 1 {
+		t.Error("Expected the client certificate to be presented")
+	}
+}
+
+func TestTLSOptionsShouldLimitVersionAndCipherSuites(t *testing.T) {
+	state, err := connectWithTLSOptions(t, newPinningTestChain(t), &TLSOptions{
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != tls.VersionTLS12 || state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 {
+		t.Error(fmt.Sprintf("Expected TLS 1.2 with the chosen suite but got %#x and %v", state.Version, tls.CipherSuiteName(state.CipherSuite)))
+	}
+}
+
+func TestTLSOptionsShouldOverrideServerName(t *testing.T) {
+	state, err := connectWithTLSOptions(t, newPinningTestChain(t), &TLSOptions{ServerName: "gateway.example.com"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.ServerName != "gateway.example.com" {
+		t.Error(fmt.Sprintf("Expected the overridden server name but got %q", state.ServerName))
+	}
+
+	if _, err := connectWithTLSOptions(t, newPinningTestChain(t), &TLSOptions{ServerName: "other.example.com"}, true); err == nil {
+		t.Error("Expected a server name the certificate isn't for to fail")
+	}
+}
+
+func TestTLSOptionsShouldSkipVerifyWhenAsked(t *testing.T) {
+	chain := newPinningTestChain(t)
+	if _, err := connectWithTLSOptions(t, chain, nil, false); err == nil {
+		t.Error("Expected an unknown authority to fail")
+	}
+	if _, err := connectWithTLSOptions(t, chain, &TLSOptions{DangerousInsecureSkipVerify: true}, false); err != nil {
+		t.Error(fmt.Sprintf("Expected to connect without verifying but got %v", err))
+	}
+}
+
+func TestTLSOptionsShouldAugmentBaseConfig(t *testing.T) {
+	chain := newPinningTestChain(t)
+	base := &tls.Config{MinVersion: tls.VersionTLS13, RootCAs: chain.roots}
+	state, err := connectWithTLSOptions(t, chain, &TLSOptions{Base: base}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != tls.VersionTLS13 || len(state.PeerCertificates) != 1 {
+		t.Error(fmt.Sprintf("Expected TLS 1.3 with the client certificate but got %#x and %v certificates", state.Version, len(state.PeerCertificates)))
+	}
+	if base.Certificates != nil || base.ServerName != "" {
+		t.Error("Expected the base config to be left alone")
+	}
+}
+
+func TestTLSOptionsHTTP2(t *testing.T) {
+	chain := newPinningTestChain(t)
+	var version uint16
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version = r.TLS.Version
+	}))
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{chain.server}}
+	server.StartTLS()
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	certPEM, keyPEM := generateTestClientCert(t, "com.example.app")
+	conn, err := NewHTTP2Connection(&HTTP2Config{
+		CertificateBytes: certPEM,
+		KeyBytes:         keyPEM,
+		Host:             host,
+		Port:             port,
+		RootCAs:          chain.roots,
+		TLS:              &TLSOptions{MaxVersion: tls.VersionTLS12},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := conn.Send(context.Background(), http2TestPayload())
+	if err != nil || !result.Accepted() {
+		t.Fatal(fmt.Sprintf("Expected the payload to be accepted but got %v", err))
+	}
+	if version != tls.VersionTLS12 {
+		t.Error(fmt.Sprintf("Expected TLS 1.2 but got %#x", version))
+	}
+}
+
+func TestTLSOptionsValidation(t *testing.T) {
+	pin := SPKIFingerprint(newPinningTestChain(t).root)
+	options := map[string]*TLSOptions{
+		"min above max":         {MinVersion: tls.VersionTLS13, MaxVersion: tls.VersionTLS12},
+		"unknown version":       {MinVersion: 0x0200},
+		"suites with tls 1.3":   {MinVersion: tls.VersionTLS13, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}},
+		"unknown suite":         {CipherSuites: []uint16{0xffff}},
+		"pinned and skipped":    {DangerousInsecureSkipVerify: true},
+		"pinned and base skips": {Base: &tls.Config{InsecureSkipVerify: true}},
+	}
+	certPEM, keyPEM := generateTestClientCert(t, "com.example.app")
+	for name, option := range options {
+		config := &APNSConfig{CertificateBytes: certPEM, KeyBytes: keyPEM, TLS: option, PinnedPublicKeys: []string{pin}}
+		if _, err := NewAPNSConnection(config); err == nil {
+			t.Error(fmt.Sprintf("Expected an error for %v", name))
+		}
+	}
+
+	skipped := &TLSOptions{DangerousInsecureSkipVerify: true}
+	if _, err := NewHTTP2Connection(&HTTP2Config{CertificateBytes: certPEM, KeyBytes: keyPEM, TLS: skipped, PinnedPublicKeys: []string{pin}}); err == nil {
+		t.Error("Expected an error for pinning and skipping verification over HTTP/2")
+	}
+	if _, err := ConnectToFeedbackService(&APNSFeedbackServiceConfig{CertificateBytes: certPEM, KeyBytes: keyPEM, TLS: skipped, PinnedPublicKeys: []string{pin}}); err == nil {
+		t.Error("Expected an error for pinning and skipping verification for feedback")
+	}
+}
@@ -0,0 +1,68 @@
+package apns
+
+import (
+	"crypto/tls"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of TLS sessions a config keeps for resuming handshakes by default
+const defaultTLSSessionCacheSize = 64
+
+// Counts of the TLS handshakes made by the connections sharing an APNSConfig
+type TLSHandshakeStats struct {
+	// Handshakes that did the full key exchange
+	Full uint64
+	// Handshakes that resumed a cached session
+	Resumed uint64
+}
+
+// TLS sessions shared by the connections made with one APNSConfig, so
+// reconnects and pool members resume each other's sessions
+// Kept per config rather than per gateway, a session must only be
+// resumed with the certificate it was made with
+type tlsSessions struct {
+	//nil when resumption is disabled
+	cache   tls.ClientSessionCache
+	full    uint64
+	resumed uint64
+}
+
+// Guards creating each config's tlsSessions
+var tlsSessionsLock sync.Mutex
+
+// The config's shared sessions, created on first use
+func (config *APNSConfig) sessions() *tlsSessions {
+	tlsSessionsLock.Lock()
+	defer tlsSessionsLock.Unlock()
+	if config.tlsSessions == nil {
+		config.tlsSessions = &tlsSessions{}
+		size := config.TLSSessionCacheSize
+		if size == 0 {
+			size = defaultTLSSessionCacheSize
+		}
+		if size > 0 {
+			config.tlsSessions.cache = tls.NewLRUClientSessionCache(size)
+		}
+	}
+	return config.tlsSessions
+}
+
+// Count a completed handshake
+func (s *tlsSessions) record(state tls.ConnectionState) {
+	if state.DidResume {
+		atomic.AddUint64(&s.resumed, 1)
+	} else {
+		atomic.AddUint64(&s.full, 1)
+	}
+}
+
+// Counts of the full and resumed handshakes of every connection made with
+// the config, including a pool's or reconnecting connection's
+func (config *APNSConfig) TLSHandshakeStats() TLSHandshakeStats {
+	s := config.sessions()
+	return TLSHandshakeStats{
+		Full:    atomic.LoadUint64(&s.full),
+		Resumed: atomic.LoadUint64(&s.resumed),
+	}
+}
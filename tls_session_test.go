@@ -0,0 +1,108 @@
+package apns
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Connect with config and wait for the gateway to close the connection,
+// by when the session ticket has been read
+func connectForSession(t *testing.T, config *APNSConfig) ConnectTiming {
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-conn.CloseChannel
+	return conn.ConnectTiming()
+}
+
+func tlsSessionTestConfig(t *testing.T) (*APNSConfig, func()) {
+	chain := newPinningTestChain(t)
+	listener, host, port := chain.listen(t)
+	certPEM, keyPEM := generateTestClientCert(t, "com.example.app")
+	return &APNSConfig{
+		CertificateBytes: certPEM,
+		KeyBytes:         keyPEM,
+		GatewayHost:      host,
+		GatewayPort:      port,
+		RootCAs:          chain.roots,
+	}, func() { listener.Close() }
+}
+
+func TestTLSSessionShouldResumeAcrossConnections(t *testing.T) {
+	config, closeListener := tlsSessionTestConfig(t)
+	defer closeListener()
+
+	if connectForSession(t, config).Resumed {
+		t.Error("Expected the first handshake to be a full one")
+	}
+	for i := 0; i < 2; i++ {
+		if !connectForSession(t, config).Resumed {
+			t.Error(fmt.Sprintf("Expected reconnect %v to resume the session", i))
+		}
+	}
+	if stats := config.TLSHandshakeStats(); stats != (TLSHandshakeStats{Full: 1, Resumed: 2}) {
+		t.Error(fmt.Sprintf("Expected 1 full and 2 resumed handshakes but got %+v", stats))
+	}
+
+	//sessions aren't shared with another config, which may have another certificate
+	other := *config
+	other.tlsSessions = nil
+	if connectForSession(t, &other).Resumed {
+		t.Error("Expected another config not to resume the session")
+	}
+}
+
+func TestTLSSessionShouldNotResumeWhenDisabled(t *testing.T) {
+	config, closeListener := tlsSessionTestConfig(t)
+	defer closeListener()
+	config.TLSSessionCacheSize = -1
+
+	connectForSession(t, config)
+	if connectForSession(t, config).Resumed {
+		t.Error("Expected no resumption with the cache disabled")
+	}
+	if stats := config.TLSHandshakeStats(); stats != (TLSHandshakeStats{Full: 2}) {
+		t.Error(fmt.Sprintf("Expected 2 full handshakes but got %+v", stats))
+	}
+}
+
+// Session cache counting what it's asked to keep
+type countingSessionCache struct {
+	tls.ClientSessionCache
+	lock *sync.Mutex
+	puts int
+}
+
+func (c *countingSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.lock.Lock()
+	c.puts++
+	c.lock.Unlock()
+	c.ClientSessionCache.Put(sessionKey, cs)
+}
+
+func TestTLSSessionShouldUseBaseConfigCache(t *testing.T) {
+	config, closeListener := tlsSessionTestConfig(t)
+	defer closeListener()
+	cache := &countingSessionCache{ClientSessionCache: tls.NewLRUClientSessionCache(1), lock: new(sync.Mutex)}
+	config.TLS = &TLSOptions{Base: &tls.Config{ClientSessionCache: cache}}
+
+	connectForSession(t, config)
+	if !connectForSession(t, config).Resumed {
+		t.Error("Expected the base config's cache to resume the session")
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.puts == 0 {
+		t.Error("Expected sessions to be kept in the base config's cache")
+	}
+}
+
+func TestTLSSessionConfigValidation(t *testing.T) {
+	certPEM, keyPEM := generateTestClientCert(t, "com.example.app")
+	if _, err := NewAPNSConnection(&APNSConfig{CertificateBytes: certPEM, KeyBytes: keyPEM, TLSSessionCacheSize: -2}); err == nil {
+		t.Error("Expected an error for a TLSSessionCacheSize below -1")
+	}
+}
@@ -0,0 +1,38 @@
+package apns
+
+// A payload's token as the 32 bytes framed for the binary protocol
+// Kept on the payload once decoded, for the Token it was decoded from, so
+// validating, framing and every resend share one decode
+type decodedToken struct {
+	hex   string
+	bytes []byte
+	err   error
+}
+
+// The payload's Token decoded for a frame, decoding it on first use
+// The bytes are shared, they mustn't be modified
+// Safe to call from many goroutines, e.g. the same payload sent over
+// several connections. Changing Token decodes it again
+func (p *Payload) binaryToken() ([]byte, error) {
+	if cached, ok := p.decodedToken.Load().(*decodedToken); ok && cached.hex == p.Token {
+		return cached.bytes, cached.err
+	}
+	token := p.Token
+	bytes, err := decodeBinaryToken(token)
+	p.decodedToken.Store(&decodedToken{hex: token, bytes: bytes, err: err})
+	return bytes, err
+}
+
+// Whether token is non-empty hex, checked without decoding it
+func isHexToken(token string) bool {
+	if token == "" || len(token)%2 != 0 {
+		return false
+	}
+	for i := 0; i < len(token); i++ {
+		c := token[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestBinaryTokenShouldDecodeOnce(t *testing.T) {
+	payload := groupTestPayload(1)
+	first, err := payload.binaryToken()
+	if err != nil || len(first) != 32 || first[31] != 1 {
+		t.Fatal(fmt.Sprintf("Expected the 32 byte token but got %x, %v", first, err))
+	}
+	if again, _ := payload.binaryToken(); &again[0] != &first[0] {
+		t.Error("Expected the decoded token to be reused")
+	}
+	//a copy sharing the cache with another token decodes its own
+	copied := *payload
+	copied.Token = groupTestPayload(2).Token
+	if token, _ := copied.binaryToken(); token[31] != 2 {
+		t.Error(fmt.Sprintf("Expected the copy's own token but got %x", token))
+	}
+	payload.Token = "not hex"
+	if _, err := payload.binaryToken(); err == nil {
+		t.Error("Expected a changed token to be decoded again")
+	}
+
+	//the same payload framed by many connections at once
+	shared := groupTestPayload(3)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := shared.binaryToken(); err != nil || token[31] != 3 {
+				t.Error(fmt.Sprintf("Expected the token but got %x, %v", token, err))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestEnqueueShouldRefuseInvalidToken(t *testing.T) {
+	_, app, _ := newManagerTestApps(t)
+	recorder := newDeadLetterRecorder()
+	app.Pool.ConnectionConfig.DeadLetterHandler = recorder.handler
+	conn, err := NewAPNSConnection(app.Pool.ConnectionConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeQueueTestConnection(conn)
+
+	payload := &Payload{AlertText: "Testing", Token: "abcd"}
+	err = conn.Enqueue(payload)
+	sendError := &SendError{}
+	if !errors.As(err, &sendError) || sendError.Kind != FailureInvalidPayload {
+		t.Error(fmt.Sprintf("Expected an invalid payload but got %v", err))
+	}
+	if letter := recorder.expect(t, 1)[payload]; letter.payload != payload {
+		t.Error(fmt.Sprintf("Expected the payload to be dead lettered but got %+v", letter))
+	}
+}
+
+// Tokens of the payloads resent after a drop, or framed by a broadcast,
+// decoded once
+func BenchmarkResendTokens1000(b *testing.B) {
+	payloads := make([]*Payload, 1000)
+	for i, token := range broadcastTestTokens(len(payloads)) {
+		payloads[i] = &Payload{Token: token}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, payload := range payloads {
+			payload.binaryToken()
+		}
+	}
+}
+
+// The same tokens decoded every time, as they were before being cached
+func BenchmarkResendTokensDecoded1000(b *testing.B) {
+	tokens := broadcastTestTokens(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, token := range tokens {
+			decodeBinaryToken(token)
+		}
+	}
+}
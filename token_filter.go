@@ -0,0 +1,74 @@
+package apns
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Matched by errors.Is for a payload refused by a TokenFilter, see
+// TokenFilteredError
+var ErrTokenFiltered = errors.New("Token filtered")
+
+// A payload's token refused by the config's TokenFilter, the Err of a
+// SendError of FailureFiltered
+type TokenFilteredError struct {
+	// The token refused
+	Token string
+	// What TokenFilter returned, or the panic it raised
+	Err error
+}
+
+func (e *TokenFilteredError) Error() string {
+	return fmt.Sprintf("Token %v filtered: %v", redactToken(e.Token), e.Err)
+}
+
+func (e *TokenFilteredError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TokenFilteredError) Is(target error) bool {
+	return target == ErrTokenFiltered
+}
+
+// Run filter on a token the connection is taking
+// Returns a *TokenFilteredError if the token is refused, nil without a
+// filter
+func filterToken(filter func(token string) error, token string) error {
+	if filter == nil {
+		return nil
+	}
+	if err := runTokenFilter(filter, token); err != nil {
+		return &TokenFilteredError{Token: token, Err: err}
+	}
+	return nil
+}
+
+func runTokenFilter(filter func(token string) error, token string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("TokenFilter panicked: %v", r))
+		}
+	}()
+	return filter(token)
+}
+
+// Whether the payload is being resent by an APNSReconnectingConnection,
+// so was allowed by the connection that handed it back and isn't
+// filtered again
+func (c *APNSConnection) replaying(payload *Payload) bool {
+	return c.replays != nil && c.replays(payload) > 0
+}
+
+// Refuse a payload its TokenFilter filtered before it's taken, reporting
+// it as any other failure and dead lettering it
+func (c *APNSConnection) tokenFiltered(payload *Payload, err error) *SendError {
+	sendError := c.sendFailed(payload, FailureFiltered, err)
+	c.deadLetter(payload, sendError)
+	return sendError
+}
+
+// Whether the payload wasn't sent because the TokenFilter refused its
+// token, so shouldn't be counted as a failure
+func (r *Result) Filtered() bool {
+	return errors.Is(r.Err, ErrTokenFiltered)
+}
@@ -0,0 +1,264 @@
+package apns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TokenFilter refusing the denied tokens and counting the calls for each
+type tokenFilterRecorder struct {
+	lock   *sync.Mutex
+	denied map[string]bool
+	calls  map[string]int
+}
+
+func newTokenFilterRecorder(denied ...string) *tokenFilterRecorder {
+	r := &tokenFilterRecorder{lock: new(sync.Mutex), denied: make(map[string]bool), calls: make(map[string]int)}
+	for _, token := range denied {
+		r.denied[token] = true
+	}
+	return r
+}
+
+func (r *tokenFilterRecorder) filter(token string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.calls[token]++
+	if r.denied[token] {
+		return errors.New("device opted out")
+	}
+	return nil
+}
+
+// Fail if any token was filtered more than once
+func (r *tokenFilterRecorder) expectOnce(t *testing.T) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for token, calls := range r.calls {
+		if calls != 1 {
+			t.Error(fmt.Sprintf("Expected %v to be filtered once but it was filtered %v times", token, calls))
+		}
+	}
+}
+
+func TestFilterTokenShouldRefuseDeniedTokens(t *testing.T) {
+	recorder := newTokenFilterRecorder(groupTestPayload(1).Token)
+	if err := filterToken(recorder.filter, groupTestPayload(0).Token); err != nil {
+		t.Error(fmt.Sprintf("Expected the token to be allowed but got %v", err))
+	}
+	denied := groupTestPayload(1).Token
+	err := filterToken(recorder.filter, denied)
+	filtered := &TokenFilteredError{}
+	if !errors.As(err, &filtered) || filtered.Token != denied || !errors.Is(err, ErrTokenFiltered) {
+		t.Error(fmt.Sprintf("Expected the token to be filtered but got %v", err))
+	}
+	recorder.expectOnce(t)
+
+	panicking := func(token string) error {
+		panic("suppression list unavailable")
+	}
+	if err := filterToken(panicking, groupTestPayload(3).Token); !errors.Is(err, ErrTokenFiltered) ||
+		!strings.Contains(err.Error(), "suppression list unavailable") {
+		t.Error(fmt.Sprintf("Expected a panicking filter to refuse the token but got %v", err))
+	}
+	if err := filterToken(nil, denied); err != nil {
+		t.Error(fmt.Sprintf("Expected no filter to allow every token but got %v", err))
+	}
+}
+
+func TestTokenFilterShouldBeAskedByEachConnection(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	payload := groupTestPayload(0)
+	denying := newTokenFilterRecorder(payload.Token)
+	allowing := newTokenFilterRecorder()
+
+	denyingConfig := *app.Pool.ConnectionConfig
+	denyingConfig.TokenFilter = denying.filter
+	allowingConfig := *app.Pool.ConnectionConfig
+	allowingConfig.TokenFilter = allowing.filter
+	denyingConn, err := NewAPNSConnection(&denyingConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeQueueTestConnection(denyingConn)
+	allowingConn, err := NewAPNSConnection(&allowingConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeQueueTestConnection(allowingConn)
+
+	//the same payload, each connection going by its own filter
+	if err := denyingConn.Enqueue(payload); !errors.Is(err, ErrTokenFiltered) {
+		t.Error(fmt.Sprintf("Expected the payload to be filtered but got %v", err))
+	}
+	if err := allowingConn.Enqueue(payload); err != nil {
+		t.Error(fmt.Sprintf("Expected the payload to be allowed but got %v", err))
+	}
+	if _, err := server.WaitForNotifications(1, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	//and asked again once the suppression list changes
+	denying.lock.Lock()
+	delete(denying.denied, payload.Token)
+	denying.lock.Unlock()
+	if err := denyingConn.Enqueue(payload); err != nil {
+		t.Error(fmt.Sprintf("Expected the payload to be allowed once the token is no longer denied but got %v", err))
+	}
+	if _, err := server.WaitForNotifications(2, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if denying.calls[payload.Token] != 2 || allowing.calls[payload.Token] != 1 {
+		t.Error(fmt.Sprintf("Expected each connection to filter the payload itself but got %v and %v",
+			denying.calls, allowing.calls))
+	}
+}
+
+func TestTokenFilterShouldNotRunAgainOnReplays(t *testing.T) {
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	filter := newTokenFilterRecorder()
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig: &APNSConfig{InFlightPayloadBufferSize: 100, FramingTimeout: 1, MaxPayloadSize: 2048,
+			TokenFilter: filter.filter},
+		ReconnectBaseDelay: 1,
+		dial:               dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, rejected := 8, 3
+	for i := 0; i < count; i++ {
+		conn.SendChannel <- groupTestPayload(i)
+	}
+	waitForPoolSends(t, dialer, []int{count})
+	dialer.socket(0).reject(8, uint32(rejected))
+	<-conn.CloseChannel
+	waitForPoolSends(t, dialer, []int{count, count - rejected - 1})
+	filter.expectOnce(t)
+
+	conn.Close()
+	for range conn.CloseChannel {
+	}
+}
+
+func TestConnectionShouldRefuseFilteredTokens(t *testing.T) {
+	server, app, _ := newManagerTestApps(t)
+	filter := newTokenFilterRecorder(groupTestPayload(1).Token, groupTestPayload(2).Token)
+	deadLetters := newDeadLetterRecorder()
+	stats := NewMemoryStatsCollector()
+	config := app.Pool.ConnectionConfig
+	config.TokenFilter = filter.filter
+	config.DeadLetterHandler = deadLetters.handler
+	config.StatsCollector = stats
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeQueueTestConnection(conn)
+
+	enqueued := groupTestPayload(1)
+	err = conn.Enqueue(enqueued)
+	sendError := &SendError{}
+	if !errors.As(err, &sendError) || sendError.Kind != FailureFiltered || !errors.Is(err, ErrTokenFiltered) {
+		t.Error(fmt.Sprintf("Expected the payload to be filtered but got %v", err))
+	}
+	sent := groupTestPayload(2)
+	conn.SendChannel <- sent
+	conn.Enqueue(groupTestPayload(0))
+	conn.SendChannel <- groupTestPayload(3)
+
+	if _, err := server.WaitForNotifications(2, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	letters := deadLetters.expect(t, 2)
+	if !errors.Is(letters[enqueued].lastReason, ErrTokenFiltered) || !errors.Is(letters[sent].lastReason, ErrTokenFiltered) {
+		t.Error(fmt.Sprintf("Expected the filtered payloads to be dead lettered but got %+v", letters))
+	}
+	snapshot := stats.Snapshot()
+	if snapshot.Filtered != 2 || snapshot.Failed != 0 || len(snapshot.FailedByReason) != 0 {
+		t.Error(fmt.Sprintf("Expected 2 filtered and none failed but got %+v", snapshot))
+	}
+	filter.expectOnce(t)
+}
+
+func TestSendGroupShouldRefuseFilteredMember(t *testing.T) {
+	_, app, _ := newManagerTestApps(t)
+	filter := newTokenFilterRecorder(groupTestPayload(1).Token)
+	deadLetters := newDeadLetterRecorder()
+	config := app.Pool.ConnectionConfig
+	config.TokenFilter = filter.filter
+	config.DeadLetterHandler = deadLetters.handler
+	conn, err := NewAPNSConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeQueueTestConnection(conn)
+
+	group := conn.NewSendGroup()
+	for i := 0; i < 3; i++ {
+		group.Add(groupTestPayload(i))
+	}
+	if err := group.Commit(); !errors.Is(err, ErrTokenFiltered) {
+		t.Error(fmt.Sprintf("Expected the group to be refused but got %v", err))
+	}
+	expectGroupStatus(t, group, []GroupMemberStatus{GroupMemberCancelled, GroupMemberFiltered, GroupMemberCancelled})
+	deadLetters.expect(t, 1)
+}
+
+func TestBroadcastShouldReportFilteredTokens(t *testing.T) {
+	conn, _ := sendTestConnection(0)
+	tokens := broadcastTestTokens(3)
+	filter := newTokenFilterRecorder(tokens[1])
+	conn.config.TokenFilter = filter.filter
+
+	results, err := conn.Broadcast(context.Background(), &Payload{AlertText: "Testing broadcast"}, tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collected := collectBroadcast(results)
+	if len(collected) != 3 || !collected[0].Accepted() || !collected[1].Filtered() || !collected[2].Accepted() {
+		t.Error(fmt.Sprintf("Expected the second token to be filtered and the rest accepted but got %+v", collected))
+	}
+	filter.expectOnce(t)
+
+	conn.Disconnect()
+	<-conn.CloseChannel
+}
+
+func TestSendStreamShouldReportFilteredTokens(t *testing.T) {
+	server, _, app := newManagerTestApps(t)
+	filter := newTokenFilterRecorder(fmt.Sprintf("%064x", 2), fmt.Sprintf("%064x", 5))
+	stats := NewMemoryStatsCollector()
+	app.HTTP2.TokenFilter = filter.filter
+	app.HTTP2.StatsCollector = stats
+	conn, err := NewHTTP2Connection(app.HTTP2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	lines := []string{}
+	for i := 0; i < 10; i++ {
+		lines = append(lines, streamTestLine(i))
+	}
+	summary, err := SendStream(context.Background(), conn, strings.NewReader(strings.Join(lines, "\n")), StreamOptions{Concurrency: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Sent != 8 || !reflect.DeepEqual(summary.Filtered, []int{2, 5}) || len(summary.Failed) != 0 || len(summary.Unsent) != 0 {
+		t.Error(fmt.Sprintf("Expected lines 2 and 5 to be filtered and the rest sent but got %+v", summary))
+	}
+	if received := server.Received(); len(received) != 8 {
+		t.Error(fmt.Sprintf("Expected 8 notifications but got %v", len(received)))
+	}
+	if snapshot := stats.Snapshot(); snapshot.Filtered != 2 || snapshot.Failed != 0 {
+		t.Error(fmt.Sprintf("Expected 2 filtered and none failed but got %+v", snapshot))
+	}
+	filter.expectOnce(t)
+}
@@ -0,0 +1,50 @@
+package apns
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Topic suffixes apple expects for push types that go to an app
+// extension rather than the app itself, e.g. com.example.app.voip
+var topicSuffixes = map[PushType]string{
+	PushTypeVoIP:         ".voip",
+	PushTypeComplication: ".complication",
+	PushTypeLiveActivity: ".push-type.liveactivity",
+	PushTypeLocation:     ".location-query",
+	PushTypeFileProvider: ".pushkit.fileprovider",
+}
+
+// OID of the UID attribute apple puts the bundle id in
+var oidUserID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+// Check the topic has the suffix apple expects for the push type
+func validateTopic(topic string, pushType PushType) error {
+	suffix, ok := topicSuffixes[pushType]
+	if ok && !strings.HasSuffix(topic, suffix) {
+		return errors.New(fmt.Sprintf("Topic %q for a %v push should end in %q", topic, pushType, suffix))
+	}
+	return nil
+}
+
+// The bundle id of a push certificate, stored as the subject's UID,
+// or "" if it doesn't have one
+func topicFromCertificate(cert *x509.Certificate) string {
+	for _, name := range cert.Subject.Names {
+		if name.Type.Equal(oidUserID) {
+			if topic, ok := name.Value.(string); ok {
+				return topic
+			}
+		}
+	}
+	return ""
+}
+
+// The app's bundle id for a topic, without the push type's suffix
+// e.g. com.example.app for com.example.app.push-type.liveactivity
+func bundleIdForTopic(topic string, pushType PushType) string {
+	return strings.TrimSuffix(topic, topicSuffixes[pushType])
+}
@@ -0,0 +1,69 @@
+package apns
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValidateTopic(t *testing.T) {
+	valid := map[string]PushType{
+		"com.example.app":                        PushTypeAlert,
+		"com.example.app.voip":                   PushTypeVoIP,
+		"com.example.app.complication":           PushTypeComplication,
+		"com.example.app.push-type.liveactivity": PushTypeLiveActivity,
+		"com.example.app.location-query":         PushTypeLocation,
+		"com.example.app.pushkit.fileprovider":   PushTypeFileProvider,
+	}
+	for topic, pushType := range valid {
+		if err := validateTopic(topic, pushType); err != nil {
+			t.Error(fmt.Sprintf("Expected %v to be valid for %v but got %v", topic, pushType, err))
+		}
+	}
+
+	invalid := map[PushType]string{
+		PushTypeVoIP:         ".voip",
+		PushTypeComplication: ".complication",
+		PushTypeLiveActivity: ".push-type.liveactivity",
+		PushTypeLocation:     ".location-query",
+		PushTypeFileProvider: ".pushkit.fileprovider",
+	}
+	for pushType, suffix := range invalid {
+		err := validateTopic("com.example.app", pushType)
+		if err == nil || !strings.Contains(err.Error(), suffix) {
+			t.Error(fmt.Sprintf("Expected %v push without %v to be invalid but got %v", pushType, suffix, err))
+		}
+	}
+}
+
+func TestValidateShouldCheckTopicSuffix(t *testing.T) {
+	p := NewVoIPPayload(validateTestToken, map[string]interface{}{"caller": "Testing"})
+	if err := p.Validate(); err != nil {
+		t.Error(fmt.Sprintf("Expected no topic to be left to the connection but got %v", err))
+	}
+	p.Topic = "com.example.app"
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), `should end in ".voip"`) {
+		t.Error(fmt.Sprintf("Expected a voip push to need the .voip suffix but got %v", err))
+	}
+	p.Topic = "com.example.app.voip"
+	if err := p.Validate(); err != nil {
+		t.Error(fmt.Sprintf("Expected a .voip topic to be valid but got %v", err))
+	}
+}
+
+func TestTopicFromCertificate(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{
+		CommonName: "Apple Push Services: com.example.app",
+		Names:      []pkix.AttributeTypeAndValue{{Type: oidUserID, Value: "com.example.app"}},
+	}}
+	if topic := topicFromCertificate(cert); topic != "com.example.app" {
+		t.Error(fmt.Sprintf("Expected the bundle id but got %q", topic))
+	}
+
+	cert.Subject.Names = nil
+	if topic := topicFromCertificate(cert); topic != "" {
+		t.Error(fmt.Sprintf("Expected no topic without a UID but got %q", topic))
+	}
+}
@@ -0,0 +1,178 @@
+package apns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Receives a span for each notification sent, set with APNSConfig.Tracer
+// or HTTP2Config.Tracer, e.g. to adapt to OpenTelemetry without this
+// package depending on it
+// StartSend is called as a connection takes a payload, with the caller's
+// ctx for Send (context.Background() for SendChannel, Enqueue and send
+// groups), and returns the ctx for the send, which HTTP2Connection passes
+// on to its request so the adapter can make child spans, and a func the
+// connection calls exactly once with how the send went
+// A span covers one attempt: each resend, e.g. by an
+// APNSReconnectingConnection, starts a span of its own
+// Called on the connection's goroutines, so it must be safe for concurrent
+// use and return quickly, as for StatsCollector
+type Tracer interface {
+	StartSend(ctx context.Context, payload *Payload) (context.Context, func(result TraceResult))
+}
+
+// How a traced send went, passed to the func returned by Tracer.StartSend
+// The times of the phases not reached are zero
+// Over HTTP/2 the span ends with apple's response. The binary protocol
+// only reports rejections, so a span for Send ends with its verdict (see
+// APNSConnection.Send) but one for SendChannel, Enqueue or a send group
+// ends once the payload is written, or when the connection closes if it
+// never was
+type TraceResult struct {
+	// The payload's ApnsId, or the one generated for it over HTTP/2
+	ApnsId string
+	// The device token, redacted as in Payload.String
+	Token string
+	// When the connection took the payload
+	Start time.Time
+	// When the payload was marshaled (framed, for the binary protocol)
+	Marshaled time.Time
+	// When the payload was written, or its latest request made over HTTP/2
+	Written time.Time
+	// When the span ended
+	End time.Time
+	// Apple's response over HTTP/2, or Send's verdict, nil otherwise
+	Result *Result
+	// Why the send failed: the payload was invalid, the connection closed
+	// before it was written, ctx was done or the request failed
+	Err error
+}
+
+// Attributes for the span of a payload's send: apns.token (redacted),
+// apns.push_type, and apns.id, apns.topic, apns.collapse_id and
+// apns.channel_id when set
+func TraceAttributes(payload *Payload) map[string]string {
+	attributes := map[string]string{
+		"apns.push_type": string(payload.ResolvedPushType()),
+	}
+	if payload.Token != "" {
+		attributes["apns.token"] = redactToken(payload.Token)
+	}
+	if payload.ApnsId != "" {
+		attributes["apns.id"] = payload.ApnsId
+	}
+	if payload.Topic != "" {
+		attributes["apns.topic"] = payload.Topic
+	}
+	if payload.CollapseId != "" {
+		attributes["apns.collapse_id"] = payload.CollapseId
+	}
+	if payload.ChannelId != "" {
+		attributes["apns.channel_id"] = payload.ChannelId
+	}
+	return attributes
+}
+
+// A span started with a Tracer, nil when there's no Tracer
+// The phases are set on the connection's goroutines while finish may be
+// called from the one waiting on Send, so it's locked
+type sendTrace struct {
+	lock   *sync.Mutex
+	clock  clock
+	end    func(result TraceResult)
+	result TraceResult
+	ended  bool
+}
+
+// Start a span for the payload if there's a tracer, returning the ctx
+// for the send
+func startTrace(tracer Tracer, c clock, ctx context.Context, payload *Payload) (context.Context, *sendTrace) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	ctx, end := tracer.StartSend(ctx, payload)
+	result := TraceResult{
+		ApnsId: payload.ApnsId,
+		Start:  c.Now(),
+	}
+	if payload.Token != "" {
+		result.Token = redactToken(payload.Token)
+	}
+	return ctx, &sendTrace{
+		lock:   new(sync.Mutex),
+		clock:  c,
+		end:    end,
+		result: result,
+	}
+}
+
+func (t *sendTrace) identify(apnsId string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.result.ApnsId = apnsId
+}
+
+func (t *sendTrace) marshaled() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.result.Marshaled = t.clock.Now()
+}
+
+func (t *sendTrace) written(at time.Time) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.result.Written = at
+}
+
+// End the span, only the first call counts
+func (t *sendTrace) finish(result *Result, err error) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	if t.ended {
+		t.lock.Unlock()
+		return
+	}
+	t.ended = true
+	t.result.End = t.clock.Now()
+	t.result.Result = result
+	t.result.Err = err
+	traceResult := t.result
+	t.lock.Unlock()
+	t.end(traceResult)
+}
+
+// End the spans of payloads the closing connection never wrote, other
+// than those passed to Send, whose spans end with its verdict
+// Called on the send go-routine once the connection has closed
+func (c *APNSConnection) endUnwrittenTraces(appleError *AppleError) {
+	if c.config.Tracer == nil {
+		return
+	}
+	err := errors.New(fmt.Sprintf("Payload was not sent before the connection closed: %v", appleError))
+	end := func(idPayloadObj *idPayload) {
+		if idPayloadObj.waiter == nil {
+			idPayloadObj.trace.finish(nil, err)
+		}
+	}
+	for e := c.inFlightPayloadBuffer.Front(); e != nil; e = e.Next() {
+		end(e.Value.(*idPayload))
+	}
+	//those pushed out of a full in flight buffer before being written
+	for _, idPayloadObj := range c.framedPayloads {
+		end(idPayloadObj)
+	}
+}
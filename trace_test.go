@@ -0,0 +1,224 @@
+package apns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Tracer keeping every span, and how many times each was ended
+type recordingTracer struct {
+	lock    *sync.Mutex
+	started []*Payload
+	ends    []int
+	results []TraceResult
+	//payloads whose send gets a cancelled ctx, to see the ctx is used
+	cancel *Payload
+}
+
+func newRecordingTracer() *recordingTracer {
+	return &recordingTracer{lock: new(sync.Mutex)}
+}
+
+func (r *recordingTracer) StartSend(ctx context.Context, payload *Payload) (context.Context, func(result TraceResult)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	span := len(r.started)
+	r.started = append(r.started, payload)
+	r.ends = append(r.ends, 0)
+	r.results = append(r.results, TraceResult{})
+	if payload == r.cancel {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		ctx = cancelled
+	}
+	return ctx, func(result TraceResult) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.ends[span]++
+		r.results[span] = result
+	}
+}
+
+// Wait for count spans to have started and ended, failing if any was
+// ended more than once, and return their results in the order started
+func (r *recordingTracer) waitForSpans(t *testing.T, count int) ([]*Payload, []TraceResult) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r.lock.Lock()
+		ended := 0
+		for _, ends := range r.ends {
+			if ends > 1 {
+				r.lock.Unlock()
+				t.Fatal(fmt.Sprintf("Expected each span to end once but got %v", r.ends))
+			}
+			ended += ends
+		}
+		if len(r.started) == count && ended == count {
+			defer r.lock.Unlock()
+			return r.started, r.results
+		}
+		started := len(r.started)
+		r.lock.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("Expected %v spans started and ended but %v started and %v ended", count, started, ended))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+const traceTestRejectedToken = "740f4707bebcf74f9b7c25d48e3358945f6aa01da5ddb387462c7eaf61bb41ab"
+
+func TestTracerShouldSpanHTTP2Sends(t *testing.T) {
+	server, config := newHTTP2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/3/device/"+traceTestRejectedToken {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+		}
+	})
+	defer server.Close()
+	tracer := newRecordingTracer()
+	config.Tracer = tracer
+	conn, err := NewHTTP2Connection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	accepted := http2TestPayload()
+	rejected := http2TestPayload()
+	rejected.Token = traceTestRejectedToken
+	invalid := http2TestPayload()
+	invalid.PushType = "notification"
+	cancelled := http2TestPayload()
+	tracer.cancel = cancelled
+	for _, payload := range []*Payload{accepted, rejected, invalid, cancelled} {
+		conn.Send(context.Background(), payload)
+	}
+
+	started, results := tracer.waitForSpans(t, 4)
+	if started[0] != accepted || started[1] != rejected || started[2] != invalid || started[3] != cancelled {
+		t.Fatal(fmt.Sprintf("Expected a span per send in order but got %v", started))
+	}
+	if result := results[0]; result.Result == nil || !result.Result.Accepted() || !isValidApnsId(result.ApnsId) ||
+		result.Token != redactToken(accepted.Token) || result.Marshaled.IsZero() || result.Written.IsZero() ||
+		result.End.Before(result.Written) || result.Err != nil {
+		t.Error(fmt.Sprintf("Expected the accepted send's phases but got %+v", result))
+	}
+	if result := results[1]; result.Result == nil || result.Result.Reason != ReasonBadDeviceToken || result.Err != nil {
+		t.Error(fmt.Sprintf("Expected the rejection but got %+v", result))
+	}
+	if result := results[2]; result.Err == nil || result.Result != nil || !result.Written.IsZero() {
+		t.Error(fmt.Sprintf("Expected the invalid payload to fail before being sent but got %+v", result))
+	}
+	if result := results[3]; !errors.Is(result.Err, context.Canceled) {
+		t.Error(fmt.Sprintf("Expected the send to use the tracer's ctx but got %+v", result))
+	}
+}
+
+func TestTracerShouldSpanBinarySendsAcrossReplays(t *testing.T) {
+	tracer := newRecordingTracer()
+	dialer := &poolTestDialer{lock: new(sync.Mutex)}
+	conn, err := NewAPNSReconnectingConnection(&APNSReconnectConfig{
+		ConnectionConfig:   &APNSConfig{InFlightPayloadBufferSize: 100, FramingTimeout: 1, MaxPayloadSize: 2048, Tracer: tracer},
+		ReconnectBaseDelay: 1,
+		dial:               dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloads := []*Payload{groupTestPayload(0), groupTestPayload(1), groupTestPayload(2)}
+	for _, payload := range payloads {
+		conn.SendChannel <- payload
+	}
+	waitForPoolSends(t, dialer, []int{3})
+	tracer.waitForSpans(t, 3)
+
+	//apple rejects the second, the third is resent on a new connection
+	dialer.socket(0).reject(8, 1)
+	<-conn.CloseChannel
+	waitForPoolSends(t, dialer, []int{3, 1})
+	invalid := groupTestPayload(3)
+	invalid.Priority = 7
+	conn.SendChannel <- invalid
+
+	started, results := tracer.waitForSpans(t, 5)
+	if started[3] != payloads[2] || started[4] != invalid {
+		t.Fatal(fmt.Sprintf("Expected spans for the replay and the invalid payload but got %v", started))
+	}
+	for i := 0; i < 4; i++ {
+		if result := results[i]; result.Err != nil || result.Written.IsZero() || result.Marshaled.IsZero() ||
+			result.Token != redactToken(started[i].Token) {
+			t.Error(fmt.Sprintf("Expected span %v to end once written but got %+v", i, result))
+		}
+	}
+	if result := results[4]; result.Err == nil || !result.Written.IsZero() {
+		t.Error(fmt.Sprintf("Expected the invalid payload's span to end with its error but got %+v", result))
+	}
+
+	conn.Close()
+	for range conn.CloseChannel {
+	}
+}
+
+func TestTracerShouldSpanBinarySendVerdicts(t *testing.T) {
+	tracer := newRecordingTracer()
+	socket := newPoolTestSocket()
+	config := shutdownTestConfig()
+	config.SendSettleWindow = 5000
+	config.Tracer = tracer
+	conn := socketAPNSConnection(socket, config)
+
+	//written first, so the rejection of the next shows apple read it
+	delivered := groupTestPayload(0)
+	go conn.Send(context.Background(), delivered)
+	waitForSocketSends(t, socket, 1)
+	rejected := groupTestPayload(1)
+	outcome := make(chan *Result, 1)
+	go func() {
+		result, _ := conn.Send(context.Background(), rejected)
+		outcome <- result
+	}()
+	waitForSocketSends(t, socket, 2)
+	socket.reject(8, 1)
+	<-outcome
+	<-conn.CloseChannel
+	if _, err := conn.Send(context.Background(), groupTestPayload(2)); err == nil {
+		t.Error("Expected a send on a closed connection to fail")
+	}
+
+	started, results := tracer.waitForSpans(t, 3)
+	if started[0] != delivered || started[1] != rejected {
+		t.Fatal(fmt.Sprintf("Expected a span per send in order but got %v", started))
+	}
+	if result := results[0]; result.Result == nil || !result.Result.Accepted() || result.Written.IsZero() {
+		t.Error(fmt.Sprintf("Expected the delivered send to end accepted but got %+v", result))
+	}
+	if result := results[1]; result.Result == nil || result.Result.Reason != BinaryReasonInvalidToken {
+		t.Error(fmt.Sprintf("Expected the rejected send to end with the rejection but got %+v", result))
+	}
+	if result := results[2]; result.Err == nil {
+		t.Error(fmt.Sprintf("Expected the send on a closed connection to end with its error but got %+v", result))
+	}
+}
+
+func TestTraceAttributesShouldRedactTheToken(t *testing.T) {
+	payload := http2TestPayload()
+	payload.ApnsId = "EC1BF194-B3B2-424A-89A9-5A918A6E6B5C"
+	payload.Topic = "com.example.app"
+	attributes := TraceAttributes(payload)
+	expected := map[string]string{
+		"apns.token":     "4ec5…3c8d",
+		"apns.id":        payload.ApnsId,
+		"apns.topic":     "com.example.app",
+		"apns.push_type": "alert",
+	}
+	if fmt.Sprint(attributes) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Expected %v but got %v", expected, attributes))
+	}
+}
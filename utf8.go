@@ -0,0 +1,232 @@
+package apns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Returned by Marshal, Size and Validate when a payload's text isn't valid
+// UTF-8, e.g. an alert cut off mid character upstream. Overlong encodings
+// and surrogates count as invalid. See InvalidUTF8Error for which field
+// and Payload.SanitizeUTF8 to replace the bad bytes instead
+var ErrInvalidUTF8 = errors.New("Invalid UTF-8")
+
+// The field holding invalid UTF-8, matched by errors.Is(err, ErrInvalidUTF8)
+type InvalidUTF8Error struct {
+	// The payload field, e.g. "AlertBody.LocArgs[1]", or the path of a
+	// custom field, e.g. "CustomFields.game.players[2]"
+	Field string
+}
+
+func (e *InvalidUTF8Error) Error() string {
+	return fmt.Sprintf("Invalid UTF-8 in %q, set SanitizeUTF8 to replace it", e.Field)
+}
+
+func (e *InvalidUTF8Error) Is(target error) bool {
+	return target == ErrInvalidUTF8
+}
+
+// Check every string marshaled into the aps object and custom fields is
+// valid UTF-8, returning an InvalidUTF8Error for the first that isn't
+// RawPayload and ApsOverride are sent as is so aren't checked
+func (p *Payload) validateUTF8() error {
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"AlertText", p.AlertText},
+		{"Sound", p.Sound},
+		{"Category", p.Category},
+		{"AlertBody.Body", p.AlertBody.Body},
+		{"AlertBody.ActionLocKey", p.AlertBody.ActionLocKey},
+		{"AlertBody.LocKey", p.AlertBody.LocKey},
+		{"AlertBody.LaunchImage", p.AlertBody.LaunchImage},
+		{"AlertBody.Title", p.AlertBody.Title},
+		{"AlertBody.TitleLocKey", p.AlertBody.TitleLocKey},
+	}
+	for _, field := range fields {
+		if !utf8.ValidString(field.value) {
+			return &InvalidUTF8Error{Field: field.name}
+		}
+	}
+	if path := invalidUTF8Strings("AlertBody.LocArgs", p.AlertBody.LocArgs); path != "" {
+		return &InvalidUTF8Error{Field: path}
+	}
+	if path := invalidUTF8Strings("AlertBody.TitleLocArgs", p.AlertBody.TitleLocArgs); path != "" {
+		return &InvalidUTF8Error{Field: path}
+	}
+	if path := invalidUTF8Path("CustomFields", "", p.CustomFields, 0); path != "" {
+		return &InvalidUTF8Error{Field: path}
+	}
+	return nil
+}
+
+// How deep custom fields are checked before tracking what's been visited
+const maxFastUTF8Depth = 32
+
+// Path of the first string in strs that isn't valid UTF-8, or ""
+func invalidUTF8Strings(path string, strs []string) string {
+	for i, s := range strs {
+		if !utf8.ValidString(s) {
+			return fmt.Sprintf("%v[%v]", path, i)
+		}
+	}
+	return ""
+}
+
+// Path of the first invalid UTF-8 under a custom field, checking the key
+// it is stored under too, or "" if it is all valid
+// The usual decoded json types are checked without reflection, until
+// nested deeper than maxFastUTF8Depth where a cycle is more likely than not
+func invalidUTF8Path(path string, key string, value interface{}, depth int) string {
+	if !utf8.ValidString(key) {
+		return path
+	}
+	if depth > maxFastUTF8Depth {
+		return (&utf8Walker{visiting: make(map[uintptr]bool)}).walk(path, reflect.ValueOf(value))
+	}
+	switch v := value.(type) {
+	case nil, bool, int, int64, float64, json.Number, json.RawMessage:
+		//raw json is embedded verbatim, like RawPayload
+		return ""
+	case string:
+		if !utf8.ValidString(v) {
+			return path
+		}
+		return ""
+	case []string:
+		return invalidUTF8Strings(path, v)
+	case []interface{}:
+		for i, elem := range v {
+			if p := invalidUTF8Path(fmt.Sprintf("%v[%v]", path, i), "", elem, depth+1); p != "" {
+				return p
+			}
+		}
+		return ""
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if p := invalidUTF8Path(path+"."+k, k, v[k], depth+1); p != "" {
+				return p
+			}
+		}
+		return ""
+	}
+	return (&utf8Walker{visiting: make(map[uintptr]bool)}).walk(path, reflect.ValueOf(value))
+}
+
+// Walks any other custom field value the way encoding/json would, see
+// customFieldWalker, looking for invalid UTF-8
+type utf8Walker struct {
+	//pointers, maps and slices on the current path, so a cycle ends the
+	//walk (marshaling reports it)
+	visiting map[uintptr]bool
+}
+
+func (w *utf8Walker) walk(path string, v reflect.Value) string {
+	if !v.IsValid() {
+		return ""
+	}
+	if v.Type().Implements(jsonMarshalerType) || v.Type().Implements(textMarshalerType) {
+		//encoded however the value likes
+		return ""
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		if !utf8.ValidString(v.String()) {
+			return path
+		}
+	case reflect.Interface:
+		return w.walk(path, v.Elem())
+	case reflect.Ptr:
+		if v.IsNil() {
+			return ""
+		}
+		return w.walkReference(v, func() string {
+			return w.walk(path, v.Elem())
+		})
+	case reflect.Map:
+		if v.IsNil() {
+			return ""
+		}
+		return w.walkReference(v, func() string {
+			keys := v.MapKeys()
+			names := make([]string, len(keys))
+			for i, key := range keys {
+				names[i] = fmt.Sprint(key)
+			}
+			sort.Sort(mapKeysByName{keys, names})
+			for i, key := range keys {
+				keyPath := path + "." + names[i]
+				if key.Kind() == reflect.String && !utf8.ValidString(key.String()) {
+					return keyPath
+				}
+				if p := w.walk(keyPath, v.MapIndex(key)); p != "" {
+					return p
+				}
+			}
+			return ""
+		})
+	case reflect.Slice:
+		if v.IsNil() || v.Type().Elem().Kind() == reflect.Uint8 {
+			//byte slices are encoded as base64
+			return ""
+		}
+		return w.walkReference(v, func() string {
+			return w.walkArray(path, v)
+		})
+	case reflect.Array:
+		return w.walkArray(path, v)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" && !field.Anonymous {
+				continue
+			}
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			fieldPath := path
+			if name := strings.Split(tag, ",")[0]; name != "" {
+				fieldPath = path + "." + name
+			} else if !field.Anonymous {
+				fieldPath = path + "." + field.Name
+			}
+			if p := w.walk(fieldPath, v.Field(i)); p != "" {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+func (w *utf8Walker) walkReference(v reflect.Value, walkFn func() string) string {
+	ptr := v.Pointer()
+	if w.visiting[ptr] {
+		return ""
+	}
+	w.visiting[ptr] = true
+	defer delete(w.visiting, ptr)
+	return walkFn()
+}
+
+func (w *utf8Walker) walkArray(path string, v reflect.Value) string {
+	for i := 0; i < v.Len(); i++ {
+		if p := w.walk(fmt.Sprintf("%v[%v]", path, i), v.Index(i)); p != "" {
+			return p
+		}
+	}
+	return ""
+}
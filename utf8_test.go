@@ -0,0 +1,91 @@
+package apns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var badUTF8Strings = map[string]string{
+	"overlong":       "slash \xc0\xaf and \xe0\x80\xaf",
+	"lone surrogate": "surrogate \xed\xa0\x80 alone",
+	"truncated":      "cut off 日本\xe8\xaa",
+}
+
+func expectInvalidUTF8(t *testing.T, err error, field string) {
+	invalid := &InvalidUTF8Error{}
+	if !errors.Is(err, ErrInvalidUTF8) || !errors.As(err, &invalid) || invalid.Field != field {
+		t.Error(fmt.Sprintf("Expected invalid UTF-8 in %v but got %v", field, err))
+	}
+}
+
+func TestMarshalShouldRejectInvalidUTF8(t *testing.T) {
+	for name, s := range badUTF8Strings {
+		payloads := map[string]*Payload{
+			"AlertText":                 {AlertText: s},
+			"Sound":                     {AlertText: "Testing", Sound: s},
+			"Category":                  {AlertText: "Testing", Category: s},
+			"AlertBody.Body":            {AlertBody: APSAlertBody{Body: s}},
+			"AlertBody.Title":           {AlertBody: APSAlertBody{Body: "Testing", Title: s}},
+			"AlertBody.LocArgs[1]":      {AlertBody: APSAlertBody{LocKey: "%@ %@", LocArgs: []string{"ok", s}}},
+			"AlertBody.TitleLocArgs[0]": {AlertBody: APSAlertBody{TitleLocKey: "t", TitleLocArgs: []string{s}}},
+			"CustomFields.game.players[2]": {CustomFields: map[string]interface{}{
+				"game": map[string]interface{}{"players": []interface{}{"a", 1, s}},
+			}},
+			"CustomFields.tags[0]": {CustomFields: map[string]interface{}{"tags": []string{s}}},
+			"CustomFields.struct.name": {CustomFields: map[string]interface{}{
+				"struct": &struct {
+					Name string `json:"name"`
+				}{s},
+			}},
+		}
+		for field, p := range payloads {
+			_, err := p.Marshal(4096)
+			expectInvalidUTF8(t, err, field)
+			_, err = p.Size()
+			expectInvalidUTF8(t, err, field)
+			if err := p.Validate(); !strings.Contains(fmt.Sprint(err), "Invalid UTF-8") {
+				t.Error(fmt.Sprintf("Expected %v %v to be invalid but got %v", name, field, err))
+			}
+		}
+	}
+
+	//raw json is sent as is
+	p := &Payload{CustomFields: map[string]interface{}{"raw": json.RawMessage("\"\xff\"")}}
+	if _, err := p.Marshal(4096); errors.Is(err, ErrInvalidUTF8) {
+		t.Error(fmt.Sprintf("Expected raw json not to be checked but got %v", err))
+	}
+}
+
+func TestMarshalShouldSanitizeInvalidUTF8(t *testing.T) {
+	for name, s := range badUTF8Strings {
+		payloads := []*Payload{
+			{AlertText: s, Sound: s, Category: s, CustomFields: map[string]interface{}{"s": s, "list": []string{s}}},
+			{AlertBody: APSAlertBody{Body: s, Title: s, LocKey: "%@", LocArgs: []string{s}}, Sound: s},
+		}
+		for _, p := range payloads {
+			p.SanitizeUTF8 = true
+			payloadJson, err := p.Marshal(4096)
+			if err != nil {
+				t.Fatal(err)
+			}
+			//both marshal paths replace each invalid byte the same way
+			if expected := referenceMarshal(t, p); string(payloadJson) != expected {
+				t.Error(fmt.Sprintf("Expected %v to be replaced as %v but got %v", name, expected, string(payloadJson)))
+			}
+			decoded := map[string]interface{}{}
+			if err := json.Unmarshal(payloadJson, &decoded); err != nil || !strings.Contains(string(payloadJson), "�") {
+				t.Error(fmt.Sprintf("Expected %v to be replaced with U+FFFD but got %s, %v", name, payloadJson, err))
+			}
+		}
+	}
+
+	//truncation never leaves a partial character
+	p := &Payload{AlertText: strings.Repeat("日本\xe8\xaa", 20), SanitizeUTF8: true}
+	payloadJson, err := p.Marshal(60)
+	if err != nil || len(payloadJson) > 60 || !json.Valid(payloadJson) {
+		t.Error(fmt.Sprintf("Expected the sanitized alert to be truncated but got %s, %v", payloadJson, err))
+	}
+}
@@ -0,0 +1,14 @@
+package apns
+
+// Create a PushKit VoIP payload carrying the custom fields
+// VoIP pushes can be up to MaxPayloadSizeVoIP bytes (see MarshalAuto) and
+// have no alert, the app reports the incoming call to CallKit itself
+// The topic needs the .voip suffix, e.g. com.example.app.voip, either as
+// Payload.Topic or the connection's default topic
+func NewVoIPPayload(token string, custom map[string]interface{}) *Payload {
+	return &Payload{
+		Token:        token,
+		PushType:     PushTypeVoIP,
+		CustomFields: custom,
+	}
+}
@@ -0,0 +1,43 @@
+package apns
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestVoIPPayloadShouldAllowLargerPayloads(t *testing.T) {
+	custom := map[string]interface{}{"caller": strings.Repeat("x", 5000)}
+	p := NewVoIPPayload(validateTestToken, custom)
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	payloadBytes, err := p.MarshalAuto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloadBytes) <= MaxPayloadSizeAlert || len(payloadBytes) > MaxPayloadSizeVoIP {
+		t.Error(fmt.Sprintf("Expected a payload between the alert and voip limits but got %v bytes", len(payloadBytes)))
+	}
+
+	p.PushType = PushTypeAlert
+	if _, err := p.MarshalAuto(); err == nil {
+		t.Error("Expected the payload to be too long for an alert push")
+	}
+}
+
+func TestValidateShouldRejectVoIPAlerts(t *testing.T) {
+	payloads := map[string]*Payload{
+		"alert": {AlertText: "Incoming call"},
+		"body":  {AlertBody: APSAlertBody{Title: "Incoming call"}},
+		"badge": {Badge: NewBadgeNumber(1)},
+		"sound": {Sound: "ring.caf"},
+	}
+	for name, p := range payloads {
+		p.Token = validateTestToken
+		p.PushType = PushTypeVoIP
+		if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "VoIP pushes can't have") {
+			t.Error(fmt.Sprintf("Expected a voip push with a %v to be invalid but got %v", name, err))
+		}
+	}
+}